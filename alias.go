@@ -0,0 +1,183 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// This file contains aliases: User-defined commands that expand to a
+// sequence of commands. The commands of an alias are separated by ";", the
+// placeholders $1, $2, ... are replaced by the arguments of the alias (see
+// Parameterized). Example:
+//
+//   alias quick "storage load $1; gch create; mosaic $2 $3 gch-euclid 40x40"
+//   quick ~/Pictures query.jpg mosaic.jpg
+//
+// Aliases can also be defined in the [alias] section of the config file (see
+// ParseConfig) and are saved in sessions.
+
+// MaxAliasDepth is the maximal depth of nested aliases (an alias using
+// another alias), it avoids endless recursion.
+const MaxAliasDepth = 16
+
+// aliasPlaceholder matches the placeholders of an alias.
+var aliasPlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+// splitAliasBody splits the body of an alias into commands, the commands are
+// separated by ";" (not inside quotes). Empty commands are ignored.
+func splitAliasBody(body string) []string {
+	res := make([]string, 0)
+	inQuotes, escaped := false, false
+	start := 0
+	add := func(cmd string) {
+		if cmd = strings.TrimSpace(cmd); cmd != "" {
+			res = append(res, cmd)
+		}
+	}
+	for i, r := range body {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == ';' && !inQuotes:
+			add(body[start:i])
+			start = i + 1
+		}
+	}
+	add(body[start:])
+	return res
+}
+
+// aliasNumArgs returns the number of arguments required by the body of an
+// alias, that is the largest placeholder.
+func aliasNumArgs(body string) int {
+	res := 0
+	for _, match := range aliasPlaceholder.FindAllStringSubmatch(body, -1) {
+		if n, err := strconv.Atoi(match[1]); err == nil && n > res {
+			res = n
+		}
+	}
+	return res
+}
+
+// DefineAlias defines the alias name, if body is empty the alias is removed.
+// The name must not be the name of a command in DefaultCommands and each
+// command in the body must be a valid command line (see ParseCommand).
+func DefineAlias(state *ExecutorState, name, body string) error {
+	if name == "" || strings.IndexFunc(name, unicode.IsSpace) >= 0 || strings.ContainsAny(name, "\"\\#$") {
+		return fmt.Errorf("Invalid alias name \"%s\"", name)
+	}
+	if _, isCmd := DefaultCommands[name]; isCmd || isBlockCommand(name) {
+		return fmt.Errorf("Can't define alias \"%s\": It's the name of a command", name)
+	}
+	if strings.TrimSpace(body) == "" {
+		delete(state.Aliases, name)
+		return nil
+	}
+	cmds := splitAliasBody(body)
+	for _, cmd := range cmds {
+		parsed, parseErr := ParseCommand(cmd)
+		if parseErr != nil {
+			return fmt.Errorf("Invalid command in alias \"%s\": %s", name, cmd)
+		}
+		if len(parsed) > 0 && isBlockCommand(parsed[0]) {
+			return fmt.Errorf("Blocks are not supported in aliases, got \"%s\"", cmd)
+		}
+	}
+	if state.Aliases == nil {
+		state.Aliases = make(map[string]string)
+	}
+	state.Aliases[name] = body
+	return nil
+}
+
+// ExpandAlias returns a reader for the commands of the alias body with the
+// placeholders replaced by args (see ParameterizedFromStrings). The arguments
+// are quoted if required, thus arguments containing spaces work. An error is
+// returned if not enough arguments are given.
+func ExpandAlias(body string, args ...string) (io.Reader, error) {
+	if required := aliasNumArgs(body); len(args) < required {
+		return nil, fmt.Errorf("Alias requires %d arguments, got %d", required, len(args))
+	}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quoteArg(arg)
+	}
+	return ParameterizedFromStrings(splitAliasBody(body), quoted...), nil
+}
+
+// quoteArg returns arg such that ParseCommand parses it as a single argument.
+func quoteArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"\\#") {
+		return arg
+	}
+	escaped := strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(arg)
+	return "\"" + escaped + "\""
+}
+
+// executeAlias executes the commands of an alias. It returns false if the
+// execution should stop.
+func executeAlias(handler CommandHandler, state *ExecutorState, commandMap CommandMap,
+	name, body string, args []string) bool {
+	if state.aliasDepth >= MaxAliasDepth {
+		return handler.OnParseErr(state, fmt.Errorf("Aliases nested too deep (more than %d), recursive alias \"%s\"?",
+			MaxAliasDepth, name))
+	}
+	r, expandErr := ExpandAlias(body, args...)
+	if expandErr != nil {
+		return handler.OnParseErr(state, fmt.Errorf("Error in alias \"%s\": %s", name, expandErr.Error()))
+	}
+	state.aliasDepth++
+	defer func() { state.aliasDepth-- }()
+	return executeLines(handler, state, commandMap, NewScannerLineReader(r, "", nil))
+}
+
+// AliasCommand defines, shows and lists aliases.
+func AliasCommand(state *ExecutorState, args ...string) error {
+	switch len(args) {
+	case 0:
+		names := make([]string, 0, len(state.Aliases))
+		for name := range state.Aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(state.Out, "%s ==> %s\n", name, state.Aliases[name])
+		}
+		return nil
+	case 1:
+		body, has := state.Aliases[args[0]]
+		if !has {
+			return fmt.Errorf("Unkown alias %s", args[0])
+		}
+		fmt.Fprintf(state.Out, "%s ==> %s\n", args[0], body)
+		return nil
+	case 2:
+		return DefineAlias(state, args[0], args[1])
+	default:
+		return errors.New("Invalid alias syntax, the commands must be enclosed in quotes")
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"container/heap"
+	"image"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// This file contains an approximate nearest neighbor index for histograms.
+// For very large databases comparing each tile with all database histograms
+// is too slow, with the index only a small part of the histograms is
+// compared.
+
+// DefaultANNChecks is the default number of histograms compared for each tile
+// when searching the ANN index.
+const DefaultANNChecks = 512
+
+// vpNode is a node in a VPTree. All histograms with distance < radius to the
+// vantage point are in inside, all other histograms are in outside.
+type vpNode struct {
+	vantage ImageID
+	radius  float64
+	inside  *vpNode
+	outside *vpNode
+}
+
+// VPTree is a vantage-point tree over histograms, see
+// https://en.wikipedia.org/wiki/Vantage-point_tree
+//
+// The search is exact if the histogram metric satisfies the triangle
+// inequality (for example euclid, manhattan and chessboard) and the number of
+// checks is not limited. For other metrics (like cosine) the search is
+// approximate. Limiting the number of checks makes the search approximate for
+// all metrics, but in high dimensions (histograms with many sub-divisions) it's
+// the only way to avoid comparing most of the histograms anyway.
+type VPTree struct {
+	root       *vpNode
+	histograms []*Histogram
+	metric     HistogramMetric
+	size       int
+}
+
+// NewVPTree builds the tree for the histograms, the index of a histogram is
+// its image id. nil histograms are ignored. Building the tree requires
+// O(n log n) metric evaluations.
+func NewVPTree(histograms []*Histogram, metric HistogramMetric) *VPTree {
+	ids := make([]ImageID, 0, len(histograms))
+	for id, hist := range histograms {
+		if hist != nil {
+			ids = append(ids, ImageID(id))
+		}
+	}
+	tree := &VPTree{histograms: histograms, metric: metric, size: len(ids)}
+	// use a fixed seed, this way the tree (and the result of a search with
+	// limited checks) is reproducible
+	rnd := rand.New(rand.NewSource(1))
+	tree.root = tree.build(ids, rnd)
+	return tree
+}
+
+// NewHistogramVPTree builds the tree for the histograms of the images with ids
+// 0 to numImages - 1 from the storage.
+func NewHistogramVPTree(storage HistogramStorage, numImages ImageID, metric HistogramMetric) (*VPTree, error) {
+	histograms := make([]*Histogram, numImages)
+	var id ImageID
+	for ; id < numImages; id++ {
+		hist, histErr := storage.GetHistogram(id)
+		if histErr != nil {
+			return nil, histErr
+		}
+		histograms[id] = hist
+	}
+	return NewVPTree(histograms, metric), nil
+}
+
+// Len returns the number of histograms in the tree.
+func (tree *VPTree) Len() int {
+	return tree.size
+}
+
+func (tree *VPTree) build(ids []ImageID, rnd *rand.Rand) *vpNode {
+	if len(ids) == 0 {
+		return nil
+	}
+	// move a random vantage point to the front
+	pos := rnd.Intn(len(ids))
+	ids[0], ids[pos] = ids[pos], ids[0]
+	node := &vpNode{vantage: ids[0]}
+	rest := ids[1:]
+	if len(rest) == 0 {
+		return node
+	}
+	vantage := tree.histograms[node.vantage]
+	dists := make([]float64, len(rest))
+	for i, id := range rest {
+		dists[i] = tree.metric(vantage, tree.histograms[id])
+	}
+	sort.Sort(&vpSorter{ids: rest, dists: dists})
+	median := len(rest) / 2
+	node.radius = dists[median]
+	node.inside = tree.build(rest[:median], rnd)
+	node.outside = tree.build(rest[median:], rnd)
+	return node
+}
+
+// vpSorter sorts ids by their distance to the vantage point.
+type vpSorter struct {
+	ids   []ImageID
+	dists []float64
+}
+
+func (s *vpSorter) Len() int {
+	return len(s.ids)
+}
+
+func (s *vpSorter) Less(i, j int) bool {
+	return s.dists[i] < s.dists[j]
+}
+
+func (s *vpSorter) Swap(i, j int) {
+	s.ids[i], s.ids[j] = s.ids[j], s.ids[i]
+	s.dists[i], s.dists[j] = s.dists[j], s.dists[i]
+}
+
+// vpCandidate is a node that still must be searched, bound is the lower bound
+// for the distance of the histograms in this node.
+type vpCandidate struct {
+	node  *vpNode
+	bound float64
+}
+
+// vpQueue is a priority queue of candidates, it implements heap.Interface.
+type vpQueue []vpCandidate
+
+func (q vpQueue) Len() int {
+	return len(q)
+}
+
+func (q vpQueue) Less(i, j int) bool {
+	return q[i].bound < q[j].bound
+}
+
+func (q vpQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *vpQueue) Push(x interface{}) {
+	*q = append(*q, x.(vpCandidate))
+}
+
+func (q *vpQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	*q = old[:n-1]
+	return x
+}
+
+// Nearest returns the image whose histogram is nearest to h and the distance.
+// The nodes are searched best first, at most maxChecks histograms are compared
+// with h (maxChecks ≤ 0 means no limit). If the tree is empty NoImageID is
+// returned.
+func (tree *VPTree) Nearest(h *Histogram, maxChecks int) (ImageID, float64) {
+	best, bestDist := NoImageID, math.MaxFloat64
+	if tree.root == nil {
+		return best, bestDist
+	}
+	queue := &vpQueue{vpCandidate{node: tree.root, bound: 0.0}}
+	checks := 0
+	for queue.Len() > 0 {
+		next := heap.Pop(queue).(vpCandidate)
+		if next.bound > bestDist {
+			// all other candidates are worse
+			break
+		}
+		if maxChecks > 0 && checks >= maxChecks {
+			break
+		}
+		node := next.node
+		dist := tree.metric(h, tree.histograms[node.vantage])
+		checks++
+		// on ties prefer the smaller id, like the exact search does
+		if dist < bestDist || (dist == bestDist && node.vantage < best) {
+			best, bestDist = node.vantage, dist
+		}
+		if node.inside != nil {
+			heap.Push(queue, vpCandidate{node: node.inside, bound: math.Max(next.bound, dist-node.radius)})
+		}
+		if node.outside != nil {
+			heap.Push(queue, vpCandidate{node: node.outside, bound: math.Max(next.bound, node.radius-dist)})
+		}
+	}
+	return best, bestDist
+}
+
+// ANNSelector is an ImageSelector that selects the image that (approximately)
+// minimizes the histogram metric for each tile, it's the approximate version
+// of GCHSelector. It uses a VPTree as index that is built once in Init.
+type ANNSelector struct {
+	HistStorage HistogramStorage
+	Metric      HistogramMetric
+	MaxChecks   int
+	NumRoutines int
+
+	// Index is the index of the database histograms, if it's nil (or has
+	// the wrong size) it's created in Init. This way an index can be reused
+	// for different selectors.
+	Index *VPTree
+}
+
+// NewANNSelector returns a new selector, maxChecks is the maximal number of
+// histograms compared for each tile (see VPTree.Nearest).
+func NewANNSelector(histStorage HistogramStorage, metric HistogramMetric, maxChecks, numRoutines int) *ANNSelector {
+	if numRoutines <= 0 {
+		numRoutines = 1
+	}
+	return &ANNSelector{
+		HistStorage: histStorage,
+		Metric:      metric,
+		MaxChecks:   maxChecks,
+		NumRoutines: numRoutines,
+	}
+}
+
+// Init builds the index if required.
+func (sel *ANNSelector) Init(storage ImageStorage) error {
+	numImages := storage.NumImages()
+	if sel.Index != nil && sel.Index.Len() == int(numImages) {
+		return nil
+	}
+	index, indexErr := NewHistogramVPTree(sel.HistStorage, numImages, sel.Metric)
+	if indexErr != nil {
+		return indexErr
+	}
+	sel.Index = index
+	return nil
+}
+
+// SelectImages searches the index for each tile, NumRoutines tiles are
+// processed concurrently.
+func (sel *ANNSelector) SelectImages(storage ImageStorage,
+	query image.Image, dist TileDivision, progress ProgressFunc) ([][]ImageID, error) {
+	// the tile histograms are computed the same way as for GCHSelector
+	tileMetric := NewHistogramImageMetric(sel.HistStorage, sel.Metric, sel.NumRoutines)
+	if initErr := tileMetric.InitTiles(storage, query, dist); initErr != nil {
+		return nil, initErr
+	}
+	result := make([][]ImageID, len(dist))
+	numTiles := 0
+	for i, inner := range dist {
+		result[i] = make([]ImageID, len(inner))
+		numTiles += len(inner)
+	}
+	type job struct {
+		i, j int
+	}
+	jobs := make(chan job, BufferSize)
+	var wg sync.WaitGroup
+	wg.Add(numTiles)
+	for w := 0; w < sel.NumRoutines; w++ {
+		go func() {
+			for next := range jobs {
+				result[next.i][next.j], _ = sel.Index.Nearest(tileMetric.TileData[next.i][next.j], sel.MaxChecks)
+				wg.Done()
+			}
+		}()
+	}
+	numDone := 0
+	go func() {
+		for i, inner := range dist {
+			for j := range inner {
+				jobs <- job{i, j}
+				numDone++
+				if progress != nil {
+					progress(numDone)
+				}
+			}
+		}
+		close(jobs)
+	}()
+	wg.Wait()
+	return result, nil
+}
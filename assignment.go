@@ -0,0 +1,232 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"image"
+	"math"
+	"sync"
+)
+
+// HungarianAssignment solves the (rectangular) assignment problem with the
+// hungarian method: Given numRows ≤ numCols and a cost function it returns an
+// assignment of each row to a distinct column s.t. the sum of the costs is
+// minimal. The result contains for each row the assigned column.
+//
+// The runtime is in O(numRows² · numCols).
+func HungarianAssignment(numRows, numCols int, cost func(i, j int) float64) []int {
+	// implementation with potentials, rows and columns are 1-indexed, row /
+	// column 0 is a dummy
+	u := make([]float64, numRows+1)
+	v := make([]float64, numCols+1)
+	p := make([]int, numCols+1)
+	way := make([]int, numCols+1)
+	minv := make([]float64, numCols+1)
+	used := make([]bool, numCols+1)
+	for i := 1; i <= numRows; i++ {
+		p[0] = i
+		j0 := 0
+		for j := range minv {
+			minv[j] = math.Inf(1)
+			used[j] = false
+		}
+		for {
+			used[j0] = true
+			i0 := p[j0]
+			delta := math.Inf(1)
+			j1 := 0
+			for j := 1; j <= numCols; j++ {
+				if used[j] {
+					continue
+				}
+				cur := cost(i0-1, j-1) - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= numCols; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+	res := make([]int, numRows)
+	for j := 1; j <= numCols; j++ {
+		if p[j] != 0 {
+			res[p[j]-1] = j - 1
+		}
+	}
+	return res
+}
+
+// AssignmentSelector is an ImageSelector that doesn't select the images for
+// each tile independently (greedy) but solves a global min-cost matching
+// between the tiles and the database images: Each image is used at most
+// MaxUsage times and the sum of the metric values of all tiles is minimized.
+// This produces better mosaics than a greedy selection with usage
+// constraints, especially if the database is small compared to the number of
+// tiles.
+//
+// If MaxUsage is ≤ 0 the usage is not restricted, in this case the result is
+// the same as for ImageMetricMinimizer. If the database doesn't contain
+// enough images to fill all tiles with MaxUsage the value is increased to the
+// smallest value possible.
+//
+// The metric values for all combinations of tiles and images are computed
+// and stored, the assignment has a runtime of O(t² · n · MaxUsage) where t is
+// the number of tiles and n the number of images.
+type AssignmentSelector struct {
+	Metric      ImageMetric
+	MaxUsage    int
+	NumRoutines int
+}
+
+// NewAssignmentSelector returns a new assignment selector.
+func NewAssignmentSelector(metric ImageMetric, maxUsage, numRoutines int) *AssignmentSelector {
+	if numRoutines <= 0 {
+		numRoutines = 1
+	}
+	return &AssignmentSelector{
+		Metric:      metric,
+		MaxUsage:    maxUsage,
+		NumRoutines: numRoutines,
+	}
+}
+
+// Init just calls InitStorage of the metric.
+func (sel *AssignmentSelector) Init(storage ImageStorage) error {
+	return sel.Metric.InitStorage(storage)
+}
+
+// computeCosts concurrently computes the metric values for all tiles and
+// images. The result contains for each tile (in the order of tiles) a list
+// of metric values for each image. Values that can't be computed are set
+// to math.MaxFloat32 (not math.MaxFloat64 to avoid overflows in the
+// assignment).
+func (sel *AssignmentSelector) computeCosts(storage ImageStorage, tiles []image.Point,
+	progress ProgressFunc) [][]float64 {
+	numImages := int(storage.NumImages())
+	res := make([][]float64, len(tiles))
+	jobs := make(chan int, BufferSize)
+	var wg sync.WaitGroup
+	wg.Add(len(tiles))
+	for w := 0; w < sel.NumRoutines; w++ {
+		go func() {
+			for t := range jobs {
+				i, j := tiles[t].Y, tiles[t].X
+				costs := make([]float64, numImages)
+				for imageID := 0; imageID < numImages; imageID++ {
+					dist, distErr := sel.Metric.Compare(storage, ImageID(imageID), i, j)
+					if distErr != nil {
+						SelectionLogger.Error("Can't compute metric value, ignoring it", LogFields{
+							"error": distErr,
+							"image": imageID,
+							"tileY": i,
+							"tileX": j,
+						})
+						dist = math.MaxFloat32
+					}
+					costs[imageID] = dist
+				}
+				res[t] = costs
+				wg.Done()
+			}
+		}()
+	}
+	go func() {
+		for t := range tiles {
+			jobs <- t
+		}
+		close(jobs)
+	}()
+	wg.Wait()
+	if progress != nil {
+		progress(len(tiles))
+	}
+	return res
+}
+
+// SelectImages computes the metric values and then solves the assignment
+// problem.
+func (sel *AssignmentSelector) SelectImages(storage ImageStorage,
+	query image.Image, dist TileDivision, progress ProgressFunc) ([][]ImageID, error) {
+	if initErr := sel.Metric.InitTiles(storage, query, dist); initErr != nil {
+		return nil, initErr
+	}
+	res := make([][]ImageID, len(dist))
+	// tiles contains the positions (j, i) of all tiles
+	tiles := make([]image.Point, 0, dist.Size())
+	for i, col := range dist {
+		res[i] = make([]ImageID, len(col))
+		for j := range col {
+			res[i][j] = NoImageID
+			tiles = append(tiles, image.Pt(j, i))
+		}
+	}
+	numImages := int(storage.NumImages())
+	if numImages == 0 || len(tiles) == 0 {
+		return res, nil
+	}
+	costs := sel.computeCosts(storage, tiles, progress)
+	maxUsage := sel.MaxUsage
+	if maxUsage <= 0 || maxUsage >= len(tiles) {
+		// no restriction, just use the best image for each tile
+		for t, tile := range tiles {
+			best, bestValue := NoImageID, math.MaxFloat64
+			for imageID, value := range costs[t] {
+				if value < bestValue {
+					best, bestValue = ImageID(imageID), value
+				}
+			}
+			res[tile.Y][tile.X] = best
+		}
+		return res, nil
+	}
+	if minUsage := (len(tiles) + numImages - 1) / numImages; maxUsage < minUsage {
+		SelectionLogger.Warn("Not enough images for max usage, increasing max usage", LogFields{
+			"max-usage": maxUsage,
+			"images":    numImages,
+			"tiles":     len(tiles),
+		})
+		maxUsage = minUsage
+	}
+	// each image is represented by maxUsage columns
+	cost := func(t, column int) float64 {
+		return costs[t][column/maxUsage]
+	}
+	assignment := HungarianAssignment(len(tiles), numImages*maxUsage, cost)
+	for t, tile := range tiles {
+		res[tile.Y][tile.X] = ImageID(assignment[t] / maxUsage)
+	}
+	return res, nil
+}
@@ -16,6 +16,7 @@ package gomosaic
 
 import (
 	"image"
+	"sync"
 )
 
 // AverageColor describes the average of several RGB colors.
@@ -58,3 +59,43 @@ func (c AverageColor) Dist(other AverageColor, metric VectorMetric) float64 {
 	v2 := []float64{float64(other.R), float64(other.G), float64(other.B)}
 	return metric(v1, v2)
 }
+
+// ComputeTileAverages computes the average color of each tile of the query
+// image given the distribution in tiles. It computes numRoutines averages
+// concurrently.
+func ComputeTileAverages(query image.Image, dist TileDivision, numRoutines int) ([][]AverageColor, error) {
+	if numRoutines <= 0 {
+		numRoutines = 1
+	}
+	tiles, tilesErr := DivideImage(query, dist, numRoutines)
+	if tilesErr != nil {
+		return nil, tilesErr
+	}
+	res := make([][]AverageColor, len(tiles))
+	for i, col := range tiles {
+		res[i] = make([]AverageColor, len(col))
+	}
+
+	type job struct {
+		i, j int
+	}
+	jobs := make(chan job, BufferSize)
+	var wg sync.WaitGroup
+	wg.Add(tiles.Size())
+	for w := 0; w < numRoutines; w++ {
+		go func() {
+			for next := range jobs {
+				res[next.i][next.j] = ComputeAverageColor(tiles[next.i][next.j])
+				wg.Done()
+			}
+		}()
+	}
+	for i, col := range tiles {
+		for j := range col {
+			jobs <- job{i, j}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return res, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"sync"
+)
+
+// This file contains functions to create mosaics for many query images
+// at once.
+
+// QueryLoader returns a query image, it's called when the mosaic for the
+// query is created. This way not all query images must be held in memory.
+type QueryLoader func() (image.Image, error)
+
+// FileQuery returns a QueryLoader that decodes the image from a file.
+func FileQuery(path string) QueryLoader {
+	return func() (image.Image, error) {
+		r, openErr := os.Open(path)
+		if openErr != nil {
+			return nil, openErr
+		}
+		defer r.Close()
+		img, _, decodeErr := image.Decode(r)
+		return img, decodeErr
+	}
+}
+
+// PreprocessedFileQuery returns a QueryLoader that decodes the image from a
+// file and applies the preprocessing, see LoadQueryImage.
+func PreprocessedFileQuery(path string, p QueryPreprocessing, resizer ImageResizer) QueryLoader {
+	return func() (image.Image, error) {
+		return LoadQueryImage(path, p, resizer)
+	}
+}
+
+// BatchDivider computes the division of a query image (used for selection)
+// and the division of its mosaic, see FrameDivider.
+type BatchDivider func(query image.Image) (TileDivision, TileDivision, error)
+
+// BatchDoneFunc is called for each composed mosaic, i is the index of the
+// query. It's called concurrently by the workers.
+type BatchDoneFunc func(i int, query, mosaic image.Image) error
+
+// ComposeMosaicBatch composes the mosaics for many query images with
+// numWorkers workers, each worker creates one mosaic at a time (using
+// numRoutines go routines). Selectors are usually not safe for concurrent use,
+// thus newSelector is called once for each worker. The selectors must use the
+// same features (histograms etc.), thus the features are loaded only once.
+// The cache of scaled database images is shared between all workers, if it's
+// nil a new cache of size ImageCacheSize is used.
+//
+// done is called for each mosaic (for example to save it), thus the mosaics
+// don't have to be held in memory. progress is called after each mosaic.
+//
+// If an error occurs the remaining queries are skipped and the first error is
+// returned.
+func ComposeMosaicBatch(storage ImageStorage, newSelector func() (ImageSelector, error),
+	queries []QueryLoader, divide BatchDivider, transforms FrameTransformFunc,
+	resizer ImageResizer, s ResizeStrategy, border TileBorder,
+	numWorkers, numRoutines int, cache *ImageCache, done BatchDoneFunc, progress ProgressFunc) error {
+	if numWorkers <= 0 {
+		numWorkers = 1
+	}
+	numWorkers = IntMin(numWorkers, len(queries))
+	if cache == nil {
+		cache = NewImageCache(ImageCacheSize)
+	}
+	selectors := make([]ImageSelector, numWorkers)
+	for w := range selectors {
+		selector, selectorErr := newSelector()
+		if selectorErr != nil {
+			return selectorErr
+		}
+		if initErr := selector.Init(storage); initErr != nil {
+			return initErr
+		}
+		selectors[w] = selector
+	}
+	// compose creates the mosaic for the query with the given selector
+	compose := func(selector ImageSelector, i int) error {
+		query, queryErr := queries[i]()
+		if queryErr != nil {
+			return fmt.Errorf("Can't load query %d: %s", i, queryErr.Error())
+		}
+		dist, mosaicDist, divideErr := divide(query)
+		if divideErr != nil {
+			return divideErr
+		}
+		selection, selectionErr := selector.SelectImages(storage, query, dist, nil)
+		if selectionErr != nil {
+			return fmt.Errorf("Can't select images for query %d: %s", i, selectionErr.Error())
+		}
+		var transform TileTransform
+		if transforms != nil {
+			var transformErr error
+			transform, transformErr = transforms(query, dist)
+			if transformErr != nil {
+				return transformErr
+			}
+		}
+		mosaic, mosaicErr := ComposeMosaic(storage, selection, mosaicDist,
+			resizer, s, transform, border, numRoutines, cache, nil)
+		if mosaicErr != nil {
+			return fmt.Errorf("Can't compose mosaic for query %d: %s", i, mosaicErr.Error())
+		}
+		return done(i, query, mosaic)
+	}
+	jobs := make(chan int, BufferSize)
+	errorChan := make(chan error, BufferSize)
+	// set to true after the first error, remaining queries are skipped
+	var m sync.Mutex
+	failed := false
+	for w := 0; w < numWorkers; w++ {
+		go func(selector ImageSelector) {
+			for i := range jobs {
+				m.Lock()
+				skip := failed
+				m.Unlock()
+				if skip {
+					errorChan <- nil
+					continue
+				}
+				err := compose(selector, i)
+				if err != nil {
+					m.Lock()
+					failed = true
+					m.Unlock()
+				}
+				errorChan <- err
+			}
+		}(selectors[w])
+	}
+	go func() {
+		for i := range queries {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+	var err error
+	for i := 0; i < len(queries); i++ {
+		nextErr := <-errorChan
+		if nextErr != nil && err == nil {
+			err = nextErr
+		}
+		if progress != nil {
+			progress(i + 1)
+		}
+	}
+	return err
+}
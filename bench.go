@@ -0,0 +1,86 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// This file contains the results of the bench command: The selection is run
+// for a query with different metrics and variety selectors, for each
+// configuration the time and the quality of the selection is measured.
+
+// BenchResult is the result of the selection with one configuration.
+type BenchResult struct {
+	// Selection is the metric, for example "gch-cosine".
+	Selection string `json:"selection"`
+	// Variety is the variety selector, see CmdVarietySelector.
+	Variety string `json:"variety"`
+	// Duration is the time the selection took.
+	Duration time.Duration `json:"duration"`
+	// MeanValue is the mean metric value of all tiles, see MeanMetricValue.
+	MeanValue float64 `json:"mean-value"`
+	// NumImages is the number of distinct images used.
+	NumImages int `json:"num-images"`
+	// Output is the path of the mosaic, empty if no mosaic was created.
+	Output string `json:"output,omitempty"`
+	// Error is set if the configuration is not supported (for example a
+	// variety selector that's not supported for the metric).
+	Error string `json:"error,omitempty"`
+}
+
+// MeanMetricValue returns the mean of all metric values (see MetricValues),
+// NaN values are ignored. If there are no values 0 is returned.
+func MeanMetricValue(values [][]float64) float64 {
+	sum, num := 0.0, 0
+	for _, col := range values {
+		for _, value := range col {
+			if !math.IsNaN(value) {
+				sum += value
+				num++
+			}
+		}
+	}
+	if num == 0 {
+		return 0.0
+	}
+	return sum / float64(num)
+}
+
+// DistinctImages returns the number of distinct images in the selection,
+// NoImageID is not counted.
+func DistinctImages(selection [][]ImageID) int {
+	used := make(map[ImageID]struct{})
+	for _, col := range selection {
+		for _, id := range col {
+			if id != NoImageID {
+				used[id] = struct{}{}
+			}
+		}
+	}
+	return len(used)
+}
+
+// WriteBenchResults writes the results as JSON to a file.
+func WriteBenchResults(path string, results []BenchResult) error {
+	data, jsonErr := json.MarshalIndent(results, "", "  ")
+	if jsonErr != nil {
+		return jsonErr
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
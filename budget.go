@@ -0,0 +1,162 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// This file contains a memory budget for operations that require a lot of
+// memory (creating histograms, computing heaps and composing mosaics). The
+// memory of an operation is estimated from the number of images, k, the tile
+// sizes etc. Operations that would exceed the budget are either run in smaller
+// chunks (fewer images decoded concurrently, a smaller image cache) or refused
+// instead of getting the process killed.
+//
+// The estimates are rough: Images are assumed to be stored with 4 bytes per
+// pixel and overhead of the go runtime is ignored.
+
+// MemorySampleSize is the number of database images inspected by
+// SampleImagePixels.
+const MemorySampleSize = 32
+
+// ErrMemoryBudget is returned if an operation exceeds the memory budget.
+type ErrMemoryBudget struct {
+	Operation        string
+	Required, Budget uint64
+}
+
+func (err ErrMemoryBudget) Error() string {
+	return fmt.Sprintf("%s requires about %s, this exceeds the memory budget of %s",
+		err.Operation, formatBytes(err.Required), formatBytes(err.Budget))
+}
+
+// MemoryBudget is the maximal number of bytes an operation may use, 0 means
+// no restriction.
+type MemoryBudget uint64
+
+// ParseMemoryBudget parses a size in bytes with an optional binary unit, for
+// example "512M", "4G" or "1.5GiB". "0", "none" and "unlimited" disable the
+// budget.
+func ParseMemoryBudget(s string) (MemoryBudget, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	switch s {
+	case "NONE", "UNLIMITED":
+		return 0, nil
+	}
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	var factor uint64 = 1
+	if n := len(s); n > 0 {
+		if pos := strings.IndexByte("KMGT", s[n-1]); pos >= 0 {
+			s = strings.TrimSpace(s[:n-1])
+			factor = 1 << (10 * uint(pos+1))
+		}
+	}
+	val, parseErr := strconv.ParseFloat(s, 64)
+	if parseErr != nil {
+		return 0, fmt.Errorf("Invalid memory size: %s", parseErr.Error())
+	}
+	if val < 0.0 {
+		return 0, fmt.Errorf("Invalid memory size: Must be >= 0, got %f", val)
+	}
+	return MemoryBudget(val * float64(factor)), nil
+}
+
+func (budget MemoryBudget) String() string {
+	if budget == 0 {
+		return "unlimited"
+	}
+	return formatBytes(uint64(budget))
+}
+
+// Check returns an ErrMemoryBudget if required exceeds the budget.
+func (budget MemoryBudget) Check(operation string, required uint64) error {
+	if budget != 0 && required > uint64(budget) {
+		return ErrMemoryBudget{Operation: operation, Required: required, Budget: uint64(budget)}
+	}
+	return nil
+}
+
+// Chunk returns the number of units (at most units) that fit in the budget,
+// the operation requires fixed bytes and perUnit bytes for each unit. Units
+// are for example the number of images decoded concurrently or the size of an
+// image cache. If not even one unit fits in the budget an ErrMemoryBudget is
+// returned.
+func (budget MemoryBudget) Chunk(operation string, fixed, perUnit uint64, units int) (int, error) {
+	if units < 1 {
+		units = 1
+	}
+	if budget == 0 || perUnit == 0 {
+		return units, budget.Check(operation, fixed)
+	}
+	required := fixed + perUnit
+	if checkErr := budget.Check(operation, required); checkErr != nil {
+		return 0, checkErr
+	}
+	return IntMin(units, int((uint64(budget)-fixed)/perUnit)), nil
+}
+
+// ImageBytes returns the memory of an image with the given number of pixels.
+func ImageBytes(pixels int) uint64 {
+	return 4 * uint64(IntMax(pixels, 0))
+}
+
+// HistogramBytes returns the memory of numImages features, each consisting of
+// parts histograms (1 for GCHs) with k sub-divisions.
+func HistogramBytes(numImages int, k uint, parts uint) uint64 {
+	return 8 * uint64(k) * uint64(k) * uint64(k) * uint64(parts) * uint64(numImages)
+}
+
+// HeapBytes returns the memory of the image heaps for numTiles tiles with k
+// images in each heap, see ComputeHeaps.
+func HeapBytes(numTiles, k int) uint64 {
+	// an entry is an ImageID and a float64, each heap has a small overhead for
+	// the heap struct and slice header
+	return uint64(numTiles) * (16*uint64(k) + 64)
+}
+
+// SampleImagePixels returns the maximal number of pixels of MemorySampleSize
+// images of the mapper (evenly distributed), only the image headers are read.
+// Images that can't be read are ignored.
+func SampleImagePixels(mapper *FSMapper) int {
+	numImages := mapper.Len()
+	if numImages == 0 {
+		return 0
+	}
+	step := IntMax(numImages/MemorySampleSize, 1)
+	res := 0
+	for id := 0; id < numImages; id += step {
+		path, _ := mapper.GetPath(ImageID(id))
+		if config, configErr := decodeImageConfig(path); configErr == nil {
+			res = IntMax(res, config.Width*config.Height)
+		}
+	}
+	return res
+}
+
+// decodeImageConfig reads the header of an image file.
+func decodeImageConfig(path string) (image.Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	return config, err
+}
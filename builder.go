@@ -0,0 +1,345 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"runtime"
+)
+
+// MosaicBuilder is the simplest way to use gomosaic as a library, it creates
+// mosaics based on global color histograms (GCHs). The options are set with
+// the With methods, all of them return the builder itself. Example:
+//
+//	mapper, err := gomosaic.CreateFSMapper("/path/to/images", true, nil)
+//	// handle error
+//	builder := gomosaic.NewMosaicBuilder(gomosaic.NewFSImageDB(mapper)).
+//	  WithMetric("cosine").
+//	  WithTiles(20, 30).
+//	  WithVariety(gomosaic.CmdVarietyRand)
+//	mosaic, err := builder.Build(query)
+//
+// If no histograms are given with WithHistograms they're computed once on the
+// first call of Build and reused for all further calls.
+//
+// Invalid options (like an unknown metric) are reported by Build.
+type MosaicBuilder struct {
+	storage     ImageStorage
+	histograms  HistogramStorage
+	k           uint
+	metric      HistogramMetric
+	batch       BatchVectorMetric
+	tilesX      int
+	tilesY      int
+	variety     CmdVarietySelector
+	layout      CmdLayout
+	cut         bool
+	jitter      float64
+	width       int
+	height      int
+	numRoutines int
+	seed        int64
+	bestFit     float64
+	strategy    ResizeStrategy
+	resizer     ImageResizer
+	border      TileBorder
+	cacheSize   int
+	cache       *ImageCache
+	progress    ProgressFunc
+	err         error
+}
+
+// NewMosaicBuilder returns a new builder using the database images from
+// storage. The defaults are: The euclidean metric, 20x20 tiles, no variety,
+// the size of the query image and k = 8 for the histograms.
+func NewMosaicBuilder(storage ImageStorage) *MosaicBuilder {
+	metric, _ := GetHistogramMetric("euclid")
+	batch, _ := GetBatchVectorMetric("euclid")
+	return &MosaicBuilder{
+		storage:     storage,
+		k:           8,
+		metric:      metric,
+		batch:       batch,
+		tilesX:      20,
+		tilesY:      20,
+		variety:     CmdVarietyNone,
+		layout:      CmdLayoutGrid,
+		jitter:      DefaultJitter,
+		width:       -1,
+		height:      -1,
+		numRoutines: runtime.NumCPU(),
+		seed:        -1,
+		bestFit:     0.05,
+		strategy:    ForceResize,
+		resizer:     DefaultResizer,
+		border:      NoTileBorder,
+		cacheSize:   ImageCacheSize,
+	}
+}
+
+// setErr remembers the first error, it's returned by Build.
+func (b *MosaicBuilder) setErr(err error) *MosaicBuilder {
+	if b.err == nil {
+		b.err = err
+	}
+	return b
+}
+
+// WithMetric sets the metric used to compare histograms, see
+// GetHistogramMetricNames for the supported names.
+func (b *MosaicBuilder) WithMetric(name string) *MosaicBuilder {
+	metric, ok := GetHistogramMetric(name)
+	if !ok {
+		return b.setErr(fmt.Errorf("Unkown metric %s", name))
+	}
+	b.metric = metric
+	b.batch, _ = GetBatchVectorMetric(name)
+	return b
+}
+
+// WithTiles sets the number of tiles in each direction.
+func (b *MosaicBuilder) WithTiles(tilesX, tilesY int) *MosaicBuilder {
+	if tilesX <= 0 || tilesY <= 0 {
+		return b.setErr(fmt.Errorf("Tiles dimensions must be positive, got %dx%d", tilesX, tilesY))
+	}
+	b.tilesX, b.tilesY = tilesX, tilesY
+	return b
+}
+
+// WithVariety sets the variety selector, CmdVarietyMetric is not supported.
+func (b *MosaicBuilder) WithVariety(variety CmdVarietySelector) *MosaicBuilder {
+	b.variety = variety
+	return b
+}
+
+// WithBestFit sets the fraction of best fitting images considered by the
+// random and penalty variety selectors, the default is 0.05.
+func (b *MosaicBuilder) WithBestFit(bestFit float64) *MosaicBuilder {
+	if bestFit < 0.0 || bestFit > 1.0 {
+		return b.setErr(fmt.Errorf("Best fit must be between 0 and 1, got %f", bestFit))
+	}
+	b.bestFit = bestFit
+	return b
+}
+
+// WithSeed sets the seed for the random variety selector, see NewSeededRand.
+func (b *MosaicBuilder) WithSeed(seed int64) *MosaicBuilder {
+	b.seed = seed
+	return b
+}
+
+// WithLayout sets the layout of the tiles.
+func (b *MosaicBuilder) WithLayout(layout CmdLayout, cut bool) *MosaicBuilder {
+	b.layout, b.cut = layout, cut
+	return b
+}
+
+// WithJitter sets the jitter of the tile boundaries for CmdLayoutJitter, see
+// JitterDivider. The jitter must be in [0, 0.5).
+func (b *MosaicBuilder) WithJitter(jitter float64) *MosaicBuilder {
+	if jitter < 0.0 || jitter >= 0.5 {
+		return b.setErr(fmt.Errorf("Jitter must be in [0, 0.5), got %v", jitter))
+	}
+	b.jitter = jitter
+	return b
+}
+
+// WithOutputSize sets the size of the mosaic. If one of the values is ≤ 0 it
+// is computed s.t. the ratio of the query image is kept, if both are ≤ 0 the
+// size of the query image is used.
+func (b *MosaicBuilder) WithOutputSize(width, height int) *MosaicBuilder {
+	b.width, b.height = width, height
+	return b
+}
+
+// WithHistograms sets precomputed histograms for the images in the storage.
+func (b *MosaicBuilder) WithHistograms(histograms HistogramStorage) *MosaicBuilder {
+	b.histograms = histograms
+	return b
+}
+
+// WithK sets the number of sub-divisions for histograms that are computed by
+// the builder, it has no effect on histograms set with WithHistograms.
+func (b *MosaicBuilder) WithK(k uint) *MosaicBuilder {
+	if k == 0 || k > 256 {
+		return b.setErr(fmt.Errorf("k must be between 1 and 256, got %d", k))
+	}
+	b.k = k
+	return b
+}
+
+// WithResizeStrategy sets the resize strategy, see GetResizeStrategyNames for
+// the supported names.
+func (b *MosaicBuilder) WithResizeStrategy(name string) *MosaicBuilder {
+	strategy, ok := GetResizeStrategy(name)
+	if !ok {
+		return b.setErr(fmt.Errorf("Unkown resize strategy %s", name))
+	}
+	b.strategy = strategy
+	return b
+}
+
+// WithResizer sets the resizer used to scale images.
+func (b *MosaicBuilder) WithResizer(resizer ImageResizer) *MosaicBuilder {
+	b.resizer = resizer
+	return b
+}
+
+// WithBorder sets the border drawn around each tile.
+func (b *MosaicBuilder) WithBorder(border TileBorder) *MosaicBuilder {
+	b.border = border
+	return b
+}
+
+// WithNumRoutines sets the number of go routines used.
+func (b *MosaicBuilder) WithNumRoutines(numRoutines int) *MosaicBuilder {
+	if numRoutines <= 0 {
+		return b.setErr(fmt.Errorf("Number of routines must be positive, got %d", numRoutines))
+	}
+	b.numRoutines = numRoutines
+	return b
+}
+
+// WithCacheSize sets the size of the image cache, see ComposeMosaic. The cache
+// is created on the first call of Build and shared between all mosaics.
+func (b *MosaicBuilder) WithCacheSize(cacheSize int) *MosaicBuilder {
+	b.cacheSize = cacheSize
+	return b
+}
+
+// WithCache sets the image cache, this way the cache can be shared with other
+// compositions.
+func (b *MosaicBuilder) WithCache(cache *ImageCache) *MosaicBuilder {
+	b.cache = cache
+	return b
+}
+
+// WithProgress sets the progress function, it's called both during the
+// computation of histograms, the selection of images and the composition.
+func (b *MosaicBuilder) WithProgress(progress ProgressFunc) *MosaicBuilder {
+	b.progress = progress
+	return b
+}
+
+// Histograms returns the histograms used by the builder, computing them if
+// required.
+func (b *MosaicBuilder) Histograms() (HistogramStorage, error) {
+	if b.histograms != nil {
+		return b.histograms, nil
+	}
+	histograms, histErr := CreateAllHistograms(b.storage, true, b.k, b.numRoutines, b.progress)
+	if histErr != nil {
+		return nil, histErr
+	}
+	b.histograms = &MemoryHistStorage{Histograms: histograms, K: b.k}
+	return b.histograms, nil
+}
+
+// selector returns the image selector given the variety.
+func (b *MosaicBuilder) selector(histograms HistogramStorage) (ImageSelector, error) {
+	numImages := int(b.storage.NumImages())
+	numBestFit := IntMin(IntMax(int(float64(numImages)*b.bestFit), 1), numImages)
+	switch b.variety {
+	case CmdVarietyNone:
+		imageMetric := NewHistogramImageMetric(histograms, b.metric, b.numRoutines)
+		imageMetric.Batch = b.batch
+		return NewImageMetricMinimizer(imageMetric, b.numRoutines), nil
+	case CmdVarietyRand:
+		imageMetric := NewHistogramImageMetric(histograms, b.metric, b.numRoutines)
+		return RandomHeapImageSelector(imageMetric, numBestFit, b.numRoutines,
+			NewSeededRand(b.seed)), nil
+	case CmdVarietyPenalty:
+		imageMetric := NewHistogramImageMetric(histograms, b.metric, b.numRoutines)
+		return UsagePenaltyImageSelector(imageMetric, 0.1, numBestFit, b.numRoutines), nil
+	case CmdVarietyAssignment:
+		imageMetric := NewHistogramImageMetric(histograms, b.metric, b.numRoutines)
+		return NewAssignmentSelector(imageMetric, 1, b.numRoutines), nil
+	case CmdVarietyDiffusion:
+		return NewErrorDiffusionSelector(histograms, b.metric, 1.0, b.numRoutines), nil
+	default:
+		return nil, fmt.Errorf("Variety %s is not supported by MosaicBuilder", b.variety.DisplayString())
+	}
+}
+
+// Build creates the mosaic for the query image.
+func (b *MosaicBuilder) Build(query image.Image) (image.Image, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.storage.NumImages() == 0 {
+		return nil, errors.New("No images in storage")
+	}
+	queryBounds := query.Bounds()
+	if queryBounds.Empty() {
+		return nil, errors.New("Query image is empty")
+	}
+	width, height := b.width, b.height
+	switch {
+	case width <= 0 && height <= 0:
+		width, height = queryBounds.Dx(), queryBounds.Dy()
+	case width <= 0:
+		width = KeepRatioWidth(queryBounds.Dx(), queryBounds.Dy(), height)
+	case height <= 0:
+		height = KeepRatioHeight(queryBounds.Dx(), queryBounds.Dy(), width)
+	}
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("mosaic image would be empty, dimensions %dx%d", width, height)
+	}
+	histograms, histErr := b.Histograms()
+	if histErr != nil {
+		return nil, histErr
+	}
+	selector, selectorErr := b.selector(histograms)
+	if selectorErr != nil {
+		return nil, selectorErr
+	}
+	dist, mosaicDist := divideQueryAndMosaic(b.layout, query, b.tilesX, b.tilesY,
+		b.cut, b.jitter, b.seed, image.Rect(0, 0, width, height))
+	if initErr := selector.Init(b.storage); initErr != nil {
+		return nil, initErr
+	}
+	selection, selectionErr := selector.SelectImages(b.storage, query, dist, b.progress)
+	if selectionErr != nil {
+		return nil, selectionErr
+	}
+	if b.cache == nil {
+		cacheSize := b.cacheSize
+		if cacheSize <= 0 {
+			cacheSize = ImageCacheSize
+		}
+		b.cache = NewImageCache(cacheSize)
+	}
+	return ComposeMosaic(b.storage, selection, mosaicDist, b.resizer, b.strategy,
+		nil, b.border, b.numRoutines, b.cache, b.progress)
+}
+
+// BuildTo creates the mosaic for the query image and encodes it to w in the
+// given format ("jpg" or "png", see EncodeMosaic) with the default options.
+// This way services can stream the mosaic, for example to an HTTP response.
+func (b *MosaicBuilder) BuildTo(w io.Writer, format string, query image.Image) error {
+	if _, formatErr := ParseMosaicFormat(format); formatErr != nil {
+		return formatErr
+	}
+	mosaic, buildErr := b.Build(query)
+	if buildErr != nil {
+		return buildErr
+	}
+	options := DefaultEncodeOptions()
+	options.NumRoutines = b.numRoutines
+	return EncodeMosaic(w, format, mosaic, options)
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// This file contains functions to validate a session before a long run: All
+// database images can be decoded and the precomputed features match the
+// images.
+
+// ImageCheckError is an image that can't be decoded.
+type ImageCheckError struct {
+	ID  ImageID
+	Err error
+}
+
+// ImageCheckResult is the result of CheckImages.
+type ImageCheckResult struct {
+	// Failed contains all images that can't be decoded, sorted by id.
+	Failed []ImageCheckError
+	// MaxPixels is the number of pixels of the largest image.
+	MaxPixels int
+	// TotalPixels is the number of pixels of all images.
+	TotalPixels int
+}
+
+// CheckImages decodes all images in the storage, numRoutines images are
+// decoded concurrently. progress is called with the number of checked images
+// (can be nil).
+func CheckImages(storage ImageStorage, numRoutines int, progress ProgressFunc) ImageCheckResult {
+	if numRoutines <= 0 {
+		numRoutines = 1
+	}
+	numImages := storage.NumImages()
+	jobs := make(chan ImageID, BufferSize)
+	var res ImageCheckResult
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(int(numImages))
+	numDone := 0
+	for w := 0; w < numRoutines; w++ {
+		go func() {
+			for id := range jobs {
+				img, loadErr := storage.LoadImage(id)
+				m.Lock()
+				if loadErr != nil {
+					res.Failed = append(res.Failed, ImageCheckError{ID: id, Err: loadErr})
+				} else {
+					pixels := img.Bounds().Dx() * img.Bounds().Dy()
+					res.TotalPixels += pixels
+					res.MaxPixels = IntMax(res.MaxPixels, pixels)
+				}
+				numDone++
+				if progress != nil {
+					progress(numDone)
+				}
+				m.Unlock()
+				wg.Done()
+			}
+		}()
+	}
+	for id := ImageID(0); id < numImages; id++ {
+		jobs <- id
+	}
+	close(jobs)
+	wg.Wait()
+	sort.Slice(res.Failed, func(i, j int) bool {
+		return res.Failed[i].ID < res.Failed[j].ID
+	})
+	return res
+}
+
+// CheckHistograms validates the GCHs in storage for the images of the mapper:
+// There must be one histogram for each image and each histogram must be a
+// valid normalized histogram (see HistogramFSController.CheckData). The
+// storage doesn't know the paths of the images, use CheckHistogramFile to
+// test if the histograms in a file belong to the images of the mapper. The
+// returned error describes all failed tests.
+func CheckHistograms(mapper *FSMapper, storage HistogramList) error {
+	if storage.Len() != mapper.Len() {
+		return fmt.Errorf("Got %d GCHs for %d images, GCHs must be re-computed",
+			storage.Len(), mapper.Len())
+	}
+	ids := make([]ImageID, mapper.Len())
+	for i := range ids {
+		ids[i] = ImageID(i)
+	}
+	controller, creationErr := CreateHistFSController(ids, mapper, storage)
+	if creationErr != nil {
+		return creationErr
+	}
+	return controller.CheckData(storage.Divisions(), true, true)
+}
+
+// CheckHistogramFile validates the GCHs read from a file for the images of the
+// mapper: There must be a histogram for each image, the file should not
+// contain histograms of other images (for example deleted images) and each
+// histogram must be a valid normalized histogram. The returned error
+// describes all failed tests.
+func CheckHistogramFile(mapper *FSMapper, controller *HistogramFSController) error {
+	errs := make([]string, 0)
+	if dataErr := controller.CheckData(controller.K, false, true); dataErr != nil {
+		errs = append(errs, dataErr.Error())
+	}
+	for _, path := range controller.MissingEntries(mapper, nil) {
+		errs = append(errs, fmt.Sprintf("No GCH for %s", path))
+	}
+	for _, path := range controller.AddtionalEntries(mapper) {
+		errs = append(errs, fmt.Sprintf("GCH for unkown image %s", path))
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(errs, "\n"))
+}
+
+// CheckLCHs validates the LCHs in storage for the images of the mapper: There
+// must be one LCH for each image and each LCH must consist of storage.Size
+// histograms with storage.K sub-divisions. The returned error describes all
+// failed tests.
+func CheckLCHs(mapper *FSMapper, storage *MemoryLCHStorage) error {
+	if len(storage.LCHs) != mapper.Len() {
+		return fmt.Errorf("Got %d LCHs for %d images, LCHs must be re-computed",
+			len(storage.LCHs), mapper.Len())
+	}
+	errs := make([]string, 0)
+	k := storage.K
+	for id, lch := range storage.LCHs {
+		path, _ := mapper.GetPath(ImageID(id))
+		if lch == nil || uint(len(lch.Histograms)) != storage.Size {
+			errs = append(errs, fmt.Sprintf("Error in LCH for %s: Expected %d histograms", path, storage.Size))
+			continue
+		}
+		for _, histogram := range lch.Histograms {
+			if histogram == nil || histogram.K != k || uint(len(histogram.Entries)) != k*k*k {
+				errs = append(errs, fmt.Sprintf("Error in LCH for %s: Expected histograms with k = %d", path, k))
+				break
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(errs, "\n"))
+}
+
+// formatBytes formats a number of bytes with a binary unit, like "1.5 MiB".
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for next := n / unit; next >= unit; next /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
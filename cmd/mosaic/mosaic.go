@@ -15,6 +15,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	_ "image/jpeg"
 	_ "image/png"
@@ -30,13 +31,15 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func usage() {
+func usage(variables []string) {
 	prefix := "Usage " + os.Args[0]
 	prefixLength := utf8.RuneCountInString(prefix)
 	prefixReplace := strings.Repeat(" ", prefixLength)
-	fmt.Println(prefix, "[--version | -v] [--help | -h] [--copyright] [--repl] [--run <path> [params...]]")
-	fmt.Println(prefixReplace, "[--execute <command> [params...]]")
+	fmt.Println(prefix, "[--version | -v] [--help | -h] [--copyright] [--<variable> <value>...]")
+	fmt.Println(prefixReplace, "[--repl] [--run <path> [params...]]")
+	fmt.Println(prefixReplace, "[--execute <command> [params...]] [--config <path>]")
 	fmt.Println(prefixReplace, "[simple <db-path> <input> <output> <tilesX x tilesY> [width x height]]")
+	fmt.Println(prefixReplace, "[quick <db-path> <input> <output> <tilesX x tilesY> [width x height]]")
 	fmt.Println(prefixReplace, "[metric <db-path> <input> <output> <tilesX x tilesY> <metric>]")
 	fmt.Println(prefixReplace, "[compare <db-path> <input> <output-dir> <tilesX x tilesY>]")
 	fmt.Println()
@@ -51,7 +54,12 @@ func usage() {
 		cmdDesc{"--help", []string{"Show this message and exit"}},
 		cmdDesc{"--version", []string{"Show version and exit"}},
 		cmdDesc{"--copyright", []string{"Show copyright information and exit"}},
-		cmdDesc{"--repl", []string{"Run interactive mode (Read–Eval–Print Loop)"}},
+		cmdDesc{"--<variable>", []string{
+			"Set a variable (the same as \"set <variable> <value>\"), for example",
+			"--routines 8 --variety random. Variables must be given before all",
+			"other arguments and are applied in all modes. Variables listed below.",
+		}},
+		cmdDesc{"--repl", []string{"Run interactive mode (Read–Eval–Print Loop), the default"}},
 		cmdDesc{"--run", []string{
 			"Run commands in the specified mosaic script file. Additional arguments",
 			"are used for variable replacements.",
@@ -62,6 +70,12 @@ func usage() {
 				"be separated by \";\".Additional arguments are used for variable",
 				"replacements.",
 			}},
+		cmdDesc{
+			"--config", []string{
+				"Create a mosaic as described in the configuration file (JSON if the",
+				"file ends with .json, YAML otherwise). The configuration contains",
+				"the database, query, output, tiles and all other options.",
+			}},
 		cmdDesc{
 			"simple", []string{
 				"Create a mosaic from images in the directory db-path. The image is",
@@ -70,8 +84,15 @@ func usage() {
 				"optional width and height specify the size of the output, if omitted",
 				"the mosaic has the same width and height as the input. You can also",
 				"specify only width or height and keep the ratio of the input image.",
-				"For example 1024x or x768.",
-				"Example: simple ~/Pictures/ input.jpg output.png 20x30 1024x",
+				"For example 1024x, x768, 50% or 2x.",
+				"Example: --routines 8 simple ~/Pictures/ input.jpg output.png 20x30 1024x",
+			}},
+		cmdDesc{
+			"quick", []string{
+				"The same as simple but the histograms are stored in db-path (for",
+				"example db-path/gch-8.gob). If the file exists only the histograms of",
+				"new images are computed, thus they're computed only once.",
+				"Example: quick ~/Pictures/ input.jpg output.png 20x30 1024x",
 			}},
 		cmdDesc{
 			"metric", []string{
@@ -97,59 +118,125 @@ func usage() {
 		}
 	}
 	fmt.Println()
+	fmt.Println("Available variables:")
+	fmt.Println(strings.Join(variables, " "))
+	fmt.Println()
 	fmt.Println("Available metrics:")
 	fmt.Println(strings.Join(gomosaic.GetHistogramMetricNames(), " "))
 }
 
+// mode describes what is executed, it's given by the flags and the first
+// argument.
+type mode struct {
+	help, version, copyright, repl bool
+	run, execute, config           string
+}
+
+// parseArgs parses the command line arguments, state is used to validate the
+// variables. It returns the mode, the variables set with flags and the
+// remaining arguments (the command like "simple" and its arguments or the
+// parameters of a script).
+func parseArgs(state *gomosaic.ExecutorState, args []string) (mode, map[string]string, []string) {
+	var m mode
+	names := state.VariableNames()
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.Usage = func() {
+		usage(names)
+	}
+	flags.BoolVar(&m.help, "help", false, "Show help and exit")
+	flags.BoolVar(&m.help, "h", false, "Show help and exit")
+	flags.BoolVar(&m.version, "version", false, "Show version and exit")
+	flags.BoolVar(&m.version, "v", false, "Show version and exit")
+	flags.BoolVar(&m.copyright, "copyright", false, "Show copyright information and exit")
+	flags.BoolVar(&m.repl, "repl", false, "Run interactive mode")
+	flags.StringVar(&m.run, "run", "", "Run commands in the script file")
+	flags.StringVar(&m.run, "script", "", "Run commands in the script file")
+	flags.StringVar(&m.execute, "execute", "", "Execute commands")
+	flags.StringVar(&m.config, "config", "", "Create a mosaic as described in the configuration file")
+	for _, name := range names {
+		flags.String(name, "", fmt.Sprintf("Set variable %s", name))
+	}
+	// errors are handled by the flag set (ExitOnError)
+	flags.Parse(args)
+	isVariable := make(map[string]bool, len(names))
+	for _, name := range names {
+		isVariable[name] = true
+	}
+	variables := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		if isVariable[f.Name] {
+			variables[f.Name] = f.Value.String()
+		}
+	})
+	// validate variables before anything is executed, the handlers only log
+	// errors
+	if varsErr := gomosaic.ApplyVariables(state, variables); varsErr != nil {
+		fmt.Fprintln(os.Stderr, "Error:", varsErr)
+		os.Exit(1)
+	}
+	return m, variables, flags.Args()
+}
+
 func main() {
 	if gomosaic.Debug {
 		fmt.Println("gomosaic is running in debug mode")
 	}
-	if len(os.Args) == 1 {
-		repl()
+	state := gomosaic.NewScriptHandler(nil).Init()
+	m, variables, args := parseArgs(state, os.Args[1:])
+	numModes := 0
+	for _, set := range []bool{m.repl, m.run != "", m.execute != "", m.config != ""} {
+		if set {
+			numModes++
+		}
+	}
+	// for --run and --execute the arguments are the parameters of the script
+	if numModes > 1 || (len(args) > 0 && (m.repl || m.config != "")) {
+		fmt.Fprintln(os.Stderr, "Error: Only one of --repl, --run, --execute, --config or a command can be used")
+		os.Exit(1)
 	}
-	switch os.Args[1] {
-	case "--help", "-h":
-		usage()
-	case "--version", "-v":
+	switch {
+	case m.help:
+		usage(state.VariableNames())
+	case m.version:
 		fmt.Println("gomsaic version", gomosaic.Version)
-	case "--copyright":
+	case m.copyright:
 		// hack, but fine
 		copyrightCommand(nil)
-	case "--repl":
-		repl()
-	case "--execute":
+	case m.repl:
+		repl(variables)
+	case m.execute != "":
 		// read commands and execute them, assume separation by semicolon
-		if len(os.Args) < 3 {
-			fmt.Fprintln(os.Stderr, "Error: exec requires a sequence of commands to execute")
-			os.Exit(1)
-		}
 		// now join them by \n so that scanner reads them correctly
-		cmds := strings.Replace(os.Args[2], ",", "\n", -1)
+		cmds := strings.Replace(m.execute, ",", "\n", -1)
 		r := strings.NewReader(cmds)
-		script(r, os.Args[3:]...)
-	case "--script", "--run":
-		if len(os.Args) < 3 {
-			fmt.Fprintln(os.Stderr, "Error: script requires a script file to execute")
-			os.Exit(1)
-		}
+		script(r, variables, args...)
+	case m.run != "":
 		// read file and execute
-		f, err := os.Open(os.Args[2])
+		f, err := os.Open(m.run)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "Error: Can't open script", err)
 			os.Exit(1)
 		}
 		defer f.Close()
-		script(f, os.Args[3:]...)
-	case "simple":
-		simple(os.Args[2:])
-	case "metric":
-		metric(os.Args[2:])
-	case "compare":
-		compare(os.Args[2:])
+		script(f, variables, args...)
+	case m.config != "":
+		runConfig(m.config, variables)
+	case len(args) == 0:
+		repl(variables)
 	default:
-		fmt.Fprintf(os.Stderr, "Invalid command \"%s\"\n", os.Args[1])
-		os.Exit(1)
+		switch args[0] {
+		case "simple":
+			simple(args[1:], variables)
+		case "quick":
+			quick(args[1:], variables)
+		case "metric":
+			metric(args[1:], variables)
+		case "compare":
+			compare(args[1:], variables)
+		default:
+			fmt.Fprintf(os.Stderr, "Invalid command \"%s\"\n", args[0])
+			os.Exit(1)
+		}
 	}
 }
 
@@ -159,6 +246,8 @@ func init() {
 	if gomosaic.Debug {
 		log.SetLevel(log.DebugLevel)
 	}
+	// the library doesn't log by default
+	gomosaic.SetLogger(gomosaic.NewLogrusLogger(nil))
 	// copy default commands, add additional methods
 	cmdMap = make(gomosaic.CommandMap, 20)
 	// This is a bit copy and paste, but DefaultCommands is also created in an
@@ -174,21 +263,28 @@ func init() {
 		Exec:        gomosaic.StatsCommand,
 		Usage:       "stats [var]",
 		Description: "Show value of variables that can be changed via set, if var is given only value of that variable",
+		Complete:    gomosaic.CompleteStats,
 	}
 	cmdMap["set"] = gomosaic.Command{
 		Exec:  gomosaic.SetVarCommand,
 		Usage: "set <variable> <value>",
 		Description: "Set value for a variable. For details about the variables" +
 			" please refer to the user documentation. To see all variables use \"stats\"",
+		Complete: gomosaic.CompleteSet,
 	}
 	cmdMap["cd"] = gomosaic.Command{
 		Exec:        gomosaic.CdCommand,
 		Usage:       "cd <dir>",
 		Description: "Change working directory to the specified directory",
+		Complete:    gomosaic.CompleteCd,
 	}
 	cmdMap["storage"] = gomosaic.Command{
-		Exec:  gomosaic.ImageStorageCommand,
-		Usage: "storage [list] or storage load [dir]",
+		Exec: gomosaic.ImageStorageCommand,
+		Usage: "storage [list] or storage load [dir] [recursive] [as <label>] or storage load --manifest <file> [--cache dir] or storage add <dir|file> [recursive]" +
+			" or storage remove <glob> or storage dedupe [exact | perceptual [max-dist]]" +
+			" or storage watch <dir> [recursive] [interval] or storage tags <file>" +
+			" or storage weight <file> or storage weight <glob> <weight>" +
+			" or storage filter [none | <conditions>]",
 		Description: "This command controls the images that are considered" +
 			" database images. This does not mean that all these images have some" +
 			" precomputed data, like histograms. Only that they were found as" +
@@ -197,43 +293,357 @@ func init() {
 			" note that this can be quite large\n\n" +
 			"If load is used the image storage will be initialized with images from" +
 			" the directory (working directory if no image provided). All previously" +
-			" loaded images will be removed from the storage.",
+			" loaded images will be removed from the storage. Files can be filtered" +
+			" with \"--include <patterns>\" and \"--exclude <patterns>\" (patterns" +
+			" separated by \",\"), for example \"storage load ~/Pictures true --exclude" +
+			" *thumb* --include *.jpg\". Symbolic links to directories are followed" +
+			" with \"--follow-symlinks true\". Images smaller than the variable" +
+			" min-image-size or with an aspect ratio above max-image-ratio are skipped." +
+			" \"--depth 2\" visits only subdirectories up to depth 2 in recursive mode." +
+			" The directories are read concurrently, the number of go routines is the" +
+			" variable routines.\n\n" +
+			"\"storage load --manifest <file>\" loads remote images: Each line of" +
+			" the manifest is a HTTP(S) URL or an S3 URL like s3://bucket/key (the" +
+			" objects must be public, \"--region eu-central-1\" selects the regional" +
+			" endpoint). All images are downloaded to the cache directory (default" +
+			" is the manifest file with the extension \".cache\") and the cached" +
+			" files are used as database images, images that are already cached" +
+			" are not downloaded again. Images that can't be downloaded are handled" +
+			" as described by image-errors.\n\n" +
+			"\"storage load ~/Cats as cats\" loads the images with the label cats:" +
+			" Only the images previously loaded as cats are replaced, all other" +
+			" images are kept (GCHs and LCHs are updated as with add). This way one" +
+			" storage can contain images from different directories, mosaics can" +
+			" be restricted to some labels with \"mosaic ... --only cats,dogs\"." +
+			" storage without arguments prints the number of images of each label.\n\n" +
+			"add adds the images from a directory (or a single image) to the storage," +
+			" remove removes all images matching the pattern (for example" +
+			" \"storage remove *thumb*\", a pattern without a directory is matched" +
+			" against the file name, otherwise against the path). Loaded GCHs and LCHs are updated" +
+			" accordingly: For new images they are computed, for removed images they" +
+			" are removed.\n\n" +
+			"dedupe removes duplicate images: exact (the default) finds files with" +
+			" identical content, perceptual finds images that look the same (for" +
+			" example the same photo with a different size). max-dist controls how" +
+			" similar images must be, 0 (the default) means that the image hashes" +
+			" must be equal, the maximum is 64.\n\n" +
+			"watch keeps the storage in sync with a directory until Ctrl+C is" +
+			" pressed: The directory is scanned every interval (default 2s) and new" +
+			" images are added, deleted images are removed (GCHs and LCHs are" +
+			" updated as with add and remove). The directory is polled, file system" +
+			" notifications are not used. New images that can't be read are skipped" +
+			" (independent of image-errors) and tried again on the next scan, errors" +
+			" are printed and don't stop watching.\n\n" +
+			"tags reads the tags of images from a .csv file (each line contains the" +
+			" path of an image followed by its tags, like \"beach/1.jpg,vacation,sea\")" +
+			" or a .json file (like {\"beach/1.jpg\": [\"vacation\", \"sea\"]}), relative" +
+			" paths are relative to the file. filter restricts the images used by mosaic," +
+			" mosaicgif and batch without changing the storage (GCHs and LCHs don't" +
+			" have to be re-computed). Conditions are of the form tag=values," +
+			" tag!=values, label=values or label!=values (values separated by \",\")," +
+			" an image is used if it fulfills all conditions, for example" +
+			" \"storage filter tag=vacation,beach label!=dogs\". \"storage filter none\"" +
+			" removes the filter.\n\n" +
+			"weight sets the weight of images: The metric value of an image is" +
+			" multiplied with its weight during the selection, thus images with a" +
+			" weight below 1 (like 0.5) are preferred and images with a weight above" +
+			" 1 are avoided. \"storage weight favorites/* 0.5\" sets the weight of all" +
+			" images matching the pattern (1 removes the weight), \"storage weight" +
+			" weights.csv\" reads the weights from a .csv file (lines like" +
+			" \"beach/1.jpg,0.5\") or a .json file (like {\"beach/1.jpg\": 0.5}). Weights" +
+			" are not supported by search ANN and variety Diffusion.",
+		Complete: gomosaic.CompleteStorage,
 	}
 	cmdMap["gch"] = gomosaic.Command{
-		Exec:  gomosaic.GCHCommand,
-		Usage: "gch create [k] or gch load <file> or gch save <file>",
+		Exec: gomosaic.GCHCommand,
+		Usage: "gch create [k] [--precision float64|float32] [--sparse true|false] or gch load <file> [--root dir] or gch save <file> [--precision float64|float32] [--sparse true|false] [--root dir]" +
+			" or gch update <file|dir> [k] or gch show <image> <out> [<other image>]",
 		Description: "Used to administrate global color histograms (GCHs)\n\n" +
 			"If \"create\" is used GCHs are created for all images in the current" +
 			" storage. The optional argument k must be a number between 1 and 256." +
 			" See usage documentation / Wiki for details about this value. 8 is the" +
-			" default value and should be fine.\n\nsave and load commands load files" +
-			" containing GHCs from a file.",
+			" default value and should be fine. With \"--precision float32\" the" +
+			" GCHs are kept with float32 entries in memory, this halves the memory" +
+			" required for the GCHs. With \"--sparse true\" only the non-zero" +
+			" entries are kept in memory. If an image can't be read (for" +
+			" example a corrupt file) the creation fails, with \"set image-errors" +
+			" skip\" such images are reported and removed from the storage (this" +
+			" also applies to \"lch create\" and \"feature create\").\n\nsave" +
+			" and load commands load files" +
+			" containing GHCs from a file. With \"--precision float32\" the" +
+			" histograms are saved with float32 entries, this halves the size of" +
+			" the file (such files are loaded with float32 precision, see" +
+			" \"create\"). With \"--sparse true\" only the non-zero entries are saved" +
+			" (such files are loaded as sparse histograms)." +
+			" Files ending with .gz (for example \"gch-8.gob.gz\") are gzip compressed." +
+			" With \"--root dir\" the paths of the images are saved relative to" +
+			" dir, this way the file can be used on another machine: Load it with" +
+			" \"--root\" set to the directory containing the images there.\n\n" +
+			"update loads the GCHs from a file (if it exists) and only computes the" +
+			" GCHs of images that are not contained in the file, the file is updated" +
+			" afterwards. If a directory is given the file is searched by its default" +
+			" name (for example \"gch-8.gob\"). This way the histograms of a database" +
+			" are only computed once.\n\n" +
+			"show draws the GCH of an image as a bar chart to out (.png, .jpg or" +
+			" .svg). If another image is given both GCHs are drawn below each other" +
+			" and their distance is printed, this shows why images are considered" +
+			" similar.",
+		Complete: gomosaic.CompleteGCH,
 	}
 	cmdMap["lch"] = gomosaic.Command{
 		Exec:  gomosaic.LCHCommand,
-		Usage: "lch create <k> <scheme> or lch load <file> or lch save <file>",
+		Usage: "lch create <k> <scheme> or lch load <file> [--root dir] or lch save <file> [--root dir]",
 		Description: "Used to administrate local color histograms (LCHs)\n\n" +
 			"\"crate\", \"load\" and \"save\" work as in the gch command. k is also" +
 			"the same as in the GCH command and scheme is the number of GCHs created" +
-			"for each image (must be either 4 or 5).",
+			"for each image: Either 4 or 5 or a grid like \"3x3\" (3 columns and 3" +
+			" rows), in this case a GCH is created for each part of the grid.\n\n" +
+			"The EXIF orientation of database images is applied by default (see" +
+			" \"set exif\"), LCHs that were computed without it (for example with" +
+			" an older version) don't match the rotated images and must be" +
+			" re-created. Changing exif drops the loaded LCHs and features.",
+		Complete: gomosaic.CompleteHistograms,
+	}
+	cmdMap["feature"] = gomosaic.Command{
+		Exec:  gomosaic.FeatureCommand,
+		Usage: "feature create <name> [key=value...] or feature load <file> [--root dir] or feature save <file> [--root dir] or feature list",
+		Description: "Used to administrate features of any kind (GCHs, LCHs, average" +
+			" colors, edge histograms, ...)\n\n" +
+			"create computes the features of all images in the current storage," +
+			" parameters are given as key=value, for example \"feature create gch" +
+			" k=8\", \"feature create lch k=8 scheme=3x3\" or \"feature create edge" +
+			" regions=4 bins=4 color=8 weight=0.5\" (edge histograms combined with GCHs)." +
+			" Features created for" +
+			" GCHs and LCHs are also used by the gch and lch selection. list shows" +
+			" all available features. save and load work as in the gch command.\n\n" +
+			"\"feature create embedding model=<file.onnx> [size=224]\" computes" +
+			" embeddings with a neural network, this requires gomosaic to be built" +
+			" with \"-tags onnx\". Use \"feature-cosine\" to compare embeddings.\n\n" +
+			"Use the selection \"feature-<metric>\" in the mosaic command to create" +
+			" a mosaic with the loaded features.",
+		Complete: gomosaic.CompleteFeature,
+	}
+	cmdMap["gray"] = gomosaic.Command{
+		Exec:  gomosaic.GrayCommand,
+		Usage: "gray create [k] or gray load <file> [--root dir] or gray save <file> [--root dir]",
+		Description: "Used to administrate luminance histograms for black-and-white" +
+			" mosaics\n\n" +
+			"create computes a 1D histogram of the gray values of all images in" +
+			" storage, k is the number of bins (between 1 and 256, defaults to 32)." +
+			" Luminance histograms are features, save and load work as in the feature" +
+			" command. Use the selection \"gray-<metric>\" (for example gray-euclid) in" +
+			" the mosaic command and \"set grayscale true\" to create a monochrome" +
+			" mosaic.",
+		Complete: gomosaic.CompleteGray,
+	}
+	cmdMap["bundle"] = gomosaic.Command{
+		Exec:  gomosaic.BundleCommand,
+		Usage: "bundle save <file> [--root dir] or bundle load <file> [--root dir]",
+		Description: "Saves all loaded GCHs and LCHs to one file or loads them" +
+			" from such a file. This simplifies the distribution of precomputed" +
+			" data. Files must end with .gob or .json, optionally followed by .gz" +
+			" for gzip compressed files. --root works as in the gch command.",
+		Complete: gomosaic.CompleteBundle,
+	}
+	cmdMap["alias"] = gomosaic.Command{
+		Exec:  gomosaic.AliasCommand,
+		Usage: "alias [<name> [\"<commands>\"]]",
+		Description: "Defines an alias: A new command that executes a sequence of" +
+			" commands. The commands are separated by \";\" and must be enclosed in" +
+			" quotes, the placeholders $1, $2, ... are replaced by the arguments of" +
+			" the alias. Example: alias quick \"storage load $1; gch create;" +
+			" mosaic $2 $3 gch-euclid 40x40\" can be used like quick ~/Pictures" +
+			" in.jpg out.jpg. An empty list of commands removes the alias, without" +
+			" commands the alias is shown and without arguments all aliases are" +
+			" listed. Aliases can also be defined in the [alias] section of the" +
+			" config file and are saved in sessions.",
+		Complete: gomosaic.CompleteAlias,
+	}
+	cmdMap["session"] = gomosaic.Command{
+		Exec:  gomosaic.SessionCommand,
+		Usage: "session save <file> or session load <file>",
+		Description: "Saves the current session to a file or restores a session" +
+			" from such a file. A session contains all variables (see \"stats\")," +
+			" the aliases, the working directory and the images in the storage. If GCHs or LCHs" +
+			" are loaded they're saved to a bundle next to the file (session.json" +
+			" uses session-features.gob). This way work can be resumed after a restart.",
+		Complete: gomosaic.CompleteSession,
 	}
 	cmdMap["mosaic"] = gomosaic.Command{
-		Exec:  gomosaic.MosaicCommand,
-		Usage: "mosaic <in> <out> <metric> <tiles> [dimension]",
+		Exec: gomosaic.MosaicCommand,
+		Usage: "mosaic <in> <out> <metric> <tiles> [dimension] [--overlay <opacity>] [--recurse <depth>]" +
+			" [--mask <mask> [--mask-metric <metric>]] [--shape <shape>] [--report <file.html>]" +
+			" [--heatmap <file.png>] [--only <labels>] [--preview <size>]" +
+			" or mosaic plan save <file> or mosaic plan render <file> <out> [dimension]" +
+			" or mosaic info <file>",
 		Description: "Creates a mosaic based on global color histograms (GCHs)." +
 			" in is the path to the query image, out the path to the output image" +
-			" (i.e. mosaic), metric is of the form gch-metric, e.g. gch-cosine." +
-			" a list of supported metrics is given below. tiles describes the number" +
+			" (i.e. mosaic), metric is of the form gch-metric, e.g. gch-cosine, feature-metric" +
+			" (features created with the feature command) or the name of a registered selector. a list of supported metrics is given below. tiles describes the number" +
 			" of tiles to use in the mosaic, for example \"30x20\" creates 30 times 20" +
 			" tiles (30 in x and 20 in y direction). dimension is optional a describes" +
 			" the dimensions of the output image. If omitted the dimensions of the input" +
 			" are used. For example 1024x768 creates a mosaic with 1024 width and 768" +
 			" height. A value can be omitted and the ratio of the query image is retained." +
 			" \"1024x\" means a mosaic with width 1024 and the height is computed by" +
-			" the query ratio. Also works in the other direction like \"x768\".\n\n" +
+			" the query ratio. Also works in the other direction like \"x768\"." +
+			" Percent values of the query size like \"50%\" or \"50%x25%\" and" +
+			" multipliers like \"2x\" are supported as well.\n\n" +
+			"The query image can be blended over the mosaic with \"--overlay 0.2\"," +
+			" the value is the opacity of the query image (between 0 and 1). If omitted" +
+			" the value of the variable overlay is used.\n\n" +
+			"With \"--recurse n\" each tile is itself rendered as a mosaic (with the" +
+			" same number of tiles), n is the depth of the recursion.\n\n" +
+			"\"--mask mask.png\" is a grayscale image with the importance of the" +
+			" regions of the query: Tiles in bright regions (like faces) are matched" +
+			" with the whole database without variety, the other tiles use the" +
+			" variety selector. \"--mask-metric\" is the metric for the bright" +
+			" regions (for example a stricter LCH metric), defaults to metric.\n\n" +
+			"Tiles that are fully transparent in the query are left empty" +
+			" (transparent in a png mosaic), \"--shape shape.png\" leaves all tiles" +
+			" empty that are black in shape.png. This way mosaics of logos or text" +
+			" can be created.\n\n" +
+			"\"--report report.html\" writes an HTML report of the mosaic: Hovering" +
+			" over a tile shows the database image used for the tile and its metric" +
+			" value (always computed with metric, image weights and the variety" +
+			" penalty are not included), the table of all tiles lists the best" +
+			" candidates of each tile as ranked by the selection.\n\n" +
+			"\"--heatmap heat.png\" saves an image of the size of the mosaic in which" +
+			" the brightness of each tile encodes the metric value of the image" +
+			" selected for it (black is the best, white the worst match). This shows" +
+			" the regions for which the database lacks fitting images.\n\n" +
+			"\"--only cats,dogs\" uses only the database images loaded with one of" +
+			" the labels (see \"storage load <dir> as <label>\").\n\n" +
+			"\"--preview 25%\" saves a low-resolution preview of the mosaic (here a" +
+			" quarter of the size) before the mosaic is composed, it's saved next to" +
+			" out with the suffix \"-preview\" (out-preview.jpg for out.jpg). The" +
+			" preview uses the same selection, so bad runs can be aborted before the" +
+			" expensive composition completes.\n\n" +
+			"The selection of the last mosaic can be saved with \"mosaic plan save plan.json\"" +
+			" and later be rendered again (without running the selection) with" +
+			" \"mosaic plan render plan.json out.png 4096x\". The images of the plan" +
+			" must be loaded in the storage, resize, tile-border and tile-border-color" +
+			" are taken from the current variables, colorize and overlay are not applied.\n\n" +
+			"The mosaic contains metadata (like the metric, the number of tiles" +
+			" and the number of database images), it is stored as text in png files" +
+			" and as EXIF data in jpg files. \"mosaic info out.png\" prints the" +
+			" metadata of a mosaic.\n\n" +
 			"Example Usage: \"mosaic in.jpg out.jpg gch-cosine 20x30 1024x768\". Valid " +
 			" metrics (each with prefix \"gch-\" like \"gch-cosine\"):\n\n" +
 			strings.Join(gomosaic.GetHistogramMetricNames(), " "),
+		Complete: gomosaic.CompleteMosaic,
+	}
+	cmdMap["mosaicgif"] = gomosaic.Command{
+		Exec:  gomosaic.MosaicGIFCommand,
+		Usage: "mosaicgif <in> <out.gif> <metric> <tiles> [dimension] [--delay <n>] [--overlay <opacity>]",
+		Description: "Creates an animated mosaic. in is either an animated GIF or a" +
+			" directory containing the frames as .jpg or .png files (sorted by name)." +
+			" A mosaic is created for each frame and the result is written as animated" +
+			" GIF to out. All other arguments are the same as for the mosaic command." +
+			" The delay between two frames (in 100ths of a second) is the delay of the" +
+			" input GIF, it can be set with \"--delay\" (default for directories is 10).",
+		Complete: gomosaic.CompleteMosaicGIF,
+	}
+	cmdMap["selfmosaic"] = gomosaic.Command{
+		Exec:  gomosaic.SelfMosaicCommand,
+		Usage: "selfmosaic <in> <out> <metric> <tiles> [dimension] [--patch <size>] [--step <size>] [--sources <files>]",
+		Description: "Creates a mosaic without the image storage: The database images" +
+			" are patches of the query image, for example \"--patch 16x16\" divides the" +
+			" query into patches of 16x16 pixels (default 32x32). \"--step 8x8\" creates" +
+			" overlapping patches whose corners are 8 pixels apart (default is the" +
+			" patch size). \"--sources a.jpg,b.jpg\" takes the patches from other" +
+			" images instead of the query. The GCHs of the patches are computed for" +
+			" each mosaic, metric must be a GCH metric like gch-cosine. All other" +
+			" arguments are the same as for the mosaic command, variety, best, seed," +
+			" layout, cut, resize, tile-border and cache are taken from the variables.",
+		Complete: gomosaic.CompleteSelfMosaic,
+	}
+	cmdMap["collage"] = gomosaic.Command{
+		Exec:  gomosaic.CollageCommand,
+		Usage: "collage <in> <out> <metric> [dimension] [--size <min-max>] [--rotation <degrees>] [--coverage <fraction>] [--images <n>] [--border <n>]",
+		Description: "Composes a scrapbook-style collage instead of a grid: Database images" +
+			" are placed at random positions with random sizes and rotations until" +
+			" the collage is covered. For each image the GCH of the query area below" +
+			" it is compared to the database images with metric (a GCH metric like" +
+			" gch-cosine), variety and best are taken from the variables. \"--size" +
+			" 32-128\" sets the length of the longer side of the images (default" +
+			" 32-128), large images are placed first. \"--rotation\" is the maximal" +
+			" rotation in degrees (default 15), \"--coverage\" the fraction of pixels" +
+			" that must be covered (default 0.98), \"--images\" limits the number of" +
+			" images (default 10000) and \"--border\" is the width of the white" +
+			" border around each image (default 2).",
+		Complete: gomosaic.CompleteCollage,
+	}
+	cmdMap["retile"] = gomosaic.Command{
+		Exec:  gomosaic.RetileCommand,
+		Usage: "retile <x> <y> [exclude|<file>]",
+		Description: "Replaces a single tile of the last mosaic created with the mosaic" +
+			" command, x and y are the column and row of the tile (starting with 0)." +
+			" The best image for the tile is selected again with the metric of the" +
+			" mosaic (without variety), \"exclude\" skips the image currently used" +
+			" for the tile and a file uses that image (which must be in the storage)." +
+			" The tile is replaced in the saved mosaic and in the plan, all other" +
+			" tiles stay the same. Recursive mosaics can't be retiled.",
+		Complete: gomosaic.CompleteRetile,
+	}
+	cmdMap["undo"] = gomosaic.Command{
+		Exec:  gomosaic.UndoCommand,
+		Usage: "undo",
+		Description: "Reverts the last command that changed the state: set, alias," +
+			" cd and the commands that change the storage or load / create" +
+			" precomputed data (like \"storage load\", \"gch create\" or \"session" +
+			" load\"). The last 20 changes can be undone, files written by" +
+			" commands (like mosaics or saved GCHs) are not changed.",
+	}
+	cmdMap["redo"] = gomosaic.Command{
+		Exec:        gomosaic.RedoCommand,
+		Usage:       "redo",
+		Description: "Restores the state after the last command reverted with undo.",
+	}
+	cmdMap["batch"] = gomosaic.Command{
+		Exec:  gomosaic.BatchCommand,
+		Usage: "batch <dir|glob> <out-dir> <metric> <tiles> [dimension] [--workers <n>] [--overlay <opacity>]",
+		Description: "Creates a mosaic for each query image in a directory (or each" +
+			" image matching the glob). The mosaics are saved in out-dir with the" +
+			" name of the query image. All other arguments are the same as for the" +
+			" mosaic command. The database images, features and the image cache are" +
+			" shared, the queries are processed by several workers in parallel" +
+			" (default 2, set with \"--workers\").",
+		Complete: gomosaic.CompleteBatch,
+	}
+	cmdMap["thumbnail"] = gomosaic.Command{
+		Exec:  gomosaic.ThumbnailCommand,
+		Usage: "thumbnail <in> <out> <size>",
+		Description: "Writes a resized copy of the image in to out. size has the" +
+			" same format as the dimension of the mosaic command, for example" +
+			" \"320x\", \"25%\" or \"0.5x\". The preprocessing of query images" +
+			" (see variable preprocess) is applied.",
+		Complete: gomosaic.CompleteThumbnail,
+	}
+	cmdMap["check"] = gomosaic.Command{
+		Exec:  gomosaic.CheckCommand,
+		Usage: "check [<in> <tiles> [dimension]] [--gch <file>]",
+		Description: "Validates the current session before a long run: All images in the" +
+			" storage are decoded and the loaded GCHs and LCHs are checked (one valid" +
+			" histogram for each image). With \"--gch file\" the GCHs in the file are" +
+			" compared with the images in the storage: The file must contain a GCH for" +
+			" each image and no GCHs of other images. If a query image and the number of tiles are" +
+			" given (as for the mosaic command) the number of tiles and the memory" +
+			" required to create the mosaic are estimated. Nothing is created.",
+		Complete: gomosaic.CompleteCheck,
+	}
+	cmdMap["bench"] = gomosaic.Command{
+		Exec:  gomosaic.BenchCommand,
+		Usage: "bench <in> <tiles> [dimension] [--feature gch|lch] [--varieties true|false] [--out <dir>]",
+		Description: "Compares the metrics for a query image: The selection is run with each" +
+			" metric (as gch-metric or lch-metric with \"--feature lch\"), for each" +
+			" metric the time of the selection, the mean metric value of all tiles" +
+			" and the number of distinct images used are reported. Note that the" +
+			" values of different metrics are not comparable. With \"--varieties true\"" +
+			" each metric is combined with each variety selector. With \"--out dir\"" +
+			" the mosaics are created in dir (like mosaic-gch-cosine.jpg) and the" +
+			" results are written to dir/bench.json.",
+		Complete: gomosaic.CompleteBench,
 	}
 
 	// add exit command
@@ -285,6 +695,16 @@ func helpCommand(state *gomosaic.ExecutorState, args ...string) error {
 			fmt.Printf("    %s\n", line)
 		}
 	}
+	fmt.Println()
+	fmt.Println("Control flow")
+	fmt.Println()
+	fmt.Println("  Usage: foreach <glob> [variable] ... end")
+	fmt.Println("    Run the commands until \"end\" for each file matching glob. $file is the")
+	fmt.Println("    path of the file and $file_name the name without extension. If variable")
+	fmt.Println("    is given it is used instead of file.")
+	fmt.Println()
+	fmt.Println("  Usage: if [not] exists <path> ... end")
+	fmt.Println("    Run the commands until \"end\" only if path exists (does not exist).")
 	return nil
 }
 
@@ -308,7 +728,7 @@ func copyrightCommand(state *gomosaic.ExecutorState, args ...string) error {
 	return nil
 }
 
-func repl() {
+func repl(variables map[string]string) {
 	// panics of Init in ReplHandler and all other panics
 	defer func() {
 		if r := recover(); r != nil {
@@ -317,15 +737,15 @@ func repl() {
 			os.Exit(1)
 		}
 	}()
-	gomosaic.Execute(gomosaic.ReplHandler{}, cmdMap)
+	gomosaic.Execute(gomosaic.ReplHandler{Variables: variables}, cmdMap)
 }
 
-func fromTemplate(template string, args ...string) {
+func fromTemplate(template string, variables map[string]string, args ...string) {
 	r := strings.NewReader(template)
-	script(r, args...)
+	script(r, variables, args...)
 }
 
-func script(r io.Reader, args ...string) {
+func script(r io.Reader, variables map[string]string, args ...string) {
 	// panics of Init in ScriptHandler and all other panics
 	defer func() {
 		if r := recover(); r != nil {
@@ -345,11 +765,31 @@ func script(r io.Reader, args ...string) {
 		}
 	}
 	h := gomosaic.NewScriptHandler(r)
+	h.Variables = variables
 
 	gomosaic.Execute(h, cmdMap)
 }
 
-func simple(args []string) {
+func runConfig(path string, variables map[string]string) {
+	cfg, cfgErr := gomosaic.ReadMosaicConfig(path)
+	if cfgErr != nil {
+		fmt.Fprintln(os.Stderr, "Error: Can't read config", cfgErr)
+		os.Exit(1)
+	}
+	// flags overwrite the variables of the config
+	if cfg.Variables == nil {
+		cfg.Variables = make(map[string]string, len(variables))
+	}
+	for name, value := range variables {
+		cfg.Variables[name] = value
+	}
+	if execErr := gomosaic.ExecuteConfig(cfg); execErr != nil {
+		fmt.Fprintln(os.Stderr, "Error:", execErr)
+		os.Exit(1)
+	}
+}
+
+func simple(args []string, variables map[string]string) {
 	// ~/Pictures/ input.jpg output.png 20x30 1024x
 	switch len(args) {
 	case 4:
@@ -360,18 +800,32 @@ func simple(args []string) {
 		fmt.Fprintln(os.Stderr, "Invalid syntax for --simple, requires 4 or 5 arguments, got", len(args))
 		os.Exit(1)
 	}
-	fromTemplate(gomosaic.RunSimple, args...)
+	fromTemplate(gomosaic.RunSimple, variables, args...)
+}
+
+func quick(args []string, variables map[string]string) {
+	// ~/Pictures/ input.jpg output.png 20x30 1024x
+	switch len(args) {
+	case 4:
+		args = append(args, "x")
+	case 5:
+		// do nothing
+	default:
+		fmt.Fprintln(os.Stderr, "Invalid syntax for quick, requires 4 or 5 arguments, got", len(args))
+		os.Exit(1)
+	}
+	fromTemplate(gomosaic.RunQuick, variables, args...)
 }
 
-func metric(args []string) {
+func metric(args []string, variables map[string]string) {
 	if len(args) != 6 {
 		fmt.Fprintln(os.Stderr, "Invalid syntax for --metric, requires exactly 6 arguments, got", len(args))
 		os.Exit(1)
 	}
-	fromTemplate(gomosaic.RunMetric, args...)
+	fromTemplate(gomosaic.RunMetric, variables, args...)
 }
 
-func compare(args []string) {
+func compare(args []string, variables map[string]string) {
 	switch len(args) {
 	case 4:
 		args = append(args, "x")
@@ -383,5 +837,5 @@ func compare(args []string) {
 	}
 	// this is a rather ugly fix for windows
 	cmd := filepath.FromSlash(gomosaic.CompareMetrics)
-	fromTemplate(cmd, args...)
+	fromTemplate(cmd, variables, args...)
 }
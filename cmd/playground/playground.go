@@ -32,6 +32,8 @@ func init() {
 	if gomosaic.Debug {
 		log.SetLevel(log.DebugLevel)
 	}
+	// the library doesn't log by default
+	gomosaic.SetLogger(gomosaic.NewLogrusLogger(nil))
 }
 
 func main() {
@@ -130,7 +132,7 @@ func main() {
 	// compose mosaic
 	fmt.Println("Composing mosaic image")
 	mosaic, mosaicErr := gomosaic.ComposeMosaic(storage, comp, dist,
-		gomosaic.DefaultResizer, gomosaic.ForceResize, 8, -1, nil)
+		gomosaic.DefaultResizer, gomosaic.ForceResize, nil, gomosaic.NoTileBorder, 8, nil, nil)
 	execTime = time.Since(start)
 	if mosaicErr != nil {
 		log.Fatal(mosaicErr)
@@ -148,7 +150,7 @@ func main() {
 	fmt.Println("Composing with random")
 	var sel gomosaic.ImageSelector
 	sel = gomosaic.RandomHeapImageSelector(gomosaic.NewHistogramImageMetric(histStorage, hMetric, 8),
-		2, 8)
+		2, 8, nil)
 	if initErr := sel.Init(storage); initErr != nil {
 		log.Fatal(initErr)
 	}
@@ -157,7 +159,7 @@ func main() {
 		log.Fatal(compseErr)
 	}
 	mosaic, mosaicErr = gomosaic.ComposeMosaic(storage, comp, dist, gomosaic.DefaultResizer,
-		gomosaic.ForceResize, 8, -1, nil)
+		gomosaic.ForceResize, nil, gomosaic.NoTileBorder, 8, nil, nil)
 	if mosaicErr != nil {
 		log.Fatal(mosaicErr)
 	}
@@ -267,7 +269,7 @@ func main2() {
 	// compose mosaic
 	fmt.Println("Composing mosaic image")
 	mosaic, mosaicErr := gomosaic.ComposeMosaic(storage, comp, dist,
-		gomosaic.DefaultResizer, gomosaic.ForceResize, 8, -1, nil)
+		gomosaic.DefaultResizer, gomosaic.ForceResize, nil, gomosaic.NoTileBorder, 8, nil, nil)
 	execTime = time.Since(start)
 	if mosaicErr != nil {
 		log.Fatal(mosaicErr)
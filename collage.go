@@ -0,0 +1,358 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/rand"
+)
+
+// This file contains collages: Instead of dividing the query into tiles the
+// database images are placed at random positions with random sizes and
+// rotations until the canvas is covered, producing a scrapbook-style image.
+// For each placement the region of the query below the image is compared to
+// the database images with a histogram metric, one of the best fitting images
+// is used.
+
+// Defaults for the options of collages.
+const (
+	DefaultCollageMinSize     = 32
+	DefaultCollageMaxSize     = 128
+	DefaultCollageMaxRotation = 15.0
+	DefaultCollageCoverage    = 0.98
+	DefaultCollageMaxImages   = 10000
+)
+
+// CollageOptions describes how a collage is composed.
+//
+// The longer side of each placed image is between MinSize and MaxSize pixels,
+// large images are placed first and the sizes decrease as the canvas gets
+// covered, thus small images fill the gaps. Each image is rotated by a random
+// angle in [-MaxRotation, MaxRotation] degrees.
+//
+// Images are placed until a fraction of Coverage pixels of the canvas is
+// covered or MaxImages images are placed. The image for each placement is
+// chosen randomly among the BestFit best images. Border is drawn around each
+// image (before it's rotated), Background fills the pixels that are not
+// covered.
+type CollageOptions struct {
+	MinSize, MaxSize int
+	MaxRotation      float64
+	Coverage         float64
+	MaxImages        int
+	BestFit          int
+	Border           TileBorder
+	Background       color.Color
+}
+
+// DefaultCollageOptions returns the default options: A white border of two
+// pixels and a white background.
+func DefaultCollageOptions() CollageOptions {
+	return CollageOptions{
+		MinSize:     DefaultCollageMinSize,
+		MaxSize:     DefaultCollageMaxSize,
+		MaxRotation: DefaultCollageMaxRotation,
+		Coverage:    DefaultCollageCoverage,
+		MaxImages:   DefaultCollageMaxImages,
+		BestFit:     1,
+		Border:      TileBorder{Width: 2, Color: color.White},
+		Background:  color.White,
+	}
+}
+
+// Validate returns an error if the options are invalid.
+func (options CollageOptions) Validate() error {
+	if options.MinSize <= 0 || options.MaxSize < options.MinSize {
+		return fmt.Errorf("Invalid collage image sizes: Must be 0 < min ≤ max, got min %d and max %d",
+			options.MinSize, options.MaxSize)
+	}
+	if options.Coverage <= 0.0 || options.Coverage > 1.0 {
+		return fmt.Errorf("Collage coverage must be in (0, 1], got %v", options.Coverage)
+	}
+	if options.MaxRotation < 0.0 || options.MaxRotation > 180.0 {
+		return fmt.Errorf("Collage rotation must be between 0 and 180 degrees, got %v", options.MaxRotation)
+	}
+	if options.MaxImages <= 0 {
+		return fmt.Errorf("Maximal number of collage images must be positive, got %d", options.MaxImages)
+	}
+	if options.BestFit <= 0 {
+		return fmt.Errorf("Number of best fitting collage images must be positive, got %d", options.BestFit)
+	}
+	if options.Border.Width < 0 {
+		return fmt.Errorf("Collage border must be ≥ 0, got %d", options.Border.Width)
+	}
+	return nil
+}
+
+// CollagePlacement describes an image placed in a collage: Bounds are the
+// bounds of the (rotated) image in the collage, Rotation the angle in
+// degrees.
+type CollagePlacement struct {
+	Image    ImageID
+	Bounds   image.Rectangle
+	Rotation float64
+}
+
+// Collage is the result of ComposeCollage, Placements are sorted in the order
+// in which the images were drawn.
+type Collage struct {
+	Image      *image.NRGBA
+	Placements []CollagePlacement
+	Coverage   float64
+}
+
+// RotateImage rotates img by the given angle in degrees (counterclockwise).
+// The result is large enough to contain the whole rotated image, pixels that
+// are not covered by img are transparent. Nearest neighbour sampling is used.
+func RotateImage(img image.Image, degrees float64) *image.NRGBA {
+	bounds := img.Bounds()
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	rad := degrees * math.Pi / 180.0
+	sin, cos := math.Sin(rad), math.Cos(rad)
+	resW := int(math.Ceil(math.Abs(w*cos) + math.Abs(h*sin)))
+	resH := int(math.Ceil(math.Abs(w*sin) + math.Abs(h*cos)))
+	res := image.NewNRGBA(image.Rect(0, 0, resW, resH))
+	cx, cy := w/2.0, h/2.0
+	rcx, rcy := float64(resW)/2.0, float64(resH)/2.0
+	for y := 0; y < resH; y++ {
+		for x := 0; x < resW; x++ {
+			// inverse rotation of the center of the pixel (y points down, thus
+			// the signs are swapped)
+			dx, dy := float64(x)+0.5-rcx, float64(y)+0.5-rcy
+			srcX := int(math.Floor(cos*dx - sin*dy + cx))
+			srcY := int(math.Floor(sin*dx + cos*dy + cy))
+			if srcX < 0 || srcY < 0 || srcX >= bounds.Dx() || srcY >= bounds.Dy() {
+				continue
+			}
+			res.Set(x, y, img.At(bounds.Min.X+srcX, bounds.Min.Y+srcY))
+		}
+	}
+	return res
+}
+
+// collageState is the state of ComposeCollage.
+type collageState struct {
+	CollageOptions
+	storage    ImageStorage
+	histograms HistogramStorage
+	metric     HistogramMetric
+	query      SubImager
+	queryRect  image.Rectangle
+	resizer    ImageResizer
+	cache      *ImageCache
+	randGen    *rand.Rand
+	canvas     *image.NRGBA
+	covered    []bool
+	numCovered int
+}
+
+// uncoveredPoint returns a random point of the canvas that is not covered yet.
+func (s *collageState) uncoveredPoint() image.Point {
+	bounds := s.canvas.Bounds()
+	width := bounds.Dx()
+	for try := 0; try < 64; try++ {
+		i := s.randGen.Intn(len(s.covered))
+		if !s.covered[i] {
+			return image.Pt(i%width, i/width)
+		}
+	}
+	// almost everything is covered, search from a random offset
+	offset := s.randGen.Intn(len(s.covered))
+	for k := range s.covered {
+		i := (offset + k) % len(s.covered)
+		if !s.covered[i] {
+			return image.Pt(i%width, i/width)
+		}
+	}
+	return image.Pt(0, 0)
+}
+
+// bestImage returns one of the BestFit images that match the area of the
+// canvas best.
+func (s *collageState) bestImage(area image.Rectangle) (ImageID, error) {
+	canvasBounds := s.canvas.Bounds()
+	// map the area to the query
+	scaleX := float64(s.queryRect.Dx()) / float64(canvasBounds.Dx())
+	scaleY := float64(s.queryRect.Dy()) / float64(canvasBounds.Dy())
+	queryArea := image.Rect(
+		s.queryRect.Min.X+int(float64(area.Min.X)*scaleX),
+		s.queryRect.Min.Y+int(float64(area.Min.Y)*scaleY),
+		s.queryRect.Min.X+int(math.Ceil(float64(area.Max.X)*scaleX)),
+		s.queryRect.Min.Y+int(math.Ceil(float64(area.Max.Y)*scaleY)),
+	).Intersect(s.queryRect)
+	if queryArea.Empty() {
+		return NoImageID, errors.New("Can't map collage area to query")
+	}
+	queryHist := GenHistogram(s.query.SubImage(queryArea), s.histograms.Divisions(), true)
+	heap := NewImageHeap(s.BestFit)
+	numImages := s.storage.NumImages()
+	for id := ImageID(0); id < numImages; id++ {
+		hist, histErr := s.histograms.GetHistogram(id)
+		if histErr != nil {
+			return NoImageID, histErr
+		}
+		heap.Add(id, s.metric(queryHist, hist))
+	}
+	view := heap.GetView()
+	if len(view) == 0 {
+		return NoImageID, errors.New("No images in storage")
+	}
+	return view[s.randGen.Intn(len(view))].Image, nil
+}
+
+// loadImage returns the image resized s.t. its longer side is size pixels.
+// Images are cached in the size MaxSize, smaller versions are computed from
+// the cached version.
+func (s *collageState) loadImage(id ImageID, size int) (image.Image, error) {
+	img := s.cache.Get(id, s.MaxSize, s.MaxSize)
+	if img == nil {
+		loaded, loadErr := LoadImageSized(s.storage, id, uint(s.MaxSize), uint(s.MaxSize))
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		img = s.fit(loaded, s.MaxSize)
+		s.cache.Put(id, s.MaxSize, s.MaxSize, img)
+	}
+	return s.fit(img, size), nil
+}
+
+// fit resizes img s.t. its longer side is size pixels, keeping the ratio.
+func (s *collageState) fit(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := size, size
+	if bounds.Dx() >= bounds.Dy() {
+		height = IntMax(1, bounds.Dy()*size/IntMax(1, bounds.Dx()))
+	} else {
+		width = IntMax(1, bounds.Dx()*size/IntMax(1, bounds.Dy()))
+	}
+	if bounds.Dx() == width && bounds.Dy() == height {
+		return img
+	}
+	return s.resizer.Resize(uint(width), uint(height), img)
+}
+
+// withBorder returns img surrounded by the border.
+func (s *collageState) withBorder(img image.Image) image.Image {
+	if s.Border.Width <= 0 {
+		return img
+	}
+	bounds := img.Bounds()
+	res := image.NewNRGBA(image.Rect(0, 0, bounds.Dx()+2*s.Border.Width, bounds.Dy()+2*s.Border.Width))
+	draw.Draw(res, res.Bounds(), image.NewUniform(s.Border.Color), image.ZP, draw.Src)
+	draw.Draw(res, image.Rect(s.Border.Width, s.Border.Width, s.Border.Width+bounds.Dx(), s.Border.Width+bounds.Dy()),
+		img, bounds.Min, draw.Src)
+	return res
+}
+
+// place draws img centered at the given point and updates the covered
+// pixels. It returns the bounds of the image on the canvas.
+func (s *collageState) place(img *image.NRGBA, center image.Point) image.Rectangle {
+	size := img.Bounds().Size()
+	min := center.Sub(size.Div(2))
+	area := image.Rectangle{Min: min, Max: min.Add(size)}
+	draw.Draw(s.canvas, area, img, image.ZP, draw.Over)
+	canvasBounds := s.canvas.Bounds()
+	visible := area.Intersect(canvasBounds)
+	for y := visible.Min.Y; y < visible.Max.Y; y++ {
+		for x := visible.Min.X; x < visible.Max.X; x++ {
+			if img.NRGBAAt(x-min.X, y-min.Y).A == 0 {
+				continue
+			}
+			i := (y-canvasBounds.Min.Y)*canvasBounds.Dx() + (x - canvasBounds.Min.X)
+			if !s.covered[i] {
+				s.covered[i] = true
+				s.numCovered++
+			}
+		}
+	}
+	return area
+}
+
+// ComposeCollage composes a collage of the query with the given bounds: The
+// images of storage are placed at random positions until the canvas is covered
+// (see CollageOptions). Each image is chosen by comparing the histogram of the
+// query area below the image with the histograms of the database images using
+// metric.
+//
+// Random numbers are generated by randGen, progress (if not nil) is called
+// after each placed image with the number of placed images.
+func ComposeCollage(storage ImageStorage, histograms HistogramStorage, metric HistogramMetric,
+	query image.Image, bounds image.Rectangle, resizer ImageResizer, options CollageOptions,
+	randGen *rand.Rand, progress ProgressFunc) (*Collage, error) {
+	if validateErr := options.Validate(); validateErr != nil {
+		return nil, validateErr
+	}
+	if storage.NumImages() == 0 {
+		return nil, errors.New("No images in storage")
+	}
+	if bounds.Empty() {
+		return nil, errors.New("Collage bounds are empty")
+	}
+	s := collageState{
+		CollageOptions: options,
+		storage:        storage,
+		histograms:     histograms,
+		metric:         metric,
+		query:          AsSubImager(query),
+		queryRect:      query.Bounds(),
+		resizer:        resizer,
+		cache:          NewImageCache(int(storage.NumImages())),
+		randGen:        randGen,
+		canvas:         image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy())),
+		covered:        make([]bool, bounds.Dx()*bounds.Dy()),
+	}
+	if options.Background != nil {
+		draw.Draw(s.canvas, s.canvas.Bounds(), image.NewUniform(options.Background), image.ZP, draw.Src)
+	}
+	res := &Collage{Image: s.canvas}
+	target := int(math.Ceil(options.Coverage * float64(len(s.covered))))
+	for s.numCovered < target && len(res.Placements) < options.MaxImages {
+		coverage := float64(s.numCovered) / float64(len(s.covered))
+		// large images first, as the canvas gets covered the sizes decrease
+		maxSize := options.MaxSize - int(coverage*float64(options.MaxSize-options.MinSize))
+		size := options.MinSize + s.randGen.Intn(maxSize-options.MinSize+1)
+		center := s.uncoveredPoint()
+		area := image.Rect(center.X-size/2, center.Y-size/2, center.X-size/2+size, center.Y-size/2+size)
+		id, bestErr := s.bestImage(area.Intersect(s.canvas.Bounds()))
+		if bestErr != nil {
+			return nil, bestErr
+		}
+		img, loadErr := s.loadImage(id, size)
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		rotation := 0.0
+		if options.MaxRotation > 0.0 {
+			rotation = (2.0*s.randGen.Float64() - 1.0) * options.MaxRotation
+		}
+		rotated := RotateImage(s.withBorder(img), rotation)
+		placed := s.place(rotated, center)
+		res.Placements = append(res.Placements, CollagePlacement{
+			Image:    id,
+			Bounds:   placed,
+			Rotation: rotation,
+		})
+		if progress != nil {
+			progress(len(res.Placements))
+		}
+	}
+	res.Coverage = float64(s.numCovered) / float64(len(s.covered))
+	return res, nil
+}
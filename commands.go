@@ -19,7 +19,8 @@ import (
 	"errors"
 	"fmt"
 	"image"
-	"image/jpeg"
+	"image/color"
+	"image/draw"
 	"image/png"
 	"io"
 	"os"
@@ -28,10 +29,13 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/nfnt/resize"
+	log "github.com/sirupsen/logrus"
 )
 
 var (
@@ -40,14 +44,50 @@ var (
 	ErrCmdSyntaxErr = errors.New("invalid command syntax")
 )
 
+// CmdVarietySelector describes the variety selector used to select the
+// database images: Without variety (CmdVarietyNone) the best image is chosen
+// for each tile, the other selectors trade some accuracy for more diverse
+// mosaics. It is used by the REPL ("set variety"), the command line flags and
+// MosaicBuilder.
+//
+// String and ParseCMDVarietySelector are symmetric: Parsing the result of
+// String returns the same selector. The selector can be encoded as JSON (or
+// any other text format) with its String representation.
 type CmdVarietySelector int
 
 const (
+	// CmdVarietyNone selects the best image for each tile.
 	CmdVarietyNone CmdVarietySelector = iota
+	// CmdVarietyRand selects a random image from the best images, see
+	// RandomHeapImageSelector.
 	CmdVarietyRand
+	// CmdVarietyMetric is reserved for metric based variety, it's not
+	// supported by all commands.
 	CmdVarietyMetric
+	// CmdVarietyPenalty penalizes images that are used often, see
+	// UsagePenaltyImageSelector.
+	CmdVarietyPenalty
+	// CmdVarietyAssignment uses each image at most a fixed number of times,
+	// see AssignmentSelector.
+	CmdVarietyAssignment
+	// CmdVarietyDiffusion distributes the color error to neighboring tiles,
+	// see ErrorDiffusionSelector.
+	CmdVarietyDiffusion
 )
 
+// cmdVarietyNames are the names of the selectors as returned by String.
+var cmdVarietyNames = []string{"none", "random", "metric", "penalty", "assignment", "diffusion"}
+
+// CmdVarietyNames returns the names of all variety selectors (in the order of
+// the constants), each name can be parsed with ParseCMDVarietySelector.
+func CmdVarietyNames() []string {
+	res := make([]string, len(cmdVarietyNames))
+	copy(res, cmdVarietyNames)
+	return res
+}
+
+// DisplayString returns the name of the selector for output to the user, for
+// example "Random".
 func (s CmdVarietySelector) DisplayString() string {
 	switch s {
 	case CmdVarietyNone:
@@ -56,21 +96,196 @@ func (s CmdVarietySelector) DisplayString() string {
 		return "Random"
 	case CmdVarietyMetric:
 		return "Metric"
+	case CmdVarietyPenalty:
+		return "Penalty"
+	case CmdVarietyAssignment:
+		return "Assignment"
+	case CmdVarietyDiffusion:
+		return "Diffusion"
 	default:
 		return "Unknown"
 	}
 }
 
+// String returns the name of the selector as accepted by
+// ParseCMDVarietySelector, for example "random".
+func (s CmdVarietySelector) String() string {
+	if s < 0 || int(s) >= len(cmdVarietyNames) {
+		return fmt.Sprintf("CmdVarietySelector(%d)", int(s))
+	}
+	return cmdVarietyNames[s]
+}
+
+// ParseCMDVarietySelector parses the name of a variety selector (case
+// insensitive), see String.
 func ParseCMDVarietySelector(s string) (CmdVarietySelector, error) {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	for i, name := range cmdVarietyNames {
+		if lower == name {
+			return CmdVarietySelector(i), nil
+		}
+	}
+	return -1, fmt.Errorf("unkown variety type: %s", s)
+}
+
+// MarshalText implements encoding.TextMarshaler, the result is the String
+// representation.
+func (s CmdVarietySelector) MarshalText() ([]byte, error) {
+	if s < 0 || int(s) >= len(cmdVarietyNames) {
+		return nil, fmt.Errorf("Invalid variety selector %d", int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, see
+// ParseCMDVarietySelector.
+func (s *CmdVarietySelector) UnmarshalText(text []byte) error {
+	val, parseErr := ParseCMDVarietySelector(string(text))
+	if parseErr != nil {
+		return parseErr
+	}
+	*s = val
+	return nil
+}
+
+// CmdLayout describes how the query image (and mosaic) is divided into tiles.
+type CmdLayout int
+
+const (
+	CmdLayoutGrid CmdLayout = iota
+	CmdLayoutBrick
+	CmdLayoutQuadtree
+	CmdLayoutJitter
+	// CmdLayoutCustom is a divider registered with RegisterDivider, the name
+	// is stored in ExecutorState.CustomLayout.
+	CmdLayoutCustom
+)
+
+func (l CmdLayout) DisplayString() string {
+	switch l {
+	case CmdLayoutGrid:
+		return "Grid"
+	case CmdLayoutBrick:
+		return "Brick"
+	case CmdLayoutQuadtree:
+		return "Quadtree"
+	case CmdLayoutJitter:
+		return "Jitter"
+	case CmdLayoutCustom:
+		return "Custom"
+	default:
+		return "Unknown"
+	}
+}
+
+// ParseCmdLayout parses the name of a built-in layout (case insensitive):
+// "grid", "brick", "quadtree" or "jitter". Custom layouts are looked up in the
+// registry instead, see RegisterDivider.
+func ParseCmdLayout(s string) (CmdLayout, error) {
+	switch strings.ToLower(s) {
+	case "grid":
+		return CmdLayoutGrid, nil
+	case "brick":
+		return CmdLayoutBrick, nil
+	case "quadtree":
+		return CmdLayoutQuadtree, nil
+	case "jitter":
+		return CmdLayoutJitter, nil
+	default:
+		return -1, fmt.Errorf("unkown layout: %s", s)
+	}
+}
+
+// CmdOrientations describes in which orientations database images are
+// considered during mosaic generation.
+type CmdOrientations int
+
+const (
+	CmdOrientationsNone CmdOrientations = iota
+	CmdOrientationsRotate
+	CmdOrientationsMirror
+	CmdOrientationsAll
+)
+
+func (o CmdOrientations) DisplayString() string {
+	switch o {
+	case CmdOrientationsNone:
+		return "None"
+	case CmdOrientationsRotate:
+		return "Rotate"
+	case CmdOrientationsMirror:
+		return "Mirror"
+	case CmdOrientationsAll:
+		return "All"
+	default:
+		return "Unknown"
+	}
+}
+
+// Orientations returns the list of orientations, nil for
+// CmdOrientationsNone.
+func (o CmdOrientations) Orientations() []Orientation {
+	switch o {
+	case CmdOrientationsRotate:
+		return RotateOrientations
+	case CmdOrientationsMirror:
+		return MirrorOrientations
+	case CmdOrientationsAll:
+		return AllOrientations
+	default:
+		return nil
+	}
+}
+
+// ParseCmdOrientations parses the orientations (case insensitive): "none",
+// "rotate", "mirror" or "all", see Orientations.
+func ParseCmdOrientations(s string) (CmdOrientations, error) {
 	switch strings.ToLower(s) {
 	case "none":
-		return CmdVarietyNone, nil
-	case "random":
-		return CmdVarietyRand, nil
-	case "metric":
-		return CmdVarietyMetric, nil
+		return CmdOrientationsNone, nil
+	case "rotate":
+		return CmdOrientationsRotate, nil
+	case "mirror":
+		return CmdOrientationsMirror, nil
+	case "all":
+		return CmdOrientationsAll, nil
+	default:
+		return -1, fmt.Errorf("unkown orientations: %s", s)
+	}
+}
+
+// CmdSearch describes how the most fitting database image for a tile is
+// found.
+type CmdSearch int
+
+const (
+	// CmdSearchExact compares each tile with all database images.
+	CmdSearchExact CmdSearch = iota
+	// CmdSearchANN uses an approximate nearest neighbor index, see ANNSelector.
+	CmdSearchANN
+)
+
+func (s CmdSearch) DisplayString() string {
+	switch s {
+	case CmdSearchExact:
+		return "Exact"
+	case CmdSearchANN:
+		return "ANN"
 	default:
-		return -1, fmt.Errorf("unkown variety type: %s", s)
+		return "Unknown"
+	}
+}
+
+// ParseCmdSearch parses the search strategy (case insensitive): "exact" or
+// "ann".
+func ParseCmdSearch(s string) (CmdSearch, error) {
+	switch strings.ToLower(s) {
+	case "exact":
+		return CmdSearchExact, nil
+	case "ann":
+		return CmdSearchANN, nil
+	default:
+		return -1, fmt.Errorf("unkown search: %s", s)
 	}
 }
 
@@ -100,14 +315,21 @@ type ExecutorState struct {
 
 	// GCHStorage stores the global color histograms. Whenever new images are
 	// loaded the old histograms become invalid (set to nil again) and must
-	// be reloaded / created.
-	GCHStorage *MemoryHistStorage
+	// be reloaded / created. It's a CompactHistStorage if the GCHs were
+	// created or loaded with float32 precision and a SparseHistStorage if they
+	// were created or loaded as sparse histograms.
+	GCHStorage HistogramList
 
 	// LCHStorage stores the local color histograms. Whenever new images are
 	// loaded the old histograms become invalid (set to nil again) and must
 	// be reloaded / created.
 	LCHStorage *MemoryLCHStorage
 
+	// Features stores the features created with the feature command (see
+	// FeatureExtractor). Whenever new images are loaded the old features become
+	// invalid (set to nil again) and must be reloaded / created.
+	Features *MemoryFeatureStorage
+
 	// Verbose is true if detailed output should be generated.
 	Verbose bool
 
@@ -140,13 +362,18 @@ type ExecutorState struct {
 	// 100.
 	JPGQuality int
 
+	// PNGCompression is the compression level used when storing png images.
+	// The images are encoded with NumRoutines go routines, see
+	// EncodePNGParallel.
+	PNGCompression png.CompressionLevel
+
 	// InterP is the interpolation functions used when resizing the images.
 	InterP resize.InterpolationFunction
 
 	// Cache size is the size of the image cache during mosaic composition.
 	// The more elements in the cache the faster the composition process is, but
-	// it also increases memory consumption. If cache size is < 0 the
-	// DefaultCacheSize is used.
+	// it also increases memory consumption. If cache size is ≤ 0 the
+	// ImageCacheSize is used.
 	CacheSize int
 
 	// VarietySelector is the current variety selector, defaults to
@@ -156,6 +383,169 @@ type ExecutorState struct {
 	// BestFit is the percent value (between 0 and 1) that describes how much
 	// percent of the input images are considered in the variety heaps.
 	BestFit float64
+
+	// Prefilter is the percent value (between 0 and 1) of database images that
+	// are kept for each tile by comparing the average colors before the metric
+	// is evaluated, see PrefilteredImageMetricMinimizer. 0 (the default)
+	// disables the prefilter. It's only used with variety "None".
+	Prefilter float64
+
+	// Seed is the seed used by the random variety selector. If it is negative
+	// (the default) the selector is seeded with the current time, otherwise the
+	// same command always produces the same mosaic.
+	Seed int64
+
+	// PenaltyWeight is the weight used by the penalty variety selector, see
+	// UsagePenaltySelector.
+	PenaltyWeight float64
+
+	// AssignmentCap is the number of times each image can be used by the
+	// assignment variety selector, see AssignmentSelector.
+	AssignmentCap int
+
+	// MaxUsage is the maximal number of tiles each image is used for, 0 (the
+	// default) means no limit. See UsageConstraints.
+	MaxUsage int
+
+	// RequiredImages are patterns of images that must be used at least once in
+	// a mosaic (see MatchPathPattern and UsageConstraints), nil means no
+	// required images.
+	RequiredImages []string
+
+	// MinImages is the minimum number of distinct images in a mosaic, if a
+	// selection uses fewer images it falls back to a round-robin selection,
+	// see MinDistinctSelector. 0 (the default) disables the check.
+	MinImages int
+
+	// ComposeErrors describes how the mosaic command handles tiles that can't
+	// be composed, defaults to ComposeFailFast. With ComposeBestEffort the
+	// failed tiles are reported and left empty.
+	ComposeErrors ComposeErrorPolicy
+
+	// ImageErrors describes how GCHs, LCHs and features are created if a
+	// database image can't be read (for example a corrupt file), defaults to
+	// ImageErrorsFail. With ImageErrorsSkip the images are reported and
+	// removed from the storage.
+	ImageErrors ImageErrorPolicy
+
+	// Prefetch is the number of tiles the database images are loaded ahead
+	// during the composition of a mosaic, see Prefetcher. It is limited by the
+	// cache size, 0 (the default) disables prefetching.
+	Prefetch int
+
+	// MaxMemory is the memory budget for creating histograms and mosaics, see
+	// MemoryBudget. Operations that exceed the budget are run with fewer
+	// routines or a smaller image cache, or refused. 0 (the default) means no
+	// restriction.
+	MaxMemory MemoryBudget
+
+	// MetricCacheSize is the number of metric values cached for the variety
+	// selectors, see MetricCache. The values are reused by later mosaic
+	// commands as long as the features don't change. 0 (the default) disables
+	// the cache.
+	MetricCacheSize int
+
+	// Pyramid is the number of levels of the image pyramids used to compose
+	// mosaics, see PyramidStorage. 0 (the default) disables pyramids.
+	Pyramid int
+
+	// PyramidDir is the directory the image pyramids are stored in, if it is
+	// empty DefaultPyramidDir is used.
+	PyramidDir string
+
+	// Strategy is the name of the resize strategy used to scale database images
+	// to the tile size, see GetResizeStrategy. Defaults to "force".
+	Strategy string
+
+	// Colorize is a value between 0 and 1 that describes how strong the tiles of
+	// the mosaic are tinted towards the average color of the query tile.
+	// 0 (the default) disables colorization, see ColorizeTransform.
+	Colorize float64
+
+	// Overlay is a value between 0 and 1 that describes the opacity of the
+	// query image blended over the mosaic. 0 (the default) disables the
+	// overlay, see OverlayImage.
+	Overlay float64
+
+	// Grayscale is true if the tiles of the mosaic should be desaturated, see
+	// GrayscaleTransform.
+	Grayscale bool
+
+	// TileBorder is the width of the border drawn around each tile, 0 (the
+	// default) means no border.
+	TileBorder int
+
+	// TileBorderColor is the color of the border drawn around each tile,
+	// defaults to black.
+	TileBorderColor color.RGBA
+
+	// Layout is the layout of the tiles in the mosaic, defaults to
+	// CmdLayoutGrid.
+	Layout CmdLayout
+
+	// CustomLayout is the name of the registered divider used if Layout is
+	// CmdLayoutCustom, see RegisterDivider.
+	CustomLayout string
+
+	// Jitter is the maximal offset of the tile boundaries (relative to the
+	// tile size) if Layout is CmdLayoutJitter, see JitterDivider. Defaults to
+	// DefaultJitter.
+	Jitter float64
+
+	// Orientations describes if database images are also considered rotated
+	// and / or mirrored, defaults to CmdOrientationsNone.
+	Orientations CmdOrientations
+
+	// MinImageWidth and MinImageHeight are the minimal dimensions of database
+	// images, smaller images are skipped when loading the storage. 0 (the
+	// default) means no restriction.
+	MinImageWidth, MinImageHeight int
+
+	// MaxImageRatio is the maximal aspect ratio (longer side divided by shorter
+	// side) of database images, images with a more extreme ratio are skipped
+	// when loading the storage. 0 (the default) means no restriction.
+	MaxImageRatio float64
+
+	// Search describes how images are selected for GCHs, defaults to
+	// CmdSearchExact. CmdSearchANN is only supported without variety.
+	Search CmdSearch
+
+	// Preprocess describes the preprocessing of query images, by default no
+	// preprocessing is done.
+	Preprocess QueryPreprocessing
+
+	// annIndex is the ANN index built by the last mosaic command, it's reused
+	// as long as the GCHs don't change.
+	annIndex *annIndexCache
+
+	// metricCache is the cache of metric values used by the last mosaic
+	// command, see cachedMetric.
+	metricCache *metricCacheEntry
+
+	// LastPlan is the plan of the last mosaic created with the mosaic command,
+	// nil if no mosaic was created yet. It can be saved with "mosaic plan save".
+	LastPlan *MosaicPlan
+
+	// LastMosaic describes the file of the last mosaic created with the mosaic
+	// command, it's used to replace single tiles with the retile command. nil
+	// if no mosaic was created yet or the last mosaic was recursive.
+	LastMosaic *MosaicOutput
+
+	// Aliases maps the names of aliases to their commands, see AliasCommand.
+	Aliases map[string]string
+
+	// Filter restricts the database images used by mosaic, mosaicgif and
+	// batch, it's set with "storage filter". nil means that all images are
+	// used.
+	Filter ImageFilter
+
+	// aliasDepth is the depth of the currently executed aliases, see
+	// MaxAliasDepth.
+	aliasDepth int
+
+	// history contains the states before the last commands that changed the
+	// state, see UndoCommand.
+	history *stateHistory
 }
 
 // GetPath returns the absolute path given some other path.
@@ -190,6 +580,79 @@ func (state *ExecutorState) GetPath(path string) (string, error) {
 	return res, nil
 }
 
+// collectStats collects the counters and timers (see Instrumentation) during
+// the execution of a command if verbose mode is enabled, the summary can be
+// printed with writeStats. The returned function restores the previous
+// instrumentation, stats is nil if verbose mode is disabled.
+func collectStats(state *ExecutorState) (stats *MemoryInstrumentation, restore func()) {
+	if !state.Verbose {
+		return nil, func() {}
+	}
+	stats = NewMemoryInstrumentation()
+	previous := GetInstrumentation()
+	if previous == nil {
+		SetInstrumentation(stats)
+	} else {
+		SetInstrumentation(MultiInstrumentation{previous, stats})
+	}
+	return stats, func() { SetInstrumentation(previous) }
+}
+
+// writeStats prints the summary of stats (see collectStats) if stats is not
+// nil.
+func writeStats(state *ExecutorState, stats *MemoryInstrumentation) {
+	if stats == nil {
+		return
+	}
+	fmt.Fprintln(state.Out)
+	fmt.Fprintln(state.Out, "Summary:")
+	stats.WriteSummary(state.Out)
+}
+
+// requiredImagesString returns the patterns of required images for the
+// variables, "none" if there are no patterns.
+func requiredImagesString(patterns []string) string {
+	if len(patterns) == 0 {
+		return "none"
+	}
+	return strings.Join(patterns, ",")
+}
+
+// pyramidDirString returns the directory for the variables, "default" if dir
+// is empty.
+func pyramidDirString(dir string) string {
+	if dir == "" {
+		return "default"
+	}
+	return dir
+}
+
+// composeStorage returns the storage the database images are loaded from:
+// ImgStorage wrapped in a PyramidStorage if pyramids are enabled.
+func (state *ExecutorState) composeStorage() (ImageStorage, error) {
+	if state.Pyramid == 0 {
+		return state.ImgStorage, nil
+	}
+	dir := state.PyramidDir
+	if dir == "" {
+		var dirErr error
+		dir, dirErr = DefaultPyramidDir()
+		if dirErr != nil {
+			return nil, dirErr
+		}
+	}
+	return NewPyramidStorage(state.ImgStorage, state.Mapper, dir, state.Pyramid,
+		NewNfntResizer(state.InterP))
+}
+
+// newImageCache returns a new image cache of size CacheSize.
+func (state *ExecutorState) newImageCache() *ImageCache {
+	if state.CacheSize <= 0 {
+		return NewImageCache(ImageCacheSize)
+	}
+	return NewImageCache(state.CacheSize)
+}
+
 // GetBestFitImages multiplies that best fit factor (BestFit) with num images
 // to get the number of best fit images for the variety selectors. It sets
 // same sane defaults in the case something weird happens.
@@ -205,10 +668,14 @@ type CommandFunc func(state *ExecutorState, args ...string) error
 
 // Command a command consists of a function to actually execute the command
 // and some information about the command.
+//
+// Complete is optional and used for tab completion in the REPL, see
+// CommandCompleteFunc.
 type Command struct {
 	Exec        CommandFunc
 	Usage       string
 	Description string
+	Complete    CommandCompleteFunc
 }
 
 // CommandMap maps command names to Commands.
@@ -235,7 +702,8 @@ var DefaultCommands CommandMap
 // Before a command is executed the Before method is called to notify the
 // handler that a command will be executed.
 //
-// Then a loop will begin that reads all lines from the state's reader.
+// Then a loop will begin that reads all lines from the state's reader (or
+// from the LineReader of the handler if it implements LineReaderHandler).
 // If there is a command line the line will be parsed, if an error during
 // parsing occurred the handler gets notified via OnParseErr. This method
 // should return true if the execution should continue despite the error.
@@ -268,19 +736,40 @@ type CommandHandler interface {
 
 // Execute implements the high-level execution loop as described in the
 // documentation of CommandHandler. commandMap is used to lookup commands.
+//
+// Besides the commands from commandMap the control flow blocks "foreach" and
+// "if" are supported, see executeBlock for details.
 func Execute(handler CommandHandler, commandMap CommandMap) {
 	state := handler.Init()
 	handler.Start(state)
-	scanner := bufio.NewScanner(state.In)
-	for scanner.Scan() {
+	var reader LineReader
+	if lineHandler, ok := handler.(LineReaderHandler); ok {
+		reader = lineHandler.NewLineReader(state, commandMap)
+	} else {
+		reader = NewScannerLineReader(state.In, "", nil)
+	}
+	executeLines(handler, state, commandMap, reader)
+}
+
+// executeLines executes all commands read from reader, it returns false if
+// the execution should stop (the handler returned false).
+func executeLines(handler CommandHandler, state *ExecutorState, commandMap CommandMap, reader LineReader) bool {
+	for {
+		line, readErr := readCommandLine(reader)
+		if readErr == io.EOF {
+			return true
+		}
+		if readErr != nil {
+			handler.OnScanErr(state, readErr)
+			return false
+		}
 		// a bit ugly with the calls to After:
 		// we want something like deferring in the loop...
 		handler.Before(state)
-		line := scanner.Text()
 		parsedCmd, parseErr := ParseCommand(line)
 		if parseErr != nil {
 			if !handler.OnParseErr(state, parseErr) {
-				return
+				return false
 			}
 			handler.After(state)
 			continue
@@ -290,24 +779,41 @@ func Execute(handler CommandHandler, commandMap CommandMap) {
 			continue
 		}
 		cmd := parsedCmd[0]
+		if isBlockCommand(cmd) {
+			// control flow, the block is read from reader
+			if !executeBlock(handler, state, commandMap, reader, parsedCmd) {
+				return false
+			}
+			handler.After(state)
+			continue
+		}
 		if nextCmd, ok := commandMap[cmd]; ok {
 			// try to execute
-			if execErr := nextCmd.Exec(state, parsedCmd[1:]...); execErr == nil {
+			execErr := state.recordCommand(parsedCmd, func() error {
+				return nextCmd.Exec(state, parsedCmd[1:]...)
+			})
+			if execErr == nil {
 				// execution of command was a success
 				handler.OnSuccess(state, nextCmd)
 			} else {
 				// execution of command failed
 				if !handler.OnError(state, execErr, nextCmd) {
-					return
+					return false
 				}
 				// continue with next
 				handler.After(state)
 				continue
 			}
+		} else if body, isAlias := state.Aliases[cmd]; isAlias {
+			if !executeAlias(handler, state, commandMap, cmd, body, parsedCmd[1:]) {
+				return false
+			}
+			handler.After(state)
+			continue
 		} else {
 			// we got an invalid command
 			if !handler.OnInvalidCmd(state, cmd) {
-				return
+				return false
 			}
 			// continue with next command
 			handler.After(state)
@@ -315,8 +821,40 @@ func Execute(handler CommandHandler, commandMap CommandMap) {
 		}
 		handler.After(state)
 	}
-	if scanErr := scanner.Err(); scanErr != nil {
-		handler.OnScanErr(state, scanErr)
+}
+
+// continuedLine checks if a line ends with a single \ (not an escaped \),
+// meaning that the command is continued on the next line. It returns the line
+// without the trailing \ and true in this case.
+func continuedLine(line string) (string, bool) {
+	trimmed := strings.TrimRightFunc(line, unicode.IsSpace)
+	numBackslashes := len(trimmed) - len(strings.TrimRight(trimmed, "\\"))
+	if numBackslashes%2 == 0 {
+		return line, false
+	}
+	return trimmed[:len(trimmed)-1], true
+}
+
+// readCommandLine reads the next command from reader. Lines ending with \ are
+// joined with the next line.
+func readCommandLine(reader LineReader) (string, error) {
+	line, err := reader.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	for {
+		stripped, continues := continuedLine(line)
+		if !continues {
+			return line, nil
+		}
+		next, nextErr := reader.ReadLine()
+		switch {
+		case nextErr == io.EOF:
+			return stripped, nil
+		case nextErr != nil:
+			return "", nextErr
+		}
+		line = stripped + " " + strings.TrimLeftFunc(next, unicode.IsSpace)
 	}
 }
 
@@ -330,6 +868,9 @@ func isEOF(r []rune, i int) bool {
 // foo bar is the command "foo" with argument "bar". Arguments might also
 // be enclosed in quotes, so foo "bar bar" is parsed as command foo with
 // argument bar bar (a single argument).
+//
+// Lines starting with # (ignoring leading whitespace) are comments, for a
+// comment the result is empty.
 func ParseCommand(s string) ([]string, error) {
 	parseErr := errors.New("error parsing command line")
 	res := make([]string, 0)
@@ -356,8 +897,15 @@ L:
 				break L
 			}
 			switch r[i] {
-			case ' ':
+			case ' ', '\t':
 				// do nothing, just remain in state
+			case '#':
+				// a comment line, ignore the rest of the line
+				if len(res) == 0 {
+					break L
+				}
+				currentArg = append(currentArg, r[i])
+				state = 1
 			case '\\':
 				state = 2
 			case '"':
@@ -372,7 +920,7 @@ L:
 				break L
 			}
 			switch r[i] {
-			case ' ':
+			case ' ', '\t':
 				// parsing done
 				res = append(res, string(currentArg))
 				currentArg = nil
@@ -447,18 +995,74 @@ func PwdCommand(state *ExecutorState, args ...string) error {
 	return nil
 }
 
+// seedString returns the string representation of a seed, "random" for
+// negative values.
+func seedString(seed int64) string {
+	if seed < 0 {
+		return "random"
+	}
+	return strconv.FormatInt(seed, 10)
+}
+
+// variables returns all variables that can be changed with "set" and their
+// current values.
+func (state *ExecutorState) variables() map[string]interface{} {
+	return map[string]interface{}{
+		"routines":          state.NumRoutines,
+		"verbose":           state.Verbose,
+		"cut":               state.CutMosaic,
+		"jpeg-quality":      state.JPGQuality,
+		"png-compression":   PNGCompressionString(state.PNGCompression),
+		"interp":            InterPString(state.InterP),
+		"cache":             state.CacheSize,
+		"variety":           state.VarietySelector.DisplayString(),
+		"best":              fmt.Sprintf("%.2f %%", 100.0*state.BestFit),
+		"prefilter":         fmt.Sprintf("%.2f %%", 100.0*state.Prefilter),
+		"seed":              seedString(state.Seed),
+		"penalty-weight":    state.PenaltyWeight,
+		"assignment-cap":    state.AssignmentCap,
+		"max-usage":         state.MaxUsage,
+		"required-images":   requiredImagesString(state.RequiredImages),
+		"min-images":        state.MinImages,
+		"compose-errors":    state.ComposeErrors.String(),
+		"image-errors":      state.ImageErrors.String(),
+		"prefetch":          state.Prefetch,
+		"max-memory":        state.MaxMemory.String(),
+		"metric-cache":      state.MetricCacheSize,
+		"pyramid":           state.Pyramid,
+		"pyramid-dir":       pyramidDirString(state.PyramidDir),
+		"resize":            state.Strategy,
+		"colorize":          fmt.Sprintf("%.2f", state.Colorize),
+		"overlay":           fmt.Sprintf("%.2f", state.Overlay),
+		"grayscale":         state.Grayscale,
+		"tile-border":       state.TileBorder,
+		"tile-border-color": HexColorString(state.TileBorderColor),
+		"layout":            state.layoutString(),
+		"jitter":            fmt.Sprintf("%.2f", state.Jitter),
+		"orientations":      state.Orientations.DisplayString(),
+		"min-image-size":    fmt.Sprintf("%dx%d", state.MinImageWidth, state.MinImageHeight),
+		"max-image-ratio":   state.MaxImageRatio,
+		"search":            state.Search.DisplayString(),
+		"preprocess":        state.Preprocess.DisplayString(),
+		"exif":              state.ImgStorage.EXIF,
+	}
+}
+
+// VariableNames returns the sorted names of all variables that can be changed
+// with "set".
+func (state *ExecutorState) VariableNames() []string {
+	vars := state.variables()
+	res := make([]string, 0, len(vars))
+	for name := range vars {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
 // StatsCommand is a command that prints variable / value pairs.
 func StatsCommand(state *ExecutorState, args ...string) error {
-	m := map[string]interface{}{
-		"routines":     state.NumRoutines,
-		"verbose":      state.Verbose,
-		"cut":          state.CutMosaic,
-		"jpeg-quality": state.JPGQuality,
-		"interp":       InterPString(state.InterP),
-		"cache":        state.CacheSize,
-		"variety":      state.VarietySelector.DisplayString(),
-		"best":         fmt.Sprintf("%.2f %%", 100.0*state.BestFit),
-	}
+	m := state.variables()
 	if len(args) == 1 {
 		// print specific value
 		if val, has := m[args[0]]; has {
@@ -523,10 +1127,23 @@ func SetVarCommand(state *ExecutorState, args ...string) error {
 		}
 		state.JPGQuality = val
 		return nil
+	case "png-compression":
+		val, parseErr := ParsePNGCompression(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for png-compression, must be \"default\", \"none\", \"speed\" or \"best\", got: \"%s\"", valueStr)
+		}
+		state.PNGCompression = val
+		return nil
 	case "interp":
 		val, parseErr := strconv.Atoi(valueStr)
 		if parseErr != nil {
-			return fmt.Errorf("invalid value for interpolation function, must be integer >= 0: %s", parseErr.Error())
+			// also accept names as printed by stats
+			interP, nameErr := InterPFromString(valueStr)
+			if nameErr != nil {
+				return fmt.Errorf("invalid value for interpolation function, must be integer >= 0 or a name like \"lanczos3\": %s", valueStr)
+			}
+			state.InterP = interP
+			return nil
 		}
 		if val < 0 {
 			return fmt.Errorf("invalid value for interpolation function, must be integer >= 0: %d", val)
@@ -544,7 +1161,7 @@ func SetVarCommand(state *ExecutorState, args ...string) error {
 	case "variety":
 		val, parseErr := ParseCMDVarietySelector(valueStr)
 		if parseErr != nil {
-			return fmt.Errorf("invalid value for variety, must be \"None\" or \"Random\", got: \"%s\"", valueStr)
+			return fmt.Errorf("invalid value for variety, must be \"None\", \"Random\", \"Penalty\", \"Assignment\" or \"Diffusion\", got: \"%s\"", valueStr)
 		}
 		state.VarietySelector = val
 		return nil
@@ -555,598 +1172,4175 @@ func SetVarCommand(state *ExecutorState, args ...string) error {
 		}
 		state.BestFit = val
 		return nil
-	default:
-		return fmt.Errorf("invalid variable \"%s\". For a list use \"stats\"", name)
-	}
-}
-
-// CdCommand is a command that changes the current directory.
-func CdCommand(state *ExecutorState, args ...string) error {
-	if len(args) != 1 {
-		return ErrCmdSyntaxErr
-	}
-	path := args[0]
-	var expandErr error
-	path, expandErr = homedir.Expand(path)
-	if expandErr != nil {
-		return fmt.Errorf("changing directory failed: %s", expandErr.Error())
-	}
-	if fi, err := os.Lstat(path); err != nil {
-		return fmt.Errorf("changing directory failed: %s", err.Error())
-	} else {
-		if !fi.IsDir() {
-			return fmt.Errorf("changing directory failed: \"%s\" is not a directory", path)
-		} else {
-			// convert to absolute path
-			abs, absErr := filepath.Abs(path)
-			if absErr != nil {
-				return fmt.Errorf("changing directory failed: %s", absErr.Error())
-			} else {
-				state.WorkingDir = abs
-				return nil
-			}
-		}
-	}
-}
-
-// ImageStorageCommand is a command that executes tasks with the fs mapper
-// and therefor the image storage (the user doesn't need to know about details
-// as mapper and storage, so it's simply called storage).
-// This command without arguments just prints the number of databases in the
-// storage.
-// With the single argument "list" it prints the path of each image in the
-// storage.
-// With the argument "load" a second argument "DIR" is required, this will
-// load all images from the directory in the storage. If a third argument
-// is provided this must be a bool that is true if the directory should be
-// scanned recursively. The default is not to scan recursively.
-//
-// Note that jpg and png files are considered valid image types, thus
-// image.jpeg and image.png should be included if you're planning to use
-// this function.
-func ImageStorageCommand(state *ExecutorState, args ...string) error {
-	switch {
-	case len(args) == 0:
-		fmt.Fprintln(state.Out, "Number of database images:", state.Mapper.Len())
-		return nil
-	case args[0] == "list":
-		for _, path := range state.Mapper.IDMapping {
-			fmt.Fprintf(state.Out, "  %s\n", path)
+	case "prefilter":
+		val, parseErr := ParsePercent(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for prefilter, must be a percent (10.0%% or 0.1), got %s", valueStr)
 		}
-		fmt.Fprintln(state.Out, "Total:", state.Mapper.Len())
+		state.Prefilter = val
 		return nil
-	case args[0] == "load":
-		var dir string
-		var recursive bool
-
-		switch {
-		case len(args) == 1:
-			dir = state.WorkingDir
-		case len(args) > 2:
-			// parse recursive flag
-			var boolErr error
-			recursive, boolErr = strconv.ParseBool(args[2])
-			if boolErr != nil {
-				return boolErr
-			}
-			// parse path argument
-			fallthrough
-		case len(args) > 1:
-			// parse the path
-			var pathErr error
-			dir, pathErr = state.GetPath(args[1])
-			if pathErr != nil {
-				return pathErr
-			}
-		default:
-			// just to be sure, should never happen
+	case "seed":
+		if strings.ToLower(valueStr) == "random" {
+			state.Seed = -1
 			return nil
 		}
-		fmt.Fprintln(state.Out, "Loading images from", dir)
-		if recursive {
-			fmt.Fprintln(state.Out, "Recursive mode enabled")
+		val, parseErr := strconv.ParseInt(valueStr, 10, 64)
+		if parseErr != nil || val < 0 {
+			return fmt.Errorf("invalid value for seed, must be int >= 0 or \"random\", got %s", valueStr)
 		}
-		state.Mapper.Clear()
-		// make gchs invalid
-		state.GCHStorage = nil
-		// make lchs invalid
-		state.LCHStorage = nil
-		if loadErr := state.Mapper.Load(dir, recursive, JPGAndPNG); loadErr != nil {
-			state.Mapper.Clear()
-			// should not be necessary, just to follow the pattern
-			state.GCHStorage = nil
+		state.Seed = val
+		return nil
+	case "min-image-size":
+		width, height, parseErr := ParseDimensionsEmpty(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for min-image-size, must be of the form 200x200: %s", parseErr.Error())
+		}
+		state.MinImageWidth, state.MinImageHeight = IntMax(width, 0), IntMax(height, 0)
+		return nil
+	case "max-image-ratio":
+		val, parseErr := strconv.ParseFloat(valueStr, 64)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for max-image-ratio (must be float >= 1, 0 means no restriction): %s", parseErr.Error())
+		}
+		if val != 0.0 && val < 1.0 {
+			return fmt.Errorf("invalid value for max-image-ratio (must be float >= 1, 0 means no restriction): %f", val)
+		}
+		state.MaxImageRatio = val
+		return nil
+	case "penalty-weight":
+		val, parseErr := strconv.ParseFloat(valueStr, 64)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for penalty-weight (must be float >= 0): %s", parseErr.Error())
+		}
+		if val < 0.0 {
+			return fmt.Errorf("invalid value for penalty-weight (must be float >= 0): %f", val)
+		}
+		state.PenaltyWeight = val
+		return nil
+	case "assignment-cap":
+		val, parseErr := strconv.Atoi(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for assignment-cap (must be int, <= 0 means no cap): %s", parseErr.Error())
+		}
+		state.AssignmentCap = val
+		return nil
+	case "max-usage":
+		val, parseErr := strconv.Atoi(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for max-usage (must be int >= 0, 0 means no limit): %s", parseErr.Error())
+		}
+		if val < 0 {
+			return fmt.Errorf("invalid value for max-usage (must be int >= 0, 0 means no limit): %d", val)
+		}
+		state.MaxUsage = val
+		return nil
+	case "required-images":
+		if valueStr == "none" {
+			state.RequiredImages = nil
+			return nil
+		}
+		var patterns []string
+		for _, pattern := range strings.Split(valueStr, ",") {
+			pattern, patternErr := pathPattern(state, pattern)
+			if patternErr != nil {
+				return fmt.Errorf("invalid value for required-images (must be \"none\" or patterns separated by \",\"): %s", patternErr.Error())
+			}
+			patterns = append(patterns, pattern)
+		}
+		state.RequiredImages = patterns
+		return nil
+	case "min-images":
+		val, parseErr := strconv.Atoi(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for min-images (must be int >= 0, 0 disables the check): %s", parseErr.Error())
+		}
+		if val < 0 {
+			return fmt.Errorf("invalid value for min-images (must be int >= 0, 0 disables the check): %d", val)
+		}
+		state.MinImages = val
+		return nil
+	case "compose-errors":
+		val, parseErr := ParseComposeErrorPolicy(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for compose-errors, must be \"fail-fast\" or \"best-effort\", got: \"%s\"", valueStr)
+		}
+		state.ComposeErrors = val
+		return nil
+	case "image-errors":
+		val, parseErr := ParseImageErrorPolicy(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for image-errors, must be \"fail\" or \"skip\", got: \"%s\"", valueStr)
+		}
+		state.ImageErrors = val
+		return nil
+	case "prefetch":
+		val, parseErr := strconv.Atoi(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for prefetch (must be int >= 0, 0 disables prefetching): %s", parseErr.Error())
+		}
+		if val < 0 {
+			return fmt.Errorf("invalid value for prefetch (must be int >= 0, 0 disables prefetching): %d", val)
+		}
+		state.Prefetch = val
+		return nil
+	case "max-memory":
+		val, parseErr := ParseMemoryBudget(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for max-memory (for example 4G, 0 means no restriction): %s", parseErr.Error())
+		}
+		state.MaxMemory = val
+		return nil
+	case "pyramid":
+		val, parseErr := strconv.Atoi(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for pyramid (must be int between 0 and %d, 0 disables pyramids): %s",
+				MaxPyramidLevels, parseErr.Error())
+		}
+		if val < 0 || val > MaxPyramidLevels {
+			return fmt.Errorf("invalid value for pyramid (must be int between 0 and %d, 0 disables pyramids): %d",
+				MaxPyramidLevels, val)
+		}
+		state.Pyramid = val
+		return nil
+	case "pyramid-dir":
+		if valueStr == "default" {
+			state.PyramidDir = ""
+			return nil
+		}
+		dir, dirErr := state.GetPath(valueStr)
+		if dirErr != nil {
+			return fmt.Errorf("invalid value for pyramid-dir (must be a directory or \"default\"): %s", dirErr.Error())
+		}
+		state.PyramidDir = dir
+		return nil
+	case "metric-cache":
+		val, parseErr := strconv.Atoi(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for metric-cache (must be int >= 0, 0 disables the cache): %s", parseErr.Error())
+		}
+		if val < 0 {
+			return fmt.Errorf("invalid value for metric-cache (must be int >= 0, 0 disables the cache): %d", val)
+		}
+		state.MetricCacheSize = val
+		if val == 0 {
+			state.metricCache = nil
+		} else if state.metricCache != nil {
+			state.metricCache.cache.MaxEntries = val
+		}
+		return nil
+	case "resize":
+		if _, ok := GetResizeStrategy(valueStr); !ok {
+			return fmt.Errorf("invalid value for resize, must be one of %s, got \"%s\"",
+				strings.Join(GetResizeStrategyNames(), ", "), valueStr)
+		}
+		state.Strategy = strings.ToLower(valueStr)
+		return nil
+	case "colorize":
+		val, parseErr := ParsePercent(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for colorize, must be a value between 0 and 1: %s", parseErr.Error())
+		}
+		if val < 0.0 || val > 1.0 {
+			return fmt.Errorf("invalid value for colorize, must be a value between 0 and 1: %.2f", val)
+		}
+		state.Colorize = val
+		return nil
+	case "overlay":
+		val, parseErr := parseOverlay(valueStr)
+		if parseErr != nil {
+			return parseErr
+		}
+		state.Overlay = val
+		return nil
+	case "grayscale":
+		val, parseErr := strconv.ParseBool(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for grayscale (must be true or false): %s", parseErr.Error())
+		}
+		state.Grayscale = val
+		return nil
+	case "tile-border":
+		val, parseErr := strconv.Atoi(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for tile-border (must be int >= 0): %s", parseErr.Error())
+		}
+		if val < 0 {
+			return fmt.Errorf("invalid value for tile-border (must be int >= 0): %d", val)
+		}
+		state.TileBorder = val
+		return nil
+	case "tile-border-color":
+		val, parseErr := ParseHexColor(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for tile-border-color: %s", parseErr.Error())
+		}
+		state.TileBorderColor = val
+		return nil
+	case "layout":
+		if _, isCustom := GetDivider(valueStr); isCustom {
+			state.Layout = CmdLayoutCustom
+			state.CustomLayout = strings.ToLower(valueStr)
+			return nil
+		}
+		val, parseErr := ParseCmdLayout(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for layout, must be \"grid\", \"brick\", \"quadtree\", \"jitter\" or a registered divider, got: \"%s\"", valueStr)
+		}
+		state.Layout = val
+		return nil
+	case "jitter":
+		val, parseErr := strconv.ParseFloat(valueStr, 64)
+		if parseErr != nil || val < 0.0 || val >= 0.5 {
+			return fmt.Errorf("invalid value for jitter (must be float in [0, 0.5)): %s", valueStr)
+		}
+		state.Jitter = val
+		return nil
+	case "orientations":
+		val, parseErr := ParseCmdOrientations(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for orientations, must be \"none\", \"rotate\", \"mirror\" or \"all\", got: \"%s\"", valueStr)
+		}
+		state.Orientations = val
+		return nil
+	case "search":
+		val, parseErr := ParseCmdSearch(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for search, must be \"exact\" or \"ann\", got: \"%s\"", valueStr)
+		}
+		state.Search = val
+		return nil
+	case "exif":
+		val, parseErr := strconv.ParseBool(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for exif (must be true or false): %s", parseErr.Error())
+		}
+		if val == state.ImgStorage.EXIF {
+			return nil
+		}
+		state.ImgStorage.EXIF = val
+		// GCHs don't depend on the orientation, but LCHs and features (for
+		// example edge histograms) do
+		if state.LCHStorage != nil {
+			fmt.Fprintln(state.Out, "LCHs depend on the orientation, they were dropped and must be re-computed")
 			state.LCHStorage = nil
-			return loadErr
 		}
-		fmt.Fprintln(state.Out, "Successfully read", state.Mapper.Len(), "images")
-		fmt.Fprintln(state.Out, "Don't forget to (re)load precomputed data if required!")
+		if state.Features != nil {
+			fmt.Fprintln(state.Out, "Features depend on the orientation, they were dropped and must be re-computed")
+			state.Features = nil
+		}
+		state.invalidateCaches()
+		return nil
+	case "preprocess":
+		val, parseErr := ParseQueryPreprocessing(valueStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid value for preprocess, must be \"none\" or a list like \"exif,autocontrast,downscale=2048\": %s", parseErr.Error())
+		}
+		state.Preprocess = val
 		return nil
 	default:
-		return ErrCmdSyntaxErr
+		return fmt.Errorf("invalid variable \"%s\". For a list use \"stats\"", name)
 	}
 }
 
-// TODO stuff here should be moved to other functions to avoid repeating code
-// later...
+// CdCommand is a command that changes the current directory.
+func CdCommand(state *ExecutorState, args ...string) error {
+	if len(args) != 1 {
+		return ErrCmdSyntaxErr
+	}
+	path := args[0]
+	var expandErr error
+	path, expandErr = homedir.Expand(path)
+	if expandErr != nil {
+		return fmt.Errorf("changing directory failed: %s", expandErr.Error())
+	}
+	if fi, err := os.Lstat(path); err != nil {
+		return fmt.Errorf("changing directory failed: %s", err.Error())
+	} else {
+		if !fi.IsDir() {
+			return fmt.Errorf("changing directory failed: \"%s\" is not a directory", path)
+		} else {
+			// convert to absolute path
+			abs, absErr := filepath.Abs(path)
+			if absErr != nil {
+				return fmt.Errorf("changing directory failed: %s", absErr.Error())
+			} else {
+				state.WorkingDir = abs
+				return nil
+			}
+		}
+	}
+}
 
-// GCHCommand can create histograms for all images in storage, save and load
-// files.
-func GCHCommand(state *ExecutorState, args ...string) error {
+// ImageStorageCommand is a command that executes tasks with the fs mapper
+// and therefor the image storage (the user doesn't need to know about details
+// as mapper and storage, so it's simply called storage).
+// This command without arguments just prints the number of databases in the
+// storage.
+// With the single argument "list" it prints the path of each image in the
+// storage.
+// With the argument "load" a second argument "DIR" is required, this will
+// load all images from the directory in the storage. If a third argument
+// is provided this must be a bool that is true if the directory should be
+// scanned recursively. The default is not to scan recursively. With
+// "as <label>" only the images with that label are replaced (see
+// FSMapper.Roots). "tags" reads the tags of images from a sidecar file,
+// "weight" sets the weights of images (see ImageWeights) and "filter" sets the
+// Filter of the state.
+//
+// Note that jpg and png files are considered valid image types, thus
+// image.jpeg and image.png should be included if you're planning to use
+// this function.
+func ImageStorageCommand(state *ExecutorState, args ...string) error {
+	args, flags, flagsErr := splitCommandFlags(args)
+	if flagsErr != nil {
+		return flagsErr
+	}
+	// the flags for remote images are only valid for load
+	manifest, hasManifest := flags["manifest"]
+	cacheDir, hasCache := flags["cache"]
+	region, hasRegion := flags["region"]
+	delete(flags, "manifest")
+	delete(flags, "cache")
+	delete(flags, "region")
+	if (hasCache || hasRegion) && !hasManifest {
+		return errors.New("--cache and --region can only be used with --manifest")
+	}
+	if hasManifest && (len(args) != 1 || args[0] != "load" || len(flags) > 0) {
+		return errors.New("--manifest can only be used as storage load --manifest <file> [--cache dir] [--region region]")
+	}
+	options, optionsErr := parseLoadOptions(state, flags)
+	if optionsErr != nil {
+		return optionsErr
+	}
 	switch {
 	case len(args) == 0:
-		return ErrCmdSyntaxErr
-	case args[0] == "create":
-		// k is the number of subdivions, defaults to 8
-		var k uint = 8
-		if len(args) > 1 {
-			asInt, parseErr := strconv.Atoi(args[1])
-			if parseErr != nil {
-				return parseErr
+		fmt.Fprintln(state.Out, "Number of database images:", state.Mapper.Len())
+		if labels := state.Mapper.Labels(); len(labels) > 0 {
+			counts := make(map[string]int, len(labels))
+			for _, path := range state.Mapper.IDMapping {
+				if label, hasLabel := state.Mapper.RootLabel(path); hasLabel {
+					counts[label]++
+				}
 			}
-			// validate k: must be >= 1 and <= 256
-			if asInt < 1 || asInt > 256 {
-				return fmt.Errorf("k for GCH must be a value between 1 and 256, got %d", asInt)
+			for _, label := range labels {
+				fmt.Fprintf(state.Out, "  %s: %d images from %s\n", label, counts[label], state.Mapper.Roots[label])
 			}
-			k = uint(asInt)
-		}
-
-		// create all histograms
-		fmt.Fprintf(state.Out, "Creating histograms for all images in storage with k = %d sub-divisions\n", k)
-		var progress ProgressFunc
-		if state.Verbose {
-			inStore := int(state.ImgStorage.NumImages())
-			progress = StdProgressFunc(state.Out, "",
-				inStore, IntMin(100, inStore/10))
 		}
-		start := time.Now()
-		histograms, histErr := CreateAllHistograms(state.ImgStorage,
-			true, k, state.NumRoutines, progress)
-		execTime := time.Since(start)
-		if histErr != nil {
-			return histErr
+		if len(state.Filter) > 0 {
+			fmt.Fprintf(state.Out, "Filter: %s (%d matching images)\n", state.Filter, numFilteredImages(state))
 		}
-		// set histograms
-		state.GCHStorage = &MemoryHistStorage{Histograms: histograms, K: k}
-		fmt.Fprintf(state.Out, "Computed %d histograms in %v\n", len(histograms), execTime)
 		return nil
-	case args[0] == "save":
-		if state.GCHStorage == nil {
-			return errors.New("No GCHs loaded yet")
-		}
-		// save ~/bla.[json|gob]
-		// save ~/
-		if len(args) < 2 {
-			return ErrCmdSyntaxErr
-		}
+	case args[0] == "tags" && len(args) == 2:
+		// tags <file.csv|file.json>
 		path, pathErr := state.GetPath(args[1])
 		if pathErr != nil {
 			return pathErr
 		}
-		// check if path is a file or directory
-		// we don't report the fiErr (this is not nil if file doesn't exist which
-		// is of course allowed)
-		fi, fiErr := os.Lstat(path)
-		if fiErr == nil && fi.IsDir() {
-			// save with default naming scheme in that directory
-			name := GCHFileName(state.GCHStorage.K, "gob")
-			path = filepath.Join(path, name)
-		}
-		controller, creationErr := CreateHistFSController(IDList(state.ImgStorage),
-			state.Mapper, state.GCHStorage)
-		if creationErr != nil {
-			return creationErr
-		}
-		// save file
-		saveErr := controller.WriteFile(path)
-		if saveErr == nil {
-			// ignore write error here
-			fmt.Fprintln(state.Out, "Successfully wrote", state.ImgStorage.NumImages(), "histograms",
-				"to", path)
+		tags, tagsErr := ReadTagsFile(path)
+		if tagsErr != nil {
+			return tagsErr
 		}
-		return saveErr
-	case args[0] == "load":
-		if len(args) < 2 {
-			return ErrCmdSyntaxErr
+		state.Mapper.AddTags(tags)
+		numTagged := 0
+		for _, image := range state.Mapper.IDMapping {
+			if len(state.Mapper.Tags[image]) > 0 {
+				numTagged++
+			}
 		}
+		fmt.Fprintln(state.Out, "Read tags of", len(tags), "images,", numTagged, "images in storage are tagged")
+		return nil
+	case args[0] == "weight" && len(args) == 2:
+		// weight <file.csv|file.json>
 		path, pathErr := state.GetPath(args[1])
 		if pathErr != nil {
 			return pathErr
 		}
-		controller := HistogramFSController{}
-		readErr := controller.ReadFile(path)
-		if readErr != nil {
-			return readErr
-		}
-		fmt.Fprintf(state.Out, "Read %d histograms\n", len(controller.Entries))
-		// we don't care about missing / new images, we just print a warning if
-		// the lengths have change.
-		if len(controller.Entries) != int(state.ImgStorage.NumImages()) {
-			fmt.Fprintln(state.Out, "Unmatched number of images in storage and loaded histograms.",
-				"Have the images changed? In this case the histograms must be re-computed.")
+		weights, weightsErr := ReadWeightsFile(path)
+		if weightsErr != nil {
+			return weightsErr
 		}
-		memStorage, createErr := MemHistStorageFromFSMapper(state.Mapper, &controller, nil)
-		if createErr != nil {
-			return createErr
+		for image, weight := range weights {
+			state.Mapper.SetWeight(image, weight)
 		}
-		state.GCHStorage = memStorage
-		fmt.Fprintln(state.Out, "Histograms have been mapped to image store.")
+		fmt.Fprintln(state.Out, "Read weights of", len(weights), "images")
 		return nil
-	default:
-		return ErrCmdSyntaxErr
-	}
-}
-
-func LCHCommand(state *ExecutorState, args ...string) error {
-	switch {
-	case len(args) == 0:
-		return ErrCmdSyntaxErr
-	case args[0] == "create":
-		if len(args) < 3 {
-			return ErrCmdSyntaxErr
+	case args[0] == "weight" && len(args) == 3:
+		// weight <glob> <weight>
+		pattern, patternErr := pathPattern(state, args[1])
+		if patternErr != nil {
+			return patternErr
 		}
-		// k is the number of subdivions
-		asInt, parseErr := strconv.Atoi(args[1])
+		weight, parseErr := strconv.ParseFloat(args[2], 64)
 		if parseErr != nil {
-			return parseErr
+			return fmt.Errorf("invalid value for weight (must be float > 0): %s", args[2])
 		}
-		// validate k: must be >= 1 and <= 256
-		if asInt < 1 || asInt > 256 {
-			return fmt.Errorf("k for LCH must be a value between 1 and 256, got %d", asInt)
+		if weightErr := ValidateWeight(weight); weightErr != nil {
+			return weightErr
 		}
-		k := uint(asInt)
-		// parse scheme size
-		asInt, parseErr = strconv.Atoi(args[2])
-		if parseErr != nil {
-			return parseErr
+		numMatching := 0
+		for _, path := range state.Mapper.IDMapping {
+			if MatchPathPattern(pattern, path) {
+				state.Mapper.SetWeight(path, weight)
+				numMatching++
+			}
 		}
-		// now create lch scheme
-		var scheme LCHScheme
-		switch asInt {
-		case 4:
-			scheme = NewFourLCHScheme()
-		case 5:
-			scheme = NewFiveLCHScheme()
+		fmt.Fprintln(state.Out, "Set weight of", numMatching, "images to", weight)
+		return nil
+	case args[0] == "filter":
+		// filter [none | <condition>...]
+		switch {
+		case len(args) == 1:
+			if len(state.Filter) == 0 {
+				fmt.Fprintln(state.Out, "No filter set")
+			} else {
+				fmt.Fprintln(state.Out, "Filter:", state.Filter)
+			}
+			return nil
+		case len(args) == 2 && args[1] == "none":
+			state.Filter = nil
+			return nil
+		}
+		filter, filterErr := ParseImageFilter(args[1:]...)
+		if filterErr != nil {
+			return filterErr
+		}
+		// the filter is kept even if no image matches, images may be added later
+		state.Filter = filter
+		fmt.Fprintln(state.Out, numFilteredImages(state), "of", state.Mapper.Len(), "images match the filter")
+		return nil
+	case args[0] == "list":
+		for _, path := range state.Mapper.IDMapping {
+			fmt.Fprintf(state.Out, "  %s\n", path)
+		}
+		fmt.Fprintln(state.Out, "Total:", state.Mapper.Len())
+		return nil
+	case args[0] == "load" && hasManifest:
+		return loadRemoteImages(state, manifest, cacheDir, region)
+	case args[0] == "load":
+		var dir string
+		var recursive bool
+		// load [dir] [recursive] as <label>
+		label := ""
+		if n := len(args); n > 2 && args[n-2] == "as" {
+			label = args[n-1]
+			args = args[:n-2]
+			if labelErr := validateRootLabel(label); labelErr != nil {
+				return labelErr
+			}
+		}
+
+		switch {
+		case len(args) == 1:
+			dir = state.WorkingDir
+		case len(args) > 2:
+			// parse recursive flag
+			var boolErr error
+			recursive, boolErr = strconv.ParseBool(args[2])
+			if boolErr != nil {
+				return boolErr
+			}
+			// parse path argument
+			fallthrough
+		case len(args) > 1:
+			// parse the path
+			var pathErr error
+			dir, pathErr = state.GetPath(args[1])
+			if pathErr != nil {
+				return pathErr
+			}
 		default:
-			return fmt.Errorf("Invalid scheme size %d: Supported are 4 and 5", asInt)
+			// just to be sure, should never happen
+			return nil
 		}
-		// create all lchs
-		fmt.Fprintf(state.Out, "Creating LCHs for all images in storage with k = %d sub-divisions and %d parts\n", k, asInt)
+		fmt.Fprintln(state.Out, "Loading images from", dir)
+		if recursive {
+			fmt.Fprintln(state.Out, "Recursive mode enabled")
+		}
+		options.Recursive = recursive
+		if label != "" {
+			return loadLabeledImages(state, dir, label, options)
+		}
+		state.Mapper.Clear()
+		// make gchs invalid
+		state.GCHStorage = nil
+		// make lchs invalid
+		state.LCHStorage = nil
+		state.Features = nil
+		state.invalidateCaches()
+		if loadErr := state.Mapper.LoadWithOptions(dir, options); loadErr != nil {
+			state.Mapper.Clear()
+			// should not be necessary, just to follow the pattern
+			state.GCHStorage = nil
+			state.LCHStorage = nil
+			state.Features = nil
+			return loadErr
+		}
+		fmt.Fprintln(state.Out, "Successfully read", state.Mapper.Len(), "images")
+		fmt.Fprintln(state.Out, "Don't forget to (re)load precomputed data if required!")
+		return nil
+	case args[0] == "add" && len(args) > 1:
+		// add <dir|file> [recursive]
+		path, pathErr := state.GetPath(args[1])
+		if pathErr != nil {
+			return pathErr
+		}
+		recursive := false
+		if len(args) > 2 {
+			var boolErr error
+			recursive, boolErr = strconv.ParseBool(args[2])
+			if boolErr != nil {
+				return boolErr
+			}
+		}
+		fi, statErr := os.Stat(path)
+		if statErr != nil {
+			return statErr
+		}
+		numBefore := state.Mapper.NumImages()
+		if fi.IsDir() {
+			options.Recursive = recursive
+			if loadErr := state.Mapper.LoadWithOptions(path, options); loadErr != nil {
+				// images added so far are kept, the precomputed data must be updated
+				// for them as well
+				if updateErr := updatePrecomputed(state, numBefore, state.ImageErrors); updateErr != nil {
+					return updateErr
+				}
+				return loadErr
+			}
+		} else {
+			if !JPGAndPNG(filepath.Ext(path)) {
+				return fmt.Errorf("Supported files are .jpg and .png, got file %s", path)
+			}
+			if _, registered := state.Mapper.Register(path); !registered {
+				fmt.Fprintln(state.Out, "Image already registered")
+			}
+		}
+		numAdded := int(state.Mapper.NumImages() - numBefore)
+		fmt.Fprintln(state.Out, "Added", numAdded, "images, total:", state.Mapper.Len())
+		return updatePrecomputed(state, numBefore, state.ImageErrors)
+	case args[0] == "remove" && len(args) == 2:
+		// remove <glob>
+		pattern, patternErr := pathPattern(state, args[1])
+		if patternErr != nil {
+			return patternErr
+		}
+		numRemoved := retainImages(state, func(path string) bool {
+			return !MatchPathPattern(pattern, path)
+		})
+		fmt.Fprintln(state.Out, "Removed", numRemoved, "images, total:", state.Mapper.Len())
+		return nil
+	case args[0] == "watch" && len(args) > 1 && len(args) <= 4:
+		// watch <dir> [recursive] [interval]
+		dir, pathErr := state.GetPath(args[1])
+		if pathErr != nil {
+			return pathErr
+		}
+		if len(args) > 2 {
+			var boolErr error
+			options.Recursive, boolErr = strconv.ParseBool(args[2])
+			if boolErr != nil {
+				return boolErr
+			}
+		}
+		interval := DefaultWatchInterval
+		if len(args) > 3 {
+			var durationErr error
+			interval, durationErr = time.ParseDuration(args[3])
+			if durationErr != nil {
+				return durationErr
+			}
+			if interval <= 0 {
+				return fmt.Errorf("Interval must be positive, got %s", args[3])
+			}
+		}
+		return watchStorage(state, dir, options, interval)
+	case args[0] == "dedupe" && len(args) <= 3:
+		// dedupe [exact | perceptual [max-dist]]
+		mode := "exact"
+		if len(args) > 1 {
+			mode = args[1]
+		}
+		var progress ProgressFunc
+		if state.Verbose {
+			numImages := state.Mapper.Len()
+			progress = StdProgressFunc(state.Out, "", numImages, IntMin(100, numImages/10))
+		}
+		var duplicates map[ImageID]ImageID
+		var dupErr error
+		switch {
+		case mode == "exact" && len(args) <= 2:
+			duplicates, dupErr = FindFileDuplicates(state.Mapper, state.NumRoutines, progress)
+		case mode == "perceptual":
+			maxDist := 0
+			if len(args) > 2 {
+				var parseErr error
+				maxDist, parseErr = strconv.Atoi(args[2])
+				if parseErr != nil || maxDist < 0 || maxDist > 64 {
+					return fmt.Errorf("invalid value for max-dist, must be int between 0 and 64: %s", args[2])
+				}
+			}
+			duplicates, dupErr = FindSimilarImages(state.ImgStorage, NewNfntResizer(state.InterP),
+				maxDist, state.NumRoutines, progress)
+		default:
+			return ErrCmdSyntaxErr
+		}
+		if dupErr != nil {
+			return dupErr
+		}
+		// sort for deterministic output
+		dupIDs := make([]int, 0, len(duplicates))
+		for id := range duplicates {
+			dupIDs = append(dupIDs, int(id))
+		}
+		sort.Ints(dupIDs)
+		dropped := make(map[string]bool, len(duplicates))
+		for _, id := range dupIDs {
+			path, _ := state.Mapper.GetPath(ImageID(id))
+			originalPath, _ := state.Mapper.GetPath(duplicates[ImageID(id)])
+			fmt.Fprintf(state.Out, "  %s (duplicate of %s)\n", path, originalPath)
+			dropped[path] = true
+		}
+		numRemoved := retainImages(state, func(path string) bool {
+			return !dropped[path]
+		})
+		fmt.Fprintln(state.Out, "Removed", numRemoved, "duplicates, total:", state.Mapper.Len())
+		return nil
+	default:
+		return ErrCmdSyntaxErr
+	}
+}
+
+// validateRootLabel returns an error if label can't be used as the label of a
+// storage root: Labels are separated by "," in --only.
+func validateRootLabel(label string) error {
+	if label == "" || strings.ContainsAny(label, ", \t") {
+		return fmt.Errorf("Invalid label \"%s\": Labels must not be empty and must not contain \",\" or spaces", label)
+	}
+	return nil
+}
+
+// loadRemoteImages replaces the storage by the images from the manifest file
+// (see ReadManifestFile). The images are downloaded to cacheDir (defaults to
+// the manifest file with the extension ".cache") and the cached files are
+// registered, images that are already cached are not downloaded again.
+// Images that can't be downloaded are handled according to the image-errors
+// policy.
+func loadRemoteImages(state *ExecutorState, manifest, cacheDir, region string) error {
+	manifest, pathErr := state.GetPath(manifest)
+	if pathErr != nil {
+		return pathErr
+	}
+	if cacheDir == "" {
+		cacheDir = manifest + ".cache"
+	} else {
+		cacheDir, pathErr = state.GetPath(cacheDir)
+		if pathErr != nil {
+			return pathErr
+		}
+	}
+	urls, manifestErr := ReadManifestFile(manifest, region)
+	if manifestErr != nil {
+		return manifestErr
+	}
+	db, dbErr := NewRemoteImageDB(urls, cacheDir)
+	if dbErr != nil {
+		return dbErr
+	}
+	fmt.Fprintln(state.Out, "Fetching", urls.Len(), "images to", cacheDir)
+	var progress ProgressFunc
+	if state.Verbose {
+		progress = StdProgressFunc(state.Out, "", urls.Len(), IntMin(100, urls.Len()/10))
+	}
+	files, report := db.FetchAll(state.NumRoutines, progress)
+	if state.ImageErrors == ImageErrorsFail {
+		if fetchErr := report.Err(); fetchErr != nil {
+			return fetchErr
+		}
+	}
+	state.Mapper.Clear()
+	state.GCHStorage = nil
+	state.LCHStorage = nil
+	state.Features = nil
+	state.invalidateCaches()
+	for _, file := range files {
+		if file != "" {
+			state.Mapper.Register(file)
+		}
+	}
+	for _, imgErr := range report.Skipped {
+		fmt.Fprintln(state.Out, imgErr.Error())
+	}
+	if len(report.Skipped) > 0 {
+		fmt.Fprintf(state.Out, "Skipped %d of %d images that can't be downloaded\n",
+			len(report.Skipped), report.NumImages)
+	}
+	fmt.Fprintln(state.Out, "Successfully read", state.Mapper.Len(), "images")
+	fmt.Fprintln(state.Out, "Don't forget to (re)load precomputed data if required!")
+	return nil
+}
+
+// loadLabeledImages replaces the images with the given label by the images
+// from dir and sets dir as the root of label. Images with other labels (or
+// without a label) are kept, the GCHs and LCHs are updated as with
+// "storage add".
+func loadLabeledImages(state *ExecutorState, dir, label string, options LoadOptions) error {
+	if _, hasRoot := state.Mapper.Roots[label]; hasRoot {
+		numRemoved := retainImages(state, func(path string) bool {
+			pathLabel, _ := state.Mapper.RootLabel(path)
+			return pathLabel != label
+		})
+		if numRemoved > 0 {
+			fmt.Fprintln(state.Out, "Removed", numRemoved, "images with label", label)
+		}
+	}
+	state.Mapper.SetRoot(label, dir)
+	numBefore := state.Mapper.NumImages()
+	loadErr := state.Mapper.LoadWithOptions(dir, options)
+	// images added so far are kept, even if an error occurred
+	if updateErr := updatePrecomputed(state, numBefore, state.ImageErrors); updateErr != nil {
+		return updateErr
+	}
+	if loadErr != nil {
+		return loadErr
+	}
+	numAdded := int(state.Mapper.NumImages() - numBefore)
+	fmt.Fprintln(state.Out, "Added", numAdded, "images as", label, "total:", state.Mapper.Len())
+	return nil
+}
+
+// restrictLabels returns a copy of the state that contains only the images
+// with one of the given labels (see FSMapper.RootLabel and restrictImages).
+func (state *ExecutorState) restrictLabels(labels []string) (*ExecutorState, error) {
+	keep := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		if _, hasRoot := state.Mapper.Roots[label]; !hasRoot {
+			return nil, fmt.Errorf("Unkown label \"%s\", labels are set with \"storage load <dir> as <label>\"", label)
+		}
+		keep[label] = true
+	}
+	return state.restrictImages(func(path string) bool {
+		label, hasLabel := state.Mapper.RootLabel(path)
+		return hasLabel && keep[label]
+	}), nil
+}
+
+// filteredState returns the state used for the selection of mosaics: If
+// Filter is set a copy of the state that contains only the matching images
+// (see restrictImages), otherwise the state itself. An error is returned if
+// no image matches the filter.
+func (state *ExecutorState) filteredState() (*ExecutorState, error) {
+	if len(state.Filter) == 0 {
+		return state, nil
+	}
+	res := state.restrictImages(func(path string) bool {
+		return state.Filter.Match(state.Mapper, path)
+	})
+	if res.Mapper.Len() == 0 {
+		return nil, fmt.Errorf("No images in storage match the filter \"%s\", use \"storage filter none\"",
+			state.Filter)
+	}
+	return res, nil
+}
+
+// numFilteredImages returns the number of images that match the filter of
+// the state.
+func numFilteredImages(state *ExecutorState) int {
+	res := 0
+	for _, path := range state.Mapper.IDMapping {
+		if state.Filter.Match(state.Mapper, path) {
+			res++
+		}
+	}
+	return res
+}
+
+// restrictImages returns a copy of the state that contains only the images
+// for which keep returns true. The mapper and the precomputed data of the
+// copy are new objects, state is not changed.
+func (state *ExecutorState) restrictImages(keep func(path string) bool) *ExecutorState {
+	res := *state
+	mapper := *state.Mapper
+	res.Mapper = &mapper
+	// Retain creates new mappings, thus the mappings of state are not changed
+	kept := res.Mapper.Retain(keep)
+	res.ImgStorage = NewFSImageDB(res.Mapper)
+	res.ImgStorage.EXIF = state.ImgStorage.EXIF
+	if state.GCHStorage != nil {
+		gchs := state.GCHStorage.Copy()
+		gchs.Retain(kept)
+		res.GCHStorage = gchs
+	}
+	if state.LCHStorage != nil {
+		lchs := *state.LCHStorage
+		lchs.Retain(kept)
+		res.LCHStorage = &lchs
+	}
+	if state.Features != nil {
+		features := *state.Features
+		features.Retain(kept)
+		res.Features = &features
+	}
+	return &res
+}
+
+// retainImages removes all images for which keep returns false from the
+// mapper, the GCHs and LCHs are updated accordingly. It returns the number of
+// removed images.
+func retainImages(state *ExecutorState, keep func(path string) bool) int {
+	// the ids change, cached values can't be used any more
+	state.invalidateCaches()
+	numBefore := state.Mapper.Len()
+	kept := state.Mapper.Retain(keep)
+	if state.GCHStorage != nil {
+		state.GCHStorage.Retain(kept)
+	}
+	if state.LCHStorage != nil {
+		state.LCHStorage.Retain(kept)
+	}
+	if state.Features != nil {
+		state.Features.Retain(kept)
+	}
+	return numBefore - state.Mapper.Len()
+}
+
+// removeSkippedImages prints the images that were skipped while creating
+// GCHs, LCHs or features (see ImageErrorPolicy) and removes them from the
+// mapper and all loaded data, thus they're not used in mosaics.
+func removeSkippedImages(state *ExecutorState, report *ImageErrorReport) {
+	if report == nil || len(report.Skipped) == 0 {
+		return
+	}
+	skipped := make(map[string]bool, len(report.Skipped))
+	for _, path := range report.Paths() {
+		skipped[path] = true
+	}
+	for _, imgErr := range report.Skipped {
+		fmt.Fprintln(state.Out, imgErr.Error())
+	}
+	retainImages(state, func(path string) bool {
+		return !skipped[path]
+	})
+	fmt.Fprintf(state.Out, "Skipped %d of %d images that can't be read, they were removed from the storage\n",
+		len(report.Skipped), report.NumImages)
+}
+
+// pathPattern validates a glob pattern given by the user. Patterns without a
+// directory are matched against the file name and returned unchanged,
+// otherwise the absolute pattern is returned (see MatchPathPattern).
+func pathPattern(state *ExecutorState, pattern string) (string, error) {
+	if strings.ContainsRune(pattern, filepath.Separator) {
+		var pathErr error
+		pattern, pathErr = state.GetPath(pattern)
+		if pathErr != nil {
+			return "", pathErr
+		}
+	}
+	if patternErr := ValidatePatterns(pattern); patternErr != nil {
+		return "", patternErr
+	}
+	return pattern, nil
+}
+
+// parseLoadOptions parses the flags of the storage command, the patterns
+// of --include and --exclude are separated by ",". The size restrictions are
+// taken from the variables min-image-size and max-image-ratio.
+func parseLoadOptions(state *ExecutorState, flags map[string]string) (LoadOptions, error) {
+	options := LoadOptions{
+		MinWidth:    state.MinImageWidth,
+		MinHeight:   state.MinImageHeight,
+		MaxRatio:    state.MaxImageRatio,
+		NumRoutines: state.NumRoutines,
+	}
+	if state.Verbose {
+		// progress is called after each directory, report every 1000 files
+		reported := 0
+		options.Progress = func(num int) {
+			if num/1000 > reported/1000 {
+				fmt.Fprintf(state.Out, "Scanned %d files\n", num)
+			}
+			reported = num
+		}
+	}
+	for name, value := range flags {
+		switch name {
+		case "include", "exclude":
+			for _, pattern := range strings.Split(value, ",") {
+				pattern, patternErr := pathPattern(state, pattern)
+				if patternErr != nil {
+					return options, patternErr
+				}
+				if name == "include" {
+					options.Include = append(options.Include, pattern)
+				} else {
+					options.Exclude = append(options.Exclude, pattern)
+				}
+			}
+		case "follow-symlinks":
+			follow, boolErr := strconv.ParseBool(value)
+			if boolErr != nil {
+				return options, fmt.Errorf("invalid value for follow-symlinks (must be true or false): %s", boolErr.Error())
+			}
+			options.FollowSymlinks = follow
+		case "depth":
+			depth, parseErr := strconv.Atoi(value)
+			if parseErr != nil || depth <= 0 {
+				return options, fmt.Errorf("invalid value for depth (must be int > 0): %s", value)
+			}
+			options.MaxDepth = depth
+		default:
+			return options, fmt.Errorf("Unkown flag --%s", name)
+		}
+	}
+	return options, nil
+}
+
+// updatePrecomputed computes the GCHs and LCHs (if they are loaded) for the
+// images with id >= from, these images must be newly added to the mapper.
+// policy describes how images that can't be read are handled, with
+// ImageErrorsSkip they're removed again (see removeSkippedImages).
+// If an error occurs the precomputed data becomes invalid (set to nil).
+func updatePrecomputed(state *ExecutorState, from ImageID, policy ImageErrorPolicy) error {
+	numImages := state.Mapper.NumImages()
+	if from >= numImages {
+		return nil
+	}
+	// the precomputed data is changed in place
+	state.invalidateCaches()
+	ids := make([]ImageID, 0, int(numImages-from))
+	for id := from; id < numImages; id++ {
+		ids = append(ids, id)
+	}
+	var progress ProgressFunc
+	if state.Verbose {
+		progress = StdProgressFunc(state.Out, "", len(ids), IntMin(100, len(ids)/10))
+	}
+	// if the number of precomputed values doesn't match we can't update them
+	if state.GCHStorage != nil && state.GCHStorage.Len() != int(from) {
+		fmt.Fprintln(state.Out, "GCHs don't match the images in storage, GCHs must be reloaded")
+		state.GCHStorage = nil
+	}
+	if state.LCHStorage != nil && len(state.LCHStorage.LCHs) != int(from) {
+		fmt.Fprintln(state.Out, "LCHs don't match the images in storage, LCHs must be reloaded")
+		state.LCHStorage = nil
+	}
+	if state.Features != nil && len(state.Features.Features) != int(from) {
+		fmt.Fprintln(state.Out, "Features don't match the images in storage, features must be reloaded")
+		state.Features = nil
+	}
+	// images skipped by any of the storages, they're removed at the end
+	skipped := &ImageErrorReport{NumImages: len(ids)}
+	if state.GCHStorage != nil {
+		fmt.Fprintln(state.Out, "Creating GCHs for new images")
+		histograms, report, histErr := CreateHistogramsWithPolicy(ids, state.ImgStorage, true,
+			state.GCHStorage.Divisions(), state.NumRoutines, progress, policy)
+		if histErr != nil {
+			state.GCHStorage = nil
+			return histErr
+		}
+		skipped.Merge(report)
+		state.GCHStorage.Append(histograms...)
+	}
+	if state.LCHStorage != nil {
+		fmt.Fprintln(state.Out, "Creating LCHs for new images")
+		scheme, schemeErr := ParseLCHScheme(state.LCHStorage.SchemeDescriptor())
+		if schemeErr != nil {
+			state.LCHStorage = nil
+			return schemeErr
+		}
+		lchs, report, lchsErr := CreateLCHsWithPolicy(scheme, ids, state.ImgStorage, true,
+			state.LCHStorage.K, state.NumRoutines, progress, policy)
+		if lchsErr != nil {
+			state.LCHStorage = nil
+			return lchsErr
+		}
+		skipped.Merge(report)
+		state.LCHStorage.LCHs = append(state.LCHStorage.LCHs, lchs...)
+	}
+	if state.Features != nil {
+		fmt.Fprintln(state.Out, "Creating features for new images")
+		features, report, featuresErr := ExtractFeaturesWithPolicy(state.Features.FeatureExtractor, ids,
+			state.ImgStorage, state.NumRoutines, progress, policy)
+		if featuresErr != nil {
+			state.Features = nil
+			return featuresErr
+		}
+		skipped.Merge(report)
+		state.Features.Features = append(state.Features.Features, features...)
+	}
+	removeSkippedImages(state, skipped)
+	return nil
+}
+
+// TODO stuff here should be moved to other functions to avoid repeating code
+// later...
+
+// GCHCommand can create histograms for all images in storage, save and load
+// files.
+func GCHCommand(state *ExecutorState, args ...string) error {
+	switch {
+	case len(args) == 0:
+		return ErrCmdSyntaxErr
+	case args[0] == "create":
+		positional, flags, flagsErr := splitCommandFlags(args[1:])
+		if flagsErr != nil {
+			return flagsErr
+		}
+		if len(positional) > 1 {
+			return ErrCmdSyntaxErr
+		}
+		// k is the number of subdivions, defaults to 8
+		var k uint = 8
+		if len(positional) > 0 {
+			var kErr error
+			k, kErr = parseGCHK(positional[0])
+			if kErr != nil {
+				return kErr
+			}
+		}
+		compact, sparse := false, false
+		for name, value := range flags {
+			switch name {
+			case "precision":
+				var precisionErr error
+				compact, precisionErr = parseGCHPrecision(value)
+				if precisionErr != nil {
+					return precisionErr
+				}
+			case "sparse":
+				var boolErr error
+				sparse, boolErr = strconv.ParseBool(value)
+				if boolErr != nil {
+					return boolErr
+				}
+			default:
+				return fmt.Errorf("Unkown flag --%s", name)
+			}
+		}
+		if compact && sparse {
+			return errors.New("Sparse histograms are always stored with float64 precision")
+		}
+
+		// create all histograms
+		fmt.Fprintf(state.Out, "Creating histograms for all images in storage with k = %d sub-divisions\n", k)
 		var progress ProgressFunc
 		if state.Verbose {
 			inStore := int(state.ImgStorage.NumImages())
 			progress = StdProgressFunc(state.Out, "",
 				inStore, IntMin(100, inStore/10))
 		}
-		start := time.Now()
-		lchs, lchsErr := CreateAllLCHs(scheme, state.ImgStorage,
-			true, k, state.NumRoutines, progress)
-		execTime := time.Since(start)
-		if lchsErr != nil {
-			return lchsErr
+		numRoutines, budgetErr := featureRoutines(state, "Creating GCHs", k, 1)
+		if budgetErr != nil {
+			return budgetErr
 		}
-		// set
-		state.LCHStorage = &MemoryLCHStorage{
-			LCHs: lchs,
-			K:    k,
-			Size: uint(asInt),
+		timer := StartTimer(TimerHistograms)
+		var report *ImageErrorReport
+		var histErr error
+		switch {
+		case sparse:
+			var histograms []*SparseHistogram
+			histograms, report, histErr = CreateSparseHistogramsWithPolicy(IDList(state.ImgStorage),
+				state.ImgStorage, true, k, numRoutines, progress, state.ImageErrors)
+			if histErr == nil {
+				state.GCHStorage = &SparseHistStorage{Histograms: histograms, K: k}
+			}
+		case compact:
+			// the float64 histograms are never held in memory
+			var histograms []*CompactHistogram
+			histograms, report, histErr = CreateCompactHistogramsWithPolicy(IDList(state.ImgStorage),
+				state.ImgStorage, true, k, numRoutines, progress, state.ImageErrors)
+			if histErr == nil {
+				state.GCHStorage = &CompactHistStorage{Histograms: histograms, K: k}
+			}
+		default:
+			var histograms []*Histogram
+			histograms, report, histErr = CreateAllHistogramsWithPolicy(state.ImgStorage,
+				true, k, numRoutines, progress, state.ImageErrors)
+			if histErr == nil {
+				state.GCHStorage = &MemoryHistStorage{Histograms: histograms, K: k}
+			}
+		}
+		execTime := timer.Stop()
+		if histErr != nil {
+			return histErr
+		}
+		state.invalidateCaches()
+		removeSkippedImages(state, report)
+		fmt.Fprintf(state.Out, "Computed %d histograms in %v\n", state.GCHStorage.Len(), execTime)
+		return nil
+	case args[0] == "save":
+		if state.GCHStorage == nil {
+			return errors.New("No GCHs loaded yet")
+		}
+		// save ~/bla.[json|gob]
+		// save ~/
+		positional, flags, flagsErr := splitCommandFlags(args[1:])
+		if flagsErr != nil {
+			return flagsErr
+		}
+		if len(positional) != 1 {
+			return ErrCmdSyntaxErr
+		}
+		compact, sparse := false, false
+		root := ""
+		for name, value := range flags {
+			switch name {
+			case "root":
+				var rootErr error
+				root, rootErr = state.GetPath(value)
+				if rootErr != nil {
+					return rootErr
+				}
+			case "precision":
+				var precisionErr error
+				compact, precisionErr = parseGCHPrecision(value)
+				if precisionErr != nil {
+					return precisionErr
+				}
+			case "sparse":
+				var boolErr error
+				sparse, boolErr = strconv.ParseBool(value)
+				if boolErr != nil {
+					return boolErr
+				}
+			default:
+				return fmt.Errorf("Unkown flag --%s", name)
+			}
+		}
+		if compact && sparse {
+			return errors.New("Sparse histograms are always stored with float64 precision")
+		}
+		path, pathErr := state.GetPath(positional[0])
+		if pathErr != nil {
+			return pathErr
+		}
+		// check if path is a file or directory
+		// we don't report the fiErr (this is not nil if file doesn't exist which
+		// is of course allowed)
+		fi, fiErr := os.Lstat(path)
+		if fiErr == nil && fi.IsDir() {
+			// save with default naming scheme in that directory
+			name := GCHFileName(state.GCHStorage.Divisions(), "gob")
+			path = filepath.Join(path, name)
+		}
+		controller, creationErr := CreateHistFSController(IDList(state.ImgStorage),
+			state.Mapper, state.GCHStorage)
+		if creationErr != nil {
+			return creationErr
+		}
+		switch {
+		case compact:
+			controller.Compact()
+		case sparse:
+			controller.Sparse()
+		}
+		if root != "" {
+			if relErr := controller.MakeRelative(root); relErr != nil {
+				return relErr
+			}
+		}
+		// save file
+		saveErr := controller.WriteFile(path)
+		if saveErr == nil {
+			// ignore write error here
+			fmt.Fprintln(state.Out, "Successfully wrote", state.ImgStorage.NumImages(), "histograms",
+				"to", path)
+		}
+		return saveErr
+	case args[0] == "load":
+		path, root, argsErr := parseFeatureFileArgs(state, args[1:])
+		if argsErr != nil {
+			return argsErr
+		}
+		controller := HistogramFSController{}
+		readErr := controller.ReadFile(path)
+		if readErr != nil {
+			return readErr
+		}
+		if rebaseErr := controller.Rebase(root); rebaseErr != nil {
+			return rebaseErr
+		}
+		return loadGCHController(state, &controller)
+	case args[0] == "update" && (len(args) == 2 || len(args) == 3):
+		var k uint = 8
+		if len(args) > 2 {
+			var kErr error
+			k, kErr = parseGCHK(args[2])
+			if kErr != nil {
+				return kErr
+			}
+		}
+		path, pathErr := state.GetPath(args[1])
+		if pathErr != nil {
+			return pathErr
+		}
+		return updateGCHFile(state, path, k)
+	case args[0] == "show" && (len(args) == 3 || len(args) == 4):
+		return showGCHs(state, args[2], append([]string{args[1]}, args[3:]...))
+	default:
+		return ErrCmdSyntaxErr
+	}
+}
+
+// stateGCH returns the GCH of an image: If the image is in the storage and
+// GCHs are loaded the stored GCH is returned, otherwise the GCH is computed
+// (with the k of the loaded GCHs or 8).
+func stateGCH(state *ExecutorState, path string) (*Histogram, error) {
+	if state.GCHStorage != nil {
+		if id, has := state.Mapper.GetID(path); has {
+			return state.GCHStorage.GetHistogram(id)
+		}
+	}
+	var k uint = 8
+	if state.GCHStorage != nil {
+		k = state.GCHStorage.Divisions()
+	}
+	img, imgErr := LoadQueryImage(path, QueryPreprocessing{}, nil)
+	if imgErr != nil {
+		return nil, imgErr
+	}
+	return GenHistogram(img, k, true), nil
+}
+
+// showGCHs implements "gch show": The GCHs of the images are drawn as bar
+// charts to out (a .png, .jpg or .svg file), see RenderHistograms. If two
+// images are given the distance of the GCHs is printed.
+func showGCHs(state *ExecutorState, out string, images []string) error {
+	outPath, outErr := state.GetPath(out)
+	if outErr != nil {
+		return outErr
+	}
+	histograms := make([]*Histogram, len(images))
+	for i, image := range images {
+		path, pathErr := state.GetPath(image)
+		if pathErr != nil {
+			return pathErr
+		}
+		var histErr error
+		if histograms[i], histErr = stateGCH(state, path); histErr != nil {
+			return histErr
+		}
+	}
+	if len(histograms) == 2 {
+		if histograms[0].K != histograms[1].K {
+			return fmt.Errorf("GCHs have different sub-divisions: %d != %d", histograms[0].K, histograms[1].K)
+		}
+		for _, name := range []string{"euclid", "cosine"} {
+			metric, _ := GetHistogramMetric(name)
+			fmt.Fprintf(state.Out, "Distance (%s): %.4f\n", name, metric(histograms[0], histograms[1]))
+		}
+	}
+	if strings.ToLower(filepath.Ext(outPath)) == ".svg" {
+		f, createErr := os.Create(outPath)
+		if createErr != nil {
+			return createErr
+		}
+		defer f.Close()
+		if writeErr := WriteHistogramsSVG(f, HistogramChartWidth, HistogramChartHeight, histograms...); writeErr != nil {
+			return writeErr
+		}
+		if closeErr := f.Close(); closeErr != nil {
+			return closeErr
+		}
+	} else {
+		chart := RenderHistograms(HistogramChartWidth, HistogramChartHeight, histograms...)
+		if saveErr := saveImage(state, outPath, chart, nil); saveErr != nil {
+			return saveErr
+		}
+	}
+	fmt.Fprintln(state.Out, "Histogram chart saved to", outPath)
+	return nil
+}
+
+// parseGCHK parses the number of sub-divisions of GCHs, it must be between 1
+// and 256.
+func parseGCHK(s string) (uint, error) {
+	asInt, parseErr := strconv.Atoi(s)
+	if parseErr != nil {
+		return 0, parseErr
+	}
+	// validate k: must be >= 1 and <= 256
+	if asInt < 1 || asInt > 256 {
+		return 0, fmt.Errorf("k for GCH must be a value between 1 and 256, got %d", asInt)
+	}
+	return uint(asInt), nil
+}
+
+// gchFileExts are the extensions of GCH files tried by "gch update" if a
+// directory is given, in this order.
+var gchFileExts = []string{"gob", "gob.gz", "json", "json.gz"}
+
+// updateGCHFile implements "gch update": The GCHs are loaded from path (if
+// it's a directory the file is found by GCHFileName), only the GCHs of images
+// not in the file are computed. If GCHs were computed the file is updated.
+func updateGCHFile(state *ExecutorState, path string, k uint) error {
+	if fi, fiErr := os.Stat(path); fiErr == nil && fi.IsDir() {
+		dir := path
+		path = filepath.Join(dir, GCHFileName(k, gchFileExts[0]))
+		for _, ext := range gchFileExts {
+			candidate := filepath.Join(dir, GCHFileName(k, ext))
+			if _, statErr := os.Stat(candidate); statErr == nil {
+				path = candidate
+				break
+			}
+		}
+	}
+	var controller *HistogramFSController
+	// the root of a portable file is kept when the file is updated
+	root := ""
+	if _, statErr := os.Stat(path); statErr == nil {
+		controller = &HistogramFSController{}
+		if readErr := controller.ReadFile(path); readErr != nil {
+			return readErr
+		}
+		root = controller.Root
+		if rebaseErr := controller.Rebase(""); rebaseErr != nil {
+			return rebaseErr
+		}
+		fmt.Fprintf(state.Out, "Read %d histograms from %s\n", len(controller.Entries), path)
+		if controller.K != k {
+			fmt.Fprintf(state.Out, "Histograms in file have k = %d, expected %d: Computing all histograms\n",
+				controller.K, k)
+		}
+	}
+	var progress ProgressFunc
+	if state.Verbose {
+		inStore := int(state.ImgStorage.NumImages())
+		progress = StdProgressFunc(state.Out, "",
+			inStore, IntMin(100, inStore/10))
+	}
+	timer := StartTimer(TimerHistograms)
+	storage, numComputed, updateErr := UpdateHistStorage(state.Mapper, state.ImgStorage,
+		controller, k, state.NumRoutines, progress)
+	execTime := timer.Stop()
+	if updateErr != nil {
+		return updateErr
+	}
+	state.GCHStorage = storage
+	state.invalidateCaches()
+	fmt.Fprintf(state.Out, "Computed %d histograms in %v\n", numComputed, execTime)
+	if numComputed == 0 && controller != nil && len(controller.Entries) == len(storage.Histograms) {
+		// file is up to date
+		return nil
+	}
+	newController, creationErr := CreateHistFSController(IDList(state.ImgStorage),
+		state.Mapper, storage)
+	if creationErr != nil {
+		return creationErr
+	}
+	if root != "" {
+		if relErr := newController.MakeRelative(root); relErr != nil {
+			return relErr
+		}
+	}
+	if writeErr := newController.WriteFile(path); writeErr != nil {
+		return writeErr
+	}
+	fmt.Fprintln(state.Out, "Successfully wrote", len(storage.Histograms), "histograms to", path)
+	return nil
+}
+
+// parseFeatureFileArgs parses the arguments "<file> [--root dir]" used to save
+// and load feature files. It returns the path of the file and the root
+// directory (empty if not given), both are resolved with state.GetPath.
+func parseFeatureFileArgs(state *ExecutorState, args []string) (string, string, error) {
+	positional, flags, flagsErr := splitCommandFlags(args)
+	if flagsErr != nil {
+		return "", "", flagsErr
+	}
+	if len(positional) != 1 {
+		return "", "", ErrCmdSyntaxErr
+	}
+	root := ""
+	for name, value := range flags {
+		switch name {
+		case "root":
+			var rootErr error
+			root, rootErr = state.GetPath(value)
+			if rootErr != nil {
+				return "", "", rootErr
+			}
+		default:
+			return "", "", fmt.Errorf("Unkown flag --%s", name)
+		}
+	}
+	path, pathErr := state.GetPath(positional[0])
+	if pathErr != nil {
+		return "", "", pathErr
+	}
+	return path, root, nil
+}
+
+// loadGCHController maps the histograms from the controller to the images in
+// the storage and sets the GCHs of the state.
+func loadGCHController(state *ExecutorState, controller *HistogramFSController) error {
+	fmt.Fprintf(state.Out, "Read %d histograms\n", len(controller.Entries))
+	// we don't care about missing / new images, we just print a warning if
+	// the lengths have change.
+	if len(controller.Entries) != int(state.ImgStorage.NumImages()) {
+		fmt.Fprintln(state.Out, "Unmatched number of images in storage and loaded histograms.",
+			"Have the images changed? In this case the histograms must be re-computed.")
+	}
+	var storage HistogramList
+	var createErr error
+	switch {
+	case controller.IsCompact():
+		// float32 files are kept with float32 precision in memory
+		storage, createErr = CompactHistStorageFromFSMapper(state.Mapper, controller)
+	case controller.IsSparse():
+		storage, createErr = SparseHistStorageFromFSMapper(state.Mapper, controller)
+	default:
+		storage, createErr = MemHistStorageFromFSMapper(state.Mapper, controller, nil)
+	}
+	if createErr != nil {
+		return createErr
+	}
+	state.GCHStorage = storage
+	state.invalidateCaches()
+	fmt.Fprintln(state.Out, "Histograms have been mapped to image store.")
+	return nil
+}
+
+func LCHCommand(state *ExecutorState, args ...string) error {
+	switch {
+	case len(args) == 0:
+		return ErrCmdSyntaxErr
+	case args[0] == "create":
+		if len(args) < 3 {
+			return ErrCmdSyntaxErr
+		}
+		// k is the number of subdivions
+		asInt, parseErr := strconv.Atoi(args[1])
+		if parseErr != nil {
+			return parseErr
+		}
+		// validate k: must be >= 1 and <= 256
+		if asInt < 1 || asInt > 256 {
+			return fmt.Errorf("k for LCH must be a value between 1 and 256, got %d", asInt)
+		}
+		k := uint(asInt)
+		// parse scheme
+		scheme, schemeErr := ParseLCHScheme(args[2])
+		if schemeErr != nil {
+			return schemeErr
+		}
+		schemeSize, sizeErr := LCHSchemeSize(args[2])
+		if sizeErr != nil {
+			return sizeErr
+		}
+		// create all lchs
+		fmt.Fprintf(state.Out, "Creating LCHs for all images in storage with k = %d sub-divisions and %d parts\n", k, schemeSize)
+		var progress ProgressFunc
+		if state.Verbose {
+			inStore := int(state.ImgStorage.NumImages())
+			progress = StdProgressFunc(state.Out, "",
+				inStore, IntMin(100, inStore/10))
+		}
+		numRoutines, budgetErr := featureRoutines(state, "Creating LCHs", k, schemeSize)
+		if budgetErr != nil {
+			return budgetErr
+		}
+		timer := StartTimer(TimerHistograms)
+		lchs, report, lchsErr := CreateAllLCHsWithPolicy(scheme, state.ImgStorage,
+			true, k, numRoutines, progress, state.ImageErrors)
+		execTime := timer.Stop()
+		if lchsErr != nil {
+			return lchsErr
+		}
+		// set
+		state.LCHStorage = &MemoryLCHStorage{
+			LCHs:   lchs,
+			K:      k,
+			Size:   schemeSize,
+			Scheme: args[2],
+		}
+		state.invalidateCaches()
+		removeSkippedImages(state, report)
+		fmt.Fprintf(state.Out, "Computed %d LCHs in %v\n", len(state.LCHStorage.LCHs), execTime)
+		return nil
+	case args[0] == "save":
+		if state.LCHStorage == nil {
+			return errors.New("No LCHs loaded yet")
+		}
+		path, root, argsErr := parseFeatureFileArgs(state, args[1:])
+		if argsErr != nil {
+			return argsErr
+		}
+		// check if path is a file or directory
+		// we don't report the fiErr (this is not nil if file doesn't exist which
+		// is of course allowed)
+		fi, fiErr := os.Lstat(path)
+		if fiErr == nil && fi.IsDir() {
+			// save with default naming scheme in that directory
+			name := LCHFileName(state.LCHStorage.K, state.LCHStorage.Size, "gob")
+			path = filepath.Join(path, name)
+		}
+		controller, creationErr := CreateLCHFSController(IDList(state.ImgStorage),
+			state.Mapper, state.LCHStorage)
+		if creationErr != nil {
+			return creationErr
+		}
+		if root != "" {
+			if relErr := controller.MakeRelative(root); relErr != nil {
+				return relErr
+			}
+		}
+		// save file
+		saveErr := controller.WriteFile(path)
+		if saveErr == nil {
+			fmt.Fprintln(state.Out, "Successfully wrote", state.ImgStorage.NumImages(),
+				"LCHs to", path)
+		}
+		return saveErr
+	case args[0] == "load":
+		path, root, argsErr := parseFeatureFileArgs(state, args[1:])
+		if argsErr != nil {
+			return argsErr
+		}
+		controller := LCHFSController{}
+		readErr := controller.ReadFile(path)
+		if readErr != nil {
+			return readErr
+		}
+		if rebaseErr := controller.Rebase(root); rebaseErr != nil {
+			return rebaseErr
+		}
+		return loadLCHController(state, &controller)
+	default:
+		return ErrCmdSyntaxErr
+	}
+}
+
+// loadLCHController maps the LCHs from the controller to the images in the
+// storage and sets the LCHs of the state.
+func loadLCHController(state *ExecutorState, controller *LCHFSController) error {
+	fmt.Fprintf(state.Out, "Read %d LCHs\n", len(controller.Entries))
+	// we don't care about missing / new images, we just print a warning if
+	// the lengths have change.
+	if len(controller.Entries) != int(state.ImgStorage.NumImages()) {
+		fmt.Fprintln(state.Out, "Unmachted number of images in storage and loaded",
+			"LCHs. Have the images changed? In this case the LCHs must be re-computed.")
+	}
+	memStorage, createErr := MemLCHStorageFromFSMapper(state.Mapper, controller, nil)
+	if createErr != nil {
+		return createErr
+	}
+	// set
+	state.LCHStorage = memStorage
+	state.invalidateCaches()
+	fmt.Fprintln(state.Out, "LCHs have been mapped to image store.")
+	return nil
+}
+
+// FeatureCommand creates, saves and loads features of any registered feature
+// extractor (see RegisterFeatureExtractor). GCH and LCH features are also
+// used as the GCHs / LCHs of the state.
+func FeatureCommand(state *ExecutorState, args ...string) error {
+	if len(args) == 0 {
+		return ErrCmdSyntaxErr
+	}
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return ErrCmdSyntaxErr
+		}
+		fmt.Fprintln(state.Out, "Registered features:", strings.Join(GetFeatureExtractorNames(), ", "))
+		if state.Features != nil {
+			fmt.Fprintf(state.Out, "Loaded: %s (%d images)\n",
+				state.Features.FeatureExtractor.Descriptor(), len(state.Features.Features))
+		}
+		return nil
+	case "create":
+		if len(args) < 2 {
+			return ErrCmdSyntaxErr
+		}
+		extractor, extractorErr := ParseFeatureExtractor(args[1:]...)
+		if extractorErr != nil {
+			return extractorErr
+		}
+		fmt.Fprintf(state.Out, "Creating features \"%s\" for all images in storage\n", extractor.Descriptor())
+		var progress ProgressFunc
+		if state.Verbose {
+			inStore := int(state.ImgStorage.NumImages())
+			progress = StdProgressFunc(state.Out, "",
+				inStore, IntMin(100, inStore/10))
+		}
+		timer := StartTimer(TimerHistograms)
+		features, report, featuresErr := CreateFeaturesWithPolicy(extractor, state.ImgStorage,
+			state.NumRoutines, progress, state.ImageErrors)
+		execTime := timer.Stop()
+		if featuresErr != nil {
+			return featuresErr
+		}
+		setStateFeatures(state, features)
+		removeSkippedImages(state, report)
+		fmt.Fprintf(state.Out, "Computed %d features in %v\n", len(state.Features.Features), execTime)
+		return nil
+	case "save":
+		if state.Features == nil {
+			return errors.New("No features loaded yet")
+		}
+		path, root, argsErr := parseFeatureFileArgs(state, args[1:])
+		if argsErr != nil {
+			return argsErr
+		}
+		file, fileErr := NewFeatureFile(state.Mapper, state.Features, root)
+		if fileErr != nil {
+			return fileErr
+		}
+		if saveErr := file.WriteFile(path); saveErr != nil {
+			return saveErr
+		}
+		fmt.Fprintln(state.Out, "Successfully wrote", len(file.Entries), "features to", path)
+		return nil
+	case "load":
+		path, root, argsErr := parseFeatureFileArgs(state, args[1:])
+		if argsErr != nil {
+			return argsErr
+		}
+		file := FeatureFile{}
+		if readErr := file.ReadFile(path); readErr != nil {
+			return readErr
+		}
+		fmt.Fprintf(state.Out, "Read %d features \"%s\"\n", len(file.Entries), file.Descriptor)
+		features, storageErr := file.Storage(state.Mapper, root)
+		if storageErr != nil {
+			return storageErr
+		}
+		setStateFeatures(state, features)
+		fmt.Fprintln(state.Out, "Features have been mapped to image store.")
+		return nil
+	default:
+		return ErrCmdSyntaxErr
+	}
+}
+
+// GrayCommand creates, saves and loads luminance histograms, see
+// LuminanceExtractor. They're stored as the features of the state.
+func GrayCommand(state *ExecutorState, args ...string) error {
+	switch {
+	case len(args) == 0:
+		return ErrCmdSyntaxErr
+	case args[0] == "create":
+		if len(args) > 2 {
+			return ErrCmdSyntaxErr
+		}
+		featureArgs := []string{"create", "gray"}
+		if len(args) == 2 {
+			featureArgs = append(featureArgs, "k="+args[1])
+		}
+		return FeatureCommand(state, featureArgs...)
+	case args[0] == "save":
+		if _, isGray := state.featureExtractor().(LuminanceExtractor); !isGray {
+			return errors.New("No luminance histograms loaded yet")
+		}
+		return FeatureCommand(state, args...)
+	case args[0] == "load":
+		return FeatureCommand(state, args...)
+	default:
+		return ErrCmdSyntaxErr
+	}
+}
+
+// setStateFeatures sets the features of the state, GCH and LCH features are
+// also set as GCHs / LCHs.
+func setStateFeatures(state *ExecutorState, features *MemoryFeatureStorage) {
+	state.Features = features
+	state.invalidateCaches()
+	if gchs := features.HistogramStorage(); gchs != nil {
+		state.GCHStorage = gchs
+	}
+	if lchs := features.LCHStorage(); lchs != nil {
+		state.LCHStorage = lchs
+	}
+}
+
+// BundleCommand saves all loaded features (GCHs and LCHs) to one file or loads
+// them from such a file, see FeatureBundle.
+func BundleCommand(state *ExecutorState, args ...string) error {
+	if len(args) == 0 {
+		return ErrCmdSyntaxErr
+	}
+	path, root, argsErr := parseFeatureFileArgs(state, args[1:])
+	if argsErr != nil {
+		return argsErr
+	}
+	switch args[0] {
+	case "save":
+		if state.GCHStorage == nil && state.LCHStorage == nil {
+			return errors.New("No GCHs or LCHs loaded yet")
+		}
+		bundle, bundleErr := stateFeatureBundle(state)
+		if bundleErr != nil {
+			return bundleErr
+		}
+		if root != "" {
+			if bundle.GCH != nil {
+				if relErr := bundle.GCH.MakeRelative(root); relErr != nil {
+					return relErr
+				}
+			}
+			if bundle.LCH != nil {
+				if relErr := bundle.LCH.MakeRelative(root); relErr != nil {
+					return relErr
+				}
+			}
+		}
+		if saveErr := bundle.WriteFile(path); saveErr != nil {
+			return saveErr
+		}
+		fmt.Fprintln(state.Out, "Successfully wrote bundle to", path)
+		return nil
+	case "load":
+		bundle := FeatureBundle{}
+		if readErr := bundle.ReadFile(path); readErr != nil {
+			return readErr
+		}
+		return loadFeatureBundle(state, &bundle, root)
+	default:
+		return ErrCmdSyntaxErr
+	}
+}
+
+// SessionCommand saves the session (variables, images and features) to a
+// file or restores a session from such a file, see SaveSession and
+// LoadSession.
+func SessionCommand(state *ExecutorState, args ...string) error {
+	if len(args) != 2 {
+		return ErrCmdSyntaxErr
+	}
+	path, pathErr := state.GetPath(args[1])
+	if pathErr != nil {
+		return pathErr
+	}
+	switch args[0] {
+	case "save":
+		if saveErr := SaveSession(state, path); saveErr != nil {
+			return saveErr
+		}
+		fmt.Fprintln(state.Out, "Successfully wrote session to", path)
+		return nil
+	case "load":
+		return LoadSession(state, path)
+	default:
+		return ErrCmdSyntaxErr
+	}
+}
+
+// stateFeatureBundle returns a bundle containing the GCHs and LCHs of the
+// state, those not loaded are nil.
+func stateFeatureBundle(state *ExecutorState) (*FeatureBundle, error) {
+	bundle := &FeatureBundle{}
+	ids := IDList(state.ImgStorage)
+	if state.GCHStorage != nil {
+		controller, creationErr := CreateHistFSController(ids, state.Mapper, state.GCHStorage)
+		if creationErr != nil {
+			return nil, creationErr
+		}
+		bundle.GCH = controller
+	}
+	if state.LCHStorage != nil {
+		controller, creationErr := CreateLCHFSController(ids, state.Mapper, state.LCHStorage)
+		if creationErr != nil {
+			return nil, creationErr
+		}
+		bundle.LCH = controller
+	}
+	return bundle, nil
+}
+
+// loadFeatureBundle rebases the features in the bundle to root (see
+// parseFeatureFileArgs) and maps them to the images of the state.
+func loadFeatureBundle(state *ExecutorState, bundle *FeatureBundle, root string) error {
+	if bundle.GCH != nil {
+		if rebaseErr := bundle.GCH.Rebase(root); rebaseErr != nil {
+			return rebaseErr
+		}
+		if gchErr := loadGCHController(state, bundle.GCH); gchErr != nil {
+			return gchErr
+		}
+	}
+	if bundle.LCH != nil {
+		if rebaseErr := bundle.LCH.Rebase(root); rebaseErr != nil {
+			return rebaseErr
+		}
+		if lchErr := loadLCHController(state, bundle.LCH); lchErr != nil {
+			return lchErr
+		}
+	}
+	return nil
+}
+
+// parseGCHPrecision parses the precision of GCHs, it returns true for
+// "float32" (compact histograms) and false for "float64".
+func parseGCHPrecision(s string) (bool, error) {
+	switch s {
+	case "float64":
+		return false, nil
+	case "float32":
+		return true, nil
+	default:
+		return false, fmt.Errorf("Invalid precision %s, must be \"float64\" or \"float32\"", s)
+	}
+}
+
+// gchMetricName returns the name of the histogram metric of a gch selection.
+func gchMetricName(s string) (string, error) {
+	switch {
+	case s == "gch":
+		return "euclid", nil
+	case strings.HasPrefix(s, "gch-"):
+		return s[4:], nil
+	default:
+		return "", fmt.Errorf("Invalid gch format, expect \"gch\" or \"gch-<metric>\", got %s", s)
+	}
+}
+
+// parseGCHMetric returns the histogram metric and its batch version (nil if
+// there is none).
+func parseGCHMetric(s string) (HistogramMetric, BatchVectorMetric, error) {
+	metricName, nameErr := gchMetricName(s)
+	if nameErr != nil {
+		return nil, nil, nameErr
+	}
+	if metric, ok := GetHistogramMetric(metricName); ok {
+		batch, _ := GetBatchVectorMetric(metricName)
+		return metric, batch, nil
+	}
+	return nil, nil, fmt.Errorf("Unkown metric %s", metricName)
+}
+
+func parseLCHMetric(s string) (HistogramMetric, error) {
+	var metricName string
+	switch {
+	case s == "lch":
+		metricName = "euclid"
+	case strings.HasPrefix(s, "lch-"):
+		metricName = s[4:]
+	default:
+		return nil, fmt.Errorf("Invalid lch format, expect \"lch\" or \"lch-<metric>\", got %s", s)
+	}
+	if metric, ok := GetHistogramMetric(metricName); ok {
+		return metric, nil
+	}
+	return nil, fmt.Errorf("Unkown metric %s", metricName)
+}
+
+// divideQueryAndMosaic computes the division of the query image and the
+// division of the mosaic given the layout. Both divisions have the same
+// structure, that is the tile at position (i, j) in the query is replaced by
+// the database image in tile (i, j) of the mosaic.
+//
+// jitter and seed are only used for CmdLayoutJitter.
+func divideQueryAndMosaic(layout CmdLayout, query image.Image, tilesX, tilesY int,
+	cut bool, jitter float64, seed int64, mosaicBounds image.Rectangle) (TileDivision, TileDivision) {
+	var divider ImageDivider
+	switch layout {
+	case CmdLayoutBrick:
+		divider = NewBrickDivider(tilesX, tilesY, cut)
+	case CmdLayoutJitter:
+		divider = NewJitterDivider(tilesX, tilesY, jitter, cut, seed)
+	case CmdLayoutQuadtree:
+		divider = NewQuadtreeDivider(query, tilesX, tilesY, cut)
+	default:
+		// the grid divisions are computed independently, this way the tiles
+		// in the mosaic all have the same size
+		gridDivider := NewFixedNumDivider(tilesX, tilesY, true)
+		dist := gridDivider.Divide(query.Bounds())
+		gridDivider.Cut = cut
+		return dist, gridDivider.Divide(mosaicBounds)
+	}
+	return divideWith(divider, query, mosaicBounds)
+}
+
+// divideWith divides the query with divider, the number of tiles in a row
+// depends on the query, so the mosaic division is computed by scaling the
+// query division.
+func divideWith(divider ImageDivider, query image.Image, mosaicBounds image.Rectangle) (TileDivision, TileDivision) {
+	dist := divider.Divide(query.Bounds())
+	return dist, ScaleDivision(dist, query.Bounds(), mosaicBounds)
+}
+
+// divideQueryAndMosaic works as the function divideQueryAndMosaic with the
+// layout of the state, this includes dividers registered with
+// RegisterDivider.
+func (state *ExecutorState) divideQueryAndMosaic(query image.Image, tilesX, tilesY int,
+	mosaicBounds image.Rectangle) (TileDivision, TileDivision) {
+	if state.Layout == CmdLayoutCustom {
+		// set only accepts registered dividers, so the grid is only used if
+		// there is a bug
+		if factory, has := GetDivider(state.CustomLayout); has {
+			return divideWith(factory(query, tilesX, tilesY, state.CutMosaic), query, mosaicBounds)
+		}
+	}
+	return divideQueryAndMosaic(state.Layout, query, tilesX, tilesY, state.CutMosaic,
+		state.Jitter, state.Seed, mosaicBounds)
+}
+
+func parseOverlay(s string) (float64, error) {
+	val, parseErr := ParsePercent(s)
+	if parseErr != nil {
+		return 0.0, fmt.Errorf("invalid value for overlay, must be a value between 0 and 1: %s", parseErr.Error())
+	}
+	if val < 0.0 || val > 1.0 {
+		return 0.0, fmt.Errorf("invalid value for overlay, must be a value between 0 and 1: %.2f", val)
+	}
+	return val, nil
+}
+
+// splitCommandFlags separates the positional arguments of a command from
+// flags of the form "--name value". Flags may appear anywhere in args, each
+// flag requires a value.
+// The result contains the positional arguments and a mapping from flag name
+// (without the leading "--") to its value.
+func splitCommandFlags(args []string) ([]string, map[string]string, error) {
+	positional := make([]string, 0, len(args))
+	flags := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			positional = append(positional, arg)
+			continue
+		}
+		name := arg[2:]
+		if name == "" {
+			return nil, nil, fmt.Errorf("invalid flag \"%s\"", arg)
+		}
+		if i+1 >= len(args) {
+			return nil, nil, fmt.Errorf("missing value for flag \"%s\"", arg)
+		}
+		flags[name] = args[i+1]
+		i++
+	}
+	return positional, flags, nil
+}
+
+func saveImage(state *ExecutorState, file string, img image.Image, metadata MosaicMetadata) error {
+	return SaveMosaic(file, img, metadata, state.JPGQuality, state.PNGCompression, state.NumRoutines)
+}
+
+// mosaicMetadata returns the metadata embedded in a mosaic: The parameters
+// together with the number of images in the storage.
+func mosaicMetadata(state *ExecutorState, parameters map[string]string) MosaicMetadata {
+	res := NewMosaicMetadata()
+	for key, value := range parameters {
+		res[key] = value
+	}
+	res["database-size"] = strconv.Itoa(int(state.ImgStorage.NumImages()))
+	return res
+}
+
+// MosaicCommand creates a mosaic images.
+// For details see the entry created in the init() method / the description
+// text of the command our the online documentation. Usage example:
+// mosaic in.jpg out.jpg gch-cosine 20x30 1024x768
+func MosaicCommand(state *ExecutorState, args ...string) error {
+	// mosaic in.png out.png gch-... tilesXxtilesY [outDimensions] [--overlay x] [--recurse n]
+	if len(args) > 0 && args[0] == "plan" {
+		return mosaicPlanCommand(state, args[1:]...)
+	}
+	if len(args) == 2 && args[0] == "info" {
+		return mosaicInfoCommand(state, args[1])
+	}
+	if int(state.ImgStorage.NumImages()) == 0 {
+		return errors.New("No images in storage, use \"storage load\"")
+	}
+	if filtered, filterErr := state.filteredState(); filterErr != nil {
+		return filterErr
+	} else if filtered != state {
+		original := state
+		defer func() { original.LastPlan, original.LastMosaic = filtered.LastPlan, filtered.LastMosaic }()
+		state = filtered
+	}
+	args, flags, flagsErr := splitCommandFlags(args)
+	if flagsErr != nil {
+		return flagsErr
+	}
+	overlay := state.Overlay
+	recurse := 0
+	maskPath, maskMetric, shapePath, reportPath, heatmapPath := "", "", "", "", ""
+	preview := ""
+	for name, value := range flags {
+		switch name {
+		case "preview":
+			if _, specErr := ParseSizeSpec(value); specErr != nil {
+				return fmt.Errorf("invalid value for preview: %s", specErr.Error())
+			}
+			preview = value
+		case "only":
+			// use only the images with the given labels, the plan of the mosaic is
+			// kept in the original state
+			restricted, restrictErr := state.restrictLabels(strings.Split(value, ","))
+			if restrictErr != nil {
+				return restrictErr
+			}
+			if restricted.Mapper.Len() == 0 {
+				return fmt.Errorf("No images with label(s) %s in storage", value)
+			}
+			original := state
+			defer func() { original.LastPlan, original.LastMosaic = restricted.LastPlan, restricted.LastMosaic }()
+			state = restricted
+		case "report":
+			reportPath = value
+		case "heatmap":
+			if !JPGAndPNG(filepath.Ext(value)) {
+				return fmt.Errorf("Supported files for the heatmap are .jpg and .png, got file %s", value)
+			}
+			heatmapPath = value
+		case "shape":
+			shapePath = value
+		case "mask":
+			maskPath = value
+		case "mask-metric":
+			maskMetric = value
+		case "overlay":
+			var overlayErr error
+			overlay, overlayErr = parseOverlay(value)
+			if overlayErr != nil {
+				return overlayErr
+			}
+		case "recurse":
+			var recurseErr error
+			recurse, recurseErr = strconv.Atoi(value)
+			if recurseErr != nil || recurse < 0 {
+				return fmt.Errorf("invalid value for recurse, must be int >= 0: %s", value)
+			}
+		default:
+			return fmt.Errorf("Unkown flag --%s", name)
+		}
+	}
+	switch {
+	case len(args) > 3:
+		stats, restore := collectStats(state)
+		defer restore()
+		totalTimer := StartTimer(TimerTotal)
+		if !JPGAndPNG(filepath.Ext(args[1])) {
+			return fmt.Errorf("Supported files are .jpg and .png, got file %s", args[1])
+		}
+		// get out path
+		outPath, outPathErr := state.GetPath(args[1])
+		if outPathErr != nil {
+			return outPathErr
+		}
+		setup, setupErr := newMosaicSetup(state, args[2])
+		if setupErr != nil {
+			return setupErr
+		}
+		tilesX, tilesY, tilesErr := parseTiles(args[3])
+		if tilesErr != nil {
+			return tilesErr
+		}
+		inPath, inPathErr := state.GetPath(args[0])
+		if inPathErr != nil {
+			return inPathErr
+		}
+		// read query image
+		if state.Verbose {
+			fmt.Fprintln(state.Out, "Reading image", inPath)
+		}
+		img, loadErr := LoadQueryImage(inPath, state.Preprocess, setup.resizer)
+		if loadErr != nil {
+			return loadErr
+		}
+		selector := setup.selector
+		if maskPath != "" {
+			var maskErr error
+			selector, maskErr = newMaskedSelector(state, setup, maskPath, args[2], maskMetric)
+			if maskErr != nil {
+				return maskErr
+			}
+		} else if maskMetric != "" {
+			return errors.New("--mask-metric requires --mask")
+		}
+		// tiles that are transparent in the query or black in the shape are
+		// left empty
+		var shape image.Image
+		if shapePath != "" {
+			var shapeErr error
+			shape, shapeErr = loadMaskImage(state, shapePath, setup.resizer)
+			if shapeErr != nil {
+				return shapeErr
+			}
+		}
+		selector = NewSkipSelector(selector, shape)
+		dimensions := ""
+		if len(args) > 4 {
+			dimensions = args[4]
+		}
+		mosaicBounds, boundsErr := mosaicDimensions(img.Bounds(), dimensions)
+		if boundsErr != nil {
+			return boundsErr
+		}
+		dist, mosaicDist := state.divideQueryAndMosaic(img, tilesX, tilesY,
+			mosaicBounds)
+		cache, budgetErr := mosaicCache(state, img, dist, mosaicDist)
+		if budgetErr != nil {
+			return budgetErr
+		}
+		if state.Verbose {
+			fmt.Fprintln(state.Out)
+			fmt.Fprintln(state.Out, "Selecting database images for tiles")
+		}
+		var progress ProgressFunc
+		if state.Verbose {
+			numTiles := dist.Size()
+			progress = StdProgressFunc(state.Out, "",
+				numTiles, IntMin(100, numTiles/10))
+		}
+		selectionTimer := StartTimer(TimerSelection)
+		numCandidates := 0
+		if reportPath != "" {
+			numCandidates = ReportCandidates
+		}
+		details, detailsErr := SelectDetailed(selector, nil, setup.storage, img, dist,
+			numCandidates, progress)
+		if detailsErr != nil {
+			return detailsErr
+		}
+		// the values reported by the selector may include image weights or the
+		// variety penalty, the report and the heatmap show the values of the
+		// plain metric
+		if (heatmapPath != "" || reportPath != "") && setup.metric != nil {
+			values, valuesErr := MetricValues(setup.storage, setup.metric, img, dist, details.Selection)
+			if valuesErr != nil {
+				return valuesErr
+			}
+			details.Values = values
+		}
+		if heatmapPath != "" && details.Values == nil {
+			return fmt.Errorf("Selection %s doesn't report metric values, can't create heatmap", args[2])
+		}
+		selection := details.Selection
+		selectionTimer.Stop()
+		if state.Verbose {
+			fmt.Fprintln(state.Out)
+			fmt.Fprintln(state.Out, "Composing mosaic")
+		}
+		oriented, _ := setup.storage.(*OrientedStorage)
+		plan, planErr := NewMosaicPlan(img.Bounds(), dist, selection, state.Mapper, oriented)
+		if planErr != nil {
+			return planErr
+		}
+		if detailsErr := plan.AddDetails(details, state.Mapper, oriented); detailsErr != nil {
+			return detailsErr
+		}
+		plan.Parameters["selection"] = args[2]
+		plan.Parameters["tiles"] = args[3]
+		plan.Parameters["layout"] = state.layoutString()
+		plan.Parameters["variety"] = state.VarietySelector.DisplayString()
+		plan.Parameters["orientations"] = state.Orientations.DisplayString()
+		if maskPath != "" {
+			plan.Parameters["mask"] = maskPath
+		}
+		state.LastPlan = plan
+		transform, transformErr := setup.transforms(img, dist)
+		if transformErr != nil {
+			return transformErr
+		}
+		composeStorage := setup.storage
+		if recurse > 0 {
+			// each tile becomes a mosaic itself, for each of these mosaics a new
+			// selector is required
+			newSelector := func() (ImageSelector, error) {
+				tileSetup, tileSetupErr := newMosaicSetup(state, args[2])
+				if tileSetupErr != nil {
+					return nil, tileSetupErr
+				}
+				return tileSetup.selector, nil
+			}
+			composeStorage = NewRecursiveStorage(setup.storage, newSelector,
+				tilesX, tilesY, recurse, maxTileSize(mosaicDist), setup.resizer,
+				setup.strategy, state.NumRoutines)
+		}
+		if preview != "" {
+			// the preview is composed from the database images, not the
+			// recursive mosaics
+			metadata := mosaicMetadata(state, plan.Parameters)
+			metadata["query"] = filepath.Base(inPath)
+			metadata["num-tiles"] = strconv.Itoa(dist.Size())
+			if previewErr := writeMosaicPreview(state, setup, previewPath(outPath), img,
+				selection, mosaicDist, transform, preview, overlay, metadata); previewErr != nil {
+				return previewErr
+			}
+		}
+		// progress func should be fine to use
+		mosaic, composeReport, mosaicErr := ComposeMosaicWithPolicy(composeStorage, selection, mosaicDist,
+			setup.resizer, setup.strategy, transform, setup.border,
+			state.NumRoutines, cache, progress, state.ComposeErrors,
+			NewPrefetcher(state.Prefetch, state.NumRoutines))
+		if mosaicErr != nil {
+			return mosaicErr
+		}
+		if len(composeReport.Errors) > 0 {
+			fmt.Fprintln(state.Out)
+			for _, tileErr := range composeReport.Errors {
+				// the plan contains the path also for oriented images, the tile is
+				// printed as (x, y) as expected by retile
+				fmt.Fprintf(state.Out, "Tile (%d, %d) left empty, can't compose %s: %s\n",
+					tileErr.Column, tileErr.Row, plan.Tiles[tileErr.Row][tileErr.Column].Path,
+					tileErr.Err.Error())
+			}
+			fmt.Fprintf(state.Out, "Composed %d of %d tiles, %d failed\n",
+				composeReport.NumComposed, composeReport.NumTiles, len(composeReport.Errors))
+		}
+		if overlay > 0.0 {
+			mosaic = OverlayImage(mosaic, img, overlay, setup.resizer)
+		}
+		if state.Verbose {
+			fmt.Fprintln(state.Out)
+			fmt.Fprintln(state.Out, "Saving image")
+		}
+		metadata := mosaicMetadata(state, plan.Parameters)
+		metadata["query"] = filepath.Base(inPath)
+		metadata["num-tiles"] = strconv.Itoa(dist.Size())
+		if len(composeReport.Errors) > 0 {
+			metadata["failed-tiles"] = strconv.Itoa(len(composeReport.Errors))
+		}
+		if writeErr := saveImage(state, outPath, mosaic, metadata); writeErr != nil {
+			return writeErr
+		}
+		fmt.Fprintln(state.Out, "Mosaic saved to", outPath)
+		// the tiles of recursive mosaics are mosaics themselves, they can't be
+		// replaced by retile
+		state.LastMosaic = nil
+		if recurse == 0 {
+			state.LastMosaic = &MosaicOutput{Query: inPath, Path: outPath, Division: mosaicDist, Overlay: overlay}
+		}
+		if reportPath != "" {
+			if reportErr := writeMosaicReport(state, reportPath, outPath,
+				mosaicDist, plan); reportErr != nil {
+				return reportErr
+			}
+		}
+		if heatmapPath != "" {
+			if heatmapErr := writeHeatmap(state, heatmapPath, mosaicDist, details.Values); heatmapErr != nil {
+				return heatmapErr
+			}
+		}
+		totalTimer.Stop()
+		writeStats(state, stats)
+		return nil
+	default:
+		return ErrCmdSyntaxErr
+	}
+}
+
+// previewPath returns the path of the preview of a mosaic: "-preview" is
+// appended to the file name, for example "out-preview.jpg" for "out.jpg".
+func previewPath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-preview" + ext
+}
+
+// writeMosaicPreview composes a low-resolution version of the mosaic from the
+// selection and saves it to path. size is a SizeSpec relative to the size of
+// the mosaic, for example "25%". The border is scaled like the tiles, the
+// preview uses its own image cache s.t. the tiles of the mosaic are not
+// evicted.
+func writeMosaicPreview(state *ExecutorState, setup *mosaicSetup, path string, query image.Image,
+	selection [][]ImageID, mosaicDist TileDivision, transform TileTransform, size string,
+	overlay float64, metadata MosaicMetadata) error {
+	mosaicBounds := mosaicDist.Bounds()
+	mosaicBounds.Min = image.Pt(0, 0)
+	previewBounds, boundsErr := mosaicDimensions(mosaicBounds, size)
+	if boundsErr != nil {
+		return boundsErr
+	}
+	previewDist := ScaleDivision(mosaicDist, mosaicBounds, previewBounds)
+	border := setup.border
+	border.Width = border.Width * previewBounds.Dx() / mosaicBounds.Dx()
+	preview, _, composeErr := ComposeMosaicWithPolicy(setup.storage, selection, previewDist,
+		setup.resizer, setup.strategy, transform, border, state.NumRoutines,
+		NewImageCache(ImageCacheSize), nil, state.ComposeErrors, nil)
+	if composeErr != nil {
+		return composeErr
+	}
+	if overlay > 0.0 {
+		preview = OverlayImage(preview, query, overlay, setup.resizer)
+	}
+	if writeErr := saveImage(state, path, preview, metadata); writeErr != nil {
+		return writeErr
+	}
+	fmt.Fprintln(state.Out, "Preview saved to", path)
+	return nil
+}
+
+// featureRoutines returns the number of images decoded concurrently when
+// creating features (parts histograms with k sub-divisions for each image):
+// If the memory budget is exceeded fewer images are decoded concurrently.
+func featureRoutines(state *ExecutorState, operation string, k, parts uint) (int, error) {
+	if state.MaxMemory == 0 {
+		return state.NumRoutines, nil
+	}
+	fixed := HistogramBytes(state.Mapper.Len(), k, parts)
+	perRoutine := ImageBytes(SampleImagePixels(state.Mapper))
+	numRoutines, budgetErr := state.MaxMemory.Chunk(operation, fixed, perRoutine, state.NumRoutines)
+	if budgetErr != nil {
+		return 0, budgetErr
+	}
+	if numRoutines < state.NumRoutines {
+		fmt.Fprintf(state.Out, "Memory budget: Decoding %d instead of %d images concurrently\n",
+			numRoutines, state.NumRoutines)
+	}
+	return numRoutines, nil
+}
+
+// mosaicCache checks the memory budget for the mosaic command and returns the
+// image cache used for the composition. The query, the mosaic, the image
+// heaps of the variety selectors and the decoded database images must fit in
+// the budget, the cache is shrunk if required.
+func mosaicCache(state *ExecutorState, query image.Image, dist, mosaicDist TileDivision) (*ImageCache, error) {
+	if state.MaxMemory == 0 {
+		return state.newImageCache(), nil
+	}
+	mosaicBounds := mosaicDist.Bounds()
+	fixed := ImageBytes(query.Bounds().Dx()*query.Bounds().Dy()) +
+		ImageBytes(mosaicBounds.Dx()*mosaicBounds.Dy()) +
+		uint64(state.NumRoutines)*ImageBytes(SampleImagePixels(state.Mapper))
+	switch state.VarietySelector {
+	case CmdVarietyRand, CmdVarietyPenalty:
+		numBestFit := state.GetBestFitImages(int(state.ImgStorage.NumImages()))
+		fixed += HeapBytes(dist.Size(), numBestFit)
+	}
+	cacheSize := state.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = ImageCacheSize
+	}
+	tileSize := maxTileSize(mosaicDist)
+	size, budgetErr := state.MaxMemory.Chunk("Creating the mosaic", fixed,
+		ImageBytes(tileSize*tileSize), cacheSize)
+	if budgetErr != nil {
+		return nil, budgetErr
+	}
+	if size < cacheSize {
+		fmt.Fprintf(state.Out, "Memory budget: Using an image cache of size %d instead of %d\n",
+			size, cacheSize)
+	}
+	return NewImageCache(size), nil
+}
+
+// writeMosaicReport writes the HTML report of a mosaic, see SaveHTMLReport.
+// The metric values and candidates are taken from the plan (registered
+// selectors don't need to provide a metric, in this case there are no
+// values).
+func writeMosaicReport(state *ExecutorState, reportFile, mosaicPath string,
+	mosaicDist TileDivision, plan *MosaicPlan) error {
+	reportPath, reportPathErr := state.GetPath(reportFile)
+	if reportPathErr != nil {
+		return reportPathErr
+	}
+	if reportErr := SaveHTMLReport(reportPath, mosaicPath, mosaicDist, plan, nil); reportErr != nil {
+		return reportErr
+	}
+	fmt.Fprintln(state.Out, "Report saved to", reportPath)
+	return nil
+}
+
+// writeHeatmap saves the heatmap of the distances, see RenderHeatmap.
+func writeHeatmap(state *ExecutorState, heatmapFile string, mosaicDist TileDivision,
+	distances [][]float64) error {
+	heatmapPath, heatmapPathErr := state.GetPath(heatmapFile)
+	if heatmapPathErr != nil {
+		return heatmapPathErr
+	}
+	if saveErr := saveImage(state, heatmapPath, RenderHeatmap(mosaicDist, distances), nil); saveErr != nil {
+		return saveErr
+	}
+	fmt.Fprintln(state.Out, "Heatmap saved to", heatmapPath)
+	return nil
+}
+
+// mosaicInfoCommand prints the metadata embedded in a mosaic.
+func mosaicInfoCommand(state *ExecutorState, file string) error {
+	// mosaic info out.png
+	path, pathErr := state.GetPath(file)
+	if pathErr != nil {
+		return pathErr
+	}
+	metadata, metadataErr := ReadMosaicMetadata(path)
+	if metadataErr != nil {
+		return metadataErr
+	}
+	if len(metadata) == 0 {
+		fmt.Fprintln(state.Out, "No gomosaic metadata found in", path)
+		return nil
+	}
+	for _, key := range metadata.Keys() {
+		fmt.Fprintf(state.Out, "%s ==> %s\n", key, metadata[key])
+	}
+	return nil
+}
+
+// mosaicPlanCommand implements the "mosaic plan" subcommands, they're used
+// to save the selection of the last mosaic and to render a saved selection.
+func mosaicPlanCommand(state *ExecutorState, args ...string) error {
+	// mosaic plan save plan.json
+	// mosaic plan render plan.json out.png [outDimensions]
+	switch {
+	case len(args) == 2 && args[0] == "save":
+		if state.LastPlan == nil {
+			return errors.New("No plan to save, create a mosaic first")
+		}
+		path, pathErr := state.GetPath(args[1])
+		if pathErr != nil {
+			return pathErr
+		}
+		if writeErr := state.LastPlan.WriteJSON(path); writeErr != nil {
+			return writeErr
+		}
+		fmt.Fprintln(state.Out, "Plan saved to", path)
+		return nil
+	case len(args) > 2 && args[0] == "render":
+		if int(state.ImgStorage.NumImages()) == 0 {
+			return errors.New("No images in storage, use \"storage load\"")
+		}
+		planPath, planPathErr := state.GetPath(args[1])
+		if planPathErr != nil {
+			return planPathErr
+		}
+		if !JPGAndPNG(filepath.Ext(args[2])) {
+			return fmt.Errorf("Supported files are .jpg and .png, got file %s", args[2])
+		}
+		outPath, outPathErr := state.GetPath(args[2])
+		if outPathErr != nil {
+			return outPathErr
+		}
+		plan, planErr := ReadMosaicPlan(planPath)
+		if planErr != nil {
+			return planErr
+		}
+		dimensions := ""
+		if len(args) > 3 {
+			dimensions = args[3]
+		}
+		mosaicBounds, boundsErr := mosaicDimensions(plan.QueryBounds, dimensions)
+		if boundsErr != nil {
+			return boundsErr
+		}
+		strategy, hasStrategy := GetResizeStrategy(state.Strategy)
+		if !hasStrategy {
+			return fmt.Errorf("Unkown resize strategy %s", state.Strategy)
+		}
+		border := TileBorder{Width: state.TileBorder, Color: state.TileBorderColor}
+		resizer := NewNfntResizer(state.InterP)
+		var progress ProgressFunc
+		if state.Verbose {
+			numTiles := plan.Division.Size()
+			progress = StdProgressFunc(state.Out, "",
+				numTiles, IntMin(100, numTiles/10))
+		}
+		stats, restore := collectStats(state)
+		defer restore()
+		storage, storageErr := state.composeStorage()
+		if storageErr != nil {
+			return storageErr
+		}
+		mosaic, mosaicErr := plan.Render(storage, state.Mapper, mosaicBounds,
+			resizer, strategy, border, state.NumRoutines, state.newImageCache(), progress)
+		if mosaicErr != nil {
+			return mosaicErr
+		}
+		metadata := mosaicMetadata(state, plan.Parameters)
+		metadata["num-tiles"] = strconv.Itoa(plan.Division.Size())
+		if writeErr := saveImage(state, outPath, mosaic, metadata); writeErr != nil {
+			return writeErr
+		}
+		fmt.Fprintln(state.Out, "Mosaic saved to", outPath)
+		writeStats(state, stats)
+		return nil
+	default:
+		return ErrCmdSyntaxErr
+	}
+}
+
+// UndoCommand reverts the last command that changed the state (like set,
+// storage load or gch create), see changesState for the recorded commands.
+func UndoCommand(state *ExecutorState, args ...string) error {
+	if len(args) != 0 {
+		return ErrCmdSyntaxErr
+	}
+	cmd, ok := state.undo()
+	if !ok {
+		return errors.New("Nothing to undo")
+	}
+	fmt.Fprintf(state.Out, "Undone \"%s\"\n", cmd)
+	return nil
+}
+
+// RedoCommand restores the state after the last command reverted with undo.
+func RedoCommand(state *ExecutorState, args ...string) error {
+	if len(args) != 0 {
+		return ErrCmdSyntaxErr
+	}
+	cmd, ok := state.redo()
+	if !ok {
+		return errors.New("Nothing to redo")
+	}
+	fmt.Fprintf(state.Out, "Redone \"%s\"\n", cmd)
+	return nil
+}
+
+// RetileCommand replaces a single tile of the last mosaic created with the
+// mosaic command: The best image for the tile (without variety) is selected
+// again, either among all images except the current image of the tile or only
+// among the orientations of a given image. The saved mosaic and the plan are
+// changed in place.
+func RetileCommand(state *ExecutorState, args ...string) error {
+	// retile x y [exclude|file]
+	if len(args) < 2 || len(args) > 3 {
+		return ErrCmdSyntaxErr
+	}
+	if state.LastPlan == nil || state.LastMosaic == nil {
+		return errors.New("No mosaic to retile, create a (non-recursive) mosaic with the mosaic command first")
+	}
+	state, filterErr := state.filteredState()
+	if filterErr != nil {
+		return filterErr
+	}
+	tileX, xErr := strconv.Atoi(args[0])
+	tileY, yErr := strconv.Atoi(args[1])
+	if xErr != nil || yErr != nil {
+		return fmt.Errorf("Invalid tile \"%s %s\", expect the column and row of the tile", args[0], args[1])
+	}
+	plan, output := state.LastPlan, state.LastMosaic
+	// plan.Tiles is indexed by row first, so y selects the row and x the column
+	if tileY < 0 || tileY >= len(plan.Tiles) {
+		return fmt.Errorf("Invalid tile (%d, %d), the mosaic has %d rows", tileX, tileY, len(plan.Tiles))
+	}
+	if tileX < 0 || tileX >= len(plan.Tiles[tileY]) {
+		return fmt.Errorf("Invalid tile (%d, %d), row %d has %d columns", tileX, tileY, tileY, len(plan.Tiles[tileY]))
+	}
+	setup, setupErr := newMosaicSetup(state, plan.Parameters["selection"])
+	if setupErr != nil {
+		return setupErr
+	}
+	if setup.metric == nil {
+		return fmt.Errorf("Selection %s doesn't support retile", plan.Parameters["selection"])
+	}
+	oriented, _ := setup.storage.(*OrientedStorage)
+	current := plan.Tiles[tileY][tileX].Path
+	var accept func(id ImageID) bool
+	if len(args) > 2 {
+		forced := ""
+		if args[2] != "exclude" {
+			var forcedErr error
+			forced, forcedErr = state.GetPath(args[2])
+			if forcedErr != nil {
+				return forcedErr
+			}
+			if _, inStorage := state.Mapper.GetID(forced); !inStorage {
+				return fmt.Errorf("Image %s is not in the storage", forced)
+			}
+		}
+		accept = func(id ImageID) bool {
+			path, _, pathErr := planImage(id, state.Mapper, oriented)
+			if pathErr != nil {
+				return false
+			}
+			if forced != "" {
+				return path == forced
+			}
+			return path != current
+		}
+	}
+	query, loadErr := LoadQueryImage(output.Query, state.Preprocess, setup.resizer)
+	if loadErr != nil {
+		return loadErr
+	}
+	id, value, bestErr := BestTileImage(setup.storage, setup.metric, query, plan.Division,
+		tileY, tileX, accept)
+	if bestErr != nil {
+		return bestErr
+	}
+	mosaic, mosaicErr := FileQuery(output.Path)()
+	if mosaicErr != nil {
+		return mosaicErr
+	}
+	transform, transformErr := setup.transforms(query, plan.Division)
+	if transformErr != nil {
+		return transformErr
+	}
+	area := output.Division[tileY][tileX]
+	patched, patchErr := PatchTile(mosaic, area, setup.storage, id, setup.resizer,
+		setup.strategy, transform, setup.border, tileY, tileX)
+	if patchErr != nil {
+		return patchErr
+	}
+	if output.Overlay > 0.0 {
+		// blend the area of the query below the tile over the new tile
+		queryArea := ScaleDivision(TileDivision{{area}}, patched.Bounds(), query.Bounds())[0][0]
+		querySub, subErr := SubImage(query, queryArea)
+		if subErr != nil {
+			return subErr
+		}
+		overlaid := OverlayImage(patched.SubImage(area), querySub, output.Overlay, setup.resizer)
+		draw.Draw(patched, area, overlaid, area.Min, draw.Src)
+	}
+	path, o, pathErr := planImage(id, state.Mapper, oriented)
+	if pathErr != nil {
+		return pathErr
+	}
+	metadata, metadataErr := ReadMosaicMetadata(output.Path)
+	if metadataErr != nil || len(metadata) == 0 {
+		metadata = mosaicMetadata(state, plan.Parameters)
+	}
+	if writeErr := saveImage(state, output.Path, patched, metadata); writeErr != nil {
+		return writeErr
+	}
+	entry := &plan.Tiles[tileY][tileX]
+	entry.Path, entry.Orientation, entry.Value = path, o, &value
+	fmt.Fprintf(state.Out, "Tile (%d, %d): Replaced %s by %s in %s\n", tileX, tileY,
+		current, path, output.Path)
+	return nil
+}
+
+// MosaicGIFCommand creates a mosaic for each frame of an animated GIF (or
+// a directory of frames) and writes the result as an animated GIF.
+func MosaicGIFCommand(state *ExecutorState, args ...string) error {
+	// mosaicgif in.gif out.gif gch-... tilesXxtilesY [outDimensions] [--delay n] [--overlay x]
+	if int(state.ImgStorage.NumImages()) == 0 {
+		return errors.New("No images in storage, use \"storage load\"")
+	}
+	state, filterErr := state.filteredState()
+	if filterErr != nil {
+		return filterErr
+	}
+	args, flags, flagsErr := splitCommandFlags(args)
+	if flagsErr != nil {
+		return flagsErr
+	}
+	overlay := state.Overlay
+	delay := -1
+	for name, value := range flags {
+		switch name {
+		case "overlay":
+			var overlayErr error
+			overlay, overlayErr = parseOverlay(value)
+			if overlayErr != nil {
+				return overlayErr
+			}
+		case "delay":
+			var delayErr error
+			delay, delayErr = strconv.Atoi(value)
+			if delayErr != nil || delay < 0 {
+				return fmt.Errorf("invalid value for delay, must be int >= 0: %s", value)
+			}
+		default:
+			return fmt.Errorf("Unkown flag --%s", name)
+		}
+	}
+	if len(args) < 4 {
+		return ErrCmdSyntaxErr
+	}
+	stats, restore := collectStats(state)
+	defer restore()
+	totalTimer := StartTimer(TimerTotal)
+	if strings.ToLower(filepath.Ext(args[1])) != ".gif" {
+		return fmt.Errorf("Output must be a .gif file, got file %s", args[1])
+	}
+	outPath, outPathErr := state.GetPath(args[1])
+	if outPathErr != nil {
+		return outPathErr
+	}
+	setup, setupErr := newMosaicSetup(state, args[2])
+	if setupErr != nil {
+		return setupErr
+	}
+	tilesX, tilesY, tilesErr := parseTiles(args[3])
+	if tilesErr != nil {
+		return tilesErr
+	}
+	inPath, inPathErr := state.GetPath(args[0])
+	if inPathErr != nil {
+		return inPathErr
+	}
+	if state.Verbose {
+		fmt.Fprintln(state.Out, "Reading frames from", inPath)
+	}
+	frames, delays, framesErr := loadQueryFrames(inPath)
+	if framesErr != nil {
+		return framesErr
+	}
+	if delay >= 0 {
+		delays = nil
+	} else {
+		delay = 10
+	}
+	dimensions := ""
+	if len(args) > 4 {
+		dimensions = args[4]
+	}
+	mosaicBounds, boundsErr := mosaicDimensions(frames[0].Bounds(), dimensions)
+	if boundsErr != nil {
+		return boundsErr
+	}
+	divide := func(frame image.Image) (TileDivision, TileDivision) {
+		return state.divideQueryAndMosaic(frame, tilesX, tilesY,
+			mosaicBounds)
+	}
+	var progress ProgressFunc
+	if state.Verbose {
+		fmt.Fprintf(state.Out, "Composing mosaics for %d frames\n", len(frames))
+		progress = StdProgressFunc(state.Out, "", len(frames), 1)
+	}
+	mosaics, mosaicsErr := ComposeMosaicFrames(setup.storage, setup.selector,
+		frames, divide, setup.transforms, setup.resizer, setup.strategy,
+		setup.border, state.NumRoutines, state.newImageCache(), progress)
+	if mosaicsErr != nil {
+		return mosaicsErr
+	}
+	if overlay > 0.0 {
+		for i, mosaic := range mosaics {
+			mosaics[i] = OverlayImage(mosaic, frames[i], overlay, setup.resizer)
+		}
+	}
+	if state.Verbose {
+		fmt.Fprintln(state.Out, "Saving animation")
+	}
+	outFile, outErr := os.Create(outPath)
+	if outErr != nil {
+		return outErr
+	}
+	defer outFile.Close()
+	if encErr := EncodeGIFFrames(outFile, mosaics, delays, delay); encErr != nil {
+		return encErr
+	}
+	fmt.Fprintln(state.Out, "Mosaic saved to", outPath)
+	totalTimer.Stop()
+	writeStats(state, stats)
+	return nil
+}
+
+// DefaultPatchSize is the size of the patches used by the selfmosaic command.
+const DefaultPatchSize = 32
+
+// SelfMosaicCommand creates a mosaic without the storage: The database is
+// created from the patches of the query image (or other source images), see
+// NewPatchStorage. The mosaic is created with a MosaicBuilder based on GCHs.
+func SelfMosaicCommand(state *ExecutorState, args ...string) error {
+	// selfmosaic in.png out.png gch-... tilesXxtilesY [outDimensions] [--patch WxH] [--step WxH] [--sources a.png,b.png]
+	args, flags, flagsErr := splitCommandFlags(args)
+	if flagsErr != nil {
+		return flagsErr
+	}
+	patchWidth, patchHeight := DefaultPatchSize, DefaultPatchSize
+	stepX, stepY := 0, 0
+	var sources []string
+	for name, value := range flags {
+		switch name {
+		case "patch", "step":
+			width, height, parseErr := ParseDimensions(value)
+			if parseErr != nil || width <= 0 || height <= 0 {
+				return fmt.Errorf("invalid value for %s, must be of the form 32x32: %s", name, value)
+			}
+			if name == "patch" {
+				patchWidth, patchHeight = width, height
+			} else {
+				stepX, stepY = width, height
+			}
+		case "sources":
+			sources = strings.Split(value, ",")
+		default:
+			return fmt.Errorf("Unkown flag --%s", name)
+		}
+	}
+	if len(args) < 4 || len(args) > 5 {
+		return ErrCmdSyntaxErr
+	}
+	if !strings.HasPrefix(args[2], "gch-") {
+		return fmt.Errorf("selfmosaic supports only GCH metrics like gch-cosine, got %s", args[2])
+	}
+	if state.Layout == CmdLayoutCustom {
+		return errors.New("selfmosaic doesn't support registered layouts")
+	}
+	tilesX, tilesY, tilesErr := parseTiles(args[3])
+	if tilesErr != nil {
+		return tilesErr
+	}
+	if !JPGAndPNG(filepath.Ext(args[1])) {
+		return fmt.Errorf("Supported files are .jpg and .png, got file %s", args[1])
+	}
+	outPath, outPathErr := state.GetPath(args[1])
+	if outPathErr != nil {
+		return outPathErr
+	}
+	inPath, inPathErr := state.GetPath(args[0])
+	if inPathErr != nil {
+		return inPathErr
+	}
+	resizer := NewNfntResizer(state.InterP)
+	query, loadErr := LoadQueryImage(inPath, state.Preprocess, resizer)
+	if loadErr != nil {
+		return loadErr
+	}
+	dimensions := ""
+	if len(args) > 4 {
+		dimensions = args[4]
+	}
+	mosaicBounds, boundsErr := mosaicDimensions(query.Bounds(), dimensions)
+	if boundsErr != nil {
+		return boundsErr
+	}
+	sourceImages := []image.Image{query}
+	if len(sources) > 0 {
+		sourceImages = make([]image.Image, len(sources))
+		for i, source := range sources {
+			sourcePath, sourcePathErr := state.GetPath(source)
+			if sourcePathErr != nil {
+				return sourcePathErr
+			}
+			var sourceErr error
+			sourceImages[i], sourceErr = LoadQueryImage(sourcePath, state.Preprocess, resizer)
+			if sourceErr != nil {
+				return sourceErr
+			}
+		}
+	}
+	storage, storageErr := NewPatchStorage(sourceImages, patchWidth, patchHeight, stepX, stepY)
+	if storageErr != nil {
+		return storageErr
+	}
+	if state.Verbose {
+		fmt.Fprintf(state.Out, "Created %d patches of size %dx%d\n", storage.NumImages(), patchWidth, patchHeight)
+	}
+	builder := NewMosaicBuilder(storage).
+		WithMetric(strings.TrimPrefix(args[2], "gch-")).
+		WithTiles(tilesX, tilesY).
+		WithVariety(state.VarietySelector).
+		WithBestFit(state.BestFit).
+		WithSeed(state.Seed).
+		WithLayout(state.Layout, state.CutMosaic).
+		WithJitter(state.Jitter).
+		WithOutputSize(mosaicBounds.Dx(), mosaicBounds.Dy()).
+		WithResizeStrategy(state.Strategy).
+		WithResizer(resizer).
+		WithBorder(TileBorder{Width: state.TileBorder, Color: state.TileBorderColor}).
+		WithNumRoutines(state.NumRoutines).
+		WithCacheSize(state.CacheSize)
+	mosaic, buildErr := builder.Build(query)
+	if buildErr != nil {
+		return buildErr
+	}
+	metadata := NewMosaicMetadata()
+	metadata["selection"] = args[2]
+	metadata["tiles"] = args[3]
+	metadata["layout"] = state.layoutString()
+	metadata["variety"] = state.VarietySelector.DisplayString()
+	metadata["query"] = filepath.Base(inPath)
+	metadata["database-size"] = strconv.Itoa(int(storage.NumImages()))
+	if writeErr := saveImage(state, outPath, mosaic, metadata); writeErr != nil {
+		return writeErr
+	}
+	fmt.Fprintln(state.Out, "Mosaic saved to", outPath)
+	return nil
+}
+
+// parseCollageSizes parses the sizes of collage images, either "min-max" or a
+// single size.
+func parseCollageSizes(s string) (int, int, error) {
+	minStr, maxStr := s, s
+	if pos := strings.Index(s, "-"); pos >= 0 {
+		minStr, maxStr = s[:pos], s[pos+1:]
+	}
+	min, minErr := strconv.Atoi(minStr)
+	max, maxErr := strconv.Atoi(maxStr)
+	if minErr != nil || maxErr != nil || min <= 0 || max < min {
+		return -1, -1, fmt.Errorf("invalid value for size, must be of the form 32-128: %s", s)
+	}
+	return min, max, nil
+}
+
+// CollageCommand composes a collage of the query: The database images are
+// placed at random positions, sizes and rotations until the canvas is covered,
+// see ComposeCollage.
+func CollageCommand(state *ExecutorState, args ...string) error {
+	// collage in.png out.png gch-... [outDimensions] [--size min-max] [--rotation deg] [--coverage f] [--images n] [--border n]
+	if int(state.ImgStorage.NumImages()) == 0 {
+		return errors.New("No images in storage, use \"storage load\"")
+	}
+	state, filterErr := state.filteredState()
+	if filterErr != nil {
+		return filterErr
+	}
+	args, flags, flagsErr := splitCommandFlags(args)
+	if flagsErr != nil {
+		return flagsErr
+	}
+	options := DefaultCollageOptions()
+	for name, value := range flags {
+		switch name {
+		case "size":
+			var sizeErr error
+			options.MinSize, options.MaxSize, sizeErr = parseCollageSizes(value)
+			if sizeErr != nil {
+				return sizeErr
+			}
+		case "rotation":
+			rotation, parseErr := strconv.ParseFloat(value, 64)
+			if parseErr != nil || rotation < 0.0 || rotation > 180.0 {
+				return fmt.Errorf("invalid value for rotation (must be float between 0 and 180): %s", value)
+			}
+			options.MaxRotation = rotation
+		case "coverage":
+			coverage, parseErr := strconv.ParseFloat(value, 64)
+			if parseErr != nil || coverage <= 0.0 || coverage > 1.0 {
+				return fmt.Errorf("invalid value for coverage (must be float in (0, 1]): %s", value)
+			}
+			options.Coverage = coverage
+		case "images":
+			numImages, parseErr := strconv.Atoi(value)
+			if parseErr != nil || numImages <= 0 {
+				return fmt.Errorf("invalid value for images (must be int > 0): %s", value)
+			}
+			options.MaxImages = numImages
+		case "border":
+			border, parseErr := strconv.Atoi(value)
+			if parseErr != nil || border < 0 {
+				return fmt.Errorf("invalid value for border (must be int ≥ 0): %s", value)
+			}
+			options.Border.Width = border
+		default:
+			return fmt.Errorf("Unkown flag --%s", name)
+		}
+	}
+	if len(args) < 3 || len(args) > 4 {
+		return ErrCmdSyntaxErr
+	}
+	if state.GCHStorage == nil {
+		return errors.New("No GCH data loaded, use \"gch create\" or \"gch load\"")
+	}
+	metric, _, metricErr := parseGCHMetric(args[2])
+	if metricErr != nil {
+		return metricErr
+	}
+	if !JPGAndPNG(filepath.Ext(args[1])) {
+		return fmt.Errorf("Supported files are .jpg and .png, got file %s", args[1])
+	}
+	outPath, outPathErr := state.GetPath(args[1])
+	if outPathErr != nil {
+		return outPathErr
+	}
+	inPath, inPathErr := state.GetPath(args[0])
+	if inPathErr != nil {
+		return inPathErr
+	}
+	resizer := NewNfntResizer(state.InterP)
+	query, loadErr := LoadQueryImage(inPath, state.Preprocess, resizer)
+	if loadErr != nil {
+		return loadErr
+	}
+	dimensions := ""
+	if len(args) > 3 {
+		dimensions = args[3]
+	}
+	collageBounds, boundsErr := mosaicDimensions(query.Bounds(), dimensions)
+	if boundsErr != nil {
+		return boundsErr
+	}
+	storage, storageErr := state.composeStorage()
+	if storageErr != nil {
+		return storageErr
+	}
+	if state.VarietySelector != CmdVarietyNone {
+		options.BestFit = state.GetBestFitImages(int(storage.NumImages()))
+	}
+	var progress ProgressFunc
+	if state.Verbose {
+		progress = func(num int) {
+			if num%100 == 0 {
+				fmt.Fprintf(state.Out, "Placed %d images\n", num)
+			}
+		}
+	}
+	collage, collageErr := ComposeCollage(storage, state.GCHStorage, metric, query, collageBounds,
+		resizer, options, NewSeededRand(state.Seed), progress)
+	if collageErr != nil {
+		return collageErr
+	}
+	if state.Verbose {
+		fmt.Fprintf(state.Out, "Placed %d images, %.1f%% of the collage covered\n",
+			len(collage.Placements), collage.Coverage*100.0)
+	}
+	metadata := NewMosaicMetadata()
+	metadata["selection"] = args[2]
+	metadata["layout"] = "collage"
+	metadata["query"] = filepath.Base(inPath)
+	metadata["images"] = strconv.Itoa(len(collage.Placements))
+	if writeErr := saveImage(state, outPath, collage.Image, metadata); writeErr != nil {
+		return writeErr
+	}
+	fmt.Fprintln(state.Out, "Collage saved to", outPath)
+	return nil
+}
+
+// BatchCommand creates a mosaic for each query image in a directory (or all
+// images matching a glob). The images, features and the image cache are
+// shared, the queries are distributed among several workers.
+func BatchCommand(state *ExecutorState, args ...string) error {
+	// batch <dir|glob> <out-dir> gch-... tilesXxtilesY [outDimensions] [--workers n] [--overlay x]
+	if int(state.ImgStorage.NumImages()) == 0 {
+		return errors.New("No images in storage, use \"storage load\"")
+	}
+	state, filterErr := state.filteredState()
+	if filterErr != nil {
+		return filterErr
+	}
+	args, flags, flagsErr := splitCommandFlags(args)
+	if flagsErr != nil {
+		return flagsErr
+	}
+	overlay := state.Overlay
+	numWorkers := 2
+	for name, value := range flags {
+		switch name {
+		case "overlay":
+			var overlayErr error
+			overlay, overlayErr = parseOverlay(value)
+			if overlayErr != nil {
+				return overlayErr
+			}
+		case "workers":
+			var workersErr error
+			numWorkers, workersErr = strconv.Atoi(value)
+			if workersErr != nil || numWorkers <= 0 {
+				return fmt.Errorf("invalid value for workers, must be int > 0: %s", value)
+			}
+		default:
+			return fmt.Errorf("Unkown flag --%s", name)
+		}
+	}
+	if len(args) < 4 {
+		return ErrCmdSyntaxErr
+	}
+	stats, restore := collectStats(state)
+	defer restore()
+	totalTimer := StartTimer(TimerTotal)
+	queryPaths, queriesErr := batchQueries(state, args[0])
+	if queriesErr != nil {
+		return queriesErr
+	}
+	if len(queryPaths) == 0 {
+		return fmt.Errorf("No query images found in %s", args[0])
+	}
+	outDir, outDirErr := state.GetPath(args[1])
+	if outDirErr != nil {
+		return outDirErr
+	}
+	if mkdirErr := os.MkdirAll(outDir, 0755); mkdirErr != nil {
+		return mkdirErr
+	}
+	setup, setupErr := newMosaicSetup(state, args[2])
+	if setupErr != nil {
+		return setupErr
+	}
+	tilesX, tilesY, tilesErr := parseTiles(args[3])
+	if tilesErr != nil {
+		return tilesErr
+	}
+	dimensions := ""
+	if len(args) > 4 {
+		dimensions = args[4]
+	}
+	// validate dimensions before the first query is loaded
+	if _, boundsErr := mosaicDimensions(image.Rect(0, 0, 1, 1), dimensions); boundsErr != nil {
+		return boundsErr
+	}
+	divide := func(query image.Image) (TileDivision, TileDivision, error) {
+		mosaicBounds, boundsErr := mosaicDimensions(query.Bounds(), dimensions)
+		if boundsErr != nil {
+			return nil, nil, boundsErr
+		}
+		dist, mosaicDist := state.divideQueryAndMosaic(query, tilesX, tilesY,
+			mosaicBounds)
+		return dist, mosaicDist, nil
+	}
+	newSelector := func() (ImageSelector, error) {
+		workerSetup, workerSetupErr := newMosaicSetup(state, args[2])
+		if workerSetupErr != nil {
+			return nil, workerSetupErr
+		}
+		// transparent tiles of the queries are left empty
+		return NewSkipSelector(workerSetup.selector, nil), nil
+	}
+	queries := make([]QueryLoader, len(queryPaths))
+	for i, path := range queryPaths {
+		queries[i] = PreprocessedFileQuery(path, state.Preprocess, setup.resizer)
+	}
+	parameters := map[string]string{
+		"selection":    args[2],
+		"tiles":        args[3],
+		"layout":       state.layoutString(),
+		"variety":      state.VarietySelector.DisplayString(),
+		"orientations": state.Orientations.DisplayString(),
+	}
+	// the workers write the output, so protect it
+	var m sync.Mutex
+	done := func(i int, query, mosaic image.Image) error {
+		if overlay > 0.0 {
+			mosaic = OverlayImage(mosaic, query, overlay, setup.resizer)
+		}
+		outPath := batchOutPath(outDir, queryPaths[i])
+		metadata := mosaicMetadata(state, parameters)
+		metadata["query"] = filepath.Base(queryPaths[i])
+		if writeErr := saveImage(state, outPath, mosaic, metadata); writeErr != nil {
+			return writeErr
+		}
+		m.Lock()
+		fmt.Fprintln(state.Out, "Mosaic saved to", outPath)
+		m.Unlock()
+		return nil
+	}
+	if state.Verbose {
+		fmt.Fprintf(state.Out, "Composing mosaics for %d query images with %d workers\n",
+			len(queries), IntMin(numWorkers, len(queries)))
+	}
+	batchErr := ComposeMosaicBatch(setup.storage, newSelector, queries, divide,
+		setup.transforms, setup.resizer, setup.strategy, setup.border, numWorkers,
+		state.NumRoutines, state.newImageCache(), done, nil)
+	if batchErr != nil {
+		return batchErr
+	}
+	totalTimer.Stop()
+	writeStats(state, stats)
+	return nil
+}
+
+// benchVarieties are the variety selectors used by the bench command.
+var benchVarieties = []CmdVarietySelector{CmdVarietyNone, CmdVarietyRand,
+	CmdVarietyPenalty, CmdVarietyAssignment, CmdVarietyDiffusion}
+
+// BenchCommand runs the selection for a query with each metric (and
+// optionally each variety selector) and reports the time and the mean metric
+// value of each configuration. With "--out dir" the mosaics and the results
+// (as JSON) are written to dir.
+func BenchCommand(state *ExecutorState, args ...string) error {
+	// bench in.png tilesXxtilesY [outDimensions] [--feature gch|lch] [--varieties true] [--out dir]
+	if int(state.ImgStorage.NumImages()) == 0 {
+		return errors.New("No images in storage, use \"storage load\"")
+	}
+	args, flags, flagsErr := splitCommandFlags(args)
+	if flagsErr != nil {
+		return flagsErr
+	}
+	feature, outDir := "gch", ""
+	varieties := []CmdVarietySelector{CmdVarietyNone}
+	for name, value := range flags {
+		switch name {
+		case "feature":
+			if value != "gch" && value != "lch" {
+				return fmt.Errorf("Invalid feature %s, must be gch or lch", value)
+			}
+			feature = value
+		case "varieties":
+			all, boolErr := strconv.ParseBool(value)
+			if boolErr != nil {
+				return boolErr
+			}
+			if all {
+				varieties = benchVarieties
+			}
+		case "out":
+			var outErr error
+			outDir, outErr = state.GetPath(value)
+			if outErr != nil {
+				return outErr
+			}
+		default:
+			return fmt.Errorf("Unkown flag --%s", name)
+		}
+	}
+	if len(args) < 2 || len(args) > 3 {
+		return ErrCmdSyntaxErr
+	}
+	tilesX, tilesY, tilesErr := parseTiles(args[1])
+	if tilesErr != nil {
+		return tilesErr
+	}
+	inPath, inPathErr := state.GetPath(args[0])
+	if inPathErr != nil {
+		return inPathErr
+	}
+	query, loadErr := LoadQueryImage(inPath, state.Preprocess, NewNfntResizer(state.InterP))
+	if loadErr != nil {
+		return loadErr
+	}
+	dimensions := ""
+	if len(args) > 2 {
+		dimensions = args[2]
+	}
+	mosaicBounds, boundsErr := mosaicDimensions(query.Bounds(), dimensions)
+	if boundsErr != nil {
+		return boundsErr
+	}
+	dist, mosaicDist := state.divideQueryAndMosaic(query, tilesX, tilesY,
+		mosaicBounds)
+	if outDir != "" {
+		if mkdirErr := os.MkdirAll(outDir, 0755); mkdirErr != nil {
+			return mkdirErr
+		}
+	}
+	results := make([]BenchResult, 0)
+	fmt.Fprintf(state.Out, "%-18s %-12s %14s %12s %8s\n", "selection", "variety", "time", "mean value", "images")
+	for _, metricName := range GetHistogramMetricNames() {
+		selectionStr := feature + "-" + metricName
+		for _, variety := range varieties {
+			result := BenchResult{Selection: selectionStr, Variety: variety.DisplayString()}
+			benchErr := benchSelection(state, &result, variety, query, dist, mosaicDist, outDir)
+			if benchErr != nil {
+				result.Error = benchErr.Error()
+				fmt.Fprintf(state.Out, "%-18s %-12s %s\n", result.Selection, result.Variety, result.Error)
+			} else {
+				fmt.Fprintf(state.Out, "%-18s %-12s %14v %12.6f %8d\n", result.Selection, result.Variety,
+					result.Duration, result.MeanValue, result.NumImages)
+			}
+			results = append(results, result)
+		}
+	}
+	if outDir != "" {
+		resultsPath := filepath.Join(outDir, "bench.json")
+		if writeErr := WriteBenchResults(resultsPath, results); writeErr != nil {
+			return writeErr
+		}
+		fmt.Fprintln(state.Out, "Results saved to", resultsPath)
+	}
+	return nil
+}
+
+// benchSelection runs the selection for one configuration of the bench
+// command and fills the result. If outDir is not empty the mosaic is created
+// and saved in outDir.
+func benchSelection(state *ExecutorState, result *BenchResult, variety CmdVarietySelector,
+	query image.Image, dist, mosaicDist TileDivision, outDir string) error {
+	setup, setupErr := newMosaicSetupWithVariety(state, result.Selection, variety)
+	if setupErr != nil {
+		return setupErr
+	}
+	selector := NewSkipSelector(setup.selector, nil)
+	start := time.Now()
+	details, detailsErr := SelectDetailed(selector, nil, setup.storage, query, dist, 0, nil)
+	if detailsErr != nil {
+		return detailsErr
+	}
+	result.Duration = time.Since(start)
+	selection, values := details.Selection, details.Values
+	if values == nil {
+		var valuesErr error
+		values, valuesErr = MetricValues(setup.storage, setup.metric, query, dist, selection)
+		if valuesErr != nil {
+			return valuesErr
+		}
+	}
+	result.MeanValue = MeanMetricValue(values)
+	result.NumImages = DistinctImages(selection)
+	if outDir == "" {
+		return nil
+	}
+	mosaic, mosaicErr := ComposeMosaic(setup.storage, selection, mosaicDist,
+		setup.resizer, setup.strategy, nil, setup.border,
+		state.NumRoutines, state.newImageCache(), nil)
+	if mosaicErr != nil {
+		return mosaicErr
+	}
+	name := "mosaic-" + result.Selection
+	if variety != CmdVarietyNone {
+		name += "-" + strings.ToLower(result.Variety)
+	}
+	result.Output = filepath.Join(outDir, name+".jpg")
+	metadata := mosaicMetadata(state, map[string]string{
+		"selection": result.Selection,
+		"variety":   result.Variety,
+		"layout":    state.layoutString(),
+		"num-tiles": strconv.Itoa(dist.Size()),
+	})
+	return saveImage(state, result.Output, mosaic, metadata)
+}
+
+// CheckCommand validates the current session without creating a mosaic: All
+// images in the storage are decoded and the GCHs and LCHs are checked (see
+// CheckHistograms and CheckLCHs). If a GCH file is given it's compared with
+// the images in the storage (see CheckHistogramFile). If a query image and the
+// number of tiles are given the number of tiles and the memory required to
+// create the mosaic are estimated. An error is returned if a check failed.
+func CheckCommand(state *ExecutorState, args ...string) error {
+	// check [in.png tilesXxtilesY [outDimensions]] [--gch file]
+	args, flags, flagsErr := splitCommandFlags(args)
+	if flagsErr != nil {
+		return flagsErr
+	}
+	if len(args) == 1 || len(args) > 3 {
+		return ErrCmdSyntaxErr
+	}
+	gchFile := ""
+	for name, value := range flags {
+		switch name {
+		case "gch":
+			var pathErr error
+			gchFile, pathErr = state.GetPath(value)
+			if pathErr != nil {
+				return pathErr
+			}
+		default:
+			return fmt.Errorf("Unkown flag --%s", name)
+		}
+	}
+	numImages := int(state.ImgStorage.NumImages())
+	numProblems := 0
+	fmt.Fprintf(state.Out, "Decoding %d images\n", numImages)
+	var progress ProgressFunc
+	if state.Verbose {
+		progress = StdProgressFunc(state.Out, "", numImages, IntMin(100, numImages/10))
+	}
+	images := CheckImages(state.ImgStorage, state.NumRoutines, progress)
+	for _, failed := range images.Failed {
+		path, _ := state.Mapper.GetPath(failed.ID)
+		fmt.Fprintf(state.Out, "Can't decode %s: %s\n", path, failed.Err.Error())
+	}
+	numProblems += len(images.Failed)
+	fmt.Fprintf(state.Out, "%d of %d images can be decoded\n", numImages-len(images.Failed), numImages)
+	// memory of the features, entries are float64 (float32 for compact GCHs)
+	var featureBytes uint64
+	if state.GCHStorage == nil {
+		fmt.Fprintln(state.Out, "No GCHs loaded")
+	} else {
+		k := uint64(state.GCHStorage.Divisions())
+		featureBytes += histogramListBytes(state.GCHStorage)
+		if gchErr := CheckHistograms(state.Mapper, state.GCHStorage); gchErr != nil {
+			fmt.Fprintln(state.Out, "GCHs are invalid:")
+			fmt.Fprintln(state.Out, gchErr.Error())
+			numProblems++
+		} else {
+			fmt.Fprintf(state.Out, "GCHs are valid (k = %d)\n", k)
+		}
+	}
+	if gchFile != "" {
+		controller := HistogramFSController{}
+		if readErr := controller.ReadFile(gchFile); readErr != nil {
+			return readErr
+		}
+		if rebaseErr := controller.Rebase(""); rebaseErr != nil {
+			return rebaseErr
+		}
+		if fileErr := CheckHistogramFile(state.Mapper, &controller); fileErr != nil {
+			fmt.Fprintf(state.Out, "GCH file %s doesn't match the images:\n", gchFile)
+			fmt.Fprintln(state.Out, fileErr.Error())
+			numProblems++
+		} else {
+			fmt.Fprintf(state.Out, "GCH file %s contains valid GCHs for all images (k = %d)\n",
+				gchFile, controller.K)
+		}
+	}
+	if state.LCHStorage == nil {
+		fmt.Fprintln(state.Out, "No LCHs loaded")
+	} else {
+		k := uint64(state.LCHStorage.K)
+		featureBytes += 8 * k * k * k * uint64(state.LCHStorage.Size) * uint64(len(state.LCHStorage.LCHs))
+		if lchErr := CheckLCHs(state.Mapper, state.LCHStorage); lchErr != nil {
+			fmt.Fprintln(state.Out, "LCHs are invalid:")
+			fmt.Fprintln(state.Out, lchErr.Error())
+			numProblems++
+		} else {
+			fmt.Fprintf(state.Out, "LCHs are valid (k = %d, scheme size %d)\n", k, state.LCHStorage.Size)
+		}
+	}
+	fmt.Fprintln(state.Out, "Memory of features:", formatBytes(featureBytes))
+	if len(args) > 1 {
+		tilesX, tilesY, tilesErr := parseTiles(args[1])
+		if tilesErr != nil {
+			return tilesErr
+		}
+		inPath, inPathErr := state.GetPath(args[0])
+		if inPathErr != nil {
+			return inPathErr
+		}
+		query, loadErr := LoadQueryImage(inPath, state.Preprocess, NewNfntResizer(state.InterP))
+		if loadErr != nil {
+			return loadErr
+		}
+		dimensions := ""
+		if len(args) > 2 {
+			dimensions = args[2]
+		}
+		mosaicBounds, boundsErr := mosaicDimensions(query.Bounds(), dimensions)
+		if boundsErr != nil {
+			return boundsErr
+		}
+		_, mosaicDist := state.divideQueryAndMosaic(query, tilesX, tilesY,
+			mosaicBounds)
+		tileSize := maxTileSize(mosaicDist)
+		cacheSize := state.CacheSize
+		if cacheSize <= 0 {
+			cacheSize = ImageCacheSize
+		}
+		// all images are stored with 4 bytes per pixel
+		queryBytes := 4 * uint64(query.Bounds().Dx()*query.Bounds().Dy())
+		mosaicBytes := 4 * uint64(mosaicBounds.Dx()*mosaicBounds.Dy())
+		cacheBytes := 4 * uint64(cacheSize*tileSize*tileSize)
+		decodeBytes := 4 * uint64(state.NumRoutines*images.MaxPixels)
+		fmt.Fprintf(state.Out, "Mosaic of size %dx%d with %d tiles (at most %dx%d pixels)\n",
+			mosaicBounds.Dx(), mosaicBounds.Dy(), mosaicDist.Size(), tileSize, tileSize)
+		fmt.Fprintln(state.Out, "Estimated memory:")
+		fmt.Fprintln(state.Out, "  query      ", formatBytes(queryBytes))
+		fmt.Fprintln(state.Out, "  mosaic     ", formatBytes(mosaicBytes))
+		fmt.Fprintln(state.Out, "  image cache", formatBytes(cacheBytes))
+		fmt.Fprintln(state.Out, "  decoding   ", formatBytes(decodeBytes))
+		fmt.Fprintln(state.Out, "  features   ", formatBytes(featureBytes))
+		totalBytes := queryBytes + mosaicBytes + cacheBytes + decodeBytes + featureBytes
+		fmt.Fprintln(state.Out, "  total      ", formatBytes(totalBytes))
+		// the mosaic command shrinks the cache if required
+		if budgetErr := state.MaxMemory.Check("The mosaic", totalBytes-cacheBytes); budgetErr != nil {
+			fmt.Fprintln(state.Out, budgetErr.Error())
+			numProblems++
+		}
+	}
+	if numProblems > 0 {
+		return fmt.Errorf("Check failed with %d problems", numProblems)
+	}
+	fmt.Fprintln(state.Out, "Check passed")
+	return nil
+}
+
+// batchQueries returns the query images for the batch command: All images
+// (.jpg, .png and .gif) in the directory or all files matching the glob.
+func batchQueries(state *ExecutorState, pattern string) ([]string, error) {
+	path, pathErr := state.GetPath(pattern)
+	if pathErr != nil {
+		return nil, pathErr
+	}
+	if info, statErr := os.Stat(path); statErr == nil && info.IsDir() {
+		path = filepath.Join(path, "*")
+	}
+	matches, globErr := filepath.Glob(path)
+	if globErr != nil {
+		return nil, fmt.Errorf("Invalid pattern %s: %s", pattern, globErr.Error())
+	}
+	res := make([]string, 0, len(matches))
+	for _, match := range matches {
+		ext := filepath.Ext(match)
+		if JPGAndPNG(ext) || strings.ToLower(ext) == ".gif" {
+			res = append(res, match)
+		}
+	}
+	return res, nil
+}
+
+// batchOutPath returns the path of the mosaic for a query in the batch
+// command: The mosaic has the same name as the query, GIFs are saved as PNG.
+func batchOutPath(outDir, query string) string {
+	name := filepath.Base(query)
+	if ext := filepath.Ext(name); !JPGAndPNG(ext) {
+		name = strings.TrimSuffix(name, ext) + ".png"
+	}
+	return filepath.Join(outDir, name)
+}
+
+// loadQueryFrames loads the frames from an animated GIF or, if path is a
+// directory, all images in that directory. The delays are nil if the frames
+// were loaded from a directory.
+func loadQueryFrames(path string) ([]image.Image, []int, error) {
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		return nil, nil, statErr
+	}
+	if info.IsDir() {
+		frames, framesErr := LoadFrameDir(path)
+		return frames, nil, framesErr
+	}
+	r, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, nil, openErr
+	}
+	defer r.Close()
+	return DecodeGIFFrames(r)
+}
+
+// mosaicSetup contains everything that is required to select the images and
+// compose a mosaic, it is created from the current state by newMosaicSetup.
+type mosaicSetup struct {
+	storage  ImageStorage
+	selector ImageSelector
+	// metric is the metric of the selection without variety, it's used to
+	// compute the metric values for reports
+	metric      ImageMetric
+	resizer     ImageResizer
+	strategy    ResizeStrategy
+	border      TileBorder
+	colorize    float64
+	grayscale   bool
+	numRoutines int
+}
+
+// transforms implements FrameTransformFunc, it returns the colorize and
+// grayscale transforms if enabled.
+func (setup *mosaicSetup) transforms(query image.Image, dist TileDivision) (TileTransform, error) {
+	var grayscale TileTransform
+	if setup.grayscale {
+		grayscale = GrayscaleTransform()
+	}
+	if setup.colorize <= 0.0 {
+		return grayscale, nil
+	}
+	// the query division has the same structure as the mosaic division,
+	// so the averages can be used for the mosaic tiles
+	averages, averagesErr := ComputeTileAverages(query, dist, setup.numRoutines)
+	if averagesErr != nil {
+		return nil, averagesErr
+	}
+	return ChainTransforms(ColorizeTransform(averages, setup.colorize), grayscale), nil
+}
+
+// gchImageMetric returns the image metric for the GCHs in gchStorage. If
+// the GCHs are compact or sparse the compact / sparse version of the metric is
+// used (if there is one), it compares the histograms without converting them.
+func (state *ExecutorState) gchImageMetric(gchStorage HistogramStorage, selectionStr string,
+	metric HistogramMetric) ImageMetric {
+	name, _ := gchMetricName(selectionStr)
+	switch s := gchStorage.(type) {
+	case *CompactHistStorage:
+		if compactMetric, has := GetCompactVectorMetric(name); has {
+			return NewCompactHistogramImageMetric(s, compactMetric, state.NumRoutines)
+		}
+	case *SparseHistStorage:
+		if sparseMetric, has := GetSparseMetric(name); has {
+			return NewSparseHistogramImageMetric(s, sparseMetric, state.NumRoutines)
+		}
+	}
+	return NewHistogramImageMetric(gchStorage, metric, state.NumRoutines)
+}
+
+// annIndexCache is an ANN index together with the information it was built
+// for.
+type annIndexCache struct {
+	gchs         HistogramList
+	numGCHs      int
+	orientations CmdOrientations
+	selection    string
+	index        *VPTree
+}
+
+// getANNIndex returns the ANN index for the current GCHs, it's only built if
+// the GCHs, orientations or the metric changed since the last call.
+func (state *ExecutorState) getANNIndex(gchStorage HistogramStorage, numImages ImageID,
+	selectionStr string, metric HistogramMetric) (*VPTree, error) {
+	if cache := state.annIndex; cache != nil && cache.gchs == state.GCHStorage &&
+		cache.numGCHs == state.GCHStorage.Len() &&
+		cache.orientations == state.Orientations && cache.selection == selectionStr {
+		return cache.index, nil
+	}
+	if state.Verbose {
+		fmt.Fprintln(state.Out, "Building ANN index")
+	}
+	index, indexErr := NewHistogramVPTree(gchStorage, numImages, metric)
+	if indexErr != nil {
+		return nil, indexErr
+	}
+	state.annIndex = &annIndexCache{
+		gchs:         state.GCHStorage,
+		numGCHs:      state.GCHStorage.Len(),
+		orientations: state.Orientations,
+		selection:    selectionStr,
+		index:        index,
+	}
+	return index, nil
+}
+
+// metricCacheEntry is a metric cache together with the information it was
+// created for.
+type metricCacheEntry struct {
+	gchs         HistogramList
+	lchs         *MemoryLCHStorage
+	features     *MemoryFeatureStorage
+	numImages    ImageID
+	orientations CmdOrientations
+	selection    string
+	cache        *MetricCache
+}
+
+// cachedMetric wraps metric in a CachedImageMetric if the metric cache is
+// enabled. The cache is reused as long as the features, orientations and the
+// metric (given by selectionStr) don't change.
+func (state *ExecutorState) cachedMetric(metric ImageMetric, selectionStr string) ImageMetric {
+	if state.MetricCacheSize <= 0 {
+		return metric
+	}
+	numImages := state.ImgStorage.NumImages()
+	if entry := state.metricCache; entry == nil || entry.gchs != state.GCHStorage ||
+		entry.lchs != state.LCHStorage || entry.features != state.Features || entry.numImages != numImages ||
+		entry.orientations != state.Orientations || entry.selection != selectionStr {
+		state.metricCache = &metricCacheEntry{
+			gchs:         state.GCHStorage,
+			lchs:         state.LCHStorage,
+			features:     state.Features,
+			numImages:    numImages,
+			orientations: state.Orientations,
+			selection:    selectionStr,
+			cache:        NewMetricCache(state.MetricCacheSize),
+		}
+	}
+	return NewCachedImageMetric(metric, state.metricCache.cache)
+}
+
+// histogramListBytes returns the (approximate) memory required for the
+// entries of the histograms in storage.
+func histogramListBytes(storage HistogramList) uint64 {
+	k := uint64(storage.Divisions())
+	switch s := storage.(type) {
+	case *CompactHistStorage:
+		return 4 * k * k * k * uint64(s.Len())
+	case *SparseHistStorage:
+		// an uint32 index and a float64 value for each entry
+		return 12 * uint64(s.NumEntries())
+	default:
+		return 8 * k * k * k * uint64(storage.Len())
+	}
+}
+
+// invalidateCaches drops the ANN index and the metric cache. It must be
+// called whenever the images or the precomputed data change, both caches are
+// keyed on the storages which are also changed in place.
+func (state *ExecutorState) invalidateCaches() {
+	state.annIndex, state.metricCache = nil, nil
+}
+
+// layoutString returns the name of the layout, for custom layouts the name of
+// the registered divider.
+func (state *ExecutorState) layoutString() string {
+	if state.Layout == CmdLayoutCustom {
+		return state.CustomLayout
+	}
+	return state.Layout.DisplayString()
+}
+
+// newMosaicSetup creates the selector (given the selection string, for
+// example "gch-cosine") and all other values from the state.
+func newMosaicSetup(state *ExecutorState, selectionStr string) (*mosaicSetup, error) {
+	return newMosaicSetupWithVariety(state, selectionStr, state.VarietySelector)
+}
+
+// newMosaicSetupWithVariety works as newMosaicSetup but uses the given variety
+// selector instead of the variety selector of the state.
+func newMosaicSetupWithVariety(state *ExecutorState, selectionStr string, variety CmdVarietySelector) (*mosaicSetup, error) {
+	if factory, isCustom := GetSelector(selectionStr); isCustom {
+		return newCustomMosaicSetup(state, factory, variety)
+	}
+	// supported gch and lch
+	useGCH := true
+
+	// try to parse gch and lch
+	// not so nice, we compute prefix stuff later again... but well
+	switch {
+	case strings.HasPrefix(selectionStr, "gch"):
+		useGCH = true
+		if state.GCHStorage == nil {
+			return nil, errors.New("No GCH data loaded, use \"gch create\" or \"gch load\"")
 		}
-		fmt.Fprintf(state.Out, "Computed %d LCHs in %v\n", len(lchs), execTime)
-		return nil
-	case args[0] == "save":
+	case strings.HasPrefix(selectionStr, "lch"):
+		useGCH = false
 		if state.LCHStorage == nil {
-			return errors.New("No LCHs loaded yet")
+			return nil, errors.New("No LCH data loaded, use \"lch create\" or \"lch load\"")
 		}
-		if len(args) < 2 {
-			return ErrCmdSyntaxErr
+	case strings.HasPrefix(selectionStr, "feature"):
+		return newFeatureMosaicSetup(state, selectionStr, variety)
+	case strings.HasPrefix(selectionStr, "gray"):
+		if _, isGray := state.featureExtractor().(LuminanceExtractor); !isGray {
+			return nil, errors.New("No luminance histograms loaded, use \"gray create\" or \"gray load\"")
 		}
-		path, pathErr := state.GetPath(args[1])
-		if pathErr != nil {
-			return pathErr
+		return newFeatureMosaicSetup(state, selectionStr, variety)
+	default:
+		return nil, fmt.Errorf("Invalid image selector, expected gch, lch, feature, gray or a registered selector, got %s", selectionStr)
+	}
+	// the storages used for selection and composition, if orientations are
+	// used they're wrapped s.t. each image exists in all orientations
+	storage, storageErr := state.composeStorage()
+	if storageErr != nil {
+		return nil, storageErr
+	}
+	var gchStorage HistogramStorage
+	var lchStorage LCHStorage
+	var scheme LCHScheme
+	if useGCH {
+		gchStorage = state.GCHStorage
+	} else {
+		lchStorage = state.LCHStorage
+		var schemeErr error
+		scheme, schemeErr = ParseLCHScheme(state.LCHStorage.SchemeDescriptor())
+		if schemeErr != nil {
+			return nil, schemeErr
 		}
-		// check if path is a file or directory
-		// we don't report the fiErr (this is not nil if file doesn't exist which
-		// is of course allowed)
-		fi, fiErr := os.Lstat(path)
-		if fiErr == nil && fi.IsDir() {
-			// save with default naming scheme in that directory
-			name := LCHFileName(state.LCHStorage.K, state.LCHStorage.Size, "gob")
-			path = filepath.Join(path, name)
+	}
+	if orientations := state.Orientations.Orientations(); len(orientations) > 0 {
+		storage = NewOrientedStorage(storage, orientations)
+		if useGCH {
+			gchStorage = NewOrientedHistogramStorage(gchStorage, orientations)
+		} else {
+			// the parts of grid schemes can't be permuted
+			if _, isGrid := scheme.(GridLCHScheme); isGrid {
+				return nil, errors.New("Orientations are not supported for grid LCH schemes")
+			}
+			lchStorage = NewOrientedLCHStorage(lchStorage, orientations)
 		}
-		controller, creationErr := CreateLCHFSController(IDList(state.ImgStorage),
-			state.Mapper, state.LCHStorage)
-		if creationErr != nil {
-			return creationErr
+	}
+	weights := state.selectionWeights()
+	var selector ImageSelector
+	var reportMetric ImageMetric
+	if useGCH {
+		metric, batch, metricErr := parseGCHMetric(selectionStr)
+		if metricErr != nil {
+			return nil, metricErr
 		}
-		// save file
-		saveErr := controller.WriteFile(path)
-		if saveErr == nil {
-			fmt.Fprintln(state.Out, "Successfully wrote", state.ImgStorage.NumImages(),
-				"LCHs to", path)
+		reportMetric = state.gchImageMetric(gchStorage, selectionStr, metric)
+		if state.Search == CmdSearchANN && variety != CmdVarietyNone {
+			return nil, errors.New("Search \"ANN\" is only supported with variety \"None\"")
 		}
-		return saveErr
-	case args[0] == "load":
-		if len(args) < 2 {
-			return ErrCmdSyntaxErr
+		if state.Search == CmdSearchANN && weights != nil {
+			return nil, errors.New("Search \"ANN\" doesn't support image weights")
 		}
-		path, pathErr := state.GetPath(args[1])
-		if pathErr != nil {
-			return pathErr
+		switch variety {
+		case CmdVarietyNone:
+			if state.Search == CmdSearchANN {
+				index, indexErr := state.getANNIndex(gchStorage, storage.NumImages(), selectionStr, metric)
+				if indexErr != nil {
+					return nil, indexErr
+				}
+				annSelector := NewANNSelector(gchStorage, metric, DefaultANNChecks, state.NumRoutines)
+				annSelector.Index = index
+				selector = annSelector
+				break
+			}
+			imageMetric := state.gchImageMetric(gchStorage, selectionStr, metric)
+			if state.Prefilter > 0.0 {
+				var prefilterErr error
+				if selector, prefilterErr = state.prefilterSelector(weightedMetric(imageMetric, weights), storage); prefilterErr != nil {
+					return nil, prefilterErr
+				}
+				break
+			}
+			if histMetric, isHist := imageMetric.(*HistogramImageMetric); isHist {
+				histMetric.Batch = batch
+			}
+			selector = NewImageMetricMinimizer(weightedMetric(imageMetric, weights), state.NumRoutines)
+		case CmdVarietyRand:
+			imageMetric := weightedMetric(state.cachedMetric(state.gchImageMetric(gchStorage, selectionStr, metric), selectionStr), weights)
+			numBestFit := state.GetBestFitImages(int(storage.NumImages()))
+			selector = RandomHeapImageSelector(imageMetric, numBestFit, state.NumRoutines,
+				NewSeededRand(state.Seed))
+		case CmdVarietyPenalty:
+			imageMetric := weightedMetric(state.cachedMetric(state.gchImageMetric(gchStorage, selectionStr, metric), selectionStr), weights)
+			numBestFit := state.GetBestFitImages(int(storage.NumImages()))
+			selector = UsagePenaltyImageSelector(imageMetric, state.PenaltyWeight, numBestFit, state.NumRoutines)
+		case CmdVarietyAssignment:
+			imageMetric := weightedMetric(state.cachedMetric(state.gchImageMetric(gchStorage, selectionStr, metric), selectionStr), weights)
+			selector = NewAssignmentSelector(imageMetric, state.AssignmentCap, state.NumRoutines)
+		case CmdVarietyDiffusion:
+			if weights != nil {
+				return nil, errors.New("Variety \"Diffusion\" doesn't support image weights")
+			}
+			selector = NewErrorDiffusionSelector(gchStorage, metric, 1.0, state.NumRoutines)
+		default:
+			return nil, fmt.Errorf("Internal error, please report bug: Got unkown variety selector (GCH): %d", variety)
 		}
-		controller := LCHFSController{}
-		readErr := controller.ReadFile(path)
-		if readErr != nil {
-			return readErr
+	} else {
+		if state.Search == CmdSearchANN {
+			return nil, errors.New("Search \"ANN\" is only supported for GCHs")
 		}
-		fmt.Fprintf(state.Out, "Read %d LCHs\n", len(controller.Entries))
-		// we don't care about missing / new images, we just print a warning if
-		// the lengths have change.
-		if len(controller.Entries) != int(state.ImgStorage.NumImages()) {
-			fmt.Fprintln(state.Out, "Unmachted number of images in storage and loaded",
-				"LCHs. Have the images changed? In this case the LCHs must be re-computed.")
+		metric, metricErr := parseLCHMetric(selectionStr)
+		if metricErr != nil {
+			return nil, metricErr
 		}
-		memStorage, createErr := MemLCHStorageFromFSMapper(state.Mapper, &controller, nil)
-		if createErr != nil {
-			return createErr
+		reportMetric = NewLCHImageMetric(lchStorage, scheme, metric, state.NumRoutines)
+		switch variety {
+		case CmdVarietyNone:
+			if state.Prefilter > 0.0 {
+				var prefilterErr error
+				imageMetric := weightedMetric(NewLCHImageMetric(lchStorage, scheme, metric, state.NumRoutines), weights)
+				if selector, prefilterErr = state.prefilterSelector(imageMetric, storage); prefilterErr != nil {
+					return nil, prefilterErr
+				}
+				break
+			}
+			lchSelector := LCHSelector(lchStorage, scheme, metric, state.NumRoutines)
+			lchSelector.Metric = weightedMetric(lchSelector.Metric, weights)
+			selector = lchSelector
+		case CmdVarietyRand:
+			imageMetric := weightedMetric(state.cachedMetric(NewLCHImageMetric(lchStorage, scheme, metric, state.NumRoutines), selectionStr), weights)
+			numBestFit := state.GetBestFitImages(int(storage.NumImages()))
+			selector = RandomHeapImageSelector(imageMetric, numBestFit, state.NumRoutines,
+				NewSeededRand(state.Seed))
+		case CmdVarietyPenalty:
+			imageMetric := weightedMetric(state.cachedMetric(NewLCHImageMetric(lchStorage, scheme, metric, state.NumRoutines), selectionStr), weights)
+			numBestFit := state.GetBestFitImages(int(storage.NumImages()))
+			selector = UsagePenaltyImageSelector(imageMetric, state.PenaltyWeight, numBestFit, state.NumRoutines)
+		case CmdVarietyAssignment:
+			imageMetric := weightedMetric(state.cachedMetric(NewLCHImageMetric(lchStorage, scheme, metric, state.NumRoutines), selectionStr), weights)
+			selector = NewAssignmentSelector(imageMetric, state.AssignmentCap, state.NumRoutines)
+		case CmdVarietyDiffusion:
+			return nil, errors.New("Variety \"Diffusion\" is only supported for GCHs")
+		default:
+			return nil, fmt.Errorf("Internal error, please report bug: Got unkown variety selector (LCH): %d", variety)
 		}
-		// set
-		state.LCHStorage = memStorage
-		fmt.Fprintln(state.Out, "LCHs have been mapped to image store.")
-		return nil
-	default:
-		return ErrCmdSyntaxErr
 	}
+	return finishMosaicSetup(state, storage, selector, reportMetric)
 }
 
-func parseGCHMetric(s string) (HistogramMetric, error) {
-	var metricName string
-	switch {
-	case s == "gch":
-		metricName = "euclid"
-	case strings.HasPrefix(s, "gch-"):
-		metricName = s[4:]
-	default:
-		return nil, fmt.Errorf("Invalid gch format, expect \"gch\" or \"gch-<metric>\", got %s", s)
+// selectionWeights returns the weights of the images used for the selection
+// (each image in all orientations if enabled), nil if all images have weight
+// 1. See ImageWeights.
+func (state *ExecutorState) selectionWeights() []float64 {
+	weights := ImageWeights(state.Mapper)
+	if weights == nil {
+		return nil
 	}
-	if metric, ok := GetHistogramMetric(metricName); ok {
-		return metric, nil
+	if orientations := state.Orientations.Orientations(); len(orientations) > 0 {
+		weights = OrientedWeights(weights, orientations)
 	}
-	return nil, fmt.Errorf("Unkown metric %s", metricName)
+	return weights
 }
 
-func parseLCHMetric(s string) (HistogramMetric, error) {
-	var metricName string
+// weightedMetric wraps metric in a WeightedImageMetric if weights is not nil.
+func weightedMetric(metric ImageMetric, weights []float64) ImageMetric {
+	if weights == nil {
+		return metric
+	}
+	return NewWeightedImageMetric(metric, weights)
+}
+
+// prefilterSelector returns a PrefilteredImageMetricMinimizer for the metric.
+// The average colors of the database images are taken from the features (if
+// they're average colors), the GCHs or the LCHs (in this order). storage is
+// the storage used for the selection (with orientations if enabled).
+func (state *ExecutorState) prefilterSelector(metric ImageMetric, storage ImageStorage) (ImageSelector, error) {
+	numImages := state.ImgStorage.NumImages()
+	var averages []AverageColor
+	var averagesErr error
+	_, isAverage := state.featureExtractor().(AverageColorExtractor)
 	switch {
-	case s == "lch":
-		metricName = "euclid"
-	case strings.HasPrefix(s, "lch-"):
-		metricName = s[4:]
+	case isAverage:
+		averages, averagesErr = FeatureAverages(state.Features)
+	case state.GCHStorage != nil:
+		averages, averagesErr = HistogramAverages(state.GCHStorage, numImages)
+	case state.LCHStorage != nil:
+		averages, averagesErr = LCHAverages(state.LCHStorage, numImages)
 	default:
-		return nil, fmt.Errorf("Invalid lch format, expect \"lch\" or \"lch-<metric>\", got %s", s)
+		return nil, errors.New("prefilter requires average colors, GCHs or LCHs, use \"feature create average\"")
 	}
-	if metric, ok := GetHistogramMetric(metricName); ok {
-		return metric, nil
+	if averagesErr != nil {
+		return nil, averagesErr
 	}
-	return nil, fmt.Errorf("Unkown metric %s", metricName)
+	if orientations := state.Orientations.Orientations(); len(orientations) > 0 {
+		averages = OrientedAverages(averages, orientations)
+	}
+	if len(averages) != int(storage.NumImages()) {
+		return nil, errors.New("Average colors don't match the images in storage, features must be reloaded")
+	}
+	return NewPrefilteredImageMetricMinimizer(metric, averages, state.Prefilter, state.NumRoutines), nil
 }
 
-func saveImage(file string, img image.Image, jpgQuality int) error {
-	outFile, outErr := os.Create(file)
-	if outErr != nil {
-		return outErr
-	}
-	defer outFile.Close()
-	var encErr error
-	ext := filepath.Ext(file)
-	switch strings.ToLower(ext) {
-	case ".jpg", ".jpeg":
-		encErr = jpeg.Encode(outFile, img, &jpeg.Options{Quality: jpgQuality})
-	case ".png":
-		encErr = png.Encode(outFile, img)
-	default:
-		// this should not happen...
-		return fmt.Errorf("Unsupported file type: %s, expected .jpg or .png", ext)
+// featureExtractor returns the extractor of the features of the state, nil if
+// no features are loaded.
+func (state *ExecutorState) featureExtractor() FeatureExtractor {
+	if state.Features == nil {
+		return nil
 	}
-	return encErr
+	return state.Features.FeatureExtractor
 }
 
-// MosaicCommand creates a mosaic images.
-// For details see the entry created in the init() method / the description
-// text of the command our the online documentation. Usage example:
-// mosaic in.jpg out.jpg gch-cosine 20x30 1024x768
-func MosaicCommand(state *ExecutorState, args ...string) error {
-	// mosaic in.png out.png gch-... tilesXxtilesY [outDimensions]
-	if int(state.ImgStorage.NumImages()) == 0 {
-		return errors.New("No images in storage, use \"storage load\"")
+// newFeatureMosaicSetup creates the setup for the features of the state
+// (selection "feature", "feature-<metric>" or the same with "gray" for
+// luminance histograms), see FeatureImageMetric.
+func newFeatureMosaicSetup(state *ExecutorState, selectionStr string, variety CmdVarietySelector) (*mosaicSetup, error) {
+	if state.Features == nil {
+		return nil, errors.New("No features loaded, use \"feature create\" or \"feature load\"")
+	}
+	if state.Search == CmdSearchANN {
+		return nil, errors.New("Search \"ANN\" is only supported for GCHs")
 	}
+	if len(state.Orientations.Orientations()) > 0 {
+		return nil, errors.New("Orientations are not supported for features")
+	}
+	split := strings.SplitN(selectionStr, "-", 2)
+	metricName := "euclid"
 	switch {
-	case len(args) > 3:
-		totalStart := time.Now()
-		if !JPGAndPNG(filepath.Ext(args[1])) {
-			return fmt.Errorf("Supported files are .jpg and .png, got file %s", args[1])
-		}
-		// get out path
-		outPath, outPathErr := state.GetPath(args[1])
-		if outPathErr != nil {
-			return outPathErr
-		}
-
-		selectionStr := args[2]
-		// supported gch and lch
-		useGCH := true
-
-		// try to parse gch and lch
-		// not so nice, we compute prefix stuff later again... but well
-		switch {
-		case strings.HasPrefix(selectionStr, "gch"):
-			useGCH = true
-			if state.GCHStorage == nil {
-				return errors.New("No GCH data loaded, use \"gch create\" or \"gch load\"")
-			}
-		case strings.HasPrefix(selectionStr, "lch"):
-			useGCH = false
-			if state.LCHStorage == nil {
-				return errors.New("No LCH data loaded, use \"lch create\" or \"lch load\"")
+	case split[0] != "feature" && split[0] != "gray":
+		return nil, fmt.Errorf("Invalid feature format, expect \"feature\" or \"feature-<metric>\", got %s", selectionStr)
+	case len(split) == 2:
+		metricName = split[1]
+	}
+	metric, ok := GetHistogramMetric(metricName)
+	if !ok {
+		return nil, fmt.Errorf("Unkown metric %s", metricName)
+	}
+	storage, storageErr := state.composeStorage()
+	if storageErr != nil {
+		return nil, storageErr
+	}
+	reportMetric := NewFeatureImageMetric(state.Features, metric, state.NumRoutines)
+	weights := state.selectionWeights()
+	var selector ImageSelector
+	switch variety {
+	case CmdVarietyNone:
+		imageMetric := weightedMetric(NewFeatureImageMetric(state.Features, metric, state.NumRoutines), weights)
+		if state.Prefilter > 0.0 {
+			var prefilterErr error
+			if selector, prefilterErr = state.prefilterSelector(imageMetric, storage); prefilterErr != nil {
+				return nil, prefilterErr
 			}
-		default:
-			return fmt.Errorf("Invalid image selector, expected gch or lch, got %s", selectionStr)
+			break
 		}
+		selector = NewImageMetricMinimizer(imageMetric, state.NumRoutines)
+	case CmdVarietyRand:
+		imageMetric := weightedMetric(state.cachedMetric(NewFeatureImageMetric(state.Features, metric, state.NumRoutines), selectionStr), weights)
+		numBestFit := state.GetBestFitImages(int(storage.NumImages()))
+		selector = RandomHeapImageSelector(imageMetric, numBestFit, state.NumRoutines,
+			NewSeededRand(state.Seed))
+	case CmdVarietyPenalty:
+		imageMetric := weightedMetric(state.cachedMetric(NewFeatureImageMetric(state.Features, metric, state.NumRoutines), selectionStr), weights)
+		numBestFit := state.GetBestFitImages(int(storage.NumImages()))
+		selector = UsagePenaltyImageSelector(imageMetric, state.PenaltyWeight, numBestFit, state.NumRoutines)
+	case CmdVarietyAssignment:
+		imageMetric := weightedMetric(state.cachedMetric(NewFeatureImageMetric(state.Features, metric, state.NumRoutines), selectionStr), weights)
+		selector = NewAssignmentSelector(imageMetric, state.AssignmentCap, state.NumRoutines)
+	case CmdVarietyDiffusion:
+		return nil, errors.New("Variety \"Diffusion\" is only supported for GCHs")
+	default:
+		return nil, fmt.Errorf("Internal error, please report bug: Got unkown variety selector (feature): %d", variety)
+	}
+	return finishMosaicSetup(state, storage, selector, reportMetric)
+}
 
-		tilesX, tilesY, tilesParseErr := ParseDimensions(args[3])
-		if tilesParseErr != nil {
-			return ErrCmdSyntaxErr
-		}
-		if tilesX == 0 || tilesY == 0 {
-			return fmt.Errorf("Tiles dimensions are not allowed to be empty, got %s", args[3])
-		}
-		inPath, inPathErr := state.GetPath(args[0])
-		if inPathErr != nil {
-			return inPathErr
-		}
-		// read query image
-		if state.Verbose {
-			fmt.Fprintln(state.Out, "Reading image", inPath)
-		}
-		start := time.Now()
-		r, openErr := os.Open(inPath)
-		if openErr != nil {
-			return openErr
-		}
-		defer r.Close()
-		img, _, decodeErr := image.Decode(r)
-		if decodeErr != nil {
-			return decodeErr
+// newCustomMosaicSetup creates the setup for a selector registered with
+// RegisterSelector. The factory gets all features that are loaded.
+func newCustomMosaicSetup(state *ExecutorState, factory SelectorFactory, variety CmdVarietySelector) (*mosaicSetup, error) {
+	storage, storageErr := state.composeStorage()
+	if storageErr != nil {
+		return nil, storageErr
+	}
+	options := SelectorOptions{
+		Variety:     variety,
+		BestFit:     state.GetBestFitImages(int(state.ImgStorage.NumImages())),
+		Seed:        state.Seed,
+		NumRoutines: state.NumRoutines,
+		Weights:     state.selectionWeights(),
+	}
+	if state.GCHStorage != nil {
+		options.GCHs = state.GCHStorage
+	}
+	if state.LCHStorage != nil {
+		scheme, schemeErr := ParseLCHScheme(state.LCHStorage.SchemeDescriptor())
+		if schemeErr != nil {
+			return nil, schemeErr
 		}
-		queryBounds := img.Bounds()
-		if queryBounds.Empty() {
-			return errors.New("Query image is empty")
+		options.LCHs, options.Scheme = state.LCHStorage, scheme
+	}
+	if orientations := state.Orientations.Orientations(); len(orientations) > 0 {
+		storage = NewOrientedStorage(storage, orientations)
+		if options.GCHs != nil {
+			options.GCHs = NewOrientedHistogramStorage(options.GCHs, orientations)
 		}
-		queryWidth, queryHeight := queryBounds.Dx(), queryBounds.Dy()
-		// compute output dimensions now that we have the original image
-		var mosaicWidth, mosaicHeight int
-		if len(args) > 4 {
-			var mosaicParseErr error
-			mosaicWidth, mosaicHeight, mosaicParseErr = ParseDimensionsEmpty(args[4])
-			if mosaicParseErr != nil {
-				return mosaicParseErr
-			}
-			// because dimensions are allowed to be empty we have to deal with
-			// negative values
-			switch {
-			case mosaicWidth < 0 && mosaicHeight < 0:
-				// keep original size
-				mosaicWidth, mosaicHeight = queryWidth, queryHeight
-			case mosaicWidth < 0:
-				// compute width and keep ratio
-				mosaicWidth = KeepRatioWidth(queryWidth, queryHeight, mosaicHeight)
-			case mosaicHeight < 0:
-				// compute height and keep ratio
-				mosaicHeight = KeepRatioHeight(queryWidth, queryHeight, mosaicWidth)
-			default:
-				// do nothing, both given
+		if options.LCHs != nil {
+			// the parts of grid schemes can't be permuted
+			if _, isGrid := options.Scheme.(GridLCHScheme); isGrid {
+				return nil, errors.New("Orientations are not supported for grid LCH schemes")
 			}
-		} else {
-			mosaicWidth, mosaicHeight = queryWidth, queryHeight
+			options.LCHs = NewOrientedLCHStorage(options.LCHs, orientations)
 		}
-		if mosaicWidth == 0 || mosaicHeight == 0 {
-			return fmt.Errorf("mosaic image would be empty, dimensions %dx%d", mosaicWidth, mosaicHeight)
+	}
+	options.Storage = storage
+	selector, reportMetric, factoryErr := factory(options)
+	if factoryErr != nil {
+		return nil, factoryErr
+	}
+	return finishMosaicSetup(state, storage, selector, reportMetric)
+}
+
+// finishMosaicSetup creates the setup for the selector, the values that don't
+// depend on the selector (resize strategy, border etc.) are taken from the
+// state. reportMetric can be nil.
+func finishMosaicSetup(state *ExecutorState, storage ImageStorage, selector ImageSelector,
+	reportMetric ImageMetric) (*mosaicSetup, error) {
+	selector, constraintsErr := state.constrainSelector(selector, storage)
+	if constraintsErr != nil {
+		return nil, constraintsErr
+	}
+	if state.MinImages > 0 {
+		if reportMetric == nil {
+			return nil, errors.New("min-images is not supported for selectors without metric")
 		}
-		divider := NewFixedNumDivider(tilesX, tilesY, true)
-		dist := divider.Divide(img.Bounds())
-		var selector ImageSelector
-		if useGCH {
-			metric, metricErr := parseGCHMetric(selectionStr)
-			if metricErr != nil {
-				return metricErr
-			}
-			switch state.VarietySelector {
-			case CmdVarietyNone:
-				selector = GCHSelector(state.GCHStorage, metric, state.NumRoutines)
-			case CmdVarietyRand:
-				imageMetric := NewHistogramImageMetric(state.GCHStorage, metric, state.NumRoutines)
-				numBestFit := state.GetBestFitImages(int(state.ImgStorage.NumImages()))
-				selector = RandomHeapImageSelector(imageMetric, numBestFit, state.NumRoutines)
-			default:
-				return fmt.Errorf("Internal error, please report bug: Got unkown variety selector (GCH): %d", state.VarietySelector)
-			}
-		} else {
-			metric, metricErr := parseLCHMetric(selectionStr)
-			if metricErr != nil {
-				return metricErr
-			}
-			// TODO this fixes the scheme on the number, that is no other four or
-			// five part scheme can be used, but I guess that's just fine
-			// otherwise we must safe it somewhere
-			var scheme LCHScheme
-			switch state.LCHStorage.SchemeSize() {
-			case 4:
-				scheme = NewFourLCHScheme()
-			case 5:
-				scheme = NewFiveLCHScheme()
-			default:
-				// should never happen
-				return fmt.Errorf("invalid scheme with %d parts. This is a bug! Pleas report", state.LCHStorage.SchemeSize())
-			}
-			switch state.VarietySelector {
-			case CmdVarietyNone:
-				selector = LCHSelector(state.LCHStorage, scheme, metric, state.NumRoutines)
-			case CmdVarietyRand:
-				imageMetric := NewLCHImageMetric(state.LCHStorage, scheme, metric, state.NumRoutines)
-				numBestFit := state.GetBestFitImages(int(state.ImgStorage.NumImages()))
-				selector = RandomHeapImageSelector(imageMetric, numBestFit, state.NumRoutines)
-			default:
-				return fmt.Errorf("Internal error, please report bug: Got unkown variety selector (LCH): %d", state.VarietySelector)
+		selector = NewMinDistinctSelector(selector, reportMetric, state.MinImages, state.NumRoutines)
+	}
+	strategy, strategyOk := GetResizeStrategy(state.Strategy)
+	if !strategyOk {
+		return nil, fmt.Errorf("Unkown resize strategy %s", state.Strategy)
+	}
+	return &mosaicSetup{
+		storage:     storage,
+		selector:    selector,
+		metric:      reportMetric,
+		resizer:     NewNfntResizer(state.InterP),
+		strategy:    strategy,
+		border:      TileBorder{Width: state.TileBorder, Color: state.TileBorderColor},
+		colorize:    state.Colorize,
+		grayscale:   state.Grayscale,
+		numRoutines: state.NumRoutines,
+	}, nil
+}
+
+// usageConstraints returns the constraints given by the variables max-usage
+// and required-images.
+func (state *ExecutorState) usageConstraints() UsageConstraints {
+	res := UsageConstraints{
+		MaxUsage:        state.MaxUsage,
+		NumOrientations: len(state.Orientations.Orientations()),
+	}
+	if len(state.RequiredImages) == 0 {
+		return res
+	}
+	res.Required = make(map[ImageID]string)
+	for id, path := range state.Mapper.IDMapping {
+		for _, pattern := range state.RequiredImages {
+			if MatchPathPattern(pattern, path) {
+				res.Required[ImageID(id)] = path
+				break
 			}
 		}
-		if state.Verbose {
-			fmt.Fprintln(state.Out)
-			fmt.Fprintln(state.Out, "Selecting database images for tiles")
-		}
-		var progress ProgressFunc
-		if state.Verbose {
-			numTiles := dist.Size()
-			progress = StdProgressFunc(state.Out, "",
-				numTiles, IntMin(100, numTiles/10))
-		}
-		selection, selectionErr := selector.SelectImages(state.ImgStorage, img, dist, progress)
-		if selectionErr != nil {
-			return selectionErr
-		}
-		execTime := time.Since(start)
-		if state.Verbose {
-			fmt.Fprintln(state.Out, "Selection took", execTime)
-			fmt.Fprintln(state.Out)
-			fmt.Fprintln(state.Out, "Composing mosaic")
-		}
-		start = time.Now()
-		// create mosaic tiles, for this create a new divider and a distribution
-		mosaicBounds := image.Rect(0, 0, mosaicWidth, mosaicHeight)
-		divider.Cut = state.CutMosaic
-		mosaicDist := divider.Divide(mosaicBounds)
-		// progress func should be fine to use
-		mosaic, mosaicErr := ComposeMosaic(state.ImgStorage, selection, mosaicDist,
-			NewNfntResizer(state.InterP), ForceResize, state.NumRoutines, ImageCacheSize, progress)
-		if mosaicErr != nil {
-			return mosaicErr
-		}
-		execTime = time.Since(start)
-		if state.Verbose {
-			fmt.Fprintln(state.Out, "Composition of mosaic took took", execTime)
-			fmt.Fprintln(state.Out)
-			fmt.Fprintln(state.Out, "Saving image")
-		}
-		if writeErr := saveImage(outPath, mosaic, state.JPGQuality); writeErr != nil {
-			return writeErr
+	}
+	return res
+}
+
+// constrainSelector applies the usage constraints (see usageConstraints) to
+// the selector: The HeapSelector of variety selectors is wrapped in a
+// ConstrainedHeapSelector, selectors without variety are replaced by a
+// HeapImageSelector that selects the best image of each heap (the size of the
+// heaps is given by best-fit). The assignment selector supports only
+// max-usage. An error is returned for all other selectors.
+func (state *ExecutorState) constrainSelector(selector ImageSelector, storage ImageStorage) (ImageSelector, error) {
+	constraints := state.usageConstraints()
+	if constraints.Empty() {
+		return selector, nil
+	}
+	numBestFit := state.GetBestFitImages(int(storage.NumImages()))
+	switch sel := selector.(type) {
+	case *HeapImageSelector:
+		sel.Selector = NewConstrainedHeapSelector(sel.Selector, constraints)
+		return sel, nil
+	case *ImageMetricMinimizer:
+		return NewHeapImageSelector(sel.Metric, NewConstrainedHeapSelector(nil, constraints),
+			numBestFit, state.NumRoutines), nil
+	case *PrefilteredImageMetricMinimizer:
+		return NewHeapImageSelector(sel.Metric, NewConstrainedHeapSelector(nil, constraints),
+			numBestFit, state.NumRoutines), nil
+	case *AssignmentSelector:
+		if len(constraints.Required) > 0 {
+			return nil, errors.New("required-images is not supported by variety \"Assignment\"")
 		}
-		fmt.Fprintln(state.Out, "Mosaic saved to", outPath)
-		if state.Verbose {
-			totalTime := time.Since(totalStart)
-			fmt.Fprintln(state.Out)
-			fmt.Fprintln(state.Out, "Total creation time:", totalTime)
+		if sel.MaxUsage <= 0 || sel.MaxUsage > constraints.MaxUsage {
+			sel.MaxUsage = constraints.MaxUsage
 		}
-		return nil
+		return sel, nil
 	default:
+		return nil, errors.New("max-usage and required-images are not supported by this selector, use search \"exact\" and a variety other than \"Diffusion\"")
+	}
+}
+
+// newMaskedSelector returns the selector for the mosaic command with an
+// importance mask: Important tiles are selected without variety using
+// maskMetric (or the metric of the mosaic if maskMetric is empty), all other
+// tiles are selected by the selector of setup.
+func newMaskedSelector(state *ExecutorState, setup *mosaicSetup, maskPath, selectionStr, maskMetric string) (ImageSelector, error) {
+	mask, maskErr := loadMaskImage(state, maskPath, setup.resizer)
+	if maskErr != nil {
+		return nil, maskErr
+	}
+	if maskMetric == "" {
+		maskMetric = selectionStr
+	}
+	importantSetup, setupErr := newMosaicSetupWithVariety(state, maskMetric, CmdVarietyNone)
+	if setupErr != nil {
+		return nil, setupErr
+	}
+	return NewMaskedSelector(mask, importantSetup.selector, setup.selector), nil
+}
+
+// loadMaskImage loads a mask image that is parallel to the query (like the
+// mask or shape of the mosaic command).
+func loadMaskImage(state *ExecutorState, maskPath string, resizer ImageResizer) (image.Image, error) {
+	path, pathErr := state.GetPath(maskPath)
+	if pathErr != nil {
+		return nil, pathErr
+	}
+	// the mask must be oriented the same way as the query
+	return LoadQueryImage(path, QueryPreprocessing{EXIF: state.Preprocess.EXIF}, resizer)
+}
+
+// maxTileSize returns the maximal width or height of all tiles in div.
+func maxTileSize(div TileDivision) int {
+	res := 0
+	for _, col := range div {
+		for _, r := range col {
+			res = IntMax(res, IntMax(r.Dx(), r.Dy()))
+		}
+	}
+	return res
+}
+
+// parseTiles parses the number of tiles (like "30x20"), both values must be
+// positive.
+func parseTiles(s string) (int, int, error) {
+	tilesX, tilesY, tilesParseErr := ParseDimensions(s)
+	if tilesParseErr != nil {
+		return -1, -1, ErrCmdSyntaxErr
+	}
+	if tilesX == 0 || tilesY == 0 {
+		return -1, -1, fmt.Errorf("Tiles dimensions are not allowed to be empty, got %s", s)
+	}
+	return tilesX, tilesY, nil
+}
+
+// mosaicDimensions computes the bounds of the mosaic given the bounds of the
+// query image and the size spec (like "1024x768", "1024x", "50%" or "2x", see
+// SizeSpec). If s is empty the dimensions of the query are used.
+func mosaicDimensions(queryBounds image.Rectangle, s string) (image.Rectangle, error) {
+	if queryBounds.Empty() {
+		return image.Rectangle{}, errors.New("Query image is empty")
+	}
+	spec, specErr := ParseSizeSpec(s)
+	if specErr != nil {
+		return image.Rectangle{}, specErr
+	}
+	mosaicWidth, mosaicHeight := spec.Apply(queryBounds.Dx(), queryBounds.Dy())
+	if mosaicWidth == 0 || mosaicHeight == 0 {
+		return image.Rectangle{}, fmt.Errorf("mosaic image would be empty, dimensions %dx%d", mosaicWidth, mosaicHeight)
+	}
+	return image.Rect(0, 0, mosaicWidth, mosaicHeight), nil
+}
+
+// ThumbnailCommand writes a resized copy of an image, the size is given as
+// SizeSpec (for example "25%" or "x200"). The image is loaded like a query
+// image, so the preprocessing is applied.
+func ThumbnailCommand(state *ExecutorState, args ...string) error {
+	if len(args) != 3 {
 		return ErrCmdSyntaxErr
 	}
+	inPath, inErr := state.GetPath(args[0])
+	if inErr != nil {
+		return inErr
+	}
+	outPath, outErr := state.GetPath(args[1])
+	if outErr != nil {
+		return outErr
+	}
+	resizer := NewNfntResizer(state.InterP)
+	img, loadErr := LoadQueryImage(inPath, state.Preprocess, resizer)
+	if loadErr != nil {
+		return loadErr
+	}
+	bounds, boundsErr := mosaicDimensions(img.Bounds(), args[2])
+	if boundsErr != nil {
+		return boundsErr
+	}
+	thumbnail := resizer.Resize(uint(bounds.Dx()), uint(bounds.Dy()), img)
+	if saveErr := saveImage(state, outPath, thumbnail, nil); saveErr != nil {
+		return saveErr
+	}
+	fmt.Fprintf(state.Out, "Thumbnail with size %dx%d saved to %s\n", bounds.Dx(), bounds.Dy(), outPath)
+	return nil
 }
 
 func init() {
@@ -1160,21 +5354,28 @@ func init() {
 		Exec:        StatsCommand,
 		Usage:       "stats [var]",
 		Description: "Show value of variables that can be changed via set, if var is given only value of that variable",
+		Complete:    CompleteStats,
 	}
 	DefaultCommands["set"] = Command{
 		Exec:  SetVarCommand,
 		Usage: "set <variable> <value>",
 		Description: "Set value for a variable. For details about the variables" +
 			" please refer to the user documentation.",
+		Complete: CompleteSet,
 	}
 	DefaultCommands["cd"] = Command{
 		Exec:        CdCommand,
 		Usage:       "cd <dir>",
 		Description: "Change working directory to the specified directory",
+		Complete:    CompleteCd,
 	}
 	DefaultCommands["storage"] = Command{
-		Exec:  ImageStorageCommand,
-		Usage: "storage [list] or storage load [dir]",
+		Exec: ImageStorageCommand,
+		Usage: "storage [list] or storage load [dir] [recursive] [as <label>] or storage load --manifest <file> [--cache dir] or storage add <dir|file> [recursive]" +
+			" or storage remove <glob> or storage dedupe [exact | perceptual [max-dist]]" +
+			" or storage watch <dir> [recursive] [interval] or storage tags <file>" +
+			" or storage weight <file> or storage weight <glob> <weight>" +
+			" or storage filter [none | <conditions>]",
 		Description: "This command controls the images that are considered" +
 			" database images. This does not mean that all these images have some" +
 			" precomputed data, like histograms. Only that they were found as" +
@@ -1183,54 +5384,375 @@ func init() {
 			" note that this can be quite large\n\n" +
 			"If load is used the image storage will be initialized with images from" +
 			" the directory (working directory if no image provided). All previously" +
-			" loaded images will be removed from the storage.",
+			" loaded images will be removed from the storage. Files can be filtered" +
+			" with \"--include <patterns>\" and \"--exclude <patterns>\" (patterns" +
+			" separated by \",\"), for example \"storage load ~/Pictures true --exclude" +
+			" *thumb* --include *.jpg\". Symbolic links to directories are followed" +
+			" with \"--follow-symlinks true\". Images smaller than the variable" +
+			" min-image-size or with an aspect ratio above max-image-ratio are skipped." +
+			" \"--depth 2\" visits only subdirectories up to depth 2 in recursive mode." +
+			" The directories are read concurrently, the number of go routines is the" +
+			" variable routines.\n\n" +
+			"\"storage load --manifest <file>\" loads remote images: Each line of" +
+			" the manifest is a HTTP(S) URL or an S3 URL like s3://bucket/key (the" +
+			" objects must be public, \"--region eu-central-1\" selects the regional" +
+			" endpoint). All images are downloaded to the cache directory (default" +
+			" is the manifest file with the extension \".cache\") and the cached" +
+			" files are used as database images, images that are already cached" +
+			" are not downloaded again. Images that can't be downloaded are handled" +
+			" as described by image-errors.\n\n" +
+			"\"storage load ~/Cats as cats\" loads the images with the label cats:" +
+			" Only the images previously loaded as cats are replaced, all other" +
+			" images are kept (GCHs and LCHs are updated as with add). This way one" +
+			" storage can contain images from different directories, mosaics can" +
+			" be restricted to some labels with \"mosaic ... --only cats,dogs\"." +
+			" storage without arguments prints the number of images of each label.\n\n" +
+			"add adds the images from a directory (or a single image) to the storage," +
+			" remove removes all images matching the pattern (for example" +
+			" \"storage remove *thumb*\", a pattern without a directory is matched" +
+			" against the file name, otherwise against the path). Loaded GCHs and LCHs are updated" +
+			" accordingly: For new images they are computed, for removed images they" +
+			" are removed.\n\n" +
+			"dedupe removes duplicate images: exact (the default) finds files with" +
+			" identical content, perceptual finds images that look the same (for" +
+			" example the same photo with a different size). max-dist controls how" +
+			" similar images must be, 0 (the default) means that the image hashes" +
+			" must be equal, the maximum is 64.\n\n" +
+			"watch keeps the storage in sync with a directory until Ctrl+C is" +
+			" pressed: The directory is scanned every interval (default 2s) and new" +
+			" images are added, deleted images are removed (GCHs and LCHs are" +
+			" updated as with add and remove). The directory is polled, file system" +
+			" notifications are not used. New images that can't be read are skipped" +
+			" (independent of image-errors) and tried again on the next scan, errors" +
+			" are printed and don't stop watching.\n\n" +
+			"tags reads the tags of images from a .csv file (each line contains the" +
+			" path of an image followed by its tags, like \"beach/1.jpg,vacation,sea\")" +
+			" or a .json file (like {\"beach/1.jpg\": [\"vacation\", \"sea\"]}), relative" +
+			" paths are relative to the file. filter restricts the images used by mosaic," +
+			" mosaicgif and batch without changing the storage (GCHs and LCHs don't" +
+			" have to be re-computed). Conditions are of the form tag=values," +
+			" tag!=values, label=values or label!=values (values separated by \",\")," +
+			" an image is used if it fulfills all conditions, for example" +
+			" \"storage filter tag=vacation,beach label!=dogs\". \"storage filter none\"" +
+			" removes the filter.\n\n" +
+			"weight sets the weight of images: The metric value of an image is" +
+			" multiplied with its weight during the selection, thus images with a" +
+			" weight below 1 (like 0.5) are preferred and images with a weight above" +
+			" 1 are avoided. \"storage weight favorites/* 0.5\" sets the weight of all" +
+			" images matching the pattern (1 removes the weight), \"storage weight" +
+			" weights.csv\" reads the weights from a .csv file (lines like" +
+			" \"beach/1.jpg,0.5\") or a .json file (like {\"beach/1.jpg\": 0.5}). Weights" +
+			" are not supported by search ANN and variety Diffusion.",
+		Complete: CompleteStorage,
 	}
 	DefaultCommands["gch"] = Command{
-		Exec:  GCHCommand,
-		Usage: "gch create [k] or gch load <file> or gch save <file>",
+		Exec: GCHCommand,
+		Usage: "gch create [k] [--precision float64|float32] [--sparse true|false] or gch load <file> [--root dir] or gch save <file> [--precision float64|float32] [--sparse true|false] [--root dir]" +
+			" or gch update <file|dir> [k] or gch show <image> <out> [<other image>]",
 		Description: "Used to administrate global color histograms (GCHs)\n\n" +
 			"If \"create\" is used GCHs are created for all images in the current" +
 			" storage. The optional argument k must be a number between 1 and 256." +
 			" See usage documentation / Wiki for details about this value. 8 is the" +
-			" default value and should be fine.\n\nsave and load commands load files" +
-			" containing GHCs from a file.",
+			" default value and should be fine. With \"--precision float32\" the" +
+			" GCHs are kept with float32 entries in memory, this halves the memory" +
+			" required for the GCHs. With \"--sparse true\" only the non-zero" +
+			" entries are kept in memory. If an image can't be read (for" +
+			" example a corrupt file) the creation fails, with \"set image-errors" +
+			" skip\" such images are reported and removed from the storage (this" +
+			" also applies to \"lch create\" and \"feature create\").\n\nsave" +
+			" and load commands load files" +
+			" containing GHCs from a file. With \"--precision float32\" the" +
+			" histograms are saved with float32 entries, this halves the size of" +
+			" the file (such files are loaded with float32 precision, see" +
+			" \"create\"). With \"--sparse true\" only the non-zero entries are saved" +
+			" (such files are loaded as sparse histograms)." +
+			" Files ending with .gz (for example \"gch-8.gob.gz\") are gzip compressed." +
+			" With \"--root dir\" the paths of the images are saved relative to" +
+			" dir, this way the file can be used on another machine: Load it with" +
+			" \"--root\" set to the directory containing the images there.\n\n" +
+			"update loads the GCHs from a file (if it exists) and only computes the" +
+			" GCHs of images that are not contained in the file, the file is updated" +
+			" afterwards. If a directory is given the file is searched by its default" +
+			" name (for example \"gch-8.gob\"). This way the histograms of a database" +
+			" are only computed once.\n\n" +
+			"show draws the GCH of an image as a bar chart to out (.png, .jpg or" +
+			" .svg). If another image is given both GCHs are drawn below each other" +
+			" and their distance is printed, this shows why images are considered" +
+			" similar.",
+		Complete: CompleteGCH,
 	}
 	DefaultCommands["lch"] = Command{
 		Exec:  LCHCommand,
-		Usage: "lch create <k> <scheme> or lch load <file> or lch save <file>",
+		Usage: "lch create <k> <scheme> or lch load <file> [--root dir] or lch save <file> [--root dir]",
 		Description: "Used to administrate local color histograms (LCHs)\n\n" +
 			"\"crate\", \"load\" and \"save\" work as in the gch command. k is also" +
 			"the same as in the GCH command and scheme is the number of GCHs created" +
-			"for each image (must be either 4 or 5).",
+			"for each image: Either 4 or 5 or a grid like \"3x3\" (3 columns and 3" +
+			" rows), in this case a GCH is created for each part of the grid.\n\n" +
+			"The EXIF orientation of database images is applied by default (see" +
+			" \"set exif\"), LCHs that were computed without it (for example with" +
+			" an older version) don't match the rotated images and must be" +
+			" re-created. Changing exif drops the loaded LCHs and features.",
+		Complete: CompleteHistograms,
+	}
+	DefaultCommands["feature"] = Command{
+		Exec:  FeatureCommand,
+		Usage: "feature create <name> [key=value...] or feature load <file> [--root dir] or feature save <file> [--root dir] or feature list",
+		Description: "Used to administrate features of any kind (GCHs, LCHs, average" +
+			" colors, edge histograms, ...)\n\n" +
+			"create computes the features of all images in the current storage," +
+			" parameters are given as key=value, for example \"feature create gch" +
+			" k=8\", \"feature create lch k=8 scheme=3x3\" or \"feature create edge" +
+			" regions=4 bins=4 color=8 weight=0.5\" (edge histograms combined with GCHs)." +
+			" Features created for" +
+			" GCHs and LCHs are also used by the gch and lch selection. list shows" +
+			" all available features. save and load work as in the gch command.\n\n" +
+			"\"feature create embedding model=<file.onnx> [size=224]\" computes" +
+			" embeddings with a neural network, this requires gomosaic to be built" +
+			" with \"-tags onnx\". Use \"feature-cosine\" to compare embeddings.\n\n" +
+			"Use the selection \"feature-<metric>\" in the mosaic command to create" +
+			" a mosaic with the loaded features.",
+		Complete: CompleteFeature,
+	}
+	DefaultCommands["gray"] = Command{
+		Exec:  GrayCommand,
+		Usage: "gray create [k] or gray load <file> [--root dir] or gray save <file> [--root dir]",
+		Description: "Used to administrate luminance histograms for black-and-white" +
+			" mosaics\n\n" +
+			"create computes a 1D histogram of the gray values of all images in" +
+			" storage, k is the number of bins (between 1 and 256, defaults to 32)." +
+			" Luminance histograms are features, save and load work as in the feature" +
+			" command. Use the selection \"gray-<metric>\" (for example gray-euclid) in" +
+			" the mosaic command and \"set grayscale true\" to create a monochrome" +
+			" mosaic.",
+		Complete: CompleteGray,
+	}
+	DefaultCommands["bundle"] = Command{
+		Exec:  BundleCommand,
+		Usage: "bundle save <file> [--root dir] or bundle load <file> [--root dir]",
+		Description: "Saves all loaded GCHs and LCHs to one file or loads them" +
+			" from such a file. This simplifies the distribution of precomputed" +
+			" data. Files must end with .gob or .json, optionally followed by .gz" +
+			" for gzip compressed files. --root works as in the gch command.",
+		Complete: CompleteBundle,
+	}
+	DefaultCommands["alias"] = Command{
+		Exec:  AliasCommand,
+		Usage: "alias [<name> [\"<commands>\"]]",
+		Description: "Defines an alias: A new command that executes a sequence of" +
+			" commands. The commands are separated by \";\" and must be enclosed in" +
+			" quotes, the placeholders $1, $2, ... are replaced by the arguments of" +
+			" the alias. Example: alias quick \"storage load $1; gch create;" +
+			" mosaic $2 $3 gch-euclid 40x40\" can be used like quick ~/Pictures" +
+			" in.jpg out.jpg. An empty list of commands removes the alias, without" +
+			" commands the alias is shown and without arguments all aliases are" +
+			" listed. Aliases can also be defined in the [alias] section of the" +
+			" config file and are saved in sessions.",
+		Complete: CompleteAlias,
+	}
+	DefaultCommands["session"] = Command{
+		Exec:  SessionCommand,
+		Usage: "session save <file> or session load <file>",
+		Description: "Saves the current session to a file or restores a session" +
+			" from such a file. A session contains all variables (see \"stats\")," +
+			" the aliases, the working directory and the images in the storage. If GCHs or LCHs" +
+			" are loaded they're saved to a bundle next to the file (session.json" +
+			" uses session-features.gob). This way work can be resumed after a restart.",
+		Complete: CompleteSession,
 	}
 	DefaultCommands["mosaic"] = Command{
-		Exec:  MosaicCommand,
-		Usage: "mosaic <in> <out> <metric> <tiles> [dimension]",
+		Exec: MosaicCommand,
+		Usage: "mosaic <in> <out> <metric> <tiles> [dimension] [--overlay <opacity>] [--recurse <depth>]" +
+			" [--mask <mask> [--mask-metric <metric>]] [--shape <shape>] [--report <file.html>]" +
+			" [--heatmap <file.png>] [--only <labels>] [--preview <size>]" +
+			" or mosaic plan save <file> or mosaic plan render <file> <out> [dimension]" +
+			" or mosaic info <file>",
 		Description: "Creates a mosaic based on global color histograms (GCHs)." +
 			" in is the path to the query image, out the path to the output image" +
-			" (i.e. mosaic), metric is of the form gch-metric, e.g. gch-cosine." +
-			" a list of supported metrics is given below. tiles describes the number" +
+			" (i.e. mosaic), metric is of the form gch-metric, e.g. gch-cosine, feature-metric" +
+			" (features created with the feature command) or the name of a registered selector. a list of supported metrics is given below. tiles describes the number" +
 			" of tiles to use in the mosaic, for example \"30x20\" creates 30 times 20" +
 			" tiles (30 in x and 20 in y direction). dimension is optional a describes" +
 			" the dimensions of the output image. If omitted the dimensions of the input" +
 			" are used. For example 1024x768 creates a mosaic with 1024 width and 768" +
 			" height. A value can be omitted and the ratio of the query image is retained." +
 			" \"1024x\" means a mosaic with width 1024 and the height is computed by" +
-			" the query ratio. Also works in the other direction like \"x768\".\n\n" +
+			" the query ratio. Also works in the other direction like \"x768\"." +
+			" Percent values of the query size like \"50%\" or \"50%x25%\" and" +
+			" multipliers like \"2x\" are supported as well.\n\n" +
+			"The query image can be blended over the mosaic with \"--overlay 0.2\"," +
+			" the value is the opacity of the query image (between 0 and 1). If omitted" +
+			" the value of the variable overlay is used.\n\n" +
+			"With \"--recurse n\" each tile is itself rendered as a mosaic (with the" +
+			" same number of tiles), n is the depth of the recursion.\n\n" +
+			"\"--mask mask.png\" is a grayscale image with the importance of the" +
+			" regions of the query: Tiles in bright regions (like faces) are matched" +
+			" with the whole database without variety, the other tiles use the" +
+			" variety selector. \"--mask-metric\" is the metric for the bright" +
+			" regions (for example a stricter LCH metric), defaults to metric.\n\n" +
+			"Tiles that are fully transparent in the query are left empty" +
+			" (transparent in a png mosaic), \"--shape shape.png\" leaves all tiles" +
+			" empty that are black in shape.png. This way mosaics of logos or text" +
+			" can be created.\n\n" +
+			"\"--report report.html\" writes an HTML report of the mosaic: Hovering" +
+			" over a tile shows the database image used for the tile and its metric" +
+			" value (always computed with metric, image weights and the variety" +
+			" penalty are not included), the table of all tiles lists the best" +
+			" candidates of each tile as ranked by the selection.\n\n" +
+			"\"--heatmap heat.png\" saves an image of the size of the mosaic in which" +
+			" the brightness of each tile encodes the metric value of the image" +
+			" selected for it (black is the best, white the worst match). This shows" +
+			" the regions for which the database lacks fitting images.\n\n" +
+			"\"--only cats,dogs\" uses only the database images loaded with one of" +
+			" the labels (see \"storage load <dir> as <label>\").\n\n" +
+			"\"--preview 25%\" saves a low-resolution preview of the mosaic (here a" +
+			" quarter of the size) before the mosaic is composed, it's saved next to" +
+			" out with the suffix \"-preview\" (out-preview.jpg for out.jpg). The" +
+			" preview uses the same selection, so bad runs can be aborted before the" +
+			" expensive composition completes.\n\n" +
+			"The selection of the last mosaic can be saved with \"mosaic plan save plan.json\"" +
+			" and later be rendered again (without running the selection) with" +
+			" \"mosaic plan render plan.json out.png 4096x\". The images of the plan" +
+			" must be loaded in the storage, resize, tile-border and tile-border-color" +
+			" are taken from the current variables, colorize and overlay are not applied.\n\n" +
+			"The mosaic contains metadata (like the metric, the number of tiles" +
+			" and the number of database images), it is stored as text in png files" +
+			" and as EXIF data in jpg files. \"mosaic info out.png\" prints the" +
+			" metadata of a mosaic.\n\n" +
 			"Example Usage: \"mosaic in.jpg out.jpg gch-cosine 20x30 1024x768\". Valid" +
 			" metrics (each with prefix \"gch-\" like \"gch-cosine\"):\n\n" +
 			strings.Join(GetHistogramMetricNames(), " "),
+		Complete: CompleteMosaic,
+	}
+	DefaultCommands["mosaicgif"] = Command{
+		Exec:  MosaicGIFCommand,
+		Usage: "mosaicgif <in> <out.gif> <metric> <tiles> [dimension] [--delay <n>] [--overlay <opacity>]",
+		Description: "Creates an animated mosaic. in is either an animated GIF or a" +
+			" directory containing the frames as .jpg or .png files (sorted by name)." +
+			" A mosaic is created for each frame and the result is written as animated" +
+			" GIF to out. All other arguments are the same as for the mosaic command." +
+			" The delay between two frames (in 100ths of a second) is the delay of the" +
+			" input GIF, it can be set with \"--delay\" (default for directories is 10).",
+		Complete: CompleteMosaicGIF,
+	}
+	DefaultCommands["selfmosaic"] = Command{
+		Exec:  SelfMosaicCommand,
+		Usage: "selfmosaic <in> <out> <metric> <tiles> [dimension] [--patch <size>] [--step <size>] [--sources <files>]",
+		Description: "Creates a mosaic without the image storage: The database images" +
+			" are patches of the query image, for example \"--patch 16x16\" divides the" +
+			" query into patches of 16x16 pixels (default 32x32). \"--step 8x8\" creates" +
+			" overlapping patches whose corners are 8 pixels apart (default is the" +
+			" patch size). \"--sources a.jpg,b.jpg\" takes the patches from other" +
+			" images instead of the query. The GCHs of the patches are computed for" +
+			" each mosaic, metric must be a GCH metric like gch-cosine. All other" +
+			" arguments are the same as for the mosaic command, variety, best, seed," +
+			" layout, cut, resize, tile-border and cache are taken from the variables.",
+		Complete: CompleteSelfMosaic,
+	}
+	DefaultCommands["collage"] = Command{
+		Exec:  CollageCommand,
+		Usage: "collage <in> <out> <metric> [dimension] [--size <min-max>] [--rotation <degrees>] [--coverage <fraction>] [--images <n>] [--border <n>]",
+		Description: "Composes a scrapbook-style collage instead of a grid: Database images" +
+			" are placed at random positions with random sizes and rotations until" +
+			" the collage is covered. For each image the GCH of the query area below" +
+			" it is compared to the database images with metric (a GCH metric like" +
+			" gch-cosine), variety and best are taken from the variables. \"--size" +
+			" 32-128\" sets the length of the longer side of the images (default" +
+			" 32-128), large images are placed first. \"--rotation\" is the maximal" +
+			" rotation in degrees (default 15), \"--coverage\" the fraction of pixels" +
+			" that must be covered (default 0.98), \"--images\" limits the number of" +
+			" images (default 10000) and \"--border\" is the width of the white" +
+			" border around each image (default 2).",
+		Complete: CompleteCollage,
+	}
+	DefaultCommands["retile"] = Command{
+		Exec:  RetileCommand,
+		Usage: "retile <x> <y> [exclude|<file>]",
+		Description: "Replaces a single tile of the last mosaic created with the mosaic" +
+			" command, x and y are the column and row of the tile (starting with 0)." +
+			" The best image for the tile is selected again with the metric of the" +
+			" mosaic (without variety), \"exclude\" skips the image currently used" +
+			" for the tile and a file uses that image (which must be in the storage)." +
+			" The tile is replaced in the saved mosaic and in the plan, all other" +
+			" tiles stay the same. Recursive mosaics can't be retiled.",
+		Complete: CompleteRetile,
+	}
+	DefaultCommands["undo"] = Command{
+		Exec:  UndoCommand,
+		Usage: "undo",
+		Description: "Reverts the last command that changed the state: set, alias," +
+			" cd and the commands that change the storage or load / create" +
+			" precomputed data (like \"storage load\", \"gch create\" or \"session" +
+			" load\"). The last 20 changes can be undone, files written by" +
+			" commands (like mosaics or saved GCHs) are not changed.",
+	}
+	DefaultCommands["redo"] = Command{
+		Exec:        RedoCommand,
+		Usage:       "redo",
+		Description: "Restores the state after the last command reverted with undo.",
+	}
+	DefaultCommands["batch"] = Command{
+		Exec:  BatchCommand,
+		Usage: "batch <dir|glob> <out-dir> <metric> <tiles> [dimension] [--workers <n>] [--overlay <opacity>]",
+		Description: "Creates a mosaic for each query image in a directory (or each" +
+			" image matching the glob). The mosaics are saved in out-dir with the" +
+			" name of the query image. All other arguments are the same as for the" +
+			" mosaic command. The database images, features and the image cache are" +
+			" shared, the queries are processed by several workers in parallel" +
+			" (default 2, set with \"--workers\").",
+		Complete: CompleteBatch,
+	}
+	DefaultCommands["thumbnail"] = Command{
+		Exec:  ThumbnailCommand,
+		Usage: "thumbnail <in> <out> <size>",
+		Description: "Writes a resized copy of the image in to out. size has the" +
+			" same format as the dimension of the mosaic command, for example" +
+			" \"320x\", \"25%\" or \"0.5x\". The preprocessing of query images" +
+			" (see variable preprocess) is applied.",
+		Complete: CompleteThumbnail,
+	}
+	DefaultCommands["check"] = Command{
+		Exec:  CheckCommand,
+		Usage: "check [<in> <tiles> [dimension]] [--gch <file>]",
+		Description: "Validates the current session before a long run: All images in the" +
+			" storage are decoded and the loaded GCHs and LCHs are checked (one valid" +
+			" histogram for each image). With \"--gch file\" the GCHs in the file are" +
+			" compared with the images in the storage: The file must contain a GCH for" +
+			" each image and no GCHs of other images. If a query image and the number of tiles are" +
+			" given (as for the mosaic command) the number of tiles and the memory" +
+			" required to create the mosaic are estimated. Nothing is created.",
+		Complete: CompleteCheck,
+	}
+	DefaultCommands["bench"] = Command{
+		Exec:  BenchCommand,
+		Usage: "bench <in> <tiles> [dimension] [--feature gch|lch] [--varieties true|false] [--out <dir>]",
+		Description: "Compares the metrics for a query image: The selection is run with each" +
+			" metric (as gch-metric or lch-metric with \"--feature lch\"), for each" +
+			" metric the time of the selection, the mean metric value of all tiles" +
+			" and the number of distinct images used are reported. Note that the" +
+			" values of different metrics are not comparable. With \"--varieties true\"" +
+			" each metric is combined with each variety selector. With \"--out dir\"" +
+			" the mosaics are created in dir (like mosaic-gch-cosine.jpg) and the" +
+			" results are written to dir/bench.json.",
+		Complete: CompleteBench,
 	}
 }
 
 // ReplHandler implements CommandHandler by reading commands from stdin and
 // writing output to stdout.
-type ReplHandler struct{}
+type ReplHandler struct {
+	// Variables are set (see the set command) after the defaults are loaded,
+	// for example from command line flags. Can be nil.
+	Variables map[string]string
+}
 
 // Init creates an initial ExecutorState. It creates a new mapper and
 // image database and sets the working directory to the current directory.
 // This method might panic if something with filepath is wrong, this should
 // however usually not be the case.
+//
+// The variables are initialized from ~/.gomosaicrc and environment variables,
+// see LoadStateDefaults, and then from Variables.
 func (h ReplHandler) Init() *ExecutorState {
 	// seems reasonable
 	initialRoutines := runtime.NumCPU() * 2
@@ -1243,7 +5765,7 @@ func (h ReplHandler) Init() *ExecutorState {
 		panic(fmt.Errorf("Unable to retrieve path: %s", err.Error()))
 	}
 	mapper := NewFSMapper()
-	return &ExecutorState{
+	state := &ExecutorState{
 		// dir is always an absolute path
 		WorkingDir:      dir,
 		NumRoutines:     initialRoutines,
@@ -1256,24 +5778,47 @@ func (h ReplHandler) Init() *ExecutorState {
 		Out:             os.Stdout,
 		CutMosaic:       false,
 		JPGQuality:      100,
+		PNGCompression:  png.DefaultCompression,
 		InterP:          resize.Lanczos3,
 		CacheSize:       ImageCacheSize,
 		VarietySelector: CmdVarietyNone,
+		Search:          CmdSearchExact,
+		Preprocess:      QueryPreprocessing{},
 		BestFit:         0.05,
+		Seed:            -1,
+		PenaltyWeight:   0.1,
+		AssignmentCap:   1,
+		Strategy:        "force",
+		TileBorderColor: color.RGBA{A: 255},
+		Jitter:          DefaultJitter,
 	}
+	LoadStateDefaults(state)
+	if varsErr := ApplyVariables(state, h.Variables); varsErr != nil {
+		log.WithError(varsErr).Warn("Can't set variables")
+	}
+	return state
 }
 
 func (h ReplHandler) Start(s *ExecutorState) {
 	fmt.Println("Welcome to the gomosaic generator")
 	fmt.Println("Copyright © 2018 Fabian Wenzelmann")
-	fmt.Print(">>> ")
+}
+
+// NewLineReader implements LineReaderHandler. If stdin is a terminal a
+// TerminalLineReader is used that supports history and completion of
+// command names and file paths. Otherwise the lines are simply scanned from
+// stdin.
+func (h ReplHandler) NewLineReader(s *ExecutorState, commandMap CommandMap) LineReader {
+	reader, err := NewTerminalLineReader(os.Stdin, s.Out, ">>> ", CompleteCommands(s, commandMap))
+	if err != nil {
+		return NewScannerLineReader(s.In, ">>> ", s.Out)
+	}
+	return reader
 }
 
 func (h ReplHandler) Before(s *ExecutorState) {}
 
-func (h ReplHandler) After(s *ExecutorState) {
-	fmt.Print(">>> ")
-}
+func (h ReplHandler) After(s *ExecutorState) {}
 
 func (h ReplHandler) OnParseErr(s *ExecutorState, err error) bool {
 	fmt.Println("Syntax error", err)
@@ -1305,6 +5850,8 @@ func (h ReplHandler) OnScanErr(s *ExecutorState, err error) {
 // and reads from a specified reader. It stops whenever an error is enountered.
 type ScriptHandler struct {
 	Source io.Reader
+	// Variables are set after the defaults are loaded, see ReplHandler.
+	Variables map[string]string
 }
 
 // NewScriptHandler returns a new script handler that reads input from the given
@@ -1317,6 +5864,9 @@ func NewScriptHandler(source io.Reader) ScriptHandler {
 // image database and sets the working directory to the current directory.
 // This method might panic if something with filepath is wrong, this should
 // however usually not be the case.
+//
+// The variables are initialized from ~/.gomosaicrc and environment variables,
+// see LoadStateDefaults, and then from Variables.
 func (h ScriptHandler) Init() *ExecutorState {
 	// seems reasonable
 	initialRoutines := runtime.NumCPU() * 2
@@ -1329,7 +5879,7 @@ func (h ScriptHandler) Init() *ExecutorState {
 		panic(fmt.Errorf("Unable to retrieve path: %s", err.Error()))
 	}
 	mapper := NewFSMapper()
-	return &ExecutorState{
+	state := &ExecutorState{
 		// dir is always an absolute path
 		WorkingDir:      dir,
 		NumRoutines:     initialRoutines,
@@ -1342,11 +5892,25 @@ func (h ScriptHandler) Init() *ExecutorState {
 		Out:             os.Stdout,
 		CutMosaic:       false,
 		JPGQuality:      100,
+		PNGCompression:  png.DefaultCompression,
 		InterP:          resize.Lanczos3,
 		CacheSize:       ImageCacheSize,
 		VarietySelector: CmdVarietyNone,
+		Search:          CmdSearchExact,
+		Preprocess:      QueryPreprocessing{},
 		BestFit:         0.05,
+		Seed:            -1,
+		PenaltyWeight:   0.1,
+		AssignmentCap:   1,
+		Strategy:        "force",
+		TileBorderColor: color.RGBA{A: 255},
+		Jitter:          DefaultJitter,
+	}
+	LoadStateDefaults(state)
+	if varsErr := ApplyVariables(state, h.Variables); varsErr != nil {
+		log.WithError(varsErr).Warn("Can't set variables")
 	}
+	return state
 }
 
 func (h ScriptHandler) Start(s *ExecutorState) {}
@@ -1441,7 +6005,7 @@ func ParameterizedFromStrings(commands []string, args ...string) io.Reader {
 	replacer := strings.NewReplacer(replaceArgs...)
 	lines := make([]string, 0, len(commands))
 	// iterate over each line and perform replacement
-	for _, line := range lines {
+	for _, line := range commands {
 		line = replacer.Replace(line)
 		lines = append(lines, line)
 	}
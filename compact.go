@@ -0,0 +1,374 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// This file contains a compact representation of histograms that stores the
+// entries as float32 instead of float64. For big databases (or histograms with
+// many sub-divisions) this halves the memory required for the histograms.
+// The precision of float32 is more than enough for normalized histograms.
+
+// CompactHistogram is a histogram with float32 entries, see Histogram for
+// details.
+type CompactHistogram struct {
+	Entries []float32
+	K       uint
+}
+
+// NewCompactHistogram converts a histogram to its compact representation.
+func NewCompactHistogram(h *Histogram) *CompactHistogram {
+	entries := make([]float32, len(h.Entries))
+	for i, e := range h.Entries {
+		entries[i] = float32(e)
+	}
+	return &CompactHistogram{Entries: entries, K: h.K}
+}
+
+// Histogram converts the compact histogram to a histogram with float64
+// entries.
+func (c *CompactHistogram) Histogram() *Histogram {
+	entries := make([]float64, len(c.Entries))
+	for i, e := range c.Entries {
+		entries[i] = float64(e)
+	}
+	return &Histogram{Entries: entries, K: c.K}
+}
+
+// CreateCompactHistograms works as CreateHistograms but returns the compact
+// histograms. Each histogram is converted directly after it was created, thus
+// the float64 version of all histograms is never held in memory.
+func CreateCompactHistograms(ids []ImageID, storage ImageStorage, normalize bool, k uint, numRoutines int, progress ProgressFunc) ([]*CompactHistogram, error) {
+	res, _, err := CreateCompactHistogramsWithPolicy(ids, storage, normalize, k, numRoutines, progress, ImageErrorsFail)
+	return res, err
+}
+
+// CreateCompactHistogramsWithPolicy works as CreateCompactHistograms, see
+// CreateHistogramsWithPolicy for the policy.
+func CreateCompactHistogramsWithPolicy(ids []ImageID, storage ImageStorage, normalize bool, k uint,
+	numRoutines int, progress ProgressFunc, policy ImageErrorPolicy) ([]*CompactHistogram, *ImageErrorReport, error) {
+	res := make([]*CompactHistogram, len(ids))
+	onImage := func(pos int, img image.Image) {
+		res[pos] = NewCompactHistogram(GenHistogram(img, k, normalize))
+	}
+	report, err := forEachImageWithPolicy(ids, storage, numRoutines, onImage, progress, policy)
+	if err != nil {
+		return nil, report, err
+	}
+	return res, report, nil
+}
+
+// CreateAllCompactHistograms creates all compact histograms for images in the
+// storage, see CreateCompactHistograms.
+func CreateAllCompactHistograms(storage ImageStorage, normalize bool, k uint, numRoutines int, progress ProgressFunc) ([]*CompactHistogram, error) {
+	return CreateCompactHistograms(IDList(storage), storage, normalize, k, numRoutines, progress)
+}
+
+// CompactHistStorage implements HistogramStorage by keeping a list of compact
+// histograms in memory.
+//
+// Note that GetHistogram has to convert the histogram and thus allocates
+// memory on each call. For selecting images use CompactHistogramImageMetric
+// (or CompactGCHSelector) which compare the compact histograms directly.
+type CompactHistStorage struct {
+	Histograms []*CompactHistogram
+	K          uint
+}
+
+// NewCompactHistStorage returns a new storage storing histograms with k
+// sub-divisons. Capacity is the capacity of the underlying histogram array,
+// negative values yield to a default capacity.
+func NewCompactHistStorage(k uint, capacity int) *CompactHistStorage {
+	if capacity < 0 {
+		capacity = 100
+	}
+	return &CompactHistStorage{
+		Histograms: make([]*CompactHistogram, 0, capacity),
+		K:          k,
+	}
+}
+
+// GetCompactHistogram returns the compact histogram on position id.
+// If id is not a valid position inside the the list an error is returned.
+func (s *CompactHistStorage) GetCompactHistogram(id ImageID) (*CompactHistogram, error) {
+	if int(id) < 0 || int(id) >= len(s.Histograms) {
+		return nil, fmt.Errorf("Histogram for id %d not registered: %w", id, ErrImageNotFound)
+	}
+	return s.Histograms[id], nil
+}
+
+// GetHistogram implements the HistogramStorage interface function by
+// converting the histogram on position id.
+func (s *CompactHistStorage) GetHistogram(id ImageID) (*Histogram, error) {
+	c, err := s.GetCompactHistogram(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.Histogram(), nil
+}
+
+// Retain keeps only the histograms for the given ids (in the given order),
+// see MemoryHistStorage.Retain.
+func (s *CompactHistStorage) Retain(ids []ImageID) {
+	histograms := make([]*CompactHistogram, len(ids))
+	for i, id := range ids {
+		histograms[i] = s.Histograms[id]
+	}
+	s.Histograms = histograms
+}
+
+// Divisions returns the number of sub-divisions k.
+func (s *CompactHistStorage) Divisions() uint {
+	return s.K
+}
+
+// Len returns the number of histograms in the storage.
+func (s *CompactHistStorage) Len() int {
+	return len(s.Histograms)
+}
+
+// Append converts the histograms to compact histograms and adds them at the
+// end of the storage. nil histograms (of skipped images) stay nil.
+func (s *CompactHistStorage) Append(histograms ...*Histogram) {
+	for _, h := range histograms {
+		if h == nil {
+			s.Histograms = append(s.Histograms, nil)
+			continue
+		}
+		s.Histograms = append(s.Histograms, NewCompactHistogram(h))
+	}
+}
+
+// Copy returns a copy of the storage, the histograms are not copied (they're
+// never changed).
+func (s *CompactHistStorage) Copy() HistogramList {
+	return &CompactHistStorage{
+		Histograms: append([]*CompactHistogram(nil), s.Histograms...),
+		K:          s.K,
+	}
+}
+
+// CompactHistStorageFromFSMapper works as MemHistStorageFromFSMapper but
+// creates a compact storage. Entries in the controller that are not compact
+// are converted.
+func CompactHistStorageFromFSMapper(mapper *FSMapper, fileContent *HistogramFSController) (*CompactHistStorage, error) {
+	histMap := make(map[string]*CompactHistogram, len(fileContent.Entries))
+	for _, entry := range fileContent.Entries {
+		if entry.Compact != nil {
+			histMap[entry.Path] = entry.Compact
+		} else if histogram := entry.GetHistogram(); histogram != nil {
+			histMap[entry.Path] = NewCompactHistogram(histogram)
+		}
+	}
+	res := NewCompactHistStorage(fileContent.K, mapper.Len())
+	for _, imagePath := range mapper.IDMapping {
+		histogram, has := histMap[imagePath]
+		if !has {
+			return nil, fmt.Errorf("No histogram for image \"%s\" found", imagePath)
+		}
+		k := histogram.K
+		if k != fileContent.K {
+			return nil, ErrHistogramMismatch{Path: imagePath, WantK: fileContent.K, GotK: histogram.K}
+		}
+		if (k * k * k) != uint(len(histogram.Entries)) {
+			return nil,
+				fmt.Errorf("Invalid histogram for image \"%s\": Not the correct number of entries in histogram",
+					imagePath)
+		}
+		res.Histograms = append(res.Histograms, histogram)
+	}
+	return res, nil
+}
+
+// CompactVectorMetric is a VectorMetric where the second vector has float32
+// entries. This way tiles (float64) can be compared with compact database
+// histograms without converting them.
+type CompactVectorMetric func(p []float64, q []float32) float64
+
+// CompactFromVectorMetric converts a vector metric to a compact metric, q is
+// converted before calling the metric. This is much slower than the metrics
+// implemented for compact histograms directly (like ManhattanCompact).
+func CompactFromVectorMetric(metric VectorMetric) CompactVectorMetric {
+	return func(p []float64, q []float32) float64 {
+		converted := make([]float64, len(q))
+		for i, e := range q {
+			converted[i] = float64(e)
+		}
+		return metric(p, converted)
+	}
+}
+
+// ManhattanCompact is the compact version of Manhattan.
+func ManhattanCompact(p []float64, q []float32) float64 {
+	var result float64
+	for i, e1 := range p {
+		result += math.Abs(e1 - float64(q[i]))
+	}
+	return result
+}
+
+// EuclideanDistanceCompact is the compact version of EuclideanDistance.
+func EuclideanDistanceCompact(p []float64, q []float32) float64 {
+	var sum float64
+	for i, e1 := range p {
+		diff := e1 - float64(q[i])
+		sum += (diff * diff)
+	}
+	return math.Sqrt(sum)
+}
+
+// MinDistanceCompact is the compact version of MinDistance.
+func MinDistanceCompact(p []float64, q []float32) float64 {
+	var sum float64
+	for i, e1 := range p {
+		sum += math.Min(e1, float64(q[i]))
+	}
+	return 1.0 - sum
+}
+
+// CosineSimilarityCompact is the compact version of CosineSimilarity.
+func CosineSimilarityCompact(p []float64, q []float32) float64 {
+	var dotProduct, lengthP, lengthQ float64
+	for i, e1 := range p {
+		e2 := float64(q[i])
+		dotProduct += (e1 * e2)
+		lengthP += (e1 * e1)
+		lengthQ += (e2 * e2)
+	}
+	if lengthP == 0.0 || lengthQ == 0.0 {
+		return 2.1
+	}
+	return 1.0 - (dotProduct / (math.Sqrt(lengthP) * math.Sqrt(lengthQ)))
+}
+
+// The following variables are used for registering named compact metrics,
+// the names are the same as for the histogram metrics.
+
+var (
+	compactVectorMetrics map[string]CompactVectorMetric
+)
+
+// RegisterCompactVectorMetric is used to register the compact version of a
+// named histogram metric (see RegisterHistogramMetric). It will only add the
+// metric if the name does not exist yet. The result is true if the metric was
+// successfully registered and false otherwise.
+//
+// All metrics should be registered by an init method.
+func RegisterCompactVectorMetric(name string, metric CompactVectorMetric) bool {
+	name = strings.ToLower(name)
+	if _, has := compactVectorMetrics[name]; has {
+		return false
+	}
+	compactVectorMetrics[name] = metric
+	return true
+}
+
+// GetCompactVectorMetric returns a registered compact metric.
+// Returns the metric and true on success and nil and false
+// otherwise.
+func GetCompactVectorMetric(name string) (CompactVectorMetric, bool) {
+	name = strings.ToLower(name)
+	if metric, has := compactVectorMetrics[name]; has {
+		return metric, true
+	}
+	return nil, false
+}
+
+func init() {
+	compactVectorMetrics = make(map[string]CompactVectorMetric)
+	RegisterCompactVectorMetric("manhattan", ManhattanCompact)
+	RegisterCompactVectorMetric("euclid", EuclideanDistanceCompact)
+	RegisterCompactVectorMetric("min", MinDistanceCompact)
+	RegisterCompactVectorMetric("cosine", CosineSimilarityCompact)
+	RegisterCompactVectorMetric("chessboard", CompactFromVectorMetric(ChessboardDistance))
+	RegisterCompactVectorMetric("canberra", CompactFromVectorMetric(CanberraDistance))
+}
+
+// CompactHistogramImageMetric implements ImageMetric and BatchImageMetric for
+// compact histograms, it's the compact version of HistogramImageMetric.
+type CompactHistogramImageMetric struct {
+	HistStorage *CompactHistStorage
+	Metric      CompactVectorMetric
+	TileData    [][]*Histogram
+	NumRoutines int
+}
+
+// NewCompactHistogramImageMetric returns a new compact histogram image metric.
+// NumRoutines is the number of things that run concurrently when initializing
+// the tile histograms.
+func NewCompactHistogramImageMetric(storage *CompactHistStorage, metric CompactVectorMetric, numRoutines int) *CompactHistogramImageMetric {
+	return &CompactHistogramImageMetric{
+		HistStorage: storage,
+		Metric:      metric,
+		NumRoutines: numRoutines,
+	}
+}
+
+// InitStorage does at the moment nothing.
+func (m *CompactHistogramImageMetric) InitStorage(storage ImageStorage) error {
+	return nil
+}
+
+// InitTiles concurrently computes the histograms of the tiles of the query
+// image, the tile histograms are not compact.
+func (m *CompactHistogramImageMetric) InitTiles(storage ImageStorage, query image.Image, dist TileDivision) error {
+	init := func(tiles Tiles) error {
+		m.TileData = make([][]*Histogram, len(tiles))
+		for i, col := range tiles {
+			m.TileData[i] = make([]*Histogram, len(col))
+		}
+		return nil
+	}
+	onTile := func(i, j int, tileImage image.Image) error {
+		m.TileData[i][j] = GenHistogram(tileImage, m.HistStorage.K, true)
+		return nil
+	}
+	return InitTilesHelper(storage, query, dist, m.NumRoutines, init, onTile)
+}
+
+// Compare compares a database image and a query image based on the metric.
+func (m *CompactHistogramImageMetric) Compare(storage ImageStorage, image ImageID, tileY, tileX int) (float64, error) {
+	hDatabase, dbErr := m.HistStorage.GetCompactHistogram(image)
+	if dbErr != nil {
+		return -1.0, dbErr
+	}
+	return m.Metric(m.TileData[tileY][tileX].Entries, hDatabase.Entries), nil
+}
+
+// CompareAll compares the tile with all database images.
+func (m *CompactHistogramImageMetric) CompareAll(storage ImageStorage, tileY, tileX int) ([]float64, error) {
+	numImages := int(storage.NumImages())
+	res := make([]float64, numImages)
+	tile := m.TileData[tileY][tileX].Entries
+	for id := 0; id < numImages; id++ {
+		if id >= len(m.HistStorage.Histograms) {
+			res[id] = math.Inf(1)
+			continue
+		}
+		res[id] = m.Metric(tile, m.HistStorage.Histograms[id].Entries)
+	}
+	return res, nil
+}
+
+// CompactGCHSelector is the compact version of GCHSelector.
+func CompactGCHSelector(histStorage *CompactHistStorage, metric CompactVectorMetric, numRoutines int) *ImageMetricMinimizer {
+	imageMetric := NewCompactHistogramImageMetric(histStorage, metric, numRoutines)
+	return NewImageMetricMinimizer(imageMetric, numRoutines)
+}
@@ -0,0 +1,471 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// This file contains the completion functions for the default commands.
+
+// CommandCompleteFunc computes the completions for the arguments of a
+// command. args are the arguments typed so far (without the command name),
+// the last argument is the one that is completed (it might be the empty
+// string). The result contains the candidates that replace the last argument.
+type CommandCompleteFunc func(state *ExecutorState, args []string) []string
+
+// CompletePrefix returns all elements from candidates that start with prefix.
+func CompletePrefix(prefix string, candidates ...string) []string {
+	res := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			res = append(res, candidate)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// CompleteFiles works as CompletePath but only returns directories and files
+// with one of the given extensions (like ".json"). If no extension is given
+// all files are returned.
+func CompleteFiles(state *ExecutorState, prefix string, exts ...string) []string {
+	candidates := CompletePath(state, prefix)
+	if len(exts) == 0 {
+		return candidates
+	}
+	res := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		if strings.HasSuffix(candidate, string(filepath.Separator)) {
+			res = append(res, candidate)
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(candidate))
+		for _, allowed := range exts {
+			if ext == allowed {
+				res = append(res, candidate)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// CompleteDirs works as CompletePath but only returns directories.
+func CompleteDirs(state *ExecutorState, prefix string) []string {
+	candidates := CompletePath(state, prefix)
+	res := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		if strings.HasSuffix(candidate, string(filepath.Separator)) {
+			res = append(res, candidate)
+		}
+	}
+	return res
+}
+
+// imageExts are the extensions of images supported as output images, query
+// images can also be GIFs (queryExts).
+var (
+	imageExts = []string{".jpg", ".jpeg", ".png"}
+	queryExts = []string{".jpg", ".jpeg", ".png", ".gif"}
+)
+
+// metricCompletions returns all selection strings for the mosaic command, that
+// is the metric names with prefix gch- and lch- and the registered selectors.
+func metricCompletions() []string {
+	names := GetHistogramMetricNames()
+	res := make([]string, 0, 4*len(names)+4)
+	res = append(res, "gch", "lch", "feature", "gray")
+	for _, name := range names {
+		res = append(res, "gch-"+name, "lch-"+name, "feature-"+name, "gray-"+name)
+	}
+	return append(res, GetSelectorNames()...)
+}
+
+// CompleteCd completes the argument of the cd command.
+func CompleteCd(state *ExecutorState, args []string) []string {
+	if len(args) != 1 {
+		return nil
+	}
+	return CompleteDirs(state, args[0])
+}
+
+// CompleteStats completes the argument of the stats command.
+func CompleteStats(state *ExecutorState, args []string) []string {
+	if len(args) != 1 {
+		return nil
+	}
+	vars := state.variables()
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	return CompletePrefix(args[0], names...)
+}
+
+// CompleteSet completes the variable name and the value (for variables with
+// a fixed set of values) of the set command.
+func CompleteSet(state *ExecutorState, args []string) []string {
+	switch len(args) {
+	case 1:
+		return CompleteStats(state, args)
+	case 2:
+		value := args[1]
+		switch args[0] {
+		case "verbose", "cut", "exif", "grayscale":
+			return CompletePrefix(value, "true", "false")
+		case "variety":
+			return CompletePrefix(value, CmdVarietyNames()...)
+		case "png-compression":
+			return CompletePrefix(value, "default", "none", "speed", "best")
+		case "layout":
+			return CompletePrefix(value, append([]string{"grid", "brick", "quadtree", "jitter"},
+				GetDividerNames()...)...)
+		case "orientations":
+			return CompletePrefix(value, "none", "rotate", "mirror", "all")
+		case "search":
+			return CompletePrefix(value, "exact", "ann")
+		case "preprocess":
+			return CompletePrefix(value, "none", "exif", "autocontrast", "exif,autocontrast")
+		case "resize":
+			return CompletePrefix(value, GetResizeStrategyNames()...)
+		case "seed":
+			return CompletePrefix(value, "random")
+		case "required-images":
+			return append(CompletePrefix(value, "none"), CompleteFiles(state, value, imageExts...)...)
+		case "pyramid-dir":
+			return append(CompletePrefix(value, "default"), CompleteDirs(state, value)...)
+		}
+	}
+	return nil
+}
+
+// CompleteStorage completes the arguments of the storage command.
+func CompleteStorage(state *ExecutorState, args []string) []string {
+	if last := args[len(args)-1]; strings.HasPrefix(last, "--") {
+		return completeFlag(last, "include", "exclude", "follow-symlinks", "depth", "manifest", "cache", "region")
+	}
+	switch {
+	case len(args) == 1:
+		return CompletePrefix(args[0], "list", "load", "add", "remove", "dedupe", "watch", "tags", "weight", "filter")
+	case len(args) == 2 && args[0] == "dedupe":
+		return CompletePrefix(args[1], "exact", "perceptual")
+	case len(args) == 2 && (args[0] == "load" || args[0] == "watch"):
+		return CompleteDirs(state, args[1])
+	case args[0] == "load" && (len(args) == 3 || (len(args) == 4 && args[2] != "as")):
+		return CompletePrefix(args[len(args)-1], "as")
+	case len(args) == 2 && (args[0] == "add" || args[0] == "remove"):
+		return CompleteFiles(state, args[1], imageExts...)
+	case len(args) == 2 && (args[0] == "tags" || args[0] == "weight"):
+		return CompleteFiles(state, args[1], ".csv", ".json")
+	case len(args) == 2 && args[0] == "filter":
+		return CompletePrefix(args[1], "none", "tag=", "tag!=", "label=", "label!=")
+	case len(args) > 2 && args[0] == "filter":
+		return CompletePrefix(args[len(args)-1], "tag=", "tag!=", "label=", "label!=")
+	default:
+		return nil
+	}
+}
+
+// CompleteHistograms completes the arguments of the gch and lch commands:
+// load and save are completed with .gob, .json and (compressed) .gz files.
+func CompleteHistograms(state *ExecutorState, args []string) []string {
+	switch {
+	case len(args) == 1:
+		return CompletePrefix(args[0], "create", "load", "save", "update")
+	case len(args) == 2 && (args[0] == "load" || args[0] == "save" || args[0] == "update"):
+		return CompleteFiles(state, args[1], ".gob", ".json", ".gz")
+	default:
+		return nil
+	}
+}
+
+// CompleteGCH completes the arguments of the gch command, see
+// CompleteHistograms. show is completed with images and the output file.
+func CompleteGCH(state *ExecutorState, args []string) []string {
+	switch {
+	case len(args) == 1:
+		return CompletePrefix(args[0], "create", "load", "save", "update", "show")
+	case args[0] == "show" && (len(args) == 2 || len(args) == 4):
+		return CompleteFiles(state, args[len(args)-1], queryExts...)
+	case args[0] == "show" && len(args) == 3:
+		return CompleteFiles(state, args[2], ".png", ".jpg", ".svg")
+	default:
+		return CompleteHistograms(state, args)
+	}
+}
+
+// CompleteCheck completes the arguments of the check command.
+func CompleteCheck(state *ExecutorState, args []string) []string {
+	if len(args) == 1 {
+		return CompleteFiles(state, args[0], queryExts...)
+	}
+	return nil
+}
+
+// CompleteThumbnail completes the arguments of the thumbnail command.
+func CompleteThumbnail(state *ExecutorState, args []string) []string {
+	switch len(args) {
+	case 1:
+		return CompleteFiles(state, args[0], queryExts...)
+	case 2:
+		return CompleteFiles(state, args[1], ".jpg", ".png")
+	default:
+		return nil
+	}
+}
+
+// CompleteBench completes the arguments of the bench command.
+func CompleteBench(state *ExecutorState, args []string) []string {
+	last := args[len(args)-1]
+	if strings.HasPrefix(last, "--") {
+		return completeFlag(last, "feature", "varieties", "out")
+	}
+	if len(args) > 1 {
+		switch args[len(args)-2] {
+		case "--feature":
+			return CompletePrefix(last, "gch", "lch")
+		case "--varieties":
+			return CompletePrefix(last, "true", "false")
+		case "--out":
+			return CompleteDirs(state, last)
+		}
+	}
+	if len(args) == 1 {
+		return CompleteFiles(state, last, queryExts...)
+	}
+	return nil
+}
+
+// CompleteBundle completes the arguments of the bundle command.
+func CompleteBundle(state *ExecutorState, args []string) []string {
+	switch len(args) {
+	case 1:
+		return CompletePrefix(args[0], "load", "save")
+	case 2:
+		return CompleteFiles(state, args[1], ".gob", ".json", ".gz")
+	default:
+		return nil
+	}
+}
+
+// CompleteFeature completes the arguments of the feature command.
+func CompleteFeature(state *ExecutorState, args []string) []string {
+	switch {
+	case len(args) == 1:
+		return CompletePrefix(args[0], "create", "list", "load", "save")
+	case len(args) == 2 && args[0] == "create":
+		return CompletePrefix(args[1], GetFeatureExtractorNames()...)
+	case len(args) == 2 && (args[0] == "load" || args[0] == "save"):
+		return CompleteFiles(state, args[1], ".gob", ".json", ".gz")
+	default:
+		return nil
+	}
+}
+
+// CompleteGray completes the arguments of the gray command.
+func CompleteGray(state *ExecutorState, args []string) []string {
+	switch {
+	case len(args) == 1:
+		return CompletePrefix(args[0], "create", "load", "save")
+	case len(args) == 2 && (args[0] == "load" || args[0] == "save"):
+		return CompleteFiles(state, args[1], ".gob", ".json", ".gz")
+	default:
+		return nil
+	}
+}
+
+// CompleteAlias completes the names of the aliases.
+func CompleteAlias(state *ExecutorState, args []string) []string {
+	if len(args) != 1 {
+		return nil
+	}
+	names := make([]string, 0, len(state.Aliases))
+	for name := range state.Aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return CompletePrefix(args[0], names...)
+}
+
+// CompleteSession completes the arguments of the session command.
+func CompleteSession(state *ExecutorState, args []string) []string {
+	switch len(args) {
+	case 1:
+		return CompletePrefix(args[0], "load", "save")
+	case 2:
+		return CompleteFiles(state, args[1], ".json")
+	default:
+		return nil
+	}
+}
+
+// completeFlag completes flags of the form "--name".
+func completeFlag(arg string, flags ...string) []string {
+	candidates := make([]string, len(flags))
+	for i, flag := range flags {
+		candidates[i] = "--" + flag
+	}
+	return CompletePrefix(arg, candidates...)
+}
+
+// CompleteMosaic completes the arguments of the mosaic command, including the
+// plan subcommand.
+func CompleteMosaic(state *ExecutorState, args []string) []string {
+	last := args[len(args)-1]
+	if strings.HasPrefix(last, "--") {
+		return completeFlag(last, "overlay", "recurse", "mask", "mask-metric", "shape", "report", "heatmap", "only", "preview")
+	}
+	if len(args) > 1 {
+		switch args[len(args)-2] {
+		case "--mask", "--shape":
+			return CompleteFiles(state, last, queryExts...)
+		case "--mask-metric":
+			return CompletePrefix(last, metricCompletions()...)
+		case "--report":
+			return CompleteFiles(state, last, ".html")
+		case "--heatmap":
+			return CompleteFiles(state, last, imageExts...)
+		case "--only":
+			// complete the last label of the list
+			prefix := last[:strings.LastIndex(last, ",")+1]
+			res := CompletePrefix(strings.TrimPrefix(last, prefix), state.Mapper.Labels()...)
+			for i, label := range res {
+				res[i] = prefix + label
+			}
+			return res
+		}
+	}
+	if args[0] == "info" {
+		if len(args) == 2 {
+			return CompleteFiles(state, last, imageExts...)
+		}
+		return nil
+	}
+	if args[0] == "plan" {
+		switch {
+		case len(args) == 2:
+			return CompletePrefix(last, "save", "render")
+		case len(args) == 3:
+			return CompleteFiles(state, last, ".json")
+		case len(args) == 4 && args[1] == "render":
+			return CompleteFiles(state, last, imageExts...)
+		default:
+			return nil
+		}
+	}
+	switch len(args) {
+	case 1:
+		return append(CompletePrefix(last, "plan", "info"), CompleteFiles(state, last, queryExts...)...)
+	case 2:
+		return CompleteFiles(state, last, imageExts...)
+	case 3:
+		return CompletePrefix(last, metricCompletions()...)
+	default:
+		return nil
+	}
+}
+
+// CompleteMosaicGIF completes the arguments of the mosaicgif command.
+func CompleteMosaicGIF(state *ExecutorState, args []string) []string {
+	last := args[len(args)-1]
+	if strings.HasPrefix(last, "--") {
+		return completeFlag(last, "delay", "overlay")
+	}
+	switch len(args) {
+	case 1, 2:
+		return CompleteFiles(state, last, ".gif")
+	case 3:
+		return CompletePrefix(last, metricCompletions()...)
+	default:
+		return nil
+	}
+}
+
+// CompleteSelfMosaic completes the arguments of the selfmosaic command.
+func CompleteSelfMosaic(state *ExecutorState, args []string) []string {
+	last := args[len(args)-1]
+	if strings.HasPrefix(last, "--") {
+		return completeFlag(last, "patch", "step", "sources")
+	}
+	if len(args) > 1 && args[len(args)-2] == "--sources" {
+		return CompleteFiles(state, last, queryExts...)
+	}
+	switch len(args) {
+	case 1:
+		return CompleteFiles(state, last, queryExts...)
+	case 2:
+		return CompleteFiles(state, last, imageExts...)
+	case 3:
+		names := GetHistogramMetricNames()
+		metrics := make([]string, len(names))
+		for i, name := range names {
+			metrics[i] = "gch-" + name
+		}
+		return CompletePrefix(last, metrics...)
+	default:
+		return nil
+	}
+}
+
+// CompleteCollage completes the arguments of the collage command.
+func CompleteCollage(state *ExecutorState, args []string) []string {
+	last := args[len(args)-1]
+	if strings.HasPrefix(last, "--") {
+		return completeFlag(last, "size", "rotation", "coverage", "images", "border")
+	}
+	switch len(args) {
+	case 1:
+		return CompleteFiles(state, last, queryExts...)
+	case 2:
+		return CompleteFiles(state, last, imageExts...)
+	case 3:
+		names := GetHistogramMetricNames()
+		metrics := make([]string, len(names))
+		for i, name := range names {
+			metrics[i] = "gch-" + name
+		}
+		return CompletePrefix(last, metrics...)
+	default:
+		return nil
+	}
+}
+
+// CompleteRetile completes the arguments of the retile command.
+func CompleteRetile(state *ExecutorState, args []string) []string {
+	if len(args) != 3 {
+		return nil
+	}
+	last := args[len(args)-1]
+	return append(CompletePrefix(last, "exclude"), CompleteFiles(state, last, imageExts...)...)
+}
+
+// CompleteBatch completes the arguments of the batch command.
+func CompleteBatch(state *ExecutorState, args []string) []string {
+	last := args[len(args)-1]
+	if strings.HasPrefix(last, "--") {
+		return completeFlag(last, "workers", "overlay")
+	}
+	switch len(args) {
+	case 1, 2:
+		return CompleteDirs(state, last)
+	case 3:
+		return CompletePrefix(last, metricCompletions()...)
+	default:
+		return nil
+	}
+}
@@ -18,9 +18,14 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"sort"
+	"strings"
 	"sync"
-
-	log "github.com/sirupsen/logrus"
+	"sync/atomic"
 )
 
 var (
@@ -51,7 +56,82 @@ func ForceResize(resizer ImageResizer, tileWidth, tileHeight uint, img image.Ima
 	return resizer.Resize(tileWidth, tileHeight, img)
 }
 
-// TODO implement smarter strategies?
+// TileTransform is a function that is applied to a (scaled) database image
+// before it is inserted into the mosaic at tile position (tileY, tileX).
+// It must not change the image passed to it (the image might be cached) but
+// return a new image instead.
+type TileTransform func(tileY, tileX int, img image.Image) image.Image
+
+// clampColor converts a float value to a color component between 0 and 255.
+func clampColor(val float64) uint8 {
+	switch {
+	case val <= 0.0:
+		return 0
+	case val >= 255.0:
+		return 255
+	default:
+		return uint8(val + 0.5)
+	}
+}
+
+// ColorizeTransform returns a TileTransform that tints each tile towards the
+// average color of the query tile. targets contains the average color for
+// each tile (for example computed by ComputeTileAverages). strength must be
+// a value between 0 and 1 and describes how strong the colors get shifted:
+// 0 means no change at all and 1 means that the average color of the database
+// image becomes the average color of the query tile.
+//
+// The structure of the image (the difference between the colors) remains
+// unchanged, only the color is shifted. This way the mosaic looks much more
+// like the query image from afar.
+func ColorizeTransform(targets [][]AverageColor, strength float64) TileTransform {
+	strength = math.Max(0.0, math.Min(1.0, strength))
+	return func(tileY, tileX int, img image.Image) image.Image {
+		if strength == 0.0 || tileY >= len(targets) || tileX >= len(targets[tileY]) {
+			return img
+		}
+		target := targets[tileY][tileX]
+		current := ComputeAverageColor(img)
+		dr := strength * (float64(target.R) - float64(current.R))
+		dg := strength * (float64(target.G) - float64(current.G))
+		db := strength * (float64(target.B) - float64(current.B))
+		return shiftColors(img, dr, dg, db)
+	}
+}
+
+// shiftColors returns a new image in which dr, dg and db are added to the
+// color components of each pixel.
+func shiftColors(img image.Image, dr, dg, db float64) image.Image {
+	bounds := img.Bounds()
+	res := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			rgba := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			res.SetRGBA(x, y, color.RGBA{
+				R: clampColor(float64(rgba.R) + dr),
+				G: clampColor(float64(rgba.G) + dg),
+				B: clampColor(float64(rgba.B) + db),
+				A: rgba.A,
+			})
+		}
+	}
+	return res
+}
+
+// TileBorder describes a border that is drawn around each tile of a mosaic.
+// Width is the width of the border on each side of a tile (so the gap between
+// two tiles is 2 * Width), a value ≤ 0 disables the border. Color is the color
+// of the gap, if it is nil black is used.
+type TileBorder struct {
+	Width int
+	Color color.Color
+}
+
+// NoTileBorder is a TileBorder that doesn't draw any border.
+var NoTileBorder = TileBorder{}
+
+// Strategies that keep the ratio of the database images are implemented in
+// crop.go.
 
 // TODO some smarter cache strategies?
 
@@ -122,6 +202,14 @@ func (cache *ImageCache) Put(id ImageID, width, height int, img image.Image) {
 	}
 }
 
+// contains returns true if the image is in the cache, in contrast to Get
+// this is not counted as cache hit or miss.
+func (cache *ImageCache) contains(id ImageID, width, height int) bool {
+	cache.m.Lock()
+	defer cache.m.Unlock()
+	return cache.lookup(cache.keyFormat(id, width, height)) != nil
+}
+
 // Get returns the image from the cache. If the return value is nil the image
 // was not found in the cache and should be added to the cache by Put.
 func (cache *ImageCache) Get(id ImageID, width, height int) image.Image {
@@ -129,12 +217,18 @@ func (cache *ImageCache) Get(id ImageID, width, height int) image.Image {
 	defer cache.m.Unlock()
 	// check if item is in cache
 	keyFmt := cache.keyFormat(id, width, height)
-	return cache.lookup(keyFmt)
+	img := cache.lookup(keyFmt)
+	if img == nil {
+		countEvent(CounterCacheMisses, 1)
+	} else {
+		countEvent(CounterCacheHits, 1)
+	}
+	return img
 }
 
 func insertTile(into *image.RGBA, area image.Rectangle, storage ImageStorage,
 	dbImage ImageID, resizer ImageResizer, s ResizeStrategy,
-	cache *ImageCache) error {
+	cache *ImageCache, transform TileTransform, tileY, tileX int) error {
 	// so sorry for the signature
 	// read image
 	tileWidth := area.Dx()
@@ -147,8 +241,9 @@ func insertTile(into *image.RGBA, area image.Rectangle, storage ImageStorage,
 	img = cache.Get(dbImage, tileWidth, tileHeight)
 	if img == nil {
 		var imgErr error
-		// use storage to read image and then resize it
-		img, imgErr = storage.LoadImage(dbImage)
+		// use storage to read image and then resize it, if the storage
+		// supports it a smaller version of the image is loaded
+		img, imgErr = LoadImageSized(storage, dbImage, uint(tileWidth), uint(tileHeight))
 		if imgErr != nil {
 			return imgErr
 		}
@@ -157,6 +252,12 @@ func insertTile(into *image.RGBA, area image.Rectangle, storage ImageStorage,
 		// add to cache
 		cache.Put(dbImage, tileWidth, tileHeight, img)
 	}
+	// the transformation is applied after the cache lookup: the same database
+	// image may be transformed differently in each tile
+	if transform != nil {
+		img = transform(tileY, tileX, img)
+	}
+	countEvent(CounterTilesComposed, 1)
 	scaledBounds := img.Bounds()
 	for y := 0; y < tileHeight; y++ {
 		for x := 0; x < tileWidth; x++ {
@@ -169,92 +270,368 @@ func insertTile(into *image.RGBA, area image.Rectangle, storage ImageStorage,
 	return nil
 }
 
+// ComposeErrorPolicy describes how ComposeMosaicWithPolicy handles tiles that
+// can't be composed, for example because the database image can't be loaded.
+type ComposeErrorPolicy int
+
+const (
+	// ComposeFailFast stops the composition with the first error.
+	ComposeFailFast ComposeErrorPolicy = iota
+	// ComposeBestEffort composes all other tiles, failed tiles are left empty
+	// and reported in the ComposeReport.
+	ComposeBestEffort
+)
+
+func (policy ComposeErrorPolicy) String() string {
+	switch policy {
+	case ComposeFailFast:
+		return "fail-fast"
+	case ComposeBestEffort:
+		return "best-effort"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseComposeErrorPolicy parses a policy, valid values are "fail-fast" and
+// "best-effort".
+func ParseComposeErrorPolicy(s string) (ComposeErrorPolicy, error) {
+	switch strings.ToLower(s) {
+	case "fail-fast":
+		return ComposeFailFast, nil
+	case "best-effort":
+		return ComposeBestEffort, nil
+	default:
+		return -1, fmt.Errorf("Unkown compose error policy: %s", s)
+	}
+}
+
+// TileError is the error for a tile that can't be composed. Divisions are
+// stored row wise, thus the tile is division[Row][Column]. The error message
+// describes the tile as (x, y), that is (Column, Row), as the retile command.
+type TileError struct {
+	Row, Column int
+	Image       ImageID
+	Err         error
+}
+
+func (err TileError) Error() string {
+	return fmt.Sprintf("Can't compose tile (%d, %d) with image %d: %s",
+		err.Column, err.Row, err.Image, err.Err.Error())
+}
+
+// Unwrap returns the wrapped error.
+func (err TileError) Unwrap() error {
+	return err.Err
+}
+
+// ComposeReport describes the result of a composition.
+type ComposeReport struct {
+	// NumTiles is the number of tiles in the mosaic.
+	NumTiles int
+	// NumComposed is the number of tiles an image was inserted into.
+	NumComposed int
+	// NumEmpty is the number of tiles with NoImageID.
+	NumEmpty int
+	// Errors contains the tiles that failed, sorted by row and column. With
+	// ComposeFailFast it contains at most one element.
+	Errors []TileError
+}
+
+// Err returns nil if no tile failed and an error describing the number of
+// failed tiles and the first error otherwise.
+func (report *ComposeReport) Err() error {
+	switch len(report.Errors) {
+	case 0:
+		return nil
+	case 1:
+		return report.Errors[0]
+	default:
+		return fmt.Errorf("Failed to compose %d of %d tiles, first error: %w",
+			len(report.Errors), report.NumTiles, report.Errors[0])
+	}
+}
+
 // ComposeMosaic concurrently composes a mosaic image given the distribution
 // in tiles and the selected images for each tile.
 // Images are loaded by the storage. The resizer and the resize strategy
 // are used to resize database images to fit in tiles. The mosaic division must
 // start from (0, 0) and the rectangles are not allowed to overlap, in short
 // it has be what we intuively would call a distribution into tiles.
+// The tiles are not required to be of the same size and the rows may contain
+// a different number of tiles.
+//
+// The mosaic is split into numRoutines horizontal bands, each band is
+// composed by one goroutine. This way no two goroutines write to the same part
+// of the mosaic.
+//
+// Tiles with NoImageID are left empty (transparent), see SkipSelector.
+//
+// transform is applied to each scaled database image before it is inserted,
+// it may be nil in which case the images are inserted as they are.
+// border describes the gap drawn around each tile, use NoTileBorder for a
+// mosaic without gaps.
+//
+// Scaled database images are cached in cache to speed up the generation
+// process. The cache can be shared between the composition of multiple mosaics
+// (also concurrently), for example when creating mosaics for the frames of an
+// animation. The more elements in the cache the faster the composition process
+// is, but it also increases memory consumption. If cache is nil a new cache of
+// size ImageCacheSize is used.
 //
-// Scaled database images are cached to speed up the generation process.
-// The cache size parameter is the size of the cache used. The more elements in
-// the cache the faster the composition process is, but it also increases
-// memory consumption. If cache size is ≤ 0 the DefaultCacheSize is used.
+// The composition stops with the first tile that can't be composed, see
+// ComposeMosaicWithPolicy for other policies.
 func ComposeMosaic(storage ImageStorage, symbolicTiles [][]ImageID,
 	mosaicDivison TileDivision, resizer ImageResizer, s ResizeStrategy,
-	numRoutines, cacheSize int, progress ProgressFunc) (image.Image, error) {
+	transform TileTransform, border TileBorder, numRoutines int, cache *ImageCache,
+	progress ProgressFunc) (image.Image, error) {
+	mosaic, _, err := ComposeMosaicWithPolicy(storage, symbolicTiles, mosaicDivison,
+		resizer, s, transform, border, numRoutines, cache, progress, ComposeFailFast, nil)
+	return mosaic, err
+}
+
+// ComposeMosaicTo composes the mosaic (see ComposeMosaic) and encodes it to w
+// in the given format, see EncodeMosaic. This way mosaics can be streamed (for
+// example to an HTTP response or a pipe) without writing an intermediate
+// file. Nothing is written to w if the composition fails.
+func ComposeMosaicTo(w io.Writer, format string, storage ImageStorage, symbolicTiles [][]ImageID,
+	mosaicDivison TileDivision, resizer ImageResizer, s ResizeStrategy,
+	transform TileTransform, border TileBorder, numRoutines int, cache *ImageCache,
+	progress ProgressFunc, options EncodeOptions) error {
+	if _, formatErr := ParseMosaicFormat(format); formatErr != nil {
+		return formatErr
+	}
+	mosaic, composeErr := ComposeMosaic(storage, symbolicTiles, mosaicDivison, resizer, s,
+		transform, border, numRoutines, cache, progress)
+	if composeErr != nil {
+		return composeErr
+	}
+	return EncodeMosaic(w, format, mosaic, options)
+}
+
+// ComposeMosaicWithPolicy works as ComposeMosaic, policy describes how tiles
+// that can't be composed are handled. The report is returned in all cases.
+// With ComposeFailFast the remaining tiles are skipped after the first error
+// and the error is returned (the mosaic is nil). With ComposeBestEffort all
+// other tiles are composed, the failed tiles are left empty and the error is
+// nil: The failed tiles must be checked in the report.
+//
+// prefetcher loads the database images of upcoming tiles into the cache, it
+// can be nil in which case no images are prefetched.
+func ComposeMosaicWithPolicy(storage ImageStorage, symbolicTiles [][]ImageID,
+	mosaicDivison TileDivision, resizer ImageResizer, s ResizeStrategy,
+	transform TileTransform, border TileBorder, numRoutines int, cache *ImageCache,
+	progress ProgressFunc, policy ComposeErrorPolicy, prefetcher *Prefetcher) (image.Image, *ComposeReport, error) {
+	defer StartTimer(TimerCompose).Stop()
+	if cache == nil {
+		cache = NewImageCache(ImageCacheSize)
+	}
 	if numRoutines <= 0 {
 		numRoutines = 1
 	}
-	if cacheSize <= 0 {
-		cacheSize = ImageCacheSize
-	}
+	report := &ComposeReport{}
 
 	numTilesVert := len(symbolicTiles)
 
 	// first create an empty image
 	res := image.NewRGBA(image.Rectangle{})
 	if numTilesVert == 0 {
-		return res, nil
+		return res, report, nil
 	}
-	lastCol := symbolicTiles[numTilesVert-1]
-	if len(lastCol) == 0 {
-		return res, nil
+	if mosaicDivison.Size() == 0 {
+		return res, report, nil
 	}
-	lastTile := mosaicDivison[numTilesVert-1][len(lastCol)-1]
-	// this should be correct because the rectangles are arranged from (0, 0)
-	// to (width, height)
-	resBounds := image.Rect(0, 0, lastTile.Max.X, lastTile.Max.Y)
+	// the rectangles are arranged from (0, 0) to (width, height), but rows
+	// may have a different number of tiles (for example for a quadtree
+	// division), so we use the union of all tiles
+	divBounds := mosaicDivison.Bounds()
+	resBounds := image.Rect(0, 0, divBounds.Max.X, divBounds.Max.Y)
 	if resBounds.Empty() {
-		return nil, errors.New("Can't compose mosaic: Image would be empty")
+		return nil, report, errors.New("Can't compose mosaic: Image would be empty")
 	}
 	res = image.NewRGBA(resBounds)
-	cache := NewImageCache(cacheSize)
+	// tileAreas are the tiles including the border, the border is drawn
+	// before the image of a tile is inserted. Tiles without an image are left
+	// transparent (including their border)
+	tileAreas := mosaicDivison
+	var borderFill image.Image
+	if border.Width > 0 {
+		// fill the tiles with the border color and shrink them
+		borderColor := border.Color
+		if borderColor == nil {
+			borderColor = color.Black
+		}
+		borderFill = image.NewUniform(borderColor)
+		mosaicDivison = mosaicDivison.Inset(border.Width)
+	}
+
+	// each worker owns a horizontal band of the mosaic, this way the workers
+	// never write to the same rows of the mosaic
+	bands := composeBands(tileAreas, numRoutines)
 
-	type job struct {
-		i, j int
+	// the tiles in the order in which they're (approximately) composed: the
+	// workers run concurrently, so the bands are interleaved
+	prefetchTiles := make([]prefetchTile, 0, mosaicDivison.Size())
+	for k := 0; len(prefetchTiles) < cap(prefetchTiles); k++ {
+		added := false
+		for _, band := range bands {
+			if k >= len(band) {
+				continue
+			}
+			added = true
+			pos := band[k]
+			if area, dbImage := mosaicDivison[pos.i][pos.j], symbolicTiles[pos.i][pos.j]; dbImage != NoImageID && !area.Empty() {
+				prefetchTiles = append(prefetchTiles, prefetchTile{id: dbImage, width: area.Dx(), height: area.Dy()})
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	prefetch := prefetcher.start(storage, resizer, s, cache, prefetchTiles)
+	defer prefetch.stop()
+
+	type result struct {
+		empty, skipped bool
+		err            *TileError
 	}
-	jobs := make(chan job, BufferSize)
-	done := make(chan bool, BufferSize)
+	done := make(chan result, BufferSize)
+	// set to true after the first error with ComposeFailFast, the remaining
+	// tiles are skipped
+	var failed int32
 
-	for w := 0; w < numRoutines; w++ {
-		go func() {
-			for next := range jobs {
-				tilesCol, divisionCol := symbolicTiles[next.i], mosaicDivison[next.i]
-				tileArea, dbImage := divisionCol[next.j], tilesCol[next.j]
-				if dbImage == NoImageID {
-					log.WithFields(log.Fields{
+	for _, band := range bands {
+		go func(band []tilePos) {
+			for _, next := range band {
+				// i is the row and j the column of the tile
+				tilesRow, divisionRow := symbolicTiles[next.i], mosaicDivison[next.i]
+				tileArea, dbImage := divisionRow[next.j], tilesRow[next.j]
+				switch {
+				case dbImage == NoImageID:
+					ComposeLogger.Debug("No image for tile, tile is left empty", LogFields{
 						"area": tileArea,
-					}).Warn("No image found for tile")
-				} else {
-					insertTile(res, tileArea, storage, dbImage, resizer, s, cache)
+					})
+					done <- result{empty: true}
+				case atomic.LoadInt32(&failed) != 0:
+					done <- result{skipped: true}
+				default:
+					if borderFill != nil {
+						draw.Draw(res, tileAreas[next.i][next.j], borderFill, image.ZP, draw.Src)
+					}
+					tileErr := insertTile(res, tileArea, storage, dbImage, resizer, s, cache,
+						transform, next.i, next.j)
+					prefetch.tileDone()
+					if tileErr == nil {
+						done <- result{}
+						break
+					}
+					ComposeLogger.Warn("Can't compose tile", LogFields{
+						"row":    next.i,
+						"column": next.j,
+						"image":  dbImage,
+						"error":  tileErr,
+					})
+					if policy == ComposeFailFast {
+						atomic.StoreInt32(&failed, 1)
+					}
+					done <- result{err: &TileError{Row: next.i, Column: next.j, Image: dbImage, Err: tileErr}}
 				}
-				done <- true
 			}
-		}()
+		}(band)
 	}
 
-	// start jobs
-	go func() {
-		for i, tilesCol := range symbolicTiles {
-			for j := 0; j < len(tilesCol); j++ {
-				jobs <- job{i, j}
-			}
-		}
-		close(jobs)
-	}()
-
-	// wait until done
+	// wait until done, all results are consumed even if the composition
+	// failed
 	numDone := 0
-	for _, tilesCol := range symbolicTiles {
-		for j := 0; j < len(tilesCol); j++ {
-			<-done
+	for _, tilesRow := range symbolicTiles {
+		for j := 0; j < len(tilesRow); j++ {
+			next := <-done
+			report.NumTiles++
+			switch {
+			case next.empty:
+				report.NumEmpty++
+			case next.err != nil:
+				report.Errors = append(report.Errors, *next.err)
+			case !next.skipped:
+				report.NumComposed++
+			}
 			numDone++
 			if progress != nil {
 				progress(numDone)
 			}
 		}
 	}
+	// with fail fast another tile may have failed concurrently
+	sort.Slice(report.Errors, func(i, j int) bool {
+		a, b := report.Errors[i], report.Errors[j]
+		return a.Row < b.Row || (a.Row == b.Row && a.Column < b.Column)
+	})
+	if policy == ComposeFailFast && len(report.Errors) > 0 {
+		report.Errors = report.Errors[:1]
+		return nil, report, report.Err()
+	}
+
+	return res, report, nil
+}
 
-	return res, nil
+// composeBands splits the tiles of div into at most n horizontal bands such
+// that no tile crosses the border between two bands. Each band contains
+// approximately the same number of tiles, the tiles in a band are sorted
+// row by row. Layouts like the quadtree layout contain tiles that span
+// multiple rows, in this case there might be fewer than n bands.
+func composeBands(div TileDivision, n int) [][]tilePos {
+	all := make([]tilePos, 0, div.Size())
+	for i, col := range div {
+		for j, r := range col {
+			all = append(all, tilePos{i: i, j: j, r: r})
+		}
+	}
+	sort.SliceStable(all, func(a, b int) bool {
+		return all[a].r.Min.Y < all[b].r.Min.Y
+	})
+	// a band can start at tile k if all tiles before k end before tile k
+	// starts
+	cuts := []int{0}
+	maxEnd := math.MinInt32
+	for k, pos := range all {
+		band := len(cuts)
+		if k > 0 && maxEnd <= pos.r.Min.Y && band < n && k >= band*len(all)/n {
+			cuts = append(cuts, k)
+		}
+		maxEnd = IntMax(maxEnd, pos.r.Max.Y)
+	}
+	cuts = append(cuts, len(all))
+	res := make([][]tilePos, 0, len(cuts)-1)
+	for c := 0; c+1 < len(cuts); c++ {
+		band := all[cuts[c]:cuts[c+1]]
+		sort.Slice(band, func(a, b int) bool {
+			return band[a].i < band[b].i || (band[a].i == band[b].i && band[a].j < band[b].j)
+		})
+		res = append(res, band)
+	}
+	return res
+}
+
+// OverlayImage blends the query image over a (finished) mosaic.
+// opacity must be a value between 0 and 1 and describes how visible the query
+// image is: 0 means that the mosaic remains unchanged, 1 means that the
+// query completely replaces the mosaic. The query is scaled with resizer to
+// the size of the mosaic first.
+//
+// This is a common technique to make the query image easier to recognize in
+// the mosaic, a value of 0.1 - 0.3 is usually a good choice.
+//
+// The result is a new image, mosaic is not changed.
+func OverlayImage(mosaic, query image.Image, opacity float64, resizer ImageResizer) image.Image {
+	bounds := mosaic.Bounds()
+	res := image.NewRGBA(bounds)
+	draw.Draw(res, bounds, mosaic, bounds.Min, draw.Src)
+	opacity = math.Max(0.0, math.Min(1.0, opacity))
+	if opacity == 0.0 || bounds.Empty() {
+		return res
+	}
+	scaled := resizer.Resize(uint(bounds.Dx()), uint(bounds.Dy()), query)
+	mask := image.NewUniform(color.Alpha{A: clampColor(255.0 * opacity)})
+	draw.DrawMask(res, bounds, scaled, scaled.Bounds().Min, mask, image.ZP, draw.Over)
+	return res
 }
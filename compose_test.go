@@ -0,0 +1,68 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"errors"
+	"image"
+	"strings"
+	"testing"
+
+	"github.com/nfnt/resize"
+)
+
+// brokenStorage contains two images, the second one can't be loaded.
+type brokenStorage struct{}
+
+func (brokenStorage) NumImages() ImageID {
+	return 2
+}
+
+func (brokenStorage) LoadImage(id ImageID) (image.Image, error) {
+	if id == 1 {
+		return nil, errors.New("broken image")
+	}
+	return image.NewRGBA(image.Rect(0, 0, 10, 10)), nil
+}
+
+func (s brokenStorage) LoadConfig(id ImageID) (image.Config, error) {
+	if _, err := s.LoadImage(id); err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{Width: 10, Height: 10}, nil
+}
+
+func TestComposeTileErrorPosition(t *testing.T) {
+	// 4 columns and 2 rows, the last tile in the second row fails
+	division := NewFixedNumDivider(4, 2, false).Divide(image.Rect(0, 0, 40, 20))
+	tiles := [][]ImageID{{0, 0, 0, 0}, {0, 0, 0, 1}}
+	_, report, err := ComposeMosaicWithPolicy(brokenStorage{}, tiles, division,
+		NewNfntResizer(resize.NearestNeighbor), ForceResize, nil, TileBorder{}, 2,
+		nil, nil, ComposeBestEffort, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Errors) != 1 {
+		t.Fatalf("Expected one failed tile, got %d", len(report.Errors))
+	}
+	tileErr := report.Errors[0]
+	if tileErr.Row != 1 || tileErr.Column != 3 {
+		t.Errorf("Expected the tile in row 1 and column 3 to fail, got row %d and column %d",
+			tileErr.Row, tileErr.Column)
+	}
+	if !strings.Contains(tileErr.Error(), "tile (3, 1)") {
+		t.Errorf("Expected the tile as (x, y) in the error, got %s", tileErr.Error())
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+)
+
+// This file contains functions to set the variables of an ExecutorState
+// from a config file and environment variables.
+
+const (
+	// ConfigFileName is the name of the config file in the home directory of the
+	// user, see LoadStateDefaults.
+	ConfigFileName = ".gomosaicrc"
+
+	// EnvPrefix is the prefix of the environment variables that set the
+	// variables of an ExecutorState. The name of the environment variable is
+	// the prefix followed by the name of the variable in upper case and "-"
+	// replaced by "_", for example GOMOSAIC_JPEG_QUALITY for jpeg-quality.
+	EnvPrefix = "GOMOSAIC_"
+)
+
+// ConfigEntry is a variable / value pair from a config file. Section is the
+// name of the section the entry is in (empty for entries before the first
+// section header).
+type ConfigEntry struct {
+	Variable, Value string
+	Section         string
+	Line            int
+}
+
+// ParseConfig parses a config file. The format is a subset of TOML: Each line
+// has the form "variable = value", values can be enclosed in quotes.
+// Empty lines and lines starting with # are ignored. Section headers like
+// "[mosaic]" set the section of the following entries.
+// The variables are the same as for the set command, in the section "alias"
+// aliases are defined (see AliasCommand):
+//
+//	[alias]
+//	quick = "storage load $1; gch create; mosaic $2 $3 gch-euclid 40x40"
+func ParseConfig(r io.Reader) ([]ConfigEntry, error) {
+	scanner := bufio.NewScanner(r)
+	res := make([]ConfigEntry, 0)
+	lineNum := 0
+	section := ""
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			section = strings.TrimSpace(strings.Trim(line, "[]"))
+			continue
+		}
+		split := strings.SplitN(line, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("Invalid config line %d: Expected \"variable = value\", got \"%s\"", lineNum, line)
+		}
+		variable, value := strings.TrimSpace(split[0]), strings.TrimSpace(split[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		res = append(res, ConfigEntry{Variable: variable, Value: value, Section: section, Line: lineNum})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ApplyConfigFile sets the variables of the state from a config file (see
+// ParseConfig). The values are set with SetVarCommand, entries in the section
+// "alias" are defined with DefineAlias.
+func ApplyConfigFile(state *ExecutorState, path string) error {
+	f, openErr := os.Open(path)
+	if openErr != nil {
+		return openErr
+	}
+	defer f.Close()
+	entries, parseErr := ParseConfig(f)
+	if parseErr != nil {
+		return parseErr
+	}
+	for _, entry := range entries {
+		if entry.Section == "alias" {
+			if aliasErr := DefineAlias(state, entry.Variable, entry.Value); aliasErr != nil {
+				return fmt.Errorf("Error in line %d of %s: %s", entry.Line, path, aliasErr.Error())
+			}
+			continue
+		}
+		if setErr := SetVarCommand(state, entry.Variable, entry.Value); setErr != nil {
+			return fmt.Errorf("Error in line %d of %s: %s", entry.Line, path, setErr.Error())
+		}
+	}
+	return nil
+}
+
+// EnvVariableName returns the name of the environment variable for a state
+// variable, see EnvPrefix.
+func EnvVariableName(variable string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(variable, "-", "_", -1))
+}
+
+// ApplyEnv sets the variables of the state from environment variables, see
+// EnvPrefix.
+func ApplyEnv(state *ExecutorState) error {
+	// keep order deterministic
+	for _, name := range state.VariableNames() {
+		envName := EnvVariableName(name)
+		value, has := os.LookupEnv(envName)
+		if !has {
+			continue
+		}
+		if setErr := SetVarCommand(state, name, value); setErr != nil {
+			return fmt.Errorf("Invalid value for %s: %s", envName, setErr.Error())
+		}
+	}
+	return nil
+}
+
+// ApplyVariables sets the variables of the state with SetVarCommand, vars
+// maps variable names to values.
+func ApplyVariables(state *ExecutorState, vars map[string]string) error {
+	// keep order deterministic
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if setErr := SetVarCommand(state, name, vars[name]); setErr != nil {
+			return fmt.Errorf("Invalid value for %s: %s", name, setErr.Error())
+		}
+	}
+	return nil
+}
+
+// LoadStateDefaults sets the variables of the state from the config file
+// ~/.gomosaicrc (if it exists) and after that from the environment variables.
+// Thus environment variables overwrite values from the config file.
+//
+// Errors are logged, values that were set before the error occurred are kept.
+func LoadStateDefaults(state *ExecutorState) {
+	if home, homeErr := homedir.Dir(); homeErr == nil {
+		path := filepath.Join(home, ConfigFileName)
+		if _, statErr := os.Stat(path); statErr == nil {
+			if configErr := ApplyConfigFile(state, path); configErr != nil {
+				log.WithError(configErr).Warn("Can't read config file")
+			}
+		}
+	}
+	if envErr := ApplyEnv(state); envErr != nil {
+		log.WithError(envErr).Warn("Can't read environment variables")
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// This file contains the control flow blocks supported by Execute.
+//
+// A block starts with "foreach" or "if" and ends with a line "end", blocks
+// can be nested.
+//
+// "foreach <glob> [variable]" executes the block for each file matching the
+// glob (relative paths are relative to the working directory). In the block
+// $file is replaced by the absolute path of the file and $file_name by the
+// name of the file without extension. If variable is given it's used instead
+// of file, for example $img and $img_name for "foreach *.jpg img". Note that
+// the replacement happens on the text level, paths with spaces are not
+// quoted.
+//
+// "if exists <path>" executes the block only if the file or directory
+// exists, "if not exists <path>" only if it does not exist.
+//
+// Example:
+//
+//   foreach ~/queries/*.jpg
+//   mosaic $file ~/mosaics/$file_name.png gch-cosine 30x30
+//   end
+
+// isBlockCommand returns true if cmd starts (or ends) a control flow block.
+func isBlockCommand(cmd string) bool {
+	switch cmd {
+	case "foreach", "if", "end":
+		return true
+	default:
+		return false
+	}
+}
+
+// sliceLineReader implements LineReader by returning lines from a slice.
+type sliceLineReader struct {
+	lines []string
+}
+
+func (r *sliceLineReader) ReadLine() (string, error) {
+	if len(r.lines) == 0 {
+		return "", io.EOF
+	}
+	next := r.lines[0]
+	r.lines = r.lines[1:]
+	return next, nil
+}
+
+// readBlock reads all lines until the "end" of the current block, nested
+// blocks are read completely.
+func readBlock(reader LineReader) ([]string, error) {
+	res := make([]string, 0)
+	depth := 1
+	for {
+		line, readErr := readCommandLine(reader)
+		if readErr == io.EOF {
+			return nil, errors.New("Missing \"end\" for block")
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+		// parse errors are reported when the line is executed
+		if parsed, parseErr := ParseCommand(line); parseErr == nil && len(parsed) > 0 {
+			switch parsed[0] {
+			case "foreach", "if":
+				depth++
+			case "end":
+				depth--
+			}
+		}
+		if depth == 0 {
+			return res, nil
+		}
+		res = append(res, line)
+	}
+}
+
+// blockCondition evaluates the condition of an if block.
+func blockCondition(state *ExecutorState, args []string) (bool, error) {
+	negate := false
+	if len(args) > 0 && args[0] == "not" {
+		negate = true
+		args = args[1:]
+	}
+	if len(args) != 2 || args[0] != "exists" {
+		return false, errors.New("Invalid if syntax, expect \"if [not] exists <path>\"")
+	}
+	path, pathErr := state.GetPath(args[1])
+	if pathErr != nil {
+		return false, pathErr
+	}
+	_, statErr := os.Stat(path)
+	exists := statErr == nil
+	return exists != negate, nil
+}
+
+// foreachReplacer returns the replacer for the variables of a foreach block.
+func foreachReplacer(variable, path string) *strings.Replacer {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	// the longer variable must come first
+	return strings.NewReplacer("$"+variable+"_name", name, "$"+variable, path)
+}
+
+// executeBlock reads the block started by parsedCmd from reader and executes
+// it. Errors in the block syntax are reported via OnParseErr. It returns false
+// if the execution should stop.
+func executeBlock(handler CommandHandler, state *ExecutorState, commandMap CommandMap,
+	reader LineReader, parsedCmd []string) bool {
+	if parsedCmd[0] == "end" {
+		return handler.OnParseErr(state, errors.New("\"end\" without \"foreach\" or \"if\""))
+	}
+	block, blockErr := readBlock(reader)
+	if blockErr != nil {
+		return handler.OnParseErr(state, blockErr)
+	}
+	args := parsedCmd[1:]
+	switch parsedCmd[0] {
+	case "foreach":
+		if len(args) == 0 || len(args) > 2 {
+			return handler.OnParseErr(state, errors.New("Invalid foreach syntax, expect \"foreach <glob> [variable]\""))
+		}
+		variable := "file"
+		if len(args) == 2 {
+			variable = args[1]
+		}
+		pattern, patternErr := state.GetPath(args[0])
+		if patternErr != nil {
+			return handler.OnParseErr(state, patternErr)
+		}
+		files, globErr := filepath.Glob(pattern)
+		if globErr != nil {
+			return handler.OnParseErr(state, fmt.Errorf("Invalid pattern %s: %s", args[0], globErr.Error()))
+		}
+		for _, file := range files {
+			replacer := foreachReplacer(variable, file)
+			lines := make([]string, len(block))
+			for i, line := range block {
+				lines[i] = replacer.Replace(line)
+			}
+			if !executeLines(handler, state, commandMap, &sliceLineReader{lines}) {
+				return false
+			}
+		}
+	case "if":
+		cond, condErr := blockCondition(state, args)
+		if condErr != nil {
+			return handler.OnParseErr(state, condErr)
+		}
+		if cond {
+			lines := make([]string, len(block))
+			copy(lines, block)
+			return executeLines(handler, state, commandMap, &sliceLineReader{lines})
+		}
+	}
+	return true
+}
@@ -0,0 +1,223 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"image"
+	"math"
+	"sort"
+	"strings"
+)
+
+// This file contains resize strategies that keep the ratio of the database
+// images and crop them to fit the tile instead of distorting them.
+
+// coverResize resizes img s.t. it covers an area of tileWidth x tileHeight,
+// keeping the ratio of the image. That is the result has exactly the width
+// or the height of the tile and the other dimension is at least as big as
+// the tile dimension.
+func coverResize(resizer ImageResizer, tileWidth, tileHeight uint, img image.Image) image.Image {
+	bounds := img.Bounds()
+	if bounds.Empty() || tileWidth == 0 || tileHeight == 0 {
+		return resizer.Resize(tileWidth, tileHeight, img)
+	}
+	width, height := float64(bounds.Dx()), float64(bounds.Dy())
+	scale := math.Max(float64(tileWidth)/width, float64(tileHeight)/height)
+	newWidth := uint(math.Ceil(width * scale))
+	newHeight := uint(math.Ceil(height * scale))
+	if newWidth < tileWidth {
+		newWidth = tileWidth
+	}
+	if newHeight < tileHeight {
+		newHeight = tileHeight
+	}
+	return resizer.Resize(newWidth, newHeight, img)
+}
+
+// cropAt returns the area of size tileWidth x tileHeight in img starting at
+// the offset (x, y) relative to the bounds of img. If no sub image can be
+// created the image itself is returned, in this case the top left area of
+// the image is used by the composition.
+func cropAt(img image.Image, x, y int, tileWidth, tileHeight uint) image.Image {
+	bounds := img.Bounds()
+	minPoint := bounds.Min.Add(image.Pt(x, y))
+	area := image.Rectangle{Min: minPoint, Max: minPoint.Add(image.Pt(int(tileWidth), int(tileHeight)))}
+	sub, subErr := SubImage(img, area.Intersect(bounds))
+	if subErr != nil {
+		return img
+	}
+	return sub
+}
+
+// CropResize is a resize strategy that keeps the ratio of the original
+// image. The image is scaled s.t. it covers the tile and then the center area
+// of the scaled image is used.
+func CropResize(resizer ImageResizer, tileWidth, tileHeight uint, img image.Image) image.Image {
+	scaled := coverResize(resizer, tileWidth, tileHeight, img)
+	bounds := scaled.Bounds()
+	x := (bounds.Dx() - int(tileWidth)) / 2
+	y := (bounds.Dy() - int(tileHeight)) / 2
+	return cropAt(scaled, x, y, tileWidth, tileHeight)
+}
+
+// EntropyCropSteps is the maximal number of positions in each direction that
+// are evaluated by EntropyCropResize.
+var EntropyCropSteps = 16
+
+// luminanceMatrix returns the luminance of each pixel in img, stored row wise.
+func luminanceMatrix(img image.Image) [][]uint8 {
+	bounds := img.Bounds()
+	res := make([][]uint8, bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := make([]uint8, bounds.Dx())
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			row[x-bounds.Min.X] = Luminance(ConvertRGB(img.At(x, y)))
+		}
+		res[y-bounds.Min.Y] = row
+	}
+	return res
+}
+
+// Luminance returns the (perceived) brightness of an RGB color as a value
+// between 0 and 255.
+func Luminance(c RGB) uint8 {
+	lum := 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+	return uint8(math.Min(255.0, math.Round(lum)))
+}
+
+// windowEntropy computes the entropy of the luminance values in the given
+// window of lum.
+func windowEntropy(lum [][]uint8, x0, y0, width, height int) float64 {
+	var counts [256]int
+	for y := y0; y < y0+height; y++ {
+		row := lum[y]
+		for x := x0; x < x0+width; x++ {
+			counts[row[x]]++
+		}
+	}
+	total := float64(width * height)
+	if total == 0.0 {
+		return 0.0
+	}
+	res := 0.0
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / total
+		res -= p * math.Log2(p)
+	}
+	return res
+}
+
+// cropOffsets returns the offsets that should be tested when moving a window
+// along an axis with the given slack (remaining pixels).
+func cropOffsets(slack int) []int {
+	if slack <= 0 {
+		return []int{0}
+	}
+	steps := IntMax(EntropyCropSteps, 1)
+	if slack < steps {
+		steps = slack
+	}
+	res := make([]int, 0, steps+1)
+	for i := 0; i <= steps; i++ {
+		res = append(res, (i*slack)/steps)
+	}
+	return res
+}
+
+// EntropyCropResize is a resize strategy that keeps the ratio of the original
+// image, like CropResize. But instead of always using the center of the
+// scaled image it chooses the area with the highest entropy (of the luminance).
+// The idea is that the part with the most information (edges, texture) is the
+// interesting part of the image, whereas areas with low entropy are usually
+// background (sky, walls etc.).
+//
+// At most EntropyCropSteps positions are evaluated in each direction.
+func EntropyCropResize(resizer ImageResizer, tileWidth, tileHeight uint, img image.Image) image.Image {
+	scaled := coverResize(resizer, tileWidth, tileHeight, img)
+	bounds := scaled.Bounds()
+	width, height := int(tileWidth), int(tileHeight)
+	slackX, slackY := bounds.Dx()-width, bounds.Dy()-height
+	if slackX <= 0 && slackY <= 0 {
+		return scaled
+	}
+	lum := luminanceMatrix(scaled)
+	// start with the center, this way we use the center if all areas have the
+	// same entropy
+	bestX, bestY := IntMax(slackX, 0)/2, IntMax(slackY, 0)/2
+	bestEntropy := windowEntropy(lum, bestX, bestY, width, height)
+	for _, y := range cropOffsets(slackY) {
+		for _, x := range cropOffsets(slackX) {
+			entropy := windowEntropy(lum, x, y, width, height)
+			if entropy > bestEntropy {
+				bestEntropy = entropy
+				bestX, bestY = x, y
+			}
+		}
+	}
+	return cropAt(scaled, bestX, bestY, tileWidth, tileHeight)
+}
+
+// The following variables and functions are used for registering named
+// resize strategies, it works the same way as for histogram metrics.
+
+var (
+	resizeStrategies map[string]ResizeStrategy
+)
+
+// RegisterResizeStrategy is used to register a named resize strategy. It will
+// only add the strategy if the name does not exist yet. The result is true
+// if the strategy was successfully registered and false otherwise.
+// All names are transformed to lowercase.
+//
+// All strategies should be registered by an init method.
+func RegisterResizeStrategy(name string, s ResizeStrategy) bool {
+	name = strings.ToLower(name)
+	if _, has := resizeStrategies[name]; has {
+		return false
+	}
+	resizeStrategies[name] = s
+	return true
+}
+
+// GetResizeStrategyNames returns a sorted list of all registered resize
+// strategies.
+func GetResizeStrategyNames() []string {
+	res := make([]string, 0, len(resizeStrategies))
+	for key := range resizeStrategies {
+		res = append(res, key)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// GetResizeStrategy returns a registered resize strategy.
+// Returns the strategy and true on success and nil and false otherwise.
+func GetResizeStrategy(name string) (ResizeStrategy, bool) {
+	name = strings.ToLower(name)
+	if s, has := resizeStrategies[name]; has {
+		return s, true
+	}
+	return nil, false
+}
+
+func init() {
+	resizeStrategies = make(map[string]ResizeStrategy)
+	RegisterResizeStrategy("force", ForceResize)
+	RegisterResizeStrategy("crop", CropResize)
+	RegisterResizeStrategy("entropy", EntropyCropResize)
+}
@@ -20,8 +20,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-
-	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
 )
 
 // This file contains some basic functions when dealing with storages, for
@@ -39,9 +40,20 @@ import (
 //
 // A mapper maps absolute paths to image ids (and vice versa). Meaning that
 // the mapping can't just be transferred to another machine.
+//
+// Roots maps labels to directories images were loaded from (see SetRoot),
+// this way one mapper can contain images from different sources that can
+// still be distinguished (see RootLabel).
+//
+// Tags maps image paths to tags (see AddTags) and Weights maps image paths to
+// weights (see SetWeight and ImageWeights). They're not removed by Clear
+// because they usually come from a sidecar file and not from the directory.
 type FSMapper struct {
 	NameMapping map[string]ImageID
 	IDMapping   []string
+	Roots       map[string]string
+	Tags        map[string][]string
+	Weights     map[string]float64
 }
 
 // NewFSMapper creates a new mapper without any values (empty mappings).
@@ -51,13 +63,120 @@ func NewFSMapper() *FSMapper {
 	return &FSMapper{
 		NameMapping: make(map[string]ImageID),
 		IDMapping:   nil,
+		Roots:       make(map[string]string),
+		Tags:        make(map[string][]string),
+		Weights:     make(map[string]float64),
 	}
 }
 
-// Clear removes all registered images from the mappings.
+// Clear removes all registered images from the mappings and all roots.
 func (m *FSMapper) Clear() {
 	m.NameMapping = make(map[string]ImageID)
 	m.IDMapping = nil
+	m.Roots = make(map[string]string)
+}
+
+// Copy returns a deep copy of the mapper, changes of the copy don't affect
+// m.
+func (m *FSMapper) Copy() *FSMapper {
+	res := &FSMapper{
+		NameMapping: make(map[string]ImageID, len(m.NameMapping)),
+		IDMapping:   append([]string(nil), m.IDMapping...),
+		Roots:       make(map[string]string, len(m.Roots)),
+		Tags:        make(map[string][]string, len(m.Tags)),
+		Weights:     make(map[string]float64, len(m.Weights)),
+	}
+	for path, id := range m.NameMapping {
+		res.NameMapping[path] = id
+	}
+	for label, dir := range m.Roots {
+		res.Roots[label] = dir
+	}
+	for path, tags := range m.Tags {
+		res.Tags[path] = append([]string(nil), tags...)
+	}
+	for path, weight := range m.Weights {
+		res.Weights[path] = weight
+	}
+	return res
+}
+
+// SetRoot sets the directory of the given label, dir should be an absolute
+// path. Images inside dir (or one of its subdirectories) have this label,
+// see RootLabel.
+func (m *FSMapper) SetRoot(label, dir string) {
+	if m.Roots == nil {
+		m.Roots = make(map[string]string)
+	}
+	m.Roots[label] = filepath.Clean(dir)
+}
+
+// RootLabel returns the label of the root that contains path. If roots are
+// nested the label of the innermost root is returned (the smallest label if
+// several labels have the same root). If path is not inside a root the
+// returned bool is false.
+func (m *FSMapper) RootLabel(path string) (string, bool) {
+	res, resRoot := "", ""
+	for label, root := range m.Roots {
+		if len(root) < len(resRoot) || (len(root) == len(resRoot) && resRoot != "" && label > res) {
+			continue
+		}
+		if rel, relErr := filepath.Rel(root, path); relErr != nil || rel == ".." ||
+			strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		res, resRoot = label, root
+	}
+	return res, resRoot != ""
+}
+
+// Labels returns the labels of all roots, sorted alphabetically.
+func (m *FSMapper) Labels() []string {
+	res := make([]string, 0, len(m.Roots))
+	for label := range m.Roots {
+		res = append(res, label)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// AddTags adds the tags of the given images (absolute paths), tags that
+// are already assigned to an image are skipped. The images don't have to be
+// registered.
+func (m *FSMapper) AddTags(tags map[string][]string) {
+	if m.Tags == nil {
+		m.Tags = make(map[string][]string, len(tags))
+	}
+	for path, pathTags := range tags {
+		for _, tag := range pathTags {
+			if !m.HasTag(path, tag) {
+				m.Tags[path] = append(m.Tags[path], tag)
+			}
+		}
+	}
+}
+
+// SetWeight sets the weight of the image with the given path (absolute), a
+// weight of 1 removes the weight. The image doesn't have to be registered.
+func (m *FSMapper) SetWeight(path string, weight float64) {
+	if weight == 1.0 {
+		delete(m.Weights, path)
+		return
+	}
+	if m.Weights == nil {
+		m.Weights = make(map[string]float64)
+	}
+	m.Weights[path] = weight
+}
+
+// HasTag returns true if the image with the given path has the tag.
+func (m *FSMapper) HasTag(path, tag string) bool {
+	for _, t := range m.Tags[path] {
+		if t == tag {
+			return true
+		}
+	}
+	return false
 }
 
 // Len returns the number of images stored in the mapper.
@@ -105,7 +224,7 @@ func (m *FSMapper) GetPath(id ImageID) (string, bool) {
 func (m *FSMapper) Register(path string) (ImageID, bool) {
 	if Debug {
 		if !filepath.IsAbs(path) {
-			log.WithField("path", path).Warn("fsMapper.Register called with relative path")
+			MapperLogger.Warn("fsMapper.Register called with relative path", LogFields{"path": path})
 		}
 	}
 	_, exists := m.NameMapping[path]
@@ -117,15 +236,39 @@ func (m *FSMapper) Register(path string) (ImageID, bool) {
 	m.IDMapping = append(m.IDMapping, path)
 	if Debug {
 		if len(m.IDMapping) != len(m.NameMapping) {
-			log.WithFields(log.Fields{
+			MapperLogger.Warn("Invalid FSMapper state, no bijective mapping?", LogFields{
 				"idMappingLen":   len(m.IDMapping),
 				"nameMappingLen": len(m.NameMapping),
-			}).Warn("Invalid FSMapper state, no bijective mapping?")
+			})
 		}
 	}
 	return id, true
 }
 
+// Retain removes all images for which keep returns false from the mapping.
+// The ids of the remaining images change, they're again 0 to Len() - 1 (the
+// order of the remaining images is not changed).
+//
+// The result contains the old ids of the remaining images: The image with
+// the new id i had the id res[i] before. This can be used to update data
+// stored by id, for example histograms (see MemoryHistStorage.Retain).
+func (m *FSMapper) Retain(keep func(path string) bool) []ImageID {
+	res := make([]ImageID, 0, len(m.IDMapping))
+	newIDMapping := make([]string, 0, len(m.IDMapping))
+	newNameMapping := make(map[string]ImageID, len(m.IDMapping))
+	for oldID, path := range m.IDMapping {
+		if !keep(path) {
+			continue
+		}
+		newNameMapping[path] = ImageID(len(newIDMapping))
+		newIDMapping = append(newIDMapping, path)
+		res = append(res, ImageID(oldID))
+	}
+	m.IDMapping = newIDMapping
+	m.NameMapping = newNameMapping
+	return res
+}
+
 // Load scans path for images supported by gomosaic.
 //
 // All files for which filter returns true will be registered to the mapping.
@@ -137,55 +280,293 @@ func (m *FSMapper) Register(path string) (ImageID, bool) {
 //
 // Note that if an error occurs it is still possible that some images were added
 // to the storage.
+//
+// For more options (include / exclude patterns) see LoadWithOptions.
 func (m *FSMapper) Load(path string, recursive bool, filter SupportedImageFunc) error {
-	if filter == nil {
-		filter = JPGAndPNG
+	return m.LoadWithOptions(path, LoadOptions{Recursive: recursive, Filter: filter})
+}
+
+// LoadOptions describes which files are registered by
+// FSMapper.LoadWithOptions.
+//
+// Include and Exclude are lists of glob patterns (see filepath.Match). A
+// pattern without a path separator is matched against the file name, other
+// patterns against the absolute path (see MatchPathPattern). If Include is not
+// empty only files that match at least one of the patterns are registered.
+// Files and directories that match one of the Exclude patterns are skipped.
+//
+// If FollowSymlinks is true symbolic links to directories are followed in
+// recursive mode (each directory is visited only once), otherwise they're
+// skipped. Symbolic links to files are always registered.
+//
+// MinWidth and MinHeight are the minimal dimensions of an image, smaller
+// images (for example icons) are skipped. MaxRatio is the maximal aspect ratio
+// (longer side divided by shorter side), images with a more extreme ratio are
+// skipped. Values <= 0 disable these checks. If one of the checks is enabled
+// the configuration of each image is read (see image.DecodeConfig), images
+// that can't be decoded are skipped.
+//
+// MaxDepth limits the depth of the subdirectories visited in recursive mode,
+// for example 1 means only the direct subdirectories. Values <= 0 mean no
+// limit.
+//
+// NumRoutines is the number of directories that are read concurrently, values
+// <= 1 read the directories sequentially. The images are registered in the
+// same order in both cases (files and subdirectories in lexical order, depth
+// first). If a directory can be reached by several paths (symbolic links) it
+// is registered by the first path in this order. If Progress is not nil it is
+// called with the number of files scanned so far after each directory.
+type LoadOptions struct {
+	Recursive      bool
+	Filter         SupportedImageFunc
+	Include        []string
+	Exclude        []string
+	FollowSymlinks bool
+	MinWidth       int
+	MinHeight      int
+	MaxRatio       float64
+	MaxDepth       int
+	NumRoutines    int
+	Progress       ProgressFunc
+}
+
+// MatchPathPattern reports whether path matches the glob pattern. If pattern
+// doesn't contain a path separator it is matched against the file name of
+// path, otherwise against path. A malformed pattern never matches.
+func MatchPathPattern(pattern, path string) bool {
+	if !strings.ContainsRune(pattern, filepath.Separator) {
+		path = filepath.Base(path)
+	}
+	matches, _ := filepath.Match(pattern, path)
+	return matches
+}
+
+// ValidatePatterns returns an error if one of the patterns is malformed.
+func ValidatePatterns(patterns ...string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid pattern \"%s\": %s", pattern, err.Error())
+		}
+	}
+	return nil
+}
+
+func (options LoadOptions) excluded(path string) bool {
+	for _, pattern := range options.Exclude {
+		if MatchPathPattern(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (options LoadOptions) accept(path string) bool {
+	if !options.Filter(filepath.Ext(path)) || options.excluded(path) {
+		return false
+	}
+	included := len(options.Include) == 0
+	for _, pattern := range options.Include {
+		if MatchPathPattern(pattern, path) {
+			included = true
+			break
+		}
+	}
+	return included && options.acceptSize(path)
+}
+
+// acceptSize checks the dimensions of the image if required.
+func (options LoadOptions) acceptSize(path string) bool {
+	if options.MinWidth <= 0 && options.MinHeight <= 0 && options.MaxRatio <= 0.0 {
+		return true
+	}
+	f, openErr := os.Open(path)
+	if openErr != nil {
+		MapperLogger.Warn("Can't open image, skipping", LogFields{"path": path, "error": openErr})
+		return false
+	}
+	defer f.Close()
+	config, _, decodeErr := image.DecodeConfig(f)
+	if decodeErr != nil {
+		MapperLogger.Warn("Can't decode image, skipping", LogFields{"path": path, "error": decodeErr})
+		return false
+	}
+	if config.Width < options.MinWidth || config.Height < options.MinHeight {
+		MapperLogger.Debug("Image too small, skipping", LogFields{"path": path})
+		return false
+	}
+	if options.MaxRatio > 0.0 {
+		short, long := IntMin(config.Width, config.Height), IntMax(config.Width, config.Height)
+		if short == 0 || float64(long)/float64(short) > options.MaxRatio {
+			MapperLogger.Debug("Aspect ratio of image too extreme, skipping", LogFields{"path": path})
+			return false
+		}
+	}
+	return true
+}
+
+// LoadWithOptions works as Load but supports more options, see LoadOptions.
+func (m *FSMapper) LoadWithOptions(path string, options LoadOptions) error {
+	if options.Filter == nil {
+		options.Filter = JPGAndPNG
+	}
+	if patternErr := ValidatePatterns(append(options.Include, options.Exclude...)...); patternErr != nil {
+		return patternErr
 	}
 	abs, absErr := filepath.Abs(path)
-	switch {
-	case absErr != nil:
+	if absErr != nil {
 		return absErr
-	case recursive:
-		return m.loadRecursive(abs, filter)
-	default:
-		return m.loadNonRecursive(abs, filter)
 	}
+	scanner := newDirScanner(options)
+	root := &scanDir{path: abs}
+	if real, realErr := filepath.EvalSymlinks(abs); realErr == nil {
+		root.real = real
+	}
+	scanner.wg.Add(1)
+	scanner.scan(root, 0, nil)
+	scanner.wg.Wait()
+	return m.registerScanned(root, map[string]bool{root.real: true})
 }
 
-func (m *FSMapper) loadNonRecursive(path string, filter SupportedImageFunc) error {
-	files, err := ioutil.ReadDir(path)
+// scanEntry is an entry of a scanned directory: Either an image that is
+// accepted by the options or a subdirectory.
+type scanEntry struct {
+	image string
+	dir   *scanDir
+}
+
+// scanDir is a directory read by dirScanner, real is the path with all
+// symbolic links evaluated. err is set if an error occurred while reading the
+// directory (entries contains the entries read before).
+type scanDir struct {
+	path    string
+	real    string
+	entries []scanEntry
+	err     error
+}
+
+// dirScanner reads a directory tree, NumRoutines directories are read
+// concurrently. The images are registered after all directories are read,
+// see registerScanned.
+//
+// Directories that can be reached by several paths (symbolic links) are read
+// for each path, only loops are not followed. Which of the paths is used is
+// decided by registerScanned, this way the result doesn't depend on the order
+// in which the directories are read.
+type dirScanner struct {
+	options LoadOptions
+	wg      sync.WaitGroup
+	sem     chan struct{}
+	// mutex protects numFiles, progress is called with the mutex held
+	mutex    sync.Mutex
+	numFiles int
+}
+
+func newDirScanner(options LoadOptions) *dirScanner {
+	return &dirScanner{
+		options: options,
+		sem:     make(chan struct{}, IntMax(1, options.NumRoutines)),
+	}
+}
+
+// scan reads the directory and starts a new scan for each subdirectory. The
+// wait group must be incremented before. ancestors contains the real paths of
+// the directories above dir.
+func (s *dirScanner) scan(dir *scanDir, depth int, ancestors []string) {
+	defer s.wg.Done()
+	// copy to avoid sharing the array between go routines
+	ancestors = append(ancestors[:len(ancestors):len(ancestors)], dir.real)
+	s.sem <- struct{}{}
+	dir.err = s.read(dir, depth, ancestors)
+	<-s.sem
+	for _, entry := range dir.entries {
+		if entry.dir == nil {
+			continue
+		}
+		s.wg.Add(1)
+		if s.options.NumRoutines > 1 {
+			go s.scan(entry.dir, depth+1, ancestors)
+		} else {
+			s.scan(entry.dir, depth+1, ancestors)
+		}
+	}
+}
+
+// read reads the entries of the directory, subdirectories are only added if
+// they should be visited.
+func (s *dirScanner) read(dir *scanDir, depth int, ancestors []string) error {
+	options := s.options
+	files, err := ioutil.ReadDir(dir.path)
 	if err != nil {
 		return err
 	}
 	for _, file := range files {
-		if !file.IsDir() && filter(filepath.Ext(file.Name())) {
-			abs := filepath.Join(path, file.Name())
-			if _, success := m.Register(abs); !success {
-				log.WithField("path", abs).Info("Image already registered")
+		abs := filepath.Join(dir.path, file.Name())
+		isLink := file.Mode()&os.ModeSymlink != 0
+		if isLink && options.Recursive && options.FollowSymlinks {
+			// check if the link points to a directory
+			if target, statErr := os.Stat(abs); statErr == nil && target.IsDir() {
+				file = target
 			}
 		}
+		if file.IsDir() {
+			if !options.Recursive || options.excluded(abs) {
+				continue
+			}
+			if options.MaxDepth > 0 && depth >= options.MaxDepth {
+				continue
+			}
+			// don't follow loops with symbolic links
+			real, realErr := filepath.EvalSymlinks(abs)
+			if realErr != nil {
+				return realErr
+			}
+			isLoop := false
+			for _, ancestor := range ancestors {
+				if ancestor == real {
+					isLoop = true
+					break
+				}
+			}
+			if !isLoop {
+				dir.entries = append(dir.entries, scanEntry{dir: &scanDir{path: abs, real: real}})
+			}
+			continue
+		}
+		if options.accept(abs) {
+			dir.entries = append(dir.entries, scanEntry{image: abs})
+		}
+	}
+	s.mutex.Lock()
+	s.numFiles += len(files)
+	if options.Progress != nil {
+		options.Progress(s.numFiles)
 	}
+	s.mutex.Unlock()
 	return nil
 }
 
-func (m *FSMapper) loadRecursive(path string, filter SupportedImageFunc) error {
-	walkFunc := func(path string, info os.FileInfo, err error) error {
-		switch {
-		case err != nil:
-			return err
-		case !info.IsDir() && filter(filepath.Ext(path)):
-			if _, success := m.Register(path); !success {
-				log.WithField("path", path).Info("Image already registered")
+// registerScanned registers the images of the directory and its
+// subdirectories in the order of the entries. visited contains the real paths
+// of the directories registered so far, each directory is only registered
+// once. It stops at the first error and returns it, the images read before
+// the error are registered (as if the directories were read sequentially).
+func (m *FSMapper) registerScanned(dir *scanDir, visited map[string]bool) error {
+	for _, entry := range dir.entries {
+		if entry.dir != nil {
+			if visited[entry.dir.real] {
+				continue
 			}
-			return nil
-		default:
-			return nil
+			visited[entry.dir.real] = true
+			if dirErr := m.registerScanned(entry.dir, visited); dirErr != nil {
+				return dirErr
+			}
+			continue
+		}
+		if _, success := m.Register(entry.image); !success {
+			MapperLogger.Info("Image already registered", LogFields{"path": entry.image})
 		}
 	}
-	if err := filepath.Walk(path, walkFunc); err != nil {
-		return err
-	}
-	return nil
+	return dir.err
 }
 
 // CreateFSMapper creates an FSMapper containing images from the root directory.
@@ -207,6 +588,16 @@ func CreateFSMapper(root string, recursive bool, filter SupportedImageFunc) (*FS
 	return res, nil
 }
 
+// CreateFSMapperWithOptions works as CreateFSMapper but supports more
+// options, see LoadOptions.
+func CreateFSMapperWithOptions(root string, options LoadOptions) (*FSMapper, error) {
+	res := NewFSMapper()
+	if err := res.LoadWithOptions(root, options); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // Gone returns images that are gone, i.e. images that are not registered
 // in the mapper.
 // This is useful for storages that store for example histograms. These storages
@@ -232,11 +623,19 @@ func (m *FSMapper) Gone(paths []string) []string {
 // Files are retrieved from a FSMapper.
 type FSImageDB struct {
 	mapper *FSMapper
+
+	// EXIF describes if the EXIF orientation of images is applied when they're
+	// loaded (see DecodeEXIF), this way images shot in portrait are loaded in
+	// portrait. Set it to false if the images are already rotated. Note that
+	// LCHs depend on the orientation, thus they must be re-computed if EXIF
+	// is changed.
+	EXIF bool
 }
 
-// NewFSImageDB returns a new data base given the filesystem mapper.
+// NewFSImageDB returns a new data base given the filesystem mapper. The EXIF
+// orientation is applied by default.
 func NewFSImageDB(mapper *FSMapper) *FSImageDB {
-	return &FSImageDB{mapper: mapper}
+	return &FSImageDB{mapper: mapper, EXIF: true}
 }
 
 // NumImages returns the number of images in the database.
@@ -248,15 +647,22 @@ func (db *FSImageDB) NumImages() ImageID {
 func (db FSImageDB) LoadImage(id ImageID) (image.Image, error) {
 	file, hasFile := db.mapper.GetPath(id)
 	if !hasFile {
-		return nil, fmt.Errorf("Invalid image id: Not associated with an image %d", id)
+		return nil, fmt.Errorf("Invalid image id %d: %w", id, ErrImageNotFound)
 	}
 	r, openErr := os.Open(file)
 	if openErr != nil {
 		return nil, openErr
 	}
 	defer r.Close()
-	img, _, decodeErr := image.Decode(r)
-	return img, decodeErr
+	countEvent(CounterImagesDecoded, 1)
+	var img image.Image
+	var decodeErr error
+	if db.EXIF {
+		img, decodeErr = DecodeEXIF(r)
+	} else {
+		img, _, decodeErr = image.Decode(r)
+	}
+	return img, wrapDecodeErr(file, decodeErr)
 }
 
 // LoadConfig loads the image configuration for the image with the given id from
@@ -264,13 +670,19 @@ func (db FSImageDB) LoadImage(id ImageID) (image.Image, error) {
 func (db FSImageDB) LoadConfig(id ImageID) (image.Config, error) {
 	file, hasFile := db.mapper.GetPath(id)
 	if !hasFile {
-		return image.Config{}, fmt.Errorf("Invalid image id: Not associated with an image %d", id)
+		return image.Config{}, fmt.Errorf("Invalid image id %d: %w", id, ErrImageNotFound)
 	}
 	r, openErr := os.Open(file)
 	if openErr != nil {
 		return image.Config{}, openErr
 	}
 	defer r.Close()
-	config, _, decodeErr := image.DecodeConfig(r)
-	return config, decodeErr
+	var config image.Config
+	var decodeErr error
+	if db.EXIF {
+		config, decodeErr = DecodeConfigEXIF(r)
+	} else {
+		config, _, decodeErr = image.DecodeConfig(r)
+	}
+	return config, wrapDecodeErr(file, decodeErr)
 }
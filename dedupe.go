@@ -0,0 +1,203 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// This file contains functions to find duplicate images in a storage, either
+// byte-identical files or images that look the same (perceptual hashing).
+
+// FileChecksum returns the md5 checksum of a file, encoded as hex string.
+func FileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, copyErr := io.Copy(h, f); copyErr != nil {
+		return "", copyErr
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DifferenceHash computes the difference hash (dHash) of an image: The image
+// is scaled to 9x8 pixels and for each row the luminance of adjacent pixels
+// is compared. The result is a 64 bit hash, similar images have similar
+// hashes (see HammingDistance). The hash doesn't change if the image is scaled
+// or compressed.
+func DifferenceHash(img image.Image, resizer ImageResizer) uint64 {
+	small := resizer.Resize(9, 8, img)
+	bounds := small.Bounds()
+	var res uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := Luminance(ConvertRGB(small.At(bounds.Min.X+x, bounds.Min.Y+y)))
+			right := Luminance(ConvertRGB(small.At(bounds.Min.X+x+1, bounds.Min.Y+y)))
+			res <<= 1
+			if left > right {
+				res |= 1
+			}
+		}
+	}
+	return res
+}
+
+// HammingDistance returns the number of bits that are different in a and b.
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// computeForIDs calls f for each id in ids concurrently with numRoutines go
+// routines. The first error is returned.
+func computeForIDs(ids []ImageID, numRoutines int, progress ProgressFunc, f func(i int, id ImageID) error) error {
+	if numRoutines <= 0 {
+		numRoutines = 1
+	}
+	type job struct {
+		pos int
+		id  ImageID
+	}
+	jobs := make(chan job, BufferSize)
+	errorChan := make(chan error, BufferSize)
+	for w := 0; w < numRoutines; w++ {
+		go func() {
+			for next := range jobs {
+				errorChan <- f(next.pos, next.id)
+			}
+		}()
+	}
+	go func() {
+		for i, id := range ids {
+			jobs <- job{pos: i, id: id}
+		}
+		close(jobs)
+	}()
+	var err error
+	for i := 0; i < len(ids); i++ {
+		nextErr := <-errorChan
+		if nextErr != nil && err == nil {
+			err = nextErr
+		}
+		if progress != nil {
+			progress(i)
+		}
+	}
+	return err
+}
+
+// FindFileDuplicates finds byte-identical files in the mapper. The result maps
+// the id of each duplicate to the id of the first image (smallest id) with
+// the same content.
+func FindFileDuplicates(mapper *FSMapper, numRoutines int, progress ProgressFunc) (map[ImageID]ImageID, error) {
+	ids := make([]ImageID, mapper.Len())
+	for i := range ids {
+		ids[i] = ImageID(i)
+	}
+	checksums := make([]string, len(ids))
+	err := computeForIDs(ids, numRoutines, progress, func(i int, id ImageID) error {
+		path, ok := mapper.GetPath(id)
+		if !ok {
+			return fmt.Errorf("Invalid image id %d: %w", id, ErrImageNotFound)
+		}
+		checksum, checksumErr := FileChecksum(path)
+		checksums[i] = checksum
+		return checksumErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	first := make(map[string]ImageID, len(checksums))
+	res := make(map[ImageID]ImageID)
+	for i, checksum := range checksums {
+		if original, has := first[checksum]; has {
+			res[ImageID(i)] = original
+		} else {
+			first[checksum] = ImageID(i)
+		}
+	}
+	return res, nil
+}
+
+// DuplicateColorTolerance is the maximal difference of each component of the
+// average colors of two images that are considered equal by
+// FindSimilarImages. The difference hash only compares the structure of the
+// images, images with different colors but the same structure (for example
+// uniform images or gradients) have the same hash.
+var DuplicateColorTolerance = 12
+
+// similarColors checks if the components of the colors differ by at most
+// DuplicateColorTolerance.
+func similarColors(c1, c2 AverageColor) bool {
+	diff := func(a, b uint8) int {
+		return IntAbs(int(a) - int(b))
+	}
+	return diff(c1.R, c2.R) <= DuplicateColorTolerance &&
+		diff(c1.G, c2.G) <= DuplicateColorTolerance &&
+		diff(c1.B, c2.B) <= DuplicateColorTolerance
+}
+
+// FindSimilarImages finds images that look the same, it compares the
+// difference hashes of the images (see DifferenceHash) and the average
+// colors (see DuplicateColorTolerance). Two images are considered equal if the
+// hamming distance of their hashes is at most maxDist (0 means that the hashes
+// must be identical) and the average colors are similar. The result maps the
+// id of each duplicate to the id of the first image (smallest id) it is
+// similar to.
+//
+// All pairs of images are compared.
+func FindSimilarImages(storage ImageStorage, resizer ImageResizer, maxDist, numRoutines int,
+	progress ProgressFunc) (map[ImageID]ImageID, error) {
+	ids := IDList(storage)
+	hashes := make([]uint64, len(ids))
+	colors := make([]AverageColor, len(ids))
+	err := computeForIDs(ids, numRoutines, progress, func(i int, id ImageID) error {
+		img, imgErr := storage.LoadImage(id)
+		if imgErr != nil {
+			return imgErr
+		}
+		hashes[i] = DifferenceHash(img, resizer)
+		colors[i] = ComputeAverageColor(resizer.Resize(9, 8, img))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[ImageID]ImageID)
+	// originals contains the positions of all images that are not duplicates
+	originals := make([]int, 0, len(hashes))
+	for i, hash := range hashes {
+		duplicate := false
+		for _, j := range originals {
+			if HammingDistance(hash, hashes[j]) <= maxDist && similarColors(colors[i], colors[j]) {
+				res[ids[i]] = ids[j]
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			originals = append(originals, i)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"image"
+	"math"
+	"sync"
+)
+
+// HistogramAverageColor estimates the average color of an image given its
+// histogram. Each bin of the histogram is represented by the color in the
+// center of the bin.
+func HistogramAverageColor(h *Histogram) AverageColor {
+	k := h.K
+	sum := h.EntrySum()
+	if k == 0 || sum == 0.0 {
+		return AverageColor{}
+	}
+	binSize := float64(QuantizeFactor) / float64(k)
+	var r, g, b float64
+	for id, entry := range h.Entries {
+		if entry == 0.0 {
+			continue
+		}
+		rID := uint(id) % k
+		gID := (uint(id) / k) % k
+		bID := uint(id) / (k * k)
+		r += entry * (float64(rID) + 0.5) * binSize
+		g += entry * (float64(gID) + 0.5) * binSize
+		b += entry * (float64(bID) + 0.5) * binSize
+	}
+	return AverageColor{
+		R: clampColor(r / sum),
+		G: clampColor(g / sum),
+		B: clampColor(b / sum),
+	}
+}
+
+// ErrorDiffusionSelector is an ImageSelector that works like Floyd-Steinberg
+// dithering: The tiles are processed row by row and for each tile the image
+// that minimizes the histogram metric is selected. The difference between the
+// average color of the tile and the selected image (the error) is then
+// distributed to the neighbouring tiles that haven't been processed yet.
+// The colors of these tiles are shifted by the error before they're matched.
+//
+// This way the overall color balance of the mosaic matches the query even if
+// the colors of the database images are limited.
+//
+// Strength is a factor for the error that gets distributed (usually between 0
+// and 1), 0 means that the selection is the same as for a GCHSelector.
+//
+// The average colors of the database images are estimated from the
+// histograms, see HistogramAverageColor.
+type ErrorDiffusionSelector struct {
+	HistStorage HistogramStorage
+	Metric      HistogramMetric
+	Strength    float64
+	NumRoutines int
+
+	dbColors []AverageColor
+}
+
+// NewErrorDiffusionSelector returns a new error diffusion selector.
+func NewErrorDiffusionSelector(storage HistogramStorage, metric HistogramMetric,
+	strength float64, numRoutines int) *ErrorDiffusionSelector {
+	if numRoutines <= 0 {
+		numRoutines = 1
+	}
+	return &ErrorDiffusionSelector{
+		HistStorage: storage,
+		Metric:      metric,
+		Strength:    strength,
+		NumRoutines: numRoutines,
+	}
+}
+
+// Init computes the average colors of the database images.
+func (sel *ErrorDiffusionSelector) Init(storage ImageStorage) error {
+	numImages := int(storage.NumImages())
+	sel.dbColors = make([]AverageColor, numImages)
+	for id := 0; id < numImages; id++ {
+		h, histErr := sel.HistStorage.GetHistogram(ImageID(id))
+		if histErr != nil {
+			return histErr
+		}
+		sel.dbColors[id] = HistogramAverageColor(h)
+	}
+	return nil
+}
+
+// bestImage concurrently computes the image that minimizes the metric.
+func (sel *ErrorDiffusionSelector) bestImage(numImages int, h *Histogram) ImageID {
+	bestIDs := make([]ImageID, sel.NumRoutines)
+	bestValues := make([]float64, sel.NumRoutines)
+	var wg sync.WaitGroup
+	wg.Add(sel.NumRoutines)
+	for w := 0; w < sel.NumRoutines; w++ {
+		go func(w int) {
+			defer wg.Done()
+			bestIDs[w], bestValues[w] = NoImageID, math.MaxFloat64
+			for id := w; id < numImages; id += sel.NumRoutines {
+				dbHist, histErr := sel.HistStorage.GetHistogram(ImageID(id))
+				if histErr != nil {
+					continue
+				}
+				if value := sel.Metric(h, dbHist); value < bestValues[w] {
+					bestIDs[w], bestValues[w] = ImageID(id), value
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	res, resValue := NoImageID, math.MaxFloat64
+	for w, id := range bestIDs {
+		if id != NoImageID && bestValues[w] < resValue {
+			res, resValue = id, bestValues[w]
+		}
+	}
+	return res
+}
+
+// SelectImages selects the images tile by tile and distributes the error.
+func (sel *ErrorDiffusionSelector) SelectImages(storage ImageStorage,
+	query image.Image, dist TileDivision, progress ProgressFunc) ([][]ImageID, error) {
+	if sel.dbColors == nil {
+		if initErr := sel.Init(storage); initErr != nil {
+			return nil, initErr
+		}
+	}
+	tiles, tilesErr := DivideImage(query, dist, sel.NumRoutines)
+	if tilesErr != nil {
+		return nil, tilesErr
+	}
+	numImages := IntMin(int(storage.NumImages()), len(sel.dbColors))
+	k := sel.HistStorage.Divisions()
+	res := make([][]ImageID, len(dist))
+	// the accumulated error of each tile (r, g, b)
+	errs := make([][][3]float64, len(dist))
+	for i, col := range dist {
+		res[i] = make([]ImageID, len(col))
+		errs[i] = make([][3]float64, len(col))
+	}
+	// distribute adds the error to the tile (i, j) if it exists
+	distribute := func(i, j int, e [3]float64, factor float64) {
+		if i < 0 || i >= len(errs) || j < 0 || j >= len(errs[i]) {
+			return
+		}
+		for c := 0; c < 3; c++ {
+			errs[i][j][c] += factor * e[c]
+		}
+	}
+	numDone := 0
+	for i, col := range dist {
+		for j := range col {
+			e := errs[i][j]
+			tile := shiftColors(tiles[i][j], e[0], e[1], e[2])
+			best := sel.bestImage(numImages, GenHistogram(tile, k, true))
+			res[i][j] = best
+			if best != NoImageID && sel.Strength != 0.0 {
+				target, got := ComputeAverageColor(tile), sel.dbColors[best]
+				diff := [3]float64{
+					sel.Strength * (float64(target.R) - float64(got.R)),
+					sel.Strength * (float64(target.G) - float64(got.G)),
+					sel.Strength * (float64(target.B) - float64(got.B)),
+				}
+				distribute(i, j+1, diff, 7.0/16.0)
+				distribute(i+1, j-1, diff, 3.0/16.0)
+				distribute(i+1, j, diff, 5.0/16.0)
+				distribute(i+1, j+1, diff, 1.0/16.0)
+			}
+			numDone++
+			if progress != nil {
+				progress(numDone)
+			}
+		}
+	}
+	return res, nil
+}
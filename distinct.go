@@ -0,0 +1,128 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"fmt"
+	"image"
+)
+
+// This file contains a selector that guarantees a minimum number of distinct
+// images in a mosaic. Selections can degenerate if the database is tiny or
+// if the metric saturates, in the worst case one image wins every tile.
+
+// MinDistinctSelector is an ImageSelector that wraps another selector and
+// checks that the selection contains at least MinImages distinct images (or
+// the number of images / tiles if that is smaller). If not the selection is
+// considered degenerate: A warning is logged (SelectionLogger) and the images
+// are selected round-robin from the heaps of the best images for each tile
+// (see ComputeHeaps), tile i uses the (i mod k)-th best image.
+type MinDistinctSelector struct {
+	Selector ImageSelector
+	// Metric is the metric used to compute the heaps for the fallback.
+	Metric ImageMetric
+	// MinImages is the number of distinct images required.
+	MinImages int
+	// K is the size of the heaps, if K is smaller than MinImages MinImages is
+	// used.
+	K           int
+	NumRoutines int
+}
+
+// NewMinDistinctSelector returns a new selector, the heap size is set to
+// minImages.
+func NewMinDistinctSelector(selector ImageSelector, metric ImageMetric, minImages, numRoutines int) *MinDistinctSelector {
+	return &MinDistinctSelector{
+		Selector:    selector,
+		Metric:      metric,
+		MinImages:   minImages,
+		K:           minImages,
+		NumRoutines: numRoutines,
+	}
+}
+
+// Init calls Init of the wrapped selector and InitStorage of the metric.
+func (sel *MinDistinctSelector) Init(storage ImageStorage) error {
+	if initErr := sel.Selector.Init(storage); initErr != nil {
+		return initErr
+	}
+	return sel.Metric.InitStorage(storage)
+}
+
+// SelectImages selects the images with the wrapped selector and falls back to
+// the round-robin selection if the selection is degenerate. Tiles for which
+// the wrapped selector returned NoImageID stay empty.
+func (sel *MinDistinctSelector) SelectImages(storage ImageStorage,
+	query image.Image, dist TileDivision, progress ProgressFunc) ([][]ImageID, error) {
+	selection, selectionErr := sel.Selector.SelectImages(storage, query, dist, progress)
+	if selectionErr != nil {
+		return nil, selectionErr
+	}
+	numTiles := 0
+	usage := make(map[ImageID]int)
+	for _, col := range selection {
+		for _, id := range col {
+			if id != NoImageID {
+				numTiles++
+				usage[id]++
+			}
+		}
+	}
+	numImages := int(storage.NumImages())
+	required := IntMin(sel.MinImages, IntMin(numImages, numTiles))
+	if len(usage) >= required {
+		return selection, nil
+	}
+	mostUsed, mostUsedCount := NoImageID, 0
+	for id, count := range usage {
+		if count > mostUsedCount || (count == mostUsedCount && id < mostUsed) {
+			mostUsed, mostUsedCount = id, count
+		}
+	}
+	SelectionLogger.Warn(fmt.Sprintf("Degenerate selection: Only %d distinct images for %d tiles, image %d is used for %.1f%% of the tiles. The database is probably too small or the metric saturates, falling back to round-robin over the %d best images",
+		len(usage), numTiles, mostUsed, 100.0*float64(mostUsedCount)/float64(numTiles), required),
+		LogFields{
+			"distinct": len(usage),
+			"required": required,
+			"tiles":    numTiles,
+			"images":   numImages,
+		})
+	if initErr := sel.Metric.InitTiles(storage, query, dist); initErr != nil {
+		return nil, initErr
+	}
+	k := IntMax(sel.K, required)
+	heaps, heapsErr := ComputeHeaps(storage, sel.Metric, query, dist, k, sel.NumRoutines, nil)
+	if heapsErr != nil {
+		return nil, heapsErr
+	}
+	views := GenHeapViews(heaps)
+	tile := 0
+	for i, col := range selection {
+		for j, id := range col {
+			if id == NoImageID {
+				continue
+			}
+			if view := views[i][j]; len(view) > 0 {
+				selection[i][j] = view[tile%len(view)].Image
+			}
+			tile++
+		}
+	}
+	if distinct := DistinctImages(selection); distinct < required {
+		SelectionLogger.Warn("Round-robin selection didn't reach the required number of distinct images",
+			LogFields{"distinct": distinct, "required": required})
+	}
+	return selection, nil
+}
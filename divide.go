@@ -17,8 +17,9 @@ package gomosaic
 import (
 	"fmt"
 	"image"
-
-	log "github.com/sirupsen/logrus"
+	"math"
+	"math/rand"
+	"sort"
 )
 
 // DivideMode is used to describe in which way to handle remaining pixels
@@ -60,8 +61,9 @@ func (mode DivideMode) String() string {
 // TileDivision represents the divison of an image into rectangles. See
 // ImageDivider for details about divisions.
 //
-// Divisons are stored column wise, that is each entry in division is a column.
-// division[0] is the first column etc.
+// Divisons are stored row wise, that is each entry in division is a row.
+// division[0] is the first row and division[y][x] is the tile in column x of
+// row y.
 type TileDivision [][]image.Rectangle
 
 // Size returns the total number of rectangles.
@@ -73,11 +75,142 @@ func (div TileDivision) Size() int {
 	return res
 }
 
+// Bounds returns the smallest rectangle that contains all rectangles of the
+// division.
+func (div TileDivision) Bounds() image.Rectangle {
+	var res image.Rectangle
+	for _, col := range div {
+		for _, r := range col {
+			res = res.Union(r)
+		}
+	}
+	return res
+}
+
+// ScaleDivision maps a division of the rectangle from to the rectangle to.
+// All rectangles are scaled by the ratio of the width / height of both
+// rectangles. This is useful for divisions that depend on the content of the
+// query image (like a QuadtreeDivider): The division is computed on the query
+// and then scaled to the size of the mosaic.
+func ScaleDivision(div TileDivision, from, to image.Rectangle) TileDivision {
+	res := make(TileDivision, len(div))
+	if from.Empty() {
+		return res
+	}
+	scaleX := func(x int) int {
+		return to.Min.X + ((x-from.Min.X)*to.Dx())/from.Dx()
+	}
+	scaleY := func(y int) int {
+		return to.Min.Y + ((y-from.Min.Y)*to.Dy())/from.Dy()
+	}
+	for i, col := range div {
+		resCol := make([]image.Rectangle, len(col))
+		for j, r := range col {
+			resCol[j] = image.Rect(scaleX(r.Min.X), scaleY(r.Min.Y),
+				scaleX(r.Max.X), scaleY(r.Max.Y))
+		}
+		res[i] = resCol
+	}
+	return res
+}
+
+// Inset returns a new division in which each rectangle is shrunk by n on each
+// side. If a rectangle is too small for that the resulting rectangle is empty,
+// see image.Rectangle.Inset.
+// This can be used to leave a gap between the tiles of a mosaic.
+func (div TileDivision) Inset(n int) TileDivision {
+	res := make(TileDivision, len(div))
+	for i, col := range div {
+		resCol := make([]image.Rectangle, len(col))
+		for j, r := range col {
+			resCol[j] = r.Inset(n)
+		}
+		res[i] = resCol
+	}
+	return res
+}
+
+// Split splits the division into two divisions: The first contains all tiles
+// for which mark is true, the second all other tiles. mark must be of the
+// same size as the division. The order of the tiles in each column is
+// retained, thus selections for both divisions can be merged again with
+// MergeSelections.
+func (div TileDivision) Split(mark [][]bool) (TileDivision, TileDivision) {
+	marked := make(TileDivision, len(div))
+	other := make(TileDivision, len(div))
+	for i, col := range div {
+		marked[i] = make([]image.Rectangle, 0, len(col))
+		other[i] = make([]image.Rectangle, 0, len(col))
+		for j, r := range col {
+			if mark[i][j] {
+				marked[i] = append(marked[i], r)
+			} else {
+				other[i] = append(other[i], r)
+			}
+		}
+	}
+	return marked, other
+}
+
+// MergeSelections merges the selections for the divisions created by Split.
+// marked is the selection for the marked tiles, other the selection for all
+// other tiles. If one of the selections is nil NoImageID is used for its
+// tiles.
+func MergeSelections(mark [][]bool, marked, other [][]ImageID) [][]ImageID {
+	res := make([][]ImageID, len(mark))
+	for i, col := range mark {
+		res[i] = make([]ImageID, len(col))
+		nextMarked, nextOther := 0, 0
+		for j, isMarked := range col {
+			switch {
+			case isMarked && marked != nil:
+				res[i][j] = marked[i][nextMarked]
+			case !isMarked && other != nil:
+				res[i][j] = other[i][nextOther]
+			default:
+				res[i][j] = NoImageID
+			}
+			if isMarked {
+				nextMarked++
+			} else {
+				nextOther++
+			}
+		}
+	}
+	return res
+}
+
+// MergeDistances merges the distances for the divisions created by Split, see
+// MergeSelections. If one of the distances is nil NaN is used for its tiles.
+func MergeDistances(mark [][]bool, marked, other [][]float64) [][]float64 {
+	res := make([][]float64, len(mark))
+	for i, col := range mark {
+		res[i] = make([]float64, len(col))
+		nextMarked, nextOther := 0, 0
+		for j, isMarked := range col {
+			switch {
+			case isMarked && marked != nil:
+				res[i][j] = marked[i][nextMarked]
+			case !isMarked && other != nil:
+				res[i][j] = other[i][nextOther]
+			default:
+				res[i][j] = math.NaN()
+			}
+			if isMarked {
+				nextMarked++
+			} else {
+				nextOther++
+			}
+		}
+	}
+	return res
+}
+
 // Tiles are the tiles of an image. They're genrated from a TileDivision
 // and the image matrix is of the same size as the TileDivision.
 //
-// Tiles are stored column wise, that is each entry in tiles is a column.
-// tiles[0] is the first column etc.
+// Tiles are stored row wise, that is each entry in tiles is a row.
+// tiles[0] is the first row etc.
 type Tiles [][]image.Image
 
 // Size returns the total number of tiles.
@@ -106,7 +239,7 @@ func (tiles Tiles) Size() int {
 // (4) The result may be empty (or nil); rows may be empty.
 //
 // (5) Images are stored in coordinates [y][x], that means each entry in the
-// tile division describes a column.
+// tile division describes a row.
 type ImageDivider interface {
 	Divide(image.Rectangle) TileDivision
 }
@@ -150,7 +283,7 @@ func (divider FixedSizeDivider) outerBound(imgBoundPosition, position int) int {
 		// now mode must be DividePad, for crop we should never end up here
 		if Debug {
 			if divider.Mode != DividePad {
-				log.Warn("Got divide mode", divider.Mode, "expected", DividePad)
+				ComposeLogger.Warn("Got unexpected divide mode", LogFields{"mode": divider.Mode, "expected": DividePad})
 			}
 		}
 		return position
@@ -270,19 +403,193 @@ func (divider *FixedNumDivider) Divide(bounds image.Rectangle) TileDivision {
 	return res
 }
 
+// BrickDivider is an ImageDivider that arranges the tiles like the bricks of
+// a wall: Each tile has the same size (as for FixedNumDivider), but every
+// second row is shifted by half a tile width. The odd rows start with a tile
+// of half the width and thus contain one tile more than the even rows.
+//
+// Cut has the same meaning as for FixedNumDivider: If set to true the
+// remaining pixels on the right and bottom are skipped. Otherwise they're
+// added to the tiles on the edges: Pixels at the bottom are added to the
+// last row. Remaining pixels on the right are added to the last tile of a row
+// if they're less than half a tile width, otherwise they form a tile on their
+// own.
+type BrickDivider struct {
+	NumX, NumY int
+	Cut        bool
+}
+
+// NewBrickDivider returns a new BrickDivider given the number of tiles in
+// x and y direction.
+func NewBrickDivider(numX, numY int, cut bool) *BrickDivider {
+	return &BrickDivider{NumX: numX, NumY: numY, Cut: cut}
+}
+
+// Divide implements the Divide method of ImageDivider.
+func (divider *BrickDivider) Divide(bounds image.Rectangle) TileDivision {
+	if bounds.Empty() || divider.NumX <= 0 || divider.NumY <= 0 {
+		return nil
+	}
+	tileWidth := IntMax(bounds.Dx()/divider.NumX, 1)
+	tileHeight := IntMax(bounds.Dy()/divider.NumY, 1)
+	numRows := divider.NumY
+	// the maximal x coordinate of each row
+	maxX := bounds.Max.X
+	if divider.Cut {
+		maxX = IntMin(bounds.Max.X, bounds.Min.X+divider.NumX*tileWidth)
+	}
+	res := make(TileDivision, numRows)
+	for i := 0; i < numRows; i++ {
+		y0 := bounds.Min.Y + i*tileHeight
+		y1 := y0 + tileHeight
+		if i+1 == numRows && !divider.Cut {
+			y1 = bounds.Max.Y
+		}
+		row := make([]image.Rectangle, 0, divider.NumX+1)
+		x := bounds.Min.X
+		if offset := tileWidth / 2; i%2 == 1 && offset > 0 {
+			row = append(row, image.Rect(x, y0, x+offset, y1))
+			x += offset
+		}
+		for ; x+tileWidth <= maxX; x += tileWidth {
+			row = append(row, image.Rect(x, y0, x+tileWidth, y1))
+		}
+		if remaining := maxX - x; remaining > 0 {
+			if remaining < tileWidth/2 && len(row) > 0 {
+				row[len(row)-1].Max.X = maxX
+			} else {
+				row = append(row, image.Rect(x, y0, maxX, y1))
+			}
+		}
+		res[i] = row
+	}
+	return res
+}
+
+// DefaultJitter is the default jitter of a JitterDivider.
+const DefaultJitter = 0.25
+
+// JitterDivider is an ImageDivider that perturbs the boundaries of a grid
+// (as for FixedNumDivider) s.t. the mosaic looks less mechanical: Each
+// boundary between two rows is moved by a random offset and within each row
+// the boundaries between the tiles are moved independently of the other rows.
+// The offsets are at most Jitter times the tile width / height, Jitter must
+// be in [0, 0.5) s.t. the boundaries don't cross.
+//
+// Cut has the same meaning as for FixedNumDivider, the outer boundaries are
+// never moved and the tiles are clamped to the bounds of the image. Seed is
+// the seed for the random offsets (see NewSeededRand), the same seed gives the
+// same division.
+type JitterDivider struct {
+	NumX, NumY int
+	Jitter     float64
+	Cut        bool
+	Seed       int64
+}
+
+// NewJitterDivider returns a new JitterDivider given the number of tiles in
+// x and y direction.
+func NewJitterDivider(numX, numY int, jitter float64, cut bool, seed int64) *JitterDivider {
+	return &JitterDivider{NumX: numX, NumY: numY, Jitter: jitter, Cut: cut, Seed: seed}
+}
+
+// jitterBoundaries returns the n+1 boundaries of n tiles of the given size
+// starting at min, the last boundary is max. The inner boundaries are moved
+// by a random offset of at most jitter * size.
+func (divider *JitterDivider) jitterBoundaries(randGen *rand.Rand, n, min, max, size int) []int {
+	res := make([]int, n+1)
+	res[0], res[n] = min, max
+	maxOffset := divider.Jitter * float64(size)
+	for i := 1; i < n; i++ {
+		offset := int(math.Round((2.0*randGen.Float64() - 1.0) * maxOffset))
+		// clamp s.t. each tile has at least one pixel
+		res[i] = IntMin(IntMax(min+i*size+offset, res[i-1]+1), max-(n-i))
+	}
+	return res
+}
+
+// Divide implements the Divide method of ImageDivider.
+func (divider *JitterDivider) Divide(bounds image.Rectangle) TileDivision {
+	if bounds.Empty() || divider.NumX <= 0 || divider.NumY <= 0 {
+		return nil
+	}
+	tileWidth := IntMax(bounds.Dx()/divider.NumX, 1)
+	tileHeight := IntMax(bounds.Dy()/divider.NumY, 1)
+	// the number of tiles is reduced for very small images
+	numX, numY := IntMin(divider.NumX, bounds.Dx()), IntMin(divider.NumY, bounds.Dy())
+	maxX, maxY := bounds.Max.X, bounds.Max.Y
+	if divider.Cut {
+		maxX = IntMin(maxX, bounds.Min.X+numX*tileWidth)
+		maxY = IntMin(maxY, bounds.Min.Y+numY*tileHeight)
+	}
+	randGen := NewSeededRand(divider.Seed)
+	ys := divider.jitterBoundaries(randGen, numY, bounds.Min.Y, maxY, tileHeight)
+	res := make(TileDivision, numY)
+	for i := range res {
+		xs := divider.jitterBoundaries(randGen, numX, bounds.Min.X, maxX, tileWidth)
+		res[i] = make([]image.Rectangle, numX)
+		for j := range res[i] {
+			res[i][j] = image.Rect(xs[j], ys[i], xs[j+1], ys[i+1])
+		}
+	}
+	return res
+}
+
+// TileExtractError is the error for a tile that can't be extracted from an
+// image, see DivideImage.
+type TileExtractError struct {
+	Row, Column int
+	Err         error
+}
+
+func (err TileExtractError) Error() string {
+	return fmt.Sprintf("Can't extract tile (%d, %d): %s", err.Row, err.Column, err.Err.Error())
+}
+
+// Unwrap returns the wrapped error.
+func (err TileExtractError) Unwrap() error {
+	return err.Err
+}
+
+// DivideError is returned by DivideImage if tiles can't be extracted, it
+// contains the errors of all failed tiles sorted by row and column.
+type DivideError struct {
+	NumTiles int
+	Errors   []TileExtractError
+}
+
+func (err *DivideError) Error() string {
+	if len(err.Errors) == 1 {
+		return err.Errors[0].Error()
+	}
+	return fmt.Sprintf("Failed to extract %d of %d tiles, first error: %s",
+		len(err.Errors), err.NumTiles, err.Errors[0].Error())
+}
+
+// Unwrap returns the error of the first failed tile.
+func (err *DivideError) Unwrap() error {
+	return err.Errors[0]
+}
+
 // DivideImage computes the actual tiles from an image and the distribution
 // into tile rectangles.
 // The returned images should all be part of the image, thus must not have the
 // same size as suggested by the distribution.
+//
+// Images that don't support sub images are converted to RGBA first (see
+// AsSubImager). If tiles can't be extracted the error is a *DivideError
+// containing all failed tiles, the tiles that were extracted are returned
+// nonetheless (failed tiles are nil).
 func DivideImage(img image.Image, distribution TileDivision, numRoutines int) (Tiles, error) {
 	if numRoutines <= 0 {
 		numRoutines = 1
 	}
+	imager := AsSubImager(img)
 	bounds := img.Bounds()
 	res := make(Tiles, len(distribution))
-	// any error that occurs sets this variable (first error)
-	// this is done later
-	var err error
+	for i, col := range distribution {
+		res[i] = make([]image.Image, len(col))
+	}
 
 	// struct that we use for the channel
 	type job struct {
@@ -290,7 +597,7 @@ func DivideImage(img image.Image, distribution TileDivision, numRoutines int) (T
 	}
 
 	jobs := make(chan job, BufferSize)
-	errorChan := make(chan error, BufferSize)
+	errorChan := make(chan *TileExtractError, BufferSize)
 
 	for w := 0; w < numRoutines; w++ {
 		go func() {
@@ -298,32 +605,43 @@ func DivideImage(img image.Image, distribution TileDivision, numRoutines int) (T
 				r := distribution[next.i][next.j]
 				// first intersect to make sure that we truly have a rectangle in the image
 				r = r.Intersect(bounds)
-				// now we try to get the subimage
+				// now we get the subimage
 				// because the intersection can be empty the computed image can be
 				// empty as well
-				subImg, subErr := SubImage(img, r)
+				subImg := imager.SubImage(r)
+				if subImg == nil {
+					errorChan <- &TileExtractError{Row: next.i, Column: next.j,
+						Err: fmt.Errorf("No sub image for area %v", r)}
+					continue
+				}
 				res[next.i][next.j] = subImg
-				errorChan <- subErr
+				errorChan <- nil
 			}
 		}()
 	}
+	numTiles := distribution.Size()
 	go func() {
 		for i, col := range distribution {
-			// initialize res[i]
-			res[i] = make([]image.Image, len(col))
 			for j := 0; j < len(col); j++ {
 				jobs <- job{i, j}
 			}
 		}
 		close(jobs)
 	}()
-	for _, col := range distribution {
-		for j := 0; j < len(col); j++ {
-			nextErr := <-errorChan
-			if nextErr != nil && err != nil {
-				err = nextErr
-			}
+	var errs []TileExtractError
+	for n := 0; n < numTiles; n++ {
+		if nextErr := <-errorChan; nextErr != nil {
+			errs = append(errs, *nextErr)
 		}
 	}
-	return res, err
+	if len(errs) == 0 {
+		return res, nil
+	}
+	sort.Slice(errs, func(a, b int) bool {
+		if errs[a].Row != errs[b].Row {
+			return errs[a].Row < errs[b].Row
+		}
+		return errs[a].Column < errs[b].Column
+	})
+	return res, &DivideError{NumTiles: numTiles, Errors: errs}
 }
@@ -0,0 +1,178 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"fmt"
+	"image"
+	"sort"
+)
+
+// This file contains types to serialize (gob or json) a TileDivision and the
+// selection of images for a division. Both types are simple structs, thus
+// the encoding is explicit and doesn't depend on the encoding of the nested
+// slices and image.Rectangle. When data is decoded it is validated, so it's
+// safe to use data from other sources (for example a plan file).
+
+// DivisionRect is the serializable form of an image.Rectangle in a division.
+type DivisionRect struct {
+	MinX, MinY, MaxX, MaxY int
+}
+
+// NewDivisionRect returns the DivisionRect for r.
+func NewDivisionRect(r image.Rectangle) DivisionRect {
+	return DivisionRect{MinX: r.Min.X, MinY: r.Min.Y, MaxX: r.Max.X, MaxY: r.Max.Y}
+}
+
+// Rectangle returns the rectangle described by r.
+func (r DivisionRect) Rectangle() image.Rectangle {
+	return image.Rect(r.MinX, r.MinY, r.MaxX, r.MaxY)
+}
+
+// DivisionData is the serializable form of a TileDivision. Columns are stored
+// as in TileDivision, Columns[0] is the first column.
+//
+// Bounds is the area covered by the division (usually not the bounds of the
+// query image: with DivideCrop the tiles cover only a part of the image and
+// with DividePad they may exceed the image).
+type DivisionData struct {
+	Bounds  DivisionRect
+	Columns [][]DivisionRect
+}
+
+// NewDivisionData returns the serializable form of div.
+func NewDivisionData(div TileDivision) *DivisionData {
+	columns := make([][]DivisionRect, len(div))
+	for i, col := range div {
+		columns[i] = make([]DivisionRect, len(col))
+		for j, r := range col {
+			columns[i][j] = NewDivisionRect(r)
+		}
+	}
+	return &DivisionData{
+		Bounds:  NewDivisionRect(div.Bounds()),
+		Columns: columns,
+	}
+}
+
+// Division returns the TileDivision described by the data. An error is
+// returned if the division is not a tiling of Bounds, see ValidateTiling.
+func (data *DivisionData) Division() (TileDivision, error) {
+	res := make(TileDivision, len(data.Columns))
+	for i, col := range data.Columns {
+		res[i] = make([]image.Rectangle, len(col))
+		for j, r := range col {
+			res[i][j] = r.Rectangle()
+		}
+	}
+	if err := ValidateTiling(res, data.Bounds.Rectangle()); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// tilePos is a tile of a division together with its position, it's used to
+// sort the tiles in ValidateTiling and composeBands.
+type tilePos struct {
+	i, j int
+	r    image.Rectangle
+}
+
+// ValidateTiling tests if div is a tiling of bounds: All tiles must be
+// non-empty rectangles contained in bounds, no two tiles may overlap and the
+// tiles must cover bounds completely. A division without tiles is a valid
+// tiling of the empty rectangle only.
+func ValidateTiling(div TileDivision, bounds image.Rectangle) error {
+	tiles := make([]tilePos, 0, div.Size())
+	area := 0
+	for i, col := range div {
+		for j, r := range col {
+			if r.Empty() {
+				return fmt.Errorf("Invalid division: Tile (%d, %d) %v is empty", i, j, r)
+			}
+			if !r.In(bounds) {
+				return fmt.Errorf("Invalid division: Tile (%d, %d) %v is not inside the bounds %v",
+					i, j, r, bounds)
+			}
+			area += r.Dx() * r.Dy()
+			tiles = append(tiles, tilePos{i: i, j: j, r: r})
+		}
+	}
+	// sort by x coordinate, this way we only have to compare a tile with the
+	// tiles that start before the tile ends
+	sort.Slice(tiles, func(a, b int) bool {
+		return tiles[a].r.Min.X < tiles[b].r.Min.X
+	})
+	for a, first := range tiles {
+		for _, second := range tiles[a+1:] {
+			if second.r.Min.X >= first.r.Max.X {
+				break
+			}
+			if first.r.Overlaps(second.r) {
+				return fmt.Errorf("Invalid division: Tiles (%d, %d) and (%d, %d) overlap",
+					first.i, first.j, second.i, second.j)
+			}
+		}
+	}
+	// all tiles are inside bounds and don't overlap, so they cover bounds if
+	// the areas are equal
+	if boundsArea := bounds.Dx() * bounds.Dy(); area != boundsArea {
+		return fmt.Errorf("Invalid division: Tiles cover %d of %d pixels of the bounds %v",
+			area, boundsArea, bounds)
+	}
+	return nil
+}
+
+// SelectionData is the serializable form of a selection (the result of an
+// ImageSelector), Columns[i][j] is the image selected for tile (i, j).
+// NoImageID is used for tiles without an image.
+type SelectionData struct {
+	Columns [][]ImageID
+}
+
+// NewSelectionData returns the serializable form of selection.
+func NewSelectionData(selection [][]ImageID) *SelectionData {
+	columns := make([][]ImageID, len(selection))
+	for i, col := range selection {
+		columns[i] = make([]ImageID, len(col))
+		copy(columns[i], col)
+	}
+	return &SelectionData{Columns: columns}
+}
+
+// Selection returns the selection for the division div. An error is returned
+// if the selection doesn't match the structure of div or if it contains an
+// id not in the range 0 to numImages - 1 (or NoImageID).
+func (data *SelectionData) Selection(div TileDivision, numImages ImageID) ([][]ImageID, error) {
+	if len(data.Columns) != len(div) {
+		return nil, fmt.Errorf("Invalid selection: Got %d columns, division has %d columns",
+			len(data.Columns), len(div))
+	}
+	res := make([][]ImageID, len(data.Columns))
+	for i, col := range data.Columns {
+		if len(col) != len(div[i]) {
+			return nil, fmt.Errorf("Invalid selection: Got %d tiles in column %d, division has %d tiles",
+				len(col), i, len(div[i]))
+		}
+		for j, id := range col {
+			if id != NoImageID && (id < 0 || id >= numImages) {
+				return nil, fmt.Errorf("Invalid selection: Invalid image id %d for tile (%d, %d)", id, i, j)
+			}
+		}
+		res[i] = make([]ImageID, len(col))
+		copy(res[i], col)
+	}
+	return res, nil
+}
@@ -21,6 +21,12 @@
 //
 // It ships with a executable program to generate mosaic images and administrate
 // image databases on the filesystem.
+//
+// To embed gomosaic in other programs MosaicBuilder provides a simple API that
+// creates a mosaic with a single call.
+//
+// The library doesn't log anything by default, SetLogger sets a Logger that
+// receives the messages (for example NewLogrusLogger).
 package gomosaic
 
 // TODO There are some functions that run loads of things concurrently
@@ -0,0 +1,206 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+)
+
+// This file contains an edge orientation histogram similar to the MPEG-7 Edge
+// Histogram Descriptor: The image is divided into a grid of regions and for
+// each region a histogram of the edge orientations is computed. The edges are
+// found with the Sobel operator. Color histograms ignore the structure of an
+// image completely, edge histograms match tiles containing lines and
+// gradients much better. Both can be combined in one feature, see
+// EdgeExtractor.
+
+// Default parameters of edge histograms.
+const (
+	DefaultEdgeRegions   = 4
+	DefaultEdgeBins      = 4
+	DefaultEdgeThreshold = 64.0
+)
+
+// grayPixels returns the gray values of all pixels of the image, row by row.
+func grayPixels(img image.Image) ([]float64, int, int) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	res := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			gray := color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray)
+			res[y*width+x] = float64(gray.Y)
+		}
+	}
+	return res, width, height
+}
+
+// GenEdgeHistogram computes the edge orientation histogram of an image. The
+// image is divided into regions x regions parts, for each part a histogram
+// with bins entries is computed: The orientation of the gradient (between 0
+// and π, computed with the Sobel operator) is mapped to one of the bins.
+// Pixels with a gradient magnitude below threshold are ignored. The
+// histogram of each part is divided by the number of pixels in that part.
+//
+// The result contains the histograms of all parts (row by row), so its length
+// is regions * regions * bins.
+func GenEdgeHistogram(img image.Image, regions, bins int, threshold float64) []float64 {
+	res := make([]float64, regions*regions*bins)
+	pixels, width, height := grayPixels(img)
+	if width < 3 || height < 3 {
+		return res
+	}
+	counts := make([]int, regions*regions)
+	at := func(x, y int) float64 {
+		return pixels[y*width+x]
+	}
+	for y := 1; y < height-1; y++ {
+		regionY := y * regions / height
+		for x := 1; x < width-1; x++ {
+			region := regionY*regions + x*regions/width
+			counts[region]++
+			gx := (at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1)) -
+				(at(x-1, y-1) + 2*at(x-1, y) + at(x-1, y+1))
+			gy := (at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1)) -
+				(at(x-1, y-1) + 2*at(x, y-1) + at(x+1, y-1))
+			if math.Hypot(gx, gy) < threshold {
+				continue
+			}
+			// orientation in [0, π)
+			angle := math.Atan2(gy, gx)
+			if angle < 0 {
+				angle += math.Pi
+			}
+			bin := int(angle / math.Pi * float64(bins))
+			if bin >= bins {
+				bin = bins - 1
+			}
+			res[region*bins+bin]++
+		}
+	}
+	for region, count := range counts {
+		if count == 0 {
+			continue
+		}
+		for bin := 0; bin < bins; bin++ {
+			res[region*bins+bin] /= float64(count)
+		}
+	}
+	return res
+}
+
+// EdgeExtractor is a FeatureExtractor for edge histograms, see
+// GenEdgeHistogram. If Color is > 0 the feature also contains a normalized
+// GCH with Color sub-divisions (stored before the edge histogram), Weight is
+// the weight of the edge histogram in the metric: The metric value is
+// (1 - Weight) * color distance + Weight * edge distance.
+type EdgeExtractor struct {
+	Regions, Bins int
+	Threshold     float64
+	Color         uint
+	Weight        float64
+}
+
+// Descriptor returns "edge regions=<regions> bins=<bins> threshold=<threshold>
+// color=<color> weight=<weight>".
+func (e EdgeExtractor) Descriptor() string {
+	return fmt.Sprintf("edge regions=%d bins=%d threshold=%s color=%d weight=%s",
+		e.Regions, e.Bins, strconv.FormatFloat(e.Threshold, 'f', -1, 64),
+		e.Color, strconv.FormatFloat(e.Weight, 'f', -1, 64))
+}
+
+// colorSize returns the number of entries of the GCH.
+func (e EdgeExtractor) colorSize() int {
+	return int(e.Color * e.Color * e.Color)
+}
+
+// Extract returns the GCH (if enabled) followed by the edge histogram.
+func (e EdgeExtractor) Extract(img image.Image) ([]float64, error) {
+	edges := GenEdgeHistogram(img, e.Regions, e.Bins, e.Threshold)
+	if e.Color == 0 {
+		return edges, nil
+	}
+	res := make([]float64, 0, e.colorSize()+len(edges))
+	res = append(res, GenHistogram(img, e.Color, true).Entries...)
+	return append(res, edges...), nil
+}
+
+// Metric returns the weighted sum of the color distance and the sum of the
+// distances of the edge histograms of all regions.
+func (e EdgeExtractor) Metric(metric HistogramMetric) FeatureMetric {
+	colorMetric := histogramFeatureMetric(metric, e.Color)
+	edgeMetric := histogramFeatureMetric(metric, 0)
+	colorSize := e.colorSize()
+	return func(p, q []float64) float64 {
+		var edgeDist float64
+		for start := colorSize; start+e.Bins <= len(p) && start+e.Bins <= len(q); start += e.Bins {
+			edgeDist += edgeMetric(p[start:start+e.Bins], q[start:start+e.Bins])
+		}
+		if colorSize == 0 {
+			return edgeDist
+		}
+		colorDist := colorMetric(p[:colorSize], q[:colorSize])
+		return (1.0-e.Weight)*colorDist + e.Weight*edgeDist
+	}
+}
+
+// parseEdgeInt parses a positive integer parameter of the edge feature.
+func parseEdgeInt(params map[string]string, key string, def, max int) (int, error) {
+	s, has := params[key]
+	if !has {
+		return def, nil
+	}
+	val, parseErr := strconv.Atoi(s)
+	if parseErr != nil || val < 1 || val > max {
+		return 0, fmt.Errorf("%s must be a value between 1 and %d, got %s", key, max, s)
+	}
+	return val, nil
+}
+
+func init() {
+	RegisterFeatureExtractor("edge", func(params map[string]string) (FeatureExtractor, error) {
+		if paramsErr := featureParams("edge", params, "regions", "bins", "threshold", "color", "weight"); paramsErr != nil {
+			return nil, paramsErr
+		}
+		res := EdgeExtractor{Threshold: DefaultEdgeThreshold, Weight: 0.5}
+		var err error
+		if res.Regions, err = parseEdgeInt(params, "regions", DefaultEdgeRegions, 16); err != nil {
+			return nil, err
+		}
+		if res.Bins, err = parseEdgeInt(params, "bins", DefaultEdgeBins, 36); err != nil {
+			return nil, err
+		}
+		if s, has := params["threshold"]; has {
+			if res.Threshold, err = strconv.ParseFloat(s, 64); err != nil || res.Threshold < 0.0 {
+				return nil, fmt.Errorf("threshold must be a value >= 0, got %s", s)
+			}
+		}
+		if s, has := params["color"]; has && s != "0" {
+			if res.Color, err = parseGCHK(s); err != nil {
+				return nil, err
+			}
+		}
+		if s, has := params["weight"]; has {
+			if res.Weight, err = strconv.ParseFloat(s, 64); err != nil || res.Weight < 0.0 || res.Weight > 1.0 {
+				return nil, fmt.Errorf("weight must be a value between 0 and 1, got %s", s)
+			}
+		}
+		return res, nil
+	})
+}
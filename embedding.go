@@ -0,0 +1,184 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/nfnt/resize"
+)
+
+// This file contains a feature extractor for image embeddings: A neural network
+// (for example a small classification network without its last layer) maps
+// each image to a vector, images with similar content (sky, faces, ...) have
+// similar vectors. The vectors are compared with the cosine distance, use the
+// selection "feature-cosine" for mosaics.
+//
+// The model is run by an EmbeddingBackend. The ONNX backend is only available
+// if gomosaic is built with "-tags onnx" (see embedding_onnx.go), it requires
+// the ONNX runtime shared library.
+
+// EmbeddingModel computes the embedding of a preprocessed image, see
+// EmbeddingInput for the format of the input.
+type EmbeddingModel interface {
+	Embed(input []float32) ([]float32, error)
+}
+
+// EmbeddingBackend loads a model from a file, size is the width and height of
+// the input images. input and output are the names of the input and output of
+// the model.
+type EmbeddingBackend func(path string, size int, input, output string) (EmbeddingModel, error)
+
+// embeddingBackend is the backend used by the "embedding" feature, nil if
+// gomosaic was built without support for embeddings.
+var embeddingBackend EmbeddingBackend
+
+// The mean and standard deviation of the color channels used to normalize the
+// input, these are the values most models trained on ImageNet expect.
+var (
+	embeddingMean = [3]float32{0.485, 0.456, 0.406}
+	embeddingStd  = [3]float32{0.229, 0.224, 0.225}
+)
+
+// EmbeddingInput converts an image to the input of an embedding model: The
+// image is resized to size x size and the channels are normalized with the
+// ImageNet mean and standard deviation. The result is stored in NCHW format
+// (first the red channel row by row, then green and blue).
+func EmbeddingInput(img image.Image, size int) []float32 {
+	scaled := resize.Resize(uint(size), uint(size), img, resize.Bilinear)
+	bounds := scaled.Bounds()
+	res := make([]float32, 3*size*size)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			r, g, b, _ := scaled.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			pos := y*size + x
+			for c, value := range [3]uint32{r, g, b} {
+				res[c*size*size+pos] = (float32(value)/0xffff - embeddingMean[c]) / embeddingStd[c]
+			}
+		}
+	}
+	return res
+}
+
+// EmbeddingExtractor is a FeatureExtractor that computes the embeddings of
+// images with a model. The vectors are normalized to length 1.
+type EmbeddingExtractor struct {
+	Model         EmbeddingModel
+	ModelPath     string
+	Size          int
+	Input, Output string
+
+	// models are usually not safe for concurrent use
+	m sync.Mutex
+}
+
+// NewEmbeddingExtractor loads the model with the backend gomosaic was built
+// with. An error is returned if gomosaic was built without support for
+// embeddings.
+func NewEmbeddingExtractor(path string, size int, input, output string) (*EmbeddingExtractor, error) {
+	if embeddingBackend == nil {
+		return nil, errors.New("Embeddings are not supported, gomosaic must be built with \"-tags onnx\"")
+	}
+	model, modelErr := embeddingBackend(path, size, input, output)
+	if modelErr != nil {
+		return nil, modelErr
+	}
+	return &EmbeddingExtractor{
+		Model:     model,
+		ModelPath: path,
+		Size:      size,
+		Input:     input,
+		Output:    output,
+	}, nil
+}
+
+// Descriptor returns "embedding model=<path> size=<size> input=<input>
+// output=<output>".
+func (e *EmbeddingExtractor) Descriptor() string {
+	return fmt.Sprintf("embedding model=%s size=%d input=%s output=%s",
+		e.ModelPath, e.Size, e.Input, e.Output)
+}
+
+// Extract computes the normalized embedding of the image.
+func (e *EmbeddingExtractor) Extract(img image.Image) ([]float64, error) {
+	input := EmbeddingInput(img, e.Size)
+	e.m.Lock()
+	output, embedErr := e.Model.Embed(input)
+	e.m.Unlock()
+	if embedErr != nil {
+		return nil, embedErr
+	}
+	res := make([]float64, len(output))
+	var length float64
+	for i, value := range output {
+		res[i] = float64(value)
+		length += res[i] * res[i]
+	}
+	if length > 0.0 {
+		length = math.Sqrt(length)
+		for i := range res {
+			res[i] /= length
+		}
+	}
+	return res, nil
+}
+
+// Metric compares the embeddings as vectors, "cosine" should be used.
+func (e *EmbeddingExtractor) Metric(metric HistogramMetric) FeatureMetric {
+	return histogramFeatureMetric(metric, 0)
+}
+
+func init() {
+	RegisterFeatureExtractor("embedding", func(params map[string]string) (FeatureExtractor, error) {
+		if paramsErr := featureParams("embedding", params, "model", "size", "input", "output"); paramsErr != nil {
+			return nil, paramsErr
+		}
+		path, has := params["model"]
+		if !has {
+			return nil, errors.New("Feature embedding requires the parameter model=<file>")
+		}
+		// the path is stored in the descriptor, so it must be absolute
+		path, pathErr := homedir.Expand(path)
+		if pathErr != nil {
+			return nil, pathErr
+		}
+		if path, pathErr = filepath.Abs(path); pathErr != nil {
+			return nil, pathErr
+		}
+		size := 224
+		if sizeStr, has := params["size"]; has {
+			var sizeErr error
+			size, sizeErr = strconv.Atoi(sizeStr)
+			if sizeErr != nil || size < 1 {
+				return nil, fmt.Errorf("size must be a positive number, got %s", sizeStr)
+			}
+		}
+		input, output := "input", "output"
+		if value, has := params["input"]; has {
+			input = value
+		}
+		if value, has := params["output"]; has {
+			output = value
+		}
+		return NewEmbeddingExtractor(path, size, input, output)
+	})
+}
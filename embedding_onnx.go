@@ -0,0 +1,120 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build onnx
+// +build onnx
+
+package gomosaic
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// This file contains the ONNX backend for embeddings (see embedding.go), it
+// is only compiled with "-tags onnx". The ONNX runtime shared library is
+// loaded from the path in the environment variable ONNXRUNTIME_LIB (or the
+// default search path of the system if it's not set).
+
+var onnxInit struct {
+	once sync.Once
+	err  error
+}
+
+// initONNX initializes the ONNX runtime (once).
+func initONNX() error {
+	onnxInit.once.Do(func() {
+		if lib := os.Getenv("ONNXRUNTIME_LIB"); lib != "" {
+			ort.SetSharedLibraryPath(lib)
+		}
+		onnxInit.err = ort.InitializeEnvironment()
+	})
+	return onnxInit.err
+}
+
+// onnxModel implements EmbeddingModel with an ONNX session, the input and
+// output tensors are reused for all images.
+type onnxModel struct {
+	session *ort.AdvancedSession
+	input   *ort.Tensor[float32]
+	output  *ort.Tensor[float32]
+}
+
+// newONNXModel loads a model with one input of shape (1, 3, size, size) and
+// one output, the shape of the output is read from the model.
+func newONNXModel(path string, size int, input, output string) (EmbeddingModel, error) {
+	if initErr := initONNX(); initErr != nil {
+		return nil, fmt.Errorf("Can't initialize ONNX runtime: %w", initErr)
+	}
+	_, outputs, infoErr := ort.GetInputOutputInfo(path)
+	if infoErr != nil {
+		return nil, infoErr
+	}
+	var outputShape ort.Shape
+	for _, info := range outputs {
+		if info.Name == output {
+			outputShape = info.Dimensions.Clone()
+		}
+	}
+	if outputShape == nil {
+		return nil, fmt.Errorf("Model %s has no output named %s", path, output)
+	}
+	// dynamic dimensions (like the batch size) are -1
+	for i, dim := range outputShape {
+		if dim < 0 {
+			outputShape[i] = 1
+		}
+	}
+	inputTensor, inputErr := ort.NewEmptyTensor[float32](ort.NewShape(1, 3, int64(size), int64(size)))
+	if inputErr != nil {
+		return nil, inputErr
+	}
+	outputTensor, outputErr := ort.NewEmptyTensor[float32](outputShape)
+	if outputErr != nil {
+		inputTensor.Destroy()
+		return nil, outputErr
+	}
+	session, sessionErr := ort.NewAdvancedSession(path, []string{input}, []string{output},
+		[]ort.Value{inputTensor}, []ort.Value{outputTensor}, nil)
+	if sessionErr != nil {
+		inputTensor.Destroy()
+		outputTensor.Destroy()
+		return nil, sessionErr
+	}
+	return &onnxModel{session: session, input: inputTensor, output: outputTensor}, nil
+}
+
+// Embed runs the model, the result is a copy of the output.
+func (model *onnxModel) Embed(input []float32) ([]float32, error) {
+	data := model.input.GetData()
+	if len(input) != len(data) {
+		return nil, fmt.Errorf("Invalid input size for ONNX model: Expected %d values, got %d",
+			len(data), len(input))
+	}
+	copy(data, input)
+	if runErr := model.session.Run(); runErr != nil {
+		return nil, runErr
+	}
+	output := model.output.GetData()
+	res := make([]float32, len(output))
+	copy(res, output)
+	return res, nil
+}
+
+func init() {
+	embeddingBackend = newONNXModel
+}
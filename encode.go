@@ -0,0 +1,357 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"sort"
+	"strings"
+)
+
+// This file contains a parallel PNG encoder. For very large mosaics encoding
+// the image with png.Encode takes longer than composing it, because the
+// compression is done by a single go routine.
+//
+// The encoder splits the image into strips of rows, each strip is filtered and
+// compressed concurrently. The compressed strips are concatenated to a single
+// zlib stream (each strip except the last ends with a sync flush), thus the
+// result is a standard PNG file. Because the strips don't share the
+// compression dictionary the files are slightly larger than the files created
+// by png.Encode.
+
+// ParsePNGCompression parses the name of a compression level: "default",
+// "none", "speed" or "best".
+func ParsePNGCompression(s string) (png.CompressionLevel, error) {
+	switch strings.ToLower(s) {
+	case "default":
+		return png.DefaultCompression, nil
+	case "none":
+		return png.NoCompression, nil
+	case "speed":
+		return png.BestSpeed, nil
+	case "best":
+		return png.BestCompression, nil
+	default:
+		return png.DefaultCompression, fmt.Errorf("unkown png compression: %s", s)
+	}
+}
+
+// PNGCompressionString returns the name of the compression level as accepted
+// by ParsePNGCompression.
+func PNGCompressionString(level png.CompressionLevel) string {
+	switch level {
+	case png.DefaultCompression:
+		return "default"
+	case png.NoCompression:
+		return "none"
+	case png.BestSpeed:
+		return "speed"
+	case png.BestCompression:
+		return "best"
+	default:
+		return fmt.Sprintf("CompressionLevel(%d)", int(level))
+	}
+}
+
+// flateLevel returns the compress/flate level for a png compression level.
+func flateLevel(level png.CompressionLevel) int {
+	switch level {
+	case png.NoCompression:
+		return flate.NoCompression
+	case png.BestSpeed:
+		return flate.BestSpeed
+	case png.BestCompression:
+		return flate.BestCompression
+	default:
+		return flate.DefaultCompression
+	}
+}
+
+// pngRowsPerStrip is the minimal number of rows compressed together, smaller
+// strips make the compression worse.
+const pngRowsPerStrip = 64
+
+// pngStrip is a compressed strip of rows.
+type pngStrip struct {
+	data     []byte
+	checksum uint32
+	length   int
+	err      error
+}
+
+// EncodePNGParallel encodes img as PNG with 8 bits per channel (RGB if the
+// image is opaque, RGBA otherwise). numRoutines strips of the image are
+// compressed concurrently. text maps keywords to values, each entry is written
+// as a text chunk (it can be nil).
+func EncodePNGParallel(w io.Writer, img image.Image, level png.CompressionLevel, numRoutines int,
+	text map[string]string) error {
+	if numRoutines <= 0 {
+		numRoutines = 1
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("Can't encode empty image with bounds %v", bounds)
+	}
+	opaque := false
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		opaque = o.Opaque()
+	}
+	bpp, colorType := 4, byte(6)
+	if opaque {
+		bpp, colorType = 3, 2
+	}
+	// compute the strips
+	rowsPerStrip := IntMax(pngRowsPerStrip, (height+4*numRoutines-1)/(4*numRoutines))
+	numStrips := (height + rowsPerStrip - 1) / rowsPerStrip
+	strips := make([]chan pngStrip, numStrips)
+	for i := range strips {
+		strips[i] = make(chan pngStrip, 1)
+	}
+	jobs := make(chan int, numStrips)
+	for i := 0; i < numStrips; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	for routine := 0; routine < IntMin(numRoutines, numStrips); routine++ {
+		go func() {
+			for strip := range jobs {
+				first := strip * rowsPerStrip
+				last := IntMin(first+rowsPerStrip, height)
+				strips[strip] <- compressPNGStrip(img, bpp, first, last, level, last == height)
+			}
+		}()
+	}
+	// write header
+	if _, err := io.WriteString(w, "\x89PNG\r\n\x1a\n"); err != nil {
+		return err
+	}
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header[0:], uint32(width))
+	binary.BigEndian.PutUint32(header[4:], uint32(height))
+	header[8] = 8
+	header[9] = colorType
+	if err := writePNGChunk(w, "IHDR", header); err != nil {
+		return err
+	}
+	keywords := make([]string, 0, len(text))
+	for keyword := range text {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+	for _, keyword := range keywords {
+		if len(keyword) == 0 || len(keyword) > 79 {
+			return fmt.Errorf("Invalid png text keyword \"%s\": Must have between 1 and 79 characters", keyword)
+		}
+		chunk := append(append([]byte(keyword), 0), text[keyword]...)
+		if err := writePNGChunk(w, "tEXt", chunk); err != nil {
+			return err
+		}
+	}
+	// write the strips in order, each strip is written as an IDAT chunk
+	checksum := adler32.Checksum(nil)
+	for i, ch := range strips {
+		strip := <-ch
+		if strip.err != nil {
+			return strip.err
+		}
+		checksum = adler32Combine(checksum, strip.checksum, strip.length)
+		data := strip.data
+		if i == 0 {
+			// zlib header
+			data = append([]byte{0x78, 0x9c}, data...)
+		}
+		if i == numStrips-1 {
+			data = append(data, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(data[len(data)-4:], checksum)
+		}
+		if err := writePNGChunk(w, "IDAT", data); err != nil {
+			return err
+		}
+	}
+	return writePNGChunk(w, "IEND", nil)
+}
+
+// compressPNGStrip filters and compresses the rows first to last - 1 of img.
+func compressPNGStrip(img image.Image, bpp, first, last int, level png.CompressionLevel, final bool) pngStrip {
+	bounds := img.Bounds()
+	rowSize := bpp * bounds.Dx()
+	prev := make([]byte, rowSize)
+	if first > 0 {
+		pngRow(img, bpp, first-1, prev)
+	}
+	current := make([]byte, rowSize)
+	filtered := make([]byte, 1+rowSize)
+	candidate := make([]byte, rowSize)
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flateLevel(level))
+	if err != nil {
+		return pngStrip{err: err}
+	}
+	checksum := adler32.New()
+	for y := first; y < last; y++ {
+		pngRow(img, bpp, y, current)
+		filterPNGRow(filtered, candidate, current, prev, bpp, level == png.NoCompression)
+		if _, err = fw.Write(filtered); err != nil {
+			return pngStrip{err: err}
+		}
+		checksum.Write(filtered)
+		prev, current = current, prev
+	}
+	if final {
+		err = fw.Close()
+	} else {
+		err = fw.Flush()
+	}
+	if err != nil {
+		return pngStrip{err: err}
+	}
+	return pngStrip{
+		data:     buf.Bytes(),
+		checksum: checksum.Sum32(),
+		length:   (last - first) * (1 + rowSize),
+	}
+}
+
+// pngRow writes the row y (relative to the bounds) of img to row, alpha is
+// written only if bpp is 4. Colors are not premultiplied in PNG.
+func pngRow(img image.Image, bpp, y int, row []byte) {
+	bounds := img.Bounds()
+	y += bounds.Min.Y
+	if rgba, ok := img.(*image.RGBA); ok && bpp == 3 {
+		// fast path for opaque RGBA images (the mosaic)
+		pix := rgba.Pix[rgba.PixOffset(bounds.Min.X, y):]
+		for x := 0; x < bounds.Dx(); x++ {
+			copy(row[3*x:3*x+3], pix[4*x:4*x+3])
+		}
+		return
+	}
+	for x := 0; x < bounds.Dx(); x++ {
+		c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, y)).(color.NRGBA)
+		row[bpp*x], row[bpp*x+1], row[bpp*x+2] = c.R, c.G, c.B
+		if bpp == 4 {
+			row[bpp*x+3] = c.A
+		}
+	}
+}
+
+// filterPNGRow filters the row and writes the filter type followed by the
+// filtered row to dst. Like png.Encode it chooses the filter with the smallest
+// sum of absolute differences, if none is true no filter is applied.
+// candidate is used as buffer and must have the size of row.
+func filterPNGRow(dst, candidate, row, prev []byte, bpp int, none bool) {
+	if none {
+		dst[0] = 0
+		copy(dst[1:], row)
+		return
+	}
+	bestSum := -1
+	for filter := byte(0); filter < 5; filter++ {
+		sum := 0
+		for i := range row {
+			var a, b, c int
+			if i >= bpp {
+				a = int(row[i-bpp])
+				c = int(prev[i-bpp])
+			}
+			b = int(prev[i])
+			var predicted int
+			switch filter {
+			case 1:
+				predicted = a
+			case 2:
+				predicted = b
+			case 3:
+				predicted = (a + b) / 2
+			case 4:
+				predicted = paeth(a, b, c)
+			}
+			candidate[i] = row[i] - byte(predicted)
+			// interpret as signed byte
+			sum += IntAbs(int(int8(candidate[i])))
+		}
+		if bestSum < 0 || sum < bestSum {
+			bestSum = sum
+			dst[0] = filter
+			copy(dst[1:], candidate)
+		}
+	}
+}
+
+// paeth is the Paeth predictor of the PNG specification.
+func paeth(a, b, c int) int {
+	p := a + b - c
+	pa, pb, pc := IntAbs(p-a), IntAbs(p-b), IntAbs(p-c)
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	default:
+		return c
+	}
+}
+
+// adler32Combine returns the adler32 checksum of the concatenation of two
+// byte sequences given their checksums and the length of the second sequence
+// (see adler32_combine in zlib).
+func adler32Combine(adler1, adler2 uint32, len2 int) uint32 {
+	const base = 65521
+	rem := uint32(len2 % base)
+	sum1 := adler1 & 0xffff
+	sum2 := (rem * sum1) % base
+	sum1 += (adler2 & 0xffff) + base - 1
+	sum2 += (adler1 >> 16) + (adler2 >> 16) + base - rem
+	if sum1 >= base {
+		sum1 -= base
+	}
+	if sum1 >= base {
+		sum1 -= base
+	}
+	if sum2 >= base<<1 {
+		sum2 -= base << 1
+	}
+	if sum2 >= base {
+		sum2 -= base
+	}
+	return sum1 | (sum2 << 16)
+}
+
+// writePNGChunk writes a chunk with the given type and data.
+func writePNGChunk(w io.Writer, chunkType string, data []byte) error {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	copy(header[4:], chunkType)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	footer := make([]byte, 4)
+	binary.BigEndian.PutUint32(footer, crc.Sum32())
+	for _, part := range [][]byte{header, data, footer} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
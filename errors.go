@@ -0,0 +1,185 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"strings"
+)
+
+// This file contains errors callers can check for with errors.Is and
+// errors.As instead of matching the error messages. The errors are usually
+// wrapped, so a comparison with == doesn't work.
+
+var (
+	// ErrImageNotFound is returned if an id (or path) is not associated with
+	// an image, for example in a storage or mapper.
+	ErrImageNotFound = errors.New("Image not found")
+
+	// ErrUnsupportedFormat is returned if the format of an image or a file
+	// is not supported.
+	ErrUnsupportedFormat = errors.New("Unsupported format")
+)
+
+// ErrHistogramMismatch is returned if a histogram has not the expected number
+// of sub-divisions k. Path is the path of the image the histogram belongs to,
+// it's empty if the path is not known.
+type ErrHistogramMismatch struct {
+	Path        string
+	WantK, GotK uint
+}
+
+// Error returns a description of the mismatch.
+func (err ErrHistogramMismatch) Error() string {
+	if err.Path == "" {
+		return fmt.Sprintf("Invalid histogram: Illegal dimension: %d != %d", err.GotK, err.WantK)
+	}
+	return fmt.Sprintf("Invalid histogram for image \"%s\": Illegal dimension: %d != %d",
+		err.Path, err.GotK, err.WantK)
+}
+
+// wrapDecodeErr wraps image.ErrFormat (returned by image.Decode if the format
+// is not registered) with ErrUnsupportedFormat. Other errors are returned as
+// they are. name describes the image, for example the path.
+func wrapDecodeErr(name string, err error) error {
+	if err == image.ErrFormat {
+		return fmt.Errorf("Can't decode %s: %w", name, ErrUnsupportedFormat)
+	}
+	return err
+}
+
+// ImageErrorPolicy describes how the creation of GCHs, LCHs and features
+// handles database images that can't be read, for example corrupt files.
+type ImageErrorPolicy int
+
+const (
+	// ImageErrorsFail fails the whole creation if one image can't be read.
+	ImageErrorsFail ImageErrorPolicy = iota
+	// ImageErrorsSkip creates the data for all other images, images that can't
+	// be read are reported in the ImageErrorReport.
+	ImageErrorsSkip
+)
+
+func (policy ImageErrorPolicy) String() string {
+	switch policy {
+	case ImageErrorsFail:
+		return "fail"
+	case ImageErrorsSkip:
+		return "skip"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseImageErrorPolicy parses a policy, valid values are "fail" and "skip".
+func ParseImageErrorPolicy(s string) (ImageErrorPolicy, error) {
+	switch strings.ToLower(s) {
+	case "fail":
+		return ImageErrorsFail, nil
+	case "skip":
+		return ImageErrorsSkip, nil
+	default:
+		return -1, fmt.Errorf("Unkown image error policy: %s", s)
+	}
+}
+
+// ImageError is the error for a database image that can't be read. Path is
+// empty if the storage doesn't know the path of the image.
+type ImageError struct {
+	Image ImageID
+	Path  string
+	Err   error
+}
+
+func (err ImageError) Error() string {
+	if err.Path == "" {
+		return fmt.Sprintf("Can't read image %d: %s", err.Image, err.Err.Error())
+	}
+	return fmt.Sprintf("Can't read image \"%s\": %s", err.Path, err.Err.Error())
+}
+
+// Unwrap returns the wrapped error.
+func (err ImageError) Unwrap() error {
+	return err.Err
+}
+
+// ImageErrorReport describes the images that couldn't be read while creating
+// GCHs, LCHs or features.
+type ImageErrorReport struct {
+	// NumImages is the number of images that should be read.
+	NumImages int
+	// Skipped contains the images that couldn't be read, in the order of the
+	// ids they were created for. With ImageErrorsFail the creation failed if
+	// it's not empty.
+	Skipped []ImageError
+}
+
+// Err returns nil if all images were read and an error describing the number
+// of failed images and the first error otherwise.
+func (report *ImageErrorReport) Err() error {
+	switch len(report.Skipped) {
+	case 0:
+		return nil
+	case 1:
+		return report.Skipped[0]
+	default:
+		return fmt.Errorf("Failed to read %d of %d images, first error: %w",
+			len(report.Skipped), report.NumImages, report.Skipped[0])
+	}
+}
+
+// Paths returns the paths of all skipped images (empty paths are ignored).
+func (report *ImageErrorReport) Paths() []string {
+	res := make([]string, 0, len(report.Skipped))
+	for _, imgErr := range report.Skipped {
+		if imgErr.Path != "" {
+			res = append(res, imgErr.Path)
+		}
+	}
+	return res
+}
+
+// Merge adds the skipped images of other that are not skipped in report yet,
+// other may be nil.
+func (report *ImageErrorReport) Merge(other *ImageErrorReport) {
+	if other == nil {
+		return
+	}
+	for _, imgErr := range other.Skipped {
+		found := false
+		for _, existing := range report.Skipped {
+			if existing.Image == imgErr.Image {
+				found = true
+				break
+			}
+		}
+		if !found {
+			report.Skipped = append(report.Skipped, imgErr)
+		}
+	}
+}
+
+// imagePath returns the path of the image with the given id if storage is a
+// FSImageDB and an empty string otherwise.
+func imagePath(storage ImageStorage, id ImageID) string {
+	db, isFS := storage.(*FSImageDB)
+	if !isFS {
+		return ""
+	}
+	path, _ := db.mapper.GetPath(id)
+	return path
+}
@@ -0,0 +1,232 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// This file contains a minimal EXIF parser, the only thing we're interested
+// in is the orientation tag of JPEG images. Cameras usually don't rotate the
+// image data but store the orientation in the EXIF data, image.Decode ignores
+// this tag so portrait images are decoded in landscape. The ASCII tags are
+// read for the metadata of mosaics, see metadata.go.
+
+// exifOrientationTag is the EXIF tag containing the orientation.
+const exifOrientationTag = 0x0112
+
+// exifHeaderSize is the number of bytes read from the start of a file to find
+// the EXIF orientation without decoding the image. The EXIF data is stored at
+// the start of a JPEG file and a segment has at most 64 KB.
+const exifHeaderSize = 1 << 17
+
+// exifOrientations maps the value of the EXIF orientation tag (1 to 8) to the
+// orientation that must be applied to display the image correctly.
+var exifOrientations = map[uint16]Orientation{
+	1: OrientationNormal,
+	2: OrientationMirror,
+	3: OrientationRotate180,
+	4: OrientationMirrorRotate180,
+	5: OrientationMirrorRotate270,
+	6: OrientationRotate90,
+	7: OrientationMirrorRotate90,
+	8: OrientationRotate270,
+}
+
+// errEXIF is returned if the EXIF data is malformed.
+var errEXIF = errors.New("Invalid EXIF data")
+
+// EXIFOrientation returns the orientation that must be applied (see
+// OrientImage) to the image encoded in data to display it correctly.
+// If data is not a JPEG image or has no orientation tag OrientationNormal is
+// returned. An error is only returned if the EXIF data is malformed.
+func EXIFOrientation(data []byte) (Orientation, error) {
+	tiff, tiffErr := exifTIFF(data)
+	if tiffErr != nil || tiff == nil {
+		return OrientationNormal, tiffErr
+	}
+	order, entry, entryErr := tiffEntry(tiff, exifOrientationTag)
+	if entryErr != nil || entry == nil {
+		return OrientationNormal, entryErr
+	}
+	// the value is of type SHORT and stored in the first two bytes of the
+	// value field
+	if o, has := exifOrientations[order.Uint16(entry[8:])]; has {
+		return o, nil
+	}
+	// unknown values are ignored, they're not uncommon
+	return OrientationNormal, nil
+}
+
+// exifTIFF returns the TIFF data of the EXIF segment of a JPEG image. If data
+// is not a JPEG image or has no EXIF segment nil is returned.
+func exifTIFF(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		// not a jpeg
+		return nil, nil
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			return nil, errEXIF
+		}
+		marker := data[pos+1]
+		switch {
+		case marker == 0xff:
+			// fill byte
+			pos++
+			continue
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			// markers without length
+			pos += 2
+			continue
+		case marker == 0xd9 || marker == 0xda:
+			// end of image or start of scan: no EXIF data found
+			return nil, nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, errEXIF
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+		pos += 2 + length
+	}
+	return nil, nil
+}
+
+// tiffEntry searches the first IFD of the TIFF data for the tag and returns
+// the byte order and the 12 byte entry, nil if the tag was not found.
+func tiffEntry(tiff []byte, tag uint16) (binary.ByteOrder, []byte, error) {
+	if len(tiff) < 8 {
+		return nil, nil, errEXIF
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, nil, errEXIF
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return nil, nil, errEXIF
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return nil, nil, errEXIF
+	}
+	numEntries := int(order.Uint16(tiff[offset:]))
+	offset += 2
+	if offset+12*numEntries > len(tiff) {
+		return nil, nil, errEXIF
+	}
+	for i := 0; i < numEntries; i++ {
+		entry := tiff[offset+12*i : offset+12*i+12]
+		if order.Uint16(entry) == tag {
+			return order, entry, nil
+		}
+	}
+	return order, nil, nil
+}
+
+// tiffASCIITag returns the value of an ASCII tag from the first IFD of the
+// TIFF data, the empty string if the tag was not found.
+func tiffASCIITag(tiff []byte, tag uint16) (string, error) {
+	order, entry, entryErr := tiffEntry(tiff, tag)
+	if entryErr != nil || entry == nil {
+		return "", entryErr
+	}
+	if order.Uint16(entry[2:]) != 2 {
+		return "", errEXIF
+	}
+	count := int(order.Uint32(entry[4:]))
+	value := entry[8:12]
+	if count > 4 {
+		offset := int(order.Uint32(entry[8:]))
+		if offset < 0 || offset+count > len(tiff) {
+			return "", errEXIF
+		}
+		value = tiff[offset : offset+count]
+	} else {
+		value = value[:count]
+	}
+	// remove the terminating null byte
+	return string(bytes.TrimRight(value, "\x00")), nil
+}
+
+// logEXIFErr logs that the EXIF data of the image read from r is malformed,
+// the path is logged if r is a file.
+func logEXIFErr(r io.Reader, err error) {
+	fields := LogFields{"error": err}
+	if f, isFile := r.(*os.File); isFile {
+		fields["path"] = f.Name()
+	}
+	MapperLogger.Warn("Malformed EXIF data, ignoring it", fields)
+}
+
+// DecodeEXIF decodes an image and applies the orientation from the EXIF data,
+// see EXIFOrientation. Malformed EXIF data is ignored (the image is returned
+// as stored), a warning is logged (MapperLogger).
+func DecodeEXIF(r io.Reader) (image.Image, error) {
+	data, readErr := ioutil.ReadAll(r)
+	if readErr != nil {
+		return nil, readErr
+	}
+	img, _, decodeErr := image.Decode(bytes.NewReader(data))
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	o, exifErr := EXIFOrientation(data)
+	if exifErr != nil {
+		logEXIFErr(r, exifErr)
+		return img, nil
+	}
+	return OrientImage(img, o), nil
+}
+
+// DecodeConfigEXIF decodes the config of an image, width and height are
+// swapped if the EXIF orientation rotates the image by 90 or 270 degrees. As
+// DecodeEXIF malformed EXIF data is ignored.
+func DecodeConfigEXIF(r io.Reader) (image.Config, error) {
+	header := make([]byte, exifHeaderSize)
+	n, readErr := io.ReadFull(r, header)
+	if readErr != nil && readErr != io.ErrUnexpectedEOF && readErr != io.EOF {
+		return image.Config{}, readErr
+	}
+	header = header[:n]
+	config, _, decodeErr := image.DecodeConfig(io.MultiReader(bytes.NewReader(header), r))
+	if decodeErr != nil {
+		return config, decodeErr
+	}
+	o, exifErr := EXIFOrientation(header)
+	if exifErr != nil {
+		logEXIFErr(r, exifErr)
+		return config, nil
+	}
+	if o.Rotations()%2 == 1 {
+		config.Width, config.Height = config.Height, config.Width
+	}
+	return config, nil
+}
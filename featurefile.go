@@ -0,0 +1,249 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// This file contains functions for reading and writing files containing
+// precomputed features (GCHs, LCHs, ...). The format of a file is given by
+// its extension: ".gob" or ".json", optionally followed by ".gz" for gzip
+// compressed files (for example "gch-8.gob.gz").
+//
+// It also contains FeatureBundle, a container that stores all features of
+// a database in one file.
+
+// featureFileFormat returns the format of a file ("gob" or "json" for
+// supported files) and true if the file is gzip compressed.
+func featureFileFormat(path string) (string, bool) {
+	path = strings.ToLower(path)
+	compressed := strings.HasSuffix(path, ".gz")
+	if compressed {
+		path = strings.TrimSuffix(path, ".gz")
+	}
+	return strings.TrimPrefix(filepath.Ext(path), "."), compressed
+}
+
+// checkFeatureFileFormat returns an error if the format is not supported,
+// kind is the kind of features (for example "GCH") used in the error message.
+func checkFeatureFileFormat(format, kind string) error {
+	if format != "gob" && format != "json" {
+		return fmt.Errorf("%w for %s file: .%s. Should be \".json\" or \".gob\" (optionally followed by \".gz\")",
+			ErrUnsupportedFormat, kind, format)
+	}
+	return nil
+}
+
+// readFeatureFile decodes the content of the file into v (gob or json
+// depending on the file extension, see featureFileFormat).
+func readFeatureFile(path, kind string, v interface{}) error {
+	format, compressed := featureFileFormat(path)
+	if formatErr := checkFeatureFileFormat(format, kind); formatErr != nil {
+		return formatErr
+	}
+	return decodeFeatureFile(path, format, compressed, v)
+}
+
+// writeFeatureFile encodes v and writes it to the file (gob or json depending
+// on the file extension, see featureFileFormat).
+func writeFeatureFile(path, kind string, v interface{}) error {
+	format, compressed := featureFileFormat(path)
+	if formatErr := checkFeatureFileFormat(format, kind); formatErr != nil {
+		return formatErr
+	}
+	return encodeFeatureFile(path, format, compressed, v)
+}
+
+// decodeFeatureFile decodes the content of the file into v, format must be
+// "gob" or "json". The format is not checked, this way the controllers can
+// read files with any extension (see for example
+// HistogramFSController.ReadGobFile).
+func decodeFeatureFile(path, format string, compressed bool, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if compressed {
+		gz, gzErr := gzip.NewReader(f)
+		if gzErr != nil {
+			return gzErr
+		}
+		defer gz.Close()
+		r = gz
+	}
+	if format == "json" {
+		return json.NewDecoder(r).Decode(v)
+	}
+	return gob.NewDecoder(r).Decode(v)
+}
+
+// encodeFeatureFile encodes v and writes it to the file, see
+// decodeFeatureFile.
+func encodeFeatureFile(path, format string, compressed bool, v interface{}) error {
+	// the file is not closed with defer, the error of Close must be returned
+	// on success (the content may not be written otherwise)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = f
+	var gz *gzip.Writer
+	if compressed {
+		gz = gzip.NewWriter(f)
+		w = gz
+	}
+	if format == "json" {
+		err = json.NewEncoder(w).Encode(v)
+	} else {
+		err = gob.NewEncoder(w).Encode(v)
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// relativeFeaturePath returns path relative to root, an error is returned if
+// path is not inside root. Paths are stored with slashes as separator, this
+// way files can be used on other operating systems as well.
+func relativeFeaturePath(root, path string) (string, error) {
+	rel, relErr := filepath.Rel(root, path)
+	if relErr != nil {
+		return "", relErr
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Image %s is not inside the root directory %s", path, root)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// rebaseFeatureRoot is used to implement Rebase for the controllers: It
+// returns the root the relative paths should be joined with. oldRoot is the
+// root the paths were made relative to (empty if the paths are absolute)
+// and newRoot the root given by the user (empty to use oldRoot).
+func rebaseFeatureRoot(oldRoot, newRoot string) (string, error) {
+	switch {
+	case oldRoot == "" && newRoot != "":
+		return "", errors.New("File contains absolute paths, it can't be rebased (save it with a root directory)")
+	case newRoot == "":
+		return oldRoot, nil
+	default:
+		return newRoot, nil
+	}
+}
+
+// makeRelativeFeaturePaths is used to implement MakeRelative for the
+// controllers: paths points to the paths of all entries and oldRoot is the
+// root of the controller (empty if the paths are absolute). If an error is
+// returned no path is changed.
+func makeRelativeFeaturePaths(oldRoot, root string, paths []*string) error {
+	if oldRoot != "" {
+		return errors.New("Paths are already relative")
+	}
+	rels := make([]string, len(paths))
+	for i, path := range paths {
+		rel, relErr := relativeFeaturePath(root, *path)
+		if relErr != nil {
+			return relErr
+		}
+		rels[i] = rel
+	}
+	for i, rel := range rels {
+		*paths[i] = rel
+	}
+	return nil
+}
+
+// rebaseFeaturePaths is used to implement Rebase for the controllers, see
+// rebaseFeatureRoot and makeRelativeFeaturePaths. It returns true if the
+// paths have been joined with the root, the root of the controller must be
+// cleared in this case.
+func rebaseFeaturePaths(oldRoot, root string, paths []*string) (bool, error) {
+	newRoot, rootErr := rebaseFeatureRoot(oldRoot, root)
+	if rootErr != nil || newRoot == "" {
+		return false, rootErr
+	}
+	for _, path := range paths {
+		*path = filepath.Join(newRoot, filepath.FromSlash(*path))
+	}
+	return true, nil
+}
+
+// FeatureBundle stores all precomputed features of a database in one file,
+// this simplifies the distribution of precomputed data. Each of the features
+// is optional (nil if not present).
+type FeatureBundle struct {
+	GCH     *HistogramFSController
+	LCH     *LCHFSController
+	Version string
+
+	// FormatVersion is the version of the file format, see FSFormatVersion.
+	FormatVersion int
+}
+
+// ReadFile reads the bundle from a file, see featureFileFormat for the
+// supported extensions. The contained controllers are migrated to the
+// current format.
+func (b *FeatureBundle) ReadFile(path string) error {
+	if err := readFeatureFile(path, "bundle", b); err != nil {
+		return err
+	}
+	if _, versionErr := checkFormatVersion(b.FormatVersion, b.Version); versionErr != nil {
+		return versionErr
+	}
+	if b.GCH != nil {
+		if err := MigrateHistogramFSController(b.GCH); err != nil {
+			return err
+		}
+	}
+	if b.LCH != nil {
+		if err := MigrateLCHFSController(b.LCH); err != nil {
+			return err
+		}
+	}
+	b.FormatVersion = FSFormatVersion
+	return nil
+}
+
+// WriteFile writes the bundle to a file, see featureFileFormat for the
+// supported extensions.
+func (b *FeatureBundle) WriteFile(path string) error {
+	b.Version = Version
+	b.FormatVersion = FSFormatVersion
+	if b.GCH != nil {
+		b.GCH.Version = Version
+		b.GCH.FormatVersion = FSFormatVersion
+	}
+	if b.LCH != nil {
+		b.LCH.Version = Version
+		b.LCH.FormatVersion = FSFormatVersion
+	}
+	return writeFeatureFile(path, "bundle", b)
+}
@@ -0,0 +1,566 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file contains a generic interface for image features: GCHs, LCHs,
+// average colors and future features are all represented as feature vectors
+// ([]float64). A FeatureExtractor computes the vector of an image, a
+// FeatureStorage maps database images to their vectors and a FeatureMetric
+// compares two vectors. This way features can be created, saved, loaded and
+// used for mosaics with the same code.
+//
+// Extractors are registered by name (see RegisterFeatureExtractor) and
+// described by a descriptor string: The name followed by the parameters, for
+// example "gch k=8" or "lch k=8 scheme=5".
+
+// FeatureMetric compares two feature vectors, the smaller the value the more
+// similar the images.
+type FeatureMetric func(p, q []float64) float64
+
+// FeatureExtractor computes the feature vector of an image. All vectors
+// computed by an extractor have the same length.
+type FeatureExtractor interface {
+	// Descriptor returns the name of the extractor followed by its parameters,
+	// see ParseFeatureExtractor.
+	Descriptor() string
+	// Extract computes the feature vector of an image.
+	Extract(img image.Image) ([]float64, error)
+	// Metric returns the metric for the feature vectors given a histogram
+	// metric (see GetHistogramMetric).
+	Metric(metric HistogramMetric) FeatureMetric
+}
+
+// FeatureStorage maps image ids to feature vectors.
+//
+// Implementations must be safe for concurrent use.
+type FeatureStorage interface {
+	GetFeature(id ImageID) ([]float64, error)
+	// Extractor returns the extractor the features were computed with.
+	Extractor() FeatureExtractor
+}
+
+// FeatureFactory creates an extractor given the parameters (for example
+// {"k": "8"}). Missing parameters should be set to a default value.
+type FeatureFactory func(params map[string]string) (FeatureExtractor, error)
+
+var (
+	featureFactories = make(map[string]FeatureFactory)
+)
+
+// RegisterFeatureExtractor is used to register a named feature extractor. It
+// will only add the extractor if the name does not exist yet. The result is
+// true if the extractor was successfully registered and false otherwise.
+// Some extractors are registered by default (for example "gch", "lch" and
+// "average").
+// All names must be lowercase strings, the register and get methods will
+// always transform a string to lowercase.
+//
+// All extractors should be registered by an init method.
+func RegisterFeatureExtractor(name string, factory FeatureFactory) bool {
+	name = strings.ToLower(name)
+	if _, has := featureFactories[name]; has || name == "" {
+		return false
+	}
+	featureFactories[name] = factory
+	return true
+}
+
+// GetFeatureExtractorNames returns the sorted names of all registered feature
+// extractors.
+func GetFeatureExtractorNames() []string {
+	res := make([]string, 0, len(featureFactories))
+	for name := range featureFactories {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// ParseFeatureExtractor creates a registered extractor. The first argument is
+// the name of the extractor, all other arguments are parameters of the form
+// key=value. A descriptor (see FeatureExtractor) can be parsed with
+// ParseFeatureExtractor(strings.Fields(descriptor)...).
+func ParseFeatureExtractor(args ...string) (FeatureExtractor, error) {
+	if len(args) == 0 {
+		return nil, errors.New("No feature given")
+	}
+	name := strings.ToLower(args[0])
+	factory, has := featureFactories[name]
+	if !has {
+		return nil, fmt.Errorf("Unkown feature %s, must be one of %s", args[0],
+			strings.Join(GetFeatureExtractorNames(), ", "))
+	}
+	params := make(map[string]string, len(args)-1)
+	for _, arg := range args[1:] {
+		split := strings.SplitN(arg, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("Invalid parameter for feature %s, must be of the form key=value: %s", name, arg)
+		}
+		params[strings.ToLower(split[0])] = split[1]
+	}
+	return factory(params)
+}
+
+// featureParams is a helper for FeatureFactories: It returns an error if
+// params contains a key that is not in allowed.
+func featureParams(name string, params map[string]string, allowed ...string) error {
+	for key := range params {
+		found := false
+		for _, a := range allowed {
+			found = found || key == a
+		}
+		if !found {
+			return fmt.Errorf("Unkown parameter for feature %s: %s", name, key)
+		}
+	}
+	return nil
+}
+
+// GCHExtractor computes normalized GCHs with K sub-divisions.
+type GCHExtractor struct {
+	K uint
+}
+
+// Descriptor returns "gch k=<k>".
+func (e GCHExtractor) Descriptor() string {
+	return fmt.Sprintf("gch k=%d", e.K)
+}
+
+// Extract returns the entries of the GCH.
+func (e GCHExtractor) Extract(img image.Image) ([]float64, error) {
+	return GenHistogram(img, e.K, true).Entries, nil
+}
+
+// Metric compares the vectors as histograms.
+func (e GCHExtractor) Metric(metric HistogramMetric) FeatureMetric {
+	return histogramFeatureMetric(metric, e.K)
+}
+
+// LCHExtractor computes normalized LCHs with K sub-divisions, Scheme is the
+// descriptor of the scheme (see ParseLCHScheme).
+type LCHExtractor struct {
+	K      uint
+	Scheme string
+
+	scheme LCHScheme
+	size   uint
+}
+
+// NewLCHExtractor returns a new extractor, an error is returned if the scheme
+// is invalid.
+func NewLCHExtractor(k uint, scheme string) (*LCHExtractor, error) {
+	parsed, schemeErr := ParseLCHScheme(scheme)
+	if schemeErr != nil {
+		return nil, schemeErr
+	}
+	size, sizeErr := LCHSchemeSize(scheme)
+	if sizeErr != nil {
+		return nil, sizeErr
+	}
+	return &LCHExtractor{K: k, Scheme: scheme, scheme: parsed, size: size}, nil
+}
+
+// Descriptor returns "lch k=<k> scheme=<scheme>".
+func (e *LCHExtractor) Descriptor() string {
+	return fmt.Sprintf("lch k=%d scheme=%s", e.K, e.Scheme)
+}
+
+// Extract returns the entries of all histograms of the LCH.
+func (e *LCHExtractor) Extract(img image.Image) ([]float64, error) {
+	lch, lchErr := GenLCH(e.scheme, img, e.K, true)
+	if lchErr != nil {
+		return nil, lchErr
+	}
+	res := make([]float64, 0, uint(len(lch.Histograms))*e.K*e.K*e.K)
+	for _, hist := range lch.Histograms {
+		res = append(res, hist.Entries...)
+	}
+	return res, nil
+}
+
+// Metric returns the sum of the metric over the histograms of the LCH, see
+// LCH.Dist.
+func (e *LCHExtractor) Metric(metric HistogramMetric) FeatureMetric {
+	n := int(e.K * e.K * e.K)
+	part := histogramFeatureMetric(metric, e.K)
+	return func(p, q []float64) float64 {
+		var sum float64
+		for start := 0; start+n <= len(p) && start+n <= len(q); start += n {
+			sum += part(p[start:start+n], q[start:start+n])
+		}
+		return sum
+	}
+}
+
+// AverageColorExtractor computes the average color of an image, the vector
+// contains the red, green and blue component (scaled to [0, 1]).
+type AverageColorExtractor struct{}
+
+// Descriptor returns "average".
+func (e AverageColorExtractor) Descriptor() string {
+	return "average"
+}
+
+// Extract returns the average color.
+func (e AverageColorExtractor) Extract(img image.Image) ([]float64, error) {
+	c := ComputeAverageColor(img)
+	return []float64{float64(c.R) / 255.0, float64(c.G) / 255.0, float64(c.B) / 255.0}, nil
+}
+
+// Metric compares the colors as vectors of length three.
+func (e AverageColorExtractor) Metric(metric HistogramMetric) FeatureMetric {
+	return histogramFeatureMetric(metric, 0)
+}
+
+// histogramFeatureMetric compares two vectors as histograms with k
+// sub-divisions.
+func histogramFeatureMetric(metric HistogramMetric, k uint) FeatureMetric {
+	return func(p, q []float64) float64 {
+		return metric(&Histogram{Entries: p, K: k}, &Histogram{Entries: q, K: k})
+	}
+}
+
+// parseFeatureK parses the parameter k (default 8), it must be between 1 and
+// 256.
+func parseFeatureK(params map[string]string) (uint, error) {
+	kStr, has := params["k"]
+	if !has {
+		return 8, nil
+	}
+	k, parseErr := strconv.Atoi(kStr)
+	if parseErr != nil || k < 1 || k > 256 {
+		return 0, fmt.Errorf("k must be a value between 1 and 256, got %s", kStr)
+	}
+	return uint(k), nil
+}
+
+func init() {
+	RegisterFeatureExtractor("gch", func(params map[string]string) (FeatureExtractor, error) {
+		if paramsErr := featureParams("gch", params, "k"); paramsErr != nil {
+			return nil, paramsErr
+		}
+		k, kErr := parseFeatureK(params)
+		if kErr != nil {
+			return nil, kErr
+		}
+		return GCHExtractor{K: k}, nil
+	})
+	RegisterFeatureExtractor("lch", func(params map[string]string) (FeatureExtractor, error) {
+		if paramsErr := featureParams("lch", params, "k", "scheme"); paramsErr != nil {
+			return nil, paramsErr
+		}
+		k, kErr := parseFeatureK(params)
+		if kErr != nil {
+			return nil, kErr
+		}
+		scheme, has := params["scheme"]
+		if !has {
+			scheme = "5"
+		}
+		return NewLCHExtractor(k, scheme)
+	})
+	RegisterFeatureExtractor("average", func(params map[string]string) (FeatureExtractor, error) {
+		if paramsErr := featureParams("average", params); paramsErr != nil {
+			return nil, paramsErr
+		}
+		return AverageColorExtractor{}, nil
+	})
+}
+
+// MemoryFeatureStorage implements FeatureStorage by keeping the features of
+// all images in memory, Features[id] is the vector of image id.
+type MemoryFeatureStorage struct {
+	FeatureExtractor FeatureExtractor
+	Features         [][]float64
+}
+
+// GetFeature returns the vector of an image.
+func (s *MemoryFeatureStorage) GetFeature(id ImageID) ([]float64, error) {
+	if int(id) < 0 || int(id) >= len(s.Features) || s.Features[id] == nil {
+		return nil, fmt.Errorf("Can't find feature for image with id %d: %w", id, ErrImageNotFound)
+	}
+	return s.Features[id], nil
+}
+
+// Extractor returns the extractor of the features.
+func (s *MemoryFeatureStorage) Extractor() FeatureExtractor {
+	return s.FeatureExtractor
+}
+
+// HistogramStorage converts the features to a GCH storage, the result is nil
+// if the features are not GCHs.
+func (s *MemoryFeatureStorage) HistogramStorage() *MemoryHistStorage {
+	gch, isGCH := s.FeatureExtractor.(GCHExtractor)
+	if !isGCH {
+		return nil
+	}
+	res := NewMemoryHistStorage(gch.K, len(s.Features))
+	for _, entries := range s.Features {
+		res.Histograms = append(res.Histograms, &Histogram{Entries: entries, K: gch.K})
+	}
+	return res
+}
+
+// LCHStorage converts the features to an LCH storage, the result is nil if
+// the features are not LCHs.
+func (s *MemoryFeatureStorage) LCHStorage() *MemoryLCHStorage {
+	lch, isLCH := s.FeatureExtractor.(*LCHExtractor)
+	if !isLCH {
+		return nil
+	}
+	res := NewMemoryLCHStorage(lch.K, lch.size, len(s.Features))
+	res.Scheme = lch.Scheme
+	n := lch.K * lch.K * lch.K
+	for _, entries := range s.Features {
+		histograms := make([]*Histogram, 0, lch.size)
+		for start := uint(0); start+n <= uint(len(entries)); start += n {
+			histograms = append(histograms, &Histogram{Entries: entries[start : start+n], K: lch.K})
+		}
+		res.LCHs = append(res.LCHs, NewLCH(histograms))
+	}
+	return res
+}
+
+// Retain keeps only the features for the given ids (in the given order), see
+// MemoryHistStorage.Retain.
+func (s *MemoryFeatureStorage) Retain(ids []ImageID) {
+	features := make([][]float64, len(ids))
+	for i, id := range ids {
+		features[i] = s.Features[id]
+	}
+	s.Features = features
+}
+
+// ExtractFeatures computes the features of the images with the given ids,
+// numRoutines images are processed concurrently. The result contains the
+// feature of ids[i] on position i.
+func ExtractFeatures(extractor FeatureExtractor, ids []ImageID, storage ImageStorage,
+	numRoutines int, progress ProgressFunc) ([][]float64, error) {
+	res, _, err := ExtractFeaturesWithPolicy(extractor, ids, storage, numRoutines, progress, ImageErrorsFail)
+	return res, err
+}
+
+// ExtractFeaturesWithPolicy works as ExtractFeatures, policy describes how
+// images that can't be read are handled. With ImageErrorsSkip the features of
+// skipped images are nil, they're listed in the returned report.
+func ExtractFeaturesWithPolicy(extractor FeatureExtractor, ids []ImageID, storage ImageStorage,
+	numRoutines int, progress ProgressFunc, policy ImageErrorPolicy) ([][]float64, *ImageErrorReport, error) {
+	res := make([][]float64, len(ids))
+	errs := make([]error, len(ids))
+	onImage := func(pos int, img image.Image) {
+		res[pos], errs[pos] = extractor.Extract(img)
+	}
+	report, err := forEachImageWithPolicy(ids, storage, numRoutines, onImage, progress, policy)
+	if err != nil {
+		return nil, report, err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, report, err
+		}
+	}
+	return res, report, nil
+}
+
+// CreateFeatures computes the features of all images in the storage, see
+// ExtractFeatures.
+func CreateFeatures(extractor FeatureExtractor, storage ImageStorage, numRoutines int,
+	progress ProgressFunc) (*MemoryFeatureStorage, error) {
+	features, _, err := CreateFeaturesWithPolicy(extractor, storage, numRoutines, progress, ImageErrorsFail)
+	return features, err
+}
+
+// CreateFeaturesWithPolicy works as CreateFeatures, see
+// ExtractFeaturesWithPolicy for the policy.
+func CreateFeaturesWithPolicy(extractor FeatureExtractor, storage ImageStorage, numRoutines int,
+	progress ProgressFunc, policy ImageErrorPolicy) (*MemoryFeatureStorage, *ImageErrorReport, error) {
+	features, report, err := ExtractFeaturesWithPolicy(extractor, IDList(storage), storage,
+		numRoutines, progress, policy)
+	if err != nil {
+		return nil, report, err
+	}
+	return &MemoryFeatureStorage{FeatureExtractor: extractor, Features: features}, report, nil
+}
+
+// FeatureImageMetric implements ImageMetric for any feature: The feature
+// vectors of the tiles are computed with the extractor of the storage and
+// compared with Metric.
+type FeatureImageMetric struct {
+	Storage     FeatureStorage
+	Metric      FeatureMetric
+	TileData    [][][]float64
+	NumRoutines int
+}
+
+// NewFeatureImageMetric returns a new metric, the histogram metric is
+// converted to a feature metric by the extractor of the storage.
+func NewFeatureImageMetric(storage FeatureStorage, metric HistogramMetric, numRoutines int) *FeatureImageMetric {
+	return &FeatureImageMetric{
+		Storage:     storage,
+		Metric:      storage.Extractor().Metric(metric),
+		NumRoutines: numRoutines,
+	}
+}
+
+// InitStorage does nothing.
+func (m *FeatureImageMetric) InitStorage(storage ImageStorage) error {
+	return nil
+}
+
+// InitTiles concurrently computes the feature vectors of the tiles.
+func (m *FeatureImageMetric) InitTiles(storage ImageStorage, query image.Image, dist TileDivision) error {
+	extractor := m.Storage.Extractor()
+	init := func(tiles Tiles) error {
+		m.TileData = make([][][]float64, len(tiles))
+		for i, col := range tiles {
+			m.TileData[i] = make([][]float64, len(col))
+		}
+		return nil
+	}
+	onTile := func(i, j int, tileImage image.Image) error {
+		feature, featureErr := extractor.Extract(tileImage)
+		if featureErr != nil {
+			return featureErr
+		}
+		m.TileData[i][j] = feature
+		return nil
+	}
+	return InitTilesHelper(storage, query, dist, m.NumRoutines, init, onTile)
+}
+
+// Compare compares the vector of the database image and the tile.
+func (m *FeatureImageMetric) Compare(storage ImageStorage, image ImageID, tileY, tileX int) (float64, error) {
+	feature, featureErr := m.Storage.GetFeature(image)
+	if featureErr != nil {
+		return -1.0, featureErr
+	}
+	return m.Metric(m.TileData[tileY][tileX], feature), nil
+}
+
+// TileHash returns the hash of the tile vector, see TileFeatureHasher.
+func (m *FeatureImageMetric) TileHash(tileY, tileX int) uint64 {
+	h := fnv.New64a()
+	hashHistogram(h, &Histogram{Entries: m.TileData[tileY][tileX]})
+	return h.Sum64()
+}
+
+// FeatureFSEntry is the feature vector of an image stored on the filesystem.
+type FeatureFSEntry struct {
+	Path    string
+	Feature []float64
+}
+
+// FeatureFile stores feature vectors on the filesystem, see featureFileFormat
+// for the supported formats.
+type FeatureFile struct {
+	// Descriptor is the descriptor of the extractor, see FeatureExtractor.
+	Descriptor string
+	Entries    []FeatureFSEntry
+	// Root is the directory the paths are relative to, empty if the paths are
+	// absolute.
+	Root          string
+	Version       string
+	FormatVersion int
+}
+
+// NewFeatureFile creates the file content for the features, mapper is used to
+// get the path of an image. If root is not empty the paths are stored
+// relative to root.
+func NewFeatureFile(mapper *FSMapper, storage *MemoryFeatureStorage, root string) (*FeatureFile, error) {
+	res := &FeatureFile{
+		Descriptor: storage.FeatureExtractor.Descriptor(),
+		Entries:    make([]FeatureFSEntry, 0, len(storage.Features)),
+		Root:       root,
+	}
+	for id, feature := range storage.Features {
+		path, ok := mapper.GetPath(ImageID(id))
+		if !ok {
+			return nil, fmt.Errorf("Can't retrieve path for image with id %d: %w", id, ErrImageNotFound)
+		}
+		if root != "" {
+			var relErr error
+			if path, relErr = relativeFeaturePath(root, path); relErr != nil {
+				return nil, relErr
+			}
+		}
+		res.Entries = append(res.Entries, FeatureFSEntry{Path: path, Feature: feature})
+	}
+	return res, nil
+}
+
+// ReadFile reads the features from a file.
+func (f *FeatureFile) ReadFile(path string) error {
+	return readFeatureFile(path, "feature", f)
+}
+
+// WriteFile writes the features to a file.
+func (f *FeatureFile) WriteFile(path string) error {
+	f.Version = Version
+	f.FormatVersion = FSFormatVersion
+	return writeFeatureFile(path, "feature", f)
+}
+
+// Storage returns the storage for the images of the mapper. root is the
+// directory the relative paths are joined with, if it's empty Root is used
+// (see rebaseFeatureRoot). An error is returned if an image of the mapper
+// has no feature vector.
+func (f *FeatureFile) Storage(mapper *FSMapper, root string) (*MemoryFeatureStorage, error) {
+	extractor, extractorErr := ParseFeatureExtractor(strings.Fields(f.Descriptor)...)
+	if extractorErr != nil {
+		return nil, extractorErr
+	}
+	root, rootErr := rebaseFeatureRoot(f.Root, root)
+	if rootErr != nil {
+		return nil, rootErr
+	}
+	byPath := make(map[string][]float64, len(f.Entries))
+	for _, entry := range f.Entries {
+		path := entry.Path
+		if root != "" {
+			path = filepath.Join(root, filepath.FromSlash(path))
+		}
+		byPath[path] = entry.Feature
+	}
+	res := &MemoryFeatureStorage{
+		FeatureExtractor: extractor,
+		Features:         make([][]float64, mapper.Len()),
+	}
+	numMissing := 0
+	for id := range res.Features {
+		path, _ := mapper.GetPath(ImageID(id))
+		feature, has := byPath[path]
+		if !has {
+			numMissing++
+			continue
+		}
+		res.Features[id] = feature
+	}
+	if numMissing > 0 {
+		return nil, fmt.Errorf("No features for %d images, features must be re-computed: %w",
+			numMissing, ErrImageNotFound)
+	}
+	return res, nil
+}
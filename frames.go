@@ -0,0 +1,191 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// This file contains functions to create a mosaic for each frame of an
+// animation (like an animated GIF).
+
+// FrameDivider computes the division of a frame (used for selection) and the
+// division of the mosaic for that frame. Both divisions must have the same
+// structure.
+type FrameDivider func(frame image.Image) (TileDivision, TileDivision)
+
+// FrameTransformFunc returns the TileTransform that is used during the
+// composition of the mosaic for a frame. dist is the division of the frame.
+// It may return nil if no transformation should be applied.
+type FrameTransformFunc func(frame image.Image, dist TileDivision) (TileTransform, error)
+
+// ComposeMosaicFrames composes a mosaic for each frame. The selector is
+// initialized once and then used for all frames, thus the features of the
+// database images are loaded only once. Also the cache of scaled database
+// images is shared between all frames, since consecutive frames usually are
+// very similar this speeds up the composition a lot.
+//
+// transforms and cache may be nil, see ComposeMosaic for the other arguments.
+// progress is called after each frame (not each tile).
+func ComposeMosaicFrames(storage ImageStorage, selector ImageSelector,
+	frames []image.Image, divide FrameDivider, transforms FrameTransformFunc,
+	resizer ImageResizer, s ResizeStrategy, border TileBorder, numRoutines int,
+	cache *ImageCache, progress ProgressFunc) ([]image.Image, error) {
+	if initErr := selector.Init(storage); initErr != nil {
+		return nil, initErr
+	}
+	if cache == nil {
+		cache = NewImageCache(ImageCacheSize)
+	}
+	res := make([]image.Image, len(frames))
+	for i, frame := range frames {
+		dist, mosaicDist := divide(frame)
+		selection, selectionErr := selector.SelectImages(storage, frame, dist, nil)
+		if selectionErr != nil {
+			return nil, fmt.Errorf("Can't select images for frame %d: %s", i, selectionErr.Error())
+		}
+		var transform TileTransform
+		if transforms != nil {
+			var transformErr error
+			transform, transformErr = transforms(frame, dist)
+			if transformErr != nil {
+				return nil, transformErr
+			}
+		}
+		mosaic, mosaicErr := ComposeMosaic(storage, selection, mosaicDist,
+			resizer, s, transform, border, numRoutines, cache, nil)
+		if mosaicErr != nil {
+			return nil, fmt.Errorf("Can't compose mosaic for frame %d: %s", i, mosaicErr.Error())
+		}
+		res[i] = mosaic
+		if progress != nil {
+			progress(i + 1)
+		}
+	}
+	return res, nil
+}
+
+// DecodeGIFFrames decodes all frames of an animated GIF. Frames in a GIF
+// may only describe the part of the image that changes, the frames returned
+// are the complete images as they're displayed.
+// The second result contains the delay of each frame (in 100ths of a second).
+func DecodeGIFFrames(r io.Reader) ([]image.Image, []int, error) {
+	g, decodeErr := gif.DecodeAll(r)
+	if decodeErr != nil {
+		return nil, nil, decodeErr
+	}
+	if len(g.Image) == 0 {
+		return nil, nil, errors.New("GIF doesn't contain any frames")
+	}
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		bounds = g.Image[0].Bounds()
+	}
+	canvas := image.NewRGBA(bounds)
+	res := make([]image.Image, len(g.Image))
+	for i, frame := range g.Image {
+		var previous *image.RGBA
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, bounds.Min, draw.Src)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		current := image.NewRGBA(bounds)
+		draw.Draw(current, bounds, canvas, bounds.Min, draw.Src)
+		res[i] = current
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return res, g.Delay, nil
+}
+
+// LoadFrameDir loads all images (.jpg and .png) from a directory as frames.
+// The frames are sorted by their file name.
+func LoadFrameDir(dir string) ([]image.Image, error) {
+	files, readErr := ioutil.ReadDir(dir)
+	if readErr != nil {
+		return nil, readErr
+	}
+	names := make([]string, 0, len(files))
+	for _, info := range files {
+		if info.Mode().IsRegular() && JPGAndPNG(filepath.Ext(info.Name())) {
+			names = append(names, info.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No frames found in %s", dir)
+	}
+	sort.Strings(names)
+	res := make([]image.Image, len(names))
+	for i, name := range names {
+		img, imgErr := loadFrame(filepath.Join(dir, name))
+		if imgErr != nil {
+			return nil, imgErr
+		}
+		res[i] = img
+	}
+	return res, nil
+}
+
+func loadFrame(path string) (image.Image, error) {
+	r, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer r.Close()
+	img, _, decodeErr := image.Decode(r)
+	return img, decodeErr
+}
+
+// EncodeGIFFrames writes the frames as an animated GIF. Each frame is
+// converted to a paletted image (with Floyd-Steinberg dithering).
+// delays contains the delay for each frame in 100ths of a second, if it
+// contains less entries than frames defaultDelay is used.
+func EncodeGIFFrames(w io.Writer, frames []image.Image, delays []int, defaultDelay int) error {
+	g := &gif.GIF{
+		Image: make([]*image.Paletted, len(frames)),
+		Delay: make([]int, len(frames)),
+	}
+	for i, frame := range frames {
+		bounds := frame.Bounds()
+		paletted := image.NewPaletted(bounds, palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, bounds, frame, bounds.Min)
+		g.Image[i] = paletted
+		if i < len(delays) {
+			g.Delay[i] = delays[i]
+		} else {
+			g.Delay[i] = defaultDelay
+		}
+	}
+	return gif.EncodeAll(w, g)
+}
@@ -15,12 +15,8 @@
 package gomosaic
 
 import (
-	"encoding/gob"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
 	"strings"
 )
 
@@ -40,10 +36,31 @@ import (
 //
 // This is however not supported at the moment. An empty string signals that
 // no checksum was computed.
+//
+// To save space the histogram can be stored as CompactHistogram or
+// SparseHistogram instead, in this case Histogram is nil and Compact or Sparse
+// is set, see HistogramFSController.Compact and HistogramFSController.Sparse.
 type HistogramFSEntry struct {
 	Path      string
 	Histogram *Histogram
 	Checksum  string
+	Compact   *CompactHistogram `json:",omitempty"`
+	Sparse    *SparseHistogram  `json:",omitempty"`
+}
+
+// GetHistogram returns the histogram of the entry, a compact or sparse
+// histogram is converted.
+func (entry HistogramFSEntry) GetHistogram() *Histogram {
+	switch {
+	case entry.Histogram != nil:
+		return entry.Histogram
+	case entry.Compact != nil:
+		return entry.Compact.Histogram()
+	case entry.Sparse != nil:
+		return entry.Sparse.Histogram()
+	default:
+		return nil
+	}
 }
 
 // NewHistogramFSEntry returns a new entry with the given content.
@@ -65,8 +82,9 @@ func NewHistogramFSEntry(path string, histogram *Histogram, checksum string) His
 // histograms to HistogramStorage, maybe perform some tests if all images
 // in the database are present in the controller.
 //
-// It also has a version field that is set to the Version variable when saving.
-// This can be useful if the definition should ever change.
+// It also has a version field that is set to the Version variable when saving
+// and a format version (see FSFormatVersion). Files with an older format are
+// migrated when they're read.
 //
 // See MissingEntries, AddtionalEntries and MemHistStorageFromFSMapper for
 // some examples.
@@ -74,6 +92,13 @@ type HistogramFSController struct {
 	Entries []HistogramFSEntry
 	K       uint
 	Version string
+
+	// FormatVersion is the version of the file format, see FSFormatVersion.
+	FormatVersion int
+
+	// Root is the directory the paths of the entries are relative to, it's
+	// empty if the paths are absolute. See MakeRelative and Rebase.
+	Root string
 }
 
 // NewHistogramFSController creates an empty file system controller with the
@@ -86,9 +111,10 @@ func NewHistogramFSController(capacity int, k uint) *HistogramFSController {
 		capacity = 100
 	}
 	return &HistogramFSController{
-		Entries: make([]HistogramFSEntry, 0, capacity),
-		K:       k,
-		Version: Version,
+		Entries:       make([]HistogramFSEntry, 0, capacity),
+		K:             k,
+		Version:       Version,
+		FormatVersion: FSFormatVersion,
 	}
 }
 
@@ -106,7 +132,7 @@ func CreateHistFSController(ids []ImageID, mapper *FSMapper, storage HistogramSt
 		// lookup file name
 		path, ok := mapper.GetPath(id)
 		if !ok {
-			return nil, fmt.Errorf("Can't retrieve path for image with id %d", id)
+			return nil, fmt.Errorf("Can't retrieve path for image with id %d: %w", id, ErrImageNotFound)
 		}
 		// lookup histogram
 		hist, histErr := storage.GetHistogram(id)
@@ -118,87 +144,132 @@ func CreateHistFSController(ids []ImageID, mapper *FSMapper, storage HistogramSt
 	return res, nil
 }
 
+// Compact converts all histograms to compact histograms, this halves the size
+// of the written files.
+func (c *HistogramFSController) Compact() {
+	for i, entry := range c.Entries {
+		if entry.Histogram != nil {
+			c.Entries[i].Compact = NewCompactHistogram(entry.Histogram)
+			c.Entries[i].Histogram = nil
+		}
+	}
+}
+
+// IsCompact returns true if the controller contains at least one histogram
+// and all histograms are compact histograms.
+func (c *HistogramFSController) IsCompact() bool {
+	for _, entry := range c.Entries {
+		if entry.Compact == nil {
+			return false
+		}
+	}
+	return len(c.Entries) > 0
+}
+
+// IsSparse returns true if the controller contains at least one histogram
+// and all histograms are sparse histograms.
+func (c *HistogramFSController) IsSparse() bool {
+	for _, entry := range c.Entries {
+		if entry.Sparse == nil {
+			return false
+		}
+	}
+	return len(c.Entries) > 0
+}
+
+// Sparse converts all histograms to sparse histograms, for histograms with
+// many zero entries this reduces the size of the written files.
+func (c *HistogramFSController) Sparse() {
+	for i, entry := range c.Entries {
+		if entry.Histogram != nil {
+			c.Entries[i].Sparse = NewSparseHistogram(entry.Histogram)
+			c.Entries[i].Histogram = nil
+		}
+	}
+}
+
 // WriteGobFile writes the histograms to a file encoded gob format.
 func (c *HistogramFSController) WriteGobFile(path string) error {
 	c.Version = Version
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	err = enc.Encode(c)
-	return err
+	c.FormatVersion = FSFormatVersion
+	return encodeFeatureFile(path, "gob", false, c)
 }
 
 // ReadGobFile reads the content of the controller from the specified file.
 // The file must be encoded in gob.
 func (c *HistogramFSController) ReadGobFile(path string) error {
-	f, err := os.Open(path)
-	if err != nil {
+	if err := decodeFeatureFile(path, "gob", false, c); err != nil {
 		return err
 	}
-	defer f.Close()
-	dec := gob.NewDecoder(f)
-	err = dec.Decode(c)
-	return err
+	return MigrateHistogramFSController(c)
 }
 
 // WriteJSON writes the histograms to  a file encoded in json format.
 func (c *HistogramFSController) WriteJSON(path string) error {
 	c.Version = Version
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	err = enc.Encode(c)
-	return err
+	c.FormatVersion = FSFormatVersion
+	return encodeFeatureFile(path, "json", false, c)
 }
 
 // ReadJSONFile reads the content of the controller from the specified file.
 // The file must be encoded in json.
 func (c *HistogramFSController) ReadJSONFile(path string) error {
-	f, err := os.Open(path)
-	if err != nil {
+	if err := decodeFeatureFile(path, "json", false, c); err != nil {
 		return err
 	}
-	defer f.Close()
-	dec := json.NewDecoder(f)
-	err = dec.Decode(c)
+	return MigrateHistogramFSController(c)
+}
+
+// entryPaths returns pointers to the paths of all entries.
+func (c *HistogramFSController) entryPaths() []*string {
+	res := make([]*string, len(c.Entries))
+	for i := range c.Entries {
+		res[i] = &c.Entries[i].Path
+	}
+	return res
+}
+
+// MakeRelative converts the paths of all entries to paths relative to root
+// (which must be an absolute path). This way the file can be moved to another
+// machine and the paths can be rebased there, see Rebase. An error is returned
+// if an image is not inside root, in this case the controller is not changed.
+func (c *HistogramFSController) MakeRelative(root string) error {
+	if err := makeRelativeFeaturePaths(c.Root, root, c.entryPaths()); err != nil {
+		return err
+	}
+	c.Root = root
+	return nil
+}
+
+// Rebase converts the relative paths (see MakeRelative) to absolute paths by
+// joining them with root. If root is empty the directory the paths were made
+// relative to is used. If the paths are already absolute nothing happens if
+// root is empty, otherwise an error is returned.
+func (c *HistogramFSController) Rebase(root string) error {
+	rebased, err := rebaseFeaturePaths(c.Root, root, c.entryPaths())
+	if rebased {
+		c.Root = ""
+	}
 	return err
 }
 
 // ReadFile reads the content of the controller from the specified file.
 // The read method depends on the file extension which must be either .json
-// or .gob.
+// or .gob, optionally followed by .gz for gzip compressed files.
 func (c *HistogramFSController) ReadFile(path string) error {
-	ext := filepath.Ext(path)
-	ext = strings.ToLower(ext)
-	switch ext {
-	case ".json":
-		return c.ReadJSONFile(path)
-	case ".gob":
-		return c.ReadGobFile(path)
-	default:
-		return fmt.Errorf("Unkown file extension for GCH file: %s. Should be \".json\" or \".gob\"", ext)
+	if err := readFeatureFile(path, "GCH", c); err != nil {
+		return err
 	}
+	return MigrateHistogramFSController(c)
 }
 
 // WriteFile writes the content of the controller to a file depending on the
-// file extension hich must be either .json or .gob.
+// file extension hich must be either .json or .gob, optionally followed by .gz
+// for gzip compressed files.
 func (c *HistogramFSController) WriteFile(path string) error {
-	ext := filepath.Ext(path)
-	ext = strings.ToLower(ext)
-	switch ext {
-	case ".json":
-		return c.WriteJSON(path)
-	case ".gob":
-		return c.WriteGobFile(path)
-	default:
-		return fmt.Errorf("Unkown file extension for GCH file: %s. Should be \".json\" or \".gob\"", ext)
-	}
+	c.Version = Version
+	c.FormatVersion = FSFormatVersion
+	return writeFeatureFile(path, "GCH", c)
 }
 
 // CheckData is used to verify (parts) of the controller data. It tests if
@@ -225,11 +296,16 @@ func (c *HistogramFSController) CheckData(k uint, checkK bool, checkNormalized b
 		errs = append(errs, fmt.Sprintf("Controller stores entries with k = %d, expected k = %d", c.K, k))
 	}
 	for _, entry := range c.Entries {
-		histK := entry.Histogram.K
+		histogram := entry.GetHistogram()
+		if histogram == nil {
+			errs = append(errs, fmt.Sprintf("Error in histogram for %s: No histogram stored", entry.Path))
+			continue
+		}
+		histK := histogram.K
 		if c.K != histK {
 			errs = append(errs, fmt.Sprintf("Error in histogram for %s: Expected histogram with k = %d, got k = %d", entry.Path, c.K, histK))
 		}
-		histEntries := entry.Histogram.Entries
+		histEntries := histogram.Entries
 		if uint(len(histEntries)) != (histK * histK * histK) {
 			errs = append(errs, fmt.Sprintf("Error in histogram for %s: Expected histogram of size %d, got size %d", entry.Path, (histK*histK*histK), len(histEntries)))
 		}
@@ -249,10 +325,13 @@ func (c *HistogramFSController) CheckData(k uint, checkK bool, checkNormalized b
 
 // Map computes the mapping filename ↦ histogram. That is useful sometimes,
 // especially when computing the diff between this and an FSMapper.
+// Compact histograms are converted.
 func (c *HistogramFSController) Map() map[string]*Histogram {
 	res := make(map[string]*Histogram, len(c.Entries))
 	for _, entry := range c.Entries {
-		res[entry.Path] = entry.Histogram
+		if histogram := entry.GetHistogram(); histogram != nil {
+			res[entry.Path] = histogram
+		}
 	}
 	return res
 }
@@ -358,16 +437,69 @@ func NewMemoryHistStorage(k uint, capacity int) *MemoryHistStorage {
 // If id is not a valid position inside the the list an error is returned.
 func (s *MemoryHistStorage) GetHistogram(id ImageID) (*Histogram, error) {
 	if int(id) < 0 || int(id) >= len(s.Histograms) {
-		return nil, fmt.Errorf("Histogram for id %d not registered", id)
+		return nil, fmt.Errorf("Histogram for id %d not registered: %w", id, ErrImageNotFound)
 	}
 	return s.Histograms[id], nil
 }
 
+// Retain keeps only the histograms for the given ids (in the given order).
+// It is used to update the storage after images were removed from a mapper,
+// see FSMapper.Retain.
+func (s *MemoryHistStorage) Retain(ids []ImageID) {
+	histograms := make([]*Histogram, len(ids))
+	for i, id := range ids {
+		histograms[i] = s.Histograms[id]
+	}
+	s.Histograms = histograms
+}
+
 // Divisions returns the number of sub-divisions k.
 func (s *MemoryHistStorage) Divisions() uint {
 	return s.K
 }
 
+// Len returns the number of histograms in the storage.
+func (s *MemoryHistStorage) Len() int {
+	return len(s.Histograms)
+}
+
+// Append adds the histograms at the end of the storage.
+func (s *MemoryHistStorage) Append(histograms ...*Histogram) {
+	s.Histograms = append(s.Histograms, histograms...)
+}
+
+// Copy returns a copy of the storage, the histograms are not copied (they're
+// never changed).
+func (s *MemoryHistStorage) Copy() HistogramList {
+	return &MemoryHistStorage{
+		Histograms: append([]*Histogram(nil), s.Histograms...),
+		K:          s.K,
+	}
+}
+
+// HistogramList is a HistogramStorage that keeps the histograms of all images
+// in memory, the histogram of the image with id i is on position i. It's
+// implemented by MemoryHistStorage and the storages that require less memory:
+// CompactHistStorage and SparseHistStorage.
+type HistogramList interface {
+	HistogramStorage
+
+	// Len returns the number of histograms.
+	Len() int
+
+	// Retain keeps only the histograms for the given ids (in the given order),
+	// see MemoryHistStorage.Retain.
+	Retain(ids []ImageID)
+
+	// Append adds the histograms at the end, they're converted to the
+	// representation used by the storage.
+	Append(histograms ...*Histogram)
+
+	// Copy returns a copy of the storage that is not affected by Retain and
+	// Append.
+	Copy() HistogramList
+}
+
 // TODO provide example sticking this all together
 
 // MemHistStorageFromFSMapper creates a new memory histogram storage that
@@ -395,8 +527,7 @@ func MemHistStorageFromFSMapper(mapper *FSMapper, fileContent *HistogramFSContro
 			// this is just a check to be sure only legal histograms are saved
 			k := histogram.K
 			if k != fileContent.K {
-				return nil, fmt.Errorf("Invalid histogram for image \"%s\": Illegal dimension: %d != %d",
-					imagePath, histogram.K, fileContent.K)
+				return nil, ErrHistogramMismatch{Path: imagePath, WantK: fileContent.K, GotK: histogram.K}
 			}
 			if (k * k * k) != uint(len(histogram.Entries)) {
 				return nil,
@@ -410,3 +541,35 @@ func MemHistStorageFromFSMapper(mapper *FSMapper, fileContent *HistogramFSContro
 	}
 	return res, nil
 }
+
+// UpdateHistStorage creates a memory histogram storage for all images of the
+// mapper: Histograms from fileContent (which can be nil) are reused if they
+// have k sub-divisions, only the histograms of the remaining images are
+// computed. It returns the storage and the number of computed histograms.
+func UpdateHistStorage(mapper *FSMapper, storage ImageStorage, fileContent *HistogramFSController,
+	k uint, numRoutines int, progress ProgressFunc) (*MemoryHistStorage, int, error) {
+	var histMap map[string]*Histogram
+	if fileContent != nil && fileContent.K == k {
+		histMap = fileContent.Map()
+	}
+	res := &MemoryHistStorage{Histograms: make([]*Histogram, mapper.Len()), K: k}
+	missing := make([]ImageID, 0)
+	for i, imagePath := range mapper.IDMapping {
+		histogram, has := histMap[imagePath]
+		if has && uint(len(histogram.Entries)) == k*k*k {
+			res.Histograms[i] = histogram
+		} else {
+			missing = append(missing, ImageID(i))
+		}
+	}
+	if len(missing) > 0 {
+		histograms, histErr := CreateHistograms(missing, storage, true, k, numRoutines, progress)
+		if histErr != nil {
+			return nil, 0, histErr
+		}
+		for i, id := range missing {
+			res.Histograms[id] = histograms[i]
+		}
+	}
+	return res, len(missing), nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gomosaictest provides utilities for testing code that creates
+// mosaics: A small deterministic image database and query, a seeded random
+// generator and helpers to compare mosaics with golden images.
+//
+// The fixtures are generated by code, so they don't depend on files and are
+// always the same. A regression test usually looks like this:
+//
+//	func TestMosaic(t *testing.T) {
+//		mosaic, err := gomosaictest.Builder().WithTiles(4, 4).Build(gomosaictest.Query())
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//		gomosaictest.AssertGolden(t, "testdata/mosaic.png", mosaic, 2)
+//	}
+package gomosaictest
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+
+	"github.com/FabianWe/gomosaic"
+	"github.com/nfnt/resize"
+)
+
+// This file contains the fixtures: The database images, the query image and
+// the random generator.
+
+// Seed is the seed used for all random generators.
+const Seed int64 = 42
+
+// FixtureSize is the size of the database images.
+const FixtureSize = 16
+
+// QueryWidth and QueryHeight are the dimensions of the query image.
+const (
+	QueryWidth  = 96
+	QueryHeight = 64
+)
+
+// Rand returns a new random generator seeded with Seed.
+func Rand() *rand.Rand {
+	return gomosaic.NewSeededRand(Seed)
+}
+
+// fixtureColors are the base colors of the database images.
+var fixtureColors = []color.NRGBA{
+	{0, 0, 0, 255},
+	{255, 255, 255, 255},
+	{220, 30, 30, 255},
+	{30, 180, 40, 255},
+	{30, 60, 220, 255},
+	{240, 220, 40, 255},
+	{40, 200, 210, 255},
+	{200, 50, 190, 255},
+	{128, 128, 128, 255},
+	{250, 140, 20, 255},
+	{110, 70, 30, 255},
+	{20, 40, 90, 255},
+}
+
+// Images returns the database images: For each base color a solid image, an
+// image with a horizontal gradient to black and an image with random noise
+// around the color. All images have the size FixtureSize x FixtureSize.
+func Images() []image.Image {
+	r := Rand()
+	res := make([]image.Image, 0, 3*len(fixtureColors))
+	for _, c := range fixtureColors {
+		solid := image.NewNRGBA(image.Rect(0, 0, FixtureSize, FixtureSize))
+		gradient := image.NewNRGBA(solid.Bounds())
+		noise := image.NewNRGBA(solid.Bounds())
+		for y := 0; y < FixtureSize; y++ {
+			for x := 0; x < FixtureSize; x++ {
+				solid.SetNRGBA(x, y, c)
+				gradient.SetNRGBA(x, y, scaleColor(c, FixtureSize-x, FixtureSize))
+				noise.SetNRGBA(x, y, color.NRGBA{
+					R: jitter(r, c.R), G: jitter(r, c.G), B: jitter(r, c.B), A: 255,
+				})
+			}
+		}
+		res = append(res, solid, gradient, noise)
+	}
+	return res
+}
+
+// Storage returns a new storage containing Images.
+func Storage() *gomosaic.MemoryImageStorage {
+	storage := gomosaic.NewMemoryImageStorage()
+	for _, img := range Images() {
+		storage.Add(img)
+	}
+	return storage
+}
+
+// Query returns the query image: A gradient from red to blue (left to right)
+// and to green (top to bottom) with a white circle in the center.
+func Query() image.Image {
+	res := image.NewNRGBA(image.Rect(0, 0, QueryWidth, QueryHeight))
+	cx, cy, radius := QueryWidth/2, QueryHeight/2, QueryHeight/4
+	for y := 0; y < QueryHeight; y++ {
+		for x := 0; x < QueryWidth; x++ {
+			dx, dy := x-cx, y-cy
+			if dx*dx+dy*dy <= radius*radius {
+				res.SetNRGBA(x, y, color.NRGBA{255, 255, 255, 255})
+				continue
+			}
+			res.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(255 * (QueryWidth - 1 - x) / (QueryWidth - 1)),
+				G: uint8(255 * y / (QueryHeight - 1)),
+				B: uint8(255 * x / (QueryWidth - 1)),
+				A: 255,
+			})
+		}
+	}
+	return res
+}
+
+// Builder returns a builder for the Storage images with deterministic
+// settings: The random generators use Seed, the images are resized with
+// nearest neighbor interpolation and only one go routine is used.
+func Builder() *gomosaic.MosaicBuilder {
+	return gomosaic.NewMosaicBuilder(Storage()).
+		WithSeed(Seed).
+		WithResizer(gomosaic.NewNfntResizer(resize.NearestNeighbor)).
+		WithNumRoutines(1)
+}
+
+// scaleColor returns the color scaled by num / denom.
+func scaleColor(c color.NRGBA, num, denom int) color.NRGBA {
+	return color.NRGBA{
+		R: uint8(int(c.R) * num / denom),
+		G: uint8(int(c.G) * num / denom),
+		B: uint8(int(c.B) * num / denom),
+		A: c.A,
+	}
+}
+
+// jitter adds a random value between -32 and 32 to v.
+func jitter(r *rand.Rand, v uint8) uint8 {
+	res := int(v) + r.Intn(65) - 32
+	switch {
+	case res < 0:
+		return 0
+	case res > 255:
+		return 255
+	default:
+		return uint8(res)
+	}
+}
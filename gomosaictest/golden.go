@@ -0,0 +1,151 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaictest
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FabianWe/gomosaic"
+)
+
+// This file contains helpers to compare mosaics with golden images.
+
+// UpdateGoldenEnv is the environment variable that, if set to a non-empty
+// value, makes AssertGolden write the golden images instead of comparing
+// them.
+const UpdateGoldenEnv = gomosaic.EnvPrefix + "UPDATE_GOLDEN"
+
+// ImageDiff describes the differences between two images of the same size.
+type ImageDiff struct {
+	// NumPixels is the number of pixels that differ by more than the
+	// tolerance.
+	NumPixels int
+	// MaxDiff is the maximal difference of a color channel.
+	MaxDiff uint8
+	// First is the first pixel that differs by more than the tolerance (in
+	// coordinates relative to the bounds).
+	First image.Point
+}
+
+// CompareImages compares the pixels of two images. A pixel differs if one of
+// its channels (as 8 bit, not premultiplied) differs by more than tolerance.
+// An error is returned if the images have different sizes.
+func CompareImages(expected, actual image.Image, tolerance uint8) (ImageDiff, error) {
+	var res ImageDiff
+	eBounds, aBounds := expected.Bounds(), actual.Bounds()
+	if eBounds.Dx() != aBounds.Dx() || eBounds.Dy() != aBounds.Dy() {
+		return res, fmt.Errorf("Images are of different size: %dx%d and %dx%d",
+			eBounds.Dx(), eBounds.Dy(), aBounds.Dx(), aBounds.Dy())
+	}
+	for y := 0; y < eBounds.Dy(); y++ {
+		for x := 0; x < eBounds.Dx(); x++ {
+			e := color.NRGBAModel.Convert(expected.At(eBounds.Min.X+x, eBounds.Min.Y+y)).(color.NRGBA)
+			a := color.NRGBAModel.Convert(actual.At(aBounds.Min.X+x, aBounds.Min.Y+y)).(color.NRGBA)
+			diff := channelDiff(e.R, a.R)
+			for _, d := range []uint8{channelDiff(e.G, a.G), channelDiff(e.B, a.B), channelDiff(e.A, a.A)} {
+				if d > diff {
+					diff = d
+				}
+			}
+			if diff > res.MaxDiff {
+				res.MaxDiff = diff
+			}
+			if diff > tolerance {
+				if res.NumPixels == 0 {
+					res.First = image.Pt(x, y)
+				}
+				res.NumPixels++
+			}
+		}
+	}
+	return res, nil
+}
+
+// AssertGolden compares img with the golden png image in path (see
+// CompareImages) and fails the test if the sizes differ or any pixel differs
+// by more than tolerance. On failure img is written next to the golden image
+// with the extension ".actual.png" for inspection.
+//
+// If the environment variable UpdateGoldenEnv is set the golden image is
+// written instead.
+func AssertGolden(t testing.TB, path string, img image.Image, tolerance uint8) {
+	t.Helper()
+	if os.Getenv(UpdateGoldenEnv) != "" {
+		if err := writePNG(path, img); err != nil {
+			t.Fatalf("Can't update golden image %s: %s", path, err.Error())
+		}
+		t.Logf("Updated golden image %s", path)
+		return
+	}
+	golden, readErr := readPNG(path)
+	if readErr != nil {
+		t.Fatalf("Can't read golden image %s: %s (set %s to create it)", path, readErr.Error(), UpdateGoldenEnv)
+	}
+	diff, compareErr := CompareImages(golden, img, tolerance)
+	if compareErr == nil && diff.NumPixels == 0 {
+		return
+	}
+	actualPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".actual.png"
+	if writeErr := writePNG(actualPath, img); writeErr != nil {
+		t.Logf("Can't write actual image %s: %s", actualPath, writeErr.Error())
+	}
+	if compareErr != nil {
+		t.Fatalf("Image doesn't match golden image %s: %s, actual image in %s", path, compareErr.Error(), actualPath)
+	}
+	t.Fatalf("Image doesn't match golden image %s: %d pixels differ by more than %d (first %v, max difference %d), actual image in %s",
+		path, diff.NumPixels, tolerance, diff.First, diff.MaxDiff, actualPath)
+}
+
+// channelDiff returns the absolute difference of a and b.
+func channelDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// readPNG decodes the png file in path.
+func readPNG(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+// writePNG writes img as png to path, the directory is created if it doesn't
+// exist.
+func writePNG(path string, img image.Image) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = png.Encode(f, img); err != nil {
+		return err
+	}
+	return f.Close()
+}
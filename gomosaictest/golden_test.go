@@ -0,0 +1,66 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaictest
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestMosaicGolden(t *testing.T) {
+	mosaic, err := Builder().WithTiles(6, 4).Build(Query())
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertGolden(t, "testdata/mosaic.png", mosaic, 2)
+}
+
+func TestQueryGolden(t *testing.T) {
+	AssertGolden(t, "testdata/query.png", Query(), 0)
+}
+
+func TestCompareImages(t *testing.T) {
+	expected := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	actual := image.NewNRGBA(image.Rect(10, 10, 14, 14))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			expected.SetNRGBA(x, y, color.NRGBA{100, 100, 100, 255})
+			actual.SetNRGBA(10+x, 10+y, color.NRGBA{100, 100, 100, 255})
+		}
+	}
+	actual.SetNRGBA(11, 12, color.NRGBA{100, 103, 100, 255})
+	actual.SetNRGBA(13, 13, color.NRGBA{90, 100, 100, 255})
+
+	diff, err := CompareImages(expected, actual, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.NumPixels != 2 || diff.MaxDiff != 10 || diff.First != image.Pt(1, 2) {
+		t.Errorf("Expected 2 pixels (first (1,2)) with max difference 10, got %+v", diff)
+	}
+
+	diff, err = CompareImages(expected, actual, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.NumPixels != 0 {
+		t.Errorf("Expected no differences with tolerance 10, got %d", diff.NumPixels)
+	}
+
+	if _, err = CompareImages(expected, image.NewNRGBA(image.Rect(0, 0, 4, 5)), 0); err == nil {
+		t.Error("Expected an error for images of different size")
+	}
+}
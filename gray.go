@@ -0,0 +1,151 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+)
+
+// This file contains support for black-and-white mosaics: A luminance
+// histogram is a 1D histogram of the gray values of an image, it ignores the
+// colors completely. Together with GrayscaleTransform (that desaturates the
+// tiles of the mosaic) this can be used to create monochrome mosaics.
+
+// GenLuminanceHistogram computes the luminance histogram of an image with k
+// bins: The gray value of each pixel (see color.GrayModel) is mapped to one of
+// k equally sized bins. If normalize is true the entries are divided by the
+// number of pixels.
+func GenLuminanceHistogram(img image.Image, k uint, normalize bool) []float64 {
+	res := make([]float64, k)
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray := color.GrayModel.Convert(img.At(x, y)).(color.Gray)
+			res[uint(gray.Y)*k/256]++
+		}
+	}
+	if numPixels := bounds.Dx() * bounds.Dy(); normalize && numPixels > 0 {
+		for i := range res {
+			res[i] /= float64(numPixels)
+		}
+	}
+	return res
+}
+
+// LuminanceExtractor is a FeatureExtractor that computes normalized luminance
+// histograms with K bins.
+type LuminanceExtractor struct {
+	K uint
+}
+
+// Descriptor returns "gray k=<k>".
+func (e LuminanceExtractor) Descriptor() string {
+	return fmt.Sprintf("gray k=%d", e.K)
+}
+
+// Extract returns the luminance histogram.
+func (e LuminanceExtractor) Extract(img image.Image) ([]float64, error) {
+	return GenLuminanceHistogram(img, e.K, true), nil
+}
+
+// Metric compares the histograms as vectors.
+func (e LuminanceExtractor) Metric(metric HistogramMetric) FeatureMetric {
+	return histogramFeatureMetric(metric, 0)
+}
+
+// DefaultLuminanceBins is the default number of bins of luminance histograms.
+const DefaultLuminanceBins = 32
+
+// ParseLuminanceBins parses the number of bins of a luminance histogram, it
+// must be between 1 and 256.
+func ParseLuminanceBins(s string) (uint, error) {
+	k, parseErr := strconv.Atoi(s)
+	if parseErr != nil || k < 1 || k > 256 {
+		return 0, fmt.Errorf("k for luminance histograms must be a value between 1 and 256, got %s", s)
+	}
+	return uint(k), nil
+}
+
+func init() {
+	RegisterFeatureExtractor("gray", func(params map[string]string) (FeatureExtractor, error) {
+		if paramsErr := featureParams("gray", params, "k"); paramsErr != nil {
+			return nil, paramsErr
+		}
+		var k uint = DefaultLuminanceBins
+		if kStr, has := params["k"]; has {
+			var kErr error
+			if k, kErr = ParseLuminanceBins(kStr); kErr != nil {
+				return nil, kErr
+			}
+		}
+		return LuminanceExtractor{K: k}, nil
+	})
+}
+
+// Desaturate returns a grayscale copy of an image. The alpha channel is kept:
+// The result is an *image.Gray if img is opaque and an *image.NRGBA with gray
+// colors otherwise.
+func Desaturate(img image.Image) image.Image {
+	bounds := img.Bounds()
+	if o, hasOpaque := img.(interface{ Opaque() bool }); hasOpaque && o.Opaque() {
+		res := image.NewGray(bounds)
+		draw.Draw(res, bounds, img, bounds.Min, draw.Src)
+		return res
+	}
+	res := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			gray := color.GrayModel.Convert(color.NRGBA{R: c.R, G: c.G, B: c.B, A: 255}).(color.Gray)
+			res.SetNRGBA(x, y, color.NRGBA{R: gray.Y, G: gray.Y, B: gray.Y, A: c.A})
+		}
+	}
+	return res
+}
+
+// GrayscaleTransform returns a TileTransform that desaturates each tile.
+func GrayscaleTransform() TileTransform {
+	return func(tileY, tileX int, img image.Image) image.Image {
+		return Desaturate(img)
+	}
+}
+
+// ChainTransforms returns a TileTransform that applies all transforms in the
+// given order, nil transforms are ignored. If all transforms are nil the
+// result is nil.
+func ChainTransforms(transforms ...TileTransform) TileTransform {
+	nonNil := make([]TileTransform, 0, len(transforms))
+	for _, t := range transforms {
+		if t != nil {
+			nonNil = append(nonNil, t)
+		}
+	}
+	switch len(nonNil) {
+	case 0:
+		return nil
+	case 1:
+		return nonNil[0]
+	}
+	return func(tileY, tileX int, img image.Image) image.Image {
+		for _, t := range nonNil {
+			img = t(tileY, tileX, img)
+		}
+		return img
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// This file contains a heatmap of the metric values of a mosaic: Each tile is
+// drawn in a gray value that encodes the distance between the tile and the
+// image selected for it. Bright regions show where the database doesn't
+// contain fitting images.
+
+// distanceRange returns the smallest and largest value that is not NaN or
+// infinite. ok is false if there is no such value.
+func distanceRange(values [][]float64) (min, max float64, ok bool) {
+	min, max = math.Inf(1), math.Inf(-1)
+	for _, col := range values {
+		for _, value := range col {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			min, max = math.Min(min, value), math.Max(max, value)
+			ok = true
+		}
+	}
+	return
+}
+
+// RenderHeatmap draws the distances of the tiles (see SelectionDetails and
+// MetricValues) into an image with the bounds of dist: The distances are
+// scaled linearly between the smallest distance (black) and the largest
+// distance (white). Tiles with a NaN distance (usually tiles without an image)
+// are transparent.
+//
+// dist is usually the division of the mosaic, the heatmap then has the same
+// size as the mosaic.
+func RenderHeatmap(dist TileDivision, values [][]float64) *image.NRGBA {
+	res := image.NewNRGBA(dist.Bounds())
+	min, max, ok := distanceRange(values)
+	if !ok {
+		return res
+	}
+	for i, col := range dist {
+		if i >= len(values) {
+			break
+		}
+		for j, tile := range col {
+			if j >= len(values[i]) {
+				break
+			}
+			value := values[i][j]
+			if math.IsNaN(value) {
+				continue
+			}
+			// a single distance (or only equal distances) is drawn white
+			brightness := 1.0
+			if max > min {
+				brightness = (math.Max(math.Min(value, max), min) - min) / (max - min)
+			}
+			gray := clampColor(255.0 * brightness)
+			c := color.NRGBA{R: gray, G: gray, B: gray, A: 255}
+			draw.Draw(res, tile, image.NewUniform(c), image.Point{}, draw.Src)
+		}
+	}
+	return res
+}
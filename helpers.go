@@ -14,6 +14,24 @@
 
 package gomosaic
 
+// This file contains small math helpers for integer types that are not
+// provided by the standard library (math only works on float64).
+// Parsing helpers (ParsePercent, ParseDimensions, ...) are in utils.go, the
+// interpolation helpers (GetInterP, InterPString, InterPFromString) in
+// image.go.
+
+const (
+	// MaxUint is the largest value of type uint.
+	MaxUint = ^uint(0)
+	// MinUint is the smallest value of type uint.
+	MinUint = 0
+	// MaxInt is the largest value of type int.
+	MaxInt = int(MaxUint >> 1)
+	// MinInt is the smallest value of type int.
+	MinInt = -MaxInt - 1
+)
+
+// MaxUint32 returns the maximum of all arguments.
 func MaxUint32(a uint32, elements ...uint32) uint32 {
 	res := a
 	for _, val := range elements {
@@ -24,6 +42,7 @@ func MaxUint32(a uint32, elements ...uint32) uint32 {
 	return res
 }
 
+// MinUint32 returns the minimum of all arguments.
 func MinUint32(a uint32, elements ...uint32) uint32 {
 	res := a
 	for _, val := range elements {
@@ -34,6 +53,7 @@ func MinUint32(a uint32, elements ...uint32) uint32 {
 	return res
 }
 
+// MaxUint8 returns the maximum of all arguments.
 func MaxUint8(a uint8, elements ...uint8) uint8 {
 	res := a
 	for _, val := range elements {
@@ -44,6 +64,7 @@ func MaxUint8(a uint8, elements ...uint8) uint8 {
 	return res
 }
 
+// MinUint8 returns the minimum of all arguments.
 func MinUint8(a uint8, elements ...uint8) uint8 {
 	res := a
 	for _, val := range elements {
@@ -54,6 +75,7 @@ func MinUint8(a uint8, elements ...uint8) uint8 {
 	return res
 }
 
+// IntMin returns the minimum of a and b.
 func IntMin(a, b int) int {
 	if a < b {
 		return a
@@ -61,9 +83,20 @@ func IntMin(a, b int) int {
 	return b
 }
 
+// IntMax returns the maximum of a and b.
 func IntMax(a, b int) int {
 	if a > b {
 		return a
 	}
 	return b
 }
+
+// IntAbs returns the absolute value of a, that is |a| as an int.
+// Note that IntAbs(MinInt) is MinInt because |MinInt| can't be represented as
+// an int.
+func IntAbs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
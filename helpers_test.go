@@ -0,0 +1,160 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"testing"
+
+	"github.com/nfnt/resize"
+)
+
+func TestIntConstants(t *testing.T) {
+	if MaxInt <= 0 || MinInt != -MaxInt-1 {
+		t.Errorf("Invalid int bounds %d and %d", MinInt, MaxInt)
+	}
+	if MaxUint != 2*uint(MaxInt)+1 || MinUint != 0 {
+		t.Errorf("Invalid uint bounds %d and %d", MinUint, MaxUint)
+	}
+	max := MaxInt
+	if max+1 != MinInt {
+		t.Errorf("MaxInt + 1 should overflow to MinInt, got %d", max+1)
+	}
+}
+
+func TestIntMinMaxAbs(t *testing.T) {
+	tests := []struct {
+		a, b, min, max int
+	}{
+		{1, 2, 1, 2},
+		{2, 1, 1, 2},
+		{-3, 3, -3, 3},
+		{5, 5, 5, 5},
+		{MinInt, MaxInt, MinInt, MaxInt},
+	}
+	for _, tc := range tests {
+		if got := IntMin(tc.a, tc.b); got != tc.min {
+			t.Errorf("IntMin(%d, %d) = %d, expected %d", tc.a, tc.b, got, tc.min)
+		}
+		if got := IntMax(tc.a, tc.b); got != tc.max {
+			t.Errorf("IntMax(%d, %d) = %d, expected %d", tc.a, tc.b, got, tc.max)
+		}
+	}
+	abs := map[int]int{0: 0, 7: 7, -7: 7, MaxInt: MaxInt, -MaxInt: MaxInt, MinInt: MinInt}
+	for a, expected := range abs {
+		if got := IntAbs(a); got != expected {
+			t.Errorf("IntAbs(%d) = %d, expected %d", a, got, expected)
+		}
+	}
+}
+
+func TestMinMaxVariadic(t *testing.T) {
+	if got := MaxUint32(3); got != 3 {
+		t.Errorf("MaxUint32(3) = %d, expected 3", got)
+	}
+	if got := MaxUint32(3, 9, 1); got != 9 {
+		t.Errorf("MaxUint32(3, 9, 1) = %d, expected 9", got)
+	}
+	if got := MinUint32(3, 9, 1); got != 1 {
+		t.Errorf("MinUint32(3, 9, 1) = %d, expected 1", got)
+	}
+	if got := MaxUint8(200, 255, 0); got != 255 {
+		t.Errorf("MaxUint8(200, 255, 0) = %d, expected 255", got)
+	}
+	if got := MinUint8(200, 255, 0); got != 0 {
+		t.Errorf("MinUint8(200, 255, 0) = %d, expected 0", got)
+	}
+}
+
+func TestParsePercent(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected float64
+	}{
+		{"50%", 0.5},
+		{"12.5 %", 0.125},
+		{" 0.25 ", 0.25},
+		{"150%", 1.5},
+		{"0", 0},
+	}
+	for _, tc := range tests {
+		got, err := ParsePercent(tc.in)
+		if err != nil {
+			t.Errorf("ParsePercent(%q) returned error: %s", tc.in, err.Error())
+			continue
+		}
+		if got != tc.expected {
+			t.Errorf("ParsePercent(%q) = %f, expected %f", tc.in, got, tc.expected)
+		}
+	}
+	for _, in := range []string{"", "%", "abc", "5%%"} {
+		if _, err := ParsePercent(in); err == nil {
+			t.Errorf("ParsePercent(%q) should return an error", in)
+		}
+	}
+}
+
+func TestParseDimensions(t *testing.T) {
+	width, height, err := ParseDimensions("1024 x 768")
+	if err != nil || width != 1024 || height != 768 {
+		t.Errorf("ParseDimensions(\"1024 x 768\") = %d, %d, %v", width, height, err)
+	}
+	for _, in := range []string{"1024", "1024x", "-1x10", "axb", "1x2x3"} {
+		if _, _, err := ParseDimensions(in); err == nil {
+			t.Errorf("ParseDimensions(%q) should return an error", in)
+		}
+	}
+	tests := []struct {
+		in            string
+		width, height int
+	}{
+		{"1024x", 1024, -1},
+		{"x768", -1, 768},
+		{"x", -1, -1},
+		{"10x20", 10, 20},
+	}
+	for _, tc := range tests {
+		width, height, err := ParseDimensionsEmpty(tc.in)
+		if err != nil || width != tc.width || height != tc.height {
+			t.Errorf("ParseDimensionsEmpty(%q) = %d, %d, %v, expected %d, %d",
+				tc.in, width, height, err, tc.width, tc.height)
+		}
+	}
+	if _, _, err := ParseDimensionsEmpty("-1x"); err == nil {
+		t.Error("ParseDimensionsEmpty(\"-1x\") should return an error")
+	}
+}
+
+func TestInterPString(t *testing.T) {
+	for quality := uint(0); quality <= 5; quality++ {
+		interP := GetInterP(quality)
+		parsed, err := InterPFromString(InterPString(interP))
+		if err != nil {
+			t.Errorf("Can't parse %s: %s", InterPString(interP), err.Error())
+			continue
+		}
+		if parsed != interP {
+			t.Errorf("InterPFromString(%s) = %s", InterPString(interP), InterPString(parsed))
+		}
+	}
+	if interP, err := InterPFromString("mitchell-netravali"); err != nil || interP != resize.MitchellNetravali {
+		t.Errorf("InterPFromString(\"mitchell-netravali\") = %s, %v", InterPString(interP), err)
+	}
+	if GetInterP(100) != resize.Lanczos3 {
+		t.Error("GetInterP should return Lanczos3 for qualities > 5")
+	}
+	if _, err := InterPFromString("cubic"); err == nil {
+		t.Error("InterPFromString(\"cubic\") should return an error")
+	}
+}
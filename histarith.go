@@ -0,0 +1,165 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// This file contains arithmetic on histograms: Histograms can be added,
+// subtracted and merged, this way the histogram of a region can be computed
+// from the histograms of its parts without scanning the pixels again (for
+// example for new LCH schemes or adaptive dividers). Marginals and per-region
+// distances are useful for debugging.
+//
+// All functions return new histograms, the arguments are never changed.
+
+// checkSameK returns an error if the histograms have different k.
+func checkSameK(h, other *Histogram) error {
+	if h.K != other.K || len(h.Entries) != len(other.Entries) {
+		return fmt.Errorf("Histograms have different sub-divisions: %d != %d", h.K, other.K)
+	}
+	return nil
+}
+
+// Plus returns the histogram h + other (entry by entry). Both histograms must
+// have the same k.
+func (h *Histogram) Plus(other *Histogram) (*Histogram, error) {
+	if err := checkSameK(h, other); err != nil {
+		return nil, err
+	}
+	res := NewHistogram(h.K)
+	for i, entry := range h.Entries {
+		res.Entries[i] = entry + other.Entries[i]
+	}
+	return res, nil
+}
+
+// Minus returns the histogram h - other (entry by entry). Both histograms must
+// have the same k. Entries can become negative, use Clamp to set them to 0.
+//
+// If h is the frequency histogram of a region and other the frequency
+// histogram of a part of that region the result is the histogram of the
+// remaining part.
+func (h *Histogram) Minus(other *Histogram) (*Histogram, error) {
+	if err := checkSameK(h, other); err != nil {
+		return nil, err
+	}
+	res := NewHistogram(h.K)
+	for i, entry := range h.Entries {
+		res.Entries[i] = entry - other.Entries[i]
+	}
+	return res, nil
+}
+
+// Scale returns the histogram with all entries multiplied by factor.
+func (h *Histogram) Scale(factor float64) *Histogram {
+	res := NewHistogram(h.K)
+	for i, entry := range h.Entries {
+		res.Entries[i] = factor * entry
+	}
+	return res
+}
+
+// Clamp returns the histogram with all negative entries set to 0.
+func (h *Histogram) Clamp() *Histogram {
+	res := NewHistogram(h.K)
+	for i, entry := range h.Entries {
+		res.Entries[i] = math.Max(entry, 0.0)
+	}
+	return res
+}
+
+// MergeHistograms merges histograms of the same k into one histogram. If
+// weights is nil the entries are simply added (use this for frequency
+// histograms). Otherwise weights[i] is the weight of histograms[i]: For
+// normalized histograms the weight should be the number of pixels of the
+// region the histogram was created for, the result is again normalized.
+//
+// For example the normalized GCH of an image can be computed from the
+// normalized histograms of a grid LCH (see GridLCHScheme) with the sizes of
+// the grid cells as weights.
+func MergeHistograms(histograms []*Histogram, weights []float64) (*Histogram, error) {
+	if len(histograms) == 0 {
+		return nil, errors.New("No histograms to merge")
+	}
+	if weights != nil && len(weights) != len(histograms) {
+		return nil, fmt.Errorf("Number of weights (%d) doesn't match number of histograms (%d)",
+			len(weights), len(histograms))
+	}
+	res := NewHistogram(histograms[0].K)
+	var weightSum float64
+	for i, hist := range histograms {
+		if err := checkSameK(res, hist); err != nil {
+			return nil, err
+		}
+		weight := 1.0
+		if weights != nil {
+			weight = weights[i]
+			weightSum += weight
+		}
+		for j, entry := range hist.Entries {
+			res.Entries[j] += weight * entry
+		}
+	}
+	if weights != nil && weightSum != 0.0 {
+		for j := range res.Entries {
+			res.Entries[j] /= weightSum
+		}
+	}
+	return res, nil
+}
+
+// Marginals returns the marginal distributions of the red, green and blue
+// channel: r[i] is the sum of all entries with a red component of i (after
+// quantization), the same holds for g and b. Each slice has length k.
+func (h *Histogram) Marginals() (r, g, b []float64) {
+	k := h.K
+	r, g, b = make([]float64, k), make([]float64, k), make([]float64, k)
+	for id, entry := range h.Entries {
+		i := uint(id)
+		r[i%k] += entry
+		g[(i/k)%k] += entry
+		b[i/(k*k)] += entry
+	}
+	return
+}
+
+// RegionDists compares the LCHs region by region: The result contains the
+// distance of each pair of histograms (the sum of the result is the value of
+// Dist). This is useful to find the regions in which two images differ.
+func (lch *LCH) RegionDists(other *LCH, delta HistogramMetric) ([]float64, error) {
+	if len(lch.Histograms) != len(other.Histograms) {
+		return nil, fmt.Errorf("Invalid LCH dimensions: %d != %d",
+			len(lch.Histograms),
+			len(other.Histograms))
+	}
+	res := make([]float64, len(lch.Histograms))
+	for i, hist := range lch.Histograms {
+		if err := checkSameK(hist, other.Histograms[i]); err != nil {
+			return nil, err
+		}
+		res[i] = math.Abs(delta(hist, other.Histograms[i]))
+	}
+	return res, nil
+}
+
+// Merge merges all histograms of the LCH into one histogram, see
+// MergeHistograms.
+func (lch *LCH) Merge(weights []float64) (*Histogram, error) {
+	return MergeHistograms(lch.Histograms, weights)
+}
@@ -130,6 +130,7 @@ func (h *Histogram) Add(img image.Image, k uint) {
 // The histogram contains the freuqency of each color after quantiation in
 // k sub-divisions.
 func GenHistogram(img image.Image, k uint, normalize bool) *Histogram {
+	countEvent(CounterGCHsComputed, 1)
 	res := NewHistogram(k)
 	res.Add(img, k)
 	bounds := img.Bounds()
@@ -206,13 +207,42 @@ func (h *Histogram) Normalize(pixels int) *Histogram {
 // progress is a function that is called to inform about the progress,
 // see doucmentation for ProgressFunc.
 func CreateHistograms(ids []ImageID, storage ImageStorage, normalize bool, k uint, numRoutines int, progress ProgressFunc) ([]*Histogram, error) {
+	res, _, err := CreateHistogramsWithPolicy(ids, storage, normalize, k, numRoutines, progress, ImageErrorsFail)
+	return res, err
+}
+
+// CreateHistogramsWithPolicy works as CreateHistograms, policy describes how
+// images that can't be read are handled. With ImageErrorsSkip the histograms
+// of skipped images are nil, they're listed in the returned report.
+func CreateHistogramsWithPolicy(ids []ImageID, storage ImageStorage, normalize bool, k uint,
+	numRoutines int, progress ProgressFunc, policy ImageErrorPolicy) ([]*Histogram, *ImageErrorReport, error) {
+	res := make([]*Histogram, len(ids))
+	onImage := func(pos int, img image.Image) {
+		res[pos] = GenHistogram(img, k, normalize)
+	}
+	report, err := forEachImageWithPolicy(ids, storage, numRoutines, onImage, progress, policy)
+	if err != nil {
+		return nil, report, err
+	}
+	return res, report, nil
+}
+
+// forEachImageWithPolicy concurrently loads the images with the given ids
+// and calls onImage for each of them, pos is the position of the id in ids.
+// It returns a report of all images that couldn't be loaded. With
+// ImageErrorsFail an ImageError for the first image (in the order of ids)
+// that couldn't be loaded is returned, with ImageErrorsSkip these images are
+// skipped and no error is returned.
+func forEachImageWithPolicy(ids []ImageID, storage ImageStorage, numRoutines int,
+	onImage func(pos int, img image.Image), progress ProgressFunc,
+	policy ImageErrorPolicy) (*ImageErrorReport, error) {
 	if numRoutines <= 0 {
 		numRoutines = 1
 	}
 	numImages := len(ids)
-	// any error that occurs sets this variable (first error)
-	// this is done later
-	var err error
+	report := &ImageErrorReport{NumImages: numImages}
+	// the error of each image, nil if the image was loaded
+	errs := make([]error, numImages)
 
 	// struct that we use for the channel
 	type job struct {
@@ -220,20 +250,18 @@ func CreateHistograms(ids []ImageID, storage ImageStorage, normalize bool, k uin
 		id  ImageID
 	}
 
-	res := make([]*Histogram, numImages)
 	jobs := make(chan job, BufferSize)
-	errorChan := make(chan error, BufferSize)
+	done := make(chan struct{}, BufferSize)
 	for w := 0; w < numRoutines; w++ {
 		go func() {
 			for next := range jobs {
 				image, imageErr := storage.LoadImage(next.id)
 				if imageErr != nil {
-					errorChan <- imageErr
-					continue
+					errs[next.pos] = imageErr
+				} else {
+					onImage(next.pos, image)
 				}
-				hist := GenHistogram(image, k, normalize)
-				res[next.pos] = hist
-				errorChan <- nil
+				done <- struct{}{}
 			}
 		}()
 	}
@@ -246,18 +274,21 @@ func CreateHistograms(ids []ImageID, storage ImageStorage, normalize bool, k uin
 	}()
 
 	for i := 0; i < numImages; i++ {
-		nextErr := <-errorChan
-		if nextErr != nil && err == nil {
-			err = nextErr
-		}
+		<-done
 		if progress != nil {
 			progress(i)
 		}
 	}
-	if err != nil {
-		return nil, err
+	for pos, err := range errs {
+		if err != nil {
+			report.Skipped = append(report.Skipped,
+				ImageError{Image: ids[pos], Path: imagePath(storage, ids[pos]), Err: err})
+		}
 	}
-	return res, nil
+	if policy == ImageErrorsFail && len(report.Skipped) > 0 {
+		return report, report.Skipped[0]
+	}
+	return report, nil
 }
 
 // CreateAllHistograms creates all histograms for images in the storage.
@@ -266,6 +297,13 @@ func CreateAllHistograms(storage ImageStorage, normalize bool, k uint, numRoutin
 	return CreateHistograms(IDList(storage), storage, normalize, k, numRoutines, progress)
 }
 
+// CreateAllHistogramsWithPolicy works as CreateAllHistograms, see
+// CreateHistogramsWithPolicy for the policy.
+func CreateAllHistogramsWithPolicy(storage ImageStorage, normalize bool, k uint, numRoutines int,
+	progress ProgressFunc, policy ImageErrorPolicy) ([]*Histogram, *ImageErrorReport, error) {
+	return CreateHistogramsWithPolicy(IDList(storage), storage, normalize, k, numRoutines, progress, policy)
+}
+
 // CreateHistogramsSequential works as CreateAllHistograms but does not use
 // concurrency.
 func CreateHistogramsSequential(storage ImageStorage, normalize bool, k uint, progress ProgressFunc) ([]*Histogram, error) {
@@ -0,0 +1,141 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+)
+
+// This file contains functions to visualize histograms as bar charts (PNG or
+// SVG): Each bin is drawn as a bar in the color of the bin (the center of the
+// quantized color), the height of the bar is the value of the entry. Drawing
+// the histograms of two images below each other shows why they're considered
+// similar (or not).
+
+// Size of the histogram charts, see RenderHistogram.
+const (
+	HistogramChartWidth  = 1024
+	HistogramChartHeight = 200
+)
+
+// HistogramBinColor returns the color in the center of bin id of a histogram
+// with k sub-divisions.
+func HistogramBinColor(id, k uint) color.RGBA {
+	center := func(i uint) uint8 {
+		return clampColor((float64(i) + 0.5) * float64(QuantizeFactor) / float64(k))
+	}
+	return color.RGBA{R: center(id % k), G: center((id / k) % k), B: center(id / (k * k)), A: 255}
+}
+
+// histogramMax returns the maximum entry of all histograms, 0 if all entries
+// are ≤ 0.
+func histogramMax(histograms ...*Histogram) float64 {
+	var res float64
+	for _, h := range histograms {
+		for _, entry := range h.Entries {
+			if entry > res {
+				res = entry
+			}
+		}
+	}
+	return res
+}
+
+// drawHistogram draws the bars of the histogram into the rectangle r of img,
+// max is the value of a bar with the height of r.
+func drawHistogram(img draw.Image, r image.Rectangle, h *Histogram, max float64) {
+	draw.Draw(img, r, image.White, image.Point{}, draw.Src)
+	n := len(h.Entries)
+	if n == 0 || max <= 0.0 {
+		return
+	}
+	for i, entry := range h.Entries {
+		if entry <= 0.0 {
+			continue
+		}
+		x0 := r.Min.X + i*r.Dx()/n
+		x1 := IntMax(r.Min.X+(i+1)*r.Dx()/n, x0+1)
+		barHeight := IntMax(int(float64(r.Dy())*entry/max+0.5), 1)
+		bar := image.Rect(x0, r.Max.Y-IntMin(barHeight, r.Dy()), x1, r.Max.Y)
+		draw.Draw(img, bar, image.NewUniform(HistogramBinColor(uint(i), h.K)), image.Point{}, draw.Src)
+	}
+}
+
+// RenderHistograms draws the histograms as bar charts below each other, each
+// chart has the given width and height (width is increased if the
+// histograms have more bins than pixels). All charts use the same scale, so
+// the bars of different histograms can be compared.
+func RenderHistograms(width, height int, histograms ...*Histogram) *image.RGBA {
+	for _, h := range histograms {
+		width = IntMax(width, len(h.Entries))
+	}
+	// one pixel gap between the charts
+	res := image.NewRGBA(image.Rect(0, 0, width, len(histograms)*(height+1)))
+	draw.Draw(res, res.Bounds(), image.Black, image.Point{}, draw.Src)
+	max := histogramMax(histograms...)
+	for i, h := range histograms {
+		y := i * (height + 1)
+		drawHistogram(res, image.Rect(0, y, width, y+height), h, max)
+	}
+	return res
+}
+
+// RenderHistogram draws the histogram as a bar chart, see RenderHistograms.
+func RenderHistogram(h *Histogram, width, height int) *image.RGBA {
+	return RenderHistograms(width, height, h)
+}
+
+// RenderLCH draws each GCH of the LCH as a bar chart, see RenderHistograms.
+func RenderLCH(lch *LCH, width, height int) *image.RGBA {
+	return RenderHistograms(width, height, lch.Histograms...)
+}
+
+// WriteHistogramsSVG writes the histograms as bar charts below each other to
+// w in SVG format, see RenderHistograms.
+func WriteHistogramsSVG(w io.Writer, width, height int, histograms ...*Histogram) error {
+	for _, h := range histograms {
+		width = IntMax(width, len(h.Entries))
+	}
+	buf := bufio.NewWriter(w)
+	totalHeight := len(histograms) * (height + 1)
+	fmt.Fprintf(buf, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n",
+		width, totalHeight, width, totalHeight)
+	fmt.Fprintf(buf, "<rect width=\"%d\" height=\"%d\" fill=\"black\"/>\n", width, totalHeight)
+	max := histogramMax(histograms...)
+	for i, h := range histograms {
+		y := i * (height + 1)
+		fmt.Fprintf(buf, "<g transform=\"translate(0,%d)\">\n", y)
+		fmt.Fprintf(buf, "<rect width=\"%d\" height=\"%d\" fill=\"white\"/>\n", width, height)
+		n := len(h.Entries)
+		for j, entry := range h.Entries {
+			if entry <= 0.0 || max <= 0.0 {
+				continue
+			}
+			barWidth := float64(width) / float64(n)
+			barHeight := float64(height) * entry / max
+			fmt.Fprintf(buf, "<rect x=\"%.2f\" y=\"%.2f\" width=\"%.2f\" height=\"%.2f\" fill=\"%s\"><title>%d: %.4f</title></rect>\n",
+				float64(j)*barWidth, float64(height)-barHeight, barWidth, barHeight,
+				HexColorString(HistogramBinColor(uint(j), h.K)), j, entry)
+		}
+		fmt.Fprintln(buf, "</g>")
+	}
+	fmt.Fprintln(buf, "</svg>")
+	return buf.Flush()
+}
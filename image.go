@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"reflect"
 	"strings"
 
@@ -104,15 +105,38 @@ type SubImager interface {
 	SubImage(r image.Rectangle) image.Image
 }
 
+// AsSubImager returns img if it implements SubImager. Otherwise img is
+// converted to an *image.RGBA (that supports sub images), this way tiles can be
+// extracted from all image types.
+func AsSubImager(img image.Image) SubImager {
+	if imager, ok := img.(SubImager); ok {
+		return imager
+	}
+	bounds := img.Bounds()
+	res := image.NewRGBA(bounds)
+	draw.Draw(res, bounds, img, bounds.Min, draw.Src)
+	return res
+}
+
 // SubImage returns a subimage of img given the boundaries r.
 // The rectangle should be a valid area in the image. If the image type does
-// not have a sub image method an error is returned.
+// not have a sub image method the area (intersected with the bounds of img) is
+// drawn into a new RGBA image, so all image types are supported. If many sub
+// images of such an image are required AsSubImager is more efficient.
+//
+// An error is returned if the sub image method of the image returns nil.
 func SubImage(img image.Image, r image.Rectangle) (image.Image, error) {
 	imager, ok := img.(SubImager)
 	if !ok {
-		return nil, fmt.Errorf("Can't create sub image from type %v", reflect.TypeOf(img))
+		r = r.Intersect(img.Bounds())
+		res := image.NewRGBA(r)
+		draw.Draw(res, r, img, r.Min, draw.Src)
+		return res, nil
+	}
+	if res := imager.SubImage(r); res != nil {
+		return res, nil
 	}
-	return imager.SubImage(r), nil
+	return nil, fmt.Errorf("Can't create sub image from type %v", reflect.TypeOf(img))
 }
 
 // ImageResizer resizes an image to the given width and height.
@@ -133,9 +157,9 @@ func NewNfntResizer(interP resize.InterpolationFunction) NfntResizer {
 
 // GetInterP returns an interpolation function given a desired quality.
 // The higher the quality the better the interpolation should be, but execution
-// time is higher. Currently supported are values between 0 and 4, each
-// selecting a different interpolation function. Values greater than 4 are
-// treated as 4.
+// time is higher. Currently supported are values between 0 and 5, each
+// selecting a different interpolation function (from nearest-neighbor to
+// Lanczos3). Values greater than 5 are treated as 5.
 //
 // This method assumes that the interpolation functions provided by nfnt/resize
 // can be sorted according to their quality. This should be a reasonable
@@ -0,0 +1,223 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// This file contains hooks to measure what happens during mosaic generation,
+// for example how many images were decoded or how long the composition took.
+
+// Names of the counters and timers reported to an Instrumentation.
+const (
+	CounterImagesDecoded   = "images_decoded"
+	CounterGCHsComputed    = "gchs_computed"
+	CounterLCHsComputed    = "lchs_computed"
+	CounterCacheHits       = "cache_hits"
+	CounterCacheMisses     = "cache_misses"
+	CounterTilesComposed   = "tiles_composed"
+	CounterTilesPrefetched = "tiles_prefetched"
+
+	CounterMetricCacheHits   = "metric_cache_hits"
+	CounterMetricCacheMisses = "metric_cache_misses"
+
+	TimerSelection  = "selection"
+	TimerCompose    = "compose"
+	TimerHistograms = "histograms"
+	TimerTotal      = "total"
+)
+
+// Instrumentation receives counter and timer events. This way the events can
+// be forwarded to monitoring systems like Prometheus or expvar (see
+// ExpvarInstrumentation). The names are the constants defined above (like
+// CounterImagesDecoded).
+//
+// Implementations must be safe for concurrent use.
+type Instrumentation interface {
+	// AddCount increases the counter by delta.
+	AddCount(name string, delta int64)
+
+	// ObserveDuration reports the duration of a task.
+	ObserveDuration(name string, d time.Duration)
+}
+
+var (
+	instrumentationMutex sync.RWMutex
+	instrumentation      Instrumentation
+)
+
+// SetInstrumentation sets the Instrumentation that receives all events, nil
+// disables the instrumentation (the default). It returns the previous
+// instrumentation.
+func SetInstrumentation(i Instrumentation) Instrumentation {
+	instrumentationMutex.Lock()
+	defer instrumentationMutex.Unlock()
+	old := instrumentation
+	instrumentation = i
+	return old
+}
+
+// GetInstrumentation returns the current instrumentation (might be nil).
+func GetInstrumentation() Instrumentation {
+	instrumentationMutex.RLock()
+	defer instrumentationMutex.RUnlock()
+	return instrumentation
+}
+
+// countEvent reports a counter event to the current instrumentation.
+func countEvent(name string, delta int64) {
+	if i := GetInstrumentation(); i != nil {
+		i.AddCount(name, delta)
+	}
+}
+
+// Timer measures the duration of a task, see StartTimer.
+type Timer struct {
+	name  string
+	start time.Time
+}
+
+// StartTimer starts a new timer, the duration is reported when Stop is called.
+func StartTimer(name string) Timer {
+	return Timer{name: name, start: time.Now()}
+}
+
+// Stop reports the duration since the start of the timer to the current
+// instrumentation and returns it.
+func (t Timer) Stop() time.Duration {
+	d := time.Since(t.start)
+	if i := GetInstrumentation(); i != nil {
+		i.ObserveDuration(t.name, d)
+	}
+	return d
+}
+
+// MultiInstrumentation forwards all events to each of its elements.
+type MultiInstrumentation []Instrumentation
+
+// AddCount calls AddCount on each element.
+func (multi MultiInstrumentation) AddCount(name string, delta int64) {
+	for _, i := range multi {
+		i.AddCount(name, delta)
+	}
+}
+
+// ObserveDuration calls ObserveDuration on each element.
+func (multi MultiInstrumentation) ObserveDuration(name string, d time.Duration) {
+	for _, i := range multi {
+		i.ObserveDuration(name, d)
+	}
+}
+
+// MemoryInstrumentation implements Instrumentation by storing the values of
+// counters and the sum of durations.
+type MemoryInstrumentation struct {
+	m         *sync.Mutex
+	counters  map[string]int64
+	durations map[string]time.Duration
+}
+
+// NewMemoryInstrumentation returns a new instrumentation with all values set to
+// zero.
+func NewMemoryInstrumentation() *MemoryInstrumentation {
+	var m sync.Mutex
+	return &MemoryInstrumentation{
+		m:         &m,
+		counters:  make(map[string]int64),
+		durations: make(map[string]time.Duration),
+	}
+}
+
+// AddCount increases the counter.
+func (mem *MemoryInstrumentation) AddCount(name string, delta int64) {
+	mem.m.Lock()
+	defer mem.m.Unlock()
+	mem.counters[name] += delta
+}
+
+// ObserveDuration adds d to the duration of the timer.
+func (mem *MemoryInstrumentation) ObserveDuration(name string, d time.Duration) {
+	mem.m.Lock()
+	defer mem.m.Unlock()
+	mem.durations[name] += d
+}
+
+// Counter returns the value of a counter.
+func (mem *MemoryInstrumentation) Counter(name string) int64 {
+	mem.m.Lock()
+	defer mem.m.Unlock()
+	return mem.counters[name]
+}
+
+// Duration returns the sum of all durations of a timer.
+func (mem *MemoryInstrumentation) Duration(name string) time.Duration {
+	mem.m.Lock()
+	defer mem.m.Unlock()
+	return mem.durations[name]
+}
+
+// WriteSummary writes all timers and counters to w, sorted by name.
+func (mem *MemoryInstrumentation) WriteSummary(w io.Writer) {
+	mem.m.Lock()
+	defer mem.m.Unlock()
+	timers := make([]string, 0, len(mem.durations))
+	for name := range mem.durations {
+		timers = append(timers, name)
+	}
+	sort.Strings(timers)
+	for _, name := range timers {
+		fmt.Fprintf(w, "  %-16s %v\n", name, mem.durations[name])
+	}
+	counters := make([]string, 0, len(mem.counters))
+	for name := range mem.counters {
+		counters = append(counters, name)
+	}
+	sort.Strings(counters)
+	for _, name := range counters {
+		fmt.Fprintf(w, "  %-16s %d\n", name, mem.counters[name])
+	}
+}
+
+// ExpvarInstrumentation implements Instrumentation by publishing the values
+// with the expvar package. Counters are published as is, for timers the sum
+// of all durations (in seconds) is published with the suffix "_seconds" and
+// the number of observations with the suffix "_count".
+type ExpvarInstrumentation struct {
+	Vars *expvar.Map
+}
+
+// NewExpvarInstrumentation publishes a new map with the given name (for
+// example "gomosaic"). Like expvar.Publish it panics if the name is already
+// in use.
+func NewExpvarInstrumentation(name string) *ExpvarInstrumentation {
+	return &ExpvarInstrumentation{Vars: expvar.NewMap(name)}
+}
+
+// AddCount increases the counter.
+func (e *ExpvarInstrumentation) AddCount(name string, delta int64) {
+	e.Vars.Add(name, delta)
+}
+
+// ObserveDuration adds the duration to the timer.
+func (e *ExpvarInstrumentation) ObserveDuration(name string, d time.Duration) {
+	e.Vars.AddFloat(name+"_seconds", d.Seconds())
+	e.Vars.Add(name+"_count", 1)
+}
@@ -15,17 +15,12 @@
 package gomosaic
 
 import (
-	"encoding/gob"
-	"encoding/json"
 	"fmt"
 	"image"
 	"math"
-	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
-
-	log "github.com/sirupsen/logrus"
 )
 
 // LCH is a sorted collection of global color histograms. Different schemes
@@ -81,10 +76,10 @@ func (lch *LCH) Dist(other *LCH, delta HistogramMetric) (float64, error) {
 func RepairDistribution(distribution TileDivision, numX, numY int) TileDivision {
 	y := len(distribution)
 	if y != numY {
-		log.WithFields(log.Fields{
+		ComposeLogger.Warn("FixedNumDivider returned distribution with wrong number of tiles (height)", LogFields{
 			"expected": numY,
 			"got":      y,
-		}).Warn("FixedNumDivider returned distribution with wrong number of tiles (height)")
+		})
 	}
 	for j := y; j < numY; j++ {
 		distribution = append(distribution, make([]image.Rectangle, numX))
@@ -93,11 +88,11 @@ func RepairDistribution(distribution TileDivision, numX, numY int) TileDivision
 		rects := distribution[j]
 		x := len(rects)
 		if x != numX {
-			log.WithFields(log.Fields{
+			ComposeLogger.Warn("FixedNumDivider returned distribution with wrong number of tiles (width)", LogFields{
 				"expected": numX,
 				"got":      x,
 				"row":      j,
-			}).Warn("FixedNumDivider returned distribution with wrong number of tiles (width)")
+			})
 		}
 		for i := x; i < numX; i++ {
 			rects = append(rects, image.Rectangle{})
@@ -127,6 +122,7 @@ func GenLCH(scheme LCHScheme, img image.Image, k uint, normalize bool) (*LCH, er
 	if distErr != nil {
 		return nil, distErr
 	}
+	countEvent(CounterLCHsComputed, 1)
 	res := make([]*Histogram, len(dist))
 	// for each part compute GCH
 	var wg sync.WaitGroup
@@ -224,6 +220,93 @@ func (s FiveLCHScheme) GetParts(img image.Image) ([][]image.Image, error) {
 	return res, nil
 }
 
+// GridLCHScheme implements a scheme that divides an image into a grid of
+// Rows x Cols parts. Each part of the grid is a part of the LCH, the parts
+// are stored row by row.
+//
+// Note that FourLCHScheme and FiveLCHScheme combine several blocks into one
+// part, GridLCHScheme does not do that.
+type GridLCHScheme struct {
+	Rows, Cols int
+}
+
+// NewGridLCHScheme returns a new grid scheme with rows x cols parts.
+func NewGridLCHScheme(rows, cols int) GridLCHScheme {
+	return GridLCHScheme{Rows: rows, Cols: cols}
+}
+
+// GetParts returns exactly Rows * Cols histograms.
+func (s GridLCHScheme) GetParts(img image.Image) ([][]image.Image, error) {
+	if s.Rows <= 0 || s.Cols <= 0 {
+		return nil, fmt.Errorf("Invalid grid scheme with %dx%d parts", s.Rows, s.Cols)
+	}
+	divider := NewFixedNumDivider(s.Cols, s.Rows, false)
+	parts := divider.Divide(img.Bounds())
+	if Debug {
+		// if in debug mode check for errors while dividing the image
+		parts = RepairDistribution(parts, s.Cols, s.Rows)
+	}
+	imageParts, partsErr := DivideImage(img, parts, s.Rows*s.Cols)
+	if partsErr != nil {
+		return nil, fmt.Errorf("Error computing distribution for LCH: %s", partsErr.Error())
+	}
+	res := make([][]image.Image, 0, s.Rows*s.Cols)
+	for _, row := range imageParts {
+		for _, part := range row {
+			res = append(res, []image.Image{part})
+		}
+	}
+	return res, nil
+}
+
+// ParseLCHScheme parses a scheme descriptor and returns the scheme.
+// Valid descriptors are "4" (FourLCHScheme), "5" (FiveLCHScheme) and
+// "CxR" (for example "3x2"), the latter describes a GridLCHScheme with C
+// columns and R rows (the same format as used for the number of tiles).
+func ParseLCHScheme(descriptor string) (LCHScheme, error) {
+	descriptor = strings.TrimSpace(descriptor)
+	switch descriptor {
+	case "4":
+		return NewFourLCHScheme(), nil
+	case "5":
+		return NewFiveLCHScheme(), nil
+	}
+	cols, rows, parseErr := ParseDimensions(descriptor)
+	if parseErr != nil || rows <= 0 || cols <= 0 {
+		return nil, fmt.Errorf("Invalid LCH scheme \"%s\": Supported are 4, 5 and grids (like 3x3)", descriptor)
+	}
+	return NewGridLCHScheme(rows, cols), nil
+}
+
+// LCHSchemeSize returns the number of parts of a scheme given its
+// descriptor, see ParseLCHScheme.
+func LCHSchemeSize(descriptor string) (uint, error) {
+	scheme, schemeErr := ParseLCHScheme(descriptor)
+	if schemeErr != nil {
+		return 0, schemeErr
+	}
+	switch s := scheme.(type) {
+	case FourLCHScheme:
+		return 4, nil
+	case FiveLCHScheme:
+		return 5, nil
+	case GridLCHScheme:
+		return uint(s.Rows * s.Cols), nil
+	default:
+		return 0, fmt.Errorf("Unknown LCH scheme %s", descriptor)
+	}
+}
+
+// lchSchemeDescriptor returns the descriptor if it is not empty. Otherwise
+// (for example for files written by older versions) the descriptor is
+// derived from the scheme size.
+func lchSchemeDescriptor(descriptor string, size uint) string {
+	if descriptor != "" {
+		return descriptor
+	}
+	return strconv.Itoa(int(size))
+}
+
 // CreateLCHs creates histograms for all images in the ids list and loads the
 // images through the given storage.
 // If you want to create all histograms for a given storage you can use
@@ -236,60 +319,32 @@ func (s FiveLCHScheme) GetParts(img image.Image) ([][]image.Image, error) {
 // see doucmentation for ProgressFunc.
 func CreateLCHs(scheme LCHScheme, ids []ImageID, storage ImageStorage, normalize bool,
 	k uint, numRoutines int, progress ProgressFunc) ([]*LCH, error) {
-	if numRoutines <= 0 {
-		numRoutines = 1
-	}
-	numImages := len(ids)
-	// any error that occurs sets this variable (first error)
-	// this is done later
-	var err error
-
-	res := make([]*LCH, numImages)
-	jobs := make(chan int, BufferSize)
-	errorChan := make(chan error, BufferSize)
-
-	// workers
-	for w := 0; w < numRoutines; w++ {
-		go func() {
-			for next := range jobs {
-				image, imageErr := storage.LoadImage(ids[next])
-				if imageErr != nil {
-					errorChan <- imageErr
-					continue
-				}
-				lch, lchErr := GenLCH(scheme, image, k, normalize)
-				if lchErr != nil {
-					errorChan <- lchErr
-					continue
-				}
-				res[next] = lch
-				errorChan <- nil
-			}
-		}()
-	}
-
-	// create jobs
-	go func() {
-		for i := 0; i < len(ids); i++ {
-			jobs <- i
-		}
-		close(jobs)
-	}()
-
-	// read errors
-	for i := 0; i < numImages; i++ {
-		nextErr := <-errorChan
-		if nextErr != nil && err == nil {
-			err = nextErr
-		}
-		if progress != nil {
-			progress(i)
-		}
-	}
+	res, _, err := CreateLCHsWithPolicy(scheme, ids, storage, normalize, k, numRoutines,
+		progress, ImageErrorsFail)
+	return res, err
+}
+
+// CreateLCHsWithPolicy works as CreateLCHs, policy describes how images that
+// can't be read are handled. With ImageErrorsSkip the LCHs of skipped images
+// are nil, they're listed in the returned report.
+func CreateLCHsWithPolicy(scheme LCHScheme, ids []ImageID, storage ImageStorage, normalize bool,
+	k uint, numRoutines int, progress ProgressFunc, policy ImageErrorPolicy) ([]*LCH, *ImageErrorReport, error) {
+	res := make([]*LCH, len(ids))
+	// errors of GenLCH don't depend on the image, they're never skipped
+	errs := make([]error, len(ids))
+	onImage := func(pos int, img image.Image) {
+		res[pos], errs[pos] = GenLCH(scheme, img, k, normalize)
+	}
+	report, err := forEachImageWithPolicy(ids, storage, numRoutines, onImage, progress, policy)
 	if err != nil {
-		return nil, err
+		return nil, report, err
 	}
-	return res, nil
+	for _, lchErr := range errs {
+		if lchErr != nil {
+			return nil, report, lchErr
+		}
+	}
+	return res, report, nil
 }
 
 // CreateAllLCHs creates all lchs for images in the storage.
@@ -299,6 +354,14 @@ func CreateAllLCHs(scheme LCHScheme, storage ImageStorage, normalize bool,
 	return CreateLCHs(scheme, IDList(storage), storage, normalize, k, numRoutines, progress)
 }
 
+// CreateAllLCHsWithPolicy works as CreateAllLCHs, see CreateLCHsWithPolicy
+// for the policy.
+func CreateAllLCHsWithPolicy(scheme LCHScheme, storage ImageStorage, normalize bool,
+	k uint, numRoutines int, progress ProgressFunc, policy ImageErrorPolicy) ([]*LCH, *ImageErrorReport, error) {
+	return CreateLCHsWithPolicy(scheme, IDList(storage), storage, normalize, k, numRoutines,
+		progress, policy)
+}
+
 // LCHStorage maps image ids to LCHs.
 // By default the histograms of the LCHs should be normalized.
 //
@@ -319,6 +382,9 @@ type MemoryLCHStorage struct {
 	LCHs []*LCH
 	K    uint
 	Size uint
+	// Scheme is the descriptor of the scheme the LCHs were created with, see
+	// ParseLCHScheme. If empty the descriptor is derived from Size.
+	Scheme string
 }
 
 // NewMemoryLCHStorage returns a new memory LCH storage storing LCHs of size
@@ -340,11 +406,22 @@ func NewMemoryLCHStorage(k, schemeSize uint, capacity int) *MemoryLCHStorage {
 // If id is not a valid position inside the the list an error is returned.
 func (s *MemoryLCHStorage) GetLCH(id ImageID) (*LCH, error) {
 	if int(id) < 0 || int(id) >= len(s.LCHs) {
-		return nil, fmt.Errorf("LCH for id %d not registered", id)
+		return nil, fmt.Errorf("LCH for id %d not registered: %w", id, ErrImageNotFound)
 	}
 	return s.LCHs[id], nil
 }
 
+// Retain keeps only the LCHs for the given ids (in the given order).
+// It is used to update the storage after images were removed from a mapper,
+// see FSMapper.Retain.
+func (s *MemoryLCHStorage) Retain(ids []ImageID) {
+	lchs := make([]*LCH, len(ids))
+	for i, id := range ids {
+		lchs[i] = s.LCHs[id]
+	}
+	s.LCHs = lchs
+}
+
 // Divisions returns the number of sub-divisions k.
 func (s *MemoryLCHStorage) Divisions() uint {
 	return s.K
@@ -355,6 +432,11 @@ func (s *MemoryLCHStorage) SchemeSize() uint {
 	return s.Size
 }
 
+// SchemeDescriptor returns the descriptor of the scheme, see ParseLCHScheme.
+func (s *MemoryLCHStorage) SchemeDescriptor() string {
+	return lchSchemeDescriptor(s.Scheme, s.Size)
+}
+
 // LCHFSEntry is used to store LCHs on the filesystem.
 // It contains the path of the image the LCH was created for as well
 // as the LCH data.
@@ -394,7 +476,15 @@ type LCHFSController struct {
 	Entries []LCHFSEntry
 	K       uint
 	Size    uint
+	Scheme  string
 	Version string
+
+	// FormatVersion is the version of the file format, see FSFormatVersion.
+	FormatVersion int
+
+	// Root is the directory the paths of the entries are relative to, it's
+	// empty if the paths are absolute. See MakeRelative and Rebase.
+	Root string
 }
 
 // NewLCHFSController returns an empty file system controller with the given
@@ -405,10 +495,11 @@ func NewLCHFSController(k, schemeSize uint, capacity int) *LCHFSController {
 		capacity = 100
 	}
 	return &LCHFSController{
-		Entries: make([]LCHFSEntry, 0, capacity),
-		K:       k,
-		Size:    schemeSize,
-		Version: Version,
+		Entries:       make([]LCHFSEntry, 0, capacity),
+		K:             k,
+		Size:          schemeSize,
+		Version:       Version,
+		FormatVersion: FSFormatVersion,
 	}
 }
 
@@ -420,13 +511,19 @@ func NewLCHFSController(k, schemeSize uint, capacity int) *LCHFSController {
 //
 // If you want to create a fs controller with all ids from a storage you can use
 // IDList to create a list of all ids.
+//
+// If the storage has a method SchemeDescriptor() string (like
+// MemoryLCHStorage) the descriptor is stored as well.
 func CreateLCHFSController(ids []ImageID, mapper *FSMapper, storage LCHStorage) (*LCHFSController, error) {
 	res := NewLCHFSController(storage.Divisions(), storage.SchemeSize(), len(ids))
+	if withScheme, ok := storage.(interface{ SchemeDescriptor() string }); ok {
+		res.Scheme = withScheme.SchemeDescriptor()
+	}
 	for _, id := range ids {
 		// lookup file name
 		path, ok := mapper.GetPath(id)
 		if !ok {
-			return nil, fmt.Errorf("Can't retrieve path for image with id %d", id)
+			return nil, fmt.Errorf("Can't retrieve path for image with id %d: %w", id, ErrImageNotFound)
 		}
 		// lookup lch
 		lch, lchErr := storage.GetLCH(id)
@@ -438,89 +535,88 @@ func CreateLCHFSController(ids []ImageID, mapper *FSMapper, storage LCHStorage)
 	return res, nil
 }
 
-// WriteGobFile writes the LCH to a file encoded gob format.
+// WriteGobFile writes the LCHs to a file encoded gob format.
 func (c *LCHFSController) WriteGobFile(path string) error {
-	// just to be sure
 	c.Version = Version
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	err = enc.Encode(c)
-	return err
+	c.FormatVersion = FSFormatVersion
+	return encodeFeatureFile(path, "gob", false, c)
 }
 
 // ReadGobFile reads the content of the controller from the specified file.
 // The file must be encoded in gob.
 func (c *LCHFSController) ReadGobFile(path string) error {
-	f, err := os.Open(path)
-	if err != nil {
+	if err := decodeFeatureFile(path, "gob", false, c); err != nil {
 		return err
 	}
-	defer f.Close()
-	dec := gob.NewDecoder(f)
-	err = dec.Decode(c)
-	return err
+	return MigrateLCHFSController(c)
 }
 
 // WriteJSON writes the LCHs to  a file encoded in json format.
 func (c *LCHFSController) WriteJSON(path string) error {
-	// again, to be sure
 	c.Version = Version
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	err = enc.Encode(c)
-	return err
+	c.FormatVersion = FSFormatVersion
+	return encodeFeatureFile(path, "json", false, c)
 }
 
 // ReadJSONFile reads the content of the controller from the specified file.
 // The file must be encoded in json.
 func (c *LCHFSController) ReadJSONFile(path string) error {
-	f, err := os.Open(path)
-	if err != nil {
+	if err := decodeFeatureFile(path, "json", false, c); err != nil {
+		return err
+	}
+	return MigrateLCHFSController(c)
+}
+
+// entryPaths returns pointers to the paths of all entries.
+func (c *LCHFSController) entryPaths() []*string {
+	res := make([]*string, len(c.Entries))
+	for i := range c.Entries {
+		res[i] = &c.Entries[i].Path
+	}
+	return res
+}
+
+// MakeRelative converts the paths of all entries to paths relative to root
+// (which must be an absolute path). This way the file can be moved to another
+// machine and the paths can be rebased there, see Rebase. An error is returned
+// if an image is not inside root, in this case the controller is not changed.
+func (c *LCHFSController) MakeRelative(root string) error {
+	if err := makeRelativeFeaturePaths(c.Root, root, c.entryPaths()); err != nil {
 		return err
 	}
-	defer f.Close()
-	dec := json.NewDecoder(f)
-	err = dec.Decode(c)
+	c.Root = root
+	return nil
+}
+
+// Rebase converts the relative paths (see MakeRelative) to absolute paths by
+// joining them with root. If root is empty the directory the paths were made
+// relative to is used. If the paths are already absolute nothing happens if
+// root is empty, otherwise an error is returned.
+func (c *LCHFSController) Rebase(root string) error {
+	rebased, err := rebaseFeaturePaths(c.Root, root, c.entryPaths())
+	if rebased {
+		c.Root = ""
+	}
 	return err
 }
 
 // ReadFile reads the content of the controller from the specified file.
 // The read method depends on the file extension which must be either .json
-// or .gob.
+// or .gob, optionally followed by .gz for gzip compressed files.
 func (c *LCHFSController) ReadFile(path string) error {
-	ext := filepath.Ext(path)
-	ext = strings.ToLower(ext)
-	switch ext {
-	case ".json":
-		return c.ReadJSONFile(path)
-	case ".gob":
-		return c.ReadGobFile(path)
-	default:
-		return fmt.Errorf("Unkown file extension for LCH file: %s. Should be \".json\" or \".gob\"", ext)
+	if err := readFeatureFile(path, "LCH", c); err != nil {
+		return err
 	}
+	return MigrateLCHFSController(c)
 }
 
 // WriteFile writes the content of the controller to a file depending on the
-// file extension hich must be either .json or .gob.
+// file extension hich must be either .json or .gob, optionally followed by .gz
+// for gzip compressed files.
 func (c *LCHFSController) WriteFile(path string) error {
-	ext := filepath.Ext(path)
-	ext = strings.ToLower(ext)
-	switch ext {
-	case ".json":
-		return c.WriteJSON(path)
-	case ".gob":
-		return c.WriteGobFile(path)
-	default:
-		return fmt.Errorf("Unkown file extension for LCH file: %s. Should be \".json\" or \".gob\"", ext)
-	}
+	c.Version = Version
+	c.FormatVersion = FSFormatVersion
+	return writeFeatureFile(path, "LCH", c)
 }
 
 // Map computes the mapping filename ↦ lch. That is useful sometimes,
@@ -565,6 +661,7 @@ func MemLCHStorageFromFSMapper(mapper *FSMapper, fileContent *LCHFSController,
 		lchMap = fileContent.Map()
 	}
 	res := NewMemoryLCHStorage(fileContent.K, fileContent.Size, mapper.Len())
+	res.Scheme = lchSchemeDescriptor(fileContent.Scheme, fileContent.Size)
 	// now add each lch to the result, if no lch exists return an error
 	for _, imagePath := range mapper.IDMapping {
 		// lookup
@@ -0,0 +1,105 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// This file contains the logging of the library. The selection, composition
+// and the FSMapper log to a Logger, by default nothing is logged. Programs
+// that want the output of these subsystems set a logger, for example
+// SetLogger(NewLogrusLogger(nil)).
+
+// LogFields are additional values attached to a log message, like the id of
+// an image. The error is stored with the key "error".
+type LogFields map[string]interface{}
+
+// Logger is used by the library to log messages, fields can be nil.
+type Logger interface {
+	Debug(msg string, fields LogFields)
+	Info(msg string, fields LogFields)
+	Warn(msg string, fields LogFields)
+	Error(msg string, fields LogFields)
+}
+
+// NopLogger is a Logger that discards all messages.
+type NopLogger struct{}
+
+// Debug does nothing.
+func (NopLogger) Debug(msg string, fields LogFields) {}
+
+// Info does nothing.
+func (NopLogger) Info(msg string, fields LogFields) {}
+
+// Warn does nothing.
+func (NopLogger) Warn(msg string, fields LogFields) {}
+
+// Error does nothing.
+func (NopLogger) Error(msg string, fields LogFields) {}
+
+// LogrusLogger is a Logger that logs to a logrus logger.
+type LogrusLogger struct {
+	Logger log.FieldLogger
+}
+
+// NewLogrusLogger returns a new logger logging to logger, if logger is nil
+// the standard logger of logrus is used.
+func NewLogrusLogger(logger log.FieldLogger) LogrusLogger {
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+	return LogrusLogger{Logger: logger}
+}
+
+// Debug logs a message with level debug.
+func (l LogrusLogger) Debug(msg string, fields LogFields) {
+	l.Logger.WithFields(log.Fields(fields)).Debug(msg)
+}
+
+// Info logs a message with level info.
+func (l LogrusLogger) Info(msg string, fields LogFields) {
+	l.Logger.WithFields(log.Fields(fields)).Info(msg)
+}
+
+// Warn logs a message with level warn.
+func (l LogrusLogger) Warn(msg string, fields LogFields) {
+	l.Logger.WithFields(log.Fields(fields)).Warn(msg)
+}
+
+// Error logs a message with level error.
+func (l LogrusLogger) Error(msg string, fields LogFields) {
+	l.Logger.WithFields(log.Fields(fields)).Error(msg)
+}
+
+var (
+	// SelectionLogger is used by the image selectors and metrics.
+	SelectionLogger Logger = NopLogger{}
+
+	// ComposeLogger is used to divide images and compose the mosaic.
+	ComposeLogger Logger = NopLogger{}
+
+	// MapperLogger is used by FSMapper and when loading images from the
+	// filesystem.
+	MapperLogger Logger = NopLogger{}
+)
+
+// SetLogger sets the logger of all subsystems (SelectionLogger, ComposeLogger
+// and MapperLogger).
+func SetLogger(logger Logger) {
+	SelectionLogger = logger
+	ComposeLogger = logger
+	MapperLogger = logger
+}
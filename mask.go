@@ -0,0 +1,248 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"image"
+	"image/color"
+)
+
+// This file contains the selection of images with an importance mask: A
+// grayscale image parallel to the query that describes which regions are
+// important (white) and which are not (black). For example the tiles showing
+// faces should be matched as good as possible, while for the background
+// variety is more important.
+
+// DefaultMaskThreshold is the default importance from which on a tile is
+// considered important, see MaskedSelector.
+const DefaultMaskThreshold = 0.5
+
+// TileImportance computes the importance of each tile in dist: The mean gray
+// value (between 0 and 1) of the tile in the mask. The mask is scaled to
+// queryBounds, thus it doesn't need to have the same size as the query.
+func TileImportance(mask image.Image, queryBounds image.Rectangle, dist TileDivision) [][]float64 {
+	maskBounds := mask.Bounds()
+	maskDist := ScaleDivision(dist, queryBounds, maskBounds)
+	res := make([][]float64, len(maskDist))
+	for i, col := range maskDist {
+		res[i] = make([]float64, len(col))
+		for j, tile := range col {
+			r := tile.Intersect(maskBounds)
+			if r.Empty() {
+				// tile is smaller than a pixel of the mask, use the pixel at its
+				// upper left corner
+				r = image.Rect(tile.Min.X, tile.Min.Y, tile.Min.X+1, tile.Min.Y+1).Intersect(maskBounds)
+				if r.Empty() {
+					continue
+				}
+			}
+			var sum uint64
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					sum += uint64(color.GrayModel.Convert(mask.At(x, y)).(color.Gray).Y)
+				}
+			}
+			res[i][j] = float64(sum) / float64(255*r.Dx()*r.Dy())
+		}
+	}
+	return res
+}
+
+// MaskedSelector is an ImageSelector that uses two selectors: Important is
+// used for all tiles with an importance (see TileImportance) of at least
+// Threshold and Other for all remaining tiles. Usually Important selects the
+// best image from the whole database (possibly with a stricter metric) and
+// Other is a variety selector.
+//
+// Each selector is called with a division that contains only its tiles.
+type MaskedSelector struct {
+	Mask      image.Image
+	Threshold float64
+	Important ImageSelector
+	Other     ImageSelector
+}
+
+// NewMaskedSelector returns a new selector with the threshold
+// DefaultMaskThreshold.
+func NewMaskedSelector(mask image.Image, important, other ImageSelector) *MaskedSelector {
+	return &MaskedSelector{
+		Mask:      mask,
+		Threshold: DefaultMaskThreshold,
+		Important: important,
+		Other:     other,
+	}
+}
+
+// Init calls Init on both selectors.
+func (sel *MaskedSelector) Init(storage ImageStorage) error {
+	if err := sel.Important.Init(storage); err != nil {
+		return err
+	}
+	return sel.Other.Init(storage)
+}
+
+// SelectImages splits the division into important and other tiles and
+// selects the images for both parts. progress is called with the number of
+// tiles processed in both parts.
+func (sel *MaskedSelector) SelectImages(storage ImageStorage,
+	query image.Image, dist TileDivision, progress ProgressFunc) ([][]ImageID, error) {
+	importance := TileImportance(sel.Mask, query.Bounds(), dist)
+	important := make([][]bool, len(importance))
+	for i, col := range importance {
+		important[i] = make([]bool, len(col))
+		for j, value := range col {
+			important[i][j] = value >= sel.Threshold
+		}
+	}
+	importantDist, otherDist := dist.Split(important)
+	numImportant := importantDist.Size()
+	var importantSelection, otherSelection [][]ImageID
+	if numImportant > 0 {
+		var selectionErr error
+		importantSelection, selectionErr = sel.Important.SelectImages(storage, query, importantDist, progress)
+		if selectionErr != nil {
+			return nil, selectionErr
+		}
+	}
+	if otherDist.Size() > 0 {
+		var otherProgress ProgressFunc
+		if progress != nil {
+			otherProgress = func(num int) {
+				progress(numImportant + num)
+			}
+		}
+		var selectionErr error
+		otherSelection, selectionErr = sel.Other.SelectImages(storage, query, otherDist, otherProgress)
+		if selectionErr != nil {
+			return nil, selectionErr
+		}
+	}
+	return MergeSelections(important, importantSelection, otherSelection), nil
+}
+
+// SelectImagesWithMask selects the images for the query with a
+// MaskedSelector with threshold DefaultMaskThreshold. The selectors must be
+// initialized.
+func SelectImagesWithMask(storage ImageStorage, query image.Image, dist TileDivision,
+	important, other ImageSelector, progress ProgressFunc, mask image.Image) ([][]ImageID, error) {
+	return NewMaskedSelector(mask, important, other).SelectImages(storage, query, dist, progress)
+}
+
+// EmptyTiles returns for each tile of dist if it should be left empty: A tile
+// is empty if it's fully transparent in the query or completely black in
+// shape. shape is optional (nil) and scaled to the bounds of the query as in
+// TileImportance.
+func EmptyTiles(query, shape image.Image, dist TileDivision) [][]bool {
+	var importance [][]float64
+	if shape != nil {
+		importance = TileImportance(shape, query.Bounds(), dist)
+	}
+	// test the alpha channel only if the query is not opaque
+	checkAlpha := true
+	if opaque, ok := query.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		checkAlpha = false
+	}
+	res := make([][]bool, len(dist))
+	for i, col := range dist {
+		res[i] = make([]bool, len(col))
+		for j, r := range col {
+			switch {
+			case importance != nil && importance[i][j] == 0.0:
+				res[i][j] = true
+			case checkAlpha:
+				res[i][j] = transparentArea(query, r)
+			}
+		}
+	}
+	return res
+}
+
+// transparentArea returns true if all pixels of img in r are fully
+// transparent.
+func transparentArea(img image.Image, r image.Rectangle) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SkipSelector is an ImageSelector that leaves the empty tiles of the query
+// (see EmptyTiles) out: Selector is called with a division that contains only
+// the other tiles and NoImageID is used for the empty tiles.
+// ComposeMosaic leaves tiles with NoImageID transparent, this way
+// non-rectangular mosaics (like logos or text) can be created.
+type SkipSelector struct {
+	Selector ImageSelector
+	// Shape is an optional mask, all tiles that are black in the mask are
+	// left empty.
+	Shape image.Image
+}
+
+// NewSkipSelector returns a new selector, shape can be nil.
+func NewSkipSelector(selector ImageSelector, shape image.Image) *SkipSelector {
+	return &SkipSelector{Selector: selector, Shape: shape}
+}
+
+// Init calls Init of the wrapped selector.
+func (sel *SkipSelector) Init(storage ImageStorage) error {
+	return sel.Selector.Init(storage)
+}
+
+// SelectImages selects the images for all tiles that are not empty.
+func (sel *SkipSelector) SelectImages(storage ImageStorage,
+	query image.Image, dist TileDivision, progress ProgressFunc) ([][]ImageID, error) {
+	empty := EmptyTiles(query, sel.Shape, dist)
+	emptyDist, otherDist := dist.Split(empty)
+	if emptyDist.Size() == 0 {
+		return sel.Selector.SelectImages(storage, query, dist, progress)
+	}
+	var selection [][]ImageID
+	if otherDist.Size() > 0 {
+		var selectionErr error
+		selection, selectionErr = sel.Selector.SelectImages(storage, query, otherDist, progress)
+		if selectionErr != nil {
+			return nil, selectionErr
+		}
+	}
+	return MergeSelections(empty, nil, selection), nil
+}
+
+// SelectImagesDetailed selects the images like SelectImages and also reports
+// the details of the selection, see SelectDetailed. Empty tiles have a value
+// of NaN and no candidates. If the wrapped selector is not a DetailedSelector
+// the details contain no values.
+func (sel *SkipSelector) SelectImagesDetailed(storage ImageStorage,
+	query image.Image, dist TileDivision, numCandidates int,
+	progress ProgressFunc) (*SelectionDetails, error) {
+	empty := EmptyTiles(query, sel.Shape, dist)
+	emptyDist, otherDist := dist.Split(empty)
+	if emptyDist.Size() == 0 {
+		return SelectDetailed(sel.Selector, nil, storage, query, dist, numCandidates, progress)
+	}
+	var details *SelectionDetails
+	if otherDist.Size() > 0 {
+		var detailsErr error
+		details, detailsErr = SelectDetailed(sel.Selector, nil, storage, query, otherDist,
+			numCandidates, progress)
+		if detailsErr != nil {
+			return nil, detailsErr
+		}
+	}
+	return MergeSelectionDetails(empty, nil, details), nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"sync"
+)
+
+// memoryImage is an entry in MemoryImageStorage, either img or data is set.
+type memoryImage struct {
+	img  image.Image
+	data []byte
+}
+
+// MemoryImageStorage implements ImageStorage by holding the images in memory.
+// Images can be added either decoded (as image.Image) or encoded (for example
+// the content of an uploaded jpg file), encoded images are decoded each time
+// they're loaded.
+//
+// This is useful when the library is embedded in other applications that
+// don't want to write images to the filesystem.
+//
+// It is safe for concurrent use.
+type MemoryImageStorage struct {
+	images []memoryImage
+	mutex  *sync.RWMutex
+}
+
+// NewMemoryImageStorage returns a new empty storage.
+func NewMemoryImageStorage() *MemoryImageStorage {
+	return &MemoryImageStorage{
+		images: nil,
+		mutex:  new(sync.RWMutex),
+	}
+}
+
+// NumImages returns the number of images in the storage.
+func (s *MemoryImageStorage) NumImages() ImageID {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return ImageID(len(s.images))
+}
+
+// Add adds a decoded image and returns its id.
+func (s *MemoryImageStorage) Add(img image.Image) ImageID {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.images = append(s.images, memoryImage{img: img})
+	return ImageID(len(s.images) - 1)
+}
+
+// AddEncoded adds an encoded image (in a format registered with the image
+// package) and returns its id. An error is returned if the image config
+// can't be decoded.
+func (s *MemoryImageStorage) AddEncoded(data []byte) (ImageID, error) {
+	if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return NoImageID, wrapDecodeErr("encoded image", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.images = append(s.images, memoryImage{data: data})
+	return ImageID(len(s.images) - 1), nil
+}
+
+// Remove removes the image with the given id. Note that the ids of all images
+// after id are decreased by one, thus precomputed data (like histograms) must
+// be updated accordingly.
+func (s *MemoryImageStorage) Remove(id ImageID) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if id < 0 || int(id) >= len(s.images) {
+		return fmt.Errorf("Invalid image id %d: %w", id, ErrImageNotFound)
+	}
+	s.images = append(s.images[:id], s.images[id+1:]...)
+	return nil
+}
+
+func (s *MemoryImageStorage) get(id ImageID) (memoryImage, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if id < 0 || int(id) >= len(s.images) {
+		return memoryImage{}, fmt.Errorf("Invalid image id %d: %w", id, ErrImageNotFound)
+	}
+	return s.images[id], nil
+}
+
+// LoadImage returns the image with the given id.
+func (s *MemoryImageStorage) LoadImage(id ImageID) (image.Image, error) {
+	entry, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if entry.img != nil {
+		return entry.img, nil
+	}
+	countEvent(CounterImagesDecoded, 1)
+	img, _, decodeErr := image.Decode(bytes.NewReader(entry.data))
+	return img, wrapDecodeErr(fmt.Sprintf("image %d", id), decodeErr)
+}
+
+// LoadConfig returns the config of the image with the given id.
+func (s *MemoryImageStorage) LoadConfig(id ImageID) (image.Config, error) {
+	entry, err := s.get(id)
+	if err != nil {
+		return image.Config{}, err
+	}
+	if entry.img != nil {
+		bounds := entry.img.Bounds()
+		return image.Config{
+			ColorModel: entry.img.ColorModel(),
+			Width:      bounds.Dx(),
+			Height:     bounds.Dy(),
+		}, nil
+	}
+	config, _, decodeErr := image.DecodeConfig(bytes.NewReader(entry.data))
+	return config, decodeErr
+}
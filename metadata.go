@@ -0,0 +1,278 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// This file contains the metadata of generated mosaics (tile counts, metric,
+// ...). The metadata is embedded in the mosaic: As text chunks in png files
+// and as EXIF data in jpg files. This way mosaics are self-describing.
+
+// pngMetadataPrefix is the prefix of the keywords of the png text chunks
+// containing the metadata.
+const pngMetadataPrefix = "gomosaic:"
+
+// EXIF tags used to store the metadata in jpg files.
+const (
+	exifImageDescriptionTag = 0x010e
+	exifSoftwareTag         = 0x0131
+)
+
+// MosaicMetadata describes how a mosaic was generated, it maps names (like
+// "metric") to values. The key "version" is always set to the version of
+// gomosaic that created the mosaic.
+type MosaicMetadata map[string]string
+
+// NewMosaicMetadata returns new metadata with the version set.
+func NewMosaicMetadata() MosaicMetadata {
+	return MosaicMetadata{"version": Version}
+}
+
+// Keys returns the sorted keys of the metadata.
+func (m MosaicMetadata) Keys() []string {
+	res := make([]string, 0, len(m))
+	for key := range m {
+		res = append(res, key)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// EncodeOptions describes how a mosaic is encoded, see EncodeMosaic.
+//
+// JPGQuality is the quality for jpg images, PNGCompression and NumRoutines are
+// used for png images (see EncodePNGParallel). Metadata is embedded in the
+// image, it can be nil.
+type EncodeOptions struct {
+	JPGQuality     int
+	PNGCompression png.CompressionLevel
+	NumRoutines    int
+	Metadata       MosaicMetadata
+}
+
+// DefaultEncodeOptions returns the options with jpg.DefaultQuality, the
+// default png compression, one routine and no metadata.
+func DefaultEncodeOptions() EncodeOptions {
+	return EncodeOptions{
+		JPGQuality:     jpeg.DefaultQuality,
+		PNGCompression: png.DefaultCompression,
+		NumRoutines:    1,
+	}
+}
+
+// EncodeMosaic writes the mosaic to w together with the metadata. format is
+// either "jpg" (or "jpeg") or "png", a leading dot is ignored (so a file
+// extension can be used). w is not buffered, use for example a bufio.Writer
+// for files.
+//
+// This way mosaics can be written to other destinations than files, for
+// example HTTP responses or pipes.
+func EncodeMosaic(w io.Writer, format string, img image.Image, options EncodeOptions) error {
+	format, formatErr := ParseMosaicFormat(format)
+	if formatErr != nil {
+		return formatErr
+	}
+	if format == "jpg" {
+		return encodeJPGMetadata(w, img, options.Metadata, options.JPGQuality)
+	}
+	text := make(map[string]string, len(options.Metadata))
+	for key, value := range options.Metadata {
+		text[pngMetadataPrefix+key] = value
+	}
+	return EncodePNGParallel(w, img, options.PNGCompression, options.NumRoutines, text)
+}
+
+// ParseMosaicFormat returns "jpg" or "png" for the formats supported by
+// EncodeMosaic (case insensitive, a leading dot is ignored).
+func ParseMosaicFormat(format string) (string, error) {
+	switch lower := strings.ToLower(strings.TrimPrefix(format, ".")); lower {
+	case "jpg", "jpeg":
+		return "jpg", nil
+	case "png":
+		return "png", nil
+	default:
+		return "", fmt.Errorf("Unsupported image format: %s, expected jpg or png", format)
+	}
+}
+
+// SaveMosaic writes the mosaic to a file together with the metadata, the
+// format (jpg or png) is given by the file extension. jpgQuality is the
+// quality for jpg files, pngCompression and numRoutines are used for png files
+// (see EncodePNGParallel). metadata can be nil.
+func SaveMosaic(path string, img image.Image, metadata MosaicMetadata,
+	jpgQuality int, pngCompression png.CompressionLevel, numRoutines int) error {
+	ext := filepath.Ext(path)
+	if _, formatErr := ParseMosaicFormat(ext); formatErr != nil {
+		return fmt.Errorf("Unsupported file type: %s, expected .jpg or .png", ext)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	options := EncodeOptions{
+		JPGQuality:     jpgQuality,
+		PNGCompression: pngCompression,
+		NumRoutines:    numRoutines,
+		Metadata:       metadata,
+	}
+	if err = EncodeMosaic(w, ext, img, options); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// encodeJPGMetadata encodes img as jpg and adds an EXIF segment containing the
+// metadata (json encoded as image description).
+func encodeJPGMetadata(w io.Writer, img image.Image, metadata MosaicMetadata, quality int) error {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if len(metadata) == 0 {
+		_, err := w.Write(data)
+		return err
+	}
+	description, jsonErr := json.Marshal(metadata)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	segment := append([]byte("Exif\x00\x00"), tiffASCII(map[uint16]string{
+		exifImageDescriptionTag: string(description),
+		exifSoftwareTag:         "gomosaic " + Version,
+	})...)
+	if len(segment)+2 > 0xffff {
+		return errors.New("Metadata is too large for an EXIF segment")
+	}
+	header := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(segment)+2))
+	// insert the segment after the start of image marker
+	for _, part := range [][]byte{data[:2], header, segment, data[2:]} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tiffASCII returns TIFF data (big endian) with one IFD containing the ASCII
+// tags.
+func tiffASCII(tags map[uint16]string) []byte {
+	ids := make([]int, 0, len(tags))
+	for tag := range tags {
+		ids = append(ids, int(tag))
+	}
+	// entries must be sorted by tag
+	sort.Ints(ids)
+	ifdSize := 2 + 12*len(ids) + 4
+	res := make([]byte, 8+ifdSize)
+	copy(res, "MM")
+	binary.BigEndian.PutUint16(res[2:], 42)
+	binary.BigEndian.PutUint32(res[4:], 8)
+	binary.BigEndian.PutUint16(res[8:], uint16(len(ids)))
+	for i, tag := range ids {
+		// the values are stored after the IFD (null terminated)
+		value := append([]byte(tags[uint16(tag)]), 0)
+		entry := res[10+12*i:]
+		binary.BigEndian.PutUint16(entry, uint16(tag))
+		binary.BigEndian.PutUint16(entry[2:], 2)
+		binary.BigEndian.PutUint32(entry[4:], uint32(len(value)))
+		if len(value) <= 4 {
+			copy(entry[8:12], value)
+		} else {
+			binary.BigEndian.PutUint32(entry[8:], uint32(len(res)))
+			res = append(res, value...)
+		}
+	}
+	return res
+}
+
+// ReadMosaicMetadata reads the metadata embedded in a mosaic (see
+// SaveMosaic). If the file contains no metadata an empty map is returned.
+func ReadMosaicMetadata(path string) (MosaicMetadata, error) {
+	data, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		return nil, readErr
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return pngMetadata(data[8:])
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		tiff, tiffErr := exifTIFF(data)
+		if tiffErr != nil || tiff == nil {
+			return MosaicMetadata{}, tiffErr
+		}
+		description, descriptionErr := tiffASCIITag(tiff, exifImageDescriptionTag)
+		if descriptionErr != nil || description == "" {
+			return MosaicMetadata{}, descriptionErr
+		}
+		res := MosaicMetadata{}
+		if jsonErr := json.Unmarshal([]byte(description), &res); jsonErr != nil {
+			// not created by gomosaic
+			return MosaicMetadata{}, nil
+		}
+		return res, nil
+	default:
+		return nil, fmt.Errorf("Unsupported file %s, expected jpg or png", path)
+	}
+}
+
+// pngMetadata returns the metadata from the text chunks of a png file, data
+// are the chunks of the file (without the png signature).
+func pngMetadata(data []byte) (MosaicMetadata, error) {
+	res := MosaicMetadata{}
+	for len(data) >= 12 {
+		length := int(binary.BigEndian.Uint32(data))
+		chunkType := string(data[4:8])
+		if length < 0 || 12+length > len(data) {
+			return nil, errors.New("Invalid png file: Chunk exceeds file")
+		}
+		if chunkType == "tEXt" {
+			chunk := data[8 : 8+length]
+			if sep := bytes.IndexByte(chunk, 0); sep >= 0 {
+				keyword := string(chunk[:sep])
+				if strings.HasPrefix(keyword, pngMetadataPrefix) {
+					res[strings.TrimPrefix(keyword, pngMetadataPrefix)] = string(chunk[sep+1:])
+				}
+			}
+		}
+		if chunkType == "IEND" {
+			break
+		}
+		data = data[12+length:]
+	}
+	return res, nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"math"
+	"strings"
+)
+
+// This file contains batched versions of the vector metrics: Comparing one
+// tile with all database images is the hotspot of the selection, so instead
+// of calling a metric function for each pair of histograms the tile is
+// compared with all database histograms in one call.
+//
+// The implementations are plain Go (no assembly or cgo), the loops are
+// unrolled and use independent accumulators so that the compiler can
+// eliminate bounds checks and the CPU can pipeline the operations. Because the
+// order of the additions differs the results may differ from the non-batched
+// metric in the last bits.
+
+// BatchVectorMetric compares the vector p with each vector in all, the result
+// contains the metric values in the same order as all. nil entries in all
+// are allowed, the value for them is +Inf.
+type BatchVectorMetric func(p []float64, all [][]float64) []float64
+
+// CompareAll compares p with each vector in all with the given metric, it's the
+// generic version of a BatchVectorMetric.
+func CompareAll(metric VectorMetric, p []float64, all [][]float64) []float64 {
+	res := make([]float64, len(all))
+	for i, q := range all {
+		if q == nil {
+			res[i] = math.Inf(1)
+			continue
+		}
+		res[i] = metric(p, q)
+	}
+	return res
+}
+
+// BatchFromVectorMetric converts a vector metric to a batch metric, see
+// CompareAll.
+func BatchFromVectorMetric(metric VectorMetric) BatchVectorMetric {
+	return func(p []float64, all [][]float64) []float64 {
+		return CompareAll(metric, p, all)
+	}
+}
+
+// ManhattanAll is the batch version of Manhattan.
+func ManhattanAll(p []float64, all [][]float64) []float64 {
+	res := make([]float64, len(all))
+	n := len(p)
+	for i, q := range all {
+		if q == nil {
+			res[i] = math.Inf(1)
+			continue
+		}
+		q = q[:n]
+		var s0, s1, s2, s3 float64
+		j := 0
+		for ; j+4 <= n; j += 4 {
+			s0 += math.Abs(p[j] - q[j])
+			s1 += math.Abs(p[j+1] - q[j+1])
+			s2 += math.Abs(p[j+2] - q[j+2])
+			s3 += math.Abs(p[j+3] - q[j+3])
+		}
+		for ; j < n; j++ {
+			s0 += math.Abs(p[j] - q[j])
+		}
+		res[i] = (s0 + s1) + (s2 + s3)
+	}
+	return res
+}
+
+// EuclideanDistanceAll is the batch version of EuclideanDistance.
+func EuclideanDistanceAll(p []float64, all [][]float64) []float64 {
+	res := make([]float64, len(all))
+	n := len(p)
+	for i, q := range all {
+		if q == nil {
+			res[i] = math.Inf(1)
+			continue
+		}
+		q = q[:n]
+		var s0, s1, s2, s3 float64
+		j := 0
+		for ; j+4 <= n; j += 4 {
+			d0 := p[j] - q[j]
+			d1 := p[j+1] - q[j+1]
+			d2 := p[j+2] - q[j+2]
+			d3 := p[j+3] - q[j+3]
+			s0 += d0 * d0
+			s1 += d1 * d1
+			s2 += d2 * d2
+			s3 += d3 * d3
+		}
+		for ; j < n; j++ {
+			d := p[j] - q[j]
+			s0 += d * d
+		}
+		res[i] = math.Sqrt((s0 + s1) + (s2 + s3))
+	}
+	return res
+}
+
+// CosineSimilarityAll is the batch version of CosineSimilarity. The length of
+// p is computed only once.
+func CosineSimilarityAll(p []float64, all [][]float64) []float64 {
+	res := make([]float64, len(all))
+	n := len(p)
+	var lengthP float64
+	for _, e := range p {
+		lengthP += e * e
+	}
+	lengthP = math.Sqrt(lengthP)
+	for i, q := range all {
+		if q == nil {
+			res[i] = math.Inf(1)
+			continue
+		}
+		q = q[:n]
+		var dot0, dot1, len0, len1 float64
+		j := 0
+		for ; j+2 <= n; j += 2 {
+			dot0 += p[j] * q[j]
+			dot1 += p[j+1] * q[j+1]
+			len0 += q[j] * q[j]
+			len1 += q[j+1] * q[j+1]
+		}
+		for ; j < n; j++ {
+			dot0 += p[j] * q[j]
+			len0 += q[j] * q[j]
+		}
+		lengthQ := len0 + len1
+		if lengthP == 0.0 || lengthQ == 0.0 {
+			// same special case as in CosineSimilarity
+			res[i] = 2.1
+			continue
+		}
+		res[i] = 1.0 - ((dot0 + dot1) / (lengthP * math.Sqrt(lengthQ)))
+	}
+	return res
+}
+
+// The following variables are used for registering named batch metrics,
+// the names are the same as for the histogram metrics.
+
+var (
+	batchVectorMetrics map[string]BatchVectorMetric
+)
+
+// RegisterBatchVectorMetric is used to register the batch version of a named
+// histogram metric (see RegisterHistogramMetric). It will only add the metric
+// if the name does not exist yet. The result is true if the metric was
+// successfully registered and false otherwise.
+//
+// All metrics should be registered by an init method.
+func RegisterBatchVectorMetric(name string, metric BatchVectorMetric) bool {
+	name = strings.ToLower(name)
+	if _, has := batchVectorMetrics[name]; has {
+		return false
+	}
+	batchVectorMetrics[name] = metric
+	return true
+}
+
+// GetBatchVectorMetric returns a registered batch metric.
+// Returns the metric and true on success and nil and false
+// otherwise.
+func GetBatchVectorMetric(name string) (BatchVectorMetric, bool) {
+	name = strings.ToLower(name)
+	if metric, has := batchVectorMetrics[name]; has {
+		return metric, true
+	}
+	return nil, false
+}
+
+func init() {
+	batchVectorMetrics = make(map[string]BatchVectorMetric)
+	RegisterBatchVectorMetric("manhattan", ManhattanAll)
+	RegisterBatchVectorMetric("euclid", EuclideanDistanceAll)
+	RegisterBatchVectorMetric("min", BatchFromVectorMetric(MinDistance))
+	RegisterBatchVectorMetric("cosine", CosineSimilarityAll)
+	RegisterBatchVectorMetric("chessboard", BatchFromVectorMetric(ChessboardDistance))
+	RegisterBatchVectorMetric("canberra", BatchFromVectorMetric(CanberraDistance))
+}
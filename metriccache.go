@@ -0,0 +1,191 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"image"
+	"math"
+	"sync"
+)
+
+// This file contains a memoization layer for image metrics: Metric values are
+// cached by the hash of the tile features (for example the tile histogram) and
+// the database image. Tiles with identical features (like a uniform
+// background) are compared with the database only once and the values can be
+// reused when the same query is rendered again (for example with a different
+// output size).
+
+// TileFeatureHasher is implemented by image metrics that can compute a hash of
+// the features of a tile (after InitTiles). Two tiles with the same hash must
+// have the same metric value for all database images.
+//
+// HistogramImageMetric and LCHImageMetric implement this interface.
+type TileFeatureHasher interface {
+	TileHash(tileY, tileX int) uint64
+}
+
+// metricCacheKey is the key of a value in a MetricCache.
+type metricCacheKey struct {
+	tile  uint64
+	image ImageID
+}
+
+// MetricCache stores metric values by tile hash and database image. It is
+// safe for concurrent use and can be shared between multiple selections (see
+// CachedImageMetric), but it must only be used for one metric and one feature
+// storage.
+//
+// If the cache contains MaxEntries values it is cleared before a new value is
+// added, a value ≤ 0 means no restriction.
+type MetricCache struct {
+	MaxEntries int
+
+	m      sync.RWMutex
+	values map[metricCacheKey]float64
+}
+
+// NewMetricCache returns a new empty cache.
+func NewMetricCache(maxEntries int) *MetricCache {
+	return &MetricCache{
+		MaxEntries: maxEntries,
+		values:     make(map[metricCacheKey]float64),
+	}
+}
+
+// Get returns the value for the tile hash and image.
+func (cache *MetricCache) Get(tile uint64, image ImageID) (float64, bool) {
+	cache.m.RLock()
+	defer cache.m.RUnlock()
+	value, has := cache.values[metricCacheKey{tile, image}]
+	return value, has
+}
+
+// Put adds a value to the cache.
+func (cache *MetricCache) Put(tile uint64, image ImageID, value float64) {
+	cache.m.Lock()
+	defer cache.m.Unlock()
+	if cache.MaxEntries > 0 && len(cache.values) >= cache.MaxEntries {
+		cache.values = make(map[metricCacheKey]float64)
+	}
+	cache.values[metricCacheKey{tile, image}] = value
+}
+
+// Len returns the number of values in the cache.
+func (cache *MetricCache) Len() int {
+	cache.m.RLock()
+	defer cache.m.RUnlock()
+	return len(cache.values)
+}
+
+// Clear removes all values from the cache.
+func (cache *MetricCache) Clear() {
+	cache.m.Lock()
+	defer cache.m.Unlock()
+	cache.values = make(map[metricCacheKey]float64)
+}
+
+// CachedImageMetric is an ImageMetric that looks up metric values in a
+// MetricCache before computing them with Metric. If Metric doesn't implement
+// TileFeatureHasher no values are cached.
+//
+// This is useful for selectors that compare each tile with all database images
+// (like the variety selectors, see ComputeHeaps). Errors are not cached.
+type CachedImageMetric struct {
+	Metric ImageMetric
+	Cache  *MetricCache
+
+	// hashes of the tiles, set in InitTiles
+	hashes [][]uint64
+}
+
+// NewCachedImageMetric returns a new cached metric.
+func NewCachedImageMetric(metric ImageMetric, cache *MetricCache) *CachedImageMetric {
+	return &CachedImageMetric{Metric: metric, Cache: cache}
+}
+
+// InitStorage calls InitStorage of the metric.
+func (m *CachedImageMetric) InitStorage(storage ImageStorage) error {
+	return m.Metric.InitStorage(storage)
+}
+
+// InitTiles calls InitTiles of the metric and computes the tile hashes.
+func (m *CachedImageMetric) InitTiles(storage ImageStorage, query image.Image, dist TileDivision) error {
+	m.hashes = nil
+	if initErr := m.Metric.InitTiles(storage, query, dist); initErr != nil {
+		return initErr
+	}
+	hasher, ok := m.Metric.(TileFeatureHasher)
+	if !ok {
+		return nil
+	}
+	m.hashes = make([][]uint64, len(dist))
+	for i, col := range dist {
+		m.hashes[i] = make([]uint64, len(col))
+		for j := range col {
+			m.hashes[i][j] = hasher.TileHash(i, j)
+		}
+	}
+	return nil
+}
+
+// Compare returns the cached value or compares the tile and image with the
+// metric.
+func (m *CachedImageMetric) Compare(storage ImageStorage, image ImageID, tileY, tileX int) (float64, error) {
+	if m.hashes == nil {
+		return m.Metric.Compare(storage, image, tileY, tileX)
+	}
+	tile := m.hashes[tileY][tileX]
+	if value, has := m.Cache.Get(tile, image); has {
+		countEvent(CounterMetricCacheHits, 1)
+		return value, nil
+	}
+	countEvent(CounterMetricCacheMisses, 1)
+	value, err := m.Metric.Compare(storage, image, tileY, tileX)
+	if err != nil {
+		return value, err
+	}
+	m.Cache.Put(tile, image, value)
+	return value, nil
+}
+
+// hashHistogram adds k and the entries of the histogram to h.
+func hashHistogram(h hash.Hash64, hist *Histogram) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(hist.K))
+	h.Write(buf[:])
+	for _, entry := range hist.Entries {
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(entry))
+		h.Write(buf[:])
+	}
+}
+
+// TileHash returns the hash of the tile histogram.
+func (m *HistogramImageMetric) TileHash(tileY, tileX int) uint64 {
+	h := fnv.New64a()
+	hashHistogram(h, m.TileData[tileY][tileX])
+	return h.Sum64()
+}
+
+// TileHash returns the hash of the tile LCH.
+func (m *LCHImageMetric) TileHash(tileY, tileX int) uint64 {
+	h := fnv.New64a()
+	for _, hist := range m.TileData[tileY][tileX].Histograms {
+		hashHistogram(h, hist)
+	}
+	return h.Sum64()
+}
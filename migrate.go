@@ -0,0 +1,158 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"fmt"
+)
+
+// This file contains the versioning of the files written by the FSControllers
+// (HistogramFSController and LCHFSController). Files with an older format are
+// migrated to the current format when they're read.
+
+// FSFormatVersion is the version of the format of files written by the
+// FSControllers. It must be increased whenever the format changes, in this
+// case a migration from the previous version must be added.
+//
+// The versions are:
+//
+//	1: The original format, files written before FormatVersion was introduced
+//	   have no version (read as 0) and are treated as version 1.
+//	2: Histograms can be stored compact or sparse and LCH files contain the
+//	   scheme descriptor.
+//	3: Paths can be stored relative to a root directory (Root field).
+const FSFormatVersion = 3
+
+// HistogramFSMigration migrates the content of a HistogramFSController from
+// one version to the next.
+type HistogramFSMigration func(c *HistogramFSController) error
+
+// LCHFSMigration migrates the content of a LCHFSController from one version to
+// the next.
+type LCHFSMigration func(c *LCHFSController) error
+
+var (
+	// histogramFSMigrations maps version v to the migration from v to v + 1.
+	histogramFSMigrations = map[int]HistogramFSMigration{
+		1: migrateHistogramFSV1,
+		2: migrateHistogramFSV2,
+	}
+
+	// lchFSMigrations maps version v to the migration from v to v + 1.
+	lchFSMigrations = map[int]LCHFSMigration{
+		1: migrateLCHFSV1,
+		2: migrateLCHFSV2,
+	}
+)
+
+// checkFormatVersion returns the version to start the migration with (files
+// without version are version 1). An error is returned if the file was
+// written by a newer version of gomosaic.
+func checkFormatVersion(formatVersion int, libVersion string) (int, error) {
+	if formatVersion <= 0 {
+		return 1, nil
+	}
+	if formatVersion > FSFormatVersion {
+		return -1, fmt.Errorf("File has format version %d (written by gomosaic %s), but this version of gomosaic (%s) only supports versions up to %d. Please update gomosaic",
+			formatVersion, libVersion, Version, FSFormatVersion)
+	}
+	return formatVersion, nil
+}
+
+// MigrateHistogramFSController migrates the content of the controller to
+// FSFormatVersion. It is called when a file is read, thus there is usually no
+// need to call it directly.
+func MigrateHistogramFSController(c *HistogramFSController) error {
+	version, versionErr := checkFormatVersion(c.FormatVersion, c.Version)
+	if versionErr != nil {
+		return versionErr
+	}
+	for ; version < FSFormatVersion; version++ {
+		migration, has := histogramFSMigrations[version]
+		if !has {
+			return fmt.Errorf("Internal error, please report bug: No migration for GCH file version %d", version)
+		}
+		if err := migration(c); err != nil {
+			return fmt.Errorf("Can't migrate GCH file from version %d: %s", version, err.Error())
+		}
+	}
+	c.FormatVersion = FSFormatVersion
+	// malformed sparse histograms would cause a panic when they're converted
+	for _, entry := range c.Entries {
+		if entry.Sparse == nil {
+			continue
+		}
+		if validateErr := entry.Sparse.Validate(); validateErr != nil {
+			return fmt.Errorf("Invalid histogram for image \"%s\": %s", entry.Path, validateErr.Error())
+		}
+	}
+	return nil
+}
+
+// MigrateLCHFSController migrates the content of the controller to
+// FSFormatVersion. It is called when a file is read, thus there is usually no
+// need to call it directly.
+func MigrateLCHFSController(c *LCHFSController) error {
+	version, versionErr := checkFormatVersion(c.FormatVersion, c.Version)
+	if versionErr != nil {
+		return versionErr
+	}
+	for ; version < FSFormatVersion; version++ {
+		migration, has := lchFSMigrations[version]
+		if !has {
+			return fmt.Errorf("Internal error, please report bug: No migration for LCH file version %d", version)
+		}
+		if err := migration(c); err != nil {
+			return fmt.Errorf("Can't migrate LCH file from version %d: %s", version, err.Error())
+		}
+	}
+	c.FormatVersion = FSFormatVersion
+	return nil
+}
+
+// migrateHistogramFSV1 migrates from version 1 to 2. The format didn't change
+// for dense histograms, it only checks that each entry contains a histogram.
+func migrateHistogramFSV1(c *HistogramFSController) error {
+	for _, entry := range c.Entries {
+		if entry.Histogram == nil && entry.Compact == nil && entry.Sparse == nil {
+			return fmt.Errorf("No histogram for %s", entry.Path)
+		}
+	}
+	return nil
+}
+
+// migrateLCHFSV1 migrates from version 1 to 2. Version 1 files only supported
+// the schemes with four or five parts, thus the scheme descriptor is the
+// size.
+func migrateLCHFSV1(c *LCHFSController) error {
+	if c.Scheme == "" && c.Size != 4 && c.Size != 5 {
+		return fmt.Errorf("Unsupported LCH scheme size %d", c.Size)
+	}
+	c.Scheme = lchSchemeDescriptor(c.Scheme, c.Size)
+	return nil
+}
+
+// migrateHistogramFSV2 migrates from version 2 to 3. Version 2 files always
+// contain absolute paths, this is the same as an empty Root.
+func migrateHistogramFSV2(c *HistogramFSController) error {
+	c.Root = ""
+	return nil
+}
+
+// migrateLCHFSV2 migrates from version 2 to 3, see migrateHistogramFSV2.
+func migrateLCHFSV2(c *LCHFSController) error {
+	c.Root = ""
+	return nil
+}
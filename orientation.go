@@ -0,0 +1,303 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"fmt"
+	"image"
+)
+
+// Orientation describes how an image is rotated and / or mirrored.
+// The lower two bits are the number of clockwise 90° rotations, the third bit
+// describes if the image is mirrored (left to right). If an image is mirrored
+// and rotated it is first mirrored and then rotated.
+type Orientation int
+
+const (
+	OrientationNormal Orientation = iota
+	OrientationRotate90
+	OrientationRotate180
+	OrientationRotate270
+	OrientationMirror
+	OrientationMirrorRotate90
+	OrientationMirrorRotate180
+	OrientationMirrorRotate270
+)
+
+var (
+	// RotateOrientations contains all orientations without mirroring.
+	RotateOrientations = []Orientation{OrientationNormal, OrientationRotate90,
+		OrientationRotate180, OrientationRotate270}
+
+	// MirrorOrientations contains the normal and the mirrored orientation.
+	MirrorOrientations = []Orientation{OrientationNormal, OrientationMirror}
+
+	// AllOrientations contains all eight orientations.
+	AllOrientations = []Orientation{OrientationNormal, OrientationRotate90,
+		OrientationRotate180, OrientationRotate270, OrientationMirror,
+		OrientationMirrorRotate90, OrientationMirrorRotate180,
+		OrientationMirrorRotate270}
+)
+
+// Rotations returns the number of clockwise 90° rotations (0 to 3).
+func (o Orientation) Rotations() int {
+	return int(o) & 3
+}
+
+// Mirrored returns true if the orientation mirrors the image.
+func (o Orientation) Mirrored() bool {
+	return int(o)&4 != 0
+}
+
+func (o Orientation) String() string {
+	switch o {
+	case OrientationNormal:
+		return "normal"
+	case OrientationRotate90:
+		return "rotate-90"
+	case OrientationRotate180:
+		return "rotate-180"
+	case OrientationRotate270:
+		return "rotate-270"
+	case OrientationMirror:
+		return "mirror"
+	case OrientationMirrorRotate90:
+		return "mirror-rotate-90"
+	case OrientationMirrorRotate180:
+		return "mirror-rotate-180"
+	case OrientationMirrorRotate270:
+		return "mirror-rotate-270"
+	default:
+		return fmt.Sprintf("Orientation(%d)", int(o))
+	}
+}
+
+// OrientImage returns a new image that is img transformed by the orientation.
+// If o is OrientationNormal img itself is returned. The bounds of the result
+// always start at (0, 0).
+func OrientImage(img image.Image, o Orientation) image.Image {
+	if o == OrientationNormal {
+		return img
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	var res *image.RGBA
+	if o.Rotations()%2 == 1 {
+		res = image.NewRGBA(image.Rect(0, 0, height, width))
+	} else {
+		res = image.NewRGBA(image.Rect(0, 0, width, height))
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := img.At(bounds.Min.X+x, bounds.Min.Y+y)
+			dx, dy := x, y
+			if o.Mirrored() {
+				dx = width - 1 - dx
+			}
+			switch o.Rotations() {
+			case 1:
+				dx, dy = height-1-dy, dx
+			case 2:
+				dx, dy = width-1-dx, height-1-dy
+			case 3:
+				dx, dy = dy, width-1-dx
+			}
+			res.Set(dx, dy, c)
+		}
+	}
+	return res
+}
+
+// splitOrientedID splits a virtual id of an oriented storage into the id in
+// the original storage and the orientation.
+func splitOrientedID(id ImageID, orientations []Orientation) (ImageID, Orientation, error) {
+	n := ImageID(len(orientations))
+	if id < 0 || n == 0 {
+		return NoImageID, OrientationNormal, fmt.Errorf("invalid oriented image id %d", id)
+	}
+	return id / n, orientations[id%n], nil
+}
+
+// OrientedStorage is an ImageStorage that contains each image of another
+// storage in several orientations, effectively multiplying the size of the
+// database.
+//
+// The ids of this storage are "virtual" ids: The id i describes the image
+// i / n of the original storage with orientation Orientations[i % n] where n
+// is the number of orientations. This way all selectors work with the
+// orientations without any changes and the selected images are loaded in the
+// right orientation during composition.
+//
+// To use it for selection the feature storages must be wrapped as well, see
+// OrientedHistogramStorage and OrientedLCHStorage.
+type OrientedStorage struct {
+	Storage      ImageStorage
+	Orientations []Orientation
+}
+
+// NewOrientedStorage returns a new oriented storage.
+func NewOrientedStorage(storage ImageStorage, orientations []Orientation) *OrientedStorage {
+	return &OrientedStorage{Storage: storage, Orientations: orientations}
+}
+
+// Split returns the id in the original storage and the orientation of a
+// virtual id.
+func (s *OrientedStorage) Split(id ImageID) (ImageID, Orientation, error) {
+	return splitOrientedID(id, s.Orientations)
+}
+
+// NumImages returns the number of images in the original storage times the
+// number of orientations.
+func (s *OrientedStorage) NumImages() ImageID {
+	return s.Storage.NumImages() * ImageID(len(s.Orientations))
+}
+
+// LoadImage loads the image from the original storage and orients it.
+func (s *OrientedStorage) LoadImage(id ImageID) (image.Image, error) {
+	baseID, o, splitErr := s.Split(id)
+	if splitErr != nil {
+		return nil, splitErr
+	}
+	img, imgErr := s.Storage.LoadImage(baseID)
+	if imgErr != nil {
+		return nil, imgErr
+	}
+	return OrientImage(img, o), nil
+}
+
+// LoadImageSized loads a version of the image that covers width x height
+// from the original storage (see LoadImageSized) and orients it.
+func (s *OrientedStorage) LoadImageSized(id ImageID, width, height uint) (image.Image, error) {
+	baseID, o, splitErr := s.Split(id)
+	if splitErr != nil {
+		return nil, splitErr
+	}
+	if o.Rotations()%2 == 1 {
+		width, height = height, width
+	}
+	img, imgErr := LoadImageSized(s.Storage, baseID, width, height)
+	if imgErr != nil {
+		return nil, imgErr
+	}
+	return OrientImage(img, o), nil
+}
+
+// LoadConfig loads the config from the original storage, width and height are
+// swapped if the image is rotated by 90° or 270°.
+func (s *OrientedStorage) LoadConfig(id ImageID) (image.Config, error) {
+	baseID, o, splitErr := s.Split(id)
+	if splitErr != nil {
+		return image.Config{}, splitErr
+	}
+	config, configErr := s.Storage.LoadConfig(baseID)
+	if configErr != nil {
+		return config, configErr
+	}
+	if o.Rotations()%2 == 1 {
+		config.Width, config.Height = config.Height, config.Width
+	}
+	return config, nil
+}
+
+// OrientedHistogramStorage is a HistogramStorage for the virtual ids of an
+// OrientedStorage. Because a global color histogram does not change if an
+// image is rotated or mirrored it simply returns the histogram of the original
+// image.
+type OrientedHistogramStorage struct {
+	Storage      HistogramStorage
+	Orientations []Orientation
+}
+
+// NewOrientedHistogramStorage returns a new oriented histogram storage.
+func NewOrientedHistogramStorage(storage HistogramStorage, orientations []Orientation) *OrientedHistogramStorage {
+	return &OrientedHistogramStorage{Storage: storage, Orientations: orientations}
+}
+
+// GetHistogram returns the histogram of the original image.
+func (s *OrientedHistogramStorage) GetHistogram(id ImageID) (*Histogram, error) {
+	baseID, _, splitErr := splitOrientedID(id, s.Orientations)
+	if splitErr != nil {
+		return nil, splitErr
+	}
+	return s.Storage.GetHistogram(baseID)
+}
+
+// Divisions returns the number of sub-divisions of the original storage.
+func (s *OrientedHistogramStorage) Divisions() uint {
+	return s.Storage.Divisions()
+}
+
+// lchDirections maps the first four entries of an LCH (north, west, south,
+// east) to the clockwise direction (north = 0, east = 1, south = 2,
+// west = 3). The mapping is its own inverse, so it is also used to map a
+// direction to the position in the LCH.
+var lchDirections = [4]int{0, 3, 2, 1}
+
+// OrientLCH returns the LCH of the image with the given orientation, that is
+// the parts (north, west, south and east) of the LCH are permuted. All other
+// parts (like the center in the five parts scheme) remain unchanged.
+func OrientLCH(lch *LCH, o Orientation) *LCH {
+	if o == OrientationNormal || len(lch.Histograms) < 4 {
+		return lch
+	}
+	res := make([]*Histogram, len(lch.Histograms))
+	copy(res, lch.Histograms)
+	for pos := 0; pos < 4; pos++ {
+		dir := lchDirections[pos]
+		if o.Mirrored() && dir%2 == 1 {
+			// swap east and west
+			dir = 4 - dir
+		}
+		dir = (dir + o.Rotations()) % 4
+		res[lchDirections[dir]] = lch.Histograms[pos]
+	}
+	return NewLCH(res)
+}
+
+// OrientedLCHStorage is an LCHStorage for the virtual ids of an
+// OrientedStorage. It returns the LCH of the original image with the parts
+// permuted according to the orientation, see OrientLCH.
+type OrientedLCHStorage struct {
+	Storage      LCHStorage
+	Orientations []Orientation
+}
+
+// NewOrientedLCHStorage returns a new oriented LCH storage.
+func NewOrientedLCHStorage(storage LCHStorage, orientations []Orientation) *OrientedLCHStorage {
+	return &OrientedLCHStorage{Storage: storage, Orientations: orientations}
+}
+
+// GetLCH returns the LCH of the original image with permuted parts.
+func (s *OrientedLCHStorage) GetLCH(id ImageID) (*LCH, error) {
+	baseID, o, splitErr := splitOrientedID(id, s.Orientations)
+	if splitErr != nil {
+		return nil, splitErr
+	}
+	lch, lchErr := s.Storage.GetLCH(baseID)
+	if lchErr != nil {
+		return nil, lchErr
+	}
+	return OrientLCH(lch, o), nil
+}
+
+// Divisions returns the number of sub-divisions of the original storage.
+func (s *OrientedLCHStorage) Divisions() uint {
+	return s.Storage.Divisions()
+}
+
+// SchemeSize returns the scheme size of the original storage.
+func (s *OrientedLCHStorage) SchemeSize() uint {
+	return s.Storage.SchemeSize()
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"errors"
+	"fmt"
+	"image"
+)
+
+// This file contains databases that are generated from patches of source
+// images: The source images (for example the query itself) are divided into
+// patches of a fixed size, the patches are the database images. This way
+// mosaics can be created from a single picture without preparing a directory
+// of images.
+
+// ImagePatches divides img into patches of size width x height. The top-left
+// corners of the patches are stepX pixels apart in x and stepY pixels in y
+// direction, a step ≤ 0 is set to the size of the patch (thus the patches
+// don't overlap). Patches that would exceed the image are skipped, if the
+// image is smaller than a patch the result is empty.
+//
+// The patches share the pixels with img (see AsSubImager), they must not be
+// changed.
+func ImagePatches(img image.Image, width, height, stepX, stepY int) ([]image.Image, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("Patch size must be positive, got %dx%d", width, height)
+	}
+	if stepX <= 0 {
+		stepX = width
+	}
+	if stepY <= 0 {
+		stepY = height
+	}
+	bounds := img.Bounds()
+	imager := AsSubImager(img)
+	var res []image.Image
+	for y := bounds.Min.Y; y+height <= bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X; x+width <= bounds.Max.X; x += stepX {
+			patch := imager.SubImage(image.Rect(x, y, x+width, y+height))
+			if patch == nil {
+				return nil, fmt.Errorf("Can't create patch at (%d, %d)", x, y)
+			}
+			res = append(res, patch)
+		}
+	}
+	return res, nil
+}
+
+// NewPatchStorage returns a storage that contains the patches of all images
+// (see ImagePatches), the patches of images[0] come first. An error is
+// returned if no patches could be created.
+func NewPatchStorage(images []image.Image, width, height, stepX, stepY int) (*MemoryImageStorage, error) {
+	res := NewMemoryImageStorage()
+	for _, img := range images {
+		patches, patchesErr := ImagePatches(img, width, height, stepX, stepY)
+		if patchesErr != nil {
+			return nil, patchesErr
+		}
+		for _, patch := range patches {
+			res.Add(patch)
+		}
+	}
+	if res.NumImages() == 0 {
+		return nil, errors.New("No patches created, the source images are smaller than the patch size")
+	}
+	return res, nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"os"
+)
+
+// PlanFormatVersion is the version of the format used to store mosaic plans.
+const PlanFormatVersion = 1
+
+// PlanEntry is the image selected for a tile in a MosaicPlan. The image is
+// identified by its path (ids are not stable between runs) and the
+// orientation of the image.
+//
+// Value and Candidates are only set if the details of the selection are known
+// (see AddDetails), they're not used during rendering.
+type PlanEntry struct {
+	Path        string
+	Orientation Orientation
+	// Value is the metric value of the tile and the image, nil if unknown.
+	Value *float64 `json:",omitempty"`
+	// Candidates are the best images for the tile, best first.
+	Candidates []PlanCandidate `json:",omitempty"`
+}
+
+// PlanCandidate is a candidate image for a tile in a MosaicPlan together with
+// its metric value.
+type PlanCandidate struct {
+	Path        string
+	Orientation Orientation
+	Value       float64
+}
+
+// MosaicPlan stores the result of the selection step: The division of the
+// query image and the database image selected for each tile, together with
+// the parameters that were used for the selection.
+//
+// Because the selection is usually the most expensive step the plan can be
+// saved and later be rendered again (for example with a different size or
+// resize strategy) without running the selection again.
+//
+// Parameters are only stored for information, they're not used during
+// rendering.
+type MosaicPlan struct {
+	QueryBounds image.Rectangle
+	Division    TileDivision
+	Tiles       [][]PlanEntry
+	Parameters  map[string]string
+	Version     int
+}
+
+// NewMosaicPlan creates a new plan from a selection. mapper is used to
+// lookup the paths of the images. If the selection was made on an
+// OrientedStorage oriented must be this storage (to get the original ids and
+// orientations), otherwise it should be nil.
+func NewMosaicPlan(queryBounds image.Rectangle, dist TileDivision, selection [][]ImageID,
+	mapper *FSMapper, oriented *OrientedStorage) (*MosaicPlan, error) {
+	tiles := make([][]PlanEntry, len(selection))
+	for i, col := range selection {
+		tiles[i] = make([]PlanEntry, len(col))
+		for j, id := range col {
+			if id == NoImageID {
+				continue
+			}
+			path, o, pathErr := planImage(id, mapper, oriented)
+			if pathErr != nil {
+				return nil, pathErr
+			}
+			tiles[i][j] = PlanEntry{Path: path, Orientation: o}
+		}
+	}
+	return &MosaicPlan{
+		QueryBounds: queryBounds,
+		Division:    dist,
+		Tiles:       tiles,
+		Parameters:  make(map[string]string),
+		Version:     PlanFormatVersion,
+	}, nil
+}
+
+// planImage returns the path and orientation of an image, see NewMosaicPlan.
+func planImage(id ImageID, mapper *FSMapper, oriented *OrientedStorage) (string, Orientation, error) {
+	o := OrientationNormal
+	if oriented != nil {
+		var splitErr error
+		id, o, splitErr = oriented.Split(id)
+		if splitErr != nil {
+			return "", o, splitErr
+		}
+	}
+	path, ok := mapper.GetPath(id)
+	if !ok {
+		return "", o, fmt.Errorf("Can't retrieve path for image with id %d", id)
+	}
+	return path, o, nil
+}
+
+// AddDetails adds the metric values and candidates of the selection the plan
+// was created from to the entries of the plan, mapper and oriented are used
+// as in NewMosaicPlan. Values that are NaN or infinite are ignored.
+func (plan *MosaicPlan) AddDetails(details *SelectionDetails, mapper *FSMapper,
+	oriented *OrientedStorage) error {
+	validValue := func(value float64) bool {
+		return !math.IsNaN(value) && !math.IsInf(value, 0)
+	}
+	for i, col := range plan.Tiles {
+		for j := range col {
+			entry := &col[j]
+			if details.Values != nil && entry.Path != "" && validValue(details.Values[i][j]) {
+				value := details.Values[i][j]
+				entry.Value = &value
+			}
+			if details.Candidates == nil {
+				continue
+			}
+			entry.Candidates = nil
+			for _, candidate := range details.Candidates[i][j] {
+				if !validValue(candidate.Value) {
+					continue
+				}
+				path, o, pathErr := planImage(candidate.Image, mapper, oriented)
+				if pathErr != nil {
+					return pathErr
+				}
+				entry.Candidates = append(entry.Candidates,
+					PlanCandidate{Path: path, Orientation: o, Value: candidate.Value})
+			}
+		}
+	}
+	return nil
+}
+
+// Selection returns the selection of the plan in terms of the images of
+// storage, storage must be an OrientedStorage with AllOrientations (see
+// NewOrientedStorage) wrapping the storage of the mapper.
+// An error is returned if an image of the plan is not registered in mapper.
+func (plan *MosaicPlan) Selection(mapper *FSMapper) ([][]ImageID, error) {
+	numOrientations := ImageID(len(AllOrientations))
+	res := make([][]ImageID, len(plan.Tiles))
+	for i, col := range plan.Tiles {
+		res[i] = make([]ImageID, len(col))
+		for j, entry := range col {
+			if entry.Path == "" {
+				res[i][j] = NoImageID
+				continue
+			}
+			id, ok := mapper.GetID(entry.Path)
+			if !ok {
+				return nil, fmt.Errorf("Image \"%s\" from plan not found in storage", entry.Path)
+			}
+			res[i][j] = id*numOrientations + ImageID(entry.Orientation)
+		}
+	}
+	return res, nil
+}
+
+// Render composes the mosaic given the plan. The images are loaded from
+// storage and the paths are mapped to ids with mapper. mosaicBounds are the
+// bounds of the resulting mosaic, the division of the plan is scaled to these
+// bounds. See ComposeMosaic for the other arguments.
+func (plan *MosaicPlan) Render(storage ImageStorage, mapper *FSMapper,
+	mosaicBounds image.Rectangle, resizer ImageResizer, s ResizeStrategy,
+	border TileBorder, numRoutines int, cache *ImageCache,
+	progress ProgressFunc) (image.Image, error) {
+	selection, selectionErr := plan.Selection(mapper)
+	if selectionErr != nil {
+		return nil, selectionErr
+	}
+	mosaicDist := ScaleDivision(plan.Division, plan.QueryBounds, mosaicBounds)
+	return ComposeMosaic(NewOrientedStorage(storage, AllOrientations), selection,
+		mosaicDist, resizer, s, nil, border, numRoutines, cache, progress)
+}
+
+// Validate tests if the division of the plan is a tiling (see ValidateTiling)
+// and if there is an entry for each tile.
+func (plan *MosaicPlan) Validate() error {
+	if divErr := ValidateTiling(plan.Division, plan.Division.Bounds()); divErr != nil {
+		return divErr
+	}
+	if len(plan.Tiles) != len(plan.Division) {
+		return fmt.Errorf("Invalid plan: Got %d columns, division has %d columns",
+			len(plan.Tiles), len(plan.Division))
+	}
+	for i, col := range plan.Tiles {
+		if len(col) != len(plan.Division[i]) {
+			return fmt.Errorf("Invalid plan: Got %d tiles in column %d, division has %d tiles",
+				len(col), i, len(plan.Division[i]))
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the plan to a file encoded in json format.
+func (plan *MosaicPlan) WriteJSON(path string) error {
+	plan.Version = PlanFormatVersion
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	err = enc.Encode(plan)
+	return err
+}
+
+// ReadMosaicPlan reads a plan from a json file.
+func ReadMosaicPlan(path string) (*MosaicPlan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var plan MosaicPlan
+	dec := json.NewDecoder(f)
+	if decErr := dec.Decode(&plan); decErr != nil {
+		return nil, decErr
+	}
+	if plan.Version != PlanFormatVersion {
+		return nil, fmt.Errorf("Unsupported plan version %d", plan.Version)
+	}
+	if validErr := plan.Validate(); validErr != nil {
+		return nil, validErr
+	}
+	return &plan, nil
+}
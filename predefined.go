@@ -36,7 +36,8 @@ var (
 	// This would create output.png with 20x30 tiles from input.jpg with images
 	// from ~/Pictures/. The output image would have the same size as the input
 	// image (no dimension given).
-	RunSimple = `storage load $1
+	RunSimple = `# load database images and compute their histograms
+storage load $1
 gch create
 mosaic $2 $3 gch-euclid $4 $5`
 
@@ -46,18 +47,32 @@ mosaic $2 $3 gch-euclid $4 $5`
 	// Example usage: RunMetric ~/Pictures/ input.jpg output.png 20x30 x cosine
 	//
 	// This would do the same as RunSimple but using cosine-similarity.
-	RunMetric = `storage load $1
+	RunMetric = `# load database images and compute their histograms
+storage load $1
 gch create
 mosaic $2 $3 gch-$6 $4 $5`
 
+	// RunQuick is similar to RunSimple but the GCHs are stored in the database
+	// directory (see "gch update"): If the directory contains a file like
+	// "gch-8.gob" it is loaded and only the histograms of new images are
+	// computed. Thus the histograms of a database are computed only once.
+	//
+	// Example usage: RunQuick ~/Pictures/ input.jpg output.png 20x30 x
+	RunQuick = `# load database images and load or compute their histograms
+storage load $1
+gch update $1
+mosaic $2 $3 gch-euclid $4 $5`
+
 	// CompareMetrics is similar to RunSimple but generates multiple output
 	// images based on different metrics. Thus the third argument is not an path
 	// for a file but a directory. In this directory multiple mosaics will be
 	// generated.
 	//
 	// Example usage: CompareMetrics ~/Pictures/ input.jpg ./output/ 20x30 x
-	CompareMetrics = `storage load $1
+	CompareMetrics = `# load database images and compute their histograms
+storage load $1
 gch create
+# create one mosaic for each metric
 mosaic $2 $3/mosaic-manhattan.jpg gch-manhattan $4 $5
 mosaic $2 $3/mosaic-euclid.jpg gch-euclid $4 $5
 mosaic $2 $3/mosaic-min.jpg gch-min $4 $5
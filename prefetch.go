@@ -0,0 +1,143 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// This file contains a prefetcher for the composition of mosaics: Database
+// images of upcoming tiles are loaded and resized into the image cache before
+// the composer needs them. This way reading images from disk (which can be
+// slow on spinning disks or network file systems) and copying pixels into the
+// mosaic happen at the same time.
+
+// Prefetcher describes how database images are prefetched during composition,
+// see ComposeMosaicWithPolicy.
+//
+// The prefetcher follows the order in which the tiles are composed (row by
+// row) and stays at most Lookahead tiles ahead of the composer. Lookahead is
+// limited to the size of the cache, otherwise prefetched images would be
+// removed from the cache before they're used. NumRoutines images are loaded
+// concurrently.
+//
+// Errors while loading images are ignored by the prefetcher, the composer
+// tries to load the image again and reports the error.
+type Prefetcher struct {
+	Lookahead   int
+	NumRoutines int
+}
+
+// NewPrefetcher returns a new prefetcher.
+func NewPrefetcher(lookahead, numRoutines int) *Prefetcher {
+	return &Prefetcher{Lookahead: lookahead, NumRoutines: numRoutines}
+}
+
+// prefetchTile is a database image scaled to the size of a tile.
+type prefetchTile struct {
+	id            ImageID
+	width, height int
+}
+
+// prefetchRun is a running prefetcher, the composer must call tileDone after
+// each tile in tiles and stop when the composition is done.
+type prefetchRun struct {
+	composed int64
+	tick     chan struct{}
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// start starts prefetching the tiles (in the order in which they're composed)
+// into cache. It returns nil if prefetching is disabled.
+func (p *Prefetcher) start(storage ImageStorage, resizer ImageResizer, s ResizeStrategy,
+	cache *ImageCache, tiles []prefetchTile) *prefetchRun {
+	if p == nil || p.Lookahead <= 0 || len(tiles) == 0 {
+		return nil
+	}
+	lookahead := IntMin(p.Lookahead, cache.size)
+	numRoutines := IntMax(p.NumRoutines, 1)
+	run := &prefetchRun{
+		tick:   make(chan struct{}, 1),
+		stopCh: make(chan struct{}),
+	}
+	jobs := make(chan prefetchTile, numRoutines)
+	run.wg.Add(numRoutines + 1)
+	for w := 0; w < numRoutines; w++ {
+		go func() {
+			defer run.wg.Done()
+			for next := range jobs {
+				if cache.contains(next.id, next.width, next.height) {
+					continue
+				}
+				img, imgErr := LoadImageSized(storage, next.id, uint(next.width), uint(next.height))
+				if imgErr != nil {
+					continue
+				}
+				img = s(resizer, uint(next.width), uint(next.height), img)
+				cache.Put(next.id, next.width, next.height, img)
+				countEvent(CounterTilesPrefetched, 1)
+			}
+		}()
+	}
+	go func() {
+		defer run.wg.Done()
+		defer close(jobs)
+		for k, next := range tiles {
+			// wait until the composer is close enough
+			for int64(k) >= atomic.LoadInt64(&run.composed)+int64(lookahead) {
+				select {
+				case <-run.tick:
+				case <-run.stopCh:
+					return
+				}
+			}
+			// skip tiles the composer already reached
+			if int64(k) < atomic.LoadInt64(&run.composed) {
+				continue
+			}
+			select {
+			case jobs <- next:
+			case <-run.stopCh:
+				return
+			}
+		}
+	}()
+	return run
+}
+
+// tileDone must be called by the composer after each tile, it can be called on
+// nil.
+func (run *prefetchRun) tileDone() {
+	if run == nil {
+		return
+	}
+	atomic.AddInt64(&run.composed, 1)
+	select {
+	case run.tick <- struct{}{}:
+	default:
+	}
+}
+
+// stop stops prefetching and waits until all prefetch routines are done, it
+// can be called on nil.
+func (run *prefetchRun) stop() {
+	if run == nil {
+		return
+	}
+	close(run.stopCh)
+	run.wg.Wait()
+}
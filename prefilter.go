@@ -0,0 +1,273 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sync"
+)
+
+// This file contains a two-pass selector: For each tile the database is first
+// pruned with the (cheap) distance of the average colors, the expensive metric
+// (GCH, LCH, embedding, ...) is only evaluated for the remaining images.
+
+// HistogramAverage approximates the average color of an image from its
+// histogram: Each bin is represented by the color in the center of the bin.
+func HistogramAverage(hist *Histogram) AverageColor {
+	k := hist.K
+	if k == 0 {
+		return AverageColor{}
+	}
+	center := func(i uint) float64 {
+		return (float64(i) + 0.5) * float64(QuantizeFactor) / float64(k)
+	}
+	var r, g, b, sum float64
+	for id, entry := range hist.Entries {
+		if entry == 0.0 {
+			continue
+		}
+		i := uint(id)
+		r += entry * center(i%k)
+		g += entry * center((i/k)%k)
+		b += entry * center(i/(k*k))
+		sum += entry
+	}
+	if sum == 0.0 {
+		return AverageColor{}
+	}
+	return AverageColor{R: clampColor(r / sum), G: clampColor(g / sum), B: clampColor(b / sum)}
+}
+
+// HistogramAverages returns the (approximated) average colors of the images
+// 0, ..., numImages - 1, see HistogramAverage.
+func HistogramAverages(storage HistogramStorage, numImages ImageID) ([]AverageColor, error) {
+	res := make([]AverageColor, numImages)
+	for id := range res {
+		hist, histErr := storage.GetHistogram(ImageID(id))
+		if histErr != nil {
+			return nil, histErr
+		}
+		res[id] = HistogramAverage(hist)
+	}
+	return res, nil
+}
+
+// LCHAverages returns the (approximated) average colors of the images
+// 0, ..., numImages - 1: The average of the colors of all parts of the LCH.
+func LCHAverages(storage LCHStorage, numImages ImageID) ([]AverageColor, error) {
+	res := make([]AverageColor, numImages)
+	for id := range res {
+		lch, lchErr := storage.GetLCH(ImageID(id))
+		if lchErr != nil {
+			return nil, lchErr
+		}
+		if len(lch.Histograms) == 0 {
+			continue
+		}
+		var r, g, b float64
+		for _, hist := range lch.Histograms {
+			avg := HistogramAverage(hist)
+			r, g, b = r+float64(avg.R), g+float64(avg.G), b+float64(avg.B)
+		}
+		n := float64(len(lch.Histograms))
+		res[id] = AverageColor{R: clampColor(r / n), G: clampColor(g / n), B: clampColor(b / n)}
+	}
+	return res, nil
+}
+
+// FeatureAverages returns the average colors stored in the features, an
+// error is returned if the features are not average colors (see
+// AverageColorExtractor).
+func FeatureAverages(storage *MemoryFeatureStorage) ([]AverageColor, error) {
+	if _, isAverage := storage.FeatureExtractor.(AverageColorExtractor); !isAverage {
+		return nil, errors.New("Features are not average colors")
+	}
+	res := make([]AverageColor, len(storage.Features))
+	for id, feature := range storage.Features {
+		if len(feature) != 3 {
+			return nil, fmt.Errorf("Invalid average color for image with id %d", id)
+		}
+		res[id] = AverageColor{
+			R: clampColor(255.0 * feature[0]),
+			G: clampColor(255.0 * feature[1]),
+			B: clampColor(255.0 * feature[2]),
+		}
+	}
+	return res, nil
+}
+
+// OrientedAverages returns the average colors for the ids of an
+// OrientedStorage: Orienting an image doesn't change its average color.
+func OrientedAverages(averages []AverageColor, orientations []Orientation) []AverageColor {
+	n := len(orientations)
+	res := make([]AverageColor, len(averages)*n)
+	for id := range res {
+		res[id] = averages[id/n]
+	}
+	return res
+}
+
+// averageDist returns the squared euclidean distance of two colors.
+func averageDist(c1, c2 AverageColor) float64 {
+	dr := float64(c1.R) - float64(c2.R)
+	dg := float64(c1.G) - float64(c2.G)
+	db := float64(c1.B) - float64(c2.B)
+	return dr*dr + dg*dg + db*db
+}
+
+// PrefilteredImageMetricMinimizer implements ImageSelector and selects the
+// image with the smallest distance to the tile like ImageMetricMinimizer, but
+// in two passes: First only the Fraction of database images with the most
+// similar average color (compared to the average color of the tile) are kept
+// for each tile, then Metric is evaluated only for these images.
+//
+// Averages contains the average color of each database image (for example
+// computed by HistogramAverages). Fraction must be a value between 0 and 1,
+// at least one image is kept for each tile.
+//
+// Errors of the metric are handled as in ImageMetricMinimizer.
+type PrefilteredImageMetricMinimizer struct {
+	Metric      ImageMetric
+	Averages    []AverageColor
+	Fraction    float64
+	NumRoutines int
+}
+
+// NewPrefilteredImageMetricMinimizer returns a new minimizer.
+func NewPrefilteredImageMetricMinimizer(metric ImageMetric, averages []AverageColor,
+	fraction float64, numRoutines int) *PrefilteredImageMetricMinimizer {
+	if numRoutines <= 0 {
+		numRoutines = 1
+	}
+	return &PrefilteredImageMetricMinimizer{
+		Metric:      metric,
+		Averages:    averages,
+		Fraction:    fraction,
+		NumRoutines: numRoutines,
+	}
+}
+
+// Init just calls InitStorage of the metric.
+func (min *PrefilteredImageMetricMinimizer) Init(storage ImageStorage) error {
+	return min.Metric.InitStorage(storage)
+}
+
+// NumCandidates returns the number of images kept for each tile.
+func (min *PrefilteredImageMetricMinimizer) NumCandidates(numImages int) int {
+	n := int(math.Ceil(min.Fraction * float64(numImages)))
+	return IntMax(1, IntMin(n, numImages))
+}
+
+// SelectImages selects the image that minimizes the metric for each tile
+// among the images with the most similar average colors. It processes
+// NumRoutines tiles concurrently.
+func (min *PrefilteredImageMetricMinimizer) SelectImages(storage ImageStorage,
+	query image.Image, dist TileDivision, progress ProgressFunc) ([][]ImageID, error) {
+	details, err := min.SelectImagesDetailed(storage, query, dist, 0, progress)
+	if err != nil {
+		return nil, err
+	}
+	return details.Selection, nil
+}
+
+// SelectImagesDetailed selects the images like SelectImages and also reports
+// the minimal metric value and the numCandidates best images (among the
+// images kept by the first pass) of each tile.
+func (min *PrefilteredImageMetricMinimizer) SelectImagesDetailed(storage ImageStorage,
+	query image.Image, dist TileDivision, numCandidates int,
+	progress ProgressFunc) (*SelectionDetails, error) {
+	numImages := storage.NumImages()
+	if int(numImages) != len(min.Averages) {
+		return nil, fmt.Errorf("Number of average colors (%d) doesn't match the number of images (%d)",
+			len(min.Averages), numImages)
+	}
+	if initErr := min.Metric.InitTiles(storage, query, dist); initErr != nil {
+		return nil, initErr
+	}
+	tileAverages, averagesErr := ComputeTileAverages(query, dist, min.NumRoutines)
+	if averagesErr != nil {
+		return nil, averagesErr
+	}
+	numKept := min.NumCandidates(int(numImages))
+	details := newTileDetails(dist, numCandidates)
+
+	type job struct {
+		i, j int
+	}
+	jobs := make(chan job, BufferSize)
+	var wg sync.WaitGroup
+	wg.Add(dist.Size())
+	for w := 0; w < min.NumRoutines; w++ {
+		go func() {
+			for next := range jobs {
+				target := tileAverages[next.i][next.j]
+				// first pass: keep the images with the most similar average colors
+				candidates := NewImageHeap(numKept)
+				for id, avg := range min.Averages {
+					candidates.Add(ImageID(id), averageDist(target, avg))
+				}
+				// second pass: evaluate the metric for the candidates
+				best, bestValue := NoImageID, math.MaxFloat64
+				var reported *ImageHeap
+				if numCandidates > 0 {
+					reported = NewImageHeap(numCandidates)
+				}
+				for _, entry := range candidates.GetView() {
+					value, metricErr := min.Metric.Compare(storage, entry.Image, next.i, next.j)
+					if metricErr != nil {
+						SelectionLogger.Error("Can't compute metric value, ignoreing it", LogFields{
+							"error": metricErr,
+							"image": entry.Image,
+							"tileY": next.i,
+							"tileX": next.j,
+						})
+						continue
+					}
+					if value < bestValue {
+						best, bestValue = entry.Image, value
+					}
+					if reported != nil {
+						reported.Add(entry.Image, value)
+					}
+				}
+				details.Selection[next.i][next.j] = best
+				if best != NoImageID {
+					details.Values[next.i][next.j] = bestValue
+				}
+				if reported != nil {
+					details.Candidates[next.i][next.j] = reported.GetView()
+				}
+				wg.Done()
+			}
+		}()
+	}
+
+	numDone := 0
+	for i, col := range dist {
+		for j := range col {
+			jobs <- job{i, j}
+			numDone++
+			if progress != nil {
+				progress(numDone)
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return details, nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// This file contains the preprocessing of query images, it's applied before
+// the query is divided into tiles.
+
+// AutoContrastClip is the fraction of the darkest and brightest pixels that
+// is ignored by AutoContrast. This way a few outliers don't prevent the
+// contrast from being stretched.
+const AutoContrastClip = 0.005
+
+// QueryPreprocessing describes the preprocessing steps applied to a query
+// image. The steps are applied in the order of the fields.
+type QueryPreprocessing struct {
+	// EXIF rotates / mirrors the image according to the EXIF orientation tag,
+	// see EXIFOrientation.
+	EXIF bool
+	// AutoContrast normalizes the contrast of the image, see AutoContrast.
+	AutoContrast bool
+	// MaxSize is the working size of the query: If the width or height of the
+	// query is larger than MaxSize the query is downscaled (keeping the
+	// ratio). 0 means that the query is not downscaled.
+	MaxSize int
+}
+
+// ParseQueryPreprocessing parses a comma separated list of preprocessing
+// steps: "exif", "autocontrast" and "downscale=<size>" (for example
+// "exif,autocontrast,downscale=2048"). "none" or an empty string disable all
+// steps.
+func ParseQueryPreprocessing(s string) (QueryPreprocessing, error) {
+	res := QueryPreprocessing{}
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "" || s == "none" {
+		return res, nil
+	}
+	for _, step := range strings.Split(s, ",") {
+		step = strings.TrimSpace(step)
+		switch {
+		case step == "exif":
+			res.EXIF = true
+		case step == "autocontrast":
+			res.AutoContrast = true
+		case strings.HasPrefix(step, "downscale="):
+			size, sizeErr := strconv.Atoi(strings.TrimPrefix(step, "downscale="))
+			if sizeErr != nil || size <= 0 {
+				return QueryPreprocessing{}, fmt.Errorf("invalid size for downscale, must be int > 0: %s", step)
+			}
+			res.MaxSize = size
+		default:
+			return QueryPreprocessing{}, fmt.Errorf("unkown preprocessing step: %s", step)
+		}
+	}
+	return res, nil
+}
+
+// DisplayString returns the preprocessing in the format accepted by
+// ParseQueryPreprocessing.
+func (p QueryPreprocessing) DisplayString() string {
+	steps := make([]string, 0, 3)
+	if p.EXIF {
+		steps = append(steps, "exif")
+	}
+	if p.AutoContrast {
+		steps = append(steps, "autocontrast")
+	}
+	if p.MaxSize > 0 {
+		steps = append(steps, fmt.Sprintf("downscale=%d", p.MaxSize))
+	}
+	if len(steps) == 0 {
+		return "none"
+	}
+	return strings.Join(steps, ",")
+}
+
+// Apply applies the preprocessing steps to img. o is the orientation from the
+// EXIF data of the image (see EXIFOrientation), it's ignored if EXIF is false.
+// resizer is used for downscaling.
+func (p QueryPreprocessing) Apply(img image.Image, o Orientation, resizer ImageResizer) image.Image {
+	if p.EXIF {
+		img = OrientImage(img, o)
+	}
+	if p.AutoContrast {
+		img = AutoContrast(img)
+	}
+	if p.MaxSize > 0 {
+		bounds := img.Bounds()
+		width, height := bounds.Dx(), bounds.Dy()
+		switch {
+		case width >= height && width > p.MaxSize:
+			img = resizer.Resize(uint(p.MaxSize), uint(KeepRatioHeight(width, height, p.MaxSize)), img)
+		case height > width && height > p.MaxSize:
+			img = resizer.Resize(uint(KeepRatioWidth(width, height, p.MaxSize)), uint(p.MaxSize), img)
+		}
+	}
+	return img
+}
+
+// LoadQueryImage decodes the query image from a file and applies the
+// preprocessing steps.
+func LoadQueryImage(path string, p QueryPreprocessing, resizer ImageResizer) (image.Image, error) {
+	data, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		return nil, readErr
+	}
+	img, _, decodeErr := image.Decode(bytes.NewReader(data))
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	o := OrientationNormal
+	if p.EXIF {
+		var exifErr error
+		o, exifErr = EXIFOrientation(data)
+		if exifErr != nil {
+			// as for the database images (see DecodeEXIF) the image is used as
+			// stored
+			ComposeLogger.Warn("Malformed EXIF data of query image, ignoring it", LogFields{
+				"path":  path,
+				"error": exifErr,
+			})
+		}
+	}
+	return p.Apply(img, o, resizer), nil
+}
+
+// AutoContrast stretches the contrast of an image: The intensities are
+// linearly mapped such that the darkest pixels become black and the brightest
+// become white (ignoring the fraction AutoContrastClip of the darkest and
+// brightest pixels). All channels are mapped the same way, values outside of
+// the range are clipped. The alpha channel is not changed.
+func AutoContrast(img image.Image) image.Image {
+	bounds := img.Bounds()
+	numPixels := bounds.Dx() * bounds.Dy()
+	if numPixels == 0 {
+		return img
+	}
+	// the non-premultiplied colors are used, this way the alpha channel can be
+	// kept
+	var hist [256]int
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			hist[(int(c.R)+int(c.G)+int(c.B))/3]++
+		}
+	}
+	clip := int(AutoContrastClip * float64(numPixels))
+	low, count := 0, 0
+	for ; low < 255; low++ {
+		count += hist[low]
+		if count > clip {
+			break
+		}
+	}
+	high, count := 255, 0
+	for ; high > 0; high-- {
+		count += hist[high]
+		if count > clip {
+			break
+		}
+	}
+	if high <= low || (low == 0 && high == 255) {
+		// nothing to stretch
+		return img
+	}
+	var mapping [256]uint8
+	for v := range mapping {
+		scaled := (v - low) * 255 / (high - low)
+		mapping[v] = uint8(IntMin(IntMax(scaled, 0), 255))
+	}
+	res := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			res.SetNRGBA(x-bounds.Min.X, y-bounds.Min.Y,
+				color.NRGBA{R: mapping[c.R], G: mapping[c.G], B: mapping[c.B], A: c.A})
+		}
+	}
+	return res
+}
@@ -0,0 +1,239 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// This file contains image pyramids: For each database image downscaled
+// versions (each level has half the width and height of the previous level)
+// are stored on disk. When a mosaic is composed the resize strategy starts
+// from the smallest level that still covers the tile instead of the original
+// image. Database images are usually much larger than the tiles, so this
+// reduces the decoding and resizing costs a lot, especially if mosaics of
+// different sizes are composed from the same database.
+
+// Limits for the number of levels of image pyramids.
+const (
+	DefaultPyramidLevels = 3
+	MaxPyramidLevels     = 8
+)
+
+// SizedImageStorage is an ImageStorage that can load a (smaller) version of an
+// image that covers a given size, that is both the width and height of the
+// returned image are at least the requested width and height (if the original
+// image is big enough). It is used during the composition of mosaics, the
+// resize strategy is applied to the returned image.
+type SizedImageStorage interface {
+	ImageStorage
+	LoadImageSized(id ImageID, width, height uint) (image.Image, error)
+}
+
+// LoadImageSized loads an image that covers width x height with LoadImageSized
+// if storage is a SizedImageStorage and with LoadImage otherwise.
+func LoadImageSized(storage ImageStorage, id ImageID, width, height uint) (image.Image, error) {
+	if sized, isSized := storage.(SizedImageStorage); isSized {
+		return sized.LoadImageSized(id, width, height)
+	}
+	return storage.LoadImage(id)
+}
+
+// PyramidLevelSize returns the size of an image of size width x height on the
+// given level of an image pyramid (level 0 is the original image).
+func PyramidLevelSize(width, height, level int) (int, int) {
+	return IntMax(1, width>>uint(level)), IntMax(1, height>>uint(level))
+}
+
+// PyramidStorage implements SizedImageStorage by wrapping another storage and
+// storing the levels 1, ..., Levels of an image pyramid for each image in Dir.
+// The pyramid of an image is created the first time a level of that image is
+// required.
+//
+// The files in Dir are identified by the path, size and modification time of
+// the original image (provided by Mapper), so they're recreated if the image
+// changes. Levels are stored as png files and created with Resizer. If the
+// wrapped storage applies the EXIF orientation (see FSImageDB.EXIF) the levels
+// are stored oriented, so they're identified by that setting as well.
+type PyramidStorage struct {
+	Storage ImageStorage
+	Mapper  *FSMapper
+	Dir     string
+	Levels  int
+	Resizer ImageResizer
+}
+
+// NewPyramidStorage returns a new storage, dir is created if it doesn't exist.
+func NewPyramidStorage(storage ImageStorage, mapper *FSMapper, dir string,
+	levels int, resizer ImageResizer) (*PyramidStorage, error) {
+	if levels < 1 || levels > MaxPyramidLevels {
+		return nil, fmt.Errorf("Number of pyramid levels must be between 1 and %d, got %d",
+			MaxPyramidLevels, levels)
+	}
+	if mkdirErr := os.MkdirAll(dir, 0755); mkdirErr != nil {
+		return nil, mkdirErr
+	}
+	return &PyramidStorage{
+		Storage: storage,
+		Mapper:  mapper,
+		Dir:     dir,
+		Levels:  levels,
+		Resizer: resizer,
+	}, nil
+}
+
+// DefaultPyramidDir returns the directory pyramids are stored in by default, a
+// directory in the user's cache directory.
+func DefaultPyramidDir() (string, error) {
+	cacheDir, cacheErr := os.UserCacheDir()
+	if cacheErr != nil {
+		return "", cacheErr
+	}
+	return filepath.Join(cacheDir, "gomosaic", "pyramids"), nil
+}
+
+// NumImages returns the number of images in the wrapped storage.
+func (s *PyramidStorage) NumImages() ImageID {
+	return s.Storage.NumImages()
+}
+
+// LoadImage loads the original image from the wrapped storage.
+func (s *PyramidStorage) LoadImage(id ImageID) (image.Image, error) {
+	return s.Storage.LoadImage(id)
+}
+
+// LoadConfig loads the config of the original image from the wrapped storage.
+func (s *PyramidStorage) LoadConfig(id ImageID) (image.Config, error) {
+	return s.Storage.LoadConfig(id)
+}
+
+// levelPaths returns the paths of the levels 1, ..., Levels of an image.
+func (s *PyramidStorage) levelPaths(id ImageID) ([]string, error) {
+	path, hasPath := s.Mapper.GetPath(id)
+	if !hasPath {
+		return nil, fmt.Errorf("Invalid image id %d: %w", id, ErrImageNotFound)
+	}
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		return nil, statErr
+	}
+	// levels created with and without EXIF orientation have different sizes
+	exif := false
+	if db, isFS := s.Storage.(*FSImageDB); isFS {
+		exif = db.EXIF
+	}
+	hash := sha1.Sum([]byte(fmt.Sprintf("%s-%d-%d-%t", path, info.Size(), info.ModTime().UnixNano(), exif)))
+	prefix := hex.EncodeToString(hash[:])
+	res := make([]string, s.Levels)
+	for i := range res {
+		res[i] = filepath.Join(s.Dir, fmt.Sprintf("%s-%d.png", prefix, i+1))
+	}
+	return res, nil
+}
+
+// LoadImageSized returns the smallest level of the pyramid of the image that
+// covers width x height. If no level covers the size the original image is
+// returned. The level is chosen for the oriented image: The size is given by
+// LoadConfig of the wrapped storage which applies the EXIF orientation as
+// LoadImage does (see DecodeConfigEXIF).
+func (s *PyramidStorage) LoadImageSized(id ImageID, width, height uint) (image.Image, error) {
+	config, configErr := s.Storage.LoadConfig(id)
+	if configErr != nil {
+		return nil, configErr
+	}
+	level := 0
+	for next := 1; next <= s.Levels; next++ {
+		levelWidth, levelHeight := PyramidLevelSize(config.Width, config.Height, next)
+		if uint(levelWidth) < width || uint(levelHeight) < height {
+			break
+		}
+		level = next
+	}
+	if level == 0 {
+		return s.Storage.LoadImage(id)
+	}
+	paths, pathsErr := s.levelPaths(id)
+	if pathsErr != nil {
+		return nil, pathsErr
+	}
+	if img, loadErr := loadPyramidLevel(paths[level-1]); loadErr == nil {
+		return img, nil
+	}
+	levels, createErr := s.createPyramid(id, paths)
+	if createErr != nil {
+		return nil, createErr
+	}
+	return levels[level-1], nil
+}
+
+// createPyramid creates all levels of the pyramid of an image and writes them
+// to the given paths.
+func (s *PyramidStorage) createPyramid(id ImageID, paths []string) ([]image.Image, error) {
+	img, imgErr := s.Storage.LoadImage(id)
+	if imgErr != nil {
+		return nil, imgErr
+	}
+	bounds := img.Bounds()
+	res := make([]image.Image, len(paths))
+	for i, path := range paths {
+		width, height := PyramidLevelSize(bounds.Dx(), bounds.Dy(), i+1)
+		// each level is created from the previous one
+		img = s.Resizer.Resize(uint(width), uint(height), img)
+		res[i] = img
+		if writeErr := writePyramidLevel(s.Dir, path, img); writeErr != nil {
+			return nil, writeErr
+		}
+	}
+	return res, nil
+}
+
+// loadPyramidLevel decodes a level of a pyramid.
+func loadPyramidLevel(path string) (image.Image, error) {
+	r, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer r.Close()
+	countEvent(CounterImagesDecoded, 1)
+	return png.Decode(r)
+}
+
+// writePyramidLevel writes a level of a pyramid to path, the image is first
+// written to a temporary file in dir, thus concurrent writes of the same level
+// don't produce broken files.
+func writePyramidLevel(dir, path string, img image.Image) error {
+	tmp, tmpErr := ioutil.TempFile(dir, "level")
+	if tmpErr != nil {
+		return tmpErr
+	}
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	encodeErr := encoder.Encode(tmp, img)
+	closeErr := tmp.Close()
+	if encodeErr == nil {
+		encodeErr = closeErr
+	}
+	if encodeErr != nil {
+		os.Remove(tmp.Name())
+		return encodeErr
+	}
+	return os.Rename(tmp.Name(), path)
+}
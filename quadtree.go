@@ -0,0 +1,147 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"image"
+	"math"
+	"sort"
+)
+
+var (
+	// DefaultQuadtreeThreshold is the default detail threshold of a
+	// QuadtreeDivider, see QuadtreeDivider.Threshold.
+	DefaultQuadtreeThreshold = 25.0
+
+	// DefaultQuadtreeDepth is the default maximal depth of a QuadtreeDivider.
+	DefaultQuadtreeDepth = 3
+
+	// DefaultQuadtreeMinSize is the default minimal width and height of a tile
+	// created by a QuadtreeDivider.
+	DefaultQuadtreeMinSize = 8
+)
+
+// LuminanceDeviation computes the standard deviation of the luminance of all
+// pixels of img in the given area. It is used as a measure for the amount of
+// detail in an area: Flat regions (like the sky) have a small value, regions
+// with many edges a big value. The result is between 0 and 127.5.
+func LuminanceDeviation(img image.Image, area image.Rectangle) float64 {
+	area = area.Intersect(img.Bounds())
+	if area.Empty() {
+		return 0.0
+	}
+	sum, sumSquares := 0.0, 0.0
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			lum := float64(Luminance(ConvertRGB(img.At(x, y))))
+			sum += lum
+			sumSquares += lum * lum
+		}
+	}
+	n := float64(area.Dx() * area.Dy())
+	mean := sum / n
+	variance := sumSquares/n - mean*mean
+	if variance <= 0.0 {
+		return 0.0
+	}
+	return math.Sqrt(variance)
+}
+
+// QuadtreeDivider is an ImageDivider that adapts the size of the tiles to
+// the content of an image. It starts with a grid of NumX x NumY tiles (like
+// FixedNumDivider) and then recursively splits each tile into four tiles if
+// the tile contains much detail. This way high-detail regions of the query
+// are represented by small tiles and flat regions remain large tiles.
+//
+// The detail of a tile is measured by LuminanceDeviation, a tile gets split
+// if the value is greater than Threshold. A tile is split at most MaxDepth
+// times and never if the resulting tiles would be smaller than MinSize.
+//
+// The division depends on Img, so the bounds passed to Divide should be the
+// bounds of Img. To get a division for the mosaic (which usually has a
+// different size) use ScaleDivision.
+//
+// The rows of the result contain all tiles with the same minimum y
+// coordinate, sorted by x coordinate. Thus the rows may have a different
+// number of tiles.
+type QuadtreeDivider struct {
+	Img        image.Image
+	NumX, NumY int
+	Cut        bool
+	Threshold  float64
+	MaxDepth   int
+	MinSize    int
+}
+
+// NewQuadtreeDivider returns a new QuadtreeDivider for the given image and
+// initial grid. Threshold, MaxDepth and MinSize are set to the default values.
+func NewQuadtreeDivider(img image.Image, numX, numY int, cut bool) *QuadtreeDivider {
+	return &QuadtreeDivider{
+		Img:       img,
+		NumX:      numX,
+		NumY:      numY,
+		Cut:       cut,
+		Threshold: DefaultQuadtreeThreshold,
+		MaxDepth:  DefaultQuadtreeDepth,
+		MinSize:   DefaultQuadtreeMinSize,
+	}
+}
+
+// split appends the leafs of the quadtree with root r to res.
+func (divider *QuadtreeDivider) split(r image.Rectangle, depth int, res []image.Rectangle) []image.Rectangle {
+	minSize := IntMax(divider.MinSize, 1)
+	if depth >= divider.MaxDepth || r.Dx() < 2*minSize || r.Dy() < 2*minSize {
+		return append(res, r)
+	}
+	if LuminanceDeviation(divider.Img, r) <= divider.Threshold {
+		return append(res, r)
+	}
+	midX := r.Min.X + r.Dx()/2
+	midY := r.Min.Y + r.Dy()/2
+	res = divider.split(image.Rect(r.Min.X, r.Min.Y, midX, midY), depth+1, res)
+	res = divider.split(image.Rect(midX, r.Min.Y, r.Max.X, midY), depth+1, res)
+	res = divider.split(image.Rect(r.Min.X, midY, midX, r.Max.Y), depth+1, res)
+	res = divider.split(image.Rect(midX, midY, r.Max.X, r.Max.Y), depth+1, res)
+	return res
+}
+
+// Divide implements the Divide method of ImageDivider.
+func (divider *QuadtreeDivider) Divide(bounds image.Rectangle) TileDivision {
+	grid := NewFixedNumDivider(divider.NumX, divider.NumY, divider.Cut).Divide(bounds)
+	if len(grid) == 0 {
+		return nil
+	}
+	leafs := make([]image.Rectangle, 0, grid.Size())
+	for _, col := range grid {
+		for _, r := range col {
+			leafs = divider.split(r, 0, leafs)
+		}
+	}
+	sort.Slice(leafs, func(i, j int) bool {
+		if leafs[i].Min.Y == leafs[j].Min.Y {
+			return leafs[i].Min.X < leafs[j].Min.X
+		}
+		return leafs[i].Min.Y < leafs[j].Min.Y
+	})
+	// group leafs with the same y coordinate
+	res := make(TileDivision, 0)
+	for i, r := range leafs {
+		if i == 0 || r.Min.Y != leafs[i-1].Min.Y {
+			res = append(res, make([]image.Rectangle, 0))
+		}
+		res[len(res)-1] = append(res[len(res)-1], r)
+	}
+	return res
+}
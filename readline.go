@@ -0,0 +1,496 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// This file contains the input handling of the command execution: A simple
+// line reader based on bufio (used for scripts) and a line editor for
+// interactive terminals with history, reverse search and tab completion.
+
+// LineReader reads command lines, one at a time. ReadLine returns io.EOF if
+// there are no more lines.
+type LineReader interface {
+	ReadLine() (string, error)
+}
+
+// LineReaderHandler is an optional interface for a CommandHandler. If the
+// handler implements it the LineReader returned by NewLineReader is used by
+// Execute to read commands. Otherwise the lines are read from the state's
+// reader (In) with a ScannerLineReader.
+type LineReaderHandler interface {
+	NewLineReader(s *ExecutorState, commandMap CommandMap) LineReader
+}
+
+// ScannerLineReader implements LineReader with a bufio.Scanner. If Prompt is
+// not empty it is written to Out before each line is read.
+type ScannerLineReader struct {
+	Scanner *bufio.Scanner
+	Prompt  string
+	Out     io.Writer
+}
+
+// NewScannerLineReader returns a new reader that reads lines from r.
+func NewScannerLineReader(r io.Reader, prompt string, out io.Writer) *ScannerLineReader {
+	return &ScannerLineReader{
+		Scanner: bufio.NewScanner(r),
+		Prompt:  prompt,
+		Out:     out,
+	}
+}
+
+// ReadLine implements LineReader.
+func (r *ScannerLineReader) ReadLine() (string, error) {
+	if r.Prompt != "" && r.Out != nil {
+		fmt.Fprint(r.Out, r.Prompt)
+	}
+	if r.Scanner.Scan() {
+		return r.Scanner.Text(), nil
+	}
+	if err := r.Scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", io.EOF
+}
+
+// CompletionFunc computes completions while editing a line. line is the
+// content of the line before the cursor. The result is a list of candidates
+// that replace the last (incomplete) word of line.
+type CompletionFunc func(line string) []string
+
+// lastWord returns the last word of a line (the word that is completed) and
+// the position where the word starts.
+func lastWord(line string) (string, int) {
+	start := strings.LastIndexFunc(line, unicode.IsSpace) + 1
+	return line[start:], start
+}
+
+// CompletePath returns all files in the directory of prefix that start with
+// prefix. Relative paths are relative to the working directory of the state,
+// the home directory can be used with "~". Directories end with the path
+// separator.
+func CompletePath(state *ExecutorState, prefix string) []string {
+	dir, file := filepath.Split(prefix)
+	lookup := dir
+	if lookup == "" {
+		lookup = "."
+	}
+	lookup, lookupErr := state.GetPath(lookup)
+	if lookupErr != nil {
+		return nil
+	}
+	files, readErr := ioutil.ReadDir(lookup)
+	if readErr != nil {
+		return nil
+	}
+	res := make([]string, 0)
+	for _, info := range files {
+		name := info.Name()
+		if !strings.HasPrefix(name, file) {
+			continue
+		}
+		// don't show hidden files unless explicitly asked for
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(file, ".") {
+			continue
+		}
+		candidate := dir + name
+		if info.IsDir() {
+			candidate += string(filepath.Separator)
+		}
+		res = append(res, candidate)
+	}
+	return res
+}
+
+// CompleteCommands returns a CompletionFunc that completes command names from
+// commandMap (and the aliases of the state) for the first word. The arguments are completed by the Complete
+// function of the command, if the command has no such function file paths
+// are completed (see CompletePath).
+func CompleteCommands(state *ExecutorState, commandMap CommandMap) CompletionFunc {
+	return func(line string) []string {
+		word, start := lastWord(line)
+		if fields := strings.Fields(line[:start]); len(fields) > 0 {
+			if cmd, has := commandMap[fields[0]]; has && cmd.Complete != nil {
+				return cmd.Complete(state, append(fields[1:], word))
+			}
+			return CompletePath(state, word)
+		}
+		res := make([]string, 0)
+		for name := range commandMap {
+			if strings.HasPrefix(name, word) {
+				res = append(res, name)
+			}
+		}
+		for name := range state.Aliases {
+			if _, isCmd := commandMap[name]; !isCmd && strings.HasPrefix(name, word) {
+				res = append(res, name)
+			}
+		}
+		sort.Strings(res)
+		return res
+	}
+}
+
+// DefaultHistorySize is the default number of lines stored in the history of
+// a TerminalLineReader.
+const DefaultHistorySize = 500
+
+// TerminalLineReader implements LineReader for interactive terminals. It
+// switches the terminal to raw mode while reading a line and supports:
+// moving the cursor (arrow keys, Home / End, Ctrl-A / Ctrl-E), browsing the
+// history (arrow keys, Ctrl-P / Ctrl-N), reverse search in the history
+// (Ctrl-R), deleting (Backspace, Del, Ctrl-K, Ctrl-U, Ctrl-W) and tab
+// completion (if Complete is not nil).
+//
+// Lines are assumed to fit into one line of the terminal.
+type TerminalLineReader struct {
+	In          *os.File
+	Out         io.Writer
+	Prompt      string
+	Complete    CompletionFunc
+	History     []string
+	HistorySize int
+
+	reader *bufio.Reader
+}
+
+// NewTerminalLineReader returns a new line reader for the terminal in.
+// An error is returned if in is not a terminal (or line editing is not
+// supported on the platform).
+func NewTerminalLineReader(in *os.File, out io.Writer, prompt string, complete CompletionFunc) (*TerminalLineReader, error) {
+	if !IsTerminal(in) {
+		return nil, fmt.Errorf("%s is not a terminal", in.Name())
+	}
+	return &TerminalLineReader{
+		In:          in,
+		Out:         out,
+		Prompt:      prompt,
+		Complete:    complete,
+		History:     nil,
+		HistorySize: DefaultHistorySize,
+		reader:      bufio.NewReader(in),
+	}, nil
+}
+
+// addHistory adds a line to the history if it is not empty and not equal
+// to the last entry.
+func (r *TerminalLineReader) addHistory(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if n := len(r.History); n > 0 && r.History[n-1] == line {
+		return
+	}
+	r.History = append(r.History, line)
+	if r.HistorySize > 0 && len(r.History) > r.HistorySize {
+		r.History = r.History[len(r.History)-r.HistorySize:]
+	}
+}
+
+// lineEditor is the state while editing a single line.
+type lineEditor struct {
+	r    *TerminalLineReader
+	line []rune
+	pos  int
+	// index in the history, len(history) is the line being edited
+	histIndex int
+	// the line being edited before browsing the history
+	saved []rune
+}
+
+func (e *lineEditor) refresh() {
+	fmt.Fprintf(e.r.Out, "\r%s%s\x1b[K", e.r.Prompt, string(e.line))
+	if back := len(e.line) - e.pos; back > 0 {
+		fmt.Fprintf(e.r.Out, "\x1b[%dD", back)
+	}
+}
+
+func (e *lineEditor) set(line []rune) {
+	e.line = append([]rune{}, line...)
+	e.pos = len(e.line)
+}
+
+func (e *lineEditor) insert(rs ...rune) {
+	newLine := make([]rune, 0, len(e.line)+len(rs))
+	newLine = append(newLine, e.line[:e.pos]...)
+	newLine = append(newLine, rs...)
+	newLine = append(newLine, e.line[e.pos:]...)
+	e.line = newLine
+	e.pos += len(rs)
+}
+
+func (e *lineEditor) delete(from, to int) {
+	e.line = append(e.line[:from], e.line[to:]...)
+	e.pos = from
+}
+
+func (e *lineEditor) history(delta int) {
+	next := e.histIndex + delta
+	if next < 0 || next > len(e.r.History) {
+		return
+	}
+	if e.histIndex == len(e.r.History) {
+		e.saved = append([]rune{}, e.line...)
+	}
+	e.histIndex = next
+	if next == len(e.r.History) {
+		e.set(e.saved)
+	} else {
+		e.set([]rune(e.r.History[next]))
+	}
+}
+
+// complete performs tab completion. If there is only one candidate it is
+// inserted, otherwise the common prefix of all candidates is inserted. If the
+// prefix does not extend the word all candidates are printed.
+func (e *lineEditor) complete() {
+	if e.r.Complete == nil {
+		return
+	}
+	before := string(e.line[:e.pos])
+	candidates := e.r.Complete(before)
+	if len(candidates) == 0 {
+		return
+	}
+	word, _ := lastWord(before)
+	replacement := candidates[0]
+	if len(candidates) == 1 {
+		if !strings.HasSuffix(replacement, string(filepath.Separator)) {
+			replacement += " "
+		}
+	} else {
+		for _, candidate := range candidates[1:] {
+			replacement = commonPrefix(replacement, candidate)
+		}
+	}
+	if len(candidates) > 1 && replacement == word {
+		fmt.Fprint(e.r.Out, "\r\n", strings.Join(candidates, "  "), "\r\n")
+		return
+	}
+	wordLen := len([]rune(word))
+	e.delete(e.pos-wordLen, e.pos)
+	e.insert([]rune(replacement)...)
+}
+
+func commonPrefix(a, b string) string {
+	ra, rb := []rune(a), []rune(b)
+	n := IntMin(len(ra), len(rb))
+	i := 0
+	for i < n && ra[i] == rb[i] {
+		i++
+	}
+	return string(ra[:i])
+}
+
+// search implements the reverse search in the history (Ctrl-R). It returns
+// true if the line should be accepted (enter was pressed).
+func (e *lineEditor) search() (bool, error) {
+	query := make([]rune, 0)
+	index := len(e.r.History)
+	match := ""
+	find := func(from int) {
+		for i := from; i >= 0; i-- {
+			if strings.Contains(e.r.History[i], string(query)) {
+				index, match = i, e.r.History[i]
+				return
+			}
+		}
+	}
+	for {
+		fmt.Fprintf(e.r.Out, "\r(reverse-i-search)`%s': %s\x1b[K", string(query), match)
+		c, _, readErr := e.r.reader.ReadRune()
+		if readErr != nil {
+			return false, readErr
+		}
+		switch c {
+		case 18: // Ctrl-R: next older match
+			find(index - 1)
+		case 127, 8: // backspace
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+				index, match = len(e.r.History), ""
+				find(index - 1)
+			}
+		case 3, 7: // Ctrl-C, Ctrl-G: cancel search
+			return false, nil
+		case '\r', '\n':
+			e.set([]rune(match))
+			return true, nil
+		default:
+			if unicode.IsPrint(c) {
+				query = append(query, c)
+				find(IntMin(index, len(e.r.History)-1))
+			} else {
+				// any other key ends the search and keeps the match
+				e.set([]rune(match))
+				return false, nil
+			}
+		}
+	}
+}
+
+// escape handles escape sequences (arrow keys etc.).
+func (e *lineEditor) escape() error {
+	c, _, err := e.r.reader.ReadRune()
+	if err != nil {
+		return err
+	}
+	if c != '[' && c != 'O' {
+		return nil
+	}
+	c, _, err = e.r.reader.ReadRune()
+	if err != nil {
+		return err
+	}
+	switch c {
+	case 'A':
+		e.history(-1)
+	case 'B':
+		e.history(1)
+	case 'C':
+		e.pos = IntMin(e.pos+1, len(e.line))
+	case 'D':
+		e.pos = IntMax(e.pos-1, 0)
+	case 'H':
+		e.pos = 0
+	case 'F':
+		e.pos = len(e.line)
+	default:
+		if c < '0' || c > '9' {
+			return nil
+		}
+		// sequences like ESC [ 3 ~
+		num := c
+		for c != '~' {
+			c, _, err = e.r.reader.ReadRune()
+			if err != nil {
+				return err
+			}
+			if c != '~' && (c < '0' || c > '9') {
+				return nil
+			}
+		}
+		switch num {
+		case '1', '7':
+			e.pos = 0
+		case '4', '8':
+			e.pos = len(e.line)
+		case '3':
+			if e.pos < len(e.line) {
+				e.delete(e.pos, e.pos+1)
+			}
+		}
+	}
+	return nil
+}
+
+// ReadLine implements LineReader. Ctrl-C discards the current line and
+// returns an empty line, Ctrl-D on an empty line returns io.EOF.
+func (r *TerminalLineReader) ReadLine() (string, error) {
+	restore, rawErr := makeRaw(r.In)
+	if rawErr != nil {
+		return "", rawErr
+	}
+	defer restore()
+	e := lineEditor{r: r, histIndex: len(r.History)}
+	for {
+		e.refresh()
+		c, _, readErr := r.reader.ReadRune()
+		if readErr != nil {
+			return "", readErr
+		}
+		switch c {
+		case '\r', '\n':
+			fmt.Fprint(r.Out, "\r\n")
+			line := string(e.line)
+			r.addHistory(line)
+			return line, nil
+		case 3: // Ctrl-C
+			fmt.Fprint(r.Out, "^C\r\n")
+			return "", nil
+		case 4: // Ctrl-D
+			if len(e.line) == 0 {
+				fmt.Fprint(r.Out, "\r\n")
+				return "", io.EOF
+			}
+			if e.pos < len(e.line) {
+				e.delete(e.pos, e.pos+1)
+			}
+		case 1: // Ctrl-A
+			e.pos = 0
+		case 5: // Ctrl-E
+			e.pos = len(e.line)
+		case 2: // Ctrl-B
+			e.pos = IntMax(e.pos-1, 0)
+		case 6: // Ctrl-F
+			e.pos = IntMin(e.pos+1, len(e.line))
+		case 16: // Ctrl-P
+			e.history(-1)
+		case 14: // Ctrl-N
+			e.history(1)
+		case 127, 8: // backspace
+			if e.pos > 0 {
+				e.delete(e.pos-1, e.pos)
+			}
+		case 11: // Ctrl-K
+			e.delete(e.pos, len(e.line))
+		case 21: // Ctrl-U
+			e.delete(0, e.pos)
+		case 23: // Ctrl-W
+			start := e.pos
+			for start > 0 && unicode.IsSpace(e.line[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(e.line[start-1]) {
+				start--
+			}
+			e.delete(start, e.pos)
+		case 12: // Ctrl-L
+			fmt.Fprint(r.Out, "\x1b[H\x1b[2J")
+		case 18: // Ctrl-R
+			accept, searchErr := e.search()
+			if searchErr != nil {
+				return "", searchErr
+			}
+			if accept {
+				e.refresh()
+				fmt.Fprint(r.Out, "\r\n")
+				line := string(e.line)
+				r.addHistory(line)
+				return line, nil
+			}
+		case '\t':
+			e.complete()
+		case 27: // escape sequence
+			if escErr := e.escape(); escErr != nil {
+				return "", escErr
+			}
+		default:
+			if unicode.IsPrint(c) {
+				e.insert(c)
+			}
+		}
+	}
+}
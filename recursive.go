@@ -0,0 +1,157 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"image"
+	"sync"
+)
+
+// RecursiveStorage is an ImageStorage that doesn't return the database images
+// themselves but a mosaic of each database image, composed from the images of
+// the same database. Using this storage for ComposeMosaic creates a "mosaic
+// of mosaics".
+//
+// Depth controls how often this is repeated: With a depth of 1 each tile is a
+// mosaic of database images, with a depth of 2 each tile is a mosaic of
+// mosaics and so on.
+//
+// Because a selector stores information about the current query a new
+// selector is created for each mosaic by NewSelector. The selector must select
+// images from Storage.
+//
+// The mosaics are rendered with a width and height of at most MaxSize (the
+// ratio of the database image is retained) and are cached, so each mosaic is
+// created only once. Note that this cache is never cleared, so it requires
+// a lot of memory for big databases.
+//
+// RecursiveStorage is safe for concurrent use.
+type RecursiveStorage struct {
+	Storage        ImageStorage
+	NewSelector    func() (ImageSelector, error)
+	TilesX, TilesY int
+	MaxSize        int
+	Resizer        ImageResizer
+	Strategy       ResizeStrategy
+	NumRoutines    int
+
+	// next is the storage the tiles of the mosaics are loaded from, Storage for
+	// depth 1 and a RecursiveStorage with depth - 1 otherwise.
+	next  ImageStorage
+	m     *sync.Mutex
+	cache map[ImageID]image.Image
+}
+
+// NewRecursiveStorage returns a new recursive storage. depth must be ≥ 1.
+func NewRecursiveStorage(storage ImageStorage, newSelector func() (ImageSelector, error),
+	tilesX, tilesY, depth, maxSize int, resizer ImageResizer, s ResizeStrategy,
+	numRoutines int) *RecursiveStorage {
+	var next ImageStorage = storage
+	if depth > 1 {
+		next = NewRecursiveStorage(storage, newSelector, tilesX, tilesY, depth-1,
+			maxSize, resizer, s, numRoutines)
+	}
+	var m sync.Mutex
+	return &RecursiveStorage{
+		Storage:     storage,
+		NewSelector: newSelector,
+		TilesX:      tilesX,
+		TilesY:      tilesY,
+		MaxSize:     maxSize,
+		Resizer:     resizer,
+		Strategy:    s,
+		NumRoutines: numRoutines,
+		next:        next,
+		m:           &m,
+		cache:       make(map[ImageID]image.Image),
+	}
+}
+
+// fitSize returns width and height scaled s.t. both are at most maxSize.
+// The ratio is retained, images that are already small enough are not
+// scaled.
+func fitSize(width, height, maxSize int) (int, int) {
+	if maxSize <= 0 || (width <= maxSize && height <= maxSize) {
+		return width, height
+	}
+	if width >= height {
+		return maxSize, IntMax(KeepRatioHeight(width, height, maxSize), 1)
+	}
+	return IntMax(KeepRatioWidth(width, height, maxSize), 1), maxSize
+}
+
+// NumImages returns the number of images in the original storage.
+func (s *RecursiveStorage) NumImages() ImageID {
+	return s.Storage.NumImages()
+}
+
+// LoadImage returns the mosaic of the database image with the given id.
+func (s *RecursiveStorage) LoadImage(id ImageID) (image.Image, error) {
+	s.m.Lock()
+	cached, has := s.cache[id]
+	s.m.Unlock()
+	if has {
+		return cached, nil
+	}
+	config, configErr := s.Storage.LoadConfig(id)
+	if configErr != nil {
+		return nil, configErr
+	}
+	// the image is scaled down anyway, so a smaller version is sufficient
+	fitWidth, fitHeight := fitSize(config.Width, config.Height, s.MaxSize)
+	img, imgErr := LoadImageSized(s.Storage, id, uint(fitWidth), uint(fitHeight))
+	if imgErr != nil {
+		return nil, imgErr
+	}
+	bounds := img.Bounds()
+	width, height := fitSize(bounds.Dx(), bounds.Dy(), s.MaxSize)
+	if width != bounds.Dx() || height != bounds.Dy() {
+		img = s.Resizer.Resize(uint(width), uint(height), img)
+	}
+	selector, selectorErr := s.NewSelector()
+	if selectorErr != nil {
+		return nil, selectorErr
+	}
+	if initErr := selector.Init(s.Storage); initErr != nil {
+		return nil, initErr
+	}
+	dist := NewFixedNumDivider(s.TilesX, s.TilesY, false).Divide(img.Bounds())
+	selection, selectionErr := selector.SelectImages(s.Storage, img, dist, nil)
+	if selectionErr != nil {
+		return nil, selectionErr
+	}
+	// the division of img might not start at (0, 0), the mosaic division must
+	mosaicDist := NewFixedNumDivider(s.TilesX, s.TilesY, false).Divide(image.Rect(0, 0, width, height))
+	mosaic, mosaicErr := ComposeMosaic(s.next, selection, mosaicDist, s.Resizer,
+		s.Strategy, nil, NoTileBorder, s.NumRoutines, nil, nil)
+	if mosaicErr != nil {
+		return nil, mosaicErr
+	}
+	s.m.Lock()
+	s.cache[id] = mosaic
+	s.m.Unlock()
+	return mosaic, nil
+}
+
+// LoadConfig returns the config of the database image, width and height are
+// the dimensions of the mosaic.
+func (s *RecursiveStorage) LoadConfig(id ImageID) (image.Config, error) {
+	config, configErr := s.Storage.LoadConfig(id)
+	if configErr != nil {
+		return config, configErr
+	}
+	config.Width, config.Height = fitSize(config.Width, config.Height, s.MaxSize)
+	return config, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"image"
+	"sort"
+	"strings"
+)
+
+// This file contains registries for named selectors and dividers. This way
+// other packages can plug in new selection strategies or layouts, they can be
+// used by name in the mosaic command (selectors) and with "set layout"
+// (dividers).
+
+// SelectorOptions contains everything a SelectorFactory might need to create
+// a selector.
+type SelectorOptions struct {
+	// Storage is the storage the selector is used with. If orientations are
+	// enabled it contains each image in all orientations.
+	Storage ImageStorage
+	// GCHs are the GCHs of the images in Storage, nil if no GCHs are loaded.
+	GCHs HistogramStorage
+	// LCHs are the LCHs of the images in Storage, nil if no LCHs are loaded.
+	LCHs LCHStorage
+	// Scheme is the scheme of the LCHs, nil if no LCHs are loaded.
+	Scheme LCHScheme
+	// Variety is the variety selector set in the REPL.
+	Variety CmdVarietySelector
+	// BestFit is the number of images in the heaps of the variety selectors,
+	// see ExecutorState.GetBestFitImages.
+	BestFit     int
+	Seed        int64
+	NumRoutines int
+	// Weights are the weights of the images in Storage (see ImageWeights and
+	// NewWeightedImageMetric), nil if all images have weight 1.
+	Weights []float64
+}
+
+// SelectorFactory creates a named selector. The ImageMetric is used to report
+// metric values (for example in the HTML report of a mosaic), it can be nil.
+type SelectorFactory func(options SelectorOptions) (ImageSelector, ImageMetric, error)
+
+// DividerFactory creates a named divider for a query image that should be
+// divided into (approximately) tilesX * tilesY tiles. If cut is true tiles
+// that would exceed the image should be cut, see FixedNumDivider.
+type DividerFactory func(query image.Image, tilesX, tilesY int, cut bool) ImageDivider
+
+var (
+	selectorFactories = make(map[string]SelectorFactory)
+	dividerFactories  = make(map[string]DividerFactory)
+)
+
+// RegisterSelector is used to register a named selector. It will only add the
+// selector if the name does not exist yet and doesn't start with "gch", "lch",
+// "feature" or "gray" (these are the builtin selectors). The result is true if the selector
+// was successfully registered and false otherwise.
+// All names must be lowercase strings, the register and get methods will
+// always transform a string to lowercase.
+//
+// All selectors should be registered by an init method.
+func RegisterSelector(name string, factory SelectorFactory) bool {
+	name = strings.ToLower(name)
+	if name == "" || strings.HasPrefix(name, "gch") || strings.HasPrefix(name, "lch") ||
+		strings.HasPrefix(name, "feature") || strings.HasPrefix(name, "gray") {
+		return false
+	}
+	if _, has := selectorFactories[name]; has {
+		return false
+	}
+	selectorFactories[name] = factory
+	return true
+}
+
+// GetSelector returns a registered selector factory.
+// Returns the factory and true on success and nil and false otherwise.
+// See RegisterSelector for details.
+func GetSelector(name string) (SelectorFactory, bool) {
+	factory, has := selectorFactories[strings.ToLower(name)]
+	return factory, has
+}
+
+// GetSelectorNames returns the sorted names of all registered selectors.
+func GetSelectorNames() []string {
+	res := make([]string, 0, len(selectorFactories))
+	for name := range selectorFactories {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// RegisterDivider is used to register a named divider. It will only add the
+// divider if the name does not exist yet and is not the name of a builtin
+// layout (see ParseCmdLayout). The result is true if the divider was
+// successfully registered and false otherwise.
+// All names must be lowercase strings, the register and get methods will
+// always transform a string to lowercase.
+//
+// All dividers should be registered by an init method.
+func RegisterDivider(name string, factory DividerFactory) bool {
+	name = strings.ToLower(name)
+	if _, builtinErr := ParseCmdLayout(name); name == "" || builtinErr == nil {
+		return false
+	}
+	if _, has := dividerFactories[name]; has {
+		return false
+	}
+	dividerFactories[name] = factory
+	return true
+}
+
+// GetDivider returns a registered divider factory.
+// Returns the factory and true on success and nil and false otherwise.
+// See RegisterDivider for details.
+func GetDivider(name string) (DividerFactory, bool) {
+	factory, has := dividerFactories[strings.ToLower(name)]
+	return factory, has
+}
+
+// GetDividerNames returns the sorted names of all registered dividers.
+func GetDividerNames() []string {
+	res := make([]string, 0, len(dividerFactories))
+	for name := range dividerFactories {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
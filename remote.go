@@ -0,0 +1,313 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// This file contains an image storage for images that are not stored on the
+// local filesystem but are retrieved via HTTP(S), for example from a web
+// server or an S3 bucket.
+
+// URLMapper is a mapping between image URLs and internal ids, it's the
+// counterpart of FSMapper for remote images.
+type URLMapper struct {
+	NameMapping map[string]ImageID
+	IDMapping   []string
+}
+
+// NewURLMapper creates a new mapper without any values (empty mappings).
+// To read the URLs from a manifest use ReadManifest.
+func NewURLMapper() *URLMapper {
+	return &URLMapper{
+		NameMapping: make(map[string]ImageID),
+		IDMapping:   nil,
+	}
+}
+
+// Len returns the number of registered images.
+func (m *URLMapper) Len() int {
+	return len(m.IDMapping)
+}
+
+// NumImages returns the number of registered images as an ImageID.
+func (m *URLMapper) NumImages() ImageID {
+	return ImageID(m.Len())
+}
+
+// GetID returns the id of the URL. The second return value is false if the
+// URL is not registered.
+func (m *URLMapper) GetID(u string) (ImageID, bool) {
+	id, has := m.NameMapping[u]
+	return id, has
+}
+
+// GetURL returns the URL of the image with the given id. The second return
+// value is false if the id is not valid.
+func (m *URLMapper) GetURL(id ImageID) (string, bool) {
+	if int(id) >= len(m.IDMapping) {
+		return "", false
+	}
+	return m.IDMapping[id], true
+}
+
+// Register adds a new URL to the mapper and returns its id. If the URL is
+// already registered the old id and false are returned.
+func (m *URLMapper) Register(u string) (ImageID, bool) {
+	if oldID, has := m.NameMapping[u]; has {
+		return oldID, false
+	}
+	id := m.NumImages()
+	m.NameMapping[u] = id
+	m.IDMapping = append(m.IDMapping, u)
+	return id, true
+}
+
+// ResolveS3URL translates an URL of the form "s3://bucket/key" to the HTTPS
+// URL of the object. If region is not empty the regional endpoint is used.
+// Note that no authentication is done, thus the objects must be public (or
+// use presigned HTTPS URLs in the manifest instead).
+func ResolveS3URL(s3URL, region string) (string, error) {
+	parsed, parseErr := url.Parse(s3URL)
+	if parseErr != nil {
+		return "", parseErr
+	}
+	if parsed.Scheme != "s3" || parsed.Host == "" {
+		return "", fmt.Errorf("Invalid S3 URL %s, expect s3://bucket/key", s3URL)
+	}
+	key := strings.TrimPrefix(parsed.Path, "/")
+	if key == "" {
+		return "", fmt.Errorf("Invalid S3 URL %s: Missing object key", s3URL)
+	}
+	host := parsed.Host + ".s3.amazonaws.com"
+	if region != "" {
+		host = parsed.Host + ".s3." + region + ".amazonaws.com"
+	}
+	res := url.URL{Scheme: "https", Host: host, Path: "/" + key}
+	return res.String(), nil
+}
+
+// ReadManifest reads a manifest of remote images: Each line contains one URL,
+// either a HTTP(S) URL or an S3 URL (see ResolveS3URL, region is used for
+// these URLs). Empty lines and lines starting with # are ignored.
+func ReadManifest(r io.Reader, region string) (*URLMapper, error) {
+	res := NewURLMapper()
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "s3://"):
+			var s3Err error
+			line, s3Err = ResolveS3URL(line, region)
+			if s3Err != nil {
+				return nil, fmt.Errorf("Error in manifest line %d: %s", lineNum, s3Err.Error())
+			}
+		case strings.HasPrefix(line, "http://"), strings.HasPrefix(line, "https://"):
+		default:
+			return nil, fmt.Errorf("Error in manifest line %d: Unsupported URL %s", lineNum, line)
+		}
+		res.Register(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ReadManifestFile reads a manifest from a file, see ReadManifest.
+func ReadManifestFile(file, region string) (*URLMapper, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadManifest(f, region)
+}
+
+// RemoteImageDB implements ImageStorage. The images are downloaded on demand
+// from the URLs of a URLMapper and stored in a local cache directory, thus
+// each image is downloaded only once.
+type RemoteImageDB struct {
+	mapper *URLMapper
+
+	// CacheDir is the directory the downloaded images are stored in.
+	CacheDir string
+
+	// Client is the client used for downloads.
+	Client *http.Client
+}
+
+// NewRemoteImageDB returns a new database given the mapper. cacheDir is
+// created if it doesn't exist. http.DefaultClient is used for downloads.
+func NewRemoteImageDB(mapper *URLMapper, cacheDir string) (*RemoteImageDB, error) {
+	if mkdirErr := os.MkdirAll(cacheDir, 0755); mkdirErr != nil {
+		return nil, mkdirErr
+	}
+	return &RemoteImageDB{mapper: mapper, CacheDir: cacheDir, Client: http.DefaultClient}, nil
+}
+
+// NumImages returns the number of images in the database.
+func (db *RemoteImageDB) NumImages() ImageID {
+	return db.mapper.NumImages()
+}
+
+// CachePath returns the path of the cached file for an URL. The name of the
+// file is the hash of the URL (plus the original extension).
+func (db *RemoteImageDB) CachePath(u string) string {
+	hash := sha1.Sum([]byte(u))
+	ext := ""
+	if parsed, parseErr := url.Parse(u); parseErr == nil {
+		ext = strings.ToLower(path.Ext(parsed.Path))
+	}
+	return filepath.Join(db.CacheDir, hex.EncodeToString(hash[:])+ext)
+}
+
+// download writes the content of the URL to file. The content is first
+// written to a temporary file, thus concurrent downloads of the same URL don't
+// produce broken files.
+func (db *RemoteImageDB) download(u, file string) error {
+	resp, getErr := db.Client.Get(u)
+	if getErr != nil {
+		return getErr
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Can't download %s: %s", u, resp.Status)
+	}
+	tmp, tmpErr := ioutil.TempFile(db.CacheDir, "download")
+	if tmpErr != nil {
+		return tmpErr
+	}
+	_, copyErr := io.Copy(tmp, resp.Body)
+	closeErr := tmp.Close()
+	if copyErr == nil {
+		copyErr = closeErr
+	}
+	if copyErr != nil {
+		os.Remove(tmp.Name())
+		return copyErr
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// Fetch returns the path of the cached image with the given id, the image is
+// downloaded if it's not in the cache.
+func (db *RemoteImageDB) Fetch(id ImageID) (string, error) {
+	u, hasURL := db.mapper.GetURL(id)
+	if !hasURL {
+		return "", fmt.Errorf("Invalid image id %d: %w", id, ErrImageNotFound)
+	}
+	file := db.CachePath(u)
+	if _, statErr := os.Stat(file); statErr == nil {
+		return file, nil
+	}
+	if downloadErr := db.download(u, file); downloadErr != nil {
+		return "", downloadErr
+	}
+	return file, nil
+}
+
+// LoadImage loads the image with the given id, downloading it if required.
+func (db *RemoteImageDB) LoadImage(id ImageID) (image.Image, error) {
+	file, fetchErr := db.Fetch(id)
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	r, openErr := os.Open(file)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer r.Close()
+	countEvent(CounterImagesDecoded, 1)
+	img, _, decodeErr := image.Decode(r)
+	return img, wrapDecodeErr(file, decodeErr)
+}
+
+// LoadConfig loads the config of the image with the given id, downloading it
+// if required.
+func (db *RemoteImageDB) LoadConfig(id ImageID) (image.Config, error) {
+	file, fetchErr := db.Fetch(id)
+	if fetchErr != nil {
+		return image.Config{}, fetchErr
+	}
+	r, openErr := os.Open(file)
+	if openErr != nil {
+		return image.Config{}, openErr
+	}
+	defer r.Close()
+	config, _, decodeErr := image.DecodeConfig(r)
+	return config, decodeErr
+}
+
+// FetchAll downloads all images that are not in the cache yet, numRoutines
+// downloads run concurrently. It returns the paths of the cached files
+// (ordered by id) and a report of the images that couldn't be downloaded,
+// their path is empty.
+func (db *RemoteImageDB) FetchAll(numRoutines int, progress ProgressFunc) ([]string, *ImageErrorReport) {
+	if numRoutines <= 0 {
+		numRoutines = 1
+	}
+	numImages := int(db.NumImages())
+	files := make([]string, numImages)
+	errs := make([]error, numImages)
+	jobs := make(chan ImageID, BufferSize)
+	done := make(chan struct{}, BufferSize)
+	for w := 0; w < numRoutines; w++ {
+		go func() {
+			for id := range jobs {
+				files[id], errs[id] = db.Fetch(id)
+				done <- struct{}{}
+			}
+		}()
+	}
+	go func() {
+		for id := 0; id < numImages; id++ {
+			jobs <- ImageID(id)
+		}
+		close(jobs)
+	}()
+	for i := 0; i < numImages; i++ {
+		<-done
+		if progress != nil {
+			progress(i)
+		}
+	}
+	report := &ImageErrorReport{NumImages: numImages}
+	for id, err := range errs {
+		if err != nil {
+			u, _ := db.mapper.GetURL(ImageID(id))
+			report.Skipped = append(report.Skipped, ImageError{Image: ImageID(id), Path: u, Err: err})
+		}
+	}
+	return files, report
+}
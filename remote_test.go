@@ -0,0 +1,74 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStorageLoadManifest(t *testing.T) {
+	dir := t.TempDir()
+	served := filepath.Join(dir, "served")
+	writeUniformPNG(t, filepath.Join(dir, "red.png"), color.NRGBA{255, 0, 0, 255})
+	writeUniformPNG(t, filepath.Join(dir, "blue.png"), color.NRGBA{0, 0, 255, 255})
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.FileServer(http.Dir(dir)).ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	manifest := "# test images\n" +
+		server.URL + "/red.png\n\n" +
+		server.URL + "/blue.png\n" +
+		server.URL + "/missing.png\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "images.txt"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state := ReplHandler{}.Init()
+	state.WorkingDir, state.Out, state.Verbose, state.NumRoutines = dir, ioutil.Discard, false, 2
+	if err := ImageStorageCommand(state, "load", "--manifest", "images.txt", "--cache", served); err == nil {
+		t.Error("Expected an error for the missing image with image-errors fail")
+	}
+	state.ImageErrors = ImageErrorsSkip
+	if err := ImageStorageCommand(state, "load", "--manifest", "images.txt", "--cache", served); err != nil {
+		t.Fatal(err)
+	}
+	if state.Mapper.Len() != 2 {
+		t.Fatalf("Expected 2 images, got %d", state.Mapper.Len())
+	}
+	if err := GCHCommand(state, "create", "4"); err != nil {
+		t.Fatal(err)
+	}
+
+	// cached images are not downloaded again
+	before := atomic.LoadInt32(&requests)
+	if err := ImageStorageCommand(state, "load", "--manifest", "images.txt", "--cache", served); err != nil {
+		t.Fatal(err)
+	}
+	if after := atomic.LoadInt32(&requests); after != before+1 {
+		t.Errorf("Expected only the missing image to be requested again, got %d requests", after-before)
+	}
+
+	if err := ImageStorageCommand(state, "add", dir, "--manifest", "images.txt"); err == nil {
+		t.Error("--manifest should only be allowed with load")
+	}
+}
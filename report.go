@@ -0,0 +1,199 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"fmt"
+	"html/template"
+	"image"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// This file contains an HTML report of a mosaic: The mosaic is shown with an
+// image map, for each tile the database image and its metric value are shown.
+// This is useful to understand why an image was selected for a tile.
+
+// ReportCandidates is the number of candidates listed for each tile in an
+// HTML report.
+const ReportCandidates = 5
+
+// MetricValues computes the metric value between each tile of the query and
+// the image selected for it. The value of tiles with NoImageID (and tiles for
+// which the metric returns an error) is NaN.
+func MetricValues(storage ImageStorage, metric ImageMetric, query image.Image,
+	dist TileDivision, selection [][]ImageID) ([][]float64, error) {
+	if initErr := metric.InitStorage(storage); initErr != nil {
+		return nil, initErr
+	}
+	if initErr := metric.InitTiles(storage, query, dist); initErr != nil {
+		return nil, initErr
+	}
+	res := make([][]float64, len(selection))
+	for i, col := range selection {
+		res[i] = make([]float64, len(col))
+		for j, id := range col {
+			res[i][j] = math.NaN()
+			if id == NoImageID {
+				continue
+			}
+			if value, compareErr := metric.Compare(storage, id, i, j); compareErr == nil {
+				res[i][j] = value
+			}
+		}
+	}
+	return res, nil
+}
+
+// reportTile is a tile in the HTML report.
+type reportTile struct {
+	Row, Column            int
+	MinX, MinY, MaxX, MaxY int
+	Path                   string
+	Link                   string
+	Orientation            Orientation
+	Value                  string
+	Candidates             []PlanCandidate
+}
+
+// reportData is the data passed to reportTemplate.
+type reportData struct {
+	Mosaic             string
+	Width, Height      int
+	Parameters         map[string]string
+	Tiles              []reportTile
+	NumTiles, NumEmpty int
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Mosaic report {{.Mosaic}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; }
+#info { position: sticky; top: 0; background: #fff; padding: 4px 0; min-height: 1.5em; }
+tr:target { background: #ffe08a; }
+</style>
+</head>
+<body>
+<h1>Mosaic report</h1>
+<table>
+<tr><th>mosaic</th><td>{{.Mosaic}}</td></tr>
+<tr><th>size</th><td>{{.Width}}x{{.Height}}</td></tr>
+<tr><th>tiles</th><td>{{.NumTiles}} ({{.NumEmpty}} empty)</td></tr>
+{{range $key, $value := .Parameters}}<tr><th>{{$key}}</th><td>{{$value}}</td></tr>
+{{end}}</table>
+<p id="info">Hover over a tile to show the database image, click it to jump to the tile in the table.</p>
+<img src="{{.Mosaic}}" width="{{.Width}}" height="{{.Height}}" usemap="#tiles" alt="mosaic">
+<map name="tiles">
+{{range .Tiles}}<area shape="rect" coords="{{.MinX}},{{.MinY}},{{.MaxX}},{{.MaxY}}" href="#tile-{{.Row}}-{{.Column}}" title="{{.Path}} ({{.Value}})" onmouseover="document.getElementById('info').textContent = this.title">
+{{end}}</map>
+<h2>Tiles</h2>
+<table>
+<tr><th>row</th><th>column</th><th>image</th><th>orientation</th><th>metric value</th><th></th><th>candidates</th></tr>
+{{range .Tiles}}<tr id="tile-{{.Row}}-{{.Column}}"><td>{{.Row}}</td><td>{{.Column}}</td><td><a href="{{.Link}}">{{.Path}}</a></td><td>{{.Orientation}}</td><td>{{.Value}}</td><td><img src="{{.Link}}" height="48" alt=""></td><td>{{range .Candidates}}{{.Path}} ({{printf "%.6f" .Value}})<br>{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// WriteHTMLReport writes an HTML report of a mosaic to w. mosaicFile is the
+// path of the mosaic image, it's used in the HTML as it is. So it should be
+// relative to the directory of the report (or absolute). mosaicDist is the
+// division of the mosaic, plan contains the selected images and values the
+// metric values (see MetricValues). If values is nil the values of the plan
+// entries are used (see MosaicPlan.AddDetails). The candidates of the plan
+// entries are listed for each tile.
+//
+// The report shows the mosaic with an image map: Hovering over a tile shows
+// the database image and the metric value, clicking it jumps to the entry of
+// the tile in a table of all tiles. The paths of the database images are
+// written as links relative to reportDir if possible.
+func WriteHTMLReport(w io.Writer, reportDir, mosaicFile string, mosaicDist TileDivision,
+	plan *MosaicPlan, values [][]float64) error {
+	if len(mosaicDist) != len(plan.Tiles) {
+		return fmt.Errorf("Division and plan are of different size: %d and %d", len(mosaicDist), len(plan.Tiles))
+	}
+	bounds := image.Rectangle{}
+	data := reportData{
+		Mosaic:     filepath.ToSlash(mosaicFile),
+		Parameters: plan.Parameters,
+	}
+	for i, col := range mosaicDist {
+		if len(col) != len(plan.Tiles[i]) {
+			return fmt.Errorf("Division and plan are of different size in row %d: %d and %d",
+				i, len(col), len(plan.Tiles[i]))
+		}
+		for j, r := range col {
+			bounds = bounds.Union(r)
+			data.NumTiles++
+			entry := plan.Tiles[i][j]
+			if entry.Path == "" {
+				data.NumEmpty++
+				continue
+			}
+			value := "-"
+			switch {
+			case values != nil:
+				if !math.IsNaN(values[i][j]) {
+					value = fmt.Sprintf("%.6f", values[i][j])
+				}
+			case entry.Value != nil:
+				value = fmt.Sprintf("%.6f", *entry.Value)
+			}
+			link := entry.Path
+			if rel, relErr := filepath.Rel(reportDir, entry.Path); relErr == nil {
+				link = rel
+			}
+			// the area coordinates are inclusive
+			data.Tiles = append(data.Tiles, reportTile{
+				Row: i, Column: j,
+				MinX: r.Min.X, MinY: r.Min.Y, MaxX: r.Max.X - 1, MaxY: r.Max.Y - 1,
+				Path:        entry.Path,
+				Link:        filepath.ToSlash(link),
+				Orientation: entry.Orientation,
+				Value:       value,
+				Candidates:  entry.Candidates,
+			})
+		}
+	}
+	data.Width, data.Height = bounds.Max.X, bounds.Max.Y
+	return reportTemplate.Execute(w, data)
+}
+
+// SaveHTMLReport writes the HTML report (see WriteHTMLReport) to a file, the
+// links are relative to the directory of the file.
+func SaveHTMLReport(path, mosaicPath string, mosaicDist TileDivision, plan *MosaicPlan,
+	values [][]float64) error {
+	reportDir := filepath.Dir(path)
+	mosaicFile := mosaicPath
+	if rel, relErr := filepath.Rel(reportDir, mosaicPath); relErr == nil {
+		mosaicFile = rel
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = WriteHTMLReport(f, reportDir, mosaicFile, mosaicDist, plan, values); err != nil {
+		return err
+	}
+	return f.Close()
+}
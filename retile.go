@@ -0,0 +1,95 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// This file contains functions to change single tiles of a mosaic after it
+// has been created: The selection is run again for one tile (for example
+// without the image that is currently used) and the tile is replaced in the
+// mosaic, the other tiles are not changed.
+
+// MosaicOutput describes a mosaic that has been saved: The path of the query
+// and the mosaic, the division of the mosaic and the opacity of the query
+// blended over the mosaic. It's required to change single tiles later.
+type MosaicOutput struct {
+	Query    string
+	Path     string
+	Division TileDivision
+	Overlay  float64
+}
+
+// BestTileImage returns the image with the smallest metric value for the tile
+// (tileY, tileX) of dist among all images for which accept returns true
+// (accept may be nil). The metric is only initialized for this tile.
+// An error is returned if no image is accepted.
+func BestTileImage(storage ImageStorage, metric ImageMetric, query image.Image,
+	dist TileDivision, tileY, tileX int, accept func(id ImageID) bool) (ImageID, float64, error) {
+	if tileY < 0 || tileY >= len(dist) || tileX < 0 || tileX >= len(dist[tileY]) {
+		return NoImageID, math.NaN(), fmt.Errorf("Invalid tile (%d, %d)", tileY, tileX)
+	}
+	if initErr := metric.InitStorage(storage); initErr != nil {
+		return NoImageID, math.NaN(), initErr
+	}
+	tile := TileDivision{{dist[tileY][tileX]}}
+	if initErr := metric.InitTiles(storage, query, tile); initErr != nil {
+		return NoImageID, math.NaN(), initErr
+	}
+	best, bestValue := NoImageID, math.Inf(1)
+	numImages := storage.NumImages()
+	for id := ImageID(0); id < numImages; id++ {
+		if accept != nil && !accept(id) {
+			continue
+		}
+		value, compareErr := metric.Compare(storage, id, 0, 0)
+		if compareErr != nil {
+			return NoImageID, math.NaN(), compareErr
+		}
+		if best == NoImageID || value < bestValue {
+			best, bestValue = id, value
+		}
+	}
+	if best == NoImageID {
+		return NoImageID, math.NaN(), errors.New("No database image left for the tile")
+	}
+	return best, bestValue, nil
+}
+
+// PatchTile returns a copy of mosaic in which the tile area is replaced by
+// the database image. The arguments are the same as for ComposeMosaic, the
+// border is drawn around the tile.
+func PatchTile(mosaic image.Image, area image.Rectangle, storage ImageStorage, id ImageID,
+	resizer ImageResizer, s ResizeStrategy, transform TileTransform, border TileBorder,
+	tileY, tileX int) (*image.RGBA, error) {
+	bounds := mosaic.Bounds()
+	res := image.NewRGBA(bounds)
+	draw.Draw(res, bounds, mosaic, bounds.Min, draw.Src)
+	inner := area
+	if border.Width > 0 {
+		draw.Draw(res, area, image.NewUniform(border.Color), image.ZP, draw.Src)
+		inner = area.Inset(border.Width)
+	}
+	if tileErr := insertTile(res, inner, storage, id, resizer, s, NewImageCache(1),
+		transform, tileY, tileX); tileErr != nil {
+		return nil, tileErr
+	}
+	return res, nil
+}
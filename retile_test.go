@@ -0,0 +1,100 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic_test
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/FabianWe/gomosaic"
+	"github.com/FabianWe/gomosaic/gomosaictest"
+)
+
+// writeTestPNG writes img as png to path.
+func writeTestPNG(t *testing.T, path string, img image.Image) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRetileNonSquare creates a mosaic with 10 columns and 3 rows and
+// replaces single tiles, the tiles are addressed by column and row.
+func TestRetileNonSquare(t *testing.T) {
+	dir := t.TempDir()
+	dbDir := filepath.Join(dir, "db")
+	if err := os.Mkdir(dbDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i, img := range gomosaictest.Images() {
+		writeTestPNG(t, filepath.Join(dbDir, fmt.Sprintf("%02d.png", i)), img)
+	}
+	writeTestPNG(t, filepath.Join(dir, "query.png"), gomosaictest.Query())
+
+	state := gomosaic.ReplHandler{}.Init()
+	state.WorkingDir, state.Out, state.Verbose = dir, ioutil.Discard, false
+	state.NumRoutines, state.PyramidDir, state.Pyramid = 1, "", 0
+	run := func(cmd gomosaic.CommandFunc, args ...string) {
+		t.Helper()
+		if err := cmd(state, args...); err != nil {
+			t.Fatalf("Command %v failed: %s", args, err.Error())
+		}
+	}
+	run(gomosaic.ImageStorageCommand, "load", dbDir)
+	run(gomosaic.GCHCommand, "create")
+	run(gomosaic.MosaicCommand, "query.png", "mosaic.png", "gch-euclid", "10x3", "200x60")
+
+	plan := state.LastPlan
+	if len(plan.Tiles) != 3 || len(plan.Tiles[0]) != 10 {
+		t.Fatalf("Expected a plan with 3 rows and 10 columns, got %d rows", len(plan.Tiles))
+	}
+	before := make([][]string, len(plan.Tiles))
+	for y, row := range plan.Tiles {
+		for _, entry := range row {
+			before[y] = append(before[y], entry.Path)
+		}
+	}
+
+	// column 5 and 9 only exist because the mosaic is wider than it is high
+	run(gomosaic.RetileCommand, "5", "0", "exclude")
+	run(gomosaic.RetileCommand, "9", "2", "exclude")
+	for y, row := range plan.Tiles {
+		for x, entry := range row {
+			changed := (x == 5 && y == 0) || (x == 9 && y == 2)
+			if changed && entry.Path == before[y][x] {
+				t.Errorf("Tile (%d, %d) should have been replaced", x, y)
+			}
+			if !changed && entry.Path != before[y][x] {
+				t.Errorf("Tile (%d, %d) should not have been changed", x, y)
+			}
+		}
+	}
+
+	for _, args := range [][]string{{"10", "0"}, {"0", "3"}, {"-1", "0"}} {
+		if err := gomosaic.RetileCommand(state, args...); err == nil {
+			t.Errorf("Expected an error for tile %v", args)
+		}
+	}
+}
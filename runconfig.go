@@ -0,0 +1,310 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file contains a declarative description of a complete mosaic
+// generation run, see MosaicConfig.
+
+// MosaicConfig describes a complete mosaic generation run: Which images to
+// use, which features to compute and how to create the mosaic.
+//
+// It can be read from JSON or YAML files, see ReadMosaicConfig. The names of
+// the fields in these files are given by the json tags. Example (YAML):
+//
+//	database: ~/Pictures
+//	recursive: true
+//	feature: gch
+//	metric: cosine
+//	query: input.jpg
+//	output: mosaic.png
+//	tiles: 30x20
+//	size: 1024x
+//	variables:
+//	  variety: random
+//	  routines: 8
+type MosaicConfig struct {
+	// Database is the directory containing the database images.
+	Database string `json:"database"`
+
+	// Recursive is true if the database directory should be scanned
+	// recursively.
+	Recursive bool `json:"recursive"`
+
+	// Feature is either "gch" (the default) or "lch".
+	Feature string `json:"feature"`
+
+	// K is the number of sub-divisions of the histograms, defaults to 8.
+	K uint `json:"k"`
+
+	// Scheme is the LCH scheme (see ParseLCHScheme), defaults to "5". It's
+	// ignored for GCHs.
+	Scheme string `json:"scheme"`
+
+	// Histograms is an optional file containing precomputed histograms (GCHs or
+	// LCHs depending on Feature). If it's empty the histograms are computed.
+	Histograms string `json:"histograms"`
+
+	// Metric is the name of the metric (see GetHistogramMetricNames), defaults
+	// to "euclid".
+	Metric string `json:"metric"`
+
+	// Selector is the name of a selector registered with RegisterSelector. If
+	// it's set it's used instead of Metric, the features given by Feature are
+	// still computed.
+	Selector string `json:"selector"`
+
+	// Query is the path of the query image.
+	Query string `json:"query"`
+
+	// Output is the path of the mosaic.
+	Output string `json:"output"`
+
+	// Tiles is the number of tiles, for example "30x20".
+	Tiles string `json:"tiles"`
+
+	// Size is the size of the mosaic, for example "1024x768" or "1024x". If
+	// it's empty the size of the query image is used.
+	Size string `json:"size"`
+
+	// Variables are set before anything else is done, see the set command.
+	// This way all options of the REPL (variety, layout, cache-size, ...) can
+	// be used.
+	Variables map[string]string `json:"variables"`
+}
+
+// setDefaults sets the default values for all unset fields.
+func (cfg *MosaicConfig) setDefaults() {
+	if cfg.Feature == "" {
+		cfg.Feature = "gch"
+	}
+	if cfg.K == 0 {
+		cfg.K = 8
+	}
+	if cfg.Scheme == "" {
+		cfg.Scheme = "5"
+	}
+	if cfg.Metric == "" {
+		cfg.Metric = "euclid"
+	}
+}
+
+// Commands returns the commands that are executed for the configuration by
+// ExecuteConfig. Each command is given as the list of its arguments, the
+// first being the name of the command (see DefaultCommands).
+func (cfg *MosaicConfig) Commands() ([][]string, error) {
+	cfg.setDefaults()
+	switch {
+	case cfg.Database == "":
+		return nil, errors.New("Invalid config: database is required")
+	case cfg.Query == "":
+		return nil, errors.New("Invalid config: query is required")
+	case cfg.Output == "":
+		return nil, errors.New("Invalid config: output is required")
+	case cfg.Tiles == "":
+		return nil, errors.New("Invalid config: tiles is required")
+	case cfg.Feature != "gch" && cfg.Feature != "lch":
+		return nil, fmt.Errorf("Invalid config: feature must be gch or lch, got %s", cfg.Feature)
+	}
+	res := make([][]string, 0, len(cfg.Variables)+3)
+	// keep order deterministic
+	names := make([]string, 0, len(cfg.Variables))
+	for name := range cfg.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		res = append(res, []string{"set", name, cfg.Variables[name]})
+	}
+	res = append(res, []string{"storage", "load", cfg.Database, strconv.FormatBool(cfg.Recursive)})
+	k := strconv.FormatUint(uint64(cfg.K), 10)
+	switch {
+	case cfg.Histograms != "":
+		res = append(res, []string{cfg.Feature, "load", cfg.Histograms})
+	case cfg.Feature == "gch":
+		res = append(res, []string{"gch", "create", k})
+	default:
+		res = append(res, []string{"lch", "create", k, cfg.Scheme})
+	}
+	selection := cfg.Feature + "-" + cfg.Metric
+	if cfg.Selector != "" {
+		if _, has := GetSelector(cfg.Selector); !has {
+			return nil, fmt.Errorf("Invalid config: selector %s is not registered", cfg.Selector)
+		}
+		selection = cfg.Selector
+	}
+	mosaic := []string{"mosaic", cfg.Query, cfg.Output, selection, cfg.Tiles}
+	if cfg.Size != "" {
+		mosaic = append(mosaic, cfg.Size)
+	}
+	res = append(res, mosaic)
+	return res, nil
+}
+
+// ExecuteConfig runs the commands of the configuration (see Commands) on a new
+// state, created with the same defaults as for scripts. The first error is
+// returned.
+func ExecuteConfig(cfg *MosaicConfig) error {
+	commands, cmdErr := cfg.Commands()
+	if cmdErr != nil {
+		return cmdErr
+	}
+	state := NewScriptHandler(nil).Init()
+	for _, args := range commands {
+		cmd, has := DefaultCommands[args[0]]
+		if !has {
+			return fmt.Errorf("Internal error, please report bug: Unkown command %s", args[0])
+		}
+		if execErr := cmd.Exec(state, args[1:]...); execErr != nil {
+			return fmt.Errorf("Error in \"%s\": %s", strings.Join(args, " "), execErr.Error())
+		}
+	}
+	return nil
+}
+
+// ParseMosaicConfigJSON parses a configuration in JSON format.
+func ParseMosaicConfigJSON(r io.Reader) (*MosaicConfig, error) {
+	res := &MosaicConfig{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// stripYAMLComment removes the comment (starting with " #") from a line of a
+// YAML configuration. A # inside a quoted value doesn't start a comment.
+func stripYAMLComment(line string) string {
+	start := 0
+	if colon := strings.Index(line, ":"); colon >= 0 {
+		value := strings.TrimLeft(line[colon+1:], " \t")
+		if len(value) > 0 && (value[0] == '"' || value[0] == '\'') {
+			// search for the comment after the closing quote
+			if end := strings.IndexByte(value[1:], value[0]); end >= 0 {
+				start = len(line) - len(value) + end + 2
+			}
+		}
+	}
+	if idx := strings.Index(line[start:], " #"); idx >= 0 {
+		return line[:start+idx]
+	}
+	return line
+}
+
+// ParseMosaicConfigYAML parses a configuration in YAML format. Only the subset
+// of YAML required for MosaicConfig is supported: "key: value" lines and one
+// level of indented "key: value" lines for variables. Comments (#) and
+// quoted values are supported.
+func ParseMosaicConfigYAML(r io.Reader) (*MosaicConfig, error) {
+	res := &MosaicConfig{}
+	// map the json names to the fields
+	fields := make(map[string]reflect.Value)
+	value := reflect.ValueOf(res).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		fields[value.Type().Field(i).Tag.Get("json")] = value.Field(i)
+	}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	// the name of the map we're currently in (after "variables:"), empty if none
+	currentMap := ""
+	for scanner.Scan() {
+		lineNum++
+		line := stripYAMLComment(scanner.Text())
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		split := strings.SplitN(trimmed, ":", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("Invalid config line %d: Expected \"key: value\", got \"%s\"", lineNum, trimmed)
+		}
+		key, val := strings.TrimSpace(split[0]), strings.TrimSpace(split[1])
+		if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+			val = val[1 : len(val)-1]
+		}
+		indented := line[0] == ' ' || line[0] == '\t'
+		if indented {
+			if currentMap == "" {
+				return nil, fmt.Errorf("Invalid config line %d: Unexpected indentation", lineNum)
+			}
+			m := fields[currentMap]
+			if m.IsNil() {
+				m.Set(reflect.MakeMap(m.Type()))
+			}
+			m.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(val))
+			continue
+		}
+		currentMap = ""
+		field, has := fields[key]
+		if !has {
+			return nil, fmt.Errorf("Invalid config line %d: Unkown key %s", lineNum, key)
+		}
+		var setErr error
+		switch field.Kind() {
+		case reflect.Map:
+			if val != "" {
+				setErr = errors.New("Expected indented \"key: value\" lines")
+			}
+			currentMap = key
+		case reflect.String:
+			field.SetString(val)
+		case reflect.Bool:
+			var b bool
+			b, setErr = strconv.ParseBool(val)
+			field.SetBool(b)
+		case reflect.Uint:
+			var u uint64
+			u, setErr = strconv.ParseUint(val, 10, 64)
+			field.SetUint(u)
+		default:
+			setErr = fmt.Errorf("Internal error, please report bug: Unsupported field type %s", field.Kind())
+		}
+		if setErr != nil {
+			return nil, fmt.Errorf("Invalid config line %d: Invalid value for %s: %s", lineNum, key, setErr.Error())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ReadMosaicConfig reads a configuration from a file, files ending with .json
+// are parsed as JSON, all other files as YAML.
+func ReadMosaicConfig(path string) (*MosaicConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		return ParseMosaicConfigJSON(f)
+	}
+	return ParseMosaicConfigYAML(f)
+}
@@ -18,8 +18,6 @@ import (
 	"image"
 	"math"
 	"sync"
-
-	log "github.com/sirupsen/logrus"
 )
 
 // ImageSelector is used to select images for all tiles.
@@ -49,6 +47,149 @@ type ImageSelector interface {
 		progress ProgressFunc) ([][]ImageID, error)
 }
 
+// SelectionDetails contains the result of a selection together with the
+// metric values computed during the selection.
+//
+// Selection is the selected image for each tile (as returned by
+// SelectImages). Values contains the metric value between each tile and the
+// image selected for it, the value of tiles without an image (NoImageID) is
+// NaN. Candidates contains the best candidates for each tile (sorted by their
+// metric value, best first), it is nil if no candidates were requested or the
+// selector doesn't report candidates.
+type SelectionDetails struct {
+	Selection  [][]ImageID
+	Values     [][]float64
+	Candidates [][][]ImageHeapEntry
+}
+
+// NewSelectionDetails returns details for a selection without values and
+// candidates.
+func NewSelectionDetails(selection [][]ImageID) *SelectionDetails {
+	return &SelectionDetails{Selection: selection}
+}
+
+// DetailedSelector is an ImageSelector that also reports the metric values
+// found during the selection, see SelectionDetails. This way the values can be
+// used (for example for a heatmap, see RenderHeatmap, or a report, see
+// WriteHTMLReport) without computing the metric again.
+//
+// numCandidates is the number of candidates to report for each tile, if it
+// is 0 no candidates are reported. Selectors that wrap other selectors can
+// return details without values if the wrapped selector is not a
+// DetailedSelector.
+type DetailedSelector interface {
+	ImageSelector
+	SelectImagesDetailed(storage ImageStorage, query image.Image, dist TileDivision,
+		numCandidates int, progress ProgressFunc) (*SelectionDetails, error)
+}
+
+// SelectDetailed selects the images for the tiles and returns the details of
+// the selection: If selector is a DetailedSelector the values found during the
+// selection are used. Otherwise the values are computed with metric after the
+// selection (see MetricValues), in this case no candidates are reported. If
+// metric is nil and the selector doesn't report values the values are nil.
+func SelectDetailed(selector ImageSelector, metric ImageMetric, storage ImageStorage,
+	query image.Image, dist TileDivision, numCandidates int,
+	progress ProgressFunc) (*SelectionDetails, error) {
+	var details *SelectionDetails
+	if detailed, isDetailed := selector.(DetailedSelector); isDetailed {
+		var detailsErr error
+		details, detailsErr = detailed.SelectImagesDetailed(storage, query, dist, numCandidates, progress)
+		if detailsErr != nil {
+			return nil, detailsErr
+		}
+	} else {
+		selection, selectionErr := selector.SelectImages(storage, query, dist, progress)
+		if selectionErr != nil {
+			return nil, selectionErr
+		}
+		details = NewSelectionDetails(selection)
+	}
+	if details.Values != nil || metric == nil {
+		return details, nil
+	}
+	values, valuesErr := MetricValues(storage, metric, query, dist, details.Selection)
+	if valuesErr != nil {
+		return nil, valuesErr
+	}
+	details.Values = values
+	return details, nil
+}
+
+// newTileDetails returns the details of a selection with one entry for each
+// tile in dist: All tiles have NoImageID and a value of NaN. If numCandidates
+// is > 0 space for the candidates is allocated as well.
+func newTileDetails(dist TileDivision, numCandidates int) *SelectionDetails {
+	res := &SelectionDetails{
+		Selection: make([][]ImageID, len(dist)),
+		Values:    make([][]float64, len(dist)),
+	}
+	if numCandidates > 0 {
+		res.Candidates = make([][][]ImageHeapEntry, len(dist))
+	}
+	for i, col := range dist {
+		res.Selection[i] = make([]ImageID, len(col))
+		res.Values[i] = make([]float64, len(col))
+		for j := range col {
+			res.Selection[i][j] = NoImageID
+			res.Values[i][j] = math.NaN()
+		}
+		if numCandidates > 0 {
+			res.Candidates[i] = make([][]ImageHeapEntry, len(col))
+		}
+	}
+	return res
+}
+
+// MergeSelectionDetails merges the details for the divisions created by
+// Split, see MergeSelections. If one of the details is nil NoImageID and NaN
+// are used for its tiles. Values and candidates are only merged if both
+// details contain them.
+func MergeSelectionDetails(mark [][]bool, marked, other *SelectionDetails) *SelectionDetails {
+	var markedSelection, otherSelection [][]ImageID
+	var markedValues, otherValues [][]float64
+	var markedCandidates, otherCandidates [][][]ImageHeapEntry
+	hasValues, hasCandidates := true, true
+	for _, details := range []*SelectionDetails{marked, other} {
+		if details != nil {
+			hasValues = hasValues && details.Values != nil
+			hasCandidates = hasCandidates && details.Candidates != nil
+		}
+	}
+	if marked != nil {
+		markedSelection, markedValues, markedCandidates = marked.Selection, marked.Values, marked.Candidates
+	}
+	if other != nil {
+		otherSelection, otherValues, otherCandidates = other.Selection, other.Values, other.Candidates
+	}
+	res := NewSelectionDetails(MergeSelections(mark, markedSelection, otherSelection))
+	if hasValues {
+		res.Values = MergeDistances(mark, markedValues, otherValues)
+	}
+	if !hasCandidates {
+		return res
+	}
+	res.Candidates = make([][][]ImageHeapEntry, len(mark))
+	for i, col := range mark {
+		res.Candidates[i] = make([][]ImageHeapEntry, len(col))
+		nextMarked, nextOther := 0, 0
+		for j, isMarked := range col {
+			switch {
+			case isMarked && markedCandidates != nil:
+				res.Candidates[i][j] = markedCandidates[i][nextMarked]
+			case !isMarked && otherCandidates != nil:
+				res.Candidates[i][j] = otherCandidates[i][nextOther]
+			}
+			if isMarked {
+				nextMarked++
+			} else {
+				nextOther++
+			}
+		}
+	}
+	return res
+}
+
 // ImageMetric is used to compare a database image (image identified by an id)
 // and a tile (previously registered) and return a metric value between the
 // database image and the tile.
@@ -65,6 +206,19 @@ type ImageMetric interface {
 	Compare(storage ImageStorage, image ImageID, tileY, tileX int) (float64, error)
 }
 
+// BatchImageMetric is an ImageMetric that can compare a tile with all database
+// images in one call, this is usually much faster than calling Compare for
+// each database image. ImageMetricMinimizer uses CompareAll if the metric
+// implements this interface.
+//
+// The result contains one value for each database image (ids from 0 to
+// storage.NumImages() - 1), images that can't be compared should have the
+// value +Inf.
+type BatchImageMetric interface {
+	ImageMetric
+	CompareAll(storage ImageStorage, tileY, tileX int) ([]float64, error)
+}
+
 // InitTilesHelper is a helper function to easily create a concurrent InitTiles
 // function for ImageMetrics.
 //
@@ -163,6 +317,9 @@ func InitTilesHelper(storage ImageStorage, query image.Image, dist TileDivision,
 // The minimizer ignores metric errors in the way that whenever Compare
 // returns an error != nil the candidate will be omitted. However a message will
 // be logged in this case.
+//
+// If the metric implements BatchImageMetric each tile is compared with all
+// database images in one call to CompareAll.
 type ImageMetricMinimizer struct {
 	Metric      ImageMetric
 	NumRoutines int
@@ -186,23 +343,33 @@ func (min *ImageMetricMinimizer) Init(storage ImageStorage) error {
 // It computes the most fitting image for NumRoutines tiles concurrently.
 func (min *ImageMetricMinimizer) SelectImages(storage ImageStorage,
 	query image.Image, dist TileDivision, progress ProgressFunc) ([][]ImageID, error) {
+	details, err := min.SelectImagesDetailed(storage, query, dist, 0, progress)
+	if err != nil {
+		return nil, err
+	}
+	return details.Selection, nil
+}
+
+// SelectImagesDetailed selects the images like SelectImages and also reports
+// the minimal metric value and the numCandidates best images of each tile.
+func (min *ImageMetricMinimizer) SelectImagesDetailed(storage ImageStorage,
+	query image.Image, dist TileDivision, numCandidates int,
+	progress ProgressFunc) (*SelectionDetails, error) {
 	if initErr := min.Metric.InitTiles(storage, query, dist); initErr != nil {
 		return nil, initErr
 	}
-	result := make([][]ImageID, len(dist))
-	bestValues := make([][]float64, len(dist))
+	details := newTileDetails(dist, numCandidates)
+	result := details.Selection
+	bestValues := details.Values
 
 	// sum of all tiles, used later
 	numTiles := 0
 
-	// initialize slices
+	// initialize values
 	for i, inner := range dist {
 		size := len(inner)
 		numTiles += size
-		result[i] = make([]ImageID, size)
-		bestValues[i] = make([]float64, size)
 		for j := 0; j < size; j++ {
-			result[i][j] = NoImageID
 			bestValues[i][j] = math.MaxFloat64
 		}
 	}
@@ -222,17 +389,53 @@ func (min *ImageMetricMinimizer) SelectImages(storage ImageStorage,
 	for w := 0; w < min.NumRoutines; w++ {
 		go func() {
 			for next := range jobs {
+				var candidates *ImageHeap
+				if numCandidates > 0 {
+					candidates = NewImageHeap(numCandidates)
+				}
+				if batch, isBatch := min.Metric.(BatchImageMetric); isBatch {
+					values, batchErr := batch.CompareAll(storage, next.i, next.j)
+					if batchErr != nil {
+						SelectionLogger.Error("Can't compute metric values, ignoring tile", LogFields{
+							"error": batchErr,
+							"tileY": next.i,
+							"tileX": next.j,
+						})
+					}
+					for imageID, dist := range values {
+						// images that can't be compared have the value +Inf, they
+						// must not become candidates
+						if math.IsInf(dist, 0) || math.IsNaN(dist) {
+							continue
+						}
+						if dist < bestValues[next.i][next.j] {
+							bestValues[next.i][next.j] = dist
+							result[next.i][next.j] = ImageID(imageID)
+						}
+						if candidates != nil {
+							candidates.Add(ImageID(imageID), dist)
+						}
+					}
+					if candidates != nil {
+						details.Candidates[next.i][next.j] = candidates.GetView()
+					}
+					wg.Done()
+					continue
+				}
 				var imageID ImageID
 				for ; imageID < numImages; imageID++ {
 					// try to compute distance and update entry
 					dist, distErr := min.Metric.Compare(storage, imageID, next.i, next.j)
 					if distErr != nil {
-						log.WithFields(log.Fields{
-							log.ErrorKey: distErr,
-							"image":      imageID,
-							"tileY":      next.i,
-							"tileX":      next.j,
-						}).Error("Can't compute metric value, ignoreing it")
+						SelectionLogger.Error("Can't compute metric value, ignoreing it", LogFields{
+							"error": distErr,
+							"image": imageID,
+							"tileY": next.i,
+							"tileX": next.j,
+						})
+						continue
+					}
+					if math.IsInf(dist, 0) || math.IsNaN(dist) {
 						continue
 					}
 					// check if better than best so far
@@ -240,6 +443,12 @@ func (min *ImageMetricMinimizer) SelectImages(storage ImageStorage,
 						bestValues[next.i][next.j] = dist
 						result[next.i][next.j] = imageID
 					}
+					if candidates != nil {
+						candidates.Add(imageID, dist)
+					}
+				}
+				if candidates != nil {
+					details.Candidates[next.i][next.j] = candidates.GetView()
 				}
 				wg.Done()
 			}
@@ -263,17 +472,37 @@ func (min *ImageMetricMinimizer) SelectImages(storage ImageStorage,
 	}()
 
 	wg.Wait()
-	return result, nil
+	noImageDistances(result, bestValues)
+	return details, nil
+}
+
+// noImageDistances sets the distance of all tiles with NoImageID to NaN.
+func noImageDistances(selection [][]ImageID, values [][]float64) {
+	for i, col := range selection {
+		for j, id := range col {
+			if id == NoImageID {
+				values[i][j] = math.NaN()
+			}
+		}
+	}
 }
 
 // HistogramImageMetric implements ImageMetric by keeping a histogram storage
 // and computing histograms for a query image.
+//
+// It implements BatchImageMetric, if Batch is set it's used to compare a tile
+// with all database images. Batch must be the batch version of Metric (see
+// GetBatchVectorMetric).
 type HistogramImageMetric struct {
 	HistStorage HistogramStorage
 	Metric      HistogramMetric
+	Batch       BatchVectorMetric
 	TileData    [][]*Histogram
 	K           uint
 	NumRoutines int
+
+	// entries of the database histograms, set in InitTiles if Batch is set
+	dbEntries [][]float64
 }
 
 // NewHistogramImageMetric returns a new histogram image metric given a metric
@@ -308,9 +537,32 @@ func (m *HistogramImageMetric) InitTiles(storage ImageStorage, query image.Image
 		m.TileData[i][j] = GenHistogram(tileImage, m.K, true)
 		return nil
 	}
+	if m.Batch != nil {
+		m.initEntries(storage)
+	}
 	return InitTilesHelper(storage, query, dist, m.NumRoutines, init, onTile)
 }
 
+// initEntries collects the entries of all database histograms, this way
+// CompareAll doesn't have to query the histogram storage for each tile.
+// Images without a histogram get a nil entry.
+func (m *HistogramImageMetric) initEntries(storage ImageStorage) {
+	numImages := storage.NumImages()
+	m.dbEntries = make([][]float64, numImages)
+	var id ImageID
+	for ; id < numImages; id++ {
+		hist, histErr := m.HistStorage.GetHistogram(id)
+		if histErr != nil {
+			SelectionLogger.Error("Can't get histogram, ignoreing it", LogFields{
+				"error": histErr,
+				"image": id,
+			})
+			continue
+		}
+		m.dbEntries[id] = hist.Entries
+	}
+}
+
 // Compare compares a database image and a query image based on the histogram
 // metric function.
 func (m *HistogramImageMetric) Compare(storage ImageStorage, image ImageID, tileY, tileX int) (float64, error) {
@@ -319,11 +571,39 @@ func (m *HistogramImageMetric) Compare(storage ImageStorage, image ImageID, tile
 	if dbErr != nil {
 		return -1.0, dbErr
 	}
+	if hDatabase.K != m.K {
+		return -1.0, ErrHistogramMismatch{WantK: m.K, GotK: hDatabase.K}
+	}
 	// get histogram for tile
 	hTile := m.TileData[tileY][tileX]
 	return m.Metric(hTile, hDatabase), nil
 }
 
+// CompareAll compares the tile with all database images with the batch
+// metric. If Batch is not set it falls back to calling Compare for each image.
+func (m *HistogramImageMetric) CompareAll(storage ImageStorage, tileY, tileX int) ([]float64, error) {
+	if m.Batch == nil {
+		numImages := storage.NumImages()
+		res := make([]float64, numImages)
+		var id ImageID
+		for ; id < numImages; id++ {
+			dist, distErr := m.Compare(storage, id, tileY, tileX)
+			if distErr != nil {
+				SelectionLogger.Error("Can't compute metric value, ignoreing it", LogFields{
+					"error": distErr,
+					"image": id,
+					"tileY": tileY,
+					"tileX": tileX,
+				})
+				dist = math.Inf(1)
+			}
+			res[id] = dist
+		}
+		return res, nil
+	}
+	return m.Batch(m.TileData[tileY][tileX].Entries, m.dbEntries), nil
+}
+
 // GCHSelector is an image selector that selects images that minimize the
 // histogram metric function Δ. Formally it is an ImageMetricMinimizer
 // and thus implements ImageSelector.
@@ -0,0 +1,208 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// This file contains sessions: The configuration of an ExecutorState (and
+// its aliases) together with the images in the storage and the precomputed features is
+// saved to a file, after a restart the session can be loaded to resume work.
+
+// Session is the saved state of an ExecutorState, it's stored as JSON.
+type Session struct {
+	// Version is the version of gomosaic that saved the session.
+	Version string `json:"version"`
+	// WorkingDir is the working directory of the state.
+	WorkingDir string `json:"working-dir"`
+	// Variables contains all variables that can be changed with "set".
+	Variables map[string]string `json:"variables"`
+	// Images are the paths of the images in the storage, in the order of their
+	// ids.
+	Images []string `json:"images"`
+	// Roots maps the labels of the storage to their directories, see
+	// FSMapper.Roots.
+	Roots map[string]string `json:"roots,omitempty"`
+	// Tags are the tags of the images, see FSMapper.Tags.
+	Tags map[string][]string `json:"tags,omitempty"`
+	// Weights are the weights of the images, see FSMapper.Weights.
+	Weights map[string]float64 `json:"weights,omitempty"`
+	// Filter is the filter set with "storage filter", see ParseImageFilter.
+	Filter []string `json:"filter,omitempty"`
+	// Aliases are the aliases defined in the session, see AliasCommand.
+	Aliases map[string]string `json:"aliases,omitempty"`
+	// Features is the path of a FeatureBundle containing the GCHs and LCHs,
+	// relative to the session file. It's empty if no features were loaded.
+	Features string `json:"features,omitempty"`
+}
+
+// NewSession returns the session of the state, Features is not set.
+func NewSession(state *ExecutorState) *Session {
+	vars := state.variables()
+	res := &Session{
+		Version:    Version,
+		WorkingDir: state.WorkingDir,
+		Variables:  make(map[string]string, len(vars)),
+		Images:     make([]string, len(state.Mapper.IDMapping)),
+	}
+	for name, value := range vars {
+		res.Variables[name] = fmt.Sprintf("%v", value)
+	}
+	copy(res.Images, state.Mapper.IDMapping)
+	if len(state.Mapper.Roots) > 0 {
+		res.Roots = make(map[string]string, len(state.Mapper.Roots))
+		for label, root := range state.Mapper.Roots {
+			res.Roots[label] = root
+		}
+	}
+	if len(state.Mapper.Tags) > 0 {
+		res.Tags = make(map[string][]string, len(state.Mapper.Tags))
+		for path, tags := range state.Mapper.Tags {
+			res.Tags[path] = append([]string(nil), tags...)
+		}
+	}
+	if len(state.Mapper.Weights) > 0 {
+		res.Weights = make(map[string]float64, len(state.Mapper.Weights))
+		for path, weight := range state.Mapper.Weights {
+			res.Weights[path] = weight
+		}
+	}
+	for _, condition := range state.Filter {
+		res.Filter = append(res.Filter, condition.String())
+	}
+	if len(state.Aliases) > 0 {
+		res.Aliases = make(map[string]string, len(state.Aliases))
+		for name, body := range state.Aliases {
+			res.Aliases[name] = body
+		}
+	}
+	return res
+}
+
+// sessionFeaturesFile returns the path of the feature bundle of a session
+// file: For session.json it's session-features.gob.
+func sessionFeaturesFile(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + "-features.gob"
+}
+
+// SaveSession writes the session of the state to path. If GCHs or LCHs are
+// loaded they're saved to a feature bundle next to the session file (see
+// sessionFeaturesFile).
+func SaveSession(state *ExecutorState, path string) error {
+	session := NewSession(state)
+	if state.GCHStorage != nil || state.LCHStorage != nil {
+		bundle, bundleErr := stateFeatureBundle(state)
+		if bundleErr != nil {
+			return bundleErr
+		}
+		featuresPath := sessionFeaturesFile(path)
+		if writeErr := bundle.WriteFile(featuresPath); writeErr != nil {
+			return writeErr
+		}
+		session.Features = filepath.Base(featuresPath)
+	}
+	data, jsonErr := json.MarshalIndent(session, "", "  ")
+	if jsonErr != nil {
+		return jsonErr
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// LoadSession restores the session saved in path (see SaveSession): The
+// variables, aliases and the working directory are set, the images are loaded into
+// the storage and the features are mapped to the images. Images that don't
+// exist anymore are skipped, in this case the features must be re-computed.
+func LoadSession(state *ExecutorState, path string) error {
+	data, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		return readErr
+	}
+	var session Session
+	if jsonErr := json.Unmarshal(data, &session); jsonErr != nil {
+		return fmt.Errorf("Invalid session file %s: %s", path, jsonErr.Error())
+	}
+	if !filepath.IsAbs(session.WorkingDir) {
+		return fmt.Errorf("Invalid session file %s: Working directory must be absolute, got \"%s\"",
+			path, session.WorkingDir)
+	}
+	if fi, statErr := os.Stat(session.WorkingDir); statErr != nil || !fi.IsDir() {
+		return fmt.Errorf("Working directory %s of the session doesn't exist", session.WorkingDir)
+	}
+	if varsErr := ApplyVariables(state, session.Variables); varsErr != nil {
+		return varsErr
+	}
+	filter, filterErr := ParseImageFilter(session.Filter...)
+	if filterErr != nil {
+		return fmt.Errorf("Invalid session file %s: %s", path, filterErr.Error())
+	}
+	for name, body := range session.Aliases {
+		if aliasErr := DefineAlias(state, name, body); aliasErr != nil {
+			return aliasErr
+		}
+	}
+	state.WorkingDir = session.WorkingDir
+	state.Mapper.Clear()
+	state.GCHStorage = nil
+	state.LCHStorage = nil
+	state.Features = nil
+	state.invalidateCaches()
+	for label, root := range session.Roots {
+		state.Mapper.SetRoot(label, root)
+	}
+	state.Mapper.Tags = nil
+	state.Mapper.AddTags(session.Tags)
+	state.Mapper.Weights = nil
+	for image, weight := range session.Weights {
+		if weightErr := ValidateWeight(weight); weightErr != nil {
+			return fmt.Errorf("Invalid session file %s: %s", path, weightErr.Error())
+		}
+		state.Mapper.SetWeight(image, weight)
+	}
+	state.Filter = filter
+	numMissing := 0
+	for _, image := range session.Images {
+		if _, statErr := os.Stat(image); statErr != nil {
+			numMissing++
+			continue
+		}
+		state.Mapper.Register(image)
+	}
+	fmt.Fprintln(state.Out, "Loaded", state.Mapper.Len(), "images")
+	if numMissing > 0 {
+		fmt.Fprintln(state.Out, "Skipped", numMissing, "images that don't exist anymore")
+	}
+	if session.Features == "" {
+		return nil
+	}
+	featuresPath := session.Features
+	if !filepath.IsAbs(featuresPath) {
+		featuresPath = filepath.Join(filepath.Dir(path), featuresPath)
+	}
+	bundle := FeatureBundle{}
+	if bundleErr := bundle.ReadFile(featuresPath); bundleErr != nil {
+		return bundleErr
+	}
+	if bundle.GCH == nil && bundle.LCH == nil {
+		return errors.New("Feature bundle of the session contains no features")
+	}
+	return loadFeatureBundle(state, &bundle, "")
+}
@@ -0,0 +1,189 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// This file contains the size specification of images relative to another
+// image, for example the size of a mosaic relative to the query.
+
+// SizeUnit describes how the value of one dimension of a SizeSpec is
+// interpreted.
+type SizeUnit int
+
+const (
+	// SizeAuto means the dimension is computed from the other dimension s.t.
+	// the ratio is kept. If both dimensions are SizeAuto the original size is
+	// used.
+	SizeAuto SizeUnit = iota
+	// SizePixels is an absolute number of pixels.
+	SizePixels
+	// SizePercent is a percent value of the original dimension.
+	SizePercent
+)
+
+// MaxSizeMultiplier is the largest multiplier in a SizeSpec: "2x" is the
+// double size but "1024x" means a width of 1024 pixels. Values with a decimal
+// point (like "2.5x") are always multipliers.
+const MaxSizeMultiplier = 10
+
+// SizeValue is one dimension of a SizeSpec.
+type SizeValue struct {
+	Unit  SizeUnit
+	Value float64
+}
+
+// apply returns the dimension given the original dimension, for SizeAuto -1
+// is returned.
+func (v SizeValue) apply(original int) int {
+	switch v.Unit {
+	case SizePixels:
+		return int(v.Value)
+	case SizePercent:
+		return int(math.Round(float64(original) * v.Value / 100.0))
+	default:
+		return -1
+	}
+}
+
+func (v SizeValue) String() string {
+	switch v.Unit {
+	case SizePixels:
+		return strconv.Itoa(int(v.Value))
+	case SizePercent:
+		return strconv.FormatFloat(v.Value, 'f', -1, 64) + "%"
+	default:
+		return ""
+	}
+}
+
+// SizeSpec describes the size of an image relative to an original image
+// (usually the query). The following forms are supported (see ParseSizeSpec):
+// Absolute pixels like "1024x768", percent values like "50%x50%" or "50%"
+// (both dimensions), multipliers like "2x" and mixed forms like "1024x50%".
+// A dimension can be omitted ("1024x" or "x50%"), in this case it's computed
+// s.t. the ratio is kept. The empty string is the original size.
+type SizeSpec struct {
+	Width, Height SizeValue
+	// Scale is the multiplier if the spec is of the form "2x", in this case
+	// Width and Height are not used. 0 if the spec is not a multiplier.
+	Scale float64
+}
+
+// parseSizeValue parses a dimension of a size spec, the empty string is
+// SizeAuto.
+func parseSizeValue(s string) (SizeValue, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return SizeValue{Unit: SizeAuto}, nil
+	}
+	if strings.HasSuffix(s, "%") {
+		percent, parseErr := strconv.ParseFloat(strings.TrimSpace(s[:len(s)-1]), 64)
+		if parseErr != nil {
+			return SizeValue{}, fmt.Errorf("Invalid percent value %s", s)
+		}
+		if percent < 0 {
+			return SizeValue{}, fmt.Errorf("Dimensions must be positive, got %s", s)
+		}
+		return SizeValue{Unit: SizePercent, Value: percent}, nil
+	}
+	pixels, parseErr := strconv.Atoi(s)
+	if parseErr != nil {
+		return SizeValue{}, fmt.Errorf("Invalid dimension %s", s)
+	}
+	if pixels < 0 {
+		return SizeValue{}, fmt.Errorf("Dimensions must be positive, got %d", pixels)
+	}
+	return SizeValue{Unit: SizePixels, Value: float64(pixels)}, nil
+}
+
+// ParseSizeSpec parses a size spec, see SizeSpec for the supported forms.
+func ParseSizeSpec(s string) (SizeSpec, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return SizeSpec{}, nil
+	}
+	split := strings.Split(s, "x")
+	switch len(split) {
+	case 1:
+		// only "50%" is allowed
+		if !strings.HasSuffix(s, "%") {
+			return SizeSpec{}, fmt.Errorf("Invalid size format: %s. Expect \"AxB\", \"50%%\" or \"2x\"", s)
+		}
+		value, valueErr := parseSizeValue(s)
+		if valueErr != nil {
+			return SizeSpec{}, valueErr
+		}
+		return SizeSpec{Width: value, Height: value}, nil
+	case 2:
+		first := strings.TrimSpace(split[0])
+		if strings.TrimSpace(split[1]) == "" && !strings.HasSuffix(first, "%") {
+			// check for a multiplier
+			if scale, parseErr := strconv.ParseFloat(first, 64); parseErr == nil &&
+				(strings.Contains(first, ".") || scale <= MaxSizeMultiplier) {
+				if scale <= 0 {
+					return SizeSpec{}, fmt.Errorf("Multiplier must be positive, got %s", first)
+				}
+				return SizeSpec{Scale: scale}, nil
+			}
+		}
+		width, widthErr := parseSizeValue(split[0])
+		if widthErr != nil {
+			return SizeSpec{}, widthErr
+		}
+		height, heightErr := parseSizeValue(split[1])
+		if heightErr != nil {
+			return SizeSpec{}, heightErr
+		}
+		return SizeSpec{Width: width, Height: height}, nil
+	default:
+		return SizeSpec{}, fmt.Errorf("Invalid size format: %s. Expect \"AxB\", \"50%%\" or \"2x\"", s)
+	}
+}
+
+// Apply returns the size given the dimensions of the original image, they
+// must be > 0.
+func (spec SizeSpec) Apply(originalWidth, originalHeight int) (int, int) {
+	if spec.Scale > 0 {
+		return int(math.Round(float64(originalWidth) * spec.Scale)),
+			int(math.Round(float64(originalHeight) * spec.Scale))
+	}
+	width, height := spec.Width.apply(originalWidth), spec.Height.apply(originalHeight)
+	switch {
+	case width < 0 && height < 0:
+		return originalWidth, originalHeight
+	case width < 0:
+		return KeepRatioWidth(originalWidth, originalHeight, height), height
+	case height < 0:
+		return width, KeepRatioHeight(originalWidth, originalHeight, width)
+	default:
+		return width, height
+	}
+}
+
+func (spec SizeSpec) String() string {
+	if spec.Scale > 0 {
+		return strconv.FormatFloat(spec.Scale, 'f', -1, 64) + "x"
+	}
+	if spec.Width.Unit == SizeAuto && spec.Height.Unit == SizeAuto {
+		return ""
+	}
+	return spec.Width.String() + "x" + spec.Height.String()
+}
@@ -0,0 +1,455 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// This file contains a sparse representation of histograms. Most photos
+// contain only a small part of all possible colors, thus for k ≥ 8 most
+// entries of a histogram are zero. A sparse histogram stores only the entries
+// that are not zero, this reduces the size of the histogram files and the
+// metrics only have to iterate the non-zero entries.
+
+// SparseHistogram is a histogram that stores only the entries that are not
+// zero, see Histogram for details. Indices is sorted in increasing order and
+// Values[i] is the value of the entry Indices[i].
+type SparseHistogram struct {
+	Indices []uint32
+	Values  []float64
+	K       uint
+}
+
+// NewSparseHistogram converts a histogram to its sparse representation.
+func NewSparseHistogram(h *Histogram) *SparseHistogram {
+	numNonZero := 0
+	for _, e := range h.Entries {
+		if e != 0.0 {
+			numNonZero++
+		}
+	}
+	res := &SparseHistogram{
+		Indices: make([]uint32, 0, numNonZero),
+		Values:  make([]float64, 0, numNonZero),
+		K:       h.K,
+	}
+	for i, e := range h.Entries {
+		if e != 0.0 {
+			res.Indices = append(res.Indices, uint32(i))
+			res.Values = append(res.Values, e)
+		}
+	}
+	return res
+}
+
+// Validate returns an error if the sparse histogram is malformed: Indices
+// and Values must have the same length and the indices must be increasing
+// and smaller than K³. Histograms read from files are validated (see
+// MigrateHistogramFSController), the methods of SparseHistogram assume that
+// the histogram is valid.
+func (s *SparseHistogram) Validate() error {
+	if len(s.Indices) != len(s.Values) {
+		return fmt.Errorf("Got %d indices but %d values in sparse histogram", len(s.Indices), len(s.Values))
+	}
+	size := uint64(s.K) * uint64(s.K) * uint64(s.K)
+	for i, index := range s.Indices {
+		if uint64(index) >= size {
+			return fmt.Errorf("Index %d out of range in sparse histogram with %d entries", index, size)
+		}
+		if i > 0 && index <= s.Indices[i-1] {
+			return errors.New("Indices of sparse histogram are not increasing")
+		}
+	}
+	return nil
+}
+
+// Histogram converts the sparse histogram to a dense histogram.
+func (s *SparseHistogram) Histogram() *Histogram {
+	res := NewHistogram(s.K)
+	for i, index := range s.Indices {
+		res.Entries[index] = s.Values[i]
+	}
+	return res
+}
+
+// SparseMetric is a function that compares two sparse histograms, it's the
+// sparse version of a HistogramMetric. Sparse metrics only iterate over the
+// non-zero entries.
+type SparseMetric func(hA, hB *SparseHistogram) float64
+
+// sparseMerge iterates over all indices that are non-zero in at least one of
+// the histograms, f is called with the values of both histograms for this
+// index.
+func sparseMerge(hA, hB *SparseHistogram, f func(a, b float64)) {
+	i, j := 0, 0
+	for i < len(hA.Indices) && j < len(hB.Indices) {
+		switch {
+		case hA.Indices[i] == hB.Indices[j]:
+			f(hA.Values[i], hB.Values[j])
+			i++
+			j++
+		case hA.Indices[i] < hB.Indices[j]:
+			f(hA.Values[i], 0.0)
+			i++
+		default:
+			f(0.0, hB.Values[j])
+			j++
+		}
+	}
+	for ; i < len(hA.Indices); i++ {
+		f(hA.Values[i], 0.0)
+	}
+	for ; j < len(hB.Indices); j++ {
+		f(0.0, hB.Values[j])
+	}
+}
+
+// SparseManhattan is the sparse version of Manhattan.
+func SparseManhattan(hA, hB *SparseHistogram) float64 {
+	var result float64
+	sparseMerge(hA, hB, func(a, b float64) {
+		result += math.Abs(a - b)
+	})
+	return result
+}
+
+// SparseEuclideanDistance is the sparse version of EuclideanDistance.
+func SparseEuclideanDistance(hA, hB *SparseHistogram) float64 {
+	var sum float64
+	sparseMerge(hA, hB, func(a, b float64) {
+		diff := a - b
+		sum += (diff * diff)
+	})
+	return math.Sqrt(sum)
+}
+
+// SparseMinDistance is the sparse version of MinDistance. Only entries that
+// are non-zero in both histograms contribute to the sum.
+func SparseMinDistance(hA, hB *SparseHistogram) float64 {
+	var sum float64
+	i, j := 0, 0
+	for i < len(hA.Indices) && j < len(hB.Indices) {
+		switch {
+		case hA.Indices[i] == hB.Indices[j]:
+			sum += math.Min(hA.Values[i], hB.Values[j])
+			i++
+			j++
+		case hA.Indices[i] < hB.Indices[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return 1.0 - sum
+}
+
+// SparseCosineSimilarity is the sparse version of CosineSimilarity.
+func SparseCosineSimilarity(hA, hB *SparseHistogram) float64 {
+	var dotProduct, lengthP, lengthQ float64
+	sparseMerge(hA, hB, func(a, b float64) {
+		dotProduct += (a * b)
+		lengthP += (a * a)
+		lengthQ += (b * b)
+	})
+	if lengthP == 0.0 || lengthQ == 0.0 {
+		return 2.1
+	}
+	return 1.0 - (dotProduct / (math.Sqrt(lengthP) * math.Sqrt(lengthQ)))
+}
+
+// SparseChessboardDistance is the sparse version of ChessboardDistance.
+func SparseChessboardDistance(hA, hB *SparseHistogram) float64 {
+	res := 0.0
+	sparseMerge(hA, hB, func(a, b float64) {
+		res = math.Max(res, math.Abs(a-b))
+	})
+	return res
+}
+
+// SparseCanberraDistance is the sparse version of CanberraDistance.
+func SparseCanberraDistance(hA, hB *SparseHistogram) float64 {
+	res := 0.0
+	sparseMerge(hA, hB, func(a, b float64) {
+		denominator := math.Abs(a) + math.Abs(b)
+		if denominator > 0.0 {
+			res += math.Abs(a-b) / denominator
+		}
+	})
+	return res
+}
+
+// The following variables are used for registering named sparse metrics,
+// the names are the same as for the histogram metrics.
+
+var (
+	sparseMetrics map[string]SparseMetric
+)
+
+// RegisterSparseMetric is used to register the sparse version of a named
+// histogram metric (see RegisterHistogramMetric). It will only add the metric
+// if the name does not exist yet. The result is true if the metric was
+// successfully registered and false otherwise.
+//
+// All metrics should be registered by an init method.
+func RegisterSparseMetric(name string, metric SparseMetric) bool {
+	name = strings.ToLower(name)
+	if _, has := sparseMetrics[name]; has {
+		return false
+	}
+	sparseMetrics[name] = metric
+	return true
+}
+
+// GetSparseMetric returns a registered sparse metric.
+// Returns the metric and true on success and nil and false
+// otherwise.
+func GetSparseMetric(name string) (SparseMetric, bool) {
+	name = strings.ToLower(name)
+	if metric, has := sparseMetrics[name]; has {
+		return metric, true
+	}
+	return nil, false
+}
+
+func init() {
+	sparseMetrics = make(map[string]SparseMetric)
+	RegisterSparseMetric("manhattan", SparseManhattan)
+	RegisterSparseMetric("euclid", SparseEuclideanDistance)
+	RegisterSparseMetric("min", SparseMinDistance)
+	RegisterSparseMetric("cosine", SparseCosineSimilarity)
+	RegisterSparseMetric("chessboard", SparseChessboardDistance)
+	RegisterSparseMetric("canberra", SparseCanberraDistance)
+}
+
+// SparseHistStorage implements HistogramStorage by keeping a list of sparse
+// histograms in memory.
+//
+// Note that GetHistogram has to convert the histogram and thus allocates
+// memory on each call. For selecting images use SparseHistogramImageMetric
+// (or SparseGCHSelector) which compare the sparse histograms directly.
+type SparseHistStorage struct {
+	Histograms []*SparseHistogram
+	K          uint
+}
+
+// NewSparseHistStorage converts the histograms to sparse histograms.
+func NewSparseHistStorage(histograms []*Histogram, k uint) *SparseHistStorage {
+	res := &SparseHistStorage{
+		Histograms: make([]*SparseHistogram, len(histograms)),
+		K:          k,
+	}
+	for i, h := range histograms {
+		res.Histograms[i] = NewSparseHistogram(h)
+	}
+	return res
+}
+
+// GetSparseHistogram returns the sparse histogram on position id.
+// If id is not a valid position inside the the list an error is returned.
+func (s *SparseHistStorage) GetSparseHistogram(id ImageID) (*SparseHistogram, error) {
+	if int(id) < 0 || int(id) >= len(s.Histograms) {
+		return nil, fmt.Errorf("Histogram for id %d not registered: %w", id, ErrImageNotFound)
+	}
+	return s.Histograms[id], nil
+}
+
+// GetHistogram implements the HistogramStorage interface function by
+// converting the histogram on position id.
+func (s *SparseHistStorage) GetHistogram(id ImageID) (*Histogram, error) {
+	h, err := s.GetSparseHistogram(id)
+	if err != nil {
+		return nil, err
+	}
+	return h.Histogram(), nil
+}
+
+// Retain keeps only the histograms for the given ids (in the given order),
+// see MemoryHistStorage.Retain.
+func (s *SparseHistStorage) Retain(ids []ImageID) {
+	histograms := make([]*SparseHistogram, len(ids))
+	for i, id := range ids {
+		histograms[i] = s.Histograms[id]
+	}
+	s.Histograms = histograms
+}
+
+// Divisions returns the number of sub-divisions k.
+func (s *SparseHistStorage) Divisions() uint {
+	return s.K
+}
+
+// Len returns the number of histograms in the storage.
+func (s *SparseHistStorage) Len() int {
+	return len(s.Histograms)
+}
+
+// Append converts the histograms to sparse histograms and adds them at the
+// end of the storage. nil histograms (of skipped images) stay nil.
+func (s *SparseHistStorage) Append(histograms ...*Histogram) {
+	for _, h := range histograms {
+		if h == nil {
+			s.Histograms = append(s.Histograms, nil)
+			continue
+		}
+		s.Histograms = append(s.Histograms, NewSparseHistogram(h))
+	}
+}
+
+// Copy returns a copy of the storage, the histograms are not copied (they're
+// never changed).
+func (s *SparseHistStorage) Copy() HistogramList {
+	return &SparseHistStorage{
+		Histograms: append([]*SparseHistogram(nil), s.Histograms...),
+		K:          s.K,
+	}
+}
+
+// NumEntries returns the number of non-zero entries of all histograms.
+func (s *SparseHistStorage) NumEntries() int {
+	res := 0
+	for _, h := range s.Histograms {
+		if h != nil {
+			res += len(h.Indices)
+		}
+	}
+	return res
+}
+
+// CreateSparseHistogramsWithPolicy works as CreateHistogramsWithPolicy but
+// returns sparse histograms. Each histogram is converted directly after it
+// was created, thus the dense version of all histograms is never held in
+// memory.
+func CreateSparseHistogramsWithPolicy(ids []ImageID, storage ImageStorage, normalize bool, k uint,
+	numRoutines int, progress ProgressFunc, policy ImageErrorPolicy) ([]*SparseHistogram, *ImageErrorReport, error) {
+	res := make([]*SparseHistogram, len(ids))
+	onImage := func(pos int, img image.Image) {
+		res[pos] = NewSparseHistogram(GenHistogram(img, k, normalize))
+	}
+	report, err := forEachImageWithPolicy(ids, storage, numRoutines, onImage, progress, policy)
+	if err != nil {
+		return nil, report, err
+	}
+	return res, report, nil
+}
+
+// SparseHistStorageFromFSMapper works as MemHistStorageFromFSMapper but
+// creates a sparse storage. Entries in the controller that are not sparse
+// are converted.
+func SparseHistStorageFromFSMapper(mapper *FSMapper, fileContent *HistogramFSController) (*SparseHistStorage, error) {
+	histMap := make(map[string]*SparseHistogram, len(fileContent.Entries))
+	for _, entry := range fileContent.Entries {
+		if entry.Sparse != nil {
+			histMap[entry.Path] = entry.Sparse
+		} else if histogram := entry.GetHistogram(); histogram != nil {
+			histMap[entry.Path] = NewSparseHistogram(histogram)
+		}
+	}
+	res := &SparseHistStorage{
+		Histograms: make([]*SparseHistogram, 0, mapper.Len()),
+		K:          fileContent.K,
+	}
+	for _, imagePath := range mapper.IDMapping {
+		histogram, has := histMap[imagePath]
+		if !has {
+			return nil, fmt.Errorf("No histogram for image \"%s\" found", imagePath)
+		}
+		if histogram.K != fileContent.K {
+			return nil, ErrHistogramMismatch{Path: imagePath, WantK: fileContent.K, GotK: histogram.K}
+		}
+		if validateErr := histogram.Validate(); validateErr != nil {
+			return nil,
+				fmt.Errorf("Invalid histogram for image \"%s\": %s", imagePath, validateErr.Error())
+		}
+		res.Histograms = append(res.Histograms, histogram)
+	}
+	return res, nil
+}
+
+// SparseHistogramImageMetric implements ImageMetric and BatchImageMetric for
+// sparse histograms, it's the sparse version of HistogramImageMetric.
+type SparseHistogramImageMetric struct {
+	HistStorage *SparseHistStorage
+	Metric      SparseMetric
+	TileData    [][]*SparseHistogram
+	NumRoutines int
+}
+
+// NewSparseHistogramImageMetric returns a new sparse histogram image metric.
+// NumRoutines is the number of things that run concurrently when initializing
+// the tile histograms.
+func NewSparseHistogramImageMetric(storage *SparseHistStorage, metric SparseMetric, numRoutines int) *SparseHistogramImageMetric {
+	return &SparseHistogramImageMetric{
+		HistStorage: storage,
+		Metric:      metric,
+		NumRoutines: numRoutines,
+	}
+}
+
+// InitStorage does at the moment nothing.
+func (m *SparseHistogramImageMetric) InitStorage(storage ImageStorage) error {
+	return nil
+}
+
+// InitTiles concurrently computes the sparse histograms of the tiles of the
+// query image.
+func (m *SparseHistogramImageMetric) InitTiles(storage ImageStorage, query image.Image, dist TileDivision) error {
+	init := func(tiles Tiles) error {
+		m.TileData = make([][]*SparseHistogram, len(tiles))
+		for i, col := range tiles {
+			m.TileData[i] = make([]*SparseHistogram, len(col))
+		}
+		return nil
+	}
+	onTile := func(i, j int, tileImage image.Image) error {
+		m.TileData[i][j] = NewSparseHistogram(GenHistogram(tileImage, m.HistStorage.K, true))
+		return nil
+	}
+	return InitTilesHelper(storage, query, dist, m.NumRoutines, init, onTile)
+}
+
+// Compare compares a database image and a query image based on the metric.
+func (m *SparseHistogramImageMetric) Compare(storage ImageStorage, image ImageID, tileY, tileX int) (float64, error) {
+	hDatabase, dbErr := m.HistStorage.GetSparseHistogram(image)
+	if dbErr != nil {
+		return -1.0, dbErr
+	}
+	return m.Metric(m.TileData[tileY][tileX], hDatabase), nil
+}
+
+// CompareAll compares the tile with all database images.
+func (m *SparseHistogramImageMetric) CompareAll(storage ImageStorage, tileY, tileX int) ([]float64, error) {
+	numImages := int(storage.NumImages())
+	res := make([]float64, numImages)
+	tile := m.TileData[tileY][tileX]
+	for id := 0; id < numImages; id++ {
+		if id >= len(m.HistStorage.Histograms) {
+			res[id] = math.Inf(1)
+			continue
+		}
+		res[id] = m.Metric(tile, m.HistStorage.Histograms[id])
+	}
+	return res, nil
+}
+
+// SparseGCHSelector is the sparse version of GCHSelector.
+func SparseGCHSelector(histStorage *SparseHistStorage, metric SparseMetric, numRoutines int) *ImageMetricMinimizer {
+	imageMetric := NewSparseHistogramImageMetric(histStorage, metric, numRoutines)
+	return NewImageMetricMinimizer(imageMetric, numRoutines)
+}
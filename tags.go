@@ -0,0 +1,207 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// This file contains tags of database images and filters on them: Tags are
+// read from a sidecar file (CSV or JSON) that maps image paths to a list of
+// tags. A filter restricts the images used for the selection (for example
+// only images tagged with "vacation") without changing the storage, thus the
+// GCHs and LCHs don't have to be re-computed.
+
+// ReadTagsCSV reads tags in CSV format: Each record contains the path of an
+// image followed by its tags, for example "cats/1.jpg,cat,vacation". Empty
+// tags are ignored, records with the same path are merged.
+func ReadTagsCSV(r io.Reader) (map[string][]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	res := make(map[string][]string)
+	for {
+		record, readErr := reader.Read()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+		if len(record) == 0 || record[0] == "" {
+			continue
+		}
+		for _, tag := range record[1:] {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				res[record[0]] = append(res[record[0]], tag)
+			}
+		}
+	}
+	return res, nil
+}
+
+// ReadTagsJSON reads tags in JSON format: An object that maps the path of
+// each image to a list of tags, for example {"cats/1.jpg": ["cat", "vacation"]}.
+func ReadTagsJSON(r io.Reader) (map[string][]string, error) {
+	var res map[string][]string
+	if jsonErr := json.NewDecoder(r).Decode(&res); jsonErr != nil {
+		return nil, jsonErr
+	}
+	return res, nil
+}
+
+// ReadTagsFile reads the tags from a .csv or .json file (see ReadTagsCSV and
+// ReadTagsJSON). Relative image paths are interpreted relative to the
+// directory of the file, the keys of the result are absolute paths.
+func ReadTagsFile(path string) (map[string][]string, error) {
+	var read func(r io.Reader) (map[string][]string, error)
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".csv":
+		read = ReadTagsCSV
+	case ".json":
+		read = ReadTagsJSON
+	default:
+		return nil, fmt.Errorf("Supported tag files are .csv and .json, got file %s", path)
+	}
+	f, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer f.Close()
+	tags, readErr := read(f)
+	if readErr != nil {
+		return nil, fmt.Errorf("Invalid tag file %s: %s", path, readErr.Error())
+	}
+	dir := filepath.Dir(path)
+	res := make(map[string][]string, len(tags))
+	for image, imageTags := range tags {
+		if !filepath.IsAbs(image) {
+			image = filepath.Join(dir, image)
+		}
+		image = filepath.Clean(image)
+		res[image] = append(res[image], imageTags...)
+	}
+	return res, nil
+}
+
+// FilterCondition is a condition on the images of a mapper: Key is either
+// "tag" (the tags of the image, see FSMapper.Tags) or "label" (the label of
+// the root of the image, see FSMapper.RootLabel). The condition is true if
+// the image has one of the Values, if Negate is true it's true if the image
+// has none of the Values.
+type FilterCondition struct {
+	Key    string
+	Values []string
+	Negate bool
+}
+
+// ParseFilterCondition parses a condition of the form "key=value1,value2" or
+// "key!=value1,value2", see FilterCondition.
+func ParseFilterCondition(s string) (FilterCondition, error) {
+	var res FilterCondition
+	pos := strings.Index(s, "=")
+	if pos <= 0 {
+		return res, fmt.Errorf("Invalid filter condition \"%s\": Must be of the form key=values or key!=values", s)
+	}
+	res.Key = s[:pos]
+	if strings.HasSuffix(res.Key, "!") {
+		res.Key, res.Negate = strings.TrimSuffix(res.Key, "!"), true
+	}
+	if res.Key != "tag" && res.Key != "label" {
+		return res, fmt.Errorf("Unkown filter key \"%s\", must be tag or label", res.Key)
+	}
+	for _, value := range strings.Split(s[pos+1:], ",") {
+		if value != "" {
+			res.Values = append(res.Values, value)
+		}
+	}
+	if len(res.Values) == 0 {
+		return res, fmt.Errorf("Invalid filter condition \"%s\": No values given", s)
+	}
+	return res, nil
+}
+
+// String returns the condition in the format of ParseFilterCondition.
+func (c FilterCondition) String() string {
+	op := "="
+	if c.Negate {
+		op = "!="
+	}
+	return c.Key + op + strings.Join(c.Values, ",")
+}
+
+// Match returns true if the image with the given path fulfills the
+// condition.
+func (c FilterCondition) Match(mapper *FSMapper, path string) bool {
+	var has func(value string) bool
+	switch c.Key {
+	case "tag":
+		has = func(value string) bool { return mapper.HasTag(path, value) }
+	default:
+		label, hasLabel := mapper.RootLabel(path)
+		has = func(value string) bool { return hasLabel && label == value }
+	}
+	for _, value := range c.Values {
+		if has(value) {
+			return !c.Negate
+		}
+	}
+	return c.Negate
+}
+
+// ImageFilter is a list of conditions, an image matches the filter if it
+// fulfills all conditions.
+type ImageFilter []FilterCondition
+
+// ParseImageFilter parses a filter, each element of conditions is parsed
+// with ParseFilterCondition.
+func ParseImageFilter(conditions ...string) (ImageFilter, error) {
+	res := make(ImageFilter, len(conditions))
+	for i, s := range conditions {
+		var condErr error
+		res[i], condErr = ParseFilterCondition(s)
+		if condErr != nil {
+			return nil, condErr
+		}
+	}
+	return res, nil
+}
+
+// String returns the conditions separated by spaces.
+func (f ImageFilter) String() string {
+	res := make([]string, len(f))
+	for i, c := range f {
+		res[i] = c.String()
+	}
+	return strings.Join(res, " ")
+}
+
+// Match returns true if the image with the given path fulfills all
+// conditions.
+func (f ImageFilter) Match(mapper *FSMapper, path string) bool {
+	for _, c := range f {
+		if !c.Match(mapper, path) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import "strings"
+
+// This file contains the history of the REPL state: Before a command that
+// changes the state (set, storage load, gch create, ...) is executed a copy
+// of the state is stored, "undo" restores the copy. This way an accidental
+// "storage load" that dropped all histograms can be reverted without
+// repeating the whole setup.
+
+// HistorySize is the number of state changes that can be undone.
+const HistorySize = 20
+
+// historyEntry is a state before (undo) or after (redo) a command.
+type historyEntry struct {
+	command string
+	state   *ExecutorState
+}
+
+// stateHistory contains the states for undo and redo, the last entry is the
+// most recent one.
+type stateHistory struct {
+	undo, redo []historyEntry
+}
+
+// push adds an entry to the undo history and clears the redo history, only the
+// last HistorySize entries are kept.
+func (h *stateHistory) push(entry historyEntry) {
+	h.undo = append(h.undo, entry)
+	if len(h.undo) > HistorySize {
+		h.undo = append([]historyEntry(nil), h.undo[len(h.undo)-HistorySize:]...)
+	}
+	h.redo = nil
+}
+
+// changesState returns true if the command (with its arguments) changes the
+// state s.t. it can be undone. Commands that only read the state (like
+// "storage list") or create files (like "mosaic") are not recorded.
+func changesState(cmd []string) bool {
+	if len(cmd) == 0 {
+		return false
+	}
+	args := cmd[1:]
+	switch cmd[0] {
+	case "set", "alias":
+		return len(args) == 2
+	case "cd":
+		return len(args) > 0
+	case "storage":
+		return len(args) > 0 && args[0] != "list"
+	case "gch":
+		return len(args) > 0 && (args[0] == "create" || args[0] == "load" || args[0] == "update")
+	case "lch", "feature", "gray":
+		return len(args) > 0 && (args[0] == "create" || args[0] == "load")
+	case "bundle", "session":
+		return len(args) > 0 && args[0] == "load"
+	default:
+		return false
+	}
+}
+
+// snapshot returns a copy of the state that is not affected by changes of
+// the state: The mapper and the precomputed data are copied. The caches and
+// the history are not part of the copy.
+func (state *ExecutorState) snapshot() *ExecutorState {
+	res := *state
+	res.Mapper = state.Mapper.Copy()
+	res.ImgStorage = NewFSImageDB(res.Mapper)
+	res.ImgStorage.EXIF = state.ImgStorage.EXIF
+	if state.GCHStorage != nil {
+		res.GCHStorage = state.GCHStorage.Copy()
+	}
+	if state.LCHStorage != nil {
+		lchs := *state.LCHStorage
+		lchs.LCHs = append([]*LCH(nil), lchs.LCHs...)
+		res.LCHStorage = &lchs
+	}
+	if state.Features != nil {
+		features := *state.Features
+		features.Features = append([][]float64(nil), features.Features...)
+		res.Features = &features
+	}
+	res.RequiredImages = append([]string(nil), state.RequiredImages...)
+	res.Filter = append(ImageFilter(nil), state.Filter...)
+	res.Aliases = make(map[string]string, len(state.Aliases))
+	for name, body := range state.Aliases {
+		res.Aliases[name] = body
+	}
+	res.annIndex, res.metricCache, res.history = nil, nil, nil
+	return &res
+}
+
+// restore replaces the state by the snapshot. The input and output, the
+// history and the last mosaic are kept, the caches are cleared.
+func (state *ExecutorState) restore(snapshot *ExecutorState) {
+	in, out, history := state.In, state.Out, state.history
+	lastPlan, lastMosaic, aliasDepth := state.LastPlan, state.LastMosaic, state.aliasDepth
+	*state = *snapshot
+	state.In, state.Out, state.history = in, out, history
+	state.LastPlan, state.LastMosaic, state.aliasDepth = lastPlan, lastMosaic, aliasDepth
+	state.invalidateCaches()
+}
+
+// recordCommand executes the command with exec and stores the state before
+// the command in the history if the command changes the state (see
+// changesState) and was successful.
+func (state *ExecutorState) recordCommand(cmd []string, exec func() error) error {
+	if !changesState(cmd) {
+		return exec()
+	}
+	before := state.snapshot()
+	if execErr := exec(); execErr != nil {
+		return execErr
+	}
+	if state.history == nil {
+		state.history = &stateHistory{}
+	}
+	state.history.push(historyEntry{command: strings.Join(cmd, " "), state: before})
+	return nil
+}
+
+// undo restores the state before the last recorded command, it returns the
+// command and false if there is nothing to undo.
+func (state *ExecutorState) undo() (string, bool) {
+	if state.history == nil || len(state.history.undo) == 0 {
+		return "", false
+	}
+	h := state.history
+	entry := h.undo[len(h.undo)-1]
+	h.undo = h.undo[:len(h.undo)-1]
+	h.redo = append(h.redo, historyEntry{command: entry.command, state: state.snapshot()})
+	state.restore(entry.state)
+	return entry.command, true
+}
+
+// redo executes the last undone command again by restoring the state after
+// the command, it returns the command and false if there is nothing to redo.
+func (state *ExecutorState) redo() (string, bool) {
+	if state.history == nil || len(state.history.redo) == 0 {
+		return "", false
+	}
+	h := state.history
+	entry := h.redo[len(h.redo)-1]
+	h.redo = h.redo[:len(h.redo)-1]
+	h.undo = append(h.undo, historyEntry{command: entry.command, state: state.snapshot()})
+	state.restore(entry.state)
+	return entry.command, true
+}
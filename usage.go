@@ -0,0 +1,294 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+)
+
+// This file contains constraints on how often database images are used in a
+// mosaic: Each image at most MaxUsage times and some images at least once.
+// The constraints are applied after the selection: Tiles are moved to other
+// images from their heaps (the best fitting images of each tile), such that
+// the metric values increase as little as possible.
+
+// UsageConstraints restricts how often database images are used in a mosaic.
+//
+// MaxUsage is the maximal number of tiles an image is used for, ≤ 0 means no
+// limit. Required contains the ids of the images that must be used for at
+// least one tile, mapped to a name that is used in error messages (usually the
+// path).
+//
+// If the ids are ids of an OrientedStorage NumOrientations must be the number
+// of orientations, all orientations of an image count as the same image (the
+// ids in Required are the ids of the original images).
+type UsageConstraints struct {
+	MaxUsage        int
+	Required        map[ImageID]string
+	NumOrientations int
+}
+
+// Empty returns true if the constraints don't restrict the selection.
+func (c UsageConstraints) Empty() bool {
+	return c.MaxUsage <= 0 && len(c.Required) == 0
+}
+
+// baseID returns the id of the original image (without orientation).
+func (c UsageConstraints) baseID(id ImageID) ImageID {
+	if c.NumOrientations > 1 {
+		return id / ImageID(c.NumOrientations)
+	}
+	return id
+}
+
+// usageState is the state of ApplyUsageConstraints.
+type usageState struct {
+	UsageConstraints
+	selection [][]ImageID
+	views     [][][]ImageHeapEntry
+	usages    map[ImageID]int
+}
+
+// value returns the value of the image in the view of the tile, +Inf if the
+// image is not in the view.
+func (s *usageState) value(i, j int, id ImageID) float64 {
+	for _, entry := range s.views[i][j] {
+		if entry.Image == id {
+			return entry.Value
+		}
+	}
+	return math.Inf(1)
+}
+
+// set assigns image id to the tile and updates the usages.
+func (s *usageState) set(i, j int, id ImageID) {
+	s.usages[s.baseID(s.selection[i][j])]--
+	s.selection[i][j] = id
+	s.usages[s.baseID(id)]++
+}
+
+// alternative returns the best entry of the view of a tile that can replace
+// the current image of the tile without violating MaxUsage, false if there
+// is no such entry.
+func (s *usageState) alternative(i, j int) (ImageHeapEntry, bool) {
+	current := s.baseID(s.selection[i][j])
+	for _, entry := range s.views[i][j] {
+		base := s.baseID(entry.Image)
+		if base != current && s.usages[base] < s.MaxUsage {
+			// the view is sorted, thus this is the best entry
+			return entry, true
+		}
+	}
+	return ImageHeapEntry{}, false
+}
+
+// requireImage uses the image (original id) for the tile for which this
+// increases the metric value the least. Tiles are only taken from images that
+// are used more than once or that are not required.
+func (s *usageState) requireImage(image ImageID, name string) error {
+	bestI, bestJ, bestID, bestDelta := -1, -1, NoImageID, math.Inf(1)
+	for i, col := range s.selection {
+		for j, current := range col {
+			if current == NoImageID {
+				continue
+			}
+			if _, isRequired := s.Required[s.baseID(current)]; isRequired && s.usages[s.baseID(current)] <= 1 {
+				continue
+			}
+			currentValue := s.value(i, j, current)
+			for _, entry := range s.views[i][j] {
+				if s.baseID(entry.Image) != image {
+					continue
+				}
+				// +Inf - +Inf is NaN, these tiles are used only if there's no other tile
+				delta := entry.Value - currentValue
+				if math.IsNaN(delta) {
+					delta = math.MaxFloat64
+				}
+				if bestI < 0 || delta < bestDelta {
+					bestI, bestJ, bestID, bestDelta = i, j, entry.Image, delta
+				}
+				// the first entry of the view is the best orientation
+				break
+			}
+		}
+	}
+	if bestI < 0 {
+		return fmt.Errorf("Can't use required image %s: It's not among the best fitting images of any free tile, increase best-fit", name)
+	}
+	s.set(bestI, bestJ, bestID)
+	return nil
+}
+
+// limitImage moves tiles from the image (original id) to other images until
+// the image is used at most MaxUsage times. The tiles for which the metric
+// value increases the least are moved.
+func (s *usageState) limitImage(image ImageID) error {
+	type move struct {
+		i, j  int
+		delta float64
+	}
+	var moves []move
+	for i, col := range s.selection {
+		for j, current := range col {
+			if current == NoImageID || s.baseID(current) != image {
+				continue
+			}
+			delta := math.Inf(1)
+			if entry, ok := s.alternative(i, j); ok {
+				delta = entry.Value - s.value(i, j, current)
+			}
+			moves = append(moves, move{i, j, delta})
+		}
+	}
+	sort.SliceStable(moves, func(a, b int) bool {
+		return moves[a].delta < moves[b].delta
+	})
+	for _, m := range moves {
+		if s.usages[image] <= s.MaxUsage {
+			return nil
+		}
+		// other tiles may have been moved in the meantime, thus compute the
+		// alternative again
+		if entry, ok := s.alternative(m.i, m.j); ok {
+			s.set(m.i, m.j, entry.Image)
+		}
+	}
+	if s.usages[image] > s.MaxUsage {
+		return fmt.Errorf("Can't use each image at most %d times: There are not enough alternatives in the best fitting images, increase best-fit or max-usage",
+			s.MaxUsage)
+	}
+	return nil
+}
+
+// ApplyUsageConstraints changes the selection such that the constraints are
+// satisfied. views contains the best fitting images of each tile (sorted, see
+// GenHeapViews), images are only replaced by images from the view of the tile.
+// First each required image that is not used yet replaces the image of the
+// tile where this increases the metric value the least, then tiles of images
+// used more than MaxUsage times are moved to the next best image that is not
+// used MaxUsage times yet. Tiles without an image (NoImageID) are not changed.
+//
+// This is a greedy approach, thus the result is not necessarily optimal. An
+// error is returned if the constraints can't be satisfied, the selection may
+// be changed anyway.
+func ApplyUsageConstraints(selection [][]ImageID, views [][][]ImageHeapEntry, constraints UsageConstraints) error {
+	if constraints.Empty() {
+		return nil
+	}
+	s := usageState{
+		UsageConstraints: constraints,
+		selection:        selection,
+		views:            views,
+		usages:           make(map[ImageID]int),
+	}
+	numTiles := 0
+	available := make(map[ImageID]bool)
+	for i, col := range selection {
+		for j, id := range col {
+			if id == NoImageID {
+				continue
+			}
+			numTiles++
+			s.usages[s.baseID(id)]++
+			for _, entry := range views[i][j] {
+				available[s.baseID(entry.Image)] = true
+			}
+		}
+	}
+	// feasibility checks
+	if len(constraints.Required) > numTiles {
+		return fmt.Errorf("Can't use %d required images in a mosaic with %d tiles", len(constraints.Required), numTiles)
+	}
+	if constraints.MaxUsage > 0 && numTiles > constraints.MaxUsage*len(available) {
+		return fmt.Errorf("Can't use each image at most %d times: %d tiles but only %d images among the best fitting images, increase best-fit or max-usage",
+			constraints.MaxUsage, numTiles, len(available))
+	}
+	// sort ids for a deterministic result
+	required := make([]int, 0, len(constraints.Required))
+	for id := range constraints.Required {
+		required = append(required, int(id))
+	}
+	sort.Ints(required)
+	for _, id := range required {
+		if s.usages[ImageID(id)] > 0 {
+			continue
+		}
+		if requireErr := s.requireImage(ImageID(id), constraints.Required[ImageID(id)]); requireErr != nil {
+			return requireErr
+		}
+	}
+	if constraints.MaxUsage <= 0 {
+		return nil
+	}
+	overused := make([]int, 0)
+	for id, usage := range s.usages {
+		if usage > constraints.MaxUsage {
+			overused = append(overused, int(id))
+		}
+	}
+	sort.Ints(overused)
+	for _, id := range overused {
+		if limitErr := s.limitImage(ImageID(id)); limitErr != nil {
+			return limitErr
+		}
+	}
+	return nil
+}
+
+// ConstrainedHeapSelector implements HeapSelector: It selects the images with
+// Selector and then applies the Constraints (see ApplyUsageConstraints). If
+// Selector is nil the best image of each heap is selected.
+type ConstrainedHeapSelector struct {
+	Selector    HeapSelector
+	Constraints UsageConstraints
+}
+
+// NewConstrainedHeapSelector returns a new constrained selector, selector can
+// be nil.
+func NewConstrainedHeapSelector(selector HeapSelector, constraints UsageConstraints) *ConstrainedHeapSelector {
+	return &ConstrainedHeapSelector{Selector: selector, Constraints: constraints}
+}
+
+// Select implements the HeapSelector interface.
+func (sel *ConstrainedHeapSelector) Select(storage ImageStorage, query image.Image, dist TileDivision, heaps [][]*ImageHeap) ([][]ImageID, error) {
+	views := GenHeapViews(heaps)
+	var res [][]ImageID
+	if sel.Selector == nil {
+		res = make([][]ImageID, len(views))
+		for i, col := range views {
+			res[i] = make([]ImageID, len(col))
+			for j, view := range col {
+				res[i][j] = NoImageID
+				if len(view) > 0 {
+					res[i][j] = view[0].Image
+				}
+			}
+		}
+	} else {
+		var selectErr error
+		res, selectErr = sel.Selector.Select(storage, query, dist, heaps)
+		if selectErr != nil {
+			return nil, selectErr
+		}
+	}
+	if constraintErr := ApplyUsageConstraints(res, views, sel.Constraints); constraintErr != nil {
+		return nil, constraintErr
+	}
+	return res, nil
+}
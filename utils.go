@@ -16,6 +16,7 @@ package gomosaic
 
 import (
 	"fmt"
+	"image/color"
 	"io"
 	"strconv"
 	"strings"
@@ -177,6 +178,10 @@ func KeepRatioWidth(originalWidth, originalHeight, height int) int {
 	return int(ratio * float64(height))
 }
 
+// ParsePercent parses a percent value, either given with a percent sign (for
+// example "50%" or "12.5 %") or as a fraction (for example "0.5"). The result
+// is always the fraction, i.e. "50%" and "0.5" both return 0.5. The range of
+// the value is not checked.
 func ParsePercent(s string) (float64, error) {
 	s = strings.TrimSpace(s)
 	suffix := `%`
@@ -196,15 +201,27 @@ func ParsePercent(s string) (float64, error) {
 	return asFloat, nil
 }
 
-// IntAbs returns the absolute value of a, that is |a| as an int.
-func IntAbs(a int) int {
-	if a < 0 {
-		return -a
+// ParseHexColor parses a color given in hex notation, for example "#ff0000"
+// for red. The leading # is optional, the short form "#f00" is also
+// supported. The alpha value of the result is always 255.
+func ParseHexColor(s string) (color.RGBA, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
 	}
-	return a
+	if len(s) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid color, expected format #rrggbb, got %s", s)
+	}
+	val, parseErr := strconv.ParseUint(s, 16, 32)
+	if parseErr != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color, expected format #rrggbb: %s", parseErr.Error())
+	}
+	return color.RGBA{R: uint8(val >> 16), G: uint8(val >> 8), B: uint8(val), A: 255}, nil
 }
 
-const MaxUint = ^uint(0)
-const MinUint = 0
-const MaxInt = int(MaxUint >> 1)
-const MinInt = -MaxInt - 1
+// HexColorString returns the hex representation of a color in the format
+// "#rrggbb", the alpha value is ignored.
+func HexColorString(c color.Color) string {
+	rgba := color.RGBAModel.Convert(c).(color.RGBA)
+	return fmt.Sprintf("#%02x%02x%02x", rgba.R, rgba.G, rgba.B)
+}
@@ -16,10 +16,9 @@ package gomosaic
 
 import (
 	"image"
+	"math"
 	"math/rand"
 	"time"
-
-	log "github.com/sirupsen/logrus"
 )
 
 func computeSingleHeap(storage ImageStorage, metric ImageMetric, i, j int, target *ImageHeap) error {
@@ -28,12 +27,12 @@ func computeSingleHeap(storage ImageStorage, metric ImageMetric, i, j int, targe
 	for ; imageID < numImages; imageID++ {
 		dist, distErr := metric.Compare(storage, imageID, i, j)
 		if distErr != nil {
-			log.WithFields(log.Fields{
-				log.ErrorKey: distErr,
-				"image":      imageID,
-				"tileY":      i,
-				"tileX":      j,
-			}).Error("Can't compute metric value, ignoring it")
+			SelectionLogger.Error("Can't compute metric value, ignoring it", LogFields{
+				"error": distErr,
+				"image": imageID,
+				"tileY": i,
+				"tileX": j,
+			})
 			continue
 		}
 		target.Add(imageID, dist)
@@ -187,6 +186,16 @@ func (sel *HeapImageSelector) SelectImages(storage ImageStorage,
 	return sel.Selector.Select(storage, query, dist, heaps)
 }
 
+// NewSeededRand returns a new random generator. If seed is negative the
+// generator is seeded with the current time, otherwise seed is used. Thus
+// a seed >= 0 yields the same sequence of numbers each time.
+func NewSeededRand(seed int64) *rand.Rand {
+	if seed < 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
 // RandomHeapSelector implements HeapSelector by using just a random element
 // from each heap.
 //
@@ -197,15 +206,16 @@ type RandomHeapSelector struct {
 
 // NewRandomHeapSelector returns a new random selector.
 // The provided random generator is used to generate random numbers. You can
-// use nil and a random generator will be created.
+// use nil and a random generator (seeded with the current time) will be
+// created. To get reproducible results use a generator with a fixed seed,
+// see NewSeededRand.
 //
 // Note that rand.Rand instances are not safe for concurrent use.
 // Thus using the same generator on two instances that run concurrently is
 // not allowed.
 func NewRandomHeapSelector(randGen *rand.Rand) *RandomHeapSelector {
 	if randGen == nil {
-		seed := time.Now().UnixNano()
-		randGen = rand.New(rand.NewSource(seed))
+		randGen = NewSeededRand(-1)
 	}
 	return &RandomHeapSelector{randGen}
 }
@@ -225,7 +235,7 @@ func (sel *RandomHeapSelector) Select(storage ImageStorage, query image.Image, d
 			// select a random one
 			n := len(view)
 			if n == 0 {
-				res[i][j] = NoImageID
+				colDist[j] = NoImageID
 			} else {
 				// there are elements
 				index := sel.randGen.Intn(n)
@@ -239,7 +249,67 @@ func (sel *RandomHeapSelector) Select(storage ImageStorage, query image.Image, d
 
 // RandomHeapImageSelector returns a HeapImageSelector using a random selection.
 // Thus it can be used as an ImageSelector.
-func RandomHeapImageSelector(metric ImageMetric, k, numRoutines int) *HeapImageSelector {
-	heapSel := NewRandomHeapSelector(nil)
+// randGen is passed to NewRandomHeapSelector, it can be nil.
+func RandomHeapImageSelector(metric ImageMetric, k, numRoutines int, randGen *rand.Rand) *HeapImageSelector {
+	heapSel := NewRandomHeapSelector(randGen)
+	return NewHeapImageSelector(metric, heapSel, k, numRoutines)
+}
+
+// UsagePenaltySelector implements HeapSelector by adding a penalty to the
+// metric value of an image each time it gets selected. For each tile the
+// image from the heap with the smallest value metric + Weight * usages is
+// selected, where usages is the number of tiles the image was selected for
+// so far.
+//
+// Weight is a dial between "best match" and "maximum variety": With a weight
+// of 0 the best image is always selected, the bigger the weight the more
+// often other images from the heaps are used. Note that the value must be
+// chosen relative to the values of the metric.
+//
+// Tiles are processed row by row.
+type UsagePenaltySelector struct {
+	Weight float64
+}
+
+// NewUsagePenaltySelector returns a new usage penalty selector.
+func NewUsagePenaltySelector(weight float64) *UsagePenaltySelector {
+	return &UsagePenaltySelector{Weight: weight}
+}
+
+// Select implements the HeapSelector interface.
+func (sel *UsagePenaltySelector) Select(storage ImageStorage, query image.Image, dist TileDivision, heaps [][]*ImageHeap) ([][]ImageID, error) {
+	res := make([][]ImageID, len(dist))
+	usages := make(map[ImageID]int)
+
+	views := GenHeapViews(heaps)
+
+	for i, col := range dist {
+		size := len(col)
+		colDist := make([]ImageID, size)
+
+		for j := 0; j < size; j++ {
+			bestImage := NoImageID
+			bestValue := math.MaxFloat64
+			for _, entry := range views[i][j] {
+				value := entry.Value + sel.Weight*float64(usages[entry.Image])
+				if value < bestValue {
+					bestImage = entry.Image
+					bestValue = value
+				}
+			}
+			colDist[j] = bestImage
+			if bestImage != NoImageID {
+				usages[bestImage]++
+			}
+		}
+		res[i] = colDist
+	}
+	return res, nil
+}
+
+// UsagePenaltyImageSelector returns a HeapImageSelector using a
+// UsagePenaltySelector. Thus it can be used as an ImageSelector.
+func UsagePenaltyImageSelector(metric ImageMetric, weight float64, k, numRoutines int) *HeapImageSelector {
+	heapSel := NewUsagePenaltySelector(weight)
 	return NewHeapImageSelector(metric, heapSel, k, numRoutines)
 }
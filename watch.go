@@ -0,0 +1,138 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// This file contains functions to keep a storage in sync with a directory.
+// The directory is polled in a fixed interval instead of using file system
+// notifications (like fsnotify), this works on all platforms and doesn't
+// require any additional dependencies.
+
+// DefaultWatchInterval is the default interval in which a watched directory
+// is scanned for changes.
+const DefaultWatchInterval = 2 * time.Second
+
+// inDir returns true if path is inside the directory dir.
+func inDir(dir, path string) bool {
+	rel, relErr := filepath.Rel(dir, path)
+	if relErr != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// DirChanges compares the images in dir with the images registered in the
+// mapper: added contains all images in dir (accepted by options) that are not
+// registered, removed contains all registered images inside dir that don't
+// exist any more (or are not accepted by options any more).
+// The mapper is not changed.
+func DirChanges(mapper *FSMapper, dir string, options LoadOptions) (added, removed []string, err error) {
+	abs, absErr := filepath.Abs(dir)
+	if absErr != nil {
+		return nil, nil, absErr
+	}
+	scanned, scanErr := CreateFSMapperWithOptions(abs, options)
+	if scanErr != nil {
+		return nil, nil, scanErr
+	}
+	added = make([]string, 0)
+	for _, path := range scanned.IDMapping {
+		if _, has := mapper.GetID(path); !has {
+			added = append(added, path)
+		}
+	}
+	removed = make([]string, 0)
+	for _, path := range mapper.IDMapping {
+		if !inDir(abs, path) {
+			continue
+		}
+		if !options.Recursive && filepath.Dir(path) != abs {
+			continue
+		}
+		if _, has := scanned.GetID(path); !has {
+			removed = append(removed, path)
+		}
+	}
+	return
+}
+
+// syncStorage applies the changes in dir (see DirChanges) to the storage of
+// the state, the GCHs and LCHs are updated accordingly. New images that
+// can't be read are skipped (not registered), thus they're tried again
+// on the next call. This way files that are still being written are added
+// once they're complete.
+func syncStorage(state *ExecutorState, dir string, options LoadOptions) error {
+	added, removed, changesErr := DirChanges(state.Mapper, dir, options)
+	if changesErr != nil {
+		return changesErr
+	}
+	if len(removed) > 0 {
+		gone := make(map[string]bool, len(removed))
+		for _, path := range removed {
+			fmt.Fprintf(state.Out, "  - %s\n", path)
+			gone[path] = true
+		}
+		retainImages(state, func(path string) bool {
+			return !gone[path]
+		})
+	}
+	numBefore := state.Mapper.NumImages()
+	if len(added) > 0 {
+		for _, path := range added {
+			fmt.Fprintf(state.Out, "  + %s\n", path)
+			state.Mapper.Register(path)
+		}
+		if updateErr := updatePrecomputed(state, numBefore, ImageErrorsSkip); updateErr != nil {
+			return updateErr
+		}
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		numAdded := int(state.Mapper.NumImages() - numBefore)
+		fmt.Fprintln(state.Out, "Added", numAdded, "and removed", len(removed),
+			"images, total:", state.Mapper.Len())
+	}
+	return nil
+}
+
+// watchStorage syncs the storage with dir every interval until the process
+// receives an interrupt signal (Ctrl+C). Errors during a sync are printed,
+// they don't stop watching.
+func watchStorage(state *ExecutorState, dir string, options LoadOptions, interval time.Duration) error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	fmt.Fprintln(state.Out, "Watching", dir, "for changes, press Ctrl+C to stop")
+	for {
+		if syncErr := syncStorage(state, dir, options); syncErr != nil {
+			fmt.Fprintln(state.Out, "Error while syncing:", syncErr.Error())
+		}
+		select {
+		case <-interrupt:
+			fmt.Fprintln(state.Out, "Stopped watching", dir)
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
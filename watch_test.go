@@ -0,0 +1,87 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeUniformPNG(t *testing.T, path string, c color.Color) {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncStorageSkipsUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	writeUniformPNG(t, filepath.Join(dir, "a.png"), color.NRGBA{255, 0, 0, 255})
+	state := ReplHandler{}.Init()
+	state.WorkingDir, state.Out, state.Verbose, state.NumRoutines = dir, ioutil.Discard, false, 1
+	if err := ImageStorageCommand(state, "load", dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := GCHCommand(state, "create", "4"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file that is not completely written yet
+	bad := filepath.Join(dir, "b.png")
+	if err := ioutil.WriteFile(bad, []byte("not a png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeUniformPNG(t, filepath.Join(dir, "c.png"), color.NRGBA{0, 0, 255, 255})
+	if err := syncStorage(state, dir, LoadOptions{}); err != nil {
+		t.Fatalf("Unreadable images should be skipped, got error: %s", err.Error())
+	}
+	if state.GCHStorage == nil {
+		t.Fatal("GCHs should still be loaded")
+	}
+	if state.Mapper.Len() != 2 || state.GCHStorage.Len() != 2 {
+		t.Fatalf("Expected 2 images and GCHs, got %d and %d", state.Mapper.Len(), state.GCHStorage.Len())
+	}
+	if _, has := state.Mapper.GetID(bad); has {
+		t.Error("Unreadable image should not be registered")
+	}
+
+	// once the file is complete it's added on the next scan
+	writeUniformPNG(t, bad, color.NRGBA{0, 255, 0, 255})
+	if err := syncStorage(state, dir, LoadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, has := state.Mapper.GetID(bad); !has {
+		t.Error("Image should be registered once it can be read")
+	}
+	if state.Mapper.Len() != 3 || state.GCHStorage.Len() != 3 {
+		t.Errorf("Expected 3 images and GCHs, got %d and %d", state.Mapper.Len(), state.GCHStorage.Len())
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 Fabian Wenzelmann
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomosaic
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// This file contains weights of database images: The metric value of an
+// image is multiplied by its weight during the selection, thus images with a
+// weight < 1 are selected more often (for example favorite photos) and images
+// with a weight > 1 less often (for example images of low quality).
+
+// ValidateWeight returns an error if weight is not a positive finite number.
+func ValidateWeight(weight float64) error {
+	if weight <= 0.0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+		return fmt.Errorf("Image weights must be positive numbers, got %v", weight)
+	}
+	return nil
+}
+
+// ReadWeightsCSV reads image weights in CSV format: Each record contains the
+// path of an image and its weight, for example "cats/1.jpg,0.5".
+func ReadWeightsCSV(r io.Reader) (map[string]float64, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	res := make(map[string]float64)
+	for {
+		record, readErr := reader.Read()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+		if len(record) == 0 || record[0] == "" {
+			continue
+		}
+		if len(record) != 2 {
+			return nil, fmt.Errorf("Expected path and weight, got %d fields for %s", len(record), record[0])
+		}
+		weight, parseErr := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if parseErr != nil {
+			return nil, fmt.Errorf("Invalid weight for %s: %s", record[0], record[1])
+		}
+		res[record[0]] = weight
+	}
+	return res, nil
+}
+
+// ReadWeightsJSON reads image weights in JSON format: An object that maps the
+// path of each image to its weight, for example {"cats/1.jpg": 0.5}.
+func ReadWeightsJSON(r io.Reader) (map[string]float64, error) {
+	var res map[string]float64
+	if jsonErr := json.NewDecoder(r).Decode(&res); jsonErr != nil {
+		return nil, jsonErr
+	}
+	return res, nil
+}
+
+// ReadWeightsFile reads the weights from a .csv or .json file (see
+// ReadWeightsCSV and ReadWeightsJSON). Relative image paths are interpreted
+// relative to the directory of the file, the keys of the result are absolute
+// paths. All weights are validated with ValidateWeight.
+func ReadWeightsFile(path string) (map[string]float64, error) {
+	var read func(r io.Reader) (map[string]float64, error)
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".csv":
+		read = ReadWeightsCSV
+	case ".json":
+		read = ReadWeightsJSON
+	default:
+		return nil, fmt.Errorf("Supported weight files are .csv and .json, got file %s", path)
+	}
+	f, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer f.Close()
+	weights, readErr := read(f)
+	if readErr != nil {
+		return nil, fmt.Errorf("Invalid weight file %s: %s", path, readErr.Error())
+	}
+	dir := filepath.Dir(path)
+	res := make(map[string]float64, len(weights))
+	for image, weight := range weights {
+		if weightErr := ValidateWeight(weight); weightErr != nil {
+			return nil, fmt.Errorf("Invalid weight file %s: %s", path, weightErr.Error())
+		}
+		if !filepath.IsAbs(image) {
+			image = filepath.Join(dir, image)
+		}
+		res[filepath.Clean(image)] = weight
+	}
+	return res, nil
+}
+
+// ImageWeights returns the weights of the images in the mapper (the weight of
+// the image with id i on position i), see FSMapper.Weights. nil is returned
+// if all images have weight 1.
+func ImageWeights(mapper *FSMapper) []float64 {
+	var res []float64
+	for id, path := range mapper.IDMapping {
+		weight, hasWeight := mapper.Weights[path]
+		if !hasWeight || weight == 1.0 {
+			continue
+		}
+		if res == nil {
+			res = make([]float64, len(mapper.IDMapping))
+			for i := range res {
+				res[i] = 1.0
+			}
+		}
+		res[id] = weight
+	}
+	return res
+}
+
+// OrientedWeights returns the weights for the ids of an OrientedStorage: Each
+// orientation of an image has the weight of the image.
+func OrientedWeights(weights []float64, orientations []Orientation) []float64 {
+	n := len(orientations)
+	res := make([]float64, len(weights)*n)
+	for id := range res {
+		res[id] = weights[id/n]
+	}
+	return res
+}
+
+// WeightedImageMetric is an ImageMetric that multiplies the values of Metric
+// with the weight of the database image, Weights contains the weight of each
+// image. Use NewWeightedImageMetric to create it, the result implements
+// BatchImageMetric if Metric does.
+type WeightedImageMetric struct {
+	Metric  ImageMetric
+	Weights []float64
+}
+
+// weightedBatchImageMetric is a WeightedImageMetric for a BatchImageMetric.
+type weightedBatchImageMetric struct {
+	*WeightedImageMetric
+	batch BatchImageMetric
+}
+
+// NewWeightedImageMetric returns a new weighted metric. If metric implements
+// BatchImageMetric the result does as well.
+func NewWeightedImageMetric(metric ImageMetric, weights []float64) ImageMetric {
+	res := &WeightedImageMetric{Metric: metric, Weights: weights}
+	if batch, isBatch := metric.(BatchImageMetric); isBatch {
+		return weightedBatchImageMetric{WeightedImageMetric: res, batch: batch}
+	}
+	return res
+}
+
+// InitStorage calls InitStorage of the metric, an error is returned if the
+// number of weights doesn't match the number of images.
+func (m *WeightedImageMetric) InitStorage(storage ImageStorage) error {
+	if numImages := storage.NumImages(); int(numImages) != len(m.Weights) {
+		return fmt.Errorf("Number of image weights (%d) doesn't match the number of images (%d)",
+			len(m.Weights), numImages)
+	}
+	return m.Metric.InitStorage(storage)
+}
+
+// InitTiles calls InitTiles of the metric.
+func (m *WeightedImageMetric) InitTiles(storage ImageStorage, query image.Image, dist TileDivision) error {
+	return m.Metric.InitTiles(storage, query, dist)
+}
+
+// Compare returns the value of the metric multiplied with the weight of the
+// image.
+func (m *WeightedImageMetric) Compare(storage ImageStorage, image ImageID, tileY, tileX int) (float64, error) {
+	value, err := m.Metric.Compare(storage, image, tileY, tileX)
+	if err != nil {
+		return value, err
+	}
+	return m.Weights[image] * value, nil
+}
+
+// CompareAll returns the values of the batch metric multiplied with the
+// weights of the images.
+func (m weightedBatchImageMetric) CompareAll(storage ImageStorage, tileY, tileX int) ([]float64, error) {
+	values, err := m.batch.CompareAll(storage, tileY, tileX)
+	if err != nil {
+		return nil, err
+	}
+	for id := range values {
+		values[id] *= m.Weights[id]
+	}
+	return values, nil
+}